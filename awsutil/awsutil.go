@@ -0,0 +1,76 @@
+// Package awsutil provides the options of AWS clients shared by aws-* plugins,
+// such as credentials, regions and the instance metadata.
+package awsutil
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AssumeRole is the options to assume an IAM role, e.g. for monitoring resources in other accounts
+type AssumeRole struct {
+	RoleARN         string
+	ExternalID      string
+	RoleSessionName string
+}
+
+// RegisterFlags registers -role-arn, -external-id and -role-session-name
+func (a *AssumeRole) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&a.RoleARN, "role-arn", "", "ARN of the IAM role to assume")
+	fs.StringVar(&a.ExternalID, "external-id", "", "External ID given when assuming the role")
+	fs.StringVar(&a.RoleSessionName, "role-session-name", "", "Session name of the assumed role")
+}
+
+// Config returns config with the credentials of the role if RoleARN is given.
+// The credentials of config (or the default credential chain) are used to call
+// sts:AssumeRole, and the credentials of the role are refreshed before they expire.
+func (a AssumeRole) Config(sess *session.Session, config *aws.Config) *aws.Config {
+	if a.RoleARN == "" {
+		return config
+	}
+	creds := stscreds.NewCredentials(sess.Copy(config), a.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if a.ExternalID != "" {
+			p.ExternalID = aws.String(a.ExternalID)
+		}
+		if a.RoleSessionName != "" {
+			p.RoleSessionName = a.RoleSessionName
+		}
+	})
+	return config.Copy().WithCredentials(creds)
+}
+
+// authErrorCodes are the codes of errors which fail every request
+var authErrorCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"UnauthorizedOperation":       true,
+	"InvalidClientTokenId":        true,
+	"ExpiredToken":                true,
+	"SignatureDoesNotMatch":       true,
+	"NoCredentialProviders":       true,
+	"UnrecognizedClientException": true,
+}
+
+// IsAuthError reports whether err is caused by the credentials or missing permissions
+func IsAuthError(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return authErrorCodes[aerr.Code()]
+	}
+	return false
+}
+
+// FormatError formats err in one line with the AWS error code, such as AccessDenied
+func FormatError(err error) string {
+	switch aerr := err.(type) {
+	case awserr.RequestFailure:
+		return fmt.Sprintf("%s: %s (status code: %d)", aerr.Code(), aerr.Message(), aerr.StatusCode())
+	case awserr.Error:
+		return fmt.Sprintf("%s: %s", aerr.Code(), aerr.Message())
+	}
+	return err.Error()
+}
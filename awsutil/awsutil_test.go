@@ -0,0 +1,61 @@
+package awsutil
+
+import (
+	"errors"
+	"flag"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	var a AssumeRole
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	a.RegisterFlags(fs)
+	err := fs.Parse([]string{"-role-arn=arn:aws:iam::123456789012:role/monitoring", "-external-id=secret"})
+	if err != nil {
+		t.Fatalf("error should be nil but: %s", err)
+	}
+	if a.RoleARN != "arn:aws:iam::123456789012:role/monitoring" || a.ExternalID != "secret" || a.RoleSessionName != "" {
+		t.Errorf("unexpected options: %+v", a)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	sess, err := session.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := aws.NewConfig().WithRegion("ap-northeast-1")
+
+	if c := (AssumeRole{}).Config(sess, config); c != config {
+		t.Errorf("config should not be changed without RoleARN")
+	}
+	c := AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/monitoring"}.Config(sess, config)
+	if c.Credentials == nil || c.Credentials == config.Credentials {
+		t.Errorf("credentials of the role should be set")
+	}
+	if aws.StringValue(c.Region) != "ap-northeast-1" {
+		t.Errorf("region should be kept but: %s", aws.StringValue(c.Region))
+	}
+}
+
+func TestFormatError(t *testing.T) {
+	var err error = awserr.NewRequestFailure(awserr.New("AccessDenied", "not authorized to perform: cloudwatch:GetMetricStatistics", nil), 403, "request-id")
+	if !IsAuthError(err) {
+		t.Errorf("AccessDenied should be an auth error")
+	}
+	if s := FormatError(err); s != "AccessDenied: not authorized to perform: cloudwatch:GetMetricStatistics (status code: 403)" {
+		t.Errorf("unexpected message: %s", s)
+	}
+
+	err = awserr.New("Throttling", "Rate exceeded", nil)
+	if IsAuthError(err) {
+		t.Errorf("Throttling should not be an auth error")
+	}
+	if s := FormatError(errors.New("error")); s != "error" {
+		t.Errorf("unexpected message: %s", s)
+	}
+}
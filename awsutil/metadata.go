@@ -0,0 +1,161 @@
+package awsutil
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultMetadataEndpoint is the endpoint of the EC2 instance metadata service
+const DefaultMetadataEndpoint = "http://169.254.169.254"
+
+const (
+	metadataTimeout  = 2 * time.Second
+	metadataTokenTTL = "21600"
+)
+
+// Metadata is a client of the EC2 instance metadata service.
+// It requests a session token for IMDSv2, and falls back to IMDSv1 if the token is not available.
+type Metadata struct {
+	Endpoint string
+	Client   *http.Client
+
+	token   string
+	triedV2 bool
+	// tokenErr is why the session token is not available
+	tokenErr error
+}
+
+// NewMetadata returns a client of the instance metadata service.
+// AWS_EC2_METADATA_SERVICE_ENDPOINT overrides the endpoint as AWS SDKs do.
+func NewMetadata() *Metadata {
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = DefaultMetadataEndpoint
+	}
+	return &Metadata{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Client:   &http.Client{Timeout: metadataTimeout},
+	}
+}
+
+var errMetadataDisabled = errors.New("instance metadata service is disabled by AWS_EC2_METADATA_DISABLED")
+
+// fetchToken gets a session token for IMDSv2, or returns "" for IMDSv1
+func (m *Metadata) fetchToken() string {
+	// the token is valid for 6 hours, but plugins don't live such long
+	if m.triedV2 {
+		return m.token
+	}
+	m.triedV2 = true
+
+	req, err := http.NewRequest("PUT", m.Endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		m.tokenErr = err
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		m.tokenErr = fmt.Errorf("the token request is rejected: %s", resp.Status)
+		return ""
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		m.tokenErr = err
+		return ""
+	}
+	m.token = string(b)
+	return m.token
+}
+
+// Get returns the metadata of path, such as "instance-id"
+func (m *Metadata) Get(path string) (string, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return "", errMetadataDisabled
+	}
+
+	req, err := http.NewRequest("GET", m.Endpoint+"/latest/meta-data/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token := m.fetchToken(); token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && m.token == "" {
+		return "", m.tokenRequiredError()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get metadata %s: %s", path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// tokenRequiredError is the error of IMDSv1 rejected by the instance requiring IMDSv2 (HttpTokens=required).
+// In containers, the response of the token request is typically dropped by the hop limit of 1.
+func (m *Metadata) tokenRequiredError() error {
+	return fmt.Errorf("the instance requires IMDSv2, but failed to get a session token: %v. "+
+		"If the plugin runs in a container, increase the hop limit of the instance metadata, "+
+		"e.g. aws ec2 modify-instance-metadata-options --instance-id <instance-id> --http-put-response-hop-limit 2", m.tokenErr)
+}
+
+// Region returns the region of the instance
+func (m *Metadata) Region() (string, error) {
+	if region, err := m.Get("placement/region"); err == nil {
+		return region, nil
+	}
+	// placement/region is not available on some old instances
+	az, err := m.Get("placement/availability-zone")
+	if err != nil {
+		return "", err
+	}
+	if len(az) < 2 {
+		return "", fmt.Errorf("unexpected availability zone: %q", az)
+	}
+	return az[:len(az)-1], nil
+}
+
+// InstanceID returns the ID of the instance
+func (m *Metadata) InstanceID() (string, error) {
+	return m.Get("instance-id")
+}
+
+// InstanceType returns the type of the instance, such as t3.micro
+func (m *Metadata) InstanceType() (string, error) {
+	return m.Get("instance-type")
+}
+
+// BlockDeviceMapping returns the devices of the block device mapping of the instance by the virtual names,
+// such as "root" and "ebs1"
+func (m *Metadata) BlockDeviceMapping() (map[string]string, error) {
+	names, err := m.Get("block-device-mapping/")
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, name := range strings.Fields(names) {
+		device, err := m.Get("block-device-mapping/" + name)
+		if err != nil {
+			return nil, err
+		}
+		devices[name] = device
+	}
+	return devices, nil
+}
@@ -0,0 +1,132 @@
+package awsutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeMetadata starts a fake instance metadata service.
+// It requires a session token like IMDSv2 if v2 is true.
+func newFakeMetadata(t *testing.T, v2 bool, data map[string]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if !v2 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte("token"))
+			return
+		}
+		if v2 && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		v, ok := data[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+}
+
+func TestMetadata(t *testing.T) {
+	for _, v2 := range []bool{true, false} {
+		ts := newFakeMetadata(t, v2, map[string]string{
+			"/latest/meta-data/instance-id":      "i-1234567890abcdef0",
+			"/latest/meta-data/instance-type":    "t3.micro",
+			"/latest/meta-data/placement/region": "ap-northeast-1",
+		})
+		md := NewMetadata()
+		md.Endpoint = ts.URL
+
+		if id, err := md.InstanceID(); err != nil || id != "i-1234567890abcdef0" {
+			t.Errorf("v2=%t: unexpected instance ID: %q, %v", v2, id, err)
+		}
+		if typ, err := md.InstanceType(); err != nil || typ != "t3.micro" {
+			t.Errorf("v2=%t: unexpected instance type: %q, %v", v2, typ, err)
+		}
+		if region, err := md.Region(); err != nil || region != "ap-northeast-1" {
+			t.Errorf("v2=%t: unexpected region: %q, %v", v2, region, err)
+		}
+		if _, err := md.Get("not-found"); err == nil {
+			t.Errorf("v2=%t: error should be returned for missing metadata", v2)
+		}
+		ts.Close()
+	}
+}
+
+func TestMetadataRegionFromAvailabilityZone(t *testing.T) {
+	ts := newFakeMetadata(t, true, map[string]string{
+		"/latest/meta-data/placement/availability-zone": "us-west-2a",
+	})
+	defer ts.Close()
+	md := NewMetadata()
+	md.Endpoint = ts.URL
+
+	if region, err := md.Region(); err != nil || region != "us-west-2" {
+		t.Errorf("unexpected region: %q, %v", region, err)
+	}
+}
+
+func TestMetadataDisabled(t *testing.T) {
+	os.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	defer os.Unsetenv("AWS_EC2_METADATA_DISABLED")
+
+	md := NewMetadata()
+	md.Endpoint = "http://127.0.0.1:0"
+	if _, err := md.InstanceID(); err != errMetadataDisabled {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMetadataTokenRequired(t *testing.T) {
+	// the response of the token request is dropped by the hop limit like in containers
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			time.Sleep(500 * time.Millisecond)
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	md := NewMetadata()
+	md.Endpoint = ts.URL
+	md.Client.Timeout = 100 * time.Millisecond
+
+	_, err := md.InstanceID()
+	if err == nil || !strings.Contains(err.Error(), "--http-put-response-hop-limit") {
+		t.Errorf("the error should suggest the hop limit, but %v", err)
+	}
+}
+
+func TestMetadataBlockDeviceMapping(t *testing.T) {
+	ts := newFakeMetadata(t, true, map[string]string{
+		"/latest/meta-data/block-device-mapping/":     "ami\nebs1\nroot",
+		"/latest/meta-data/block-device-mapping/ami":  "/dev/xvda",
+		"/latest/meta-data/block-device-mapping/ebs1": "sdf",
+		"/latest/meta-data/block-device-mapping/root": "/dev/xvda",
+	})
+	defer ts.Close()
+	md := NewMetadata()
+	md.Endpoint = ts.URL
+
+	devices, err := md.BlockDeviceMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 3 || devices["ebs1"] != "sdf" || devices["root"] != "/dev/xvda" {
+		t.Errorf("unexpected block device mapping: %v", devices)
+	}
+}
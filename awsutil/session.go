@@ -0,0 +1,78 @@
+package awsutil
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Options are the options of AWS clients shared by aws-* plugins
+type Options struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	AssumeRole      AssumeRole
+	// Endpoint overrides the endpoint of the services, e.g. for LocalStack or VPC endpoints.
+	// AWS_ENDPOINT_URL is used if empty.
+	Endpoint string
+
+	// Metadata is used to resolve the region on EC2 instances. NewMetadata() is used if nil.
+	Metadata *Metadata
+}
+
+// ResolveRegion returns the region given by Region, AWS_REGION (or AWS_DEFAULT_REGION),
+// or the instance metadata in this order. It returns "" if none of them is available.
+func (o Options) ResolveRegion() string {
+	if o.Region != "" {
+		return o.Region
+	}
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(env); region != "" {
+			return region
+		}
+	}
+	md := o.Metadata
+	if md == nil {
+		md = NewMetadata()
+	}
+	region, _ := md.Region()
+	return region
+}
+
+// ResolveEndpoint returns the endpoint given by Endpoint or AWS_ENDPOINT_URL
+func (o Options) ResolveEndpoint() string {
+	if o.Endpoint != "" {
+		return o.Endpoint
+	}
+	return os.Getenv("AWS_ENDPOINT_URL")
+}
+
+// NewSession returns a session and a config to create service clients.
+// The credentials are the static keys if both AccessKeyID and SecretAccessKey are given,
+// or the default credential chain otherwise, and the role is assumed with them if RoleARN is given.
+// If the endpoint is resolved, all clients created with the config send requests to it.
+func (o Options) NewSession() (*session.Session, *aws.Config, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := aws.NewConfig()
+	if o.AccessKeyID != "" && o.SecretAccessKey != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(o.AccessKeyID, o.SecretAccessKey, ""))
+	}
+	if region := o.ResolveRegion(); region != "" {
+		config = config.WithRegion(region)
+	}
+	config = o.AssumeRole.Config(sess, config)
+
+	// the role is assumed with the default STS endpoint, since custom endpoints are usually for the monitored services
+	if endpoint := o.ResolveEndpoint(); endpoint != "" {
+		// path-style addressing, which LocalStack requires for S3
+		config = config.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	return sess, config, nil
+}
@@ -0,0 +1,126 @@
+package awsutil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestResolveRegion(t *testing.T) {
+	ts := newFakeMetadata(t, true, map[string]string{
+		"/latest/meta-data/placement/region": "us-west-2",
+	})
+	defer ts.Close()
+	md := NewMetadata()
+	md.Endpoint = ts.URL
+
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	o := Options{Metadata: md}
+	if r := o.ResolveRegion(); r != "us-west-2" {
+		t.Errorf("region should be got from metadata but: %s", r)
+	}
+
+	os.Setenv("AWS_DEFAULT_REGION", "eu-west-1")
+	if r := o.ResolveRegion(); r != "eu-west-1" {
+		t.Errorf("region should be got from AWS_DEFAULT_REGION but: %s", r)
+	}
+
+	os.Setenv("AWS_REGION", "ap-southeast-1")
+	if r := o.ResolveRegion(); r != "ap-southeast-1" {
+		t.Errorf("region should be got from AWS_REGION but: %s", r)
+	}
+
+	o.Region = "ap-northeast-1"
+	if r := o.ResolveRegion(); r != "ap-northeast-1" {
+		t.Errorf("region should be got from the option but: %s", r)
+	}
+}
+
+func TestNewSession(t *testing.T) {
+	_, config, err := Options{Region: "ap-northeast-1", AccessKeyID: "id", SecretAccessKey: "secret"}.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(config.Region) != "ap-northeast-1" {
+		t.Errorf("unexpected region: %s", aws.StringValue(config.Region))
+	}
+	v, err := config.Credentials.Get()
+	if err != nil || v.AccessKeyID != "id" || v.SecretAccessKey != "secret" {
+		t.Errorf("static credentials should be used but: %+v, %v", v, err)
+	}
+
+	_, config, err = Options{Region: "ap-northeast-1", AccessKeyID: "id"}.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Credentials != nil {
+		t.Errorf("default credential chain should be used without the secret access key")
+	}
+
+	_, config, err = Options{
+		Region:     "ap-northeast-1",
+		AssumeRole: AssumeRole{RoleARN: "arn:aws:iam::123456789012:role/monitoring"},
+	}.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Credentials == nil {
+		t.Errorf("credentials of the role should be set")
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	defer os.Setenv("AWS_ENDPOINT_URL", os.Getenv("AWS_ENDPOINT_URL"))
+	os.Unsetenv("AWS_ENDPOINT_URL")
+
+	if e := (Options{}).ResolveEndpoint(); e != "" {
+		t.Errorf("endpoint should be empty but: %s", e)
+	}
+	os.Setenv("AWS_ENDPOINT_URL", "http://localhost:4566")
+	if e := (Options{}).ResolveEndpoint(); e != "http://localhost:4566" {
+		t.Errorf("endpoint should be got from AWS_ENDPOINT_URL but: %s", e)
+	}
+	if e := (Options{Endpoint: "https://vpce.example.com"}).ResolveEndpoint(); e != "https://vpce.example.com" {
+		t.Errorf("endpoint should be got from the option but: %s", e)
+	}
+}
+
+func TestNewSessionWithEndpoint(t *testing.T) {
+	var requested bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<ListMetricsResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/">
+  <ListMetricsResult><Metrics/></ListMetricsResult>
+  <ResponseMetadata><RequestId>request-id</RequestId></ResponseMetadata>
+</ListMetricsResponse>`))
+	}))
+	defer ts.Close()
+
+	sess, config, err := Options{
+		Region:          "ap-northeast-1",
+		AccessKeyID:     "id",
+		SecretAccessKey: "secret",
+		Endpoint:        ts.URL,
+	}.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aws.BoolValue(config.S3ForcePathStyle) {
+		t.Errorf("path-style addressing should be enabled with the endpoint")
+	}
+	if _, err := cloudwatch.New(sess, config).ListMetrics(&cloudwatch.ListMetricsInput{}); err != nil {
+		t.Fatalf("request to the endpoint should succeed but: %s", err)
+	}
+	if !requested {
+		t.Errorf("request should be sent to the endpoint")
+	}
+}
@@ -0,0 +1,29 @@
+// Package envutil provides the flags of the plugins given by the environment variables,
+// such as the passwords which should not appear in mackerel-agent.conf or the process list.
+package envutil
+
+import (
+	"flag"
+	"os"
+)
+
+// SetFromEnv sets the flag from the first non-empty variable of envs after fs is parsed.
+// A non-empty flag given on the command line beats the environment variables,
+// which beat the default of the flag.
+func SetFromEnv(fs *flag.FlagSet, name string, envs ...string) error {
+	given := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name && f.Value.String() != "" {
+			given = true
+		}
+	})
+	if given {
+		return nil
+	}
+	for _, env := range envs {
+		if v := os.Getenv(env); v != "" {
+			return fs.Set(name, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package envutil
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestSetFromEnv(t *testing.T) {
+	const env = "MACKEREL_PLUGIN_ENVUTIL_TEST_PASSWORD"
+	const legacyEnv = "MACKEREL_PLUGIN_ENVUTIL_TEST_LEGACY_PASSWORD"
+	defer os.Unsetenv(env)
+	defer os.Unsetenv(legacyEnv)
+
+	for _, tt := range []struct {
+		name      string
+		args      []string
+		def       string
+		env       string
+		legacyEnv string
+		expected  string
+	}{
+		{"flag beats env", []string{"-password=flag"}, "", "env", "", "flag"},
+		{"env beats default", nil, "default", "env", "", "env"},
+		{"empty flag is not given", []string{"-password="}, "", "env", "", "env"},
+		{"empty env keeps default", nil, "default", "", "", "default"},
+		{"empty env keeps empty", nil, "", "", "", ""},
+		{"first env beats the others", nil, "", "env", "legacy", "env"},
+		{"falls back to the others", nil, "", "", "legacy", "legacy"},
+	} {
+		os.Setenv(env, tt.env)
+		os.Setenv(legacyEnv, tt.legacyEnv)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		password := fs.String("password", tt.def, "Password")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetFromEnv(fs, "password", env, legacyEnv); err != nil {
+			t.Errorf("%s: error should be nil but: %s", tt.name, err)
+		}
+		if *password != tt.expected {
+			t.Errorf("%s: password should be %q: %q", tt.name, tt.expected, *password)
+		}
+	}
+}
+
+func TestSetFromEnvUnknownFlag(t *testing.T) {
+	const env = "MACKEREL_PLUGIN_ENVUTIL_TEST_PASSWORD"
+	os.Setenv(env, "env")
+	defer os.Unsetenv(env)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := SetFromEnv(fs, "password", env); err == nil {
+		t.Errorf("error should be returned for the unknown flag")
+	}
+}
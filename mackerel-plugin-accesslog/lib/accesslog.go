@@ -14,7 +14,6 @@ import (
 	"time"
 
 	"github.com/Songmu/axslogparser"
-	"github.com/Songmu/postailer"
 	mp "github.com/mackerelio/go-mackerel-plugin"
 	"github.com/mackerelio/golib/pluginutil"
 	"github.com/montanaflynn/stats"
@@ -27,6 +26,25 @@ type AccesslogPlugin struct {
 	posFile   string
 	parser    axslogparser.Parser
 	noPosFile bool
+	catchup   *catchupOptions
+
+	trackStatus []int
+	pathGroups  []pathGroup
+	// percentiles are those of the latency_ms graph, defaultPercentiles if empty
+	percentiles []float64
+}
+
+func (p *AccesslogPlugin) latencyPercentiles() []float64 {
+	if len(p.percentiles) == 0 {
+		return defaultPercentiles
+	}
+	return p.percentiles
+}
+
+// parseErrorCounter is implemented by the parsers which count unparsable lines or values
+type parseErrorCounter interface {
+	resetParseErrors()
+	parseErrorCount() int
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -40,7 +58,7 @@ func (p *AccesslogPlugin) MetricKeyPrefix() string {
 // GraphDefinition interface for mackerelplugin
 func (p *AccesslogPlugin) GraphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(p.prefix)
-	return map[string]mp.Graphs{
+	graphs := map[string]mp.Graphs{
 		"access_num": {
 			Label: labelPrefix + " Access Num",
 			Unit:  "integer",
@@ -73,6 +91,48 @@ func (p *AccesslogPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+	var latencyMetrics []mp.Metrics
+	percentiles := p.latencyPercentiles()
+	// from the highest, as the graph has been
+	for i := len(percentiles) - 1; i >= 0; i-- {
+		latencyMetrics = append(latencyMetrics, mp.Metrics{Name: percentileKey(percentiles[i]), Label: formatPercentile(percentiles[i]) + " Percentile"})
+	}
+	graphs["latency_ms"] = mp.Graphs{
+		Label:   labelPrefix + " Latency Percentiles (ms)",
+		Unit:    "float",
+		Metrics: latencyMetrics,
+	}
+	if len(p.trackStatus) > 0 {
+		var metrics []mp.Metrics
+		for _, code := range p.trackStatus {
+			metrics = append(metrics, mp.Metrics{Name: statusCountKey(code), Label: fmt.Sprintf("HTTP %d Count", code)})
+		}
+		graphs["access_status"] = mp.Graphs{
+			Label:   labelPrefix + " Access Num by Status",
+			Unit:    "integer",
+			Metrics: metrics,
+		}
+	}
+	if _, ok := p.parser.(parseErrorCounter); ok {
+		graphs["parse_errors"] = mp.Graphs{
+			Label: labelPrefix + " Parse Errors",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "parse_errors", Label: "Parse Errors"},
+			},
+		}
+	}
+	if len(p.pathGroups) > 0 {
+		graphs["path_group.#"] = mp.Graphs{
+			Label: labelPrefix + " Access Num by Path Group",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "total_count", Label: "Total Count"},
+				{Name: "5xx_count", Label: "HTTP 5xx Count"},
+			},
+		}
+	}
+	return graphs
 }
 
 var posRe = regexp.MustCompile(`^([a-zA-Z]):[/\\]`)
@@ -101,8 +161,11 @@ func (p *AccesslogPlugin) getReadCloser() (io.ReadCloser, bool, error) {
 	fi, err := os.Stat(posfile)
 	// don't output count metrics when the pos file doesn't exist or is too old
 	takeCount := err == nil && fi.ModTime().After(time.Now().Add(-2*time.Minute))
-	rc, err := postailer.Open(p.file, posfile)
-	return rc, takeCount, err
+	t, err := openTail(p.file, posfile, p.catchup)
+	if err != nil {
+		return nil, false, err
+	}
+	return t, takeCount, nil
 }
 
 // FetchMetrics interface for mackerelplugin
@@ -114,11 +177,25 @@ func (p *AccesslogPlugin) FetchMetrics() (map[string]float64, error) {
 	defer rc.Close()
 
 	countMetrics := []string{"total_count", "2xx_count", "3xx_count", "4xx_count", "5xx_count"}
+	for _, code := range p.trackStatus {
+		countMetrics = append(countMetrics, statusCountKey(code))
+	}
+	if len(p.pathGroups) > 0 {
+		for _, g := range p.pathGroups {
+			countMetrics = append(countMetrics, pathGroupKey(g.name, "total_count"), pathGroupKey(g.name, "5xx_count"))
+		}
+		countMetrics = append(countMetrics, pathGroupKey(otherPathGroup, "total_count"), pathGroupKey(otherPathGroup, "5xx_count"))
+	}
 	ret := make(map[string]float64)
 	for _, k := range countMetrics {
 		ret[k] = 0
 	}
-	var reqtimes []float64
+	ec, countErrors := p.parser.(parseErrorCounter)
+	if countErrors {
+		ec.resetParseErrors()
+		countMetrics = append(countMetrics, "parse_errors")
+	}
+	reqtimes := newReqtimeSampler(maxReqtimeSamples)
 	r := bufio.NewReader(rc)
 	for {
 		var (
@@ -153,22 +230,45 @@ func (p *AccesslogPlugin) FetchMetrics() (map[string]float64, error) {
 		}
 		ret[string(fmt.Sprintf("%d", l.Status)[0])+"xx_count"]++
 		ret["total_count"]++
+		if len(p.trackStatus) > 0 {
+			// only the tracked codes are initialized in ret
+			k := statusCountKey(l.Status)
+			if _, ok := ret[k]; ok {
+				ret[k]++
+			}
+		}
+		if len(p.pathGroups) > 0 {
+			g := matchPathGroup(p.pathGroups, l.RequestURI)
+			ret[pathGroupKey(g, "total_count")]++
+			if l.Status >= 500 && l.Status < 600 {
+				ret[pathGroupKey(g, "5xx_count")]++
+			}
+		}
 
+		// lines without the request time are counted above but excluded from latency
 		if l.ReqTime != nil {
-			reqtimes = append(reqtimes, *l.ReqTime)
+			reqtimes.add(*l.ReqTime)
 		} else if l.TakenSec != nil {
-			reqtimes = append(reqtimes, *l.TakenSec)
+			reqtimes.add(*l.TakenSec)
 		}
 	}
+	if countErrors {
+		ret["parse_errors"] = float64(ec.parseErrorCount())
+	}
 	if ret["total_count"] > 0 {
 		for _, v := range []string{"2xx", "3xx", "4xx", "5xx"} {
 			ret[v+"_percentage"] = ret[v+"_count"] * 100 / ret["total_count"]
 		}
 	}
-	if len(reqtimes) > 0 {
-		ret["average"], _ = stats.Mean(reqtimes)
+	if reqtimes.count > 0 {
+		ret["average"] = reqtimes.mean()
 		for _, v := range []int{90, 95, 99} {
-			ret[fmt.Sprintf("%d", v)+"_percentile"], _ = stats.Percentile(reqtimes, float64(v))
+			ret[fmt.Sprintf("%d", v)+"_percentile"], _ = stats.Percentile(reqtimes.samples, float64(v))
+		}
+		for _, v := range p.latencyPercentiles() {
+			if pt, err := stats.Percentile(reqtimes.samples, v); err == nil {
+				ret[percentileKey(v)] = pt * 1000
+			}
 		}
 	}
 	if !takeCount {
@@ -179,14 +279,48 @@ func (p *AccesslogPlugin) FetchMetrics() (map[string]float64, error) {
 	return ret, nil
 }
 
+func stringOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringSlice) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
 // Do the plugin
 func Do() {
 	var (
 		optPrefix    = flag.String("metric-key-prefix", "", "Metric key prefix")
-		optFormat    = flag.String("format", "", "Access Log format ('ltsv' or 'apache')")
+		optFormat    = flag.String("format", "", "Access Log format ('ltsv', 'apache' or 'json')")
 		optPosFile   = flag.String("posfile", "", "(not necessary to specify it in the usual use case) posfile")
 		optNoPosFile = flag.Bool("no-posfile", false, "no position file")
+		optStatus    = flag.String("track-status", "", "Comma separated status codes counted individually (e.g. 499,502,503,504)")
+		optGroups    stringSlice
+
+		optReadRotated = flag.Bool("read-rotated", false, "Read the rest of the log from the latest rotated file (plain or gzipped) after rotation")
+		optRotatedGlob = flag.String("rotated-glob", "", "Glob of rotated files for -read-rotated (default /path/to/access.log.* and /path/to/access.log-*)")
+		optMaxCatchup  = flag.Int64("max-catchup-bytes", defaultMaxCatchupBytes, "Max bytes read from the rotated file after rotation")
+
+		optStatusLabel  = flag.String("ltsv-status-label", "", "LTSV label of the status (default status)")
+		optReqtimeLabel = flag.String("ltsv-reqtime-label", "", "LTSV label of the request time in seconds (default reqtime)")
+		optSizeLabel    = flag.String("ltsv-size-label", "", "LTSV label of the response size (default size)")
+		optStatusKey    = flag.String("status-key", "", "JSON key of the status, which may be a dotted path (default status)")
+		optReqtimeKey   = flag.String("reqtime-key", "", "JSON key of the request time in seconds (default reqtime)")
+		optSizeKey      = flag.String("size-key", "", "JSON key of the response size (default size)")
+		optPercentiles  = flag.String("percentiles", "", "Comma separated percentiles of the latency in milliseconds (default 50,90,95,99)")
+		optAggregate    = flag.String("reqtime-aggregate", "", "How multiple values of the request time are aggregated ('sum', 'max' or 'last', default sum)")
 	)
+	flag.Var(&optGroups, "path-group", "Path group in the form of name=regex (can be specified multiple times)")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION] /path/to/access.log\n", os.Args[0])
 		flag.PrintDefaults()
@@ -205,17 +339,83 @@ func Do() {
 		parser = &axslogparser.LTSV{}
 	case "apache":
 		parser = &axslogparser.Apache{}
+	case "json":
 	default:
 		fmt.Fprintf(os.Stderr, "Error: '%s' is invalid format name\n", *optFormat)
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *optFormat != "json" && (*optStatusKey != "" || *optReqtimeKey != "" || *optSizeKey != "") {
+		fmt.Fprintln(os.Stderr, "Error: JSON options can be specified only with json format")
+		os.Exit(1)
+	}
+	if *optFormat == "json" {
+		if *optStatusLabel != "" || *optReqtimeLabel != "" || *optSizeLabel != "" {
+			fmt.Fprintln(os.Stderr, "Error: LTSV options can not be specified with json format")
+			os.Exit(1)
+		}
+		jp, err := newJSONParser(
+			stringOr(*optStatusKey, "status"),
+			stringOr(*optReqtimeKey, "reqtime"),
+			stringOr(*optSizeKey, "size"),
+			stringOr(*optAggregate, "sum"),
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		parser = jp
+	} else if *optStatusLabel != "" || *optReqtimeLabel != "" || *optSizeLabel != "" || *optAggregate != "" {
+		if *optFormat == "apache" {
+			fmt.Fprintln(os.Stderr, "Error: LTSV options can not be specified with apache format")
+			os.Exit(1)
+		}
+		lp, err := newLTSVParser(
+			stringOr(*optStatusLabel, "status"),
+			stringOr(*optReqtimeLabel, "reqtime"),
+			stringOr(*optSizeLabel, "size"),
+			stringOr(*optAggregate, "sum"),
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		parser = lp
+	}
+
+	trackStatus, err := parseTrackStatus(*optStatus)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	percentiles, err := parsePercentiles(*optPercentiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	var pathGroups []pathGroup
+	for _, v := range optGroups {
+		g, err := parsePathGroup(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		pathGroups = append(pathGroups, g)
+	}
 
 	mp.NewMackerelPlugin(&AccesslogPlugin{
 		prefix:    *optPrefix,
 		file:      flag.Args()[0],
 		posFile:   *optPosFile,
 		noPosFile: *optNoPosFile,
-		parser:    parser,
+		catchup: &catchupOptions{
+			readRotated: *optReadRotated,
+			glob:        *optRotatedGlob,
+			maxBytes:    *optMaxCatchup,
+		},
+		parser:      parser,
+		trackStatus: trackStatus,
+		pathGroups:  pathGroups,
+		percentiles: percentiles,
 	}).Run()
 }
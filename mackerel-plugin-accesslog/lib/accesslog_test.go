@@ -44,6 +44,10 @@ var fetchMetricsTests = []struct {
 			"90_percentile":  2.018,
 			"95_percentile":  3.018,
 			"99_percentile":  3.018,
+			"p50_ms":         38,
+			"p90_ms":         2017.9999999999998,
+			"p95_ms":         3018,
+			"p99_ms":         3018,
 		},
 	},
 	{
@@ -63,6 +67,10 @@ var fetchMetricsTests = []struct {
 			"90_percentile":  0.015,
 			"95_percentile":  0.015,
 			"99_percentile":  0.015,
+			"p50_ms":         10,
+			"p90_ms":         15,
+			"p95_ms":         15,
+			"p99_ms":         15,
 		},
 	},
 }
@@ -112,6 +120,10 @@ func TestFetchMetricsWithCustomParser(t *testing.T) {
 		"90_percentile":  2.018,
 		"95_percentile":  3.018,
 		"99_percentile":  3.018,
+		"p50_ms":         38,
+		"p90_ms":         2017.9999999999998,
+		"p95_ms":         3018,
+		"p99_ms":         3018,
 	}
 	if !reflect.DeepEqual(out, expected) {
 		t.Errorf("out:  %#v\n want: %#v", out, expected)
@@ -140,3 +152,214 @@ func TestFetchMetricsWithCustomParser(t *testing.T) {
 		t.Errorf("out:  %#v\n want: %#v", out, expected)
 	}
 }
+
+func TestReqtimeSampler(t *testing.T) {
+	s := newReqtimeSampler(100)
+	for i := 1; i <= 1000; i++ {
+		s.add(float64(i))
+	}
+	if s.count != 1000 {
+		t.Errorf("count should be 1000 but: %d", s.count)
+	}
+	if len(s.samples) != 100 {
+		t.Errorf("samples should be capped to 100 but: %d", len(s.samples))
+	}
+	if s.mean() != 500.5 {
+		t.Errorf("mean should be of all the values but: %f", s.mean())
+	}
+}
+
+func TestFetchMetricsWithBreakdown(t *testing.T) {
+	g, err := parsePathGroup(`errors=^/(404|500)$`)
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	p := &AccesslogPlugin{
+		file:        "testdata/sample-ltsv.tsv",
+		noPosFile:   true,
+		trackStatus: []int{404, 503},
+		pathGroups:  []pathGroup{g},
+	}
+	out, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+
+	expected := map[string]float64{
+		"status_404_count":              1,
+		"status_503_count":              0,
+		"path_group.errors.total_count": 2,
+		"path_group.errors.5xx_count":   1,
+		"path_group.other.total_count":  8,
+		"path_group.other.5xx_count":    0,
+	}
+	for k, v := range expected {
+		if out[k] != v {
+			t.Errorf("%s: out: %v want: %v", k, out[k], v)
+		}
+	}
+	if _, ok := p.GraphDefinition()["path_group.#"]; !ok {
+		t.Errorf("graph of path groups should be defined")
+	}
+}
+
+func TestParsePathGroup(t *testing.T) {
+	g, err := parsePathGroup("api=^/api/")
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	if name := matchPathGroup([]pathGroup{g}, "/api/users?id=1"); name != "api" {
+		t.Errorf("should match api but: %s", name)
+	}
+	if name := matchPathGroup([]pathGroup{g}, "/?q=/api/"); name != "other" {
+		t.Errorf("should match other but: %s", name)
+	}
+
+	for _, s := range []string{"api", "api=(", "other=^/", "a.b=^/"} {
+		if _, err := parsePathGroup(s); err == nil {
+			t.Errorf("%s: error should be returned", s)
+		}
+	}
+}
+
+func TestParseTrackStatus(t *testing.T) {
+	codes, err := parseTrackStatus("499, 502,503,504")
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	if !reflect.DeepEqual(codes, []int{499, 502, 503, 504}) {
+		t.Errorf("out: %v", codes)
+	}
+	if _, err := parseTrackStatus("5xx"); err == nil {
+		t.Errorf("error should be returned")
+	}
+}
+
+func TestFetchMetricsWithLTSVLabels(t *testing.T) {
+	for _, tt := range []struct {
+		aggregate string
+		average   float64
+	}{
+		{"sum", (0.004 + 0.120 + 0.010 + 0.030) / 2},
+		{"max", (0.120 + 0.030) / 2},
+		{"last", (0.120 + 0.030) / 2},
+	} {
+		parser, err := newLTSVParser("code", "upstream_response_time", "bytes", tt.aggregate)
+		if err != nil {
+			t.Fatalf("error should be nil but: %+v", err)
+		}
+		p := &AccesslogPlugin{
+			file:      "testdata/sample-ltsv-custom.tsv",
+			noPosFile: true,
+			parser:    parser,
+		}
+		out, err := p.FetchMetrics()
+		if err != nil {
+			t.Fatalf("error should be nil but: %+v", err)
+		}
+		// the line with the unparsable value is counted but excluded from latency
+		if out["total_count"] != 4 || out["2xx_count"] != 3 || out["5xx_count"] != 1 {
+			t.Errorf("%s: unexpected counts: %#v", tt.aggregate, out)
+		}
+		if out["parse_errors"] != 1 {
+			t.Errorf("%s: parse_errors should be 1 but: %v", tt.aggregate, out["parse_errors"])
+		}
+		if d := out["average"] - tt.average; d > 1e-9 || d < -1e-9 {
+			t.Errorf("%s: average should be %v but: %v", tt.aggregate, tt.average, out["average"])
+		}
+	}
+
+	if _, err := newLTSVParser("status", "reqtime", "size", "avg"); err == nil {
+		t.Errorf("error should be returned for invalid aggregate")
+	}
+}
+
+func TestFetchMetricsWithJSON(t *testing.T) {
+	parser, err := newJSONParser("response.status", "request_time", "response.bytes", "sum")
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	g, err := parsePathGroup(`api=^/api/`)
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	p := &AccesslogPlugin{
+		file:       "testdata/sample-json.log",
+		noPosFile:  true,
+		parser:     parser,
+		pathGroups: []pathGroup{g},
+	}
+	out, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	// the truncated line and the line without the status are counted as parse errors
+	if out["total_count"] != 4 || out["2xx_count"] != 2 || out["3xx_count"] != 1 || out["5xx_count"] != 1 {
+		t.Errorf("unexpected counts: %#v", out)
+	}
+	if out["parse_errors"] != 2 {
+		t.Errorf("parse_errors should be 2 but: %v", out["parse_errors"])
+	}
+	if out[pathGroupKey("api", "total_count")] != 3 || out[pathGroupKey("api", "5xx_count")] != 1 {
+		t.Errorf("unexpected counts of the path group: %#v", out)
+	}
+	average := (0.010 + 0.030 + 0.004 + 0.120) / 3
+	if d := out["average"] - average; d > 1e-9 || d < -1e-9 {
+		t.Errorf("average should be %v but: %v", average, out["average"])
+	}
+	if _, ok := p.GraphDefinition()["parse_errors"]; !ok {
+		t.Errorf("parse_errors graph should be defined")
+	}
+}
+
+func TestLookupJSON(t *testing.T) {
+	obj := map[string]interface{}{
+		"response":     map[string]interface{}{"status": 200.0},
+		"upstream.rtt": "0.1",
+	}
+	if v, ok := lookupJSON(obj, "response.status"); !ok || v != 200.0 {
+		t.Errorf("response.status should be 200 but: %v", v)
+	}
+	if v, ok := lookupJSON(obj, "upstream.rtt"); !ok || v != "0.1" {
+		t.Errorf("upstream.rtt should be 0.1 but: %v", v)
+	}
+	if _, ok := lookupJSON(obj, "response.status.code"); ok {
+		t.Errorf("response.status.code should not be found")
+	}
+}
+
+func TestFetchMetricsWithPercentiles(t *testing.T) {
+	percentiles, err := parsePercentiles("50, 99.9")
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	p := &AccesslogPlugin{
+		file:        "testdata/sample-ltsv.tsv",
+		noPosFile:   true,
+		percentiles: percentiles,
+	}
+	out, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	if _, ok := out["p50_ms"]; !ok {
+		t.Errorf("p50_ms should be posted: %#v", out)
+	}
+	if _, ok := out["p99_9_ms"]; !ok {
+		t.Errorf("p99_9_ms should be posted: %#v", out)
+	}
+	if _, ok := out["p95_ms"]; ok {
+		t.Errorf("p95_ms should not be posted: %#v", out)
+	}
+
+	metrics := p.GraphDefinition()["latency_ms"].Metrics
+	if len(metrics) != 2 || metrics[0].Name != "p99_9_ms" || metrics[0].Label != "99.9 Percentile" {
+		t.Errorf("unexpected metrics of latency_ms: %#v", metrics)
+	}
+
+	for _, s := range []string{"0", "101", "p99"} {
+		if _, err := parsePercentiles(s); err == nil {
+			t.Errorf("error should be returned for %s", s)
+		}
+	}
+}
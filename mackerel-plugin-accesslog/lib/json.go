@@ -0,0 +1,140 @@
+package mpaccesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Songmu/axslogparser"
+)
+
+// jsonParser parses JSON logs of one object per line, like the logs of nginx
+// with escape=json or of envoy. The keys may be dotted paths to nested fields.
+type jsonParser struct {
+	statusKey  string
+	reqtimeKey string
+	sizeKey    string
+	aggregate  string
+
+	// parseErrors is the number of unparsable lines or values
+	parseErrors int
+}
+
+// the keys of the request URI and the request line, tried in order
+var (
+	jsonURIKeys     = []string{"uri", "request_uri", "path"}
+	jsonRequestKeys = []string{"req", "request"}
+)
+
+func newJSONParser(statusKey, reqtimeKey, sizeKey, aggregate string) (*jsonParser, error) {
+	if !reqtimeAggregates[aggregate] {
+		return nil, fmt.Errorf("'%s' is invalid aggregate of the request time", aggregate)
+	}
+	return &jsonParser{
+		statusKey:  statusKey,
+		reqtimeKey: reqtimeKey,
+		sizeKey:    sizeKey,
+		aggregate:  aggregate,
+	}, nil
+}
+
+// lookupJSON returns the value of the key, which is a dotted path like
+// response.status unless the object has the key as is
+func lookupJSON(obj map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := obj[key]; ok {
+		return v, true
+	}
+	var v interface{} = obj
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func jsonString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	}
+	return ""
+}
+
+// Parse parses a line of JSON log
+func (p *jsonParser) Parse(line string) (*axslogparser.Log, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		p.parseErrors++
+		return nil, fmt.Errorf("invalid JSON log: %s", err)
+	}
+
+	l := &axslogparser.Log{}
+	v, ok := lookupJSON(obj, p.statusKey)
+	if !ok {
+		p.parseErrors++
+		return nil, fmt.Errorf("no status in the key %s: %s", p.statusKey, line)
+	}
+	status, err := strconv.Atoi(jsonString(v))
+	if err != nil {
+		p.parseErrors++
+		return nil, fmt.Errorf("invalid status: %v", v)
+	}
+	l.Status = status
+
+	if v, ok := lookupJSON(obj, p.reqtimeKey); ok && v != nil {
+		reqtime, ok, err := parseReqtime(jsonString(v), p.aggregate)
+		if err != nil {
+			p.parseErrors++
+		} else if ok {
+			l.ReqTime = &reqtime
+		}
+	}
+	if v, ok := lookupJSON(obj, p.sizeKey); ok && v != nil {
+		if s := jsonString(v); s != "" && s != "-" {
+			size, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				p.parseErrors++
+			} else {
+				l.Size = size
+			}
+		}
+	}
+	if v, ok := lookupJSON(obj, "method"); ok {
+		l.Method = jsonString(v)
+	}
+	for _, k := range jsonURIKeys {
+		if v, ok := lookupJSON(obj, k); ok {
+			l.RequestURI = jsonString(v)
+			break
+		}
+	}
+	for _, k := range jsonRequestKeys {
+		if v, ok := lookupJSON(obj, k); ok {
+			l.Request = jsonString(v)
+			break
+		}
+	}
+	if l.RequestURI == "" {
+		// request is like "GET /path HTTP/1.1"
+		if f := strings.Fields(l.Request); len(f) >= 2 {
+			l.RequestURI = f[1]
+		}
+	}
+	return l, nil
+}
+
+func (p *jsonParser) resetParseErrors() {
+	p.parseErrors = 0
+}
+
+func (p *jsonParser) parseErrorCount() int {
+	return p.parseErrors
+}
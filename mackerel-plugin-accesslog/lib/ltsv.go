@@ -0,0 +1,128 @@
+package mpaccesslog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Songmu/axslogparser"
+)
+
+// ltsvParser parses LTSV logs with the labels given by options
+// instead of the default ones of axslogparser.
+type ltsvParser struct {
+	statusLabel  string
+	reqtimeLabel string
+	sizeLabel    string
+	aggregate    string // how multiple values of the request time are aggregated: sum, max or last
+
+	// parseErrors is the number of unparsable values of the request time or the size
+	parseErrors int
+}
+
+var reqtimeAggregates = map[string]bool{"sum": true, "max": true, "last": true}
+
+func newLTSVParser(statusLabel, reqtimeLabel, sizeLabel, aggregate string) (*ltsvParser, error) {
+	if !reqtimeAggregates[aggregate] {
+		return nil, fmt.Errorf("'%s' is invalid aggregate of the request time", aggregate)
+	}
+	return &ltsvParser{
+		statusLabel:  statusLabel,
+		reqtimeLabel: reqtimeLabel,
+		sizeLabel:    sizeLabel,
+		aggregate:    aggregate,
+	}, nil
+}
+
+// Parse parses a line of LTSV log
+func (p *ltsvParser) Parse(line string) (*axslogparser.Log, error) {
+	l := &axslogparser.Log{}
+	var status string
+	for _, field := range strings.Split(line, "\t") {
+		i := strings.Index(field, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid LTSV field: %s", field)
+		}
+		label, value := field[:i], field[i+1:]
+		switch label {
+		case p.statusLabel:
+			status = value
+		case p.reqtimeLabel:
+			reqtime, ok, err := parseReqtime(value, p.aggregate)
+			if err != nil {
+				p.parseErrors++
+			} else if ok {
+				l.ReqTime = &reqtime
+			}
+		case p.sizeLabel:
+			if value == "-" {
+				continue
+			}
+			size, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				p.parseErrors++
+				continue
+			}
+			l.Size = size
+		case "req":
+			l.Request = value
+		case "method":
+			l.Method = value
+		case "uri":
+			l.RequestURI = value
+		}
+	}
+	if status == "" {
+		return nil, fmt.Errorf("no status in the label %s: %s", p.statusLabel, line)
+	}
+	var err error
+	if l.Status, err = strconv.Atoi(status); err != nil {
+		return nil, fmt.Errorf("invalid status: %s", status)
+	}
+	if l.RequestURI == "" {
+		// req is like "GET /path HTTP/1.1"
+		if f := strings.Fields(l.Request); len(f) >= 2 {
+			l.RequestURI = f[1]
+		}
+	}
+	return l, nil
+}
+
+func (p *ltsvParser) resetParseErrors() {
+	p.parseErrors = 0
+}
+
+func (p *ltsvParser) parseErrorCount() int {
+	return p.parseErrors
+}
+
+// parseReqtime parses the request time which contains multiple values separated
+// by commas or colons when the upstream is retried (e.g. "0.004, 0.120")
+func parseReqtime(value, aggregate string) (float64, bool, error) {
+	var (
+		ret float64
+		ok  bool
+	)
+	for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' }) {
+		v = strings.TrimSpace(v)
+		if v == "-" || v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		switch aggregate {
+		case "sum":
+			ret += f
+		case "max":
+			if !ok || f > ret {
+				ret = f
+			}
+		case "last":
+			ret = f
+		}
+		ok = true
+	}
+	return ret, ok, nil
+}
@@ -0,0 +1,73 @@
+package mpaccesslog
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// otherPathGroup is the group of paths matching none of the path groups
+const otherPathGroup = "other"
+
+var pathGroupNameRe = regexp.MustCompile(`^[-a-zA-Z0-9_]+$`)
+
+type pathGroup struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// parsePathGroup parses the value of -path-group in the form of name=regex
+func parsePathGroup(s string) (pathGroup, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return pathGroup{}, fmt.Errorf("path group should be in the form of name=regex: %s", s)
+	}
+	name := s[:i]
+	if !pathGroupNameRe.MatchString(name) || name == otherPathGroup {
+		return pathGroup{}, fmt.Errorf("invalid path group name: %s", name)
+	}
+	re, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return pathGroup{}, fmt.Errorf("invalid regex of path group %s: %s", name, err)
+	}
+	return pathGroup{name: name, re: re}, nil
+}
+
+// matchPathGroup returns the name of the first group matching the path of the request URI
+func matchPathGroup(groups []pathGroup, uri string) string {
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	for _, g := range groups {
+		if g.re.MatchString(uri) {
+			return g.name
+		}
+	}
+	return otherPathGroup
+}
+
+// parseTrackStatus parses the value of -track-status like 499,502,503,504
+func parseTrackStatus(s string) ([]int, error) {
+	var codes []int
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code: %s", v)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func statusCountKey(code int) string {
+	return fmt.Sprintf("status_%d_count", code)
+}
+
+func pathGroupKey(name, metric string) string {
+	return "path_group." + name + "." + metric
+}
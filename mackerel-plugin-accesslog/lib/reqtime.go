@@ -0,0 +1,74 @@
+package mpaccesslog
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// maxReqtimeSamples is the number of request times kept for calculating percentiles.
+// Percentiles are exact up to this number of lines, and are estimated from a
+// uniform random sample (reservoir sampling) beyond it.
+const maxReqtimeSamples = 100000
+
+// defaultPercentiles are the percentiles of the latency_ms graph
+var defaultPercentiles = []float64{50, 90, 95, 99}
+
+// parsePercentiles parses the value of -percentiles like 50,90,99.9
+func parsePercentiles(s string) ([]float64, error) {
+	var ps []float64
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile: %s", v)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func formatPercentile(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// percentileKey returns the metric name of the percentile like p99_ms, or p99_9_ms for 99.9
+func percentileKey(p float64) string {
+	return "p" + strings.Replace(formatPercentile(p), ".", "_", 1) + "_ms"
+}
+
+type reqtimeSampler struct {
+	samples []float64
+	count   int
+	sum     float64
+	max     int
+	rand    *rand.Rand
+}
+
+func newReqtimeSampler(max int) *reqtimeSampler {
+	return &reqtimeSampler{
+		max:  max,
+		rand: rand.New(rand.NewSource(1)),
+	}
+}
+
+func (s *reqtimeSampler) add(v float64) {
+	s.count++
+	s.sum += v
+	if len(s.samples) < s.max {
+		s.samples = append(s.samples, v)
+		return
+	}
+	if i := s.rand.Intn(s.count); i < s.max {
+		s.samples[i] = v
+	}
+}
+
+// mean returns the average of all the added values, not only of the samples
+func (s *reqtimeSampler) mean() float64 {
+	return s.sum / float64(s.count)
+}
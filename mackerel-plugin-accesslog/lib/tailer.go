@@ -0,0 +1,295 @@
+package mpaccesslog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rotatedSuffixes are the suffixes of rotated files (e.g. access.log.1, access.log-20170308)
+// searched for the rest of the old file
+var rotatedSuffixes = []string{".*", "-*"}
+
+// defaultMaxCatchupBytes is the default limit of bytes read from the rotated file
+const defaultMaxCatchupBytes = 100 * 1024 * 1024
+
+type position struct {
+	Dev   uint64 `json:"dev,omitempty"`
+	Inode uint64 `json:"inode"`
+	Pos   int64  `json:"pos"`
+}
+
+func (p *position) sameFile(fi os.FileInfo) bool {
+	dev, inode := fileID(fi)
+	if p.Inode == 0 || inode == 0 {
+		return true
+	}
+	// dev is not recorded in pos files written by older versions
+	return p.Inode == inode && (p.Dev == 0 || p.Dev == dev)
+}
+
+func loadPosition(posfile string) (*position, error) {
+	b, err := ioutil.ReadFile(posfile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pos position
+	if err := json.Unmarshal(b, &pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+func savePosition(posfile string, pos *position) error {
+	if err := os.MkdirAll(filepath.Dir(posfile), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(posfile, b, 0644)
+}
+
+// catchupOptions configures reading the rest of the old file after rotation
+type catchupOptions struct {
+	// readRotated enables reading the most recent file matching glob (plain or gzipped)
+	// when the old file is not found by its inode
+	readRotated bool
+	glob        string
+	maxBytes    int64
+}
+
+// tailer reads the file from the position recorded in the pos file, and records the position on Close.
+type tailer struct {
+	io.Reader
+	closers []io.Closer
+	pos     *position
+	posfile string
+}
+
+func openTail(file, posfile string, c *catchupOptions) (*tailer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	saved, err := loadPosition(posfile)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dev, inode := fileID(fi)
+	t := &tailer{
+		pos:     &position{Dev: dev, Inode: inode},
+		posfile: posfile,
+	}
+
+	var readers []io.Reader
+	switch {
+	case saved == nil:
+	case !saved.sameFile(fi):
+		// rotated by renaming; read the rest of the old file first
+		if r := t.openRotated(file, saved, c); r != nil {
+			readers = append(readers, r)
+		}
+	case fi.Size() < saved.Pos:
+		// truncated by copytruncate; read from the head
+	default:
+		if _, err := f.Seek(saved.Pos, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.pos.Pos = saved.Pos
+	}
+	t.closers = append(t.closers, f)
+	t.Reader = io.MultiReader(append(readers, &positionReader{f, t.pos})...)
+	return t, nil
+}
+
+// openRotated returns the reader of the rest of the old file, or nil if it is not found
+func (t *tailer) openRotated(file string, pos *position, c *catchupOptions) io.Reader {
+	if c == nil {
+		c = &catchupOptions{}
+	}
+	var r io.Reader
+	if old := findRotated(file, pos); old != nil {
+		if _, err := old.Seek(pos.Pos, io.SeekStart); err != nil {
+			old.Close()
+			return nil
+		}
+		t.closers = append(t.closers, old)
+		r = old
+	} else if c.readRotated {
+		name := latestRotated(file, c.glob)
+		if name == "" {
+			return nil
+		}
+		if r = t.openSkipped(name, pos.Pos); r == nil {
+			return nil
+		}
+	} else {
+		return nil
+	}
+	if c.maxBytes > 0 {
+		r = &catchupReader{r: bufio.NewReader(r), remain: c.maxBytes}
+	}
+	return r
+}
+
+// openSkipped opens the file, which may be gzipped, and skips to the offset
+func (t *tailer) openSkipped(name string, offset int64) io.Reader {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			log.Printf("%s: %s", name, err)
+			f.Close()
+			return nil
+		}
+		r = gz
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+		// the file is shorter than the offset, so that it is not the old file
+		f.Close()
+		return nil
+	}
+	t.closers = append(t.closers, f)
+	return r
+}
+
+func findRotated(file string, pos *position) *os.File {
+	for _, suffix := range rotatedSuffixes {
+		names, _ := filepath.Glob(filepath.Join(filepath.Dir(file), escapeGlob(filepath.Base(file))+suffix))
+		for _, name := range names {
+			fi, err := os.Stat(name)
+			if err != nil || fi.Size() < pos.Pos {
+				continue
+			}
+			dev, inode := fileID(fi)
+			if inode == pos.Inode && (pos.Dev == 0 || dev == pos.Dev) {
+				f, err := os.Open(name)
+				if err != nil {
+					return nil
+				}
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// latestRotated returns the most recently modified file matching glob
+// (the rotated file names by default)
+func latestRotated(file, glob string) string {
+	var patterns []string
+	if glob != "" {
+		patterns = []string{glob}
+	} else {
+		for _, suffix := range rotatedSuffixes {
+			patterns = append(patterns, filepath.Join(filepath.Dir(file), escapeGlob(filepath.Base(file))+suffix))
+		}
+	}
+	var (
+		latest  string
+		latestT int64
+	)
+	for _, pattern := range patterns {
+		names, _ := filepath.Glob(pattern)
+		for _, name := range names {
+			fi, err := os.Stat(name)
+			if err != nil || !fi.Mode().IsRegular() || name == file {
+				continue
+			}
+			if t := fi.ModTime().UnixNano(); latest == "" || t > latestT {
+				latest, latestT = name, t
+			}
+		}
+	}
+	return latest
+}
+
+func escapeGlob(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// Close closes the files and records the position of the current file
+func (t *tailer) Close() error {
+	for _, c := range t.closers {
+		c.Close()
+	}
+	return savePosition(t.posfile, t.pos)
+}
+
+type positionReader struct {
+	r   io.Reader
+	pos *position
+}
+
+func (r *positionReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.pos.Pos += int64(n)
+	return n, err
+}
+
+// catchupReader reads up to remain bytes, and then to the end of the line
+// so that a line is not split at the limit
+type catchupReader struct {
+	r      *bufio.Reader
+	remain int64
+	rest   []byte
+	done   bool
+}
+
+func (c *catchupReader) Read(p []byte) (int, error) {
+	if c.remain > 0 {
+		if int64(len(p)) > c.remain {
+			p = p[:c.remain]
+		}
+		n, err := c.r.Read(p)
+		c.remain -= int64(n)
+		return n, err
+	}
+	if !c.done {
+		c.done = true
+		var err error
+		c.rest, err = c.r.ReadBytes('\n')
+		if err == nil {
+			if _, err := c.r.Peek(1); err == nil {
+				log.Println("reached the limit of catching up the rotated file, and the rest of it is skipped")
+			}
+		}
+	}
+	if len(c.rest) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
@@ -0,0 +1,163 @@
+package mpaccesslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func readTail(t *testing.T, file, posfile string) string {
+	return readTailWithCatchup(t, file, posfile, nil)
+}
+
+func readTailWithCatchup(t *testing.T, file, posfile string, c *catchupOptions) string {
+	tl, err := openTail(file, posfile, c)
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	b, err := ioutil.ReadAll(tl)
+	if err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatalf("error should be nil but: %+v", err)
+	}
+	return string(b)
+}
+
+func writeFile(t *testing.T, file, content string, flag int) {
+	f, err := os.OpenFile(file, flag|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+}
+
+func TestTailCopyTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	posfile := filepath.Join(dir, "pos", "access.log.pos.json")
+
+	writeFile(t, file, "line1\nline2\n", os.O_TRUNC)
+	if out := readTail(t, file, posfile); out != "line1\nline2\n" {
+		t.Errorf("first read: %q", out)
+	}
+	writeFile(t, file, "line3\n", os.O_APPEND)
+	if out := readTail(t, file, posfile); out != "line3\n" {
+		t.Errorf("appended: %q", out)
+	}
+
+	// copytruncate shrinks the file in place
+	writeFile(t, file, "line4\n", os.O_TRUNC)
+	if out := readTail(t, file, posfile); out != "line4\n" {
+		t.Errorf("truncated: %q", out)
+	}
+}
+
+func TestTailRenameRotation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode is not available on Windows")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-plugin-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	posfile := filepath.Join(dir, "access.log.pos.json")
+
+	writeFile(t, file, "line1\n", os.O_TRUNC)
+	readTail(t, file, posfile)
+	writeFile(t, file, "line2\n", os.O_APPEND)
+
+	// the rest of the old file is read before the new file
+	if err := os.Rename(file, file+".1"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, file, "line3\nline4\n", os.O_TRUNC)
+	if out := readTail(t, file, posfile); out != "line2\nline3\nline4\n" {
+		t.Errorf("rotated: %q", out)
+	}
+	if out := readTail(t, file, posfile); out != "" {
+		t.Errorf("after rotation: %q", out)
+	}
+
+	// the new file is read from the head when the old file is not found
+	if err := os.Rename(file, file+"-20170308"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(file + "-20170308")
+	writeFile(t, file, "line5\n", os.O_TRUNC)
+	if out := readTail(t, file, posfile); out != "line5\n" {
+		t.Errorf("old file removed: %q", out)
+	}
+}
+
+func gzipFile(t *testing.T, src, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	if err := ioutil.WriteFile(dst, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(src)
+}
+
+func TestTailReadRotatedGzip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("inode is not available on Windows")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-plugin-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "access.log")
+	posfile := filepath.Join(dir, "access.log.pos.json")
+
+	rotate := func() {
+		writeFile(t, file, "line1\n", os.O_TRUNC)
+		readTail(t, file, posfile)
+		writeFile(t, file, "line2\nline3\n", os.O_APPEND)
+		if err := os.Rename(file, file+".1"); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, file, "line4\n", os.O_TRUNC)
+		// the old file is compressed while the agent is down
+		gzipFile(t, file+".1", file+".1.gz")
+	}
+
+	rotate()
+	if out := readTail(t, file, posfile); out != "line4\n" {
+		t.Errorf("without -read-rotated: %q", out)
+	}
+
+	os.Remove(posfile)
+	rotate()
+	c := &catchupOptions{readRotated: true, maxBytes: defaultMaxCatchupBytes}
+	if out := readTailWithCatchup(t, file, posfile, c); out != "line2\nline3\nline4\n" {
+		t.Errorf("with -read-rotated: %q", out)
+	}
+
+	// the catch-up stops at the end of the line over the limit
+	os.Remove(posfile)
+	rotate()
+	c = &catchupOptions{readRotated: true, glob: filepath.Join(dir, "*.gz"), maxBytes: 3}
+	if out := readTailWithCatchup(t, file, posfile, c); out != "line2\nline4\n" {
+		t.Errorf("with -max-catchup-bytes: %q", out)
+	}
+}
@@ -1,16 +1,18 @@
 package mpapache2
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 	"github.com/urfave/cli"
 )
 
@@ -23,6 +25,14 @@ type Apache2Plugin struct {
 	Tempfile    string
 	Prefix      string
 	LabelPrefix string
+
+	// Scheme is http or https, and URI overrides Scheme, Host, Port and Path if it is given
+	Scheme             string
+	URI                string
+	User               string
+	Password           string
+	InsecureSkipVerify bool
+	Timeout            time.Duration
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -85,10 +95,25 @@ func (c Apache2Plugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "score-", Label: "Open slot", Diff: false, Stacked: true},
 			},
 		},
+		"scoreboard_usage": {
+			Label: (labelPrefix + " Scoreboard Usage"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "busy_percentage", Label: "Busy slots in ServerLimit", Diff: false},
+			},
+		},
 	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host, the port and the status page
+func (c Apache2Plugin) tempfile(tempfile string) string {
+	if c.URI != "" {
+		return pluginutil.Tempfile(tempfile, "apache2", c.URI)
+	}
+	return pluginutil.Tempfile(tempfile, "apache2", c.Host, strconv.Itoa(int(c.Port)), c.Path)
+}
+
 // main function
 func doMain(c *cli.Context) error {
 
@@ -100,9 +125,15 @@ func doMain(c *cli.Context) error {
 	apache2.Header = c.StringSlice("header")
 	apache2.Prefix = c.String("metric-key-prefix")
 	apache2.LabelPrefix = c.String("metric-label-prefix")
+	apache2.Scheme = c.String("scheme")
+	apache2.URI = c.String("uri")
+	apache2.User = c.String("user")
+	apache2.Password = c.String("password")
+	apache2.InsecureSkipVerify = c.Bool("insecure")
+	apache2.Timeout = c.Duration("timeout")
 
 	helper := mp.NewMackerelPlugin(apache2)
-	helper.Tempfile = c.String("tempfile")
+	helper.Tempfile = apache2.tempfile(c.String("tempfile"))
 
 	helper.Run()
 	return nil
@@ -110,7 +141,7 @@ func doMain(c *cli.Context) error {
 
 // FetchMetrics fetch the metrics
 func (c Apache2Plugin) FetchMetrics() (map[string]interface{}, error) {
-	data, err := getApache2Metrics(c.Host, c.Port, c.Path, c.Header)
+	data, err := c.getApache2Metrics()
 	if err != nil {
 		return nil, err
 	}
@@ -128,27 +159,37 @@ func (c Apache2Plugin) FetchMetrics() (map[string]interface{}, error) {
 	return stat, nil
 }
 
+// scoreboardStates are the states of the workers in the scoreboard, where "." is an open slot
+const scoreboardStates = "_SRWKDCLGI."
+
 // parsing scoreboard from server-status?auto
+// The scoreboard has a character for each slot of ServerLimit (times ThreadsPerChild), which can be several thousand
+// characters on event MPM, so the characters are counted in a single pass.
 func parseApache2Scoreboard(str string, p *map[string]interface{}) error {
 	for _, line := range strings.Split(str, "\n") {
-		matched, err := regexp.MatchString("Scoreboard(.*)", line)
-		if err != nil {
-			return err
-		}
-		if !matched {
+		if !strings.HasPrefix(line, "Scoreboard:") {
 			continue
 		}
-		record := strings.Split(line, ":")
-		for _, sb := range strings.Split(strings.Trim(record[1], " "), "") {
+		scoreboard := strings.TrimSpace(strings.TrimPrefix(line, "Scoreboard:"))
+		var counts [256]float64
+		for i := 0; i < len(scoreboard); i++ {
+			counts[scoreboard[i]]++
+		}
+		for c, n := range counts {
+			// the known states are posted even if there is no worker in them
+			if n == 0 && strings.IndexByte(scoreboardStates, byte(c)) < 0 {
+				continue
+			}
+			sb := string(rune(c))
 			if sb == "." {
 				sb = ""
 			}
-			name := fmt.Sprintf("score-%s", sb)
-			c, assert := (*p)[name].(float64)
-			if !assert {
-				c = 0.0
-			}
-			(*p)[name] = c + 1.0
+			(*p)["score-"+sb] = n
+		}
+
+		// the slots are busy but the waiting and the open ones
+		if slots := len(scoreboard); slots > 0 {
+			(*p)["busy_percentage"] = 100.0 * (float64(slots) - counts['_'] - counts['.']) / float64(slots)
 		}
 		return nil
 	}
@@ -185,14 +226,35 @@ func parseApache2Status(str string, p *map[string]interface{}) error {
 	return nil
 }
 
+// statusURI returns the URI of the status page
+func (c Apache2Plugin) statusURI() string {
+	if c.URI != "" {
+		return c.URI
+	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + c.Host + ":" + strconv.FormatUint(uint64(c.Port), 10) + c.Path
+}
+
+// httpClient returns the client with the timeout, which follows the redirects, e.g. from http to https
+func (c Apache2Plugin) httpClient() *http.Client {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if c.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport, Timeout: c.Timeout}
+}
+
 // Getting apache2 status from server-status module data.
-func getApache2Metrics(host string, port uint16, path string, header []string) (string, error) {
-	uri := "http://" + host + ":" + strconv.FormatUint(uint64(port), 10) + path
+func (c Apache2Plugin) getApache2Metrics() (string, error) {
+	uri := c.statusURI()
 	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return "", err
 	}
-	for _, h := range header {
+	for _, h := range c.Header {
 		kv := strings.SplitN(h, ":", 2)
 		var k, v string
 		k = strings.TrimSpace(kv[0])
@@ -205,15 +267,25 @@ func getApache2Metrics(host string, port uint16, path string, header []string) (
 			req.Header.Set(k, v)
 		}
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if c.User != "" || c.Password != "" {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("HTTP status error: %d: authentication failed for %s", resp.StatusCode, resp.Request.URL)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("HTTP status error: %d", resp.StatusCode)
 	}
+	// the status page without ?auto, or the page of the redirect or the login is not the machine readable status
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return "", fmt.Errorf("%s returned HTML instead of the status of ?auto", resp.Request.URL)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
 	if err != nil {
 		return "", err
 	}
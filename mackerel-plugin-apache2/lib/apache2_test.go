@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"regexp"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -28,6 +29,25 @@ func TestParseApache2Scoreboard(t *testing.T) {
 	assert.EqualValues(t, stat["score-G"], 1)
 	assert.EqualValues(t, stat["score-I"], 1)
 	assert.EqualValues(t, stat["score-"], 5)
+	assert.EqualValues(t, stat["busy_percentage"], 100.0*10/16)
+}
+
+func TestParseApache2ScoreboardEventMPM(t *testing.T) {
+	stub := "Scoreboard: " + strings.Repeat("_", 3000) + strings.Repeat("K", 800) + strings.Repeat("W", 200) + strings.Repeat(".", 4000)
+	stat := make(map[string]interface{})
+
+	err := parseApache2Scoreboard(stub, &stat)
+	assert.Nil(t, err)
+	assert.EqualValues(t, stat["score-_"], 3000)
+	assert.EqualValues(t, stat["score-K"], 800)
+	assert.EqualValues(t, stat["score-W"], 200)
+	assert.EqualValues(t, stat["score-"], 4000)
+	// the states without the workers are posted as 0
+	assert.EqualValues(t, stat["score-C"], 0)
+	assert.EqualValues(t, stat["busy_percentage"], 12.5)
+
+	err = parseApache2Scoreboard("BusyWorkers: 1\n", &stat)
+	assert.NotNil(t, err)
 }
 
 func TestParseApache2Status(t *testing.T) {
@@ -79,7 +99,7 @@ Scoreboard: W_.__...........................`
 	path := found[4]
 	header := []string{fmt.Sprintf("Host: %s", found[2]), "X-Text-Header: test"}
 
-	ret, err := getApache2Metrics(host, uint16(port), path, header)
+	ret, err := Apache2Plugin{Host: host, Port: uint16(port), Path: path, Header: header}.getApache2Metrics()
 	assert.Nil(t, err)
 	assert.NotNil(t, ret)
 	assert.NotEmpty(t, ret)
@@ -90,3 +110,101 @@ Scoreboard: W_.__...........................`
 	assert.Contains(t, ret, "IdleWorkers")
 	assert.Contains(t, ret, "Scoreboard")
 }
+
+func TestTempfile(t *testing.T) {
+	p := Apache2Plugin{Host: "127.0.0.1", Port: 80, Path: "/server-status?auto"}
+	for field, other := range map[string]Apache2Plugin{
+		"Host": {Host: "127.0.0.2", Port: 80, Path: "/server-status?auto"},
+		"Port": {Host: "127.0.0.1", Port: 8080, Path: "/server-status?auto"},
+		"Path": {Host: "127.0.0.1", Port: 80, Path: "/status?auto"},
+		"URI":  {URI: "http://127.0.0.1:8080/server-status?auto"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/apache2.json"); f != "/tmp/apache2.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+const testStatus = `Total Accesses: 668
+Total kBytes: 2789
+CPULoad: .000599374
+BusyWorkers: 1
+IdleWorkers: 3
+Scoreboard: W_.__...........................`
+
+func TestGetApache2MetricsHTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				user, password, ok := r.BasicAuth()
+				if !ok || user != "mackerel" || password != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				assert.Equal(t, "status.example.com", r.Host)
+				fmt.Fprintln(w, testStatus)
+			}))
+	defer ts.Close()
+
+	apache2 := Apache2Plugin{
+		URI:                ts.URL + "/server-status?auto",
+		Header:             []string{"Host: status.example.com"},
+		User:               "mackerel",
+		Password:           "secret",
+		InsecureSkipVerify: true,
+	}
+	ret, err := apache2.getApache2Metrics()
+	assert.Nil(t, err)
+	assert.Contains(t, ret, "Total Accesses")
+
+	apache2.Password = "wrong"
+	_, err = apache2.getApache2Metrics()
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("getApache2Metrics() should fail with the authentication: %v", err)
+	}
+
+	apache2.InsecureSkipVerify = false
+	_, err = apache2.getApache2Metrics()
+	assert.NotNil(t, err, "the certificate of the test server should not be verified")
+}
+
+func TestGetApache2MetricsRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/server-status", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "auto" {
+			w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+			fmt.Fprintln(w, "<html><body>Apache Server Status</body></html>")
+			return
+		}
+		fmt.Fprintln(w, testStatus)
+	})
+	mux.HandleFunc("/old-status", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/server-status?auto", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/server-status", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	ret, err := Apache2Plugin{URI: ts.URL + "/old-status"}.getApache2Metrics()
+	assert.Nil(t, err, "the redirect should be followed")
+	assert.Contains(t, ret, "Scoreboard")
+
+	_, err = Apache2Plugin{URI: ts.URL + "/login"}.getApache2Metrics()
+	if err == nil || !strings.Contains(err.Error(), "returned HTML") {
+		t.Errorf("getApache2Metrics() should fail with the HTML: %v", err)
+	}
+}
+
+func TestStatusURI(t *testing.T) {
+	apache2 := Apache2Plugin{Host: "127.0.0.1", Port: 443, Path: "/server-status?auto", Scheme: "https"}
+	assert.Equal(t, "https://127.0.0.1:443/server-status?auto", apache2.statusURI())
+	apache2.Scheme = ""
+	assert.Equal(t, "http://127.0.0.1:443/server-status?auto", apache2.statusURI())
+	apache2.URI = "https://status.example.com/server-status?auto"
+	assert.Equal(t, "https://status.example.com/server-status?auto", apache2.statusURI())
+}
@@ -1,6 +1,8 @@
 package mpapache2
 
 import (
+	"time"
+
 	"github.com/urfave/cli"
 )
 
@@ -12,6 +14,12 @@ var flags = []cli.Flag{
 	cliTempFile,
 	cliMetricKerPrefix,
 	cliLabelPrefix,
+	cliScheme,
+	cliURI,
+	cliUser,
+	cliPassword,
+	cliInsecure,
+	cliTimeout,
 }
 
 var cliHTTPHost = cli.StringFlag{
@@ -59,3 +67,36 @@ var cliLabelPrefix = cli.StringFlag{
 	Value: "Apache",
 	Usage: "Set metric label prefix.",
 }
+
+var cliScheme = cli.StringFlag{
+	Name:  "scheme",
+	Value: "http",
+	Usage: "Set the scheme of the status page (http or https).",
+}
+
+var cliURI = cli.StringFlag{
+	Name:  "uri",
+	Usage: "Set the URI of the status page, overriding the scheme, the host, the port and the status page (e.g. https://status.example.com/server-status?auto).",
+}
+
+var cliUser = cli.StringFlag{
+	Name:  "user",
+	Usage: "Set the user of the basic authentication.",
+}
+
+var cliPassword = cli.StringFlag{
+	Name:   "password",
+	Usage:  "Set the password of the basic authentication.",
+	EnvVar: "MACKEREL_PLUGIN_APACHE2_PASSWORD",
+}
+
+var cliInsecure = cli.BoolFlag{
+	Name:  "insecure",
+	Usage: "Skip the verification of the server certificate.",
+}
+
+var cliTimeout = cli.DurationFlag{
+	Name:  "timeout",
+	Value: 10 * time.Second,
+	Usage: "Set the timeout of the request to the status page.",
+}
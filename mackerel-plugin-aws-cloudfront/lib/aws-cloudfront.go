@@ -8,10 +8,10 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 const (
@@ -24,15 +24,38 @@ const (
 type metrics struct {
 	Name string
 	Type string
+	// Additional is true for the additional metrics, which are published only when enabled on the distribution
+	Additional bool
+}
+
+var errNoDataPoint = errors.New("fetched no datapoints")
+
+var distributionMetrics = [...]metrics{
+	{Name: "Requests", Type: metricsTypeSum},
+	{Name: "BytesDownloaded", Type: metricsTypeSum},
+	{Name: "BytesUploaded", Type: metricsTypeSum},
+	{Name: "4xxErrorRate", Type: metricsTypeAverage},
+	{Name: "5xxErrorRate", Type: metricsTypeAverage},
+	{Name: "CacheHitRate", Type: metricsTypeAverage, Additional: true},
+	{Name: "OriginLatency", Type: metricsTypeAverage, Additional: true},
 }
 
 // CloudFrontPlugin mackerel plugin for cloudfront
 type CloudFrontPlugin struct {
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	CloudWatch      *cloudwatch.CloudWatch
 	Name            string
 	Prefix          string
+
+	// Distributions are the distributions monitored in one run, whose metrics are in the graphs with the wildcard
+	Distributions []distribution
+	// AllDistributions lists all the distributions of the account as Distributions
+	AllDistributions bool
+	// NameFrom is "id", "alias" or "comment" to name the distributions in the metric names
+	NameFrom string
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -44,35 +67,61 @@ func (p CloudFrontPlugin) MetricKeyPrefix() string {
 }
 
 func (p *CloudFrontPlugin) prepare() error {
-	sess, err := session.NewSession()
+	// CloudFront metrics are available only in us-east-1 regardless of the default region
+	sess, config, err := awsutil.Options{
+		Region:          region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	config = config.WithRegion(region)
-
 	p.CloudWatch = cloudwatch.New(sess, config)
 
+	if p.AllDistributions || (len(p.Distributions) > 0 && p.NameFrom != "" && p.NameFrom != "id") {
+		dists, err := listDistributions(cloudfront.New(sess, config))
+		if err != nil {
+			return err
+		}
+		if p.AllDistributions {
+			p.Distributions = dists
+		} else {
+			// the aliases and the comments of the given distributions
+			summaries := make(map[string]distribution)
+			for _, d := range dists {
+				summaries[d.ID] = d
+			}
+			for i, d := range p.Distributions {
+				if s, ok := summaries[d.ID]; ok {
+					p.Distributions[i] = s
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
-func (p CloudFrontPlugin) getLastPoint(metric metrics) (float64, error) {
-	now := time.Now()
-
-	dimensions := []*cloudwatch.Dimension{
+func distributionDimensions(id string) []*cloudwatch.Dimension {
+	return []*cloudwatch.Dimension{
 		{
 			Name:  aws.String("DistributionId"),
-			Value: aws.String(p.Name),
+			Value: aws.String(id),
 		},
 		{
 			Name:  aws.String("Region"),
 			Value: aws.String("Global"),
 		},
 	}
+}
+
+func (p CloudFrontPlugin) getLastPoint(metric metrics) (float64, error) {
+	now := time.Now()
+
+	dimensions := distributionDimensions(p.Name)
 
 	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
 		Dimensions: dimensions,
@@ -89,7 +138,7 @@ func (p CloudFrontPlugin) getLastPoint(metric metrics) (float64, error) {
 
 	datapoints := response.Datapoints
 	if len(datapoints) == 0 {
-		return 0, errors.New("fetched no datapoints")
+		return 0, errNoDataPoint
 	}
 
 	// get a least recently datapoint
@@ -112,28 +161,63 @@ func (p CloudFrontPlugin) getLastPoint(metric metrics) (float64, error) {
 
 // FetchMetrics fetch the metrics
 func (p CloudFrontPlugin) FetchMetrics() (map[string]float64, error) {
+	if len(p.Distributions) > 0 {
+		return p.fetchDistributions()
+	}
+
 	stat := make(map[string]float64)
 
-	for _, met := range [...]metrics{
-		{Name: "Requests", Type: metricsTypeSum},
-		{Name: "BytesDownloaded", Type: metricsTypeSum},
-		{Name: "BytesUploaded", Type: metricsTypeSum},
-		{Name: "4xxErrorRate", Type: metricsTypeAverage},
-		{Name: "5xxErrorRate", Type: metricsTypeAverage},
-	} {
+	for _, met := range distributionMetrics {
 		v, err := p.getLastPoint(met)
 		if err == nil {
 			stat[met.Name] = v
-		} else {
-			log.Printf("%s: %s", met, err)
+		} else if !(met.Additional && err == errNoDataPoint) {
+			log.Printf("%s: %s", met.Name, err)
 		}
 	}
 
 	return stat, nil
 }
 
+// fetchDistributions fetches the metrics of the distributions at once, in the graphs with the wildcard for the
+// distribution
+func (p CloudFrontPlugin) fetchDistributions() (map[string]float64, error) {
+	stats, err := fetchDistributionsMetrics(p.CloudWatch, p.Distributions, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	graphKeys := make(map[string]string)
+	for k, g := range p.graphDefinition() {
+		for _, m := range g.Metrics {
+			graphKeys[m.Name] = k
+		}
+	}
+	stat := make(map[string]float64)
+	for _, d := range p.Distributions {
+		for met, v := range stats[d.ID] {
+			if k, ok := graphKeys[met]; ok {
+				stat[k+"."+d.key(p.NameFrom)+"."+met] = v
+			}
+		}
+	}
+	return stat, nil
+}
+
 // GraphDefinition of CloudFrontPlugin
 func (p CloudFrontPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphdef := p.graphDefinition()
+	if len(p.Distributions) == 0 {
+		return graphdef
+	}
+	graphs := make(map[string]mp.Graphs)
+	for k, g := range graphdef {
+		graphs[k+".#"] = g
+	}
+	return graphs
+}
+
+func (p CloudFrontPlugin) graphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(p.Prefix)
 	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
 
@@ -161,6 +245,20 @@ func (p CloudFrontPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "5xxErrorRate", Label: "5xx", Stacked: true},
 			},
 		},
+		"CacheHitRate": {
+			Label: labelPrefix + " Cache Hit Rate",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "CacheHitRate", Label: "Cache Hit"},
+			},
+		},
+		"OriginLatency": {
+			Label: labelPrefix + " Origin Latency (ms)",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "OriginLatency", Label: "Origin Latency"},
+			},
+		},
 	}
 }
 
@@ -168,17 +266,37 @@ func (p CloudFrontPlugin) GraphDefinition() map[string]mp.Graphs {
 func Do() {
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
-	optIdentifier := flag.String("identifier", "", "Distribution ID")
+	optIdentifier := flag.String("identifier", "", "Distribution ID, or comma separated IDs to monitor multiple distributions")
+	optAllDistributions := flag.Bool("all-distributions", false, "Monitor all the distributions of the account")
+	optNameFrom := flag.String("name-from", "id", "Name the distributions in the metric names by 'id', 'alias' or 'comment' (with multiple distributions)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "cloudfront", "Metric key prefix")
-	flag.Parse()
-
 	var plugin CloudFrontPlugin
+	plugin.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&plugin.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Name = *optIdentifier
 	plugin.Prefix = *optPrefix
+	plugin.AllDistributions = *optAllDistributions
+	plugin.NameFrom = *optNameFrom
+	switch plugin.NameFrom {
+	case "id", "alias", "comment":
+	default:
+		log.Fatalf("-name-from should be 'id', 'alias' or 'comment': %s", plugin.NameFrom)
+	}
+	if ids := strings.Split(plugin.Name, ","); len(ids) > 1 {
+		for _, id := range ids {
+			if id = strings.TrimSpace(id); id != "" {
+				plugin.Distributions = append(plugin.Distributions, distribution{ID: id})
+			}
+		}
+	}
+	if plugin.Name == "" && !plugin.AllDistributions {
+		log.Fatalln("specify -identifier or -all-distributions")
+	}
 
 	err := plugin.prepare()
 	if err != nil {
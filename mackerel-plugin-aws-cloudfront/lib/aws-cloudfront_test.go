@@ -0,0 +1,26 @@
+package mpawscloudfront
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrepare(t *testing.T) {
+	os.Setenv("AWS_REGION", "ap-northeast-1")
+	defer os.Unsetenv("AWS_REGION")
+
+	var p CloudFrontPlugin
+	assert.Nil(t, p.prepare())
+	assert.Equal(t, "us-east-1", *p.CloudWatch.Config.Region, "region is pinned to us-east-1")
+}
+
+func TestGraphDefinition(t *testing.T) {
+	p := CloudFrontPlugin{Prefix: "cloudfront"}
+	graphs := p.GraphDefinition()
+
+	assert.Equal(t, "percentage", graphs["CacheHitRate"].Unit)
+	assert.Equal(t, "percentage", graphs["ErrorRate"].Unit)
+	assert.Equal(t, "Cloudfront Origin Latency (ms)", graphs["OriginLatency"].Label)
+}
@@ -0,0 +1,130 @@
+package mpawscloudfront
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// maxMetricDataQueries is the maximum number of queries in a GetMetricData request
+const maxMetricDataQueries = 500
+
+// distribution is a monitored distribution, whose metrics are posted under its key
+type distribution struct {
+	ID    string
+	Alias string
+	// Comment is the comment of the distribution, which is often its purpose
+	Comment string
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// key returns the key of the distribution in the metric names, named by the ID, the first alias or the comment.
+// The ID is used if the alias or the comment is empty.
+func (d distribution) key(nameFrom string) string {
+	name := d.ID
+	switch nameFrom {
+	case "alias":
+		if d.Alias != "" {
+			name = d.Alias
+		}
+	case "comment":
+		if d.Comment != "" {
+			name = d.Comment
+		}
+	}
+	return invalidKeyRe.ReplaceAllString(name, "_")
+}
+
+// listDistributions lists all the distributions of the account
+func listDistributions(svc cloudfrontiface.CloudFrontAPI) ([]distribution, error) {
+	var dists []distribution
+	err := svc.ListDistributionsPages(&cloudfront.ListDistributionsInput{}, func(page *cloudfront.ListDistributionsOutput, lastPage bool) bool {
+		if page.DistributionList == nil {
+			return true
+		}
+		for _, s := range page.DistributionList.Items {
+			d := distribution{ID: aws.StringValue(s.Id), Comment: aws.StringValue(s.Comment)}
+			if s.Aliases != nil && len(s.Aliases.Items) > 0 {
+				d.Alias = aws.StringValue(s.Aliases.Items[0])
+			}
+			dists = append(dists, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dists, nil
+}
+
+// fetchDistributionsMetrics fetches the metrics of the distributions by GetMetricData, in the batches of
+// maxMetricDataQueries queries. The metrics without datapoints, e.g. of the distributions without traffic, are not
+// returned.
+func fetchDistributionsMetrics(cw cloudwatchiface.CloudWatchAPI, dists []distribution, now time.Time) (map[string]map[string]float64, error) {
+	type query struct {
+		id     string
+		metric string
+	}
+	var queries []*cloudwatch.MetricDataQuery
+	targets := make(map[string]query)
+	for i, d := range dists {
+		for j, met := range distributionMetrics {
+			id := fmt.Sprintf("m%d_%d", i, j)
+			targets[id] = query{d.ID, met.Name}
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String(met.Name),
+						Dimensions: distributionDimensions(d.ID),
+					},
+					Period: aws.Int64(60),
+					Stat:   aws.String(met.Type),
+				},
+			})
+		}
+	}
+
+	stats := make(map[string]map[string]float64)
+	for len(queries) > 0 {
+		n := len(queries)
+		if n > maxMetricDataQueries {
+			n = maxMetricDataQueries
+		}
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min (to fetch at least 1 data-point)
+			EndTime:           aws.Time(now),
+			MetricDataQueries: queries[:n],
+			// the least recent datapoint first, because the most recent datapoint is not stable
+			ScanBy: aws.String(cloudwatch.ScanByTimestampAscending),
+		}
+		err := cw.GetMetricDataPages(input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+			for _, r := range page.MetricDataResults {
+				q, ok := targets[aws.StringValue(r.Id)]
+				if !ok || len(r.Values) == 0 {
+					continue
+				}
+				if stats[q.id] == nil {
+					stats[q.id] = make(map[string]float64)
+				}
+				if _, ok := stats[q.id][q.metric]; !ok {
+					stats[q.id][q.metric] = aws.Float64Value(r.Values[0])
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		queries = queries[n:]
+	}
+	return stats, nil
+}
@@ -0,0 +1,89 @@
+package mpawscloudfront
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudfront"
+	"github.com/aws/aws-sdk-go/service/cloudfront/cloudfrontiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCloudFront struct {
+	cloudfrontiface.CloudFrontAPI
+	pages []*cloudfront.ListDistributionsOutput
+}
+
+func (f fakeCloudFront) ListDistributionsPages(input *cloudfront.ListDistributionsInput, fn func(*cloudfront.ListDistributionsOutput, bool) bool) error {
+	for i, page := range f.pages {
+		if !fn(page, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListDistributions(t *testing.T) {
+	svc := fakeCloudFront{pages: []*cloudfront.ListDistributionsOutput{
+		{DistributionList: &cloudfront.DistributionList{Items: []*cloudfront.DistributionSummary{
+			{Id: aws.String("E1ABCDEF"), Comment: aws.String("static assets"), Aliases: &cloudfront.Aliases{Items: []*string{aws.String("static.example.com")}}},
+		}}},
+		{DistributionList: &cloudfront.DistributionList{Items: []*cloudfront.DistributionSummary{
+			{Id: aws.String("E2GHIJKL"), Comment: aws.String(""), Aliases: &cloudfront.Aliases{}},
+		}}},
+	}}
+	dists, err := listDistributions(svc)
+	assert.Nil(t, err)
+	assert.Equal(t, []distribution{
+		{ID: "E1ABCDEF", Alias: "static.example.com", Comment: "static assets"},
+		{ID: "E2GHIJKL"},
+	}, dists)
+
+	assert.Equal(t, "E1ABCDEF", dists[0].key("id"))
+	assert.Equal(t, "static_example_com", dists[0].key("alias"))
+	assert.Equal(t, "static_assets", dists[0].key("comment"))
+	assert.Equal(t, "E2GHIJKL", dists[1].key("alias"), "fall back to the ID without aliases")
+}
+
+// fakeMetricDataCloudWatch returns the values of the Requests of the distributions with traffic only
+type fakeMetricDataCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	requests map[string]float64
+	calls    int
+}
+
+func (f *fakeMetricDataCloudWatch) GetMetricDataPages(input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool) error {
+	f.calls++
+	var results []*cloudwatch.MetricDataResult
+	for _, q := range input.MetricDataQueries {
+		r := &cloudwatch.MetricDataResult{Id: q.Id}
+		id := aws.StringValue(q.MetricStat.Metric.Dimensions[0].Value)
+		if v, ok := f.requests[id]; ok && aws.StringValue(q.MetricStat.Metric.MetricName) == "Requests" {
+			r.Values = []*float64{aws.Float64(v), aws.Float64(v + 1)}
+		}
+		results = append(results, r)
+	}
+	fn(&cloudwatch.GetMetricDataOutput{MetricDataResults: results}, true)
+	return nil
+}
+
+func TestFetchDistributionsMetrics(t *testing.T) {
+	cw := &fakeMetricDataCloudWatch{requests: map[string]float64{"E1ABCDEF": 120}}
+	dists := []distribution{{ID: "E1ABCDEF"}, {ID: "E2GHIJKL"}}
+	stats, err := fetchDistributionsMetrics(cw, dists, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cw.calls, "all the queries in a call")
+	assert.Equal(t, map[string]map[string]float64{
+		"E1ABCDEF": {"Requests": 120},
+	}, stats, "nothing for the distribution without traffic")
+}
+
+func TestGraphDefinitionDistributions(t *testing.T) {
+	p := CloudFrontPlugin{Prefix: "cloudfront", Distributions: []distribution{{ID: "E1ABCDEF"}, {ID: "E2GHIJKL"}}}
+	graphs := p.GraphDefinition()
+	assert.Len(t, graphs, 5)
+	assert.Equal(t, "BytesDownloaded", graphs["Transfer.#"].Metrics[0].Name)
+}
@@ -10,11 +10,12 @@ import (
 	"golang.org/x/sync/errgroup"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 const (
@@ -24,8 +25,11 @@ const (
 	metricsTypeMaximum     = "Maximum"
 	metricsTypeMinimum     = "Minimum"
 	metricsTypeSampleCount = "SampleCount"
+	metricsTypeP99         = "p99"
 )
 
+const billingModePayPerRequest = "PAY_PER_REQUEST"
+
 // has 1 CloudWatch MetricName and corresponding N Mackerel Metrics
 type metricsGroup struct {
 	CloudWatchName string
@@ -45,8 +49,14 @@ type DynamoDBPlugin struct {
 
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	Region          string
 	CloudWatch      *cloudwatch.CloudWatch
+	// OnDemand is true if the table is in on-demand capacity mode
+	OnDemand bool
+	// GSIs are the names of the global secondary indexes of the table
+	GSIs []string
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -56,24 +66,70 @@ func (p DynamoDBPlugin) MetricKeyPrefix() string {
 
 // prepare creates CloudWatch instance
 func (p *DynamoDBPlugin) prepare() error {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
+	p.CloudWatch = cloudwatch.New(sess, config)
+
+	onDemand, err := isOnDemand(dynamodb.New(sess, config), p.TableName)
+	if err != nil {
+		// keep working as before for the credentials without dynamodb:DescribeTable
+		log.Printf("failed to detect billing mode, assume provisioned: %s", err)
 	}
+	p.OnDemand = onDemand
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+	if len(p.GSIs) == 0 {
+		gsis, err := globalSecondaryIndexNames(dynamodb.New(sess, config), p.TableName)
+		if err != nil {
+			log.Printf("failed to list global secondary indexes, specify them by -gsi: %s", err)
+		}
+		p.GSIs = gsis
+	}
 
 	return nil
 }
 
+// globalSecondaryIndexNames lists the global secondary indexes of the table
+func globalSecondaryIndexNames(svc dynamodbiface.DynamoDBAPI, tableName string) ([]string, error) {
+	res, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Table == nil {
+		return nil, nil
+	}
+	var names []string
+	for _, gsi := range res.Table.GlobalSecondaryIndexes {
+		names = append(names, aws.StringValue(gsi.IndexName))
+	}
+	return names, nil
+}
+
+// isOnDemand detects the billing mode of the table
+func isOnDemand(svc dynamodbiface.DynamoDBAPI, tableName string) (bool, error) {
+	res, err := svc.DescribeTable(&dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.Table == nil || res.Table.BillingModeSummary == nil {
+		// BillingModeSummary is omitted for the tables which have been always provisioned
+		return false, nil
+	}
+	return aws.StringValue(res.Table.BillingModeSummary.BillingMode) == billingModePayPerRequest, nil
+}
+
 func transformAndAppendDatapoint(stats map[string]interface{}, dp *cloudwatch.Datapoint, dataType string, label string, fillZero bool) map[string]interface{} {
 	if dp != nil {
 		switch dataType {
@@ -87,6 +143,12 @@ func transformAndAppendDatapoint(stats map[string]interface{}, dp *cloudwatch.Da
 			stats[label] = *dp.Minimum
 		case metricsTypeSampleCount:
 			stats[label] = *dp.SampleCount
+		default:
+			if v, ok := dp.ExtendedStatistics[dataType]; ok {
+				stats[label] = *v
+			} else if fillZero {
+				stats[label] = 0.0
+			}
 		}
 	} else if fillZero {
 		stats[label] = 0.0
@@ -151,19 +213,24 @@ func fetchOperationWildcardMetrics(cw cloudwatchiface.CloudWatchAPI, mg metricsG
 // getLastPoint fetches a CloudWatch metric and parse
 func getLastPointFromCloudWatch(cw cloudwatchiface.CloudWatchAPI, metric metricsGroup, dimensions []*cloudwatch.Dimension) (*cloudwatch.Datapoint, error) {
 	now := time.Now()
-	statsInput := make([]*string, len(metric.Metrics))
-	for i, typ := range metric.Metrics {
-		statsInput[i] = aws.String(typ.Type)
+	var statsInput, extendedStatsInput []*string
+	for _, typ := range metric.Metrics {
+		if strings.HasPrefix(typ.Type, "p") {
+			extendedStatsInput = append(extendedStatsInput, aws.String(typ.Type))
+		} else {
+			statsInput = append(statsInput, aws.String(typ.Type))
+		}
 	}
 	input := &cloudwatch.GetMetricStatisticsInput{
 		// 8 min, since some metrics are aggregated over 5 min
-		StartTime:  aws.Time(now.Add(time.Duration(480) * time.Second * -1)),
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metric.CloudWatchName),
-		Period:     aws.Int64(60),
-		Statistics: statsInput,
-		Namespace:  aws.String(namespace),
-		Dimensions: dimensions,
+		StartTime:          aws.Time(now.Add(time.Duration(480) * time.Second * -1)),
+		EndTime:            aws.Time(now),
+		MetricName:         aws.String(metric.CloudWatchName),
+		Period:             aws.Int64(60),
+		Statistics:         statsInput,
+		ExtendedStatistics: extendedStatsInput,
+		Namespace:          aws.String(namespace),
+		Dimensions:         dimensions,
 	}
 	response, err := cw.GetMetricStatistics(input)
 	if err != nil {
@@ -230,6 +297,7 @@ var operationalMetricsGroup = []metricsGroup{
 		{MackerelName: "SuccessfulRequestLatency.#.Minimum", Type: metricsTypeMinimum},
 		{MackerelName: "SuccessfulRequestLatency.#.Maximum", Type: metricsTypeMaximum},
 		{MackerelName: "SuccessfulRequestLatency.#.Average", Type: metricsTypeAverage},
+		{MackerelName: "SuccessfulRequestLatency.#.p99", Type: metricsTypeP99},
 	}},
 	{CloudWatchName: "ThrottledRequests", Metrics: []metric{
 		{MackerelName: "ThrottledRequests.#", Type: metricsTypeSampleCount},
@@ -245,6 +313,75 @@ var operationalMetricsGroup = []metricsGroup{
 	}},
 }
 
+// throttle events broken down by operations, fetched for on-demand tables
+var onDemandOperationalMetricsGroup = []metricsGroup{
+	{CloudWatchName: "ReadThrottleEvents", Metrics: []metric{
+		{MackerelName: "ReadThrottleEventsByOperation.#", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "WriteThrottleEvents", Metrics: []metric{
+		{MackerelName: "WriteThrottleEventsByOperation.#", Type: metricsTypeSum},
+	}},
+}
+
+// metrics which take "GlobalSecondaryIndexName" dimensions, posted without filling zero for idle indexes
+var gsiMetricsGroup = []metricsGroup{
+	{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []metric{
+		{MackerelName: "ConsumedReadCapacityUnits", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ConsumedWriteCapacityUnits", Metrics: []metric{
+		{MackerelName: "ConsumedWriteCapacityUnits", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ReadThrottleEvents", Metrics: []metric{
+		{MackerelName: "ReadThrottleEvents", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "WriteThrottleEvents", Metrics: []metric{
+		{MackerelName: "WriteThrottleEvents", Type: metricsTypeSum},
+	}},
+}
+
+// account-level metrics, which don't take any dimensions
+var accountMetricsGroup = []metricsGroup{
+	{CloudWatchName: "AccountMaxTableLevelReads", Metrics: []metric{
+		{MackerelName: "AccountMaxTableLevelReads", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "AccountMaxTableLevelWrites", Metrics: []metric{
+		{MackerelName: "AccountMaxTableLevelWrites", Type: metricsTypeMaximum},
+	}},
+}
+
+func isProvisionedMetricsGroup(mg metricsGroup) bool {
+	return strings.HasPrefix(mg.CloudWatchName, "Provisioned")
+}
+
+// gsiMetricName returns the name of the wildcard metric of the index, whose name may contain dots
+func gsiMetricName(index, name string) string {
+	return "gsi." + strings.Replace(index, ".", "_", -1) + "." + name
+}
+
+// fetchGSIMetrics fetches the metrics of the global secondary index. The consumed capacity units are normalized per
+// second as well as the ones of the table.
+func fetchGSIMetrics(cw cloudwatchiface.CloudWatchAPI, tableName, index string) (map[string]interface{}, error) {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("TableName"), Value: aws.String(tableName)},
+		{Name: aws.String("GlobalSecondaryIndexName"), Value: aws.String(index)},
+	}
+	stats := make(map[string]interface{})
+	for _, mg := range gsiMetricsGroup {
+		dp, err := getLastPointFromCloudWatch(cw, mg, dimensions)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range mg.Metrics {
+			name := gsiMetricName(index, m.MackerelName)
+			stats = transformAndAppendDatapoint(stats, dp, m.Type, name, m.FillZero)
+			if v, ok := stats[name].(float64); ok && strings.HasPrefix(mg.CloudWatchName, "Consumed") {
+				stats[name] = v / 60.0
+			}
+		}
+	}
+	return stats, nil
+}
+
 // FetchMetrics fetch the metrics
 func (p DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stats := make(map[string]interface{})
@@ -256,6 +393,9 @@ func (p DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
 	var mu sync.Mutex
 	var eg errgroup.Group
 	for _, met := range defaultMetricsGroup {
+		if p.OnDemand && isProvisionedMetricsGroup(met) {
+			continue
+		}
 		met := met
 		eg.Go(func() error {
 			dp, err := getLastPointFromCloudWatch(p.CloudWatch, met, tableDimensions)
@@ -271,7 +411,29 @@ func (p DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
 		})
 	}
 
-	for _, met := range operationalMetricsGroup {
+	operationalGroups := operationalMetricsGroup
+	if p.OnDemand {
+		operationalGroups = append(operationalGroups, onDemandOperationalMetricsGroup...)
+
+		for _, met := range accountMetricsGroup {
+			met := met
+			eg.Go(func() error {
+				dp, err := getLastPointFromCloudWatch(p.CloudWatch, met, nil)
+				if err != nil {
+					// account-level metrics are not always available
+					log.Printf("failed to fetch %s: %s", met.CloudWatchName, err)
+					return nil
+				}
+				for _, m := range met.Metrics {
+					mu.Lock()
+					stats = transformAndAppendDatapoint(stats, dp, m.Type, m.MackerelName, m.FillZero)
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+	}
+	for _, met := range operationalGroups {
 		met := met
 		eg.Go(func() error {
 			operationalStats, err := fetchOperationWildcardMetrics(p.CloudWatch, met, tableDimensions)
@@ -290,6 +452,22 @@ func (p DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
 		})
 	}
 
+	for _, index := range p.GSIs {
+		index := index
+		eg.Go(func() error {
+			gsiStats, err := fetchGSIMetrics(p.CloudWatch, p.TableName, index)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			for name, s := range gsiStats {
+				stats[name] = s
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+
 	if err := eg.Wait(); err != nil {
 		return nil, err
 	}
@@ -432,9 +610,54 @@ func (p DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "Minimum", Label: "Min"},
 				{Name: "Maximum", Label: "Max"},
 				{Name: "Average", Label: "Average"},
+				{Name: "p99", Label: "p99"},
+			},
+		},
+		"gsi.#": {
+			Label: (labelPrefix + " Global Secondary Index"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ConsumedReadCapacityUnits", Label: "Consumed Read Capacity"},
+				{Name: "ConsumedWriteCapacityUnits", Label: "Consumed Write Capacity"},
+				{Name: "ReadThrottleEvents", Label: "Read Throttle Events"},
+				{Name: "WriteThrottleEvents", Label: "Write Throttle Events"},
 			},
 		},
 	}
+
+	if p.OnDemand {
+		for key, accountMetric := range map[string]string{
+			"ReadCapacity":  "AccountMaxTableLevelReads",
+			"WriteCapacity": "AccountMaxTableLevelWrites",
+		} {
+			g := graphdef[key]
+			// provisioned capacity is meaningless on on-demand tables
+			g.Metrics = append(g.Metrics[1:], mp.Metrics{Name: accountMetric, Label: "Account Max Table Level"})
+			graphdef[key] = g
+		}
+		graphdef["ReadThrottleEventsByOperation"] = mp.Graphs{
+			Label: (labelPrefix + " Read Throttle Events by Operation"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "GetItem", Label: "GetItem", Stacked: true, AbsoluteName: true},
+				{Name: "BatchGetItem", Label: "BatchGetItem", Stacked: true, AbsoluteName: true},
+				{Name: "Scan", Label: "Scan", Stacked: true, AbsoluteName: true},
+				{Name: "Query", Label: "Query", Stacked: true, AbsoluteName: true},
+				{Name: "TransactGetItems", Label: "TransactGetItems", Stacked: true, AbsoluteName: true},
+			},
+		}
+		graphdef["WriteThrottleEventsByOperation"] = mp.Graphs{
+			Label: (labelPrefix + " Write Throttle Events by Operation"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "PutItem", Label: "PutItem", Stacked: true, AbsoluteName: true},
+				{Name: "DeleteItem", Label: "DeleteItem", Stacked: true, AbsoluteName: true},
+				{Name: "UpdateItem", Label: "UpdateItem", Stacked: true, AbsoluteName: true},
+				{Name: "BatchWriteItem", Label: "BatchWriteItem", Stacked: true, AbsoluteName: true},
+				{Name: "TransactWriteItems", Label: "TransactWriteItems", Stacked: true, AbsoluteName: true},
+			},
+		}
+	}
 	return graphdef
 }
 
@@ -445,15 +668,22 @@ func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
 	optTableName := flag.String("table-name", "", "DynamoDB Table Name")
 	optPrefix := flag.String("metric-key-prefix", "dynamodb", "Metric key prefix")
-	flag.Parse()
-
+	optGSIs := flag.String("gsi", "", "Comma separated global secondary index names (default: all the indexes of the table)")
 	var plugin DynamoDBPlugin
+	plugin.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&plugin.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Region = *optRegion
 	plugin.TableName = *optTableName
 	plugin.Prefix = *optPrefix
+	for _, index := range strings.Split(*optGSIs, ",") {
+		if index = strings.TrimSpace(index); index != "" {
+			plugin.GSIs = append(plugin.GSIs, index)
+		}
+	}
 
 	err := plugin.prepare()
 	if err != nil {
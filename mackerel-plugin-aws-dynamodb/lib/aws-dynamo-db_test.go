@@ -0,0 +1,149 @@
+package mpawsdynamodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	billingMode *string
+	gsis        []string
+}
+
+func (f fakeDynamoDB) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	table := &dynamodb.TableDescription{TableName: input.TableName}
+	if f.billingMode != nil {
+		table.BillingModeSummary = &dynamodb.BillingModeSummary{BillingMode: f.billingMode}
+	}
+	for _, name := range f.gsis {
+		table.GlobalSecondaryIndexes = append(table.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{IndexName: aws.String(name)})
+	}
+	return &dynamodb.DescribeTableOutput{Table: table}, nil
+}
+
+func TestIsOnDemand(t *testing.T) {
+	onDemand, err := isOnDemand(fakeDynamoDB{billingMode: aws.String("PAY_PER_REQUEST")}, "MyTable")
+	assert.Nil(t, err)
+	assert.True(t, onDemand)
+
+	onDemand, err = isOnDemand(fakeDynamoDB{billingMode: aws.String("PROVISIONED")}, "MyTable")
+	assert.Nil(t, err)
+	assert.False(t, onDemand)
+
+	onDemand, err = isOnDemand(fakeDynamoDB{}, "MyTable")
+	assert.Nil(t, err)
+	assert.False(t, onDemand)
+}
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	input *cloudwatch.GetMetricStatisticsInput
+}
+
+func (f *fakeCloudWatch) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	f.input = input
+	return &cloudwatch.GetMetricStatisticsOutput{
+		Datapoints: []*cloudwatch.Datapoint{{
+			Timestamp:          aws.Time(time.Now()),
+			Average:            aws.Float64(3.0),
+			ExtendedStatistics: map[string]*float64{"p99": aws.Float64(12.5)},
+		}},
+	}, nil
+}
+
+func TestGetLastPointExtendedStatistics(t *testing.T) {
+	cw := &fakeCloudWatch{}
+	mg := metricsGroup{CloudWatchName: "SuccessfulRequestLatency", Metrics: []metric{
+		{MackerelName: "SuccessfulRequestLatency.GetItem.Average", Type: metricsTypeAverage},
+		{MackerelName: "SuccessfulRequestLatency.GetItem.p99", Type: metricsTypeP99},
+	}}
+	dp, err := getLastPointFromCloudWatch(cw, mg, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []*string{aws.String("Average")}, cw.input.Statistics)
+	assert.Equal(t, []*string{aws.String("p99")}, cw.input.ExtendedStatistics)
+
+	stats := make(map[string]interface{})
+	for _, m := range mg.Metrics {
+		stats = transformAndAppendDatapoint(stats, dp, m.Type, m.MackerelName, m.FillZero)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"SuccessfulRequestLatency.GetItem.Average": 3.0,
+		"SuccessfulRequestLatency.GetItem.p99":     12.5,
+	}, stats)
+}
+
+func TestGraphDefinitionOnDemand(t *testing.T) {
+	p := DynamoDBPlugin{Prefix: "dynamodb"}
+	graphs := p.GraphDefinition()
+	assert.Equal(t, "ProvisionedReadCapacityUnits", graphs["ReadCapacity"].Metrics[0].Name)
+	_, ok := graphs["ReadThrottleEventsByOperation"]
+	assert.False(t, ok)
+
+	p.OnDemand = true
+	graphs = p.GraphDefinition()
+	for _, m := range graphs["ReadCapacity"].Metrics {
+		assert.NotEqual(t, "ProvisionedReadCapacityUnits", m.Name)
+	}
+	assert.Equal(t, "AccountMaxTableLevelWrites", graphs["WriteCapacity"].Metrics[2].Name)
+	assert.Len(t, graphs["WriteThrottleEventsByOperation"].Metrics, 5)
+}
+
+func TestGlobalSecondaryIndexNames(t *testing.T) {
+	names, err := globalSecondaryIndexNames(fakeDynamoDB{gsis: []string{"ByUser", "ByDate"}}, "MyTable")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ByUser", "ByDate"}, names)
+
+	names, err = globalSecondaryIndexNames(fakeDynamoDB{}, "MyTable")
+	assert.Nil(t, err)
+	assert.Len(t, names, 0)
+}
+
+// fakeGSICloudWatch returns the Sum of the metrics of the active indexes only
+type fakeGSICloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	sums map[string]float64
+}
+
+func (f fakeGSICloudWatch) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	var index string
+	for _, d := range input.Dimensions {
+		if aws.StringValue(d.Name) == "GlobalSecondaryIndexName" {
+			index = aws.StringValue(d.Value)
+		}
+	}
+	sum, ok := f.sums[index+"/"+aws.StringValue(input.MetricName)]
+	if !ok {
+		return &cloudwatch.GetMetricStatisticsOutput{}, nil
+	}
+	return &cloudwatch.GetMetricStatisticsOutput{
+		Datapoints: []*cloudwatch.Datapoint{{Timestamp: aws.Time(time.Now()), Sum: aws.Float64(sum)}},
+	}, nil
+}
+
+func TestFetchGSIMetrics(t *testing.T) {
+	cw := fakeGSICloudWatch{sums: map[string]float64{
+		"by.user/ConsumedReadCapacityUnits":  120,
+		"by.user/ConsumedWriteCapacityUnits": 30,
+		"by.user/ReadThrottleEvents":         2,
+	}}
+	stats, err := fetchGSIMetrics(cw, "MyTable", "by.user")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"gsi.by_user.ConsumedReadCapacityUnits":  2.0,
+		"gsi.by_user.ConsumedWriteCapacityUnits": 0.5,
+		"gsi.by_user.ReadThrottleEvents":         2.0,
+	}, stats)
+
+	// idle indexes have no datapoints
+	stats, err = fetchGSIMetrics(cw, "MyTable", "ByDate")
+	assert.Nil(t, err)
+	assert.Len(t, stats, 0)
+}
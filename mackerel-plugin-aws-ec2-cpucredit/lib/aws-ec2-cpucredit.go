@@ -3,14 +3,14 @@ package mpawsec2cpucredit
 import (
 	"errors"
 	"flag"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 var graphdef = map[string]mp.Graphs{
@@ -24,12 +24,43 @@ var graphdef = map[string]mp.Graphs{
 	},
 }
 
+// surplusGraphdef is for the instances which can run in unlimited mode
+var surplusGraphdef = map[string]mp.Graphs{
+	"ec2.cpucredit_surplus": {
+		Label: "EC2 CPU Surplus Credit",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "surplus_balance", Label: "Surplus Balance", Diff: false},
+			{Name: "surplus_charged", Label: "Surplus Charged", Diff: false},
+		},
+	},
+}
+
+// surplusFamilies are the instance families reporting the surplus credits of unlimited mode
+var surplusFamilies = map[string]bool{
+	"t3":  true,
+	"t3a": true,
+	"t4g": true,
+}
+
 // CPUCreditPlugin is a mackerel plugin
 type CPUCreditPlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	InstanceID      string
+	InstanceType    string
+}
+
+// instanceFamily returns the family of the instance type, e.g. t3 of t3.micro
+func instanceFamily(instanceType string) string {
+	return strings.SplitN(instanceType, ".", 2)[0]
+}
+
+func (p CPUCreditPlugin) hasSurplusCredits() bool {
+	return surplusFamilies[instanceFamily(p.InstanceType)]
 }
 
 func getLastPointAverage(cw *cloudwatch.CloudWatch, dimension *cloudwatch.Dimension, metricName string) (float64, error) {
@@ -73,19 +104,17 @@ func getLastPointAverage(cw *cloudwatch.CloudWatch, dimension *cloudwatch.Dimens
 
 // FetchMetrics fetch the metrics
 func (p CPUCreditPlugin) FetchMetrics() (map[string]float64, error) {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return nil, err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
-	}
-
 	cw := cloudwatch.New(sess, config)
 
 	dimension := &cloudwatch.Dimension{
@@ -105,34 +134,62 @@ func (p CPUCreditPlugin) FetchMetrics() (map[string]float64, error) {
 		return nil, err
 	}
 
+	if p.hasSurplusCredits() {
+		for name, metricName := range map[string]string{
+			"surplus_balance": "CPUSurplusCreditBalance",
+			"surplus_charged": "CPUSurplusCreditsCharged",
+		} {
+			v, err := getLastPointAverage(cw, dimension, metricName)
+			if err != nil {
+				log.Printf("%s: %s", metricName, err)
+				continue
+			}
+			stat[name] = v
+		}
+	}
+
 	return stat, nil
 }
 
 // GraphDefinition for plugin
 func (p CPUCreditPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	if !p.hasSurplusCredits() {
+		return graphdef
+	}
+	graphs := make(map[string]mp.Graphs)
+	for k, v := range graphdef {
+		graphs[k] = v
+	}
+	for k, v := range surplusGraphdef {
+		graphs[k] = v
+	}
+	return graphs
 }
 
 // Do the plugin
 func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
 	optInstanceID := flag.String("instance-id", "", "Instance ID")
+	optInstanceType := flag.String("instance-type", "", "Instance type (e.g. t3.micro)")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	var cpucredit CPUCreditPlugin
+	cpucredit.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&cpucredit.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
 	flag.Parse()
 
-	var cpucredit CPUCreditPlugin
+	// the region is resolved from AWS_REGION or the instance metadata if not specified
+	cpucredit.Region = *optRegion
+	cpucredit.InstanceID = *optInstanceID
+	cpucredit.InstanceType = *optInstanceType
 
-	if *optRegion == "" || *optInstanceID == "" {
-		ec2metadata := ec2metadata.New(session.New())
-		if ec2metadata.Available() {
-			cpucredit.Region, _ = ec2metadata.Region()
-			cpucredit.InstanceID, _ = ec2metadata.GetMetadata("instance-id")
-		}
-	} else {
-		cpucredit.Region = *optRegion
-		cpucredit.InstanceID = *optInstanceID
+	md := awsutil.NewMetadata()
+	if cpucredit.InstanceID == "" {
+		cpucredit.InstanceID, _ = md.InstanceID()
+	}
+	if cpucredit.InstanceType == "" {
+		cpucredit.InstanceType, _ = md.InstanceType()
 	}
 
 	cpucredit.AccessKeyID = *optAccessKeyID
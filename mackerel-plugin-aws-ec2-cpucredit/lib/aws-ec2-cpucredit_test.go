@@ -0,0 +1,54 @@
+package mpawsec2cpucredit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphDefinition(t *testing.T) {
+	for _, tt := range []struct {
+		instanceType string
+		surplus      bool
+	}{
+		{"t2.micro", false},
+		{"t3.micro", true},
+		{"t3a.large", true},
+		{"t4g.nano", true},
+		{"", false},
+	} {
+		p := CPUCreditPlugin{InstanceType: tt.instanceType}
+		graphs := p.GraphDefinition()
+		assert.Contains(t, graphs, "ec2.cpucredit", tt.instanceType)
+		_, ok := graphs["ec2.cpucredit_surplus"]
+		assert.Equal(t, tt.surplus, ok, tt.instanceType)
+	}
+}
+
+// the instance type is available on instances requiring IMDSv2
+func TestInstanceTypeWithIMDSv2(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+			w.Write([]byte("token"))
+		case r.Header.Get("X-Aws-Ec2-Metadata-Token") != "token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/instance-type":
+			w.Write([]byte("t3.micro"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	md := awsutil.NewMetadata()
+	md.Endpoint = ts.URL
+	instanceType, err := md.InstanceType()
+	assert.Nil(t, err)
+	assert.Equal(t, "t3.micro", instanceType)
+	assert.Equal(t, "t3", instanceFamily(instanceType))
+}
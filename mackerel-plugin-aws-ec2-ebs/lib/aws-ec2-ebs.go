@@ -3,22 +3,25 @@ package mpawsec2ebs
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 var metricPeriodDefault = 300
 var metricPeriodByVolumeType = map[string]int{
 	"io1": 60,
+	"io2": 60,
+	"gp3": 60,
 }
 
 var baseGraphs = []string{
@@ -30,15 +33,35 @@ var baseGraphs = []string{
 	"ec2.ebs.idle_time.#",
 }
 
+// for the volume types with burst buckets (gp2, st1 and sc1)
 var defaultGraphs = append([]string{
 	"ec2.ebs.burst_balance.#",
 }, baseGraphs...)
 
-var io1Graphs = append([]string{
+// for the volume types with provisioned IOPS and throughput (io1, io2 and gp3)
+var provisionedGraphs = append([]string{
 	"ec2.ebs.throughput_delivered.#",
 	"ec2.ebs.consumed_ops.#",
+	"ec2.ebs.exceeded_check.#",
 }, baseGraphs...)
 
+var graphsByVolumeType = map[string][]string{
+	"gp2":      defaultGraphs,
+	"st1":      defaultGraphs,
+	"sc1":      defaultGraphs,
+	"io1":      provisionedGraphs,
+	"io2":      provisionedGraphs,
+	"gp3":      provisionedGraphs,
+	"standard": baseGraphs,
+}
+
+func graphsForVolumeType(volumeType string) []string {
+	if graphs, ok := graphsByVolumeType[volumeType]; ok {
+		return graphs
+	}
+	return baseGraphs
+}
+
 type cloudWatchSetting struct {
 	MetricName string
 	Statistics string
@@ -95,6 +118,15 @@ var cloudwatchdefs = map[string](cloudWatchSetting){
 		MetricName: "VolumeConsumedReadWriteOps", Statistics: "Sum",
 		CalcFunc: func(val float64, period float64) float64 { return val },
 	},
+	// reported only for the volumes attached to Nitro-based instances
+	"ec2.ebs.exceeded_check.#.iops": cloudWatchSetting{
+		MetricName: "VolumeIOPSExceededCheck", Statistics: "Average",
+		CalcFunc: func(val float64, period float64) float64 { return val },
+	},
+	"ec2.ebs.exceeded_check.#.throughput": cloudWatchSetting{
+		MetricName: "VolumeThroughputExceededCheck", Statistics: "Average",
+		CalcFunc: func(val float64, period float64) float64 { return val },
+	},
 	"ec2.ebs.burst_balance.#.burst_balance": cloudWatchSetting{
 		MetricName: "BurstBalance", Statistics: "Average",
 		CalcFunc: func(val float64, period float64) float64 { return val },
@@ -162,6 +194,14 @@ var graphdef = map[string]mp.Graphs{
 			{Name: "consumed_ops", Label: "Consumed Ops", Diff: false},
 		},
 	},
+	"ec2.ebs.exceeded_check.#": {
+		Label: "EBS Provisioned Performance Exceeded Check",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "iops", Label: "IOPS", Diff: false},
+			{Name: "throughput", Label: "Throughput", Diff: false},
+		},
+	},
 	"ec2.ebs.burst_balance.#": {
 		Label: "EBS Burst Balance",
 		Unit:  "percentage",
@@ -178,42 +218,91 @@ type EBSPlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	InstanceID      string
-	Credentials     *credentials.Credentials
-	EC2             *ec2.EC2
-	CloudWatch      *cloudwatch.CloudWatch
-	Volumes         []*ec2.Volume
+	VolumeIDs       []string
+	KeyByDevice     bool
+	// Metadata resolves the region and the block device mapping on EC2 instances, sharing the session token of IMDSv2
+	Metadata   *awsutil.Metadata
+	EC2        *ec2.EC2
+	CloudWatch *cloudwatch.CloudWatch
+	Volumes    []*ec2.Volume
 }
 
 func (p *EBSPlugin) prepare() error {
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		p.Credentials = credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, "")
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+		Metadata:        p.Metadata,
+	}.NewSession()
+	if err != nil {
+		return err
 	}
 
-	p.EC2 = ec2.New(session.New(&aws.Config{Credentials: p.Credentials, Region: &p.Region}))
-	resp, err := p.EC2.DescribeVolumes(&ec2.DescribeVolumesInput{
+	p.EC2 = ec2.New(sess, config)
+	p.CloudWatch = cloudwatch.New(sess, config)
+
+	volumes, err := describeVolumes(p.EC2, p.InstanceID, p.VolumeIDs)
+	if err != nil {
+		return err
+	}
+
+	p.Volumes = volumes
+	if len(p.Volumes) == 0 {
+		if p.Metadata != nil {
+			if devices, err := p.Metadata.BlockDeviceMapping(); err == nil {
+				return fmt.Errorf("DescribeVolumes response has no volumes of %s, whose block device mapping is %v", p.InstanceID, devices)
+			}
+		}
+		return errors.New("DescribeVolumes response has no volumes")
+	}
+
+	return nil
+}
+
+// describeVolumes returns the volumes attached to the instance, or only the specified ones of them
+func describeVolumes(svc ec2iface.EC2API, instanceID string, volumeIDs []string) ([]*ec2.Volume, error) {
+	input := &ec2.DescribeVolumesInput{
 		Filters: []*ec2.Filter{
 			{
 				Name: aws.String("attachment.instance-id"),
 				Values: []*string{
-					&p.InstanceID,
+					aws.String(instanceID),
 				},
 			},
 		},
-	})
-	if err != nil {
-		return err
 	}
-	if resp.NextToken != nil {
-		return errors.New("DescribeVolumes response has NextToken")
+	if len(volumeIDs) > 0 {
+		input.VolumeIds = aws.StringSlice(volumeIDs)
 	}
 
-	p.Volumes = resp.Volumes
-	if len(p.Volumes) == 0 {
-		return errors.New("DescribeVolumes response has no volumes")
+	var volumes []*ec2.Volume
+	err := svc.DescribeVolumesPages(input, func(page *ec2.DescribeVolumesOutput, lastPage bool) bool {
+		volumes = append(volumes, page.Volumes...)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	return volumes, nil
+}
 
-	return nil
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// volumeKey returns the wildcard part of the metric names for the volume
+func (p EBSPlugin) volumeKey(vol *ec2.Volume) string {
+	if p.KeyByDevice {
+		for _, a := range vol.Attachments {
+			if aws.StringValue(a.InstanceId) == p.InstanceID && a.Device != nil {
+				return invalidKeyRe.ReplaceAllString(strings.TrimPrefix(*a.Device, "/dev/"), "_")
+			}
+		}
+	}
+	return normalizeVolumeID(*vol.VolumeId)
 }
 
 var errNoDataPoint = errors.New("fetched no datapoints")
@@ -272,16 +361,9 @@ func (p EBSPlugin) getLastPoint(vol *ec2.Volume, metricName string, statType str
 // FetchMetrics fetch the metrics
 func (p EBSPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]interface{})
-	p.CloudWatch = cloudwatch.New(session.New(&aws.Config{Credentials: p.Credentials, Region: &p.Region}))
 	for _, vol := range p.Volumes {
-		volumeID := normalizeVolumeID(*vol.VolumeId)
-		graphs := defaultGraphs
-		if *vol.VolumeType == "io1" {
-			graphs = io1Graphs
-		} else {
-			graphs = defaultGraphs
-		}
-		for _, graphName := range graphs {
+		volumeID := p.volumeKey(vol)
+		for _, graphName := range graphsForVolumeType(aws.StringValue(vol.VolumeType)) {
 			for _, metric := range graphdef[graphName].Metrics {
 				metricKey := graphName + "." + metric.Name
 				cloudwatchdef := cloudwatchdefs[metricKey]
@@ -311,27 +393,49 @@ func normalizeVolumeID(volumeID string) string {
 	return strings.Replace(volumeID, ".", "_", -1)
 }
 
+func parseVolumeIDs(s string) []string {
+	var volumeIDs []string
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			volumeIDs = append(volumeIDs, id)
+		}
+	}
+	return volumeIDs
+}
+
 // Do the plugin
 func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
 	optInstanceID := flag.String("instance-id", "", "Instance ID")
+	optVolumeIDs := flag.String("volume-ids", "", "Comma separated volume IDs (default: all volumes attached to the instance)")
+	optKeyBy := flag.String("key-by", "volume-id", "Name volumes in metric names by 'volume-id' or 'device'")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	flag.Parse()
-
 	var ebs EBSPlugin
+	ebs.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&ebs.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	ebs.Region = *optRegion
 	ebs.InstanceID = *optInstanceID
-
-	// get metadata in ec2 instance
-	ec2MC := ec2metadata.New(session.New())
-	if *optRegion == "" {
-		ebs.Region, _ = ec2MC.Region()
+	ebs.VolumeIDs = parseVolumeIDs(*optVolumeIDs)
+	switch *optKeyBy {
+	case "volume-id":
+	case "device":
+		ebs.KeyByDevice = true
+	default:
+		log.Fatalf("'%s' is invalid key-by", *optKeyBy)
 	}
+
+	// get metadata in ec2 instance, by IMDSv2 or IMDSv1
+	ebs.Metadata = awsutil.NewMetadata()
 	if *optInstanceID == "" {
-		ebs.InstanceID, _ = ec2MC.GetMetadata("instance-id")
+		instanceID, err := ebs.Metadata.InstanceID()
+		if err != nil {
+			log.Fatalf("failed to get the instance ID from the instance metadata, or specify -instance-id: %s", err)
+		}
+		ebs.InstanceID = instanceID
 	}
 
 	ebs.AccessKeyID = *optAccessKeyID
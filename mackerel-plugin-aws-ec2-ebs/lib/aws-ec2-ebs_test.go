@@ -0,0 +1,82 @@
+package mpawsec2ebs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEC2Client struct {
+	ec2iface.EC2API
+	input *ec2.DescribeVolumesInput
+	pages []*ec2.DescribeVolumesOutput
+}
+
+func (m *mockEC2Client) DescribeVolumesPages(input *ec2.DescribeVolumesInput, fn func(*ec2.DescribeVolumesOutput, bool) bool) error {
+	m.input = input
+	for i, page := range m.pages {
+		if !fn(page, i == len(m.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestDescribeVolumes(t *testing.T) {
+	m := &mockEC2Client{pages: []*ec2.DescribeVolumesOutput{
+		{Volumes: []*ec2.Volume{{VolumeId: aws.String("vol-1")}, {VolumeId: aws.String("vol-2")}}, NextToken: aws.String("next")},
+		{Volumes: []*ec2.Volume{{VolumeId: aws.String("vol-3")}}},
+	}}
+	volumes, err := describeVolumes(m, "i-1234", nil)
+	assert.Nil(t, err)
+	assert.Len(t, volumes, 3, "all pages are read")
+	assert.Nil(t, m.input.VolumeIds)
+	assert.Equal(t, "i-1234", *m.input.Filters[0].Values[0])
+
+	_, err = describeVolumes(m, "i-1234", []string{"vol-1", "vol-3"})
+	assert.Nil(t, err)
+	assert.Equal(t, aws.StringSlice([]string{"vol-1", "vol-3"}), m.input.VolumeIds)
+}
+
+func TestParseVolumeIDs(t *testing.T) {
+	assert.Nil(t, parseVolumeIDs(""))
+	assert.Equal(t, []string{"vol-1", "vol-2"}, parseVolumeIDs("vol-1, vol-2,"))
+}
+
+func TestGraphsForVolumeType(t *testing.T) {
+	assert.Contains(t, graphsForVolumeType("gp2"), "ec2.ebs.burst_balance.#")
+	assert.Contains(t, graphsForVolumeType("st1"), "ec2.ebs.burst_balance.#")
+	assert.NotContains(t, graphsForVolumeType("gp3"), "ec2.ebs.burst_balance.#")
+	assert.Contains(t, graphsForVolumeType("gp3"), "ec2.ebs.throughput_delivered.#")
+	assert.Contains(t, graphsForVolumeType("io2"), "ec2.ebs.exceeded_check.#")
+	assert.Equal(t, baseGraphs, graphsForVolumeType("unknown"))
+
+	for _, graphs := range graphsByVolumeType {
+		for _, graphName := range graphs {
+			for _, metric := range graphdef[graphName].Metrics {
+				_, ok := cloudwatchdefs[graphName+"."+metric.Name]
+				assert.True(t, ok, graphName+"."+metric.Name)
+			}
+		}
+	}
+}
+
+func TestVolumeKey(t *testing.T) {
+	vol := &ec2.Volume{
+		VolumeId: aws.String("vol-0123456789abcdef0"),
+		Attachments: []*ec2.VolumeAttachment{
+			{InstanceId: aws.String("i-1234"), Device: aws.String("/dev/sdf")},
+		},
+	}
+	p := EBSPlugin{InstanceID: "i-1234"}
+	assert.Equal(t, "vol-0123456789abcdef0", p.volumeKey(vol))
+
+	p.KeyByDevice = true
+	assert.Equal(t, "sdf", p.volumeKey(vol))
+
+	p.InstanceID = "i-5678"
+	assert.Equal(t, "vol-0123456789abcdef0", p.volumeKey(vol), "falls back to volume ID")
+}
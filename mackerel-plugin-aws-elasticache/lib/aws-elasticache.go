@@ -9,11 +9,11 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elasticache"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 var metricsdefMemcached = []string{
@@ -32,7 +32,7 @@ var metricsdefRedis = []string{
 	"CurrConnections", "Evictions", "Reclaimed", "NewConnections", "BytesUsedForCache",
 	"CacheHits", "CacheMisses", "ReplicationLag", "GetTypeCmds", "SetTypeCmds",
 	"KeyBasedCmds", "StringBasedCmds", "HashBasedCmds", "ListBasedCmds", "SetBasedCmds",
-	"SortedSetBasedCmds", "CurrItems",
+	"SortedSetBasedCmds", "CurrItems", "EngineCPUUtilization", "DatabaseMemoryUsagePercentage",
 }
 
 var graphdefMemcached = map[string]mp.Graphs{
@@ -157,6 +157,14 @@ var graphdefRedis = map[string]mp.Graphs{
 			{Name: "CPUUtilization", Label: "CPUUtilization"},
 		},
 	},
+	// EngineCPUUtilization is the utilization of the core running the Redis process
+	"ecache.EngineCPUUtilization": {
+		Label: "ECache Engine CPU Utilization",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "EngineCPUUtilization", Label: "EngineCPUUtilization"},
+		},
+	},
 	"ecache.SwapUsage": {
 		Label: "ECache Swap Usage",
 		Unit:  "bytes",
@@ -171,6 +179,21 @@ var graphdefRedis = map[string]mp.Graphs{
 			{Name: "FreeableMemory", Label: "FreeableMemory"},
 		},
 	},
+	"ecache.DatabaseMemoryUsagePercentage": {
+		Label: "ECache Database Memory Usage",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "DatabaseMemoryUsagePercentage", Label: "DatabaseMemoryUsagePercentage"},
+		},
+	},
+	// .ReplicationLag ...Only valid for read replicas
+	"ecache.ReplicationLag": {
+		Label: "ECache Replication Lag",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "ReplicationLag", Label: "ReplicationLag"},
+		},
+	},
 	"ecache.NetworkTraffic": {
 		Label: "ECache Network Traffic",
 		Unit:  "bytes",
@@ -238,10 +261,14 @@ type ECachePlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	CacheClusterID  string
 	CacheNodeID     string
 	ElastiCacheType string
 	CacheMetrics    []string
+	// CacheNodes are the nodes of the replication group, whose metrics are posted per node
+	CacheNodes []cacheNode
 }
 
 func getLastPoint(cloudWatch *cloudwatch.CloudWatch, dimensions []*cloudwatch.Dimension, metricName string) (float64, error) {
@@ -279,33 +306,66 @@ func getLastPoint(cloudWatch *cloudwatch.CloudWatch, dimensions []*cloudwatch.Di
 	return latestVal, nil
 }
 
+func (p ECachePlugin) session() (*session.Session, *aws.Config, error) {
+	return awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
+}
+
+func (p ECachePlugin) elastiCache() (*elasticache.ElastiCache, error) {
+	sess, config, err := p.session()
+	if err != nil {
+		return nil, err
+	}
+	return elasticache.New(sess, config), nil
+}
+
 // FetchMetrics fetch elasticache values
 func (p ECachePlugin) FetchMetrics() (map[string]float64, error) {
-	sess, err := session.NewSession()
+	sess, config, err := p.session()
 	if err != nil {
 		return nil, err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
+	cloudWatch := cloudwatch.New(sess, config)
+
+	if len(p.CacheNodes) == 0 {
+		return p.fetchNode(cloudWatch, p.CacheClusterID, p.CacheNodeID), nil
 	}
 
-	cloudWatch := cloudwatch.New(sess, config)
+	// metrics of the nodes are in the graphs with the wildcard for the node
+	graphKeys := make(map[string]string)
+	for k, g := range p.graphDefinition() {
+		for _, m := range g.Metrics {
+			graphKeys[m.Name] = k
+		}
+	}
+	stat := make(map[string]float64)
+	for _, node := range p.CacheNodes {
+		for met, v := range p.fetchNode(cloudWatch, node.ClusterID, node.NodeID) {
+			if k, ok := graphKeys[met]; ok {
+				stat[k+"."+node.key()+"."+met] = v
+			}
+		}
+	}
+	return stat, nil
+}
 
+func (p ECachePlugin) fetchNode(cloudWatch *cloudwatch.CloudWatch, clusterID, nodeID string) map[string]float64 {
 	stat := make(map[string]float64)
 
 	perInstances := []*cloudwatch.Dimension{
 		{
 			Name:  aws.String("CacheClusterId"),
-			Value: aws.String(p.CacheClusterID),
+			Value: aws.String(clusterID),
 		},
 		{
 			Name:  aws.String("CacheNodeId"),
-			Value: aws.String(p.CacheNodeID),
+			Value: aws.String(nodeID),
 		},
 	}
 
@@ -314,15 +374,13 @@ func (p ECachePlugin) FetchMetrics() (map[string]float64, error) {
 		if err == nil {
 			stat[met] = v
 		} else {
-			log.Printf("%s: %s", met, err)
+			log.Printf("%s %s: %s", clusterID, met, err)
 		}
 	}
-
-	return stat, nil
+	return stat
 }
 
-// GraphDefinition graph definition
-func (p ECachePlugin) GraphDefinition() map[string]mp.Graphs {
+func (p ECachePlugin) graphDefinition() map[string]mp.Graphs {
 	switch p.ElastiCacheType {
 	case "memcached":
 		return graphdefMemcached
@@ -334,6 +392,19 @@ func (p ECachePlugin) GraphDefinition() map[string]mp.Graphs {
 	}
 }
 
+// GraphDefinition graph definition
+func (p ECachePlugin) GraphDefinition() map[string]mp.Graphs {
+	graphdef := p.graphDefinition()
+	if len(p.CacheNodes) == 0 {
+		return graphdef
+	}
+	graphs := make(map[string]mp.Graphs)
+	for k, g := range graphdef {
+		graphs[k+".#"] = g
+	}
+	return graphs
+}
+
 // Do the plugin
 func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
@@ -341,20 +412,13 @@ func Do() {
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optCacheClusterID := flag.String("cache-cluster-id", "", "Cache Cluster Id")
 	optCacheNodeID := flag.String("cache-node-id", "0001", "Cache Node Id")
-	optElastiCacheType := flag.String("elasticache-type", "", "ElastiCache type")
+	optElastiCacheType := flag.String("elasticache-type", "", "ElastiCache type ('memcached' or 'redis', detected if not specified)")
+	flag.StringVar(optElastiCacheType, "engine", "", "Alias of -elasticache-type")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	flag.Parse()
-
 	var ecache ECachePlugin
-
-	if *optRegion == "" {
-		ec2metadata := ec2metadata.New(session.New())
-		if ec2metadata.Available() {
-			ecache.Region, _ = ec2metadata.Region()
-		}
-	} else {
-		ecache.Region = *optRegion
-	}
+	ecache.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&ecache.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	ecache.Region = *optRegion
 	ecache.AccessKeyID = *optAccessKeyID
@@ -362,10 +426,29 @@ func Do() {
 	ecache.CacheClusterID = *optCacheClusterID
 	ecache.CacheNodeID = *optCacheNodeID
 	ecache.ElastiCacheType = *optElastiCacheType
+
+	// detect the engine and the nodes of the replication group if permitted
+	svc, err := ecache.elastiCache()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	engine, nodes, err := describeCluster(svc, ecache.CacheClusterID)
+	if err != nil {
+		if ecache.ElastiCacheType == "" {
+			log.Printf("failed to detect elasticache-type, specify -elasticache-type: %s", err)
+			os.Exit(1)
+		}
+	} else {
+		if ecache.ElastiCacheType == "" {
+			ecache.ElastiCacheType = engine
+		}
+		ecache.CacheNodes = nodes
+	}
 	switch ecache.ElastiCacheType {
 	case "memcached":
 		ecache.CacheMetrics = metricsdefMemcached
-	case "redis":
+	case "redis", "valkey":
+		ecache.ElastiCacheType = "redis"
 		ecache.CacheMetrics = metricsdefRedis
 	default:
 		log.Printf("elasticache-type is 'memcached' or 'redis'.")
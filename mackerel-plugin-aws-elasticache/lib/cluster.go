@@ -0,0 +1,73 @@
+package mpawselasticache
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+)
+
+// cacheNode is a node of the replication group given by -cache-cluster-id
+type cacheNode struct {
+	ClusterID string
+	NodeID    string
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// key is used in the metric names instead of the wildcard
+func (n cacheNode) key() string {
+	return invalidKeyRe.ReplaceAllString(n.ClusterID+"-"+n.NodeID, "_")
+}
+
+// describeCluster returns the engine of the cache cluster or the replication group of id,
+// and the nodes if it is a replication group.
+func describeCluster(svc elasticacheiface.ElastiCacheAPI, id string) (string, []cacheNode, error) {
+	groups, err := svc.DescribeReplicationGroups(&elasticache.DescribeReplicationGroupsInput{
+		ReplicationGroupId: aws.String(id),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != elasticache.ErrCodeReplicationGroupNotFoundFault {
+			return "", nil, err
+		}
+	}
+	if err == nil && len(groups.ReplicationGroups) > 0 {
+		var (
+			engine string
+			nodes  []cacheNode
+		)
+		for _, member := range groups.ReplicationGroups[0].MemberClusters {
+			clusters, err := svc.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+				CacheClusterId:    member,
+				ShowCacheNodeInfo: aws.Bool(true),
+			})
+			if err != nil {
+				return "", nil, err
+			}
+			for _, c := range clusters.CacheClusters {
+				engine = aws.StringValue(c.Engine)
+				for _, n := range c.CacheNodes {
+					nodes = append(nodes, cacheNode{
+						ClusterID: aws.StringValue(c.CacheClusterId),
+						NodeID:    aws.StringValue(n.CacheNodeId),
+					})
+				}
+			}
+		}
+		return engine, nodes, nil
+	}
+
+	clusters, err := svc.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+		CacheClusterId: aws.String(id),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if len(clusters.CacheClusters) == 0 {
+		return "", nil, fmt.Errorf("cache cluster %s is not found", id)
+	}
+	return aws.StringValue(clusters.CacheClusters[0].Engine), nil, nil
+}
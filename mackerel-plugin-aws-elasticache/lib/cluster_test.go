@@ -0,0 +1,82 @@
+package mpawselasticache
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeElastiCache struct {
+	elasticacheiface.ElastiCacheAPI
+	groups   map[string][]string
+	clusters map[string]*elasticache.CacheCluster
+}
+
+func (f fakeElastiCache) DescribeReplicationGroups(input *elasticache.DescribeReplicationGroupsInput) (*elasticache.DescribeReplicationGroupsOutput, error) {
+	members, ok := f.groups[aws.StringValue(input.ReplicationGroupId)]
+	if !ok {
+		return nil, awserr.New(elasticache.ErrCodeReplicationGroupNotFoundFault, "not found", nil)
+	}
+	return &elasticache.DescribeReplicationGroupsOutput{
+		ReplicationGroups: []*elasticache.ReplicationGroup{{MemberClusters: aws.StringSlice(members)}},
+	}, nil
+}
+
+func (f fakeElastiCache) DescribeCacheClusters(input *elasticache.DescribeCacheClustersInput) (*elasticache.DescribeCacheClustersOutput, error) {
+	c, ok := f.clusters[aws.StringValue(input.CacheClusterId)]
+	if !ok {
+		return nil, awserr.New(elasticache.ErrCodeCacheClusterNotFoundFault, "not found", nil)
+	}
+	return &elasticache.DescribeCacheClustersOutput{CacheClusters: []*elasticache.CacheCluster{c}}, nil
+}
+
+func newFakeElastiCache() fakeElastiCache {
+	cluster := func(id, engine string) *elasticache.CacheCluster {
+		return &elasticache.CacheCluster{
+			CacheClusterId: aws.String(id),
+			Engine:         aws.String(engine),
+			CacheNodes:     []*elasticache.CacheNode{{CacheNodeId: aws.String("0001")}},
+		}
+	}
+	return fakeElastiCache{
+		groups: map[string][]string{"redis01": {"redis01-001", "redis01-002"}},
+		clusters: map[string]*elasticache.CacheCluster{
+			"redis01-001":   cluster("redis01-001", "redis"),
+			"redis01-002":   cluster("redis01-002", "redis"),
+			"elasticache01": cluster("elasticache01", "memcached"),
+		},
+	}
+}
+
+func TestDescribeCluster(t *testing.T) {
+	svc := newFakeElastiCache()
+
+	engine, nodes, err := describeCluster(svc, "redis01")
+	assert.Nil(t, err)
+	assert.Equal(t, "redis", engine)
+	assert.Equal(t, []cacheNode{{"redis01-001", "0001"}, {"redis01-002", "0001"}}, nodes)
+	assert.Equal(t, "redis01-001-0001", nodes[0].key())
+
+	engine, nodes, err = describeCluster(svc, "elasticache01")
+	assert.Nil(t, err)
+	assert.Equal(t, "memcached", engine)
+	assert.Nil(t, nodes)
+
+	_, _, err = describeCluster(svc, "unknown")
+	assert.NotNil(t, err)
+}
+
+func TestGraphDefinitionPerNode(t *testing.T) {
+	p := ECachePlugin{ElastiCacheType: "redis"}
+	assert.Contains(t, p.GraphDefinition(), "ecache.EngineCPUUtilization")
+
+	p.CacheNodes = []cacheNode{{"redis01-001", "0001"}}
+	graphs := p.GraphDefinition()
+	assert.Contains(t, graphs, "ecache.EngineCPUUtilization.#")
+	assert.Contains(t, graphs, "ecache.ReplicationLag.#")
+	assert.NotContains(t, graphs, "ecache.EngineCPUUtilization")
+}
@@ -6,11 +6,9 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 const (
@@ -172,25 +170,25 @@ type ESPlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	Domain          string
 	ClientID        string
 	CloudWatch      *cloudwatch.CloudWatch
 }
 
 func (p *ESPlugin) prepare() error {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
-	}
-
 	p.CloudWatch = cloudwatch.New(sess, config)
 	return nil
 }
@@ -317,18 +315,10 @@ func Do() {
 	optClientID := flag.String("client-id", "", "AWS Client ID")
 	optDomain := flag.String("domain", "", "ES domain name")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	flag.Parse()
-
 	var es ESPlugin
-
-	if *optRegion == "" {
-		ec2metadata := ec2metadata.New(session.New())
-		if ec2metadata.Available() {
-			es.Region, _ = ec2metadata.Region()
-		}
-	} else {
-		es.Region = *optRegion
-	}
+	es.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&es.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	es.Region = *optRegion
 	es.Domain = *optDomain
@@ -4,14 +4,13 @@ import (
 	"errors"
 	"flag"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 var graphdef = map[string]mp.Graphs{
@@ -40,6 +39,10 @@ type statType int
 const (
 	stAve statType = iota
 	stSum
+	stP50
+	stP90
+	stP95
+	stP99
 )
 
 func (s statType) String() string {
@@ -48,36 +51,69 @@ func (s statType) String() string {
 		return "Average"
 	case stSum:
 		return "Sum"
+	case stP50:
+		return "p50"
+	case stP90:
+		return "p90"
+	case stP95:
+		return "p95"
+	case stP99:
+		return "p99"
 	}
 	return ""
 }
 
+// extended reports whether s is a percentile given by ExtendedStatistics
+func (s statType) extended() bool {
+	return s == stP50 || s == stP90 || s == stP95 || s == stP99
+}
+
 // ELBPlugin elb plugin for mackerel
 type ELBPlugin struct {
 	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	AZs             []*string
 	CloudWatch      *cloudwatch.CloudWatch
 	Lbname          string
+	// LBType is classic, alb or nlb
+	LBType         string
+	PerTargetGroup bool
+	TargetGroups   []*string
+	// AZTargetGroups are the target groups in each AvailabilityZone of NLB
+	AZTargetGroups []azTargetGroup
+}
+
+func (p ELBPlugin) namespace() string {
+	switch p.LBType {
+	case "alb":
+		return "AWS/ApplicationELB"
+	case "nlb":
+		return "AWS/NetworkELB"
+	}
+	return "AWS/ELB"
 }
 
 func (p *ELBPlugin) prepare() error {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
-	}
-
 	p.CloudWatch = cloudwatch.New(sess, config)
 
+	if p.LBType != "classic" {
+		return p.prepareV2()
+	}
+
 	ret, err := p.CloudWatch.ListMetrics(&cloudwatch.ListMetricsInput{
 		Namespace: aws.String("AWS/ELB"),
 		Dimensions: []*cloudwatch.DimensionFilter{
@@ -109,15 +145,20 @@ func (p *ELBPlugin) prepare() error {
 func (p ELBPlugin) getLastPoint(dimensions []*cloudwatch.Dimension, metricName string, sTyp statType) (float64, error) {
 	now := time.Now()
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+	input := &cloudwatch.GetMetricStatisticsInput{
 		Dimensions: dimensions,
 		StartTime:  aws.Time(now.Add(time.Duration(120) * time.Second * -1)), // 2 min (to fetch at least 1 data-point)
 		EndTime:    aws.Time(now),
 		MetricName: aws.String(metricName),
 		Period:     aws.Int64(60),
-		Statistics: []*string{aws.String(sTyp.String())},
-		Namespace:  aws.String("AWS/ELB"),
-	})
+		Namespace:  aws.String(p.namespace()),
+	}
+	if sTyp.extended() {
+		input.ExtendedStatistics = []*string{aws.String(sTyp.String())}
+	} else {
+		input.Statistics = []*string{aws.String(sTyp.String())}
+	}
+	response, err := p.CloudWatch.GetMetricStatistics(input)
 	if err != nil {
 		return 0, err
 	}
@@ -140,6 +181,8 @@ func (p ELBPlugin) getLastPoint(dimensions []*cloudwatch.Dimension, metricName s
 			latestVal = *dp.Average
 		case stSum:
 			latestVal = *dp.Sum
+		default:
+			latestVal = aws.Float64Value(dp.ExtendedStatistics[sTyp.String()])
 		}
 	}
 
@@ -148,6 +191,10 @@ func (p ELBPlugin) getLastPoint(dimensions []*cloudwatch.Dimension, metricName s
 
 // FetchMetrics fetch elb metrics
 func (p ELBPlugin) FetchMetrics() (map[string]float64, error) {
+	if p.LBType != "classic" {
+		return p.fetchMetricsV2(), nil
+	}
+
 	stat := make(map[string]float64)
 
 	// HostCount per AZ
@@ -199,54 +246,88 @@ func (p ELBPlugin) FetchMetrics() (map[string]float64, error) {
 
 // GraphDefinition for Mackerel
 func (p ELBPlugin) GraphDefinition() map[string]mp.Graphs {
-	for _, grp := range [...]string{"elb.healthy_host_count", "elb.unhealthy_host_count"} {
+	if p.LBType != "classic" {
+		return p.graphDefinitionV2()
+	}
+
+	for grp, g := range hostCountGraphs(p.AZs) {
+		g.Label = "ELB " + g.Label
+		graphdef["elb."+grp] = g
+	}
+
+	return graphdef
+}
+
+// hostCountGraphs returns the graphs of the host counts per AvailabilityZone
+func hostCountGraphs(azs []*string) map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	for _, grp := range [...]string{"healthy_host_count", "unhealthy_host_count"} {
 		var namePre string
 		var label string
 		switch grp {
-		case "elb.healthy_host_count":
+		case "healthy_host_count":
 			namePre = "HealthyHostCount_"
-			label = "ELB Healthy Host Count"
-		case "elb.unhealthy_host_count":
+			label = "Healthy Host Count"
+		case "unhealthy_host_count":
 			namePre = "UnHealthyHostCount_"
-			label = "ELB Unhealthy Host Count"
+			label = "Unhealthy Host Count"
 		}
 
 		var metrics []mp.Metrics
-		for _, az := range p.AZs {
+		for _, az := range azs {
 			metrics = append(metrics, mp.Metrics{Name: namePre + *az, Label: *az, Stacked: true})
 		}
-		graphdef[grp] = mp.Graphs{
+		graphs[grp] = mp.Graphs{
 			Label:   label,
 			Unit:    "integer",
 			Metrics: metrics,
 		}
 	}
-
-	return graphdef
+	return graphs
 }
 
 // Do the plugin
 func Do() {
 	optRegion := flag.String("region", "", "AWS Region")
-	optLbname := flag.String("lbname", "", "ELB Name")
+	optLbname := flag.String("lbname", "", "ELB Name (LoadBalancer dimension like app/my-alb/50dc6c495c0c9188 for alb and nlb)")
+	optLBType := flag.String("load-balancer-type", "classic", "Load balancer type ('classic' (or 'clb'), 'alb' or 'nlb')")
+	optPerTargetGroup := flag.Bool("per-target-group", false, "Post metrics per target group (alb and nlb only)")
+	optTargetGroups := flag.String("target-group", "", "Comma separated TargetGroup dimensions like targetgroup/my-tg/73e2d6bc24d8a067 to post metrics per target group (alb and nlb only)")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	flag.Parse()
-
 	var elb ELBPlugin
+	elb.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&elb.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
-	if *optRegion == "" {
-		ec2metadata := ec2metadata.New(session.New())
-		if ec2metadata.Available() {
-			elb.Region, _ = ec2metadata.Region()
-		}
-	} else {
-		elb.Region = *optRegion
-	}
+	elb.Region = *optRegion
 	elb.AccessKeyID = *optAccessKeyID
 	elb.SecretAccessKey = *optSecretAccessKey
 	elb.Lbname = *optLbname
+	elb.LBType = *optLBType
+	elb.PerTargetGroup = *optPerTargetGroup
+	for _, tg := range strings.Split(*optTargetGroups, ",") {
+		if tg = strings.TrimSpace(tg); tg != "" {
+			elb.TargetGroups = append(elb.TargetGroups, aws.String(tg))
+		}
+	}
+	if len(elb.TargetGroups) > 0 {
+		elb.PerTargetGroup = true
+	}
+	switch elb.LBType {
+	case "classic", "clb":
+		elb.LBType = "classic"
+		if elb.PerTargetGroup {
+			log.Fatalln("-per-target-group and -target-group are for alb and nlb")
+		}
+	case "alb", "nlb":
+		if elb.Lbname == "" {
+			log.Fatalln("-lbname is required for alb and nlb")
+		}
+	default:
+		log.Fatalf("'%s' is invalid load-balancer-type", elb.LBType)
+	}
 
 	err := elb.prepare()
 	if err != nil {
@@ -0,0 +1,57 @@
+package mpawselb
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	assert.Equal(t, "AWS/ELB", ELBPlugin{LBType: "classic"}.namespace())
+	assert.Equal(t, "AWS/ApplicationELB", ELBPlugin{LBType: "alb"}.namespace())
+	assert.Equal(t, "AWS/NetworkELB", ELBPlugin{LBType: "nlb"}.namespace())
+}
+
+func TestTargetGroupKey(t *testing.T) {
+	assert.Equal(t, "my-tg", targetGroupKey("targetgroup/my-tg/73e2d6bc24d8a067"))
+	assert.Equal(t, "my_tg", targetGroupKey("my.tg"))
+}
+
+func TestGraphDefinitionV2(t *testing.T) {
+	p := ELBPlugin{LBType: "alb"}
+	graphs := p.GraphDefinition()
+	assert.Len(t, graphs, 6)
+	assert.Equal(t, "ALB Target Response Time", graphs["alb.target_response_time"].Label)
+	assert.Len(t, graphs["alb.target_response_time"].Metrics, 4)
+	assert.Len(t, graphs["alb.http_target"].Metrics, 3)
+	_, ok := graphs["alb.target_group_requests.#"]
+	assert.False(t, ok)
+
+	p.PerTargetGroup = true
+	graphs = p.GraphDefinition()
+	assert.Len(t, graphs, 10)
+	assert.Len(t, graphs["alb.target_group_hosts.#"].Metrics, 2)
+
+	p = ELBPlugin{LBType: "nlb", PerTargetGroup: true}
+	graphs = p.GraphDefinition()
+	assert.Len(t, graphs, 4)
+	assert.Equal(t, "NLB Active Flow Count", graphs["nlb.active_flows"].Label)
+	assert.Equal(t, "HealthyHostCount", graphs["nlb.target_group_hosts.#"].Metrics[0].Name)
+
+	// the host counts per AvailabilityZone
+	p.AZs = []*string{aws.String("ap-northeast-1a"), aws.String("ap-northeast-1c")}
+	graphs = p.GraphDefinition()
+	assert.Len(t, graphs, 6)
+	assert.Equal(t, "NLB Healthy Host Count", graphs["nlb.healthy_host_count"].Label)
+	assert.Equal(t, "UnHealthyHostCount_ap-northeast-1c", graphs["nlb.unhealthy_host_count"].Metrics[1].Name)
+}
+
+func TestGraphDefinitionClassic(t *testing.T) {
+	p := ELBPlugin{LBType: "classic", AZs: []*string{aws.String("ap-northeast-1a")}}
+	graphs := p.GraphDefinition()
+	assert.Equal(t, "ELB Healthy Host Count", graphs["elb.healthy_host_count"].Label)
+	assert.Equal(t, "HealthyHostCount_ap-northeast-1a", graphs["elb.healthy_host_count"].Metrics[0].Name)
+	assert.Equal(t, "ELB Unhealthy Host Count", graphs["elb.unhealthy_host_count"].Label)
+}
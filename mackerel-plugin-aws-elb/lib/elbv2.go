@@ -0,0 +1,299 @@
+package mpawselb
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// metricV2 is a metric of Application and Network Load Balancers
+type metricV2 struct {
+	name  string // the name in CloudWatch
+	key   string // the name in Mackerel
+	sTyp  statType
+	graph string
+}
+
+var albMetrics = []metricV2{
+	{"RequestCount", "RequestCount", stSum, "requests"},
+	{"TargetResponseTime", "TargetResponseTime_p50", stP50, "target_response_time"},
+	{"TargetResponseTime", "TargetResponseTime_p90", stP90, "target_response_time"},
+	{"TargetResponseTime", "TargetResponseTime_p95", stP95, "target_response_time"},
+	{"TargetResponseTime", "TargetResponseTime_p99", stP99, "target_response_time"},
+	{"HTTPCode_Target_2XX_Count", "HTTPCode_Target_2XX_Count", stSum, "http_target"},
+	{"HTTPCode_Target_4XX_Count", "HTTPCode_Target_4XX_Count", stSum, "http_target"},
+	{"HTTPCode_Target_5XX_Count", "HTTPCode_Target_5XX_Count", stSum, "http_target"},
+	{"HTTPCode_ELB_5XX_Count", "HTTPCode_ELB_5XX_Count", stSum, "http_elb"},
+	{"ActiveConnectionCount", "ActiveConnectionCount", stSum, "active_connections"},
+	{"RejectedConnectionCount", "RejectedConnectionCount", stSum, "rejected_connections"},
+}
+
+var nlbMetrics = []metricV2{
+	{"ActiveFlowCount", "ActiveFlowCount", stAve, "active_flows"},
+	{"ProcessedBytes", "ProcessedBytes", stSum, "processed_bytes"},
+	{"TCP_Client_Reset_Count", "TCP_Client_Reset_Count", stSum, "tcp_resets"},
+}
+
+// metrics with the TargetGroup dimension posted with -per-target-group
+var albTargetGroupMetrics = []metricV2{
+	{"RequestCount", "RequestCount", stSum, "target_group_requests"},
+	{"TargetResponseTime", "TargetResponseTime_p99", stP99, "target_group_response_time"},
+	{"HTTPCode_Target_5XX_Count", "HTTPCode_Target_5XX_Count", stSum, "target_group_http_target"},
+	{"HealthyHostCount", "HealthyHostCount", stAve, "target_group_hosts"},
+	{"UnHealthyHostCount", "UnHealthyHostCount", stAve, "target_group_hosts"},
+}
+
+var nlbTargetGroupMetrics = []metricV2{
+	{"HealthyHostCount", "HealthyHostCount", stAve, "target_group_hosts"},
+	{"UnHealthyHostCount", "UnHealthyHostCount", stAve, "target_group_hosts"},
+}
+
+var graphsV2 = map[string]mp.Graphs{
+	"requests": {
+		Label: "Request Count",
+		Unit:  "integer",
+	},
+	"target_response_time": {
+		Label: "Target Response Time",
+		Unit:  "float",
+	},
+	"http_target": {
+		Label: "HTTP Target Count",
+		Unit:  "integer",
+	},
+	"http_elb": {
+		Label: "HTTP ELB Count",
+		Unit:  "integer",
+	},
+	"active_connections": {
+		Label: "Active Connection Count",
+		Unit:  "integer",
+	},
+	"rejected_connections": {
+		Label: "Rejected Connection Count",
+		Unit:  "integer",
+	},
+	"active_flows": {
+		Label: "Active Flow Count",
+		Unit:  "integer",
+	},
+	"processed_bytes": {
+		Label: "Processed Bytes",
+		Unit:  "bytes",
+	},
+	"tcp_resets": {
+		Label: "TCP Client Reset Count",
+		Unit:  "integer",
+	},
+	"target_group_requests": {
+		Label: "Target Group Request Count",
+		Unit:  "integer",
+	},
+	"target_group_response_time": {
+		Label: "Target Group Response Time",
+		Unit:  "float",
+	},
+	"target_group_http_target": {
+		Label: "Target Group HTTP Target Count",
+		Unit:  "integer",
+	},
+	"target_group_hosts": {
+		Label: "Target Group Host Count",
+		Unit:  "integer",
+	},
+}
+
+var metricLabelsV2 = map[string]string{
+	"RequestCount":              "Requests",
+	"TargetResponseTime_p50":    "p50",
+	"TargetResponseTime_p90":    "p90",
+	"TargetResponseTime_p95":    "p95",
+	"TargetResponseTime_p99":    "p99",
+	"HTTPCode_Target_2XX_Count": "2XX",
+	"HTTPCode_Target_4XX_Count": "4XX",
+	"HTTPCode_Target_5XX_Count": "5XX",
+	"HTTPCode_ELB_5XX_Count":    "5XX",
+	"ActiveConnectionCount":     "Active",
+	"RejectedConnectionCount":   "Rejected",
+	"ActiveFlowCount":           "Active",
+	"ProcessedBytes":            "Processed",
+	"TCP_Client_Reset_Count":    "Client Reset",
+	"HealthyHostCount":          "Healthy",
+	"UnHealthyHostCount":        "Unhealthy",
+}
+
+func (p ELBPlugin) metricsV2() (lb, targetGroup []metricV2) {
+	if p.LBType == "nlb" {
+		return nlbMetrics, nlbTargetGroupMetrics
+	}
+	return albMetrics, albTargetGroupMetrics
+}
+
+// azTargetGroup is a target group in an AvailabilityZone, whose hosts of NLB are counted per AvailabilityZone
+type azTargetGroup struct {
+	az          string
+	targetGroup string
+}
+
+// prepareV2 lists the target groups of the load balancer unless they are given by -target-group, and the ones per
+// AvailabilityZone for NLB
+func (p *ELBPlugin) prepareV2() error {
+	if p.LBType == "nlb" {
+		if err := p.listAZTargetGroups(); err != nil {
+			return err
+		}
+	}
+	if !p.PerTargetGroup || len(p.TargetGroups) > 0 {
+		return nil
+	}
+	ret, err := p.CloudWatch.ListMetrics(&cloudwatch.ListMetricsInput{
+		Namespace: aws.String(p.namespace()),
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{Name: aws.String("LoadBalancer"), Value: aws.String(p.Lbname)},
+			{Name: aws.String("TargetGroup")},
+		},
+		MetricName: aws.String("HealthyHostCount"),
+	})
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, met := range ret.Metrics {
+		// skip the metrics per AvailabilityZone
+		if len(met.Dimensions) != 2 {
+			continue
+		}
+		for _, d := range met.Dimensions {
+			if aws.StringValue(d.Name) == "TargetGroup" && !seen[aws.StringValue(d.Value)] {
+				seen[aws.StringValue(d.Value)] = true
+				p.TargetGroups = append(p.TargetGroups, d.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// listAZTargetGroups lists the target groups in each AvailabilityZone, since the host counts of NLB have no
+// dimensions of the AvailabilityZone without the TargetGroup
+func (p *ELBPlugin) listAZTargetGroups() error {
+	ret, err := p.CloudWatch.ListMetrics(&cloudwatch.ListMetricsInput{
+		Namespace: aws.String(p.namespace()),
+		Dimensions: []*cloudwatch.DimensionFilter{
+			{Name: aws.String("LoadBalancer"), Value: aws.String(p.Lbname)},
+			{Name: aws.String("TargetGroup")},
+			{Name: aws.String("AvailabilityZone")},
+		},
+		MetricName: aws.String("HealthyHostCount"),
+	})
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, met := range ret.Metrics {
+		var atg azTargetGroup
+		for _, d := range met.Dimensions {
+			switch aws.StringValue(d.Name) {
+			case "AvailabilityZone":
+				atg.az = aws.StringValue(d.Value)
+			case "TargetGroup":
+				atg.targetGroup = aws.StringValue(d.Value)
+			}
+		}
+		if atg.az == "" || atg.targetGroup == "" {
+			continue
+		}
+		if !seen[atg.az] {
+			seen[atg.az] = true
+			p.AZs = append(p.AZs, aws.String(atg.az))
+		}
+		p.AZTargetGroups = append(p.AZTargetGroups, atg)
+	}
+	return nil
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// targetGroupKey returns my-tg of targetgroup/my-tg/73e2d6bc24d8a067
+func targetGroupKey(targetGroup string) string {
+	if fields := strings.Split(targetGroup, "/"); len(fields) == 3 {
+		targetGroup = fields[1]
+	}
+	return invalidKeyRe.ReplaceAllString(targetGroup, "_")
+}
+
+func (p ELBPlugin) fetchMetricsV2() map[string]float64 {
+	stat := make(map[string]float64)
+	lbMetrics, tgMetrics := p.metricsV2()
+
+	lb := &cloudwatch.Dimension{
+		Name:  aws.String("LoadBalancer"),
+		Value: aws.String(p.Lbname),
+	}
+	for _, met := range lbMetrics {
+		v, err := p.getLastPoint([]*cloudwatch.Dimension{lb}, met.name, met.sTyp)
+		if err == nil {
+			stat[met.key] = v
+		}
+	}
+
+	// the host counts of the target groups are summed up per AvailabilityZone
+	for _, atg := range p.AZTargetGroups {
+		d := []*cloudwatch.Dimension{
+			lb,
+			{Name: aws.String("TargetGroup"), Value: aws.String(atg.targetGroup)},
+			{Name: aws.String("AvailabilityZone"), Value: aws.String(atg.az)},
+		}
+		for _, met := range []string{"HealthyHostCount", "UnHealthyHostCount"} {
+			v, err := p.getLastPoint(d, met, stAve)
+			if err == nil {
+				stat[met+"_"+atg.az] += v
+			}
+		}
+	}
+
+	for _, tg := range p.TargetGroups {
+		d := []*cloudwatch.Dimension{lb, {Name: aws.String("TargetGroup"), Value: tg}}
+		for _, met := range tgMetrics {
+			v, err := p.getLastPoint(d, met.name, met.sTyp)
+			if err == nil {
+				stat[p.LBType+"."+met.graph+"."+targetGroupKey(*tg)+"."+met.key] = v
+			}
+		}
+	}
+	return stat
+}
+
+func (p ELBPlugin) graphDefinitionV2() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	label := strings.ToUpper(p.LBType) + " "
+	add := func(key string, met metricV2) {
+		g, ok := graphs[key]
+		if !ok {
+			g = graphsV2[met.graph]
+			g.Label = label + g.Label
+		}
+		g.Metrics = append(g.Metrics, mp.Metrics{Name: met.key, Label: metricLabelsV2[met.key]})
+		graphs[key] = g
+	}
+
+	lbMetrics, tgMetrics := p.metricsV2()
+	for _, met := range lbMetrics {
+		add(p.LBType+"."+met.graph, met)
+	}
+	if p.PerTargetGroup {
+		for _, met := range tgMetrics {
+			add(p.LBType+"."+met.graph+".#", met)
+		}
+	}
+	if len(p.AZs) > 0 {
+		for grp, g := range hostCountGraphs(p.AZs) {
+			g.Label = label + g.Label
+			graphs[p.LBType+"."+grp] = g
+		}
+	}
+	return graphs
+}
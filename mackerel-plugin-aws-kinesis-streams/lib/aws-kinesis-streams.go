@@ -4,14 +4,16 @@ import (
 	"errors"
 	"flag"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 const (
@@ -35,8 +37,57 @@ type KinesisStreamsPlugin struct {
 
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	Region          string
 	CloudWatch      *cloudwatch.CloudWatch
+	// Consumers are the names of enhanced fan-out consumers of the stream
+	Consumers []string
+	// ShardLevel enables the metrics of enhanced shard-level monitoring
+	ShardLevel bool
+	Shards     []string
+	// IteratorAgeStatistics are the statistics of the stream-level GetRecords.IteratorAgeMilliseconds
+	IteratorAgeStatistics []string
+}
+
+var defaultIteratorAgeStatistics = []string{metricsTypeAverage, metricsTypeMaximum, metricsTypeMinimum}
+
+var percentileRe = regexp.MustCompile(`^p\d+(\.\d+)?$`)
+
+// isValidStatistic reports whether the statistic is supported by GetMetricStatistics
+func isValidStatistic(s string) bool {
+	switch s {
+	case metricsTypeSum, metricsTypeAverage, metricsTypeMaximum, metricsTypeMinimum:
+		return true
+	}
+	return percentileRe.MatchString(s)
+}
+
+func (p KinesisStreamsPlugin) iteratorAgeStatistics() []string {
+	if len(p.IteratorAgeStatistics) == 0 {
+		return defaultIteratorAgeStatistics
+	}
+	return p.IteratorAgeStatistics
+}
+
+// iteratorAgeMetrics returns the metrics of the stream-level iterator age for the statistics, keeping the names of the
+// default ones
+func (p KinesisStreamsPlugin) iteratorAgeMetrics() []mp.Metrics {
+	var ms []mp.Metrics
+	for _, s := range p.iteratorAgeStatistics() {
+		switch s {
+		case metricsTypeAverage:
+			ms = append(ms, mp.Metrics{Name: "GetRecordsDelayAverageMilliseconds", Label: "Average"})
+		case metricsTypeMaximum:
+			ms = append(ms, mp.Metrics{Name: "GetRecordsDelayMaxMilliseconds", Label: "Max"})
+		case metricsTypeMinimum:
+			ms = append(ms, mp.Metrics{Name: "GetRecordsDelayMinMilliseconds", Label: "Min"})
+		default:
+			name := strings.Replace(strings.ToUpper(s[:1])+s[1:], ".", "_", -1)
+			ms = append(ms, mp.Metrics{Name: "GetRecordsDelay" + name + "Milliseconds", Label: s})
+		}
+	}
+	return ms
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -49,44 +100,89 @@ func (p KinesisStreamsPlugin) MetricKeyPrefix() string {
 
 // prepare creates CloudWatch instance
 func (p *KinesisStreamsPlugin) prepare() error {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
+	p.CloudWatch = cloudwatch.New(sess, config)
+
+	consumers, err := listConsumers(kinesis.New(sess, config), p.Name)
+	if err != nil {
+		// consumer metrics are optional, e.g. without kinesis:ListStreamConsumers
+		log.Printf("failed to list stream consumers: %s", err)
 	}
+	p.Consumers = consumers
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+	if p.ShardLevel {
+		shards, err := listShards(kinesis.New(sess, config), p.Name)
+		if err != nil {
+			return err
+		}
+		p.Shards = shards
+	}
 
 	return nil
 }
 
-// getLastPoint fetches a CloudWatch metric and parse
-func (p KinesisStreamsPlugin) getLastPoint(metric metrics) (float64, error) {
-	now := time.Now()
+// listConsumers returns the names of active enhanced fan-out consumers
+func listConsumers(svc kinesisiface.KinesisAPI, streamName string) ([]string, error) {
+	summary, err := svc.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: aws.String(streamName),
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	dimensions := []*cloudwatch.Dimension{
-		{
-			Name:  aws.String("StreamName"),
-			Value: aws.String(p.Name),
-		},
+	var consumers []string
+	input := &kinesis.ListStreamConsumersInput{
+		StreamARN: summary.StreamDescriptionSummary.StreamARN,
 	}
+	err = svc.ListStreamConsumersPages(input, func(page *kinesis.ListStreamConsumersOutput, lastPage bool) bool {
+		for _, c := range page.Consumers {
+			if aws.StringValue(c.ConsumerStatus) == kinesis.ConsumerStatusActive {
+				consumers = append(consumers, aws.StringValue(c.ConsumerName))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return consumers, nil
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// consumerKey sanitizes the consumer name to be used in metric names
+func consumerKey(name string) string {
+	return invalidKeyRe.ReplaceAllString(name, "_")
+}
+
+// getLastPoint fetches a CloudWatch metric and parse
+func (p KinesisStreamsPlugin) getLastPoint(metric metrics, dimensions []*cloudwatch.Dimension) (float64, error) {
+	now := time.Now()
 
-	response, err := p.CloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+	input := &cloudwatch.GetMetricStatisticsInput{
 		Dimensions: dimensions,
 		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min
 		EndTime:    aws.Time(now),
 		MetricName: aws.String(metric.CloudWatchName),
 		Period:     aws.Int64(60),
-		Statistics: []*string{aws.String(metric.Type)},
 		Namespace:  aws.String(namespace),
-	})
+	}
+	if percentileRe.MatchString(metric.Type) {
+		input.ExtendedStatistics = []*string{aws.String(metric.Type)}
+	} else {
+		input.Statistics = []*string{aws.String(metric.Type)}
+	}
+	response, err := p.CloudWatch.GetMetricStatistics(input)
 	if err != nil {
 		return 0, err
 	}
@@ -113,22 +209,36 @@ func (p KinesisStreamsPlugin) getLastPoint(metric metrics) (float64, error) {
 			latestVal = *dp.Maximum
 		case metricsTypeMinimum:
 			latestVal = *dp.Minimum
+		default:
+			if v, ok := dp.ExtendedStatistics[metric.Type]; ok {
+				latestVal = *v
+			}
 		}
 	}
 
 	return latestVal, nil
 }
 
+// metrics of enhanced fan-out consumers, which take the ConsumerName dimension
+var consumerMetrics = [...]metrics{
+	{CloudWatchName: "SubscribeToShard.RateExceeded", MackerelName: "consumer_operations.#.RateExceeded", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShard.Success", MackerelName: "consumer_operations.#.SubscribeSuccess", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.Success", MackerelName: "consumer_operations.#.EventSuccess", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.Bytes", MackerelName: "consumer_bytes.#.Bytes", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.Records", MackerelName: "consumer_records.#.Records", Type: metricsTypeSum},
+	{CloudWatchName: "SubscribeToShardEvent.MillisBehindLatest", MackerelName: "consumer_delay.#.MillisBehindLatest", Type: metricsTypeMaximum},
+}
+
 // FetchMetrics fetch the metrics
 func (p KinesisStreamsPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]interface{})
 
-	for _, met := range [...]metrics{
+	streamDimension := &cloudwatch.Dimension{
+		Name:  aws.String("StreamName"),
+		Value: aws.String(p.Name),
+	}
+	streamMetrics := []metrics{
 		{CloudWatchName: "GetRecords.Bytes", MackerelName: "GetRecordsBytes", Type: metricsTypeSum},
-		// Max of IteratorAgeMilliseconds is useful especially when few of iterators are in trouble
-		{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMaxMilliseconds", Type: metricsTypeMaximum},
-		{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayMinMilliseconds", Type: metricsTypeMinimum},
-		{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: "GetRecordsDelayAverageMilliseconds", Type: metricsTypeAverage},
 		{CloudWatchName: "GetRecords.Latency", MackerelName: "GetRecordsLatency", Type: metricsTypeAverage},
 		{CloudWatchName: "GetRecords.Records", MackerelName: "GetRecordsRecords", Type: metricsTypeSum},
 		{CloudWatchName: "GetRecords.Success", MackerelName: "GetRecordsSuccess", Type: metricsTypeSum},
@@ -141,16 +251,50 @@ func (p KinesisStreamsPlugin) FetchMetrics() (map[string]interface{}, error) {
 		{CloudWatchName: "PutRecords.Latency", MackerelName: "PutRecordsLatency", Type: metricsTypeAverage},
 		{CloudWatchName: "PutRecords.Records", MackerelName: "PutRecordsRecords", Type: metricsTypeSum},
 		{CloudWatchName: "PutRecords.Success", MackerelName: "PutRecordsSuccess", Type: metricsTypeSum},
-		{CloudWatchName: "ReadProvidionedThroughputExceeded", MackerelName: "ReadThroughputExceeded", Type: metricsTypeAverage},
-		{CloudWatchName: "WriteProvidionedThroughputExceeded", MackerelName: "WriteThroughputExceeded", Type: metricsTypeAverage},
-	} {
-		v, err := p.getLastPoint(met)
+		{CloudWatchName: "ReadProvisionedThroughputExceeded", MackerelName: "ReadThroughputExceeded", Type: metricsTypeAverage},
+		{CloudWatchName: "WriteProvisionedThroughputExceeded", MackerelName: "WriteThroughputExceeded", Type: metricsTypeAverage},
+		// Sum is the number of throttled requests in the period
+		{CloudWatchName: "ReadProvisionedThroughputExceeded", MackerelName: "ReadThroughputExceededCount", Type: metricsTypeSum},
+		{CloudWatchName: "WriteProvisionedThroughputExceeded", MackerelName: "WriteThroughputExceededCount", Type: metricsTypeSum},
+	}
+	// Max of IteratorAgeMilliseconds is useful especially when few of iterators are in trouble
+	statistics := p.iteratorAgeStatistics()
+	for i, m := range p.iteratorAgeMetrics() {
+		streamMetrics = append(streamMetrics, metrics{CloudWatchName: "GetRecords.IteratorAgeMilliseconds", MackerelName: m.Name, Type: statistics[i]})
+	}
+	for _, met := range streamMetrics {
+		v, err := p.getLastPoint(met, []*cloudwatch.Dimension{streamDimension})
 		if err == nil {
 			stat[met.MackerelName] = v
 		} else {
 			log.Printf("%s: %s", met, err)
 		}
 	}
+
+	for _, consumer := range p.Consumers {
+		dimensions := []*cloudwatch.Dimension{
+			streamDimension,
+			{Name: aws.String("ConsumerName"), Value: aws.String(consumer)},
+		}
+		for _, met := range consumerMetrics {
+			v, err := p.getLastPoint(met, dimensions)
+			if err == nil {
+				stat[strings.Replace(met.MackerelName, "#", consumerKey(consumer), 1)] = v
+			} else {
+				log.Printf("%s %s: %s", consumer, met, err)
+			}
+		}
+	}
+
+	if len(p.Shards) > 0 {
+		shardStat, err := fetchShardMetrics(p.CloudWatch, p.Name, p.Shards, time.Now())
+		if err != nil {
+			log.Printf("failed to fetch shard-level metrics: %s", err)
+		}
+		for name, v := range shardStat {
+			stat[name] = v
+		}
+	}
 	return stat, nil
 }
 
@@ -171,13 +315,9 @@ func (p KinesisStreamsPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 		"iteratorage": {
-			Label: (labelPrefix + " Read Delay"),
-			Unit:  "integer",
-			Metrics: []mp.Metrics{
-				{Name: "GetRecordsDelayAverageMilliseconds", Label: "Average"},
-				{Name: "GetRecordsDelayMaxMilliseconds", Label: "Max"},
-				{Name: "GetRecordsDelayMinMilliseconds", Label: "Min"},
-			},
+			Label:   (labelPrefix + " Read Delay"),
+			Unit:    "integer",
+			Metrics: p.iteratorAgeMetrics(),
 		},
 		"latency": {
 			Label: (labelPrefix + " Operation Latency"),
@@ -214,6 +354,76 @@ func (p KinesisStreamsPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "WriteThroughputExceeded", Label: "Write"},
 			},
 		},
+		"throughput_exceeded": {
+			Label: (labelPrefix + " Throughput Exceeded"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ReadThroughputExceededCount", Label: "Read"},
+				{Name: "WriteThroughputExceededCount", Label: "Write"},
+			},
+		},
+	}
+	if len(p.Consumers) > 0 {
+		graphdef["consumer_operations.#"] = mp.Graphs{
+			Label: (labelPrefix + " Consumer Operations"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "SubscribeSuccess", Label: "SubscribeToShard Success"},
+				{Name: "EventSuccess", Label: "SubscribeToShardEvent Success"},
+				{Name: "RateExceeded", Label: "SubscribeToShard RateExceeded"},
+			},
+		}
+		graphdef["consumer_bytes.#"] = mp.Graphs{
+			Label: (labelPrefix + " Consumer Bytes"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "Bytes", Label: "Bytes"},
+			},
+		}
+		graphdef["consumer_records.#"] = mp.Graphs{
+			Label: (labelPrefix + " Consumer Records"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "Records", Label: "Records"},
+			},
+		}
+		graphdef["consumer_delay.#"] = mp.Graphs{
+			Label: (labelPrefix + " Consumer Read Delay"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "MillisBehindLatest", Label: "Max"},
+			},
+		}
+	}
+	if p.ShardLevel {
+		graphdef["shard_bytes.#"] = mp.Graphs{
+			Label: (labelPrefix + " Shard Incoming Bytes"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "IncomingBytes", Label: "Incoming"},
+			},
+		}
+		graphdef["shard_records.#"] = mp.Graphs{
+			Label: (labelPrefix + " Shard Incoming Records"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "IncomingRecords", Label: "Incoming"},
+			},
+		}
+		graphdef["shard_iteratorage.#"] = mp.Graphs{
+			Label: (labelPrefix + " Shard Read Delay"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "IteratorAgeMilliseconds", Label: "Max"},
+			},
+		}
+		graphdef["shard_throughput_exceeded.#"] = mp.Graphs{
+			Label: (labelPrefix + " Shard Throughput Exceeded"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "WriteThroughputExceeded", Label: "Write"},
+			},
+		}
 	}
 	return graphdef
 }
@@ -226,15 +436,28 @@ func Do() {
 	optIdentifier := flag.String("identifier", "", "Stream Name")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "kinesis-streams", "Metric key prefix")
-	flag.Parse()
-
+	optShardLevel := flag.Bool("shard-level", false, "Post the metrics of enhanced shard-level monitoring per shard")
+	optStatistic := flag.String("statistic", strings.Join(defaultIteratorAgeStatistics, ","), "Comma separated statistics of the stream-level iterator age, e.g. Maximum,p99")
 	var plugin KinesisStreamsPlugin
+	plugin.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&plugin.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Region = *optRegion
 	plugin.Name = *optIdentifier
 	plugin.Prefix = *optPrefix
+	plugin.ShardLevel = *optShardLevel
+	for _, s := range strings.Split(*optStatistic, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !isValidStatistic(s) {
+			log.Fatalf("invalid statistic: %s", s)
+		}
+		plugin.IteratorAgeStatistics = append(plugin.IteratorAgeStatistics, s)
+	}
 
 	err := plugin.prepare()
 	if err != nil {
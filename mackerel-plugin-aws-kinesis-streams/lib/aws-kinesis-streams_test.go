@@ -1,7 +1,14 @@
 package mpawskinesisstreams
 
 import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/stretchr/testify/assert"
 )
 
 func ExampleKinesisStreamsPlugin_GraphDefinition() {
@@ -12,5 +19,78 @@ func ExampleKinesisStreamsPlugin_GraphDefinition() {
 
 	// Output:
 	// # mackerel-agent-plugin
-	// {"graphs":{"my-stream.bytes":{"label":"My Stream Bytes","unit":"integer","metrics":[{"name":"GetRecordsBytes","label":"GetRecords","stacked":false},{"name":"IncomingBytes","label":"Total Incoming","stacked":false},{"name":"PutRecordBytes","label":"PutRecord","stacked":false},{"name":"PutRecordsBytes","label":"PutRecords","stacked":false}]},"my-stream.iteratorage":{"label":"My Stream Read Delay","unit":"integer","metrics":[{"name":"GetRecordsDelayAverageMilliseconds","label":"Average","stacked":false},{"name":"GetRecordsDelayMaxMilliseconds","label":"Max","stacked":false},{"name":"GetRecordsDelayMinMilliseconds","label":"Min","stacked":false}]},"my-stream.latency":{"label":"My Stream Operation Latency","unit":"integer","metrics":[{"name":"GetRecordsLatency","label":"GetRecords","stacked":false},{"name":"PutRecordLatency","label":"PutRecord","stacked":false},{"name":"PutRecordsLatency","label":"PutRecords","stacked":false}]},"my-stream.pending":{"label":"My Stream Pending Operations","unit":"integer","metrics":[{"name":"ReadThroughputExceeded","label":"Read","stacked":false},{"name":"WriteThroughputExceeded","label":"Write","stacked":false}]},"my-stream.records":{"label":"My Stream Records","unit":"integer","metrics":[{"name":"GetRecordsRecords","label":"GetRecords","stacked":false},{"name":"IncomingRecords","label":"Total Incoming","stacked":false},{"name":"PutRecordsRecords","label":"PutRecords","stacked":false}]},"my-stream.success":{"label":"My Stream Operation Success","unit":"integer","metrics":[{"name":"GetRecordsSuccess","label":"GetRecords","stacked":false},{"name":"PutRecordSuccess","label":"PutRecord","stacked":false},{"name":"PutRecordsSuccess","label":"PutRecords","stacked":false}]}}}
+	// {"graphs":{"my-stream.bytes":{"label":"My Stream Bytes","unit":"integer","metrics":[{"name":"GetRecordsBytes","label":"GetRecords","stacked":false},{"name":"IncomingBytes","label":"Total Incoming","stacked":false},{"name":"PutRecordBytes","label":"PutRecord","stacked":false},{"name":"PutRecordsBytes","label":"PutRecords","stacked":false}]},"my-stream.iteratorage":{"label":"My Stream Read Delay","unit":"integer","metrics":[{"name":"GetRecordsDelayAverageMilliseconds","label":"Average","stacked":false},{"name":"GetRecordsDelayMaxMilliseconds","label":"Max","stacked":false},{"name":"GetRecordsDelayMinMilliseconds","label":"Min","stacked":false}]},"my-stream.latency":{"label":"My Stream Operation Latency","unit":"integer","metrics":[{"name":"GetRecordsLatency","label":"GetRecords","stacked":false},{"name":"PutRecordLatency","label":"PutRecord","stacked":false},{"name":"PutRecordsLatency","label":"PutRecords","stacked":false}]},"my-stream.pending":{"label":"My Stream Pending Operations","unit":"integer","metrics":[{"name":"ReadThroughputExceeded","label":"Read","stacked":false},{"name":"WriteThroughputExceeded","label":"Write","stacked":false}]},"my-stream.records":{"label":"My Stream Records","unit":"integer","metrics":[{"name":"GetRecordsRecords","label":"GetRecords","stacked":false},{"name":"IncomingRecords","label":"Total Incoming","stacked":false},{"name":"PutRecordsRecords","label":"PutRecords","stacked":false}]},"my-stream.success":{"label":"My Stream Operation Success","unit":"integer","metrics":[{"name":"GetRecordsSuccess","label":"GetRecords","stacked":false},{"name":"PutRecordSuccess","label":"PutRecord","stacked":false},{"name":"PutRecordsSuccess","label":"PutRecords","stacked":false}]},"my-stream.throughput_exceeded":{"label":"My Stream Throughput Exceeded","unit":"integer","metrics":[{"name":"ReadThroughputExceededCount","label":"Read","stacked":false},{"name":"WriteThroughputExceededCount","label":"Write","stacked":false}]}}}
+}
+
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+	pages []*kinesis.ListStreamConsumersOutput
+}
+
+func (f fakeKinesis) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamName: input.StreamName,
+			StreamARN:  aws.String("arn:aws:kinesis:ap-northeast-1:123456789012:stream/" + *input.StreamName),
+		},
+	}, nil
+}
+
+func (f fakeKinesis) ListStreamConsumersPages(input *kinesis.ListStreamConsumersInput, fn func(*kinesis.ListStreamConsumersOutput, bool) bool) error {
+	for i, page := range f.pages {
+		if !fn(page, i == len(f.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestListConsumers(t *testing.T) {
+	svc := fakeKinesis{pages: []*kinesis.ListStreamConsumersOutput{
+		{Consumers: []*kinesis.Consumer{
+			{ConsumerName: aws.String("app-1"), ConsumerStatus: aws.String(kinesis.ConsumerStatusActive)},
+			{ConsumerName: aws.String("app-2"), ConsumerStatus: aws.String(kinesis.ConsumerStatusCreating)},
+		}, NextToken: aws.String("next")},
+		{Consumers: []*kinesis.Consumer{
+			{ConsumerName: aws.String("app.3"), ConsumerStatus: aws.String(kinesis.ConsumerStatusActive)},
+		}},
+	}}
+	consumers, err := listConsumers(svc, "my-stream")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app-1", "app.3"}, consumers)
+	assert.Equal(t, "app_3", consumerKey(consumers[1]))
+}
+
+func TestGraphDefinitionWithConsumers(t *testing.T) {
+	kinesis := KinesisStreamsPlugin{Prefix: "my-stream", Consumers: []string{"app-1"}}
+	graphs := kinesis.GraphDefinition()
+	assert.Len(t, graphs, 11)
+	assert.Equal(t, "MillisBehindLatest", graphs["consumer_delay.#"].Metrics[0].Name)
+	for _, met := range consumerMetrics {
+		name := strings.Replace(met.MackerelName, "#", "app-1", 1)
+		found := false
+		for key, g := range graphs {
+			for _, m := range g.Metrics {
+				if strings.Replace(key, "#", "app-1", 1)+"."+m.Name == name {
+					found = true
+				}
+			}
+		}
+		assert.True(t, found, name)
+	}
+}
+
+func TestIteratorAgeMetrics(t *testing.T) {
+	var kinesis KinesisStreamsPlugin
+	assert.Equal(t, "GetRecordsDelayAverageMilliseconds", kinesis.iteratorAgeMetrics()[0].Name)
+
+	kinesis.IteratorAgeStatistics = []string{"Maximum", "p99", "p99.9"}
+	assert.Equal(t, []mp.Metrics{
+		{Name: "GetRecordsDelayMaxMilliseconds", Label: "Max"},
+		{Name: "GetRecordsDelayP99Milliseconds", Label: "p99"},
+		{Name: "GetRecordsDelayP99_9Milliseconds", Label: "p99.9"},
+	}, kinesis.iteratorAgeMetrics())
+
+	assert.True(t, isValidStatistic("p99"))
+	assert.False(t, isValidStatistic("Median"))
 }
@@ -0,0 +1,108 @@
+package mpawskinesisstreams
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// maxMetricDataQueries is the maximum number of queries in a GetMetricData request
+const maxMetricDataQueries = 500
+
+// metrics of enhanced shard-level monitoring, which take the ShardId dimension
+var shardMetrics = [...]metrics{
+	{CloudWatchName: "IncomingBytes", MackerelName: "shard_bytes.#.IncomingBytes", Type: metricsTypeSum},
+	{CloudWatchName: "IncomingRecords", MackerelName: "shard_records.#.IncomingRecords", Type: metricsTypeSum},
+	{CloudWatchName: "IteratorAgeMilliseconds", MackerelName: "shard_iteratorage.#.IteratorAgeMilliseconds", Type: metricsTypeMaximum},
+	{CloudWatchName: "WriteProvisionedThroughputExceeded", MackerelName: "shard_throughput_exceeded.#.WriteThroughputExceeded", Type: metricsTypeSum},
+}
+
+// listShards returns the IDs of the open shards of the stream
+func listShards(svc kinesisiface.KinesisAPI, streamName string) ([]string, error) {
+	var shards []string
+	input := &kinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		res, err := svc.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range res.Shards {
+			// the closed shards after resharding have the ending sequence number
+			if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+				continue
+			}
+			shards = append(shards, aws.StringValue(s.ShardId))
+		}
+		if res.NextToken == nil {
+			break
+		}
+		// StreamName must not be specified with NextToken
+		input = &kinesis.ListShardsInput{NextToken: res.NextToken}
+	}
+	return shards, nil
+}
+
+// fetchShardMetrics fetches the metrics of the shards by GetMetricData, in the batches of maxMetricDataQueries queries
+func fetchShardMetrics(cw cloudwatchiface.CloudWatchAPI, streamName string, shards []string, now time.Time) (map[string]interface{}, error) {
+	var queries []*cloudwatch.MetricDataQuery
+	names := make(map[string]string)
+	for i, shard := range shards {
+		for j, met := range shardMetrics {
+			id := fmt.Sprintf("m%d_%d", i, j)
+			names[id] = strings.Replace(met.MackerelName, "#", shard, 1)
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String(met.CloudWatchName),
+						Dimensions: []*cloudwatch.Dimension{
+							{Name: aws.String("StreamName"), Value: aws.String(streamName)},
+							{Name: aws.String("ShardId"), Value: aws.String(shard)},
+						},
+					},
+					Period: aws.Int64(60),
+					Stat:   aws.String(met.Type),
+				},
+			})
+		}
+	}
+
+	stat := make(map[string]interface{})
+	for len(queries) > 0 {
+		n := len(queries)
+		if n > maxMetricDataQueries {
+			n = maxMetricDataQueries
+		}
+		input := &cloudwatch.GetMetricDataInput{
+			StartTime:         aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min
+			EndTime:           aws.Time(now),
+			MetricDataQueries: queries[:n],
+			ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+		}
+		err := cw.GetMetricDataPages(input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+			for _, r := range page.MetricDataResults {
+				name, ok := names[aws.StringValue(r.Id)]
+				if !ok || len(r.Values) == 0 {
+					continue
+				}
+				// the values are sorted by the timestamps descending, and the first page has the latest one
+				if _, ok := stat[name]; !ok {
+					stat[name] = aws.Float64Value(r.Values[0])
+				}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		queries = queries[n:]
+	}
+	return stat, nil
+}
@@ -0,0 +1,72 @@
+package mpawskinesisstreams
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeShardsKinesis struct {
+	kinesisiface.KinesisAPI
+	pages []*kinesis.ListShardsOutput
+}
+
+func (f fakeShardsKinesis) ListShards(input *kinesis.ListShardsInput) (*kinesis.ListShardsOutput, error) {
+	if input.NextToken == nil {
+		return f.pages[0], nil
+	}
+	return f.pages[1], nil
+}
+
+func TestListShards(t *testing.T) {
+	svc := fakeShardsKinesis{pages: []*kinesis.ListShardsOutput{
+		{Shards: []*kinesis.Shard{
+			{ShardId: aws.String("shardId-000000000000"), SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("1"), EndingSequenceNumber: aws.String("2")}},
+			{ShardId: aws.String("shardId-000000000001"), SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("3")}},
+		}, NextToken: aws.String("next")},
+		{Shards: []*kinesis.Shard{
+			{ShardId: aws.String("shardId-000000000002"), SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String("4")}},
+		}},
+	}}
+	shards, err := listShards(svc, "my-stream")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"shardId-000000000001", "shardId-000000000002"}, shards)
+}
+
+type fakeMetricDataCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	batches []int
+}
+
+func (f *fakeMetricDataCloudWatch) GetMetricDataPages(input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool) error {
+	f.batches = append(f.batches, len(input.MetricDataQueries))
+	var results []*cloudwatch.MetricDataResult
+	for _, q := range input.MetricDataQueries {
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:     q.Id,
+			Values: []*float64{aws.Float64(float64(len(q.MetricStat.Metric.Dimensions))), aws.Float64(0)},
+		})
+	}
+	fn(&cloudwatch.GetMetricDataOutput{MetricDataResults: results}, true)
+	return nil
+}
+
+func TestFetchShardMetrics(t *testing.T) {
+	var shards []string
+	for i := 0; i < 130; i++ {
+		shards = append(shards, fmt.Sprintf("shardId-%012d", i))
+	}
+	cw := &fakeMetricDataCloudWatch{}
+	stat, err := fetchShardMetrics(cw, "my-stream", shards, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{500, 20}, cw.batches)
+	assert.Len(t, stat, 520)
+	assert.Equal(t, 2.0, stat["shard_iteratorage.shardId-000000000000.IteratorAgeMilliseconds"])
+}
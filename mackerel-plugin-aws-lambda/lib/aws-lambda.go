@@ -3,15 +3,17 @@ package mpawslambda
 import (
 	"flag"
 	"log"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 const (
@@ -20,12 +22,16 @@ const (
 	metricsTypeSum     = "Sum"
 	metricsTypeMaximum = "Maximum"
 	metricsTypeMinimum = "Minimum"
+	metricsTypeP95     = "p95"
+	metricsTypeP99     = "p99"
 )
 
 // has 1 CloudWatch MetricName and corresponding N Mackerel Metrics
 type metricsGroup struct {
 	CloudWatchName string
 	Metrics        []metric
+	// AccountLevel is true if the metric is only available across all functions
+	AccountLevel bool
 }
 
 type metric struct {
@@ -36,13 +42,25 @@ type metric struct {
 // LambdaPlugin mackerel plugin for aws Lambda
 type LambdaPlugin struct {
 	FunctionName string
+	Qualifier    string
 	Prefix       string
 
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 	Region          string
 
 	CloudWatch *cloudwatch.CloudWatch
+
+	// AllFunctions posts the metrics of the functions listed by ListFunctions per function, filtered by
+	// FunctionPattern and FunctionTag (key=value)
+	AllFunctions    bool
+	FunctionPattern *regexp.Regexp
+	FunctionTag     string
+	Functions       []string
+	// DurationStatistics are the statistics of Duration per function
+	DurationStatistics []string
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -53,45 +71,83 @@ func (p LambdaPlugin) MetricKeyPrefix() string {
 // prepare creates CloudWatch instance
 func (p *LambdaPlugin) prepare() error {
 
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
-	}
-
 	p.CloudWatch = cloudwatch.New(sess, config)
 
+	if p.AllFunctions {
+		functions, err := listFunctions(lambda.New(sess, config), p.FunctionPattern)
+		if err != nil {
+			return err
+		}
+		if p.FunctionTag != "" {
+			kv := strings.SplitN(p.FunctionTag, "=", 2)
+			if len(kv) != 2 {
+				kv = append(kv, "")
+			}
+			functions, err = filterFunctionsByTag(resourcegroupstaggingapi.New(sess, config), functions, kv[0], kv[1])
+			if err != nil {
+				return err
+			}
+		}
+		p.Functions = functions
+	}
+
 	return nil
 }
 
+// functionDimensions returns CloudWatch dimensions of the function, or the alias or version if qualifier is given
+func functionDimensions(functionName, qualifier string) []*cloudwatch.Dimension {
+	if functionName == "" {
+		return nil
+	}
+	dimensions := []*cloudwatch.Dimension{{
+		Name:  aws.String("FunctionName"),
+		Value: aws.String(functionName),
+	}}
+	if qualifier != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("Resource"),
+			Value: aws.String(functionName + ":" + qualifier),
+		})
+	}
+	return dimensions
+}
+
+func isExtendedStatistic(typ string) bool {
+	return typ == metricsTypeP95 || typ == metricsTypeP99
+}
+
 // getLastPoint fetches a CloudWatch metric and parse
-func getLastPointFromCloudWatch(cw cloudwatchiface.CloudWatchAPI, functionName string, metric metricsGroup) (*cloudwatch.Datapoint, error) {
+func getLastPointFromCloudWatch(cw cloudwatchiface.CloudWatchAPI, dimensions []*cloudwatch.Dimension, metric metricsGroup) (*cloudwatch.Datapoint, error) {
 	now := time.Now()
-	statsInput := make([]*string, len(metric.Metrics))
-	for i, typ := range metric.Metrics {
-		statsInput[i] = aws.String(typ.Type)
+	var statsInput, extendedStatsInput []*string
+	for _, typ := range metric.Metrics {
+		if isExtendedStatistic(typ.Type) {
+			extendedStatsInput = append(extendedStatsInput, aws.String(typ.Type))
+		} else {
+			statsInput = append(statsInput, aws.String(typ.Type))
+		}
 	}
 	input := &cloudwatch.GetMetricStatisticsInput{
 		// Usually Cloudwatch datapoints delays about 2 mins, so retrieve last 3 mins (with 1 min buffer)
-		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)),
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metric.CloudWatchName),
-		Period:     aws.Int64(60),
-		Statistics: statsInput,
-		Namespace:  aws.String(namespace),
-	}
-	if functionName != "" {
-		input.Dimensions = []*cloudwatch.Dimension{{
-			Name:  aws.String("FunctionName"),
-			Value: aws.String(functionName),
-		}}
+		StartTime:          aws.Time(now.Add(time.Duration(180) * time.Second * -1)),
+		EndTime:            aws.Time(now),
+		MetricName:         aws.String(metric.CloudWatchName),
+		Period:             aws.Int64(60),
+		Statistics:         statsInput,
+		ExtendedStatistics: extendedStatsInput,
+		Namespace:          aws.String(namespace),
+		Dimensions:         dimensions,
 	}
 	response, err := cw.GetMetricStatistics(input)
 	if err != nil {
@@ -128,6 +184,10 @@ func transformMetrics(stats map[string]interface{}) map[string]interface{} {
 		}
 		delete(stats, "invocations_total")
 	}
+	// CloudWatch reports utilization as a fraction
+	if utilization, ok := stats["provisioned_concurrency_utilization"].(float64); ok {
+		stats["provisioned_concurrency_utilization"] = utilization * 100
+	}
 	return stats
 }
 
@@ -143,6 +203,10 @@ func mergeStatsFromDatapoint(stats map[string]interface{}, dp *cloudwatch.Datapo
 				stats[met.MackerelName] = *dp.Maximum
 			case metricsTypeMinimum:
 				stats[met.MackerelName] = *dp.Minimum
+			default:
+				if v, ok := dp.ExtendedStatistics[met.Type]; ok {
+					stats[met.MackerelName] = *v
+				}
 			}
 		}
 	}
@@ -166,19 +230,46 @@ var lambdaMetricsGroup = []metricsGroup{
 		{MackerelName: "duration_avg", Type: metricsTypeAverage},
 		{MackerelName: "duration_max", Type: metricsTypeMaximum},
 		{MackerelName: "duration_min", Type: metricsTypeMinimum},
+		{MackerelName: "duration_p95", Type: metricsTypeP95},
+		{MackerelName: "duration_p99", Type: metricsTypeP99},
+	}},
+	{CloudWatchName: "ConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "concurrent_executions", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "UnreservedConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "unreserved_concurrent_executions", Type: metricsTypeMaximum},
+	}, AccountLevel: true},
+	// the metrics below are reported only for the functions with provisioned concurrency
+	{CloudWatchName: "ProvisionedConcurrentExecutions", Metrics: []metric{
+		{MackerelName: "provisioned_concurrent_executions", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrencyUtilization", Metrics: []metric{
+		{MackerelName: "provisioned_concurrency_utilization", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "ProvisionedConcurrencySpilloverInvocations", Metrics: []metric{
+		{MackerelName: "provisioned_concurrency_spillover_invocations", Type: metricsTypeSum},
 	}},
 }
 
 // FetchMetrics fetch the metrics
 func (p LambdaPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if p.AllFunctions {
+		return fetchFunctionsMetrics(p.CloudWatch, p.Functions, functionMetrics(p.DurationStatistics), time.Now())
+	}
+
 	stats := make(map[string]interface{})
 
+	dimensions := functionDimensions(p.FunctionName, p.Qualifier)
 	for _, met := range lambdaMetricsGroup {
-		v, err := getLastPointFromCloudWatch(p.CloudWatch, p.FunctionName, met)
+		d := dimensions
+		if met.AccountLevel {
+			d = nil
+		}
+		v, err := getLastPointFromCloudWatch(p.CloudWatch, d, met)
 		if err == nil {
 			stats = mergeStatsFromDatapoint(stats, v, met)
 		} else {
-			log.Printf("%s: %s", met, err)
+			log.Printf("%s: %s", met.CloudWatchName, err)
 		}
 	}
 	return transformMetrics(stats), nil
@@ -187,6 +278,9 @@ func (p LambdaPlugin) FetchMetrics() (map[string]interface{}, error) {
 // GraphDefinition of LambdaPlugin
 func (p LambdaPlugin) GraphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(p.Prefix)
+	if p.AllFunctions {
+		return functionGraphDefinition(labelPrefix, functionMetrics(p.DurationStatistics))
+	}
 
 	graphdef := map[string]mp.Graphs{
 		"invocations": {
@@ -212,6 +306,31 @@ func (p LambdaPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "duration_avg", Label: "Average"},
 				{Name: "duration_max", Label: "Maximum"},
 				{Name: "duration_min", Label: "Minimum"},
+				{Name: "duration_p95", Label: "p95"},
+				{Name: "duration_p99", Label: "p99"},
+			},
+		},
+		"concurrency": {
+			Label: (labelPrefix + " Concurrency"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "concurrent_executions", Label: "Concurrent Executions"},
+				{Name: "unreserved_concurrent_executions", Label: "Unreserved Concurrent Executions"},
+				{Name: "provisioned_concurrent_executions", Label: "Provisioned Concurrent Executions"},
+			},
+		},
+		"provisioned_concurrency_utilization": {
+			Label: (labelPrefix + " Provisioned Concurrency Utilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "provisioned_concurrency_utilization", Label: "Utilization"},
+			},
+		},
+		"provisioned_concurrency_spillover": {
+			Label: (labelPrefix + " Provisioned Concurrency Spillover"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "provisioned_concurrency_spillover_invocations", Label: "Invocations"},
 			},
 		},
 	}
@@ -224,19 +343,51 @@ func Do() {
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optRegion := flag.String("region", "", "AWS Region")
 	optFunctionName := flag.String("function-name", "", "Function Name")
+	optQualifier := flag.String("qualifier", "", "Alias or version of the function")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "lambda", "Metric key prefix")
-	flag.Parse()
-
+	optAllFunctions := flag.Bool("all-functions", false, "Post the metrics of all the functions per function")
+	optFunctionPattern := flag.String("function-pattern", "", "Regexp of the names of the functions (implies -all-functions)")
+	optFunctionTag := flag.String("function-tag", "", "Tag of the functions as key=value (implies -all-functions)")
+	optStatistics := flag.String("statistics", strings.Join(defaultDurationStatistics, ","), "Comma separated statistics of Duration per function")
 	var plugin LambdaPlugin
+	plugin.AssumeRole.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&plugin.Endpoint, "endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	flag.Parse()
 
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Region = *optRegion
 
 	plugin.FunctionName = *optFunctionName
+	plugin.Qualifier = *optQualifier
+	if plugin.Qualifier != "" && plugin.FunctionName == "" {
+		log.Fatalln("-qualifier requires -function-name")
+	}
 	plugin.Prefix = *optPrefix
 
+	plugin.AllFunctions = *optAllFunctions || *optFunctionPattern != "" || *optFunctionTag != ""
+	if plugin.AllFunctions && plugin.FunctionName != "" {
+		log.Fatalln("-function-name cannot be used with -all-functions, -function-pattern or -function-tag")
+	}
+	if *optFunctionPattern != "" {
+		re, err := regexp.Compile(*optFunctionPattern)
+		if err != nil {
+			log.Fatalf("invalid -function-pattern: %s", err)
+		}
+		plugin.FunctionPattern = re
+	}
+	plugin.FunctionTag = *optFunctionTag
+	for _, s := range strings.Split(*optStatistics, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !isValidStatistic(s) {
+			log.Fatalf("invalid statistic: %s", s)
+		}
+		plugin.DurationStatistics = append(plugin.DurationStatistics, s)
+	}
+
 	err := plugin.prepare()
 	if err != nil {
 		log.Fatalln(err)
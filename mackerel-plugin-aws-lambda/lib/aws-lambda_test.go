@@ -24,7 +24,7 @@ func ExampleLambdaPlugin_GraphDefinition() {
 
 	// Output:
 	// # mackerel-agent-plugin
-	// {"graphs":{"lambda.dead_letters":{"label":"Lambda Dead Letter","unit":"integer","metrics":[{"name":"dead_letter_errors","label":"Errors","stacked":false}]},"lambda.duration":{"label":"Lambda Duration","unit":"float","metrics":[{"name":"duration_avg","label":"Average","stacked":false},{"name":"duration_max","label":"Maximum","stacked":false},{"name":"duration_min","label":"Minimum","stacked":false}]},"lambda.invocations":{"label":"Lambda Invocations","unit":"integer","metrics":[{"name":"invocations_success","label":"Success","stacked":false},{"name":"invocations_error","label":"Error","stacked":false},{"name":"invocations_throttles","label":"Throttles","stacked":false}]}}}
+	// {"graphs":{"lambda.concurrency":{"label":"Lambda Concurrency","unit":"integer","metrics":[{"name":"concurrent_executions","label":"Concurrent Executions","stacked":false},{"name":"unreserved_concurrent_executions","label":"Unreserved Concurrent Executions","stacked":false},{"name":"provisioned_concurrent_executions","label":"Provisioned Concurrent Executions","stacked":false}]},"lambda.dead_letters":{"label":"Lambda Dead Letter","unit":"integer","metrics":[{"name":"dead_letter_errors","label":"Errors","stacked":false}]},"lambda.duration":{"label":"Lambda Duration","unit":"float","metrics":[{"name":"duration_avg","label":"Average","stacked":false},{"name":"duration_max","label":"Maximum","stacked":false},{"name":"duration_min","label":"Minimum","stacked":false},{"name":"duration_p95","label":"p95","stacked":false},{"name":"duration_p99","label":"p99","stacked":false}]},"lambda.invocations":{"label":"Lambda Invocations","unit":"integer","metrics":[{"name":"invocations_success","label":"Success","stacked":false},{"name":"invocations_error","label":"Error","stacked":false},{"name":"invocations_throttles","label":"Throttles","stacked":false}]},"lambda.provisioned_concurrency_spillover":{"label":"Lambda Provisioned Concurrency Spillover","unit":"integer","metrics":[{"name":"provisioned_concurrency_spillover_invocations","label":"Invocations","stacked":false}]},"lambda.provisioned_concurrency_utilization":{"label":"Lambda Provisioned Concurrency Utilization","unit":"percentage","metrics":[{"name":"provisioned_concurrency_utilization","label":"Utilization","stacked":false}]}}}
 }
 
 func TestPrepare(t *testing.T) {
@@ -33,6 +33,12 @@ func TestPrepare(t *testing.T) {
 	p2.prepare()
 	assert.Equal(t, "MySuperRegion", *p2.CloudWatch.Config.Region, "Specified region is used")
 
+	p3 := defaultLambda()
+	p3.Region = "MySuperRegion"
+	p3.Endpoint = "http://localhost:4566"
+	p3.prepare()
+	assert.Equal(t, "http://localhost:4566", *p3.CloudWatch.Config.Endpoint, "Specified endpoint is used")
+
 	// XXX Maybe we should test around AccesKeyID?
 }
 
@@ -131,7 +137,7 @@ func (m *mockCloudWatchClient) GetMetricStatistics(input *cloudwatch.GetMetricSt
 func TestGetLastPointFromCloudWatch(t *testing.T) {
 	mockCw := &mockCloudWatchClient{}
 
-	dp0, err := getLastPointFromCloudWatch(mockCw, "myFunction",
+	dp0, err := getLastPointFromCloudWatch(mockCw, functionDimensions("myFunction", ""),
 		metricsGroup{CloudWatchName: "Throttles", Metrics: []metric{
 			{MackerelName: "invocations_throttles", Type: metricsTypeSum},
 		}})
@@ -144,7 +150,7 @@ func TestGetLastPointFromCloudWatch(t *testing.T) {
 			"Can request Single statistics")
 	}
 
-	dp1, err := getLastPointFromCloudWatch(mockCw, "myFunction",
+	dp1, err := getLastPointFromCloudWatch(mockCw, functionDimensions("myFunction", ""),
 		metricsGroup{CloudWatchName: "Duration", Metrics: []metric{
 			{MackerelName: "duration_avg", Type: metricsTypeAverage},
 			{MackerelName: "duration_max", Type: metricsTypeMaximum},
@@ -159,7 +165,7 @@ func TestGetLastPointFromCloudWatch(t *testing.T) {
 			"Can request multiple statistics at once")
 	}
 
-	dp2, err := getLastPointFromCloudWatch(mockCw, "",
+	dp2, err := getLastPointFromCloudWatch(mockCw, functionDimensions("", ""),
 		metricsGroup{CloudWatchName: "Throttles", Metrics: []metric{
 			{MackerelName: "invocations_throttles", Type: metricsTypeSum},
 		}})
@@ -232,3 +238,41 @@ func TestMergeStatsFromDatapoint(t *testing.T) {
 		"Can merge already existing stats / can merge multiple stats at once",
 	)
 }
+
+func TestFunctionDimensions(t *testing.T) {
+	assert.Nil(t, functionDimensions("", ""))
+	assert.Equal(t,
+		[]*cloudwatch.Dimension{
+			{Name: aws.String("FunctionName"), Value: aws.String("myFunction")},
+			{Name: aws.String("Resource"), Value: aws.String("myFunction:live")},
+		},
+		functionDimensions("myFunction", "live"),
+		"Resource dimension is added for qualifier")
+}
+
+func TestMergeExtendedStatistics(t *testing.T) {
+	mg := metricsGroup{CloudWatchName: "Duration", Metrics: []metric{
+		{MackerelName: "duration_avg", Type: metricsTypeAverage},
+		{MackerelName: "duration_p95", Type: metricsTypeP95},
+		{MackerelName: "duration_p99", Type: metricsTypeP99},
+	}}
+	dp := cloudwatch.Datapoint{
+		Average:            aws.Float64(25.0),
+		ExtendedStatistics: map[string]*float64{"p99": aws.Float64(120.0)},
+		Timestamp:          aws.Time(time.Now()),
+	}
+	assert.Equal(t,
+		map[string]interface{}{
+			"duration_avg": 25.0,
+			"duration_p99": 120.0,
+		},
+		mergeStatsFromDatapoint(make(map[string]interface{}), &dp, mg),
+		"Missing percentiles are omitted")
+
+	assert.Equal(t,
+		map[string]interface{}{
+			"provisioned_concurrency_utilization": 75.0,
+		},
+		transformMetrics(map[string]interface{}{"provisioned_concurrency_utilization": 0.75}),
+		"Utilization is converted to percentage")
+}
@@ -0,0 +1,217 @@
+package mpawslambda
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// maxMetricDataQueries is the maximum number of queries in a GetMetricData request
+const maxMetricDataQueries = 500
+
+// defaultDurationStatistics are the statistics of Duration per function
+var defaultDurationStatistics = []string{metricsTypeAverage, metricsTypeMaximum, "p50", "p99"}
+
+var percentileRe = regexp.MustCompile(`^p\d+(\.\d+)?$`)
+
+// isValidStatistic reports whether the statistic is supported by GetMetricData
+func isValidStatistic(s string) bool {
+	switch s {
+	case metricsTypeAverage, metricsTypeSum, metricsTypeMaximum, metricsTypeMinimum:
+		return true
+	}
+	return percentileRe.MatchString(s)
+}
+
+// functionMetric is a metric of each function, posted as function.<name>.<Graph>.<Name>
+type functionMetric struct {
+	CloudWatchName string
+	Type           string
+	Graph          string
+	Name           string
+	Label          string
+	// Scale is multiplied to the value if not zero, e.g. to convert fractions to percentage
+	Scale float64
+}
+
+// statisticName returns the metric name of the statistic, such as avg for Average and p99 for p99
+func statisticName(s string) string {
+	switch s {
+	case metricsTypeAverage:
+		return "avg"
+	case metricsTypeSum:
+		return "sum"
+	case metricsTypeMaximum:
+		return "max"
+	case metricsTypeMinimum:
+		return "min"
+	}
+	return strings.Replace(s, ".", "_", -1)
+}
+
+// functionMetrics returns the metrics of each function with the statistics of Duration
+func functionMetrics(durationStatistics []string) []functionMetric {
+	if len(durationStatistics) == 0 {
+		durationStatistics = defaultDurationStatistics
+	}
+	ms := []functionMetric{
+		{CloudWatchName: "Invocations", Type: metricsTypeSum, Graph: "invocations", Name: "invocations", Label: "Invocations"},
+		{CloudWatchName: "Errors", Type: metricsTypeSum, Graph: "invocations", Name: "errors", Label: "Errors"},
+		{CloudWatchName: "Throttles", Type: metricsTypeSum, Graph: "invocations", Name: "throttles", Label: "Throttles"},
+	}
+	for _, s := range durationStatistics {
+		ms = append(ms, functionMetric{CloudWatchName: "Duration", Type: s, Graph: "duration", Name: statisticName(s), Label: s})
+	}
+	return append(ms,
+		functionMetric{CloudWatchName: "ConcurrentExecutions", Type: metricsTypeMaximum, Graph: "concurrency", Name: "concurrent_executions", Label: "Concurrent Executions"},
+		// CloudWatch reports utilization as a fraction
+		functionMetric{CloudWatchName: "ProvisionedConcurrencyUtilization", Type: metricsTypeMaximum, Graph: "provisioned_concurrency_utilization", Name: "utilization", Label: "Utilization", Scale: 100},
+		functionMetric{CloudWatchName: "AsyncEventsReceived", Type: metricsTypeSum, Graph: "async_events", Name: "received", Label: "Received"},
+		functionMetric{CloudWatchName: "AsyncEventsDropped", Type: metricsTypeSum, Graph: "async_events", Name: "dropped", Label: "Dropped"},
+	)
+}
+
+// functionGraphDefinition returns the graphs of the metrics of each function
+func functionGraphDefinition(labelPrefix string, metrics []functionMetric) map[string]mp.Graphs {
+	graphs := map[string]mp.Graphs{
+		"function.#.invocations":                         {Label: labelPrefix + " Function Invocations", Unit: "integer"},
+		"function.#.duration":                            {Label: labelPrefix + " Function Duration", Unit: "float"},
+		"function.#.concurrency":                         {Label: labelPrefix + " Function Concurrency", Unit: "integer"},
+		"function.#.provisioned_concurrency_utilization": {Label: labelPrefix + " Function Provisioned Concurrency Utilization", Unit: "percentage"},
+		"function.#.async_events":                        {Label: labelPrefix + " Function Async Events", Unit: "integer"},
+	}
+	for _, met := range metrics {
+		key := "function.#." + met.Graph
+		g := graphs[key]
+		g.Metrics = append(g.Metrics, mp.Metrics{Name: met.Name, Label: met.Label})
+		graphs[key] = g
+	}
+	return graphs
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// listFunctions lists the names of the functions matching the pattern, or all of them if pattern is nil
+func listFunctions(svc lambdaiface.LambdaAPI, pattern *regexp.Regexp) ([]string, error) {
+	var functions []string
+	err := svc.ListFunctionsPages(&lambda.ListFunctionsInput{}, func(page *lambda.ListFunctionsOutput, lastPage bool) bool {
+		for _, f := range page.Functions {
+			name := aws.StringValue(f.FunctionName)
+			if pattern == nil || pattern.MatchString(name) {
+				functions = append(functions, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return functions, nil
+}
+
+// filterFunctionsByTag returns the functions with the tag of key=value, by the Resource Groups Tagging API
+func filterFunctionsByTag(svc resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI, functions []string, key, value string) ([]string, error) {
+	tagged := make(map[string]bool)
+	input := &resourcegroupstaggingapi.GetResourcesInput{
+		ResourceTypeFilters: []*string{aws.String("lambda:function")},
+		TagFilters:          []*resourcegroupstaggingapi.TagFilter{{Key: aws.String(key), Values: []*string{aws.String(value)}}},
+	}
+	err := svc.GetResourcesPages(input, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+		for _, m := range page.ResourceTagMappingList {
+			a, err := arn.Parse(aws.StringValue(m.ResourceARN))
+			if err != nil {
+				continue
+			}
+			// the resource of the function is function:<name>
+			tagged[strings.TrimPrefix(a.Resource, "function:")] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	var filtered []string
+	for _, f := range functions {
+		if tagged[f] {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered, nil
+}
+
+// fetchFunctionsMetrics fetches the metrics of the functions by GetMetricData, in the batches of maxMetricDataQueries
+// queries
+func fetchFunctionsMetrics(cw cloudwatchiface.CloudWatchAPI, functions []string, metrics []functionMetric, now time.Time) (map[string]interface{}, error) {
+	type query struct {
+		name   string
+		metric functionMetric
+	}
+	var queries []*cloudwatch.MetricDataQuery
+	targets := make(map[string]query)
+	for i, f := range functions {
+		for j, met := range metrics {
+			id := fmt.Sprintf("m%d_%d", i, j)
+			targets[id] = query{"function." + invalidKeyRe.ReplaceAllString(f, "_") + "." + met.Graph + "." + met.Name, met}
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String(namespace),
+						MetricName: aws.String(met.CloudWatchName),
+						Dimensions: functionDimensions(f, ""),
+					},
+					Period: aws.Int64(60),
+					Stat:   aws.String(met.Type),
+				},
+			})
+		}
+	}
+
+	stats := make(map[string]interface{})
+	for len(queries) > 0 {
+		n := len(queries)
+		if n > maxMetricDataQueries {
+			n = maxMetricDataQueries
+		}
+		input := &cloudwatch.GetMetricDataInput{
+			// Usually Cloudwatch datapoints delays about 2 mins, so retrieve last 3 mins (with 1 min buffer)
+			StartTime:         aws.Time(now.Add(time.Duration(180) * time.Second * -1)),
+			EndTime:           aws.Time(now),
+			MetricDataQueries: queries[:n],
+			ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+		}
+		err := cw.GetMetricDataPages(input, func(page *cloudwatch.GetMetricDataOutput, lastPage bool) bool {
+			for _, r := range page.MetricDataResults {
+				q, ok := targets[aws.StringValue(r.Id)]
+				if !ok || len(r.Values) == 0 {
+					continue
+				}
+				if _, ok := stats[q.name]; ok {
+					continue
+				}
+				v := aws.Float64Value(r.Values[0])
+				if q.metric.Scale != 0 {
+					v *= q.metric.Scale
+				}
+				stats[q.name] = v
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		queries = queries[n:]
+	}
+	return stats, nil
+}
@@ -0,0 +1,126 @@
+package mpawslambda
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockLambdaClient struct {
+	lambdaiface.LambdaAPI
+	pages [][]string
+}
+
+func (m mockLambdaClient) ListFunctionsPages(input *lambda.ListFunctionsInput, fn func(*lambda.ListFunctionsOutput, bool) bool) error {
+	for i, names := range m.pages {
+		var page lambda.ListFunctionsOutput
+		for _, name := range names {
+			page.Functions = append(page.Functions, &lambda.FunctionConfiguration{FunctionName: aws.String(name)})
+		}
+		if !fn(&page, i == len(m.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+type mockTaggingClient struct {
+	resourcegroupstaggingapiiface.ResourceGroupsTaggingAPIAPI
+	arns []string
+}
+
+func (m mockTaggingClient) GetResourcesPages(input *resourcegroupstaggingapi.GetResourcesInput, fn func(*resourcegroupstaggingapi.GetResourcesOutput, bool) bool) error {
+	var page resourcegroupstaggingapi.GetResourcesOutput
+	for _, a := range m.arns {
+		page.ResourceTagMappingList = append(page.ResourceTagMappingList, &resourcegroupstaggingapi.ResourceTagMapping{ResourceARN: aws.String(a)})
+	}
+	fn(&page, true)
+	return nil
+}
+
+func TestListFunctions(t *testing.T) {
+	svc := mockLambdaClient{pages: [][]string{{"api-users", "batch-report"}, {"api-orders"}}}
+	functions, err := listFunctions(svc, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"api-users", "batch-report", "api-orders"}, functions)
+
+	functions, err = listFunctions(svc, regexp.MustCompile(`^api-`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"api-users", "api-orders"}, functions)
+
+	tagging := mockTaggingClient{arns: []string{"arn:aws:lambda:ap-northeast-1:123456789012:function:api-orders"}}
+	functions, err = filterFunctionsByTag(tagging, functions, "team", "orders")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"api-orders"}, functions)
+}
+
+type mockMetricDataClient struct {
+	cloudwatchiface.CloudWatchAPI
+	batches []int
+}
+
+func (m *mockMetricDataClient) GetMetricDataPages(input *cloudwatch.GetMetricDataInput, fn func(*cloudwatch.GetMetricDataOutput, bool) bool) error {
+	m.batches = append(m.batches, len(input.MetricDataQueries))
+	var results []*cloudwatch.MetricDataResult
+	for _, q := range input.MetricDataQueries {
+		r := &cloudwatch.MetricDataResult{Id: q.Id}
+		switch aws.StringValue(q.MetricStat.Metric.MetricName) {
+		case "Invocations":
+			r.Values = []*float64{aws.Float64(30), aws.Float64(25)}
+		case "ProvisionedConcurrencyUtilization":
+			r.Values = []*float64{aws.Float64(0.5)}
+		case "Duration":
+			if aws.StringValue(q.MetricStat.Stat) == "p99" {
+				r.Values = []*float64{aws.Float64(120)}
+			}
+		}
+		results = append(results, r)
+	}
+	fn(&cloudwatch.GetMetricDataOutput{MetricDataResults: results}, true)
+	return nil
+}
+
+func TestFetchFunctionsMetrics(t *testing.T) {
+	cw := &mockMetricDataClient{}
+	metrics := functionMetrics([]string{"p99"})
+	stats, err := fetchFunctionsMetrics(cw, []string{"api-users"}, metrics, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"function.api-users.invocations.invocations":                         30.0,
+		"function.api-users.duration.p99":                                    120.0,
+		"function.api-users.provisioned_concurrency_utilization.utilization": 50.0,
+	}, stats, "the metrics without datapoints are omitted")
+
+	var functions []string
+	for i := 0; i < 70; i++ {
+		functions = append(functions, "function")
+	}
+	_, err = fetchFunctionsMetrics(cw, functions, metrics, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []int{8, 500, 60}, cw.batches, "the queries are batched")
+}
+
+func TestFunctionGraphDefinition(t *testing.T) {
+	p := LambdaPlugin{Prefix: "lambda", AllFunctions: true}
+	graphs := p.GraphDefinition()
+	assert.Len(t, graphs, 5)
+	assert.Equal(t, "Lambda Function Duration", graphs["function.#.duration"].Label)
+	var names []string
+	for _, m := range graphs["function.#.duration"].Metrics {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"avg", "max", "p50", "p99"}, names)
+	assert.Equal(t, "dropped", graphs["function.#.async_events"].Metrics[1].Name)
+
+	assert.True(t, isValidStatistic("p99.9"))
+	assert.False(t, isValidStatistic("Median"))
+}
@@ -3,16 +3,17 @@ package mpawsrds
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 // RDSPlugin mackerel plugin for amazon RDS
@@ -24,76 +25,127 @@ type RDSPlugin struct {
 	Engine          string
 	Prefix          string
 	LabelPrefix     string
+	AssumeRole      awsutil.AssumeRole
+	Endpoint        string
 }
 
-func getLastPoint(cloudWatch *cloudwatch.CloudWatch, dimension *cloudwatch.Dimension, metricName string) (float64, error) {
-	now := time.Now()
+const (
+	// maxQueriesPerRequest is the limit of queries in a GetMetricData request
+	maxQueriesPerRequest = 500
+	// fetchTimeout is the time for retrying throttled requests within the timeout of plugins
+	fetchTimeout = 25 * time.Second
+)
 
-	response, err := cloudWatch.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
-		Dimensions: []*cloudwatch.Dimension{dimension},
-		StartTime:  aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min (to fetch at least 1 data-point)
-		EndTime:    aws.Time(now),
-		MetricName: aws.String(metricName),
-		Period:     aws.Int64(60),
-		Statistics: []*string{aws.String("Average")},
-		Namespace:  aws.String("AWS/RDS"),
-	})
-	if err != nil {
-		return 0, err
-	}
+// throttleBackoff is the first interval of retrying throttled requests, doubled every retry
+var throttleBackoff = time.Second
 
-	datapoints := response.Datapoints
-	if len(datapoints) == 0 {
-		return 0, errors.New("fetched no datapoints")
-	}
+// getLastPoints fetches the latest values of the metrics with GetMetricData.
+// The metrics without datapoints, e.g. AuroraReplicaLag of the writer or
+// ServerlessDatabaseCapacity of provisioned instances, are not in the result.
+func getLastPoints(cloudWatch cloudwatchiface.CloudWatchAPI, dimension *cloudwatch.Dimension, metricNames []string) (map[string]float64, error) {
+	now := time.Now()
+	deadline := now.Add(fetchTimeout)
 
-	latest := new(time.Time)
-	var latestVal float64
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(*latest) {
-			continue
+	stat := make(map[string]float64)
+	latest := make(map[string]time.Time)
+	for start := 0; start < len(metricNames); start += maxQueriesPerRequest {
+		end := start + maxQueriesPerRequest
+		if end > len(metricNames) {
+			end = len(metricNames)
+		}
+		ids := make(map[string]string)
+		var queries []*cloudwatch.MetricDataQuery
+		for i, name := range metricNames[start:end] {
+			id := fmt.Sprintf("m%d", i)
+			ids[id] = name
+			queries = append(queries, &cloudwatch.MetricDataQuery{
+				Id: aws.String(id),
+				MetricStat: &cloudwatch.MetricStat{
+					Metric: &cloudwatch.Metric{
+						Namespace:  aws.String("AWS/RDS"),
+						MetricName: aws.String(name),
+						Dimensions: []*cloudwatch.Dimension{dimension},
+					},
+					Period: aws.Int64(60),
+					Stat:   aws.String("Average"),
+				},
+			})
 		}
 
-		latest = dp.Timestamp
-		latestVal = *dp.Average
+		input := &cloudwatch.GetMetricDataInput{
+			MetricDataQueries: queries,
+			StartTime:         aws.Time(now.Add(time.Duration(180) * time.Second * -1)), // 3 min (to fetch at least 1 data-point)
+			EndTime:           aws.Time(now),
+			ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+		}
+		for {
+			output, err := getMetricData(cloudWatch, input, deadline)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range output.MetricDataResults {
+				name := ids[aws.StringValue(r.Id)]
+				if code := aws.StringValue(r.StatusCode); code != cloudwatch.StatusCodeComplete && len(r.Values) == 0 {
+					log.Printf("%s: %s", name, code)
+				}
+				for i, ts := range r.Timestamps {
+					if i >= len(r.Values) || !ts.After(latest[name]) {
+						continue
+					}
+					latest[name] = *ts
+					stat[name] = aws.Float64Value(r.Values[i])
+				}
+			}
+			if output.NextToken == nil {
+				break
+			}
+			input.NextToken = output.NextToken
+		}
 	}
+	return stat, nil
+}
 
-	return latestVal, nil
+// getMetricData retries throttled requests with backoff until the deadline
+func getMetricData(cloudWatch cloudwatchiface.CloudWatchAPI, input *cloudwatch.GetMetricDataInput, deadline time.Time) (*cloudwatch.GetMetricDataOutput, error) {
+	backoff := throttleBackoff
+	for {
+		output, err := cloudWatch.GetMetricData(input)
+		if err == nil || !request.IsErrorThrottle(err) || time.Now().Add(backoff).After(deadline) {
+			return output, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
 }
 
 // FetchMetrics interface for mackerel-plugin
 func (p RDSPlugin) FetchMetrics() (map[string]float64, error) {
-	sess, err := session.NewSession()
+	sess, config, err := awsutil.Options{
+		Region:          p.Region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return nil, err
 	}
 
-	config := aws.NewConfig()
-	if p.AccessKeyID != "" && p.SecretAccessKey != "" {
-		config = config.WithCredentials(credentials.NewStaticCredentials(p.AccessKeyID, p.SecretAccessKey, ""))
-	}
-	if p.Region != "" {
-		config = config.WithRegion(p.Region)
-	}
-
 	cloudWatch := cloudwatch.New(sess, config)
 
-	stat := make(map[string]float64)
-
 	perInstance := &cloudwatch.Dimension{
 		Name:  aws.String("DBInstanceIdentifier"),
 		Value: aws.String(p.Identifier),
 	}
 
-	for _, met := range p.rdsMetrics() {
-		v, err := getLastPoint(cloudWatch, perInstance, met)
-		if err == nil {
-			stat[met] = v
-		} else {
-			log.Printf("%s: %s", met, err)
-		}
+	stat, err := getLastPoints(cloudWatch, perInstance, p.rdsMetrics())
+	if err != nil {
+		return nil, errors.New(awsutil.FormatError(err))
 	}
 
+	if len(stat) == 0 {
+		log.Printf("fetched no datapoints of %s, check -identifier and -region", p.Identifier)
+	}
 	return stat, nil
 }
 
@@ -200,8 +252,10 @@ func (p RDSPlugin) GraphDefinition() map[string]mp.Graphs {
 		graphdef = mergeGraphDefs(graphdef, p.mySQLGraphDefinition())
 	case "postgresql":
 		graphdef = mergeGraphDefs(graphdef, p.postgreSQLGraphDefinition())
-	case "aurora":
+	case "aurora", "aurora-mysql":
 		graphdef = p.auroraGraphDefinition()
+	case "aurora-postgresql":
+		graphdef = p.auroraPostgreSQLGraphDefinition()
 	}
 	return graphdef
 }
@@ -212,10 +266,13 @@ func Do() {
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optIdentifier := flag.String("identifier", "", "DB Instance Identifier")
-	optEngine := flag.String("engine", "", "RDS Engine")
+	optEngine := flag.String("engine", "", "RDS Engine (mysql, mariadb, postgresql, aurora-mysql or aurora-postgresql)")
 	optPrefix := flag.String("metric-key-prefix", "rds", "Metric key prefix")
 	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric Label prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optEndpoint := flag.String("endpoint", "", "AWS endpoint URL, e.g. for LocalStack or VPC endpoints (default: AWS_ENDPOINT_URL)")
+	var assumeRole awsutil.AssumeRole
+	assumeRole.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	rds := RDSPlugin{
@@ -231,19 +288,13 @@ func Do() {
 		rds.LabelPrefix = *optLabelPrefix
 	}
 
-	if *optRegion == "" {
-		ec2metadata := ec2metadata.New(session.New())
-		if ec2metadata.Available() {
-			rds.Region, _ = ec2metadata.Region()
-		}
-	} else {
-		rds.Region = *optRegion
-	}
-
+	rds.Region = *optRegion
 	rds.Identifier = *optIdentifier
 	rds.AccessKeyID = *optAccessKeyID
 	rds.SecretAccessKey = *optSecretAccessKey
 	rds.Engine = *optEngine
+	rds.AssumeRole = assumeRole
+	rds.Endpoint = *optEndpoint
 
 	helper := mp.NewMackerelPlugin(rds)
 	helper.Tempfile = *optTempfile
@@ -0,0 +1,86 @@
+package mpawsrds
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuroraGraphDefinition(t *testing.T) {
+	p := RDSPlugin{Prefix: "rds", LabelPrefix: "RDS", Engine: "aurora-postgresql"}
+	metrics := p.rdsMetrics()
+	for _, m := range []string{"AuroraReplicaLag", "BufferCacheHitRatio", "CommitLatency", "Deadlocks", "ServerlessDatabaseCapacity", "MaximumUsedTransactionIDs"} {
+		assert.Contains(t, metrics, m)
+	}
+	for _, m := range []string{"BinLogDiskUsage", "ResultSetCacheHitRatio", "FreeStorageSpace", "AuroraBinlogReplicaLag"} {
+		assert.NotContains(t, metrics, m)
+	}
+
+	p.Engine = "aurora-mysql"
+	metrics = p.rdsMetrics()
+	for _, m := range []string{"AuroraReplicaLag", "AuroraBinlogReplicaLag", "BufferCacheHitRatio", "CommitLatency", "Deadlocks", "ServerlessDatabaseCapacity"} {
+		assert.Contains(t, metrics, m)
+	}
+	assert.NotContains(t, metrics, "BinLogDiskUsage")
+
+	// aurora is the same as aurora-mysql
+	aurora := RDSPlugin{Prefix: "rds", LabelPrefix: "RDS", Engine: "aurora"}
+	assert.Equal(t, p.GraphDefinition(), aurora.GraphDefinition())
+}
+
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	throttles int
+	calls     int
+}
+
+func (c *fakeCloudWatch) GetMetricData(input *cloudwatch.GetMetricDataInput) (*cloudwatch.GetMetricDataOutput, error) {
+	c.calls++
+	if c.throttles > 0 {
+		c.throttles--
+		return nil, awserr.New("Throttling", "Rate exceeded", nil)
+	}
+	now := time.Now()
+	var results []*cloudwatch.MetricDataResult
+	for i, q := range input.MetricDataQueries {
+		if aws.StringValue(q.MetricStat.Metric.MetricName) == "ServerlessDatabaseCapacity" {
+			results = append(results, &cloudwatch.MetricDataResult{Id: q.Id, StatusCode: aws.String(cloudwatch.StatusCodeComplete)})
+			continue
+		}
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			StatusCode: aws.String(cloudwatch.StatusCodeComplete),
+			Timestamps: []*time.Time{aws.Time(now.Add(-60 * time.Second)), aws.Time(now.Add(-120 * time.Second))},
+			Values:     []*float64{aws.Float64(float64(i)), aws.Float64(-1)},
+		})
+	}
+	return &cloudwatch.GetMetricDataOutput{MetricDataResults: results}, nil
+}
+
+func TestGetLastPoints(t *testing.T) {
+	throttleBackoff = time.Millisecond
+	dimension := &cloudwatch.Dimension{Name: aws.String("DBInstanceIdentifier"), Value: aws.String("mysql01")}
+
+	cw := &fakeCloudWatch{throttles: 2}
+	stat, err := getLastPoints(cw, dimension, []string{"CPUUtilization", "ServerlessDatabaseCapacity", "Deadlocks"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, cw.calls, "throttled requests are retried")
+	assert.Equal(t, map[string]float64{"CPUUtilization": 0, "Deadlocks": 2}, stat)
+
+	var names []string
+	for i := 0; i < maxQueriesPerRequest+1; i++ {
+		names = append(names, fmt.Sprintf("Metric%d", i))
+	}
+	cw = &fakeCloudWatch{}
+	stat, err = getLastPoints(cw, dimension, names)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cw.calls, "queries are chunked")
+	assert.Equal(t, maxQueriesPerRequest+1, len(stat))
+	assert.Equal(t, 0.0, stat[fmt.Sprintf("Metric%d", maxQueriesPerRequest)])
+}
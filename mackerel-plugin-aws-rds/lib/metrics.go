@@ -192,9 +192,97 @@ func (p RDSPlugin) auroraGraphDefinition() map[string]mp.Graphs {
 			Label: p.LabelPrefix + " Aurora ReplicaLag",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
+				{Name: "AuroraReplicaLag", Label: "ReplicaLag"},
 				{Name: "AuroraReplicaLagMaximum", Label: "Maximum"},
 				{Name: "AuroraReplicaLagMinimum", Label: "Minimum"},
 			},
 		},
+		p.Prefix + ".ServerlessDatabaseCapacity": p.serverlessGraph(),
 	}
 }
+
+// .ServerlessDatabaseCapacity ...Only valid for Aurora Serverless
+func (p RDSPlugin) serverlessGraph() mp.Graphs {
+	return mp.Graphs{
+		Label: p.LabelPrefix + " Serverless Database Capacity",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "ServerlessDatabaseCapacity", Label: "Capacity"},
+		},
+	}
+}
+
+func (p RDSPlugin) auroraPostgreSQLGraphDefinition() map[string]mp.Graphs {
+	base := p.baseGraphDefs()
+	graphdef := map[string]mp.Graphs{
+		p.Prefix + ".Deadlocks": {
+			Label: p.LabelPrefix + " Dead Locks",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "Deadlocks", Label: "Deadlocks"},
+			},
+		},
+		p.Prefix + ".EngineUptime": {
+			Label: p.LabelPrefix + " Engine Uptime",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "EngineUptime", Label: "EngineUptime"},
+			},
+		},
+		p.Prefix + ".Latency": {
+			Label: p.LabelPrefix + " Latency [msec]",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "CommitLatency", Label: "Commit"},
+			},
+		},
+		p.Prefix + ".IOLatency": {
+			Label: p.LabelPrefix + " IO Latency in second",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ReadLatency", Label: "Read"},
+				{Name: "WriteLatency", Label: "Write"},
+			},
+		},
+		p.Prefix + ".CommitThroughput": {
+			Label: p.LabelPrefix + " Commit Throughput",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "CommitThroughput", Label: "Commit"},
+			},
+		},
+		p.Prefix + ".CacheHitRatio": {
+			Label: p.LabelPrefix + " Cache Hit Ratio",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "BufferCacheHitRatio", Label: "Buffer"},
+			},
+		},
+		p.Prefix + ".AuroraReplicaLag": {
+			Label: p.LabelPrefix + " Aurora ReplicaLag",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "AuroraReplicaLag", Label: "ReplicaLag"},
+				{Name: "AuroraReplicaLagMaximum", Label: "Maximum"},
+				{Name: "AuroraReplicaLagMinimum", Label: "Minimum"},
+			},
+		},
+		p.Prefix + ".FreeLocalStorage": {
+			Label: p.LabelPrefix + " Free Local Storage",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "FreeLocalStorage", Label: "FreeLocalStorage"},
+			},
+		},
+		p.Prefix + ".ServerlessDatabaseCapacity": p.serverlessGraph(),
+	}
+	// the storage of Aurora is not of the instance, and the latency is replaced by IOLatency above
+	for _, k := range []string{"DiskQueueDepth", "CPUUtilization", "CPUCreditBalance", "CPUCreditUsage", "DatabaseConnections", "FreeableMemory", "SwapUsage", "IOPS", "Throughput", "NetworkThroughput"} {
+		graphdef[p.Prefix+"."+k] = base[p.Prefix+"."+k]
+	}
+	postgres := p.postgreSQLGraphDefinition()
+	for _, k := range []string{"MaximumUsedTransactionIDs", "ReplicationSlotDiskUsage", "TransactionLogsDiskUsage"} {
+		graphdef[p.Prefix+"."+k] = postgres[p.Prefix+"."+k]
+	}
+	return graphdef
+}
@@ -3,11 +3,19 @@ package mpawsses
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 
-	"github.com/crowdmob/goamz/aws"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
 	mp "github.com/mackerelio/go-mackerel-plugin"
-	ses "github.com/naokibtn/go-ses"
+	"github.com/mackerelio/mackerel-agent-plugins/awsutil"
 )
 
 var graphdef = map[string]mp.Graphs{
@@ -36,60 +44,154 @@ var graphdef = map[string]mp.Graphs{
 			{Name: "Rejects", Label: "Rejects"},
 		},
 	},
+	"ses.reputation": {
+		Label: "SES Reputation",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "BounceRate", Label: "Bounce Rate"},
+			{Name: "ComplaintRate", Label: "Complaint Rate"},
+		},
+	},
+	"ses.sending_enabled": {
+		Label: "SES Sending Enabled",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "SendingEnabled", Label: "Enabled"},
+		},
+	},
 }
 
 // SESPlugin mackerel plugin for Amazon SES
 type SESPlugin struct {
 	Endpoint        string
+	Region          string
 	AccessKeyID     string
 	SecretAccessKey string
+	AssumeRole      awsutil.AssumeRole
+}
+
+// regionFromEndpoint returns us-west-2 of https://email.us-west-2.amazonaws.com
+func regionFromEndpoint(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 3 || labels[0] != "email" {
+		return ""
+	}
+	return labels[1]
 }
 
 // FetchMetrics interface for mackerel plugin
 func (p SESPlugin) FetchMetrics() (map[string]float64, error) {
-	if p.Endpoint == "" {
-		return nil, errors.New("no endpoint")
+	region := p.Region
+	if region == "" {
+		region = regionFromEndpoint(p.Endpoint)
 	}
-
-	auth, err := aws.GetAuth(p.AccessKeyID, p.SecretAccessKey, "", time.Now())
+	sess, config, err := awsutil.Options{
+		Region:          region,
+		AccessKeyID:     p.AccessKeyID,
+		SecretAccessKey: p.SecretAccessKey,
+		AssumeRole:      p.AssumeRole,
+		Endpoint:        p.Endpoint,
+	}.NewSession()
 	if err != nil {
 		return nil, err
 	}
+	if config.Region == nil {
+		return nil, errors.New("no region, specify -region or -endpoint")
+	}
+	if p.AssumeRole.RoleARN != "" {
+		// fail once here rather than every request below
+		if _, err := config.Credentials.Get(); err != nil {
+			return nil, fmt.Errorf("failed to assume the role %s: %s", p.AssumeRole.RoleARN, awsutil.FormatError(err))
+		}
+	}
 
-	sescfg := ses.Config{
-		AccessKeyID:     auth.AccessKey,
-		SecretAccessKey: auth.SecretKey,
-		SecurityToken:   auth.Token(),
-		Endpoint:        p.Endpoint,
+	svc := ses.New(sess, config)
+	stat := fetchSESMetrics(svc)
+	for k, v := range fetchReputationMetrics(svc, cloudwatch.New(sess, config), time.Now()) {
+		stat[k] = v
 	}
+	return stat, nil
+}
 
+func fetchSESMetrics(svc sesiface.SESAPI) map[string]float64 {
 	stat := make(map[string]float64)
-	quota, err := sescfg.GetSendQuota()
+	quota, err := svc.GetSendQuota(&ses.GetSendQuotaInput{})
 	if err == nil {
-		stat["SentLast24Hours"] = quota.SentLast24Hours
-		stat["Max24HourSend"] = quota.Max24HourSend
-		stat["MaxSendRate"] = quota.MaxSendRate
+		stat["SentLast24Hours"] = *quota.SentLast24Hours
+		stat["Max24HourSend"] = *quota.Max24HourSend
+		stat["MaxSendRate"] = *quota.MaxSendRate
+	} else {
+		log.Printf("GetSendQuota: %s", awsutil.FormatError(err))
 	}
 
-	datapoints, err := sescfg.GetSendStatistics()
+	statistics, err := svc.GetSendStatistics(&ses.GetSendStatisticsInput{})
 	if err == nil {
-		latest := ses.SendDataPoint{
-			Timestamp: time.Unix(0, 0),
-		}
-
-		for _, dp := range datapoints {
-			if latest.Timestamp.Before(dp.Timestamp) {
+		var latest *ses.SendDataPoint
+		for _, dp := range statistics.SendDataPoints {
+			if latest == nil || latest.Timestamp.Before(*dp.Timestamp) {
 				latest = dp
 			}
 		}
 
-		stat["Complaints"] = float64(latest.Complaints)
-		stat["DeliveryAttempts"] = float64(latest.DeliveryAttempts)
-		stat["Bounces"] = float64(latest.Bounces)
-		stat["Rejects"] = float64(latest.Rejects)
+		if latest != nil {
+			stat["Complaints"] = float64(*latest.Complaints)
+			stat["DeliveryAttempts"] = float64(*latest.DeliveryAttempts)
+			stat["Bounces"] = float64(*latest.Bounces)
+			stat["Rejects"] = float64(*latest.Rejects)
+		}
+	} else {
+		log.Printf("GetSendStatistics: %s", awsutil.FormatError(err))
 	}
 
-	return stat, nil
+	return stat
+}
+
+// fetchReputationMetrics fetches whether sending is enabled, and the bounce and complaint rates of the reputation
+// dashboard posted to CloudWatch in percentage
+func fetchReputationMetrics(svc sesiface.SESAPI, cw cloudwatchiface.CloudWatchAPI, now time.Time) map[string]float64 {
+	stat := make(map[string]float64)
+	enabled, err := svc.GetAccountSendingEnabled(&ses.GetAccountSendingEnabledInput{})
+	if err == nil {
+		stat["SendingEnabled"] = 0
+		if aws.BoolValue(enabled.Enabled) {
+			stat["SendingEnabled"] = 1
+		}
+	} else {
+		log.Printf("GetAccountSendingEnabled: %s", awsutil.FormatError(err))
+	}
+
+	for name, metricName := range map[string]string{
+		"BounceRate":    "Reputation.BounceRate",
+		"ComplaintRate": "Reputation.ComplaintRate",
+	} {
+		res, err := cw.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String("AWS/SES"),
+			MetricName: aws.String(metricName),
+			// the reputation metrics are not posted every minute
+			StartTime:  aws.Time(now.Add(-2 * time.Hour)),
+			EndTime:    aws.Time(now),
+			Period:     aws.Int64(300),
+			Statistics: []*string{aws.String("Maximum")},
+		})
+		if err != nil {
+			log.Printf("%s: %s", metricName, awsutil.FormatError(err))
+			continue
+		}
+		var latest *cloudwatch.Datapoint
+		for _, dp := range res.Datapoints {
+			if latest == nil || latest.Timestamp.Before(*dp.Timestamp) {
+				latest = dp
+			}
+		}
+		if latest != nil {
+			stat[name] = *latest.Maximum * 100
+		}
+	}
+	return stat
 }
 
 // GraphDefinition interface for mackerel plugin
@@ -99,19 +201,21 @@ func (p SESPlugin) GraphDefinition() map[string]mp.Graphs {
 
 // Do the plugin
 func Do() {
-	optEndpoint := flag.String("endpoint", "", "AWS Endpoint")
+	optEndpoint := flag.String("endpoint", "", "AWS Endpoint (default: AWS_ENDPOINT_URL)")
+	optRegion := flag.String("region", "", "AWS Region")
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	var plugin SESPlugin
+	plugin.AssumeRole.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	var ses SESPlugin
-
-	ses.Endpoint = *optEndpoint
-	ses.AccessKeyID = *optAccessKeyID
-	ses.SecretAccessKey = *optSecretAccessKey
+	plugin.Endpoint = *optEndpoint
+	plugin.Region = *optRegion
+	plugin.AccessKeyID = *optAccessKeyID
+	plugin.SecretAccessKey = *optSecretAccessKey
 
-	helper := mp.NewMackerelPlugin(ses)
+	helper := mp.NewMackerelPlugin(plugin)
 	helper.Tempfile = *optTempfile
 
 	helper.Run()
@@ -0,0 +1,93 @@
+package mpawsses
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionFromEndpoint(t *testing.T) {
+	assert.Equal(t, "us-west-2", regionFromEndpoint("https://email.us-west-2.amazonaws.com"))
+	assert.Equal(t, "", regionFromEndpoint("http://localhost:4566"))
+	assert.Equal(t, "", regionFromEndpoint(""))
+}
+
+type mockSESClient struct {
+	sesiface.SESAPI
+	quotaErr error
+}
+
+func (m mockSESClient) GetSendQuota(*ses.GetSendQuotaInput) (*ses.GetSendQuotaOutput, error) {
+	if m.quotaErr != nil {
+		return nil, m.quotaErr
+	}
+	return &ses.GetSendQuotaOutput{
+		Max24HourSend:   aws.Float64(50000),
+		MaxSendRate:     aws.Float64(14),
+		SentLast24Hours: aws.Float64(1234),
+	}, nil
+}
+
+func (m mockSESClient) GetSendStatistics(*ses.GetSendStatisticsInput) (*ses.GetSendStatisticsOutput, error) {
+	now := time.Now()
+	return &ses.GetSendStatisticsOutput{
+		SendDataPoints: []*ses.SendDataPoint{
+			{Bounces: aws.Int64(1), Complaints: aws.Int64(0), DeliveryAttempts: aws.Int64(100), Rejects: aws.Int64(0), Timestamp: aws.Time(now.Add(-30 * time.Minute))},
+			{Bounces: aws.Int64(2), Complaints: aws.Int64(1), DeliveryAttempts: aws.Int64(120), Rejects: aws.Int64(3), Timestamp: aws.Time(now)},
+			{Bounces: aws.Int64(0), Complaints: aws.Int64(0), DeliveryAttempts: aws.Int64(80), Rejects: aws.Int64(0), Timestamp: aws.Time(now.Add(-15 * time.Minute))},
+		},
+	}, nil
+}
+
+func TestFetchSESMetrics(t *testing.T) {
+	stat := fetchSESMetrics(mockSESClient{})
+	assert.Equal(t, map[string]float64{
+		"Max24HourSend":    50000,
+		"MaxSendRate":      14,
+		"SentLast24Hours":  1234,
+		"Bounces":          2,
+		"Complaints":       1,
+		"DeliveryAttempts": 120,
+		"Rejects":          3,
+	}, stat)
+
+	stat = fetchSESMetrics(mockSESClient{quotaErr: errors.New("AccessDenied")})
+	_, ok := stat["MaxSendRate"]
+	assert.False(t, ok, "quota is skipped on error")
+	assert.Equal(t, 120.0, stat["DeliveryAttempts"])
+}
+
+func (m mockSESClient) GetAccountSendingEnabled(*ses.GetAccountSendingEnabledInput) (*ses.GetAccountSendingEnabledOutput, error) {
+	return &ses.GetAccountSendingEnabledOutput{Enabled: aws.Bool(true)}, nil
+}
+
+type mockCloudWatchClient struct {
+	cloudwatchiface.CloudWatchAPI
+}
+
+func (m mockCloudWatchClient) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	if *input.MetricName != "Reputation.BounceRate" {
+		return &cloudwatch.GetMetricStatisticsOutput{}, nil
+	}
+	return &cloudwatch.GetMetricStatisticsOutput{
+		Datapoints: []*cloudwatch.Datapoint{
+			{Maximum: aws.Float64(0.02), Timestamp: aws.Time(input.EndTime.Add(-time.Hour))},
+			{Maximum: aws.Float64(0.015), Timestamp: aws.Time(input.EndTime.Add(-10 * time.Minute))},
+		},
+	}, nil
+}
+
+func TestFetchReputationMetrics(t *testing.T) {
+	stat := fetchReputationMetrics(mockSESClient{}, mockCloudWatchClient{}, time.Now())
+	assert.Equal(t, map[string]float64{
+		"SendingEnabled": 1,
+		"BounceRate":     1.5,
+	}, stat)
+}
@@ -0,0 +1,141 @@
+package mpdocker
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// userHZ is the unit of cpuacct.stat of cgroup v1, to which usage_usec of cgroup v2 is converted
+const userHZ = 100
+
+// findUnifiedPath returns the root of cgroup v2, which is the prefix itself on the unified hierarchy, or unified
+// under the prefix on the hybrid hierarchy
+func findUnifiedPath(prefix string) string {
+	for _, path := range []string{prefix, prefix + "/unified"} {
+		if ok, err := exists(path + "/cgroup.controllers"); ok && err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// buildUnified returns the cgroup v2 directory of the container by the systemd or the cgroupfs driver, or
+// an empty string if it is not found
+func (pb *pathBuilder) buildUnified(id string) string {
+	if pb.unified == "" {
+		return ""
+	}
+	for _, dir := range []string{
+		fmt.Sprintf("%s/system.slice/docker-%s.scope", pb.unified, id),
+		fmt.Sprintf("%s/docker/%s", pb.unified, id),
+	} {
+		if ok, err := exists(dir); ok && err == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// parseFlatKeyed parses the flat keyed files of cgroup v2 in the form of <key> <value>, e.g. cpu.stat and memory.stat
+func parseFlatKeyed(data string) map[string]float64 {
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = v
+	}
+	return values
+}
+
+// parseIOStat sums io.stat of all the devices in the form of <major>:<minor> rbytes=<n> wbytes=<n> rios=<n> ...
+func parseIOStat(data string) map[string]float64 {
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				continue
+			}
+			values[kv[0]] += v
+		}
+	}
+	return values
+}
+
+// fetchUnifiedMetrics sets the metrics of the controllers which are not found in cgroup v1, so that the hybrid
+// hierarchy uses whichever has the data of the container
+func fetchUnifiedMetrics(res map[string]interface{}, dir, name string, found map[string]bool) error {
+	if !found["cpuacct"] || !found["cpu"] {
+		if ok, err := exists(dir + "/cpu.stat"); ok && err == nil {
+			data, err := getFile(dir + "/cpu.stat")
+			if err != nil {
+				return err
+			}
+			stat := parseFlatKeyed(data)
+			if !found["cpuacct"] {
+				res["docker.cpuacct."+name+".user"] = stat["user_usec"] * userHZ / 1000000
+				res["docker.cpuacct."+name+".system"] = stat["system_usec"] * userHZ / 1000000
+			}
+			if _, ok := stat["throttled_usec"]; ok && !found["cpu"] {
+				res["docker.cpu_throttled_time."+name+".throttled_time"] = stat["throttled_usec"] / 1000
+			}
+		}
+	}
+
+	if !found["memory"] {
+		if ok, err := exists(dir + "/memory.stat"); ok && err == nil {
+			data, err := getFile(dir + "/memory.stat")
+			if err != nil {
+				return err
+			}
+			stat := parseFlatKeyed(data)
+			res["docker.memory."+name+".cache"] = stat["file"]
+			res["docker.memory."+name+".rss"] = stat["anon"]
+		}
+		if data, err := getFile(dir + "/memory.current"); err == nil {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(data), 64); err == nil {
+				res["docker.memory_usage."+name+".usage"] = v
+			}
+		}
+		// memory.max is "max" without the limit
+		if data, err := getFile(dir + "/memory.max"); err == nil {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(data), 64); err == nil {
+				res["docker.memory_usage."+name+".limit"] = v
+			}
+		}
+	}
+
+	// io.stat has neither the queued ios nor the sync and the async ones
+	if !found["blkio"] {
+		if ok, err := exists(dir + "/io.stat"); ok && err == nil {
+			data, err := getFile(dir + "/io.stat")
+			if err != nil {
+				return err
+			}
+			stat := parseIOStat(data)
+			res["docker.blkio.io_serviced."+name+".read"] = stat["rios"]
+			res["docker.blkio.io_serviced."+name+".write"] = stat["wios"]
+			res["docker.blkio.io_service_bytes."+name+".read"] = stat["rbytes"]
+			res["docker.blkio.io_service_bytes."+name+".write"] = stat["wbytes"]
+		}
+	}
+	return nil
+}
@@ -43,6 +43,37 @@ var graphdef = map[string]mp.Graphs{
 			{Name: "rss", Label: "RSS", Diff: false, Stacked: true},
 		},
 	},
+	"docker.memory_usage.#": {
+		Label: "Docker Memory Usage",
+		Unit:  "bytes",
+		Metrics: []mp.Metrics{
+			{Name: "usage", Label: "Usage", Diff: false},
+			{Name: "limit", Label: "Limit", Diff: false},
+		},
+	},
+	"docker.cpu_throttled_time.#": {
+		Label: "Docker CPU Throttled Time",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "throttled_time", Label: "Throttled Time (msec)", Diff: true},
+		},
+	},
+	"docker.network.#": {
+		Label: "Docker Network Traffic",
+		Unit:  "bytes/sec",
+		Metrics: []mp.Metrics{
+			{Name: "rxBytes", Label: "Receive", Diff: true, Type: "uint64"},
+			{Name: "txBytes", Label: "Transmit", Diff: true, Type: "uint64"},
+		},
+	},
+	"docker.network_packets.#": {
+		Label: "Docker Network Packets",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "rxPackets", Label: "Receive", Diff: true, Type: "uint64"},
+			{Name: "txPackets", Label: "Transmit", Diff: true, Type: "uint64"},
+		},
+	},
 	"docker.blkio.io_queued.#": {
 		Label: "Docker BlkIO Queued",
 		Unit:  "integer",
@@ -87,6 +118,10 @@ type DockerPlugin struct {
 	pathBuilder      *pathBuilder
 	lastMetricValues mp.MetricValues
 	UseCPUPercentage bool
+	// LabelFilters lists the containers which have the labels by the API method
+	LabelFilters []string
+	// Timeout bounds the requests to the Engine API
+	Timeout time.Duration
 }
 
 func getFile(path string) (string, error) {
@@ -129,8 +164,15 @@ func (m DockerPlugin) getDockerPs() (string, error) {
 }
 
 func (m DockerPlugin) listContainer() ([]docker.APIContainers, error) {
-	client, _ := docker.NewClient(m.Host)
-	containers, err := client.ListContainers(docker.ListContainersOptions{})
+	client, err := m.newClient()
+	if err != nil {
+		return nil, err
+	}
+	opts := docker.ListContainersOptions{}
+	if len(m.LabelFilters) > 0 {
+		opts.Filters = map[string][]string{"label": m.LabelFilters}
+	}
+	containers, err := client.ListContainers(opts)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +196,8 @@ func findPrefixPath() (string, error) {
 type pathBuilder struct {
 	prefix   string
 	pathType pathType
+	// unified is the root of cgroup v2, which is empty on cgroup v1 only
+	unified string
 }
 
 type pathType uint8
@@ -171,13 +215,19 @@ func newPathBuilder() (*pathBuilder, error) {
 	if err != nil {
 		return nil, err
 	}
+	unified := findUnifiedPath(prefixPath)
+	if unified == prefixPath {
+		// the unified hierarchy has no cgroup v1 controllers
+		return &pathBuilder{prefix: prefixPath, pathType: pathUnknown, unified: unified}, nil
+	}
 	pathT, err := guessPathType(prefixPath)
-	if err != nil {
+	if err != nil && unified == "" {
 		return nil, err
 	}
 	return &pathBuilder{
 		prefix:   prefixPath,
 		pathType: pathT,
+		unified:  unified,
 	}, nil
 }
 
@@ -306,7 +356,10 @@ func (m DockerPlugin) generateName(container docker.APIContainers) string {
 	case "image_name":
 		return fmt.Sprintf("%s_%s", container.Image, strings.Replace(container.Names[0], "/", "", 1))
 	case "label":
-		return container.Labels[m.Label]
+		// the containers without the label, e.g. the ones out of compose, are named by their names
+		if v, ok := container.Labels[m.Label]; ok && v != "" {
+			return v
+		}
 	}
 	return strings.Replace(container.Names[0], "/", "", 1)
 }
@@ -322,12 +375,15 @@ func (m DockerPlugin) FetchMetricsWithAPI(containers []docker.APIContainers) (ma
 			defer wg.Done()
 			name := strings.Replace(cont.Names[0], "/", "", 1)
 			metricName := normalizeMetricName(m.generateName(cont))
-			client, _ := docker.NewClient(m.Host)
+			client, err := m.newClient()
+			if err != nil {
+				log.Fatal(err)
+			}
 			errC := make(chan error, 1)
 			statsC := make(chan *docker.Stats)
 			done := make(chan bool)
 			go func() {
-				errC <- client.Stats(docker.StatsOptions{ID: name, Stats: statsC, Stream: false, Done: done, Timeout: time.Duration(20) * time.Second})
+				errC <- client.Stats(docker.StatsOptions{ID: name, Stats: statsC, Stream: false, Done: done, Timeout: m.Timeout})
 				close(errC)
 			}()
 			var resultStats []*docker.Stats
@@ -338,7 +394,7 @@ func (m DockerPlugin) FetchMetricsWithAPI(containers []docker.APIContainers) (ma
 				}
 				resultStats = append(resultStats, stats)
 			}
-			err := <-errC
+			err = <-errC
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -347,6 +403,9 @@ func (m DockerPlugin) FetchMetricsWithAPI(containers []docker.APIContainers) (ma
 			}
 			mu.Lock()
 			m.parseStats(&res, metricName, resultStats[0])
+			if !isHostNetwork(cont) {
+				parseNetworkStats(res, metricName, resultStats[0])
+			}
 			mu.Unlock()
 		}(container)
 	}
@@ -367,23 +426,36 @@ func (m DockerPlugin) parseStats(stats *map[string]interface{}, name string, res
 		(*stats)["docker.cpuacct."+name+".user"] = (*result).CPUStats.CPUUsage.UsageInUsermode
 		(*stats)["docker.cpuacct."+name+".system"] = (*result).CPUStats.CPUUsage.UsageInKernelmode
 	}
-	(*stats)["docker.memory."+name+".cache"] = (*result).MemoryStats.Stats.TotalCache
-	(*stats)["docker.memory."+name+".rss"] = (*result).MemoryStats.Stats.TotalRss
+	// throttled_time is in nanoseconds
+	(*stats)["docker.cpu_throttled_time."+name+".throttled_time"] = float64((*result).CPUStats.ThrottlingData.ThrottledTime) / 1000000
+	memory := (*result).MemoryStats.Stats
+	if memory.TotalCache == 0 && memory.TotalRss == 0 && (memory.File > 0 || memory.Anon > 0) {
+		// the stats of cgroup v2
+		(*stats)["docker.memory."+name+".cache"] = memory.File
+		(*stats)["docker.memory."+name+".rss"] = memory.Anon
+	} else {
+		(*stats)["docker.memory."+name+".cache"] = memory.TotalCache
+		(*stats)["docker.memory."+name+".rss"] = memory.TotalRss
+	}
+	(*stats)["docker.memory_usage."+name+".usage"] = (*result).MemoryStats.Usage
+	if limit := (*result).MemoryStats.Limit; limit > 0 {
+		(*stats)["docker.memory_usage."+name+".limit"] = limit
+	}
 
 	fields := []string{"read", "write", "sync", "async"}
 	for _, field := range fields {
 		for _, s := range (*result).BlkioStats.IOQueueRecursive {
-			if s.Op == strings.Title(field) {
+			if strings.EqualFold(s.Op, field) {
 				(*stats)["docker.blkio.io_queued."+name+"."+field] = s.Value
 			}
 		}
 		for _, s := range (*result).BlkioStats.IOServicedRecursive {
-			if s.Op == strings.Title(field) {
+			if strings.EqualFold(s.Op, field) {
 				(*stats)["docker.blkio.io_serviced."+name+"."+field] = s.Value
 			}
 		}
 		for _, s := range (*result).BlkioStats.IOServiceBytesRecursive {
-			if s.Op == strings.Title(field) {
+			if strings.EqualFold(s.Op, field) {
 				(*stats)["docker.blkio.io_service_bytes."+name+"."+field] = s.Value
 			}
 		}
@@ -391,6 +463,33 @@ func (m DockerPlugin) parseStats(stats *map[string]interface{}, name string, res
 	return nil
 }
 
+// isHostNetwork reports whether the container uses the network of the host, whose counters are the same as the host
+func isHostNetwork(container docker.APIContainers) bool {
+	_, ok := container.Networks.Networks["host"]
+	return ok
+}
+
+// parseNetworkStats sets the traffic of the container summed up over the interfaces. The traffic of a new container
+// has no diff until the next run, and the counters of a recreated one are reset, which are skipped as uint64.
+func parseNetworkStats(stats map[string]interface{}, name string, result *docker.Stats) {
+	networks := result.Networks
+	if len(networks) == 0 {
+		// API version 1.20 or earlier
+		networks = map[string]docker.NetworkStats{"eth0": result.Network}
+	}
+	var rxBytes, txBytes, rxPackets, txPackets uint64
+	for _, n := range networks {
+		rxBytes += n.RxBytes
+		txBytes += n.TxBytes
+		rxPackets += n.RxPackets
+		txPackets += n.TxPackets
+	}
+	stats["docker.network."+name+".rxBytes"] = rxBytes
+	stats["docker.network."+name+".txBytes"] = txBytes
+	stats["docker.network_packets."+name+".rxPackets"] = rxPackets
+	stats["docker.network_packets."+name+".txPackets"] = txPackets
+}
+
 func addCPUPercentageStats(stats *map[string]interface{}, lastStat map[string]interface{}) {
 	for k, v := range lastStat {
 		if !strings.HasPrefix(k, internalCPUStatPrefix) || !strings.HasSuffix(k, ".host") {
@@ -439,10 +538,13 @@ func (m DockerPlugin) FetchMetricsWithFile(dockerStats *map[string][]string) (ma
 
 	res := map[string]interface{}{}
 	for id, name := range *dockerStats {
+		// found is the cgroup v1 controllers which have the data of the container
+		found := map[string]bool{}
 		for metric, stats := range metrics {
 			if ok, err := exists(pb.build(id, metric, "stat")); !ok || err != nil {
 				continue
 			}
+			found[metric] = true
 			data, err := getFile(pb.build(id, metric, "stat"))
 			if err != nil {
 				return nil, err
@@ -456,11 +558,32 @@ func (m DockerPlugin) FetchMetricsWithFile(dockerStats *map[string][]string) (ma
 			}
 		}
 
+		if ok, err := exists(pb.build(id, "memory", "usage_in_bytes")); ok && err == nil {
+			data, err := getFile(pb.build(id, "memory", "usage_in_bytes"))
+			if err != nil {
+				return nil, err
+			}
+			res[fmt.Sprintf("docker.memory_usage.%s_%s.usage", normalizeMetricName(name[0]), id[0:6])] = strings.TrimSpace(data)
+		}
+
+		// throttled_time of cpu.stat is in nanoseconds
+		if ok, err := exists(pb.build(id, "cpu", "stat")); ok && err == nil {
+			data, err := getFile(pb.build(id, "cpu", "stat"))
+			if err != nil {
+				return nil, err
+			}
+			if v, ok := parseFlatKeyed(data)["throttled_time"]; ok {
+				found["cpu"] = true
+				res[fmt.Sprintf("docker.cpu_throttled_time.%s_%s.throttled_time", normalizeMetricName(name[0]), id[0:6])] = v / 1000000
+			}
+		}
+
 		// blkio statistics
 		for _, blkioType := range []string{"io_queued", "io_serviced", "io_service_bytes"} {
 			if ok, err := exists(pb.build(id, "blkio", blkioType)); !ok || err != nil {
 				continue
 			}
+			found["blkio"] = true
 			data, err := getFile(pb.build(id, "blkio", blkioType))
 			if err != nil {
 				return nil, err
@@ -479,6 +602,11 @@ func (m DockerPlugin) FetchMetricsWithFile(dockerStats *map[string][]string) (ma
 			}
 		}
 
+		if dir := pb.buildUnified(id); dir != "" {
+			if err := fetchUnifiedMetrics(res, dir, fmt.Sprintf("%s_%s", normalizeMetricName(name[0]), id[0:6]), found); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return res, nil
@@ -498,11 +626,16 @@ func Do() {
 	}
 
 	optHost := flag.String("host", "unix:///var/run/docker.sock", "Host for socket")
+	flag.StringVar(optHost, "docker-host", "unix:///var/run/docker.sock", "Host for socket (alias of -host)")
 	optCommand := flag.String("command", "docker", "Command path to docker")
 	optMethod := flag.String("method", "", "Specify the method to collect stats, 'API' or 'File'. If not specified, an appropriate method is chosen.")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optNameFormat := flag.String("name-format", "name_id", "Set the name format from "+strings.Join(candidateNameFormat, ", "))
 	optLabel := flag.String("label", "", "Use the value of the key as name in case that name-format is label.")
+	optNameFromLabel := flag.String("name-from-label", "", "Use the value of the label as name, e.g. com.docker.compose.service or io.kubernetes.pod.name. The same as -name-format label -label <key>.")
+	var optLabelFilters LabelFiltersFlag
+	flag.Var(&optLabelFilters, "label-filter", "Collect only the containers which have the label of key=value or key with the 'API' method. (can be specified multiple times)")
+	optTimeout := flag.Duration("timeout", 20*time.Second, "Timeout of the requests to the Docker Engine API")
 	optCPUFormat := flag.String("cpu-format", "", "Specify which CPU metrics format to use, 'percentage' or 'usage'. 'percentage' is default for 'API' method, and is not supported in 'File' method.")
 	flag.Parse()
 
@@ -510,13 +643,15 @@ func Do() {
 
 	docker.Host = fmt.Sprintf("%s", *optHost)
 	docker.DockerCommand = *optCommand
-	_, err := exec.LookPath(docker.DockerCommand)
-	if err != nil {
-		log.Fatalf("Docker command is not found: %s", docker.DockerCommand)
-	}
+	docker.LabelFilters = optLabelFilters
+	docker.Timeout = *optTimeout
 
 	docker.NameFormat = *optNameFormat
 	docker.Label = *optLabel
+	if *optNameFromLabel != "" {
+		docker.NameFormat = "label"
+		docker.Label = *optNameFromLabel
+	}
 	if !setCandidateNameFormat[docker.NameFormat] {
 		log.Fatalf("Name flag should be each of '%s'", strings.Join(candidateNameFormat, ","))
 	}
@@ -524,8 +659,13 @@ func Do() {
 		log.Fatalf("Label flag should be set when name flag is 'label'.")
 	}
 
+	var err error
 	if *optMethod == "" {
-		docker.Method, err = guessMethod(docker.DockerCommand)
+		// the docker command is not needed to guess by the Engine API, e.g. in a container
+		docker.Method, err = docker.guessMethodWithAPI()
+		if err != nil {
+			docker.Method, err = guessMethod(docker.DockerCommand)
+		}
 		if err != nil {
 			log.Fatalf("Fail to guess stats method: %s", err.Error())
 		}
@@ -537,6 +677,12 @@ func Do() {
 	}
 
 	if docker.Method == "File" {
+		if _, err := exec.LookPath(docker.DockerCommand); err != nil {
+			log.Fatalf("Docker command is not found: %s", docker.DockerCommand)
+		}
+		if len(docker.LabelFilters) > 0 {
+			log.Fatalf("'-label-filter' is not supported with File method.")
+		}
 		pb, err := newPathBuilder()
 		if err != nil {
 			log.Fatalf("failed to resolve docker metrics path: %s. It may be no Docker containers exists.", err)
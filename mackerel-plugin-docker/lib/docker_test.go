@@ -1,6 +1,10 @@
 package mpdocker
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/fsouza/go-dockerclient"
@@ -23,8 +27,8 @@ func TestGraphDefinition(t *testing.T) {
 	var docker DockerPlugin
 
 	graphdef := docker.GraphDefinition()
-	if len(graphdef) != 6 {
-		t.Errorf("GraphDefinition: %d should be 6", len(graphdef))
+	if len(graphdef) != 10 {
+		t.Errorf("GraphDefinition: %d should be 10", len(graphdef))
 	}
 }
 
@@ -84,6 +88,34 @@ func TestGenerateName(t *testing.T) {
 
 }
 
+func TestParseNetworkStats(t *testing.T) {
+	var result docker.Stats
+	result.Networks = map[string]docker.NetworkStats{
+		"eth0": {RxBytes: 1000, TxBytes: 500, RxPackets: 10, TxPackets: 5},
+		"eth1": {RxBytes: 24, TxBytes: 12, RxPackets: 1, TxPackets: 1},
+	}
+	stats := map[string]interface{}{}
+	parseNetworkStats(stats, "my-mongodb_bab2b0", &result)
+	expected := map[string]interface{}{
+		"docker.network.my-mongodb_bab2b0.rxBytes":           uint64(1024),
+		"docker.network.my-mongodb_bab2b0.txBytes":           uint64(512),
+		"docker.network_packets.my-mongodb_bab2b0.rxPackets": uint64(11),
+		"docker.network_packets.my-mongodb_bab2b0.txPackets": uint64(6),
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("network stats should be %v, but %v", expected, stats)
+	}
+
+	host := docker.APIContainers{Networks: docker.NetworkList{Networks: map[string]docker.ContainerNetwork{"host": {}}}}
+	if !isHostNetwork(host) {
+		t.Errorf("the container on the host network should be detected")
+	}
+	bridge := docker.APIContainers{Networks: docker.NetworkList{Networks: map[string]docker.ContainerNetwork{"bridge": {}}}}
+	if isHostNetwork(bridge) {
+		t.Errorf("the container on the bridge network should not be detected as the host network")
+	}
+}
+
 func TestAddCPUPercentageStats(t *testing.T) {
 	stats := map[string]interface{}{
 		"docker._internal.cpuacct.containerA.user":       uint64(3000),
@@ -134,3 +166,75 @@ func TestAddCPUPercentageStats(t *testing.T) {
 		t.Errorf("docker.cpuacct_percentage.containerE.user should not be calculated")
 	}
 }
+
+func TestFetchMetricsWithFileUnified(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-plugin-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	id := "bab2b03c736de41ecba6470eba736c5109436f706eedca4f3e0d93d6530eccd4"
+	dir := filepath.Join(root, "system.slice", "docker-"+id+".scope")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"cgroup.controllers": "cpuset cpu io memory pids\n",
+		"cpu.stat":           "usage_usec 3000000\nuser_usec 2000000\nsystem_usec 1000000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 1500\n",
+		"memory.stat":        "anon 1048576\nfile 2097152\nkernel 4096\n",
+		"memory.current":     "3145728\n",
+		"memory.max":         "max\n",
+		"io.stat":            "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n8:16 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if name == "cgroup.controllers" {
+			path = filepath.Join(root, name)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if unified := findUnifiedPath(root); unified != root {
+		t.Fatalf("the unified hierarchy should be found at %s, but %q", root, unified)
+	}
+	m := DockerPlugin{pathBuilder: &pathBuilder{prefix: root, pathType: pathUnknown, unified: root}}
+	stats, err := m.FetchMetricsWithFile(&map[string][]string{id: {"my-mongodb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{
+		"docker.cpuacct.my-mongodb_bab2b0.user":                      200,
+		"docker.cpuacct.my-mongodb_bab2b0.system":                    100,
+		"docker.cpu_throttled_time.my-mongodb_bab2b0.throttled_time": 1.5,
+		"docker.memory.my-mongodb_bab2b0.cache":                      2097152,
+		"docker.memory.my-mongodb_bab2b0.rss":                        1048576,
+		"docker.memory_usage.my-mongodb_bab2b0.usage":                3145728,
+		"docker.blkio.io_serviced.my-mongodb_bab2b0.read":            2,
+		"docker.blkio.io_serviced.my-mongodb_bab2b0.write":           2,
+		"docker.blkio.io_service_bytes.my-mongodb_bab2b0.read":       8192,
+		"docker.blkio.io_service_bytes.my-mongodb_bab2b0.write":      8192,
+	}
+	for key, value := range expected {
+		if stats[key] != value {
+			t.Errorf("%s should be %f, but %v", key, value, stats[key])
+		}
+	}
+	if _, ok := stats["docker.memory_usage.my-mongodb_bab2b0.limit"]; ok {
+		t.Errorf("the limit should not be posted without memory.max")
+	}
+}
+
+func TestParseIOStat(t *testing.T) {
+	stat := parseIOStat("8:0 rbytes=4096 wbytes=8192 rios=1 wios=2\n\n  \n8:16\n8:32 rbytes=1024 wbytes=0 rios=1 wios=0\n")
+	expected := map[string]float64{"rbytes": 5120, "wbytes": 8192, "rios": 2, "wios": 2}
+	if len(stat) != len(expected) {
+		t.Errorf("parseIOStat: %d values should be %d: %v", len(stat), len(expected), stat)
+	}
+	for key, value := range expected {
+		if stat[key] != value {
+			t.Errorf("%s should be %f, but %v", key, value, stat[key])
+		}
+	}
+}
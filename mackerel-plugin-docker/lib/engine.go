@@ -0,0 +1,59 @@
+package mpdocker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// LabelFiltersFlag is the flag of the label filters of the containers, which is repeated for all of them
+type LabelFiltersFlag []string
+
+func (f *LabelFiltersFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set adds the filter in the form of key=value, or key for the containers which have the label
+func (f *LabelFiltersFlag) Set(value string) error {
+	if value == "" || strings.HasPrefix(value, "=") {
+		return fmt.Errorf("the label filter should be key=value or key: %q", value)
+	}
+	*f = append(*f, value)
+	return nil
+}
+
+// newClient returns the client of the Engine API whose requests are bounded by the timeout
+func (m DockerPlugin) newClient() (*docker.Client, error) {
+	client, err := docker.NewClient(m.Host)
+	if err != nil {
+		return nil, err
+	}
+	client.SetTimeout(m.Timeout)
+	return client, nil
+}
+
+// guessMethodWithAPI chooses the method by the version of the Engine API, which needs no docker command
+func (m DockerPlugin) guessMethodWithAPI() (string, error) {
+	client, err := m.newClient()
+	if err != nil {
+		return "", err
+	}
+	env, err := client.Version()
+	if err != nil {
+		return "", err
+	}
+	return methodForAPIVersion(env.Get("ApiVersion")), nil
+}
+
+// methodForAPIVersion returns File for the API version under 1.17, which has no stats API
+func methodForAPIVersion(version string) string {
+	var major, minor int
+	if _, err := fmt.Sscanf(version, "%d.%d", &major, &minor); err != nil {
+		return "API"
+	}
+	if major == 1 && minor < 17 {
+		return "File"
+	}
+	return "API"
+}
@@ -0,0 +1,48 @@
+package mpdocker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestMethodForAPIVersion(t *testing.T) {
+	for version, expected := range map[string]string{
+		"1.16": "File",
+		"1.17": "API",
+		"1.43": "API",
+		"":     "API",
+	} {
+		if method := methodForAPIVersion(version); method != expected {
+			t.Errorf("method of API version %q should be %s, but %s", version, expected, method)
+		}
+	}
+}
+
+func TestLabelFiltersFlag(t *testing.T) {
+	var f LabelFiltersFlag
+	for _, v := range []string{"com.docker.compose.project=web", "io.kubernetes.pod.name"} {
+		if err := f.Set(v); err != nil {
+			t.Errorf("%q should be a valid filter, but %s", v, err)
+		}
+	}
+	if err := f.Set("=web"); err == nil {
+		t.Errorf("the filter without the key should be an error")
+	}
+	if expected := (LabelFiltersFlag{"com.docker.compose.project=web", "io.kubernetes.pod.name"}); !reflect.DeepEqual(f, expected) {
+		t.Errorf("filters should be %v, but %v", expected, f)
+	}
+}
+
+func TestGenerateNameFromLabel(t *testing.T) {
+	m := DockerPlugin{NameFormat: "label", Label: "com.docker.compose.service"}
+	service := docker.APIContainers{Names: []string{"/web_app_1"}, Labels: map[string]string{"com.docker.compose.service": "app"}}
+	if name := m.generateName(service); name != "app" {
+		t.Errorf("the name should be the service, but %s", name)
+	}
+	other := docker.APIContainers{Names: []string{"/standalone"}}
+	if name := m.generateName(other); name != "standalone" {
+		t.Errorf("the container without the label should be named by the name, but %s", name)
+	}
+}
@@ -0,0 +1,115 @@
+package mpelasticsearch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+)
+
+// tlsConfig builds the TLS configuration from the options
+func (p ElasticsearchPlugin) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: p.InsecureSkipVerify}
+	if p.CACert != "" {
+		pem, err := ioutil.ReadFile(p.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", p.CACert)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// httpClient returns the client with the TLS configuration, whose requests are bounded by the context of each request
+func (p ElasticsearchPlugin) httpClient() (*http.Client, error) {
+	if !p.InsecureSkipVerify && p.CACert == "" {
+		return http.DefaultClient, nil
+	}
+	config, err := p.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// setAuth sets the Authorization header of the API key, or the basic authentication
+func (p ElasticsearchPlugin) setAuth(req *http.Request) {
+	if p.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+p.APIKey)
+		return
+	}
+	if p.User != "" || p.Password != "" {
+		req.SetBasicAuth(p.User, p.Password)
+	}
+}
+
+// checkStatus returns the error of the response which is not 2xx, where 401 and 403 are the failures of the authentication
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	msg := strings.TrimSpace(string(body))
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("authentication failed: %s: %s", resp.Status, msg)
+	}
+	return fmt.Errorf("unexpected status: %s: %s", resp.Status, msg)
+}
+
+// get decodes the JSON response of the path into v, where doing is what is fetched, e.g. "the node stats"
+func (p ElasticsearchPlugin) get(ctx context.Context, client *http.Client, path, doing string, v interface{}) error {
+	req, err := http.NewRequest("GET", p.URI+path, nil)
+	if err != nil {
+		return err
+	}
+	p.setAuth(req)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "fetching "+doing); derr != nil {
+			return derr
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "reading "+doing); derr != nil {
+			return derr
+		}
+		return err
+	}
+	return nil
+}
+
+// readAuthFile reads the user and the password from the first line of the file in the form of <user>:<password>
+func readAuthFile(path string) (user, password string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	line := strings.TrimRight(strings.SplitN(string(b), "\n", 2)[0], "\r")
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("%s should be in the form of <user>:<password>", path)
+	}
+	return line[:i], line[i+1:], nil
+}
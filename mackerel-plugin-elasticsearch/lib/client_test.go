@@ -0,0 +1,105 @@
+package mpelasticsearch
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchMetricsBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "elastic" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"type":"security_exception"},"status":401}`))
+			return
+		}
+		testHandler(w, r)
+	}))
+	defer ts.Close()
+
+	elasticsearch := ElasticsearchPlugin{URI: ts.URL, User: "elastic", Password: "secret"}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6991, stat["http_opened"])
+
+	elasticsearch.Password = "wrong"
+	_, err = elasticsearch.FetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), "authentication failed: 401 Unauthorized") {
+		t.Errorf("FetchMetrics() should fail with the authentication: %v", err)
+	}
+}
+
+func TestFetchMetricsAPIKey(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "ApiKey a2V5OnNlY3JldA==" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		testHandler(w, r)
+	}))
+	defer ts.Close()
+
+	elasticsearch := ElasticsearchPlugin{URI: ts.URL, User: "elastic", Password: "secret", APIKey: "a2V5OnNlY3JldA=="}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6991, stat["http_opened"])
+}
+
+func TestFetchMetricsTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(testHandler)
+	defer ts.Close()
+
+	elasticsearch := ElasticsearchPlugin{URI: ts.URL}
+	_, err := elasticsearch.FetchMetrics()
+	assert.NotNil(t, err, "the certificate of the test server should not be verified")
+
+	elasticsearch.InsecureSkipVerify = true
+	_, err = elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "mackerel-plugin-elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacert := filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(cacert, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	elasticsearch = ElasticsearchPlugin{URI: ts.URL, CACert: cacert}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6991, stat["http_opened"])
+}
+
+func TestReadAuthFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auth")
+	if err := ioutil.WriteFile(path, []byte("elastic:p@ss:word\r\nignored\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	user, password, err := readAuthFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "elastic", user)
+	assert.Equal(t, "p@ss:word", password)
+
+	invalid := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(invalid, []byte("elastic\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = readAuthFile(invalid)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,103 @@
+package mpelasticsearch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// clusterStatuses are the values of the status of the cluster health
+var clusterStatuses = map[string]float64{
+	"green":  0,
+	"yellow": 1,
+	"red":    2,
+}
+
+var clusterHealthPlace = map[string]string{
+	"cluster_number_of_nodes":           "number_of_nodes",
+	"cluster_number_of_data_nodes":      "number_of_data_nodes",
+	"cluster_active_primary_shards":     "active_primary_shards",
+	"cluster_active_shards":             "active_shards",
+	"cluster_relocating_shards":         "relocating_shards",
+	"cluster_initializing_shards":       "initializing_shards",
+	"cluster_unassigned_shards":         "unassigned_shards",
+	"cluster_delayed_unassigned_shards": "delayed_unassigned_shards",
+}
+
+// fetchClusterHealth returns the metrics of _cluster/health and the number of _cluster/pending_tasks, which are
+// answered by the master. They are bounded by ClusterHealthTimeout, so that the node stats are posted in time.
+func (p ElasticsearchPlugin) fetchClusterHealth(ctx context.Context, client *http.Client) (map[string]float64, error) {
+	if p.ClusterHealthTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.ClusterHealthTimeout)
+		defer cancel()
+	}
+
+	var health map[string]interface{}
+	if err := p.get(ctx, client, "/_cluster/health", "the cluster health", &health); err != nil {
+		return nil, err
+	}
+
+	stat := make(map[string]float64)
+	status, ok := clusterStatuses[fmt.Sprint(health["status"])]
+	if !ok {
+		return nil, fmt.Errorf("unknown status of the cluster: %v", health["status"])
+	}
+	stat["cluster_status"] = status
+	for k, v := range clusterHealthPlace {
+		if val, ok := health[v].(float64); ok {
+			stat[k] = val
+		}
+	}
+
+	var pending struct {
+		Tasks []interface{} `json:"tasks"`
+	}
+	if err := p.get(ctx, client, "/_cluster/pending_tasks", "the pending tasks of the cluster", &pending); err != nil {
+		// the health fetched so far is posted
+		return stat, err
+	}
+	stat["cluster_pending_tasks"] = float64(len(pending.Tasks))
+	return stat, nil
+}
+
+func (p ElasticsearchPlugin) clusterGraphDefinition() map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		p.Prefix + ".cluster.status": {
+			Label: (p.LabelPrefix + " Cluster Status"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_status", Label: "Status (green=0, yellow=1, red=2)"},
+			},
+		},
+		p.Prefix + ".cluster.nodes": {
+			Label: (p.LabelPrefix + " Cluster Nodes"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_number_of_nodes", Label: "Nodes"},
+				{Name: "cluster_number_of_data_nodes", Label: "Data Nodes"},
+			},
+		},
+		p.Prefix + ".cluster.shards": {
+			Label: (p.LabelPrefix + " Cluster Shards"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_active_primary_shards", Label: "Active Primary"},
+				{Name: "cluster_active_shards", Label: "Active"},
+				{Name: "cluster_relocating_shards", Label: "Relocating"},
+				{Name: "cluster_initializing_shards", Label: "Initializing"},
+				{Name: "cluster_unassigned_shards", Label: "Unassigned"},
+				{Name: "cluster_delayed_unassigned_shards", Label: "Delayed Unassigned"},
+			},
+		},
+		p.Prefix + ".cluster.pending_tasks": {
+			Label: (p.LabelPrefix + " Cluster Pending Tasks"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_pending_tasks", Label: "Pending Tasks"},
+			},
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package mpelasticsearch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchMetricsClusterHealth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/_nodes/_local/stats", testHandler)
+	mux.HandleFunc("/_cluster/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"cluster_name":"test","status":"yellow","timed_out":false,"number_of_nodes":3,"number_of_data_nodes":2,"active_primary_shards":5,"active_shards":9,"relocating_shards":1,"initializing_shards":0,"unassigned_shards":1,"delayed_unassigned_shards":0,"number_of_pending_tasks":2}`)
+	})
+	mux.HandleFunc("/_cluster/pending_tasks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"tasks":[{"insert_order":101,"priority":"URGENT","source":"create-index [foo_9]","time_in_queue_millis":86},{"insert_order":46,"priority":"HIGH","source":"shard-started","time_in_queue_millis":842}]}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	elasticsearch := ElasticsearchPlugin{URI: ts.URL, ClusterHealth: true}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 6991, stat["http_opened"])
+	assert.EqualValues(t, 1, stat["cluster_status"])
+	assert.EqualValues(t, 3, stat["cluster_number_of_nodes"])
+	assert.EqualValues(t, 2, stat["cluster_number_of_data_nodes"])
+	assert.EqualValues(t, 5, stat["cluster_active_primary_shards"])
+	assert.EqualValues(t, 9, stat["cluster_active_shards"])
+	assert.EqualValues(t, 1, stat["cluster_relocating_shards"])
+	assert.EqualValues(t, 0, stat["cluster_initializing_shards"])
+	assert.EqualValues(t, 1, stat["cluster_unassigned_shards"])
+	assert.EqualValues(t, 2, stat["cluster_pending_tasks"])
+}
+
+func TestFetchMetricsClusterHealthTimeout(t *testing.T) {
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/_nodes/_local/stats", testHandler)
+	mux.HandleFunc("/_cluster/health", func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	defer close(done)
+
+	elasticsearch := ElasticsearchPlugin{
+		URI:                  ts.URL,
+		ClusterHealth:        true,
+		ClusterHealthTimeout: 100 * time.Millisecond,
+	}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err, "the node stats should be posted without the cluster health")
+	assert.EqualValues(t, 6991, stat["http_opened"])
+	assert.NotContains(t, stat, "cluster_status")
+}
+
+func TestGraphDefinitionClusterHealth(t *testing.T) {
+	elasticsearch := ElasticsearchPlugin{Prefix: "elasticsearch", LabelPrefix: "Elasticsearch"}
+	assert.NotContains(t, elasticsearch.GraphDefinition(), "elasticsearch.cluster.status")
+
+	elasticsearch.ClusterHealth = true
+	graphdef := elasticsearch.GraphDefinition()
+	assert.EqualValues(t, "Elasticsearch Cluster Status", graphdef["elasticsearch.cluster.status"].Label)
+	assert.EqualValues(t, "cluster_unassigned_shards", graphdef["elasticsearch.cluster.shards"].Metrics[4].Name)
+}
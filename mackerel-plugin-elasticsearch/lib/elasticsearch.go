@@ -1,18 +1,18 @@
 package mpelasticsearch
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"net/http"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
-var logger = logging.GetLogger("metrics.plugin.elasticsearch")
+var logger = pluginutil.NewLogger("elasticsearch")
 
 var metricPlace = map[string][]string{
 	"http_opened":                 {"http", "total_opened"},
@@ -92,25 +92,41 @@ type ElasticsearchPlugin struct {
 	URI         string
 	Prefix      string
 	LabelPrefix string
+
+	// User and Password authenticate with the basic authentication, unless APIKey is given
+	User     string
+	Password string
+	APIKey   string
+
+	InsecureSkipVerify bool
+	CACert             string
+
+	// ClusterHealth fetches the health of the cluster, which should be enabled on one node of the cluster
+	ClusterHealth        bool
+	ClusterHealthTimeout time.Duration
+
+	// Indices selects the indices whose stats are posted, at most IndicesLimit largest ones if it is positive
+	Indices      *IndexFilter
+	IndicesLimit int
+
+	MaxExecutionTime time.Duration
 }
 
 // FetchMetrics interface for mackerelplugin
 func (p ElasticsearchPlugin) FetchMetrics() (map[string]float64, error) {
-	resp, err := http.Get(p.URI + "/_nodes/_local/stats")
+	ctx, cancel := pluginutil.WithMaxExecutionTime(p.MaxExecutionTime)
+	defer cancel()
+
+	client, err := p.httpClient()
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	stat := make(map[string]float64)
-	decoder := json.NewDecoder(resp.Body)
-
 	var s map[string]interface{}
-	err = decoder.Decode(&s)
-	if err != nil {
+	if err := p.get(ctx, client, "/_nodes/_local/stats", "the node stats", &s); err != nil {
 		return nil, err
 	}
 
+	stat := make(map[string]float64)
 	nodes := s["nodes"].(map[string]interface{})
 	n := ""
 	for k := range nodes {
@@ -121,16 +137,37 @@ func (p ElasticsearchPlugin) FetchMetrics() (map[string]float64, error) {
 	}
 	node := nodes[n].(map[string]interface{})
 
+	log := logger.With(pluginutil.LogFields{"uri": p.URI, "node": n})
 	for k, v := range metricPlace {
 		val, err := getFloatValue(node, v)
 		if err != nil {
-			logger.Errorf("Failed to find '%s': %s", k, err)
+			log.Errorf("Failed to find '%s': %s", k, err)
 			continue
 		}
 
 		stat[k] = val
 	}
 
+	if p.ClusterHealth {
+		// the node stats are posted even if the master is too busy to answer
+		clusterStat, err := p.fetchClusterHealth(ctx, client)
+		if err != nil {
+			log.Warningf("Failed to fetch the cluster health: %s", err)
+		}
+		for k, v := range clusterStat {
+			stat[k] = v
+		}
+	}
+	if p.Indices != nil {
+		indexStat, err := p.fetchIndices(ctx, client)
+		if err != nil {
+			log.Warningf("Failed to fetch the stats of the indices: %s", err)
+		}
+		for k, v := range indexStat {
+			stat[k] = v
+		}
+	}
+
 	return stat, nil
 }
 
@@ -239,6 +276,17 @@ func (p ElasticsearchPlugin) GraphDefinition() map[string]mp.Graphs {
 		},
 	}
 
+	if p.ClusterHealth {
+		for k, v := range p.clusterGraphDefinition() {
+			graphdef[k] = v
+		}
+	}
+	if p.Indices != nil {
+		for k, v := range p.indicesGraphDefinition() {
+			graphdef[k] = v
+		}
+	}
+
 	return graphdef
 }
 
@@ -250,11 +298,48 @@ func Do() {
 	optPrefix := flag.String("metric-key-prefix", "elasticsearch", "Metric key prefix")
 	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric Label prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optUser := flag.String("user", "", "User of the basic authentication")
+	optPassword := flag.String("password", "", "Password of the basic authentication (or $MACKEREL_PLUGIN_ELASTICSEARCH_PASSWORD)")
+	optAuthFile := flag.String("authfile", "", "File of <user>:<password> of the basic authentication")
+	optAPIKey := flag.String("api-key", "", "Base64 encoded API key sent as the Authorization: ApiKey header (or $MACKEREL_PLUGIN_ELASTICSEARCH_API_KEY)")
+	optInsecure := flag.Bool("insecure", false, "Skip the verification of the server certificate")
+	optCACert := flag.String("cacert", "", "CA certificate file to verify the server certificate")
+	optClusterHealth := flag.Bool("cluster-health", false, "Fetch the health of the cluster (enable on one node of the cluster)")
+	optClusterHealthTimeout := flag.Duration("cluster-health-timeout", 10*time.Second, "Timeout to fetch the health of the cluster")
+	optIndices := flag.String("indices", "", "Comma separated names of the indices, or the regexp of them enclosed in slashes such as /^logs-/")
+	optIndicesLimit := flag.Int("indices-limit", 0, "Max number of the indices posted in the descending order of the store size (0 for no limit)")
+	optMaxExecutionTime := pluginutil.MaxExecutionTimeFlag(flag.CommandLine)
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_ELASTICSEARCH_PASSWORD")
+	envutil.SetFromEnv(flag.CommandLine, "api-key", "MACKEREL_PLUGIN_ELASTICSEARCH_API_KEY")
 
 	var elasticsearch ElasticsearchPlugin
 	elasticsearch.URI = fmt.Sprintf("%s://%s:%s", *optScheme, *optHost, *optPort)
 	elasticsearch.Prefix = *optPrefix
+	elasticsearch.MaxExecutionTime = *optMaxExecutionTime
+	elasticsearch.User = *optUser
+	elasticsearch.Password = *optPassword
+	elasticsearch.APIKey = *optAPIKey
+	elasticsearch.InsecureSkipVerify = *optInsecure
+	elasticsearch.CACert = *optCACert
+	elasticsearch.ClusterHealth = *optClusterHealth
+	elasticsearch.ClusterHealthTimeout = *optClusterHealthTimeout
+	if *optIndices != "" {
+		indices, err := ParseIndexFilter(*optIndices)
+		if err != nil {
+			logger.Fatalf("Invalid -indices: %s", err)
+		}
+		elasticsearch.Indices = indices
+		elasticsearch.IndicesLimit = *optIndicesLimit
+	}
+	if *optAuthFile != "" {
+		user, password, err := readAuthFile(*optAuthFile)
+		if err != nil {
+			logger.Fatalf("Failed to read the auth file: %s", err)
+		}
+		elasticsearch.User = user
+		elasticsearch.Password = password
+	}
 	if *optLabelPrefix == "" {
 		elasticsearch.LabelPrefix = strings.Title(*optPrefix)
 	} else {
@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -51,3 +53,21 @@ func TestFetchMetrics(t *testing.T) {
 	assert.EqualValues(t, 3, stat["threads_fetch_shard_store"])
 	assert.EqualValues(t, 1, stat["threads_listener"])
 }
+
+func TestFetchMetricsMaxExecutionTime(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	elasticsearch := ElasticsearchPlugin{
+		URI:              ts.URL,
+		MaxExecutionTime: 100 * time.Millisecond,
+	}
+	_, err := elasticsearch.FetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), "deadline exceeded while fetching the node stats") {
+		t.Errorf("FetchMetrics() should fail with the deadline: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package mpelasticsearch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// IndexFilter selects the indices whose stats are posted
+type IndexFilter struct {
+	// Names are the names of the indices, or Pattern matches the names if Names is empty
+	Names   []string
+	Pattern *regexp.Regexp
+}
+
+// ParseIndexFilter parses the comma separated names of the indices, or the regexp enclosed in slashes, e.g. /^logs-/
+func ParseIndexFilter(s string) (*IndexFilter, error) {
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		return &IndexFilter{Pattern: re}, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no indices in %q", s)
+	}
+	return &IndexFilter{Names: names}, nil
+}
+
+// path returns the path of the primaries stats of the indices, where the names are given to Elasticsearch
+// so as not to fetch the stats of all the indices
+func (f *IndexFilter) path() string {
+	const metrics = "/_stats/docs,store,indexing,search?level=indices"
+	if len(f.Names) == 0 {
+		return metrics
+	}
+	names := make([]string, len(f.Names))
+	for i, name := range f.Names {
+		names[i] = url.PathEscape(name)
+	}
+	return "/" + strings.Join(names, ",") + metrics + "&ignore_unavailable=true"
+}
+
+func (f *IndexFilter) match(name string) bool {
+	if f.Pattern != nil {
+		return f.Pattern.MatchString(name)
+	}
+	for _, n := range f.Names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+var indexStatPlace = map[string][]string{
+	"docs_count":           {"docs", "count"},
+	"store_size_bytes":     {"store", "size_in_bytes"},
+	"indexing_index_total": {"indexing", "index_total"},
+	"search_query_total":   {"search", "query_total"},
+}
+
+// indexMetricName escapes the name of the index into the characters allowed in the metric names, so that
+// the names of the indices are distinguished: "_" is escaped as "__", and the other characters but the
+// alphanumerics and "-" are escaped as "_" followed by the hex digits of their bytes, e.g. "." as "_2e".
+func indexMetricName(name string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		case c == '_':
+			b.WriteString("__")
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// fetchIndices returns the primaries stats of the indices matched with Indices as index.<name>.*, which are limited
+// to the IndicesLimit largest indices in the store size if IndicesLimit is positive
+func (p ElasticsearchPlugin) fetchIndices(ctx context.Context, client *http.Client) (map[string]float64, error) {
+	var s struct {
+		Indices map[string]struct {
+			Primaries map[string]interface{} `json:"primaries"`
+		} `json:"indices"`
+	}
+	if err := p.get(ctx, client, p.Indices.path(), "the stats of the indices", &s); err != nil {
+		return nil, err
+	}
+
+	type index struct {
+		name string
+		stat map[string]float64
+	}
+	var indices []index
+	for name, v := range s.Indices {
+		if !p.Indices.match(name) {
+			continue
+		}
+		stat := make(map[string]float64)
+		for k, place := range indexStatPlace {
+			if val, err := getFloatValue(v.Primaries, place); err == nil {
+				stat[k] = val
+			}
+		}
+		indices = append(indices, index{name: name, stat: stat})
+	}
+	if p.IndicesLimit > 0 && len(indices) > p.IndicesLimit {
+		sort.Slice(indices, func(i, j int) bool {
+			si, sj := indices[i].stat["store_size_bytes"], indices[j].stat["store_size_bytes"]
+			if si != sj {
+				return si > sj
+			}
+			return indices[i].name < indices[j].name
+		})
+		indices = indices[:p.IndicesLimit]
+	}
+
+	stat := make(map[string]float64)
+	for _, i := range indices {
+		prefix := p.Prefix + ".index." + indexMetricName(i.name) + "."
+		for k, v := range i.stat {
+			stat[prefix+k] = v
+		}
+	}
+	return stat, nil
+}
+
+func (p ElasticsearchPlugin) indicesGraphDefinition() map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		p.Prefix + ".index.#": {
+			Label: (p.LabelPrefix + " Index"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "docs_count", Label: "Docs"},
+				{Name: "store_size_bytes", Label: "Store Size (bytes)"},
+				{Name: "indexing_index_total", Label: "Indexing-Index", Diff: true},
+				{Name: "search_query_total", Label: "Search-Query", Diff: true},
+			},
+		},
+	}
+}
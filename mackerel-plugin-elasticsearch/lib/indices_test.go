@@ -0,0 +1,74 @@
+package mpelasticsearch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testIndicesStats = `{"_shards":{"total":6,"successful":6,"failed":0},"indices":{
+"logs-2020.01.01":{"uuid":"a","primaries":{"docs":{"count":100,"deleted":0},"store":{"size_in_bytes":4096},"indexing":{"index_total":120},"search":{"query_total":30}},"total":{"docs":{"count":200}}},
+"logs-2020.01.02":{"uuid":"b","primaries":{"docs":{"count":50,"deleted":0},"store":{"size_in_bytes":8192},"indexing":{"index_total":60},"search":{"query_total":10}}},
+"my_index":{"uuid":"c","primaries":{"docs":{"count":1},"store":{"size_in_bytes":1024},"indexing":{"index_total":1},"search":{"query_total":2}}}}}`
+
+func TestParseIndexFilter(t *testing.T) {
+	f, err := ParseIndexFilter("logs-a, logs-b,")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"logs-a", "logs-b"}, f.Names)
+	assert.Equal(t, "/logs-a,logs-b/_stats/docs,store,indexing,search?level=indices&ignore_unavailable=true", f.path())
+	assert.True(t, f.match("logs-b"))
+	assert.False(t, f.match("logs-c"))
+
+	f, err = ParseIndexFilter("/^logs-/")
+	assert.Nil(t, err)
+	assert.Equal(t, "/_stats/docs,store,indexing,search?level=indices", f.path())
+	assert.True(t, f.match("logs-c"))
+	assert.False(t, f.match("my_index"))
+
+	_, err = ParseIndexFilter("/[/")
+	assert.NotNil(t, err)
+	_, err = ParseIndexFilter(",")
+	assert.NotNil(t, err)
+}
+
+func TestIndexMetricName(t *testing.T) {
+	assert.Equal(t, "logs-2020_2e01_2e01", indexMetricName("logs-2020.01.01"))
+	assert.Equal(t, "my__index", indexMetricName("my_index"))
+	assert.Equal(t, "_2ekibana", indexMetricName(".kibana"))
+	// the names are distinguished after they are escaped
+	assert.NotEqual(t, indexMetricName("a._b"), indexMetricName("a_.b"))
+	assert.NotEqual(t, indexMetricName("a.b"), indexMetricName("a_2eb"))
+}
+
+func TestFetchMetricsIndices(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/_nodes/_local/stats", testHandler)
+	mux.HandleFunc("/_stats/docs,store,indexing,search", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testIndicesStats)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	indices, _ := ParseIndexFilter("/^logs-/")
+	elasticsearch := ElasticsearchPlugin{URI: ts.URL, Prefix: "elasticsearch", Indices: indices}
+	stat, err := elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 6991, stat["http_opened"])
+	assert.EqualValues(t, 100, stat["elasticsearch.index.logs-2020_2e01_2e01.docs_count"])
+	assert.EqualValues(t, 4096, stat["elasticsearch.index.logs-2020_2e01_2e01.store_size_bytes"])
+	assert.EqualValues(t, 120, stat["elasticsearch.index.logs-2020_2e01_2e01.indexing_index_total"])
+	assert.EqualValues(t, 30, stat["elasticsearch.index.logs-2020_2e01_2e01.search_query_total"])
+	assert.EqualValues(t, 50, stat["elasticsearch.index.logs-2020_2e01_2e02.docs_count"])
+	assert.NotContains(t, stat, "elasticsearch.index.my__index.docs_count")
+
+	// the largest index is left
+	elasticsearch.IndicesLimit = 1
+	stat, err = elasticsearch.FetchMetrics()
+	assert.Nil(t, err)
+	assert.Contains(t, stat, "elasticsearch.index.logs-2020_2e01_2e02.docs_count")
+	assert.NotContains(t, stat, "elasticsearch.index.logs-2020_2e01_2e01.docs_count")
+}
@@ -12,14 +12,23 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/golib/logging"
 )
 
+var logger = logging.GetLogger("metrics.plugin.fluentd")
+
 // FluentdMetrics plugin for fluentd
 type FluentdMetrics struct {
-	Target          string
+	Target string
+	// Targets are monitor_agent of the workers of the multi-worker fluentd, which are used instead of Target
+	Targets []string
+	// PerWorker posts the metrics of each worker instead of the sum of them
+	PerWorker       bool
 	Tempfile        string
 	pluginType      string
 	pluginIDPattern *regexp.Regexp
+	// pluginTypePattern matches the whole type, so that -plugin-type of a type name matches the type only
+	pluginTypePattern *regexp.Regexp
 
 	plugins []FluentdPluginMetrics
 }
@@ -33,7 +42,15 @@ type FluentdPluginMetrics struct {
 	Type                  string `json:"type"`
 	PluginCategory        string `json:"plugin_category"`
 	PluginID              string `json:"plugin_id"`
-	normalizedPluginID    string
+	// the counters of fluentd v1, which are missing in the older versions
+	EmitRecords   *uint64 `json:"emit_records"`
+	EmitCount     *uint64 `json:"emit_count"`
+	WriteCount    *uint64 `json:"write_count"`
+	RollbackCount *uint64 `json:"rollback_count"`
+	Retry         *struct {
+		Steps *uint64 `json:"steps"`
+	} `json:"retry"`
+	normalizedPluginID string
 }
 
 // FluentMonitorJSON monitor json
@@ -47,6 +64,7 @@ func normalizePluginID(in string) string {
 	return normalizePluginIDRe.ReplaceAllString(in, "_")
 }
 
+// getNormalizedPluginID returns the plugin_id, which is stable across the restarts if it is set by @id
 func (fpm FluentdPluginMetrics) getNormalizedPluginID() string {
 	if fpm.normalizedPluginID == "" {
 		fpm.normalizedPluginID = normalizePluginID(fpm.PluginID)
@@ -60,14 +78,33 @@ func (f *FluentdMetrics) parseStats(body []byte) (map[string]interface{}, error)
 	f.plugins = j.Plugins
 
 	metrics := make(map[string]interface{})
+	typeIndexes := make(map[string]int)
 	for _, p := range f.plugins {
 		if f.nonTargetPlugin(p) {
 			continue
 		}
 		pid := p.getNormalizedPluginID()
+		if pid == "" {
+			// the type and the index in the plugins of the type without plugin_id
+			pid = normalizePluginID(fmt.Sprintf("%s_%d", p.Type, typeIndexes[p.Type]))
+			typeIndexes[p.Type]++
+		}
 		metrics["fluentd.retry_count."+pid] = float64(p.RetryCount)
 		metrics["fluentd.buffer_queue_length."+pid] = float64(p.BufferQueueLength)
 		metrics["fluentd.buffer_total_queued_size."+pid] = float64(p.BufferTotalQueuedSize)
+		for name, v := range map[string]*uint64{
+			"emit_records":   p.EmitRecords,
+			"emit_count":     p.EmitCount,
+			"write_count":    p.WriteCount,
+			"rollback_count": p.RollbackCount,
+		} {
+			if v != nil {
+				metrics["fluentd."+name+"."+pid] = float64(*v)
+			}
+		}
+		if p.Retry != nil && p.Retry.Steps != nil {
+			metrics["fluentd.retry_steps."+pid] = float64(*p.Retry.Steps)
+		}
 	}
 	return metrics, err
 }
@@ -76,7 +113,11 @@ func (f *FluentdMetrics) nonTargetPlugin(plugin FluentdPluginMetrics) bool {
 	if plugin.PluginCategory != "output" {
 		return true
 	}
-	if f.pluginType != "" && f.pluginType != plugin.Type {
+	if f.pluginTypePattern != nil {
+		if !f.pluginTypePattern.MatchString(plugin.Type) {
+			return true
+		}
+	} else if f.pluginType != "" && f.pluginType != plugin.Type {
 		return true
 	}
 	if f.pluginIDPattern != nil && !f.pluginIDPattern.MatchString(plugin.PluginID) {
@@ -87,10 +128,18 @@ func (f *FluentdMetrics) nonTargetPlugin(plugin FluentdPluginMetrics) bool {
 
 // FetchMetrics interface for mackerelplugin
 func (f FluentdMetrics) FetchMetrics() (map[string]interface{}, error) {
-	resp, err := http.Get(f.Target)
+	if len(f.Targets) > 0 {
+		return f.fetchWorkersMetrics()
+	}
+	return f.fetchMetrics(f.Target)
+}
+
+func (f FluentdMetrics) fetchMetrics(target string) (map[string]interface{}, error) {
+	resp, err := http.Get(target)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -123,14 +172,51 @@ func (f FluentdMetrics) GraphDefinition() map[string]mp.Graphs {
 				{Name: "*", Label: "%1", Diff: false},
 			},
 		},
+		"fluentd.retry_steps": {
+			Label: "Fluentd retry steps",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: false},
+			},
+		},
+		"fluentd.emit_records": {
+			Label: "Fluentd emit records",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: true},
+			},
+		},
+		"fluentd.emit_count": {
+			Label: "Fluentd emit count",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: true},
+			},
+		},
+		"fluentd.write_count": {
+			Label: "Fluentd write count",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: true},
+			},
+		},
+		"fluentd.rollback_count": {
+			Label: "Fluentd rollback count",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: true},
+			},
+		},
 	}
 }
 
 // Do the plugin
 func Do() {
 	host := flag.String("host", "localhost", "fluentd monitor_agent host")
-	port := flag.String("port", "24220", "fluentd monitor_agent port")
-	pluginType := flag.String("plugin-type", "", "Gets the metric that matches this plugin type")
+	port := flag.String("port", "24220", "fluentd monitor_agent port, or comma separated ports of the workers")
+	workers := flag.Int("workers", 0, "Number of the workers of fluentd, whose monitor_agent ports are sequential from -port")
+	perWorker := flag.Bool("per-worker", false, "Post the metrics of each worker instead of the sum of the workers")
+	pluginType := flag.String("plugin-type", "", "Gets the metric that matches this plugin type (regexp matching the whole type)")
 	pluginIDPatternString := flag.String("plugin-id-pattern", "", "Gets the metric that matches this plugin id pattern")
 	tempFile := flag.String("tempfile", "", "Temp file name")
 	flag.Parse()
@@ -145,24 +231,51 @@ func Do() {
 		}
 	}
 
+	var pluginTypePattern *regexp.Regexp
+	if *pluginType != "" {
+		pluginTypePattern, err = regexp.Compile("^(?:" + *pluginType + ")$")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to exec mackerel-plugin-fluentd: invalid plugin-type: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ports, err := parsePorts(*port, *workers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to exec mackerel-plugin-fluentd: %s\n", err)
+		os.Exit(1)
+	}
+
 	f := FluentdMetrics{
-		Target:          fmt.Sprintf("http://%s:%s/api/plugins.json", *host, *port),
+		Target:          fmt.Sprintf("http://%s:%s/api/plugins.json", *host, ports[0]),
+		PerWorker:       *perWorker,
 		Tempfile:        *tempFile,
 		pluginType:      *pluginType,
 		pluginIDPattern: pluginIDPattern,
+
+		pluginTypePattern: pluginTypePattern,
+	}
+
+	if len(ports) > 1 {
+		for _, p := range ports {
+			f.Targets = append(f.Targets, fmt.Sprintf("http://%s:%s/api/plugins.json", *host, p))
+		}
 	}
 
 	helper := mp.NewMackerelPlugin(f)
 
 	helper.Tempfile = *tempFile
 	if *tempFile == "" {
-		tempFileSuffix := []string{*host, *port}
+		tempFileSuffix := []string{*host, strings.Join(ports, "_")}
 		if *pluginType != "" {
 			tempFileSuffix = append(tempFileSuffix, *pluginType)
 		}
 		if *pluginIDPatternString != "" {
 			tempFileSuffix = append(tempFileSuffix, fmt.Sprintf("%x", md5.Sum([]byte(*pluginIDPatternString))))
 		}
+		if *perWorker {
+			tempFileSuffix = append(tempFileSuffix, "per-worker")
+		}
 		helper.SetTempfileByBasename(fmt.Sprintf("mackerel-plugin-fluentd-%s", strings.Join(tempFileSuffix, "-")))
 	}
 
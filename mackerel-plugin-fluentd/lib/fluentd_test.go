@@ -12,8 +12,8 @@ func TestGraphDefinition(t *testing.T) {
 	var fluentd FluentdMetrics
 
 	graphdef := fluentd.GraphDefinition()
-	if len(graphdef) != 3 {
-		t.Errorf("GetTempfilename: %d should be 3", len(graphdef))
+	if len(graphdef) != 8 {
+		t.Errorf("GetTempfilename: %d should be 8", len(graphdef))
 	}
 }
 
@@ -101,3 +101,29 @@ func TestPluginIDPatternOption(t *testing.T) {
 	assert.EqualValues(t, reflect.TypeOf(stat["fluentd.buffer_total_queued_size.do_not_match_plugin_id"]).String(), "float64")
 	assert.EqualValues(t, stat["fluentd.buffer_total_queued_size.do_not_match_plugin_id"].(float64), 53)
 }
+
+func TestParseCounters(t *testing.T) {
+	// fluentd v1 with @id, and the older one without the counters
+	stub := `{"plugins":[{"plugin_id":"out_es","plugin_category":"output","type":"elasticsearch","output_plugin":true,"buffer_queue_length":2,"buffer_total_queued_size":1024,"retry_count":5,"emit_records":1200,"emit_count":30,"write_count":28,"rollback_count":1,"retry":{"start":"2023-01-02 03:04:05 +0900","steps":3,"next_time":"2023-01-02 03:05:05 +0900"}},{"plugin_id":"out_file","plugin_category":"output","type":"file","output_plugin":true,"buffer_queue_length":0,"buffer_total_queued_size":0,"retry_count":0},{"plugin_category":"output","type":"forward","output_plugin":true,"retry_count":0},{"plugin_id":"in_tail","plugin_category":"input","type":"tail","output_plugin":false,"emit_records":99}]}`
+
+	var fluentd FluentdMetrics
+	stat, err := fluentd.parseStats([]byte(stub))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1200, stat["fluentd.emit_records.out_es"])
+	assert.EqualValues(t, 30, stat["fluentd.emit_count.out_es"])
+	assert.EqualValues(t, 28, stat["fluentd.write_count.out_es"])
+	assert.EqualValues(t, 1, stat["fluentd.rollback_count.out_es"])
+	assert.EqualValues(t, 3, stat["fluentd.retry_steps.out_es"])
+	assert.EqualValues(t, 5, stat["fluentd.retry_count.out_es"])
+	assert.NotContains(t, stat, "fluentd.emit_records.out_file")
+	assert.NotContains(t, stat, "fluentd.retry_steps.out_file")
+	assert.Contains(t, stat, "fluentd.retry_count.forward_0")
+	assert.NotContains(t, stat, "fluentd.emit_records.in_tail")
+
+	fluentd = FluentdMetrics{pluginTypePattern: regexp.MustCompile("^(?:elastic.*|forward)$")}
+	stat, err = fluentd.parseStats([]byte(stub))
+	assert.Nil(t, err)
+	assert.Contains(t, stat, "fluentd.emit_records.out_es")
+	assert.Contains(t, stat, "fluentd.retry_count.forward_0")
+	assert.NotContains(t, stat, "fluentd.retry_count.out_file")
+}
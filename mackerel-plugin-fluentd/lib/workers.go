@@ -0,0 +1,68 @@
+package mpfluentd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePorts returns the ports of monitor_agent of the workers, which are a comma separated list, or the sequential
+// ports from the port for the number of the workers, as monitor_agent binds the port plus the worker id
+func parsePorts(ports string, workers int) ([]string, error) {
+	var result []string
+	for _, port := range strings.Split(ports, ",") {
+		if port = strings.TrimSpace(port); port != "" {
+			result = append(result, port)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no ports are specified")
+	}
+	if workers <= 1 {
+		return result, nil
+	}
+	if len(result) > 1 {
+		return nil, fmt.Errorf("-workers can't be used with the list of the ports")
+	}
+	base, err := strconv.Atoi(result[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q for -workers: %s", result[0], err)
+	}
+	result = nil
+	for i := 0; i < workers; i++ {
+		result = append(result, strconv.Itoa(base+i))
+	}
+	return result, nil
+}
+
+// fetchWorkersMetrics fetches the metrics of each worker, which are summed up per plugin, or named by the index of
+// the worker with PerWorker. The workers which are down are excluded.
+func (f FluentdMetrics) fetchWorkersMetrics() (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+	var lastErr error
+	fetched := 0
+	for i, target := range f.Targets {
+		workerStat, err := f.fetchMetrics(target)
+		if err != nil {
+			logger.Warningf("Failed to fetch the worker %s. Skip the worker. %s", target, err)
+			lastErr = err
+			continue
+		}
+		fetched++
+		for k, v := range workerStat {
+			if f.PerWorker {
+				stat[fmt.Sprintf("%s_worker%d", k, i)] = v
+				continue
+			}
+			if sum, ok := stat[k]; ok {
+				stat[k] = sum.(float64) + v.(float64)
+			} else {
+				stat[k] = v
+			}
+		}
+	}
+	if fetched == 0 {
+		return nil, lastErr
+	}
+	return stat, nil
+}
@@ -0,0 +1,56 @@
+package mpfluentd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("24220", 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"24220", "24221", "24222"}, ports)
+
+	ports, err = parsePorts("24220, 24230", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"24220", "24230"}, ports)
+
+	_, err = parsePorts("24220,24230", 2)
+	assert.NotNil(t, err)
+}
+
+func TestFetchWorkersMetrics(t *testing.T) {
+	worker := func(queued string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"plugins":[{"plugin_id":"out_es","plugin_category":"output","type":"elasticsearch","output_plugin":true,"buffer_queue_length":1,"buffer_total_queued_size":` + queued + `,"retry_count":0}]}`))
+		}))
+	}
+	w0 := worker("100")
+	defer w0.Close()
+	w1 := worker("200")
+	defer w1.Close()
+	// the worker which is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	f := FluentdMetrics{Targets: []string{w0.URL, down.URL, w1.URL}}
+	stat, err := f.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 300, stat["fluentd.buffer_total_queued_size.out_es"])
+	assert.EqualValues(t, 2, stat["fluentd.buffer_queue_length.out_es"])
+
+	f.PerWorker = true
+	stat, err = f.FetchMetrics()
+	assert.Nil(t, err)
+	if !reflect.DeepEqual(stat["fluentd.buffer_total_queued_size.out_es_worker2"], float64(200)) {
+		t.Errorf("the metrics should be named by the index of the worker, but %v", stat)
+	}
+	assert.NotContains(t, stat, "fluentd.buffer_total_queued_size.out_es")
+
+	f = FluentdMetrics{Targets: []string{down.URL}}
+	_, err = f.FetchMetrics()
+	assert.NotNil(t, err)
+}
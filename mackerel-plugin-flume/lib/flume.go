@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 const (
@@ -207,6 +208,11 @@ func (p *FlumePlugin) parseSource(ret map[string]float64, componentName string,
 	ret["source.connection." + componentName + ".OpenConnectionCount"]            = p.convertFloat64(value["OpenConnectionCount"].(string))
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the metrics
+func (p *FlumePlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "flume", p.URI)
+}
+
 // Do the plugin
 func Do() {
 	optHost     := flag.String("host", "localhost", "Host Name")
@@ -214,10 +220,11 @@ func Do() {
 	optPrefix   := flag.String("metric-key-prefix", "", "Metric key prefix")
 	optTempfile := flag.String("tempfile", "" , "Temp file name")
 	flag.Parse()
-	plugin := mp.NewMackerelPlugin(&FlumePlugin{
+	flume := &FlumePlugin{
 		URI:    fmt.Sprintf("http://%s:%s/metrics", *optHost, *optPort),
 		Prefix: *optPrefix,
-	})
-	plugin.Tempfile = *optTempfile
+	}
+	plugin := mp.NewMackerelPlugin(flume)
+	plugin.Tempfile = flume.tempfile(*optTempfile)
 	plugin.Run()
 }
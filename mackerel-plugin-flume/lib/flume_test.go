@@ -87,3 +87,13 @@ func TestParseMetrics(t *testing.T) {
 	assert.EqualValues(t, ret["source.event_num.source.EventReceivedCount"], 260969)
 	assert.EqualValues(t, ret["source.connection.source.OpenConnectionCount"], 0)
 }
+
+func TestTempfile(t *testing.T) {
+	p := &FlumePlugin{URI: "http://localhost:41414/metrics"}
+	if other := (&FlumePlugin{URI: "http://localhost:41415/metrics"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/flume.json"); f != "/tmp/flume.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"google.golang.org/api/monitoring/v3"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
 )
 
 const zuluFormat string = "2006-01-02T15:4:05Z"
@@ -217,10 +218,11 @@ func Do() {
 	optProject := flag.String("project", "", "Project Identifier (Name or ID)")
 	optInstanceName := flag.String("instance-name", "", "Instance Name")
 
-	optAPIKey := flag.String("api-key", "", "API key")
+	optAPIKey := flag.String("api-key", "", "API key (or $MACKEREL_PLUGIN_GCP_COMPUTE_ENGINE_API_KEY)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "api-key", "MACKEREL_PLUGIN_GCP_COMPUTE_ENGINE_API_KEY")
 
 	if *optAPIKey == "" {
 		log.Fatalln("-api-key is required")
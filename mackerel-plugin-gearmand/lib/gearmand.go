@@ -2,12 +2,15 @@ package mpgearmand
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -16,18 +19,6 @@ import (
 
 const nullPrefix = "-"
 
-var graphdef = map[string]mp.Graphs{
-	"gearmand.queue.#": {
-		Label: "Gearmand Queue",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "available", Label: "Available", Diff: false, Stacked: false},
-			{Name: "running", Label: "Running", Diff: false, Stacked: false},
-			{Name: "total", Label: "Total", Diff: false, Stacked: false},
-		},
-	},
-}
-
 type gearmandFunction struct {
 	function  string
 	available uint32
@@ -36,7 +27,7 @@ type gearmandFunction struct {
 }
 
 func (f *gearmandFunction) key(key string) string {
-	return "gearmand.queue." + f.name() + "." + key
+	return "queue." + f.name() + "." + key
 }
 
 func (f *gearmandFunction) name() string {
@@ -52,11 +43,33 @@ func (f *gearmandFunction) name() string {
 	return name
 }
 
+// metricKey returns the name of the function escaped to be unique in the metric names. The characters other than
+// alphanumerics and hyphens are replaced with "_" and their hex codes, and "_" itself is doubled, so that e.g.
+// Job::Foo and Job__Foo do not collide.
+func (f *gearmandFunction) metricKey() string {
+	var b bytes.Buffer
+	for _, c := range []byte(f.function) {
+		switch {
+		case c == '_':
+			b.WriteString("__")
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
+
 // GearmandPlugin mackerel plugin for gearmand
 type GearmandPlugin struct {
-	Target   string
-	Socket   string
-	Tempfile string
+	Target      string
+	Socket      string
+	Tempfile    string
+	Prefix      string
+	LabelPrefix string
+	// ExcludeFunction drops the functions matching the regexp if not nil
+	ExcludeFunction *regexp.Regexp
 }
 
 func (m GearmandPlugin) connect() (net.Conn, error) {
@@ -75,8 +88,23 @@ func (m GearmandPlugin) FetchMetrics() (map[string]interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 	fmt.Fprintln(conn, "status")
-	return m.parseStats(conn)
+	stat, err := m.parseStats(conn)
+	if err != nil {
+		return nil, err
+	}
+	// the response of status ends with "." and nothing follows it until the next command
+	fmt.Fprintln(conn, "workers")
+	workers, err := parseWorkers(conn)
+	if err != nil {
+		return nil, err
+	}
+	if stat == nil {
+		stat = make(map[string]interface{})
+	}
+	stat["connected_workers"] = workers
+	return stat, nil
 }
 
 func (m GearmandPlugin) parseStats(conn io.Reader) (map[string]interface{}, error) {
@@ -94,9 +122,18 @@ func (m GearmandPlugin) parseStats(conn io.Reader) (map[string]interface{}, erro
 			return nil, err
 		}
 
+		if m.ExcludeFunction != nil && m.ExcludeFunction.MatchString(function.function) {
+			continue
+		}
+
 		stat[function.key("available")] = function.available
 		stat[function.key("running")] = function.running
 		stat[function.key("total")] = function.total
+
+		key := "function." + function.metricKey()
+		stat[key+".queued"] = function.total
+		stat[key+".running"] = function.running
+		stat[key+".workers"] = function.available
 	}
 	if err := scanner.Err(); err != nil {
 		return stat, err
@@ -136,6 +173,31 @@ func parseLine(line string) (*gearmandFunction, error) {
 	}, nil
 }
 
+// parseWorkers returns the number of the connected worker processes, which have registered any functions, from the
+// response of the workers command
+func parseWorkers(conn io.Reader) (uint32, error) {
+	// format: FD IP-ADDRESS CLIENT-ID : FUNCTION ...
+	scanner := bufio.NewScanner(conn)
+	var workers uint32
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "." {
+			return workers, nil
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return 0, errors.New("Invalid format: " + line)
+		}
+		if strings.TrimSpace(line[i+1:]) != "" {
+			workers++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("unexpected end of the workers")
+}
+
 func reverse(src []string) []string {
 	length := len(src)
 	dest := make([]string, length)
@@ -145,9 +207,48 @@ func reverse(src []string) []string {
 	return dest
 }
 
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m GearmandPlugin) MetricKeyPrefix() string {
+	if m.Prefix == "" {
+		m.Prefix = "gearmand"
+	}
+	return m.Prefix
+}
+
 // GraphDefinition interface for mackerelplugin
 func (m GearmandPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := m.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(m.MetricKeyPrefix())
+	}
+
+	return map[string]mp.Graphs{
+		"queue.#": {
+			Label: labelPrefix + " Queue",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "available", Label: "Available", Diff: false, Stacked: false},
+				{Name: "running", Label: "Running", Diff: false, Stacked: false},
+				{Name: "total", Label: "Total", Diff: false, Stacked: false},
+			},
+		},
+		"function.#": {
+			Label: labelPrefix + " Function",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "queued", Label: "Queued"},
+				{Name: "running", Label: "Running"},
+				{Name: "workers", Label: "Workers"},
+			},
+		},
+		"workers": {
+			Label: labelPrefix + " Workers",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "connected_workers", Label: "Connected"},
+			},
+		},
+	}
 }
 
 // Do the plugin
@@ -156,9 +257,19 @@ func Do() {
 	optPort := flag.String("port", "7003", "Port")
 	optSocket := flag.String("socket", "", "Server socket (overrides hosts and port)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "gearmand", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
+	optExcludeFunction := flag.String("exclude-function", "", "Regexp of the functions not to be posted")
 	flag.Parse()
 
-	var gearmand GearmandPlugin
+	gearmand := GearmandPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
+	if *optExcludeFunction != "" {
+		re, err := regexp.Compile(*optExcludeFunction)
+		if err != nil {
+			log.Fatalf("Invalid -exclude-function: %s", err)
+		}
+		gearmand.ExcludeFunction = re
+	}
 	if *optSocket != "" {
 		gearmand.Socket = *optSocket
 	} else {
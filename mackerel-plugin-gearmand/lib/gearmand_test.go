@@ -3,6 +3,7 @@ package mpgearmand
 import (
 	"bytes"
 	"reflect"
+	"regexp"
 	"testing"
 	// "github.com/k0kubun/pp"
 
@@ -20,9 +21,18 @@ func TestGraphDefinition(t *testing.T) {
 
 	graphdef := gearmand.GraphDefinition()
 	// pp.Print(graphdef)
-	if len(graphdef) != 1 {
-		t.Errorf("parseDefinition: %d should be 1", len(graphdef))
+	if len(graphdef) != 3 {
+		t.Errorf("parseDefinition: %d should be 3", len(graphdef))
 	}
+
+	// the default prefixes keep the graph name and the label unchanged
+	assert.Equal(t, "gearmand", gearmand.MetricKeyPrefix())
+	assert.Equal(t, "Gearmand Queue", graphdef["queue.#"].Label)
+
+	gearmand.Prefix = "gearmand-jobs"
+	assert.Equal(t, "Gearmand-Jobs Queue", gearmand.GraphDefinition()["queue.#"].Label)
+	gearmand.LabelPrefix = "Jobs"
+	assert.Equal(t, "Jobs Queue", gearmand.GraphDefinition()["queue.#"].Label)
 }
 
 func TestParse(t *testing.T) {
@@ -32,19 +42,58 @@ func TestParse(t *testing.T) {
 	stat, err := gearmand.parseStats(status)
 	// pp.Print(stat)
 	assert.Nil(t, err)
-	if len(stat) != 9 {
-		t.Errorf("parseStats: %d should be 9", len(stat))
+	if len(stat) != 18 {
+		t.Errorf("parseStats: %d should be 18", len(stat))
 	}
 	for _, val := range stat {
 		assert.EqualValues(t, reflect.TypeOf(val).String(), "uint32")
 	}
-	assert.EqualValues(t, stat["gearmand.queue.Job--Foo.available"].(uint32), 6)
-	assert.EqualValues(t, stat["gearmand.queue.Job--Foo.running"].(uint32), 0)
-	assert.EqualValues(t, stat["gearmand.queue.Job--Foo.total"].(uint32), 0)
-	assert.EqualValues(t, stat["gearmand.queue.prefix1-Job--Bar.available"].(uint32), 18)
-	assert.EqualValues(t, stat["gearmand.queue.prefix1-Job--Bar.running"].(uint32), 0)
-	assert.EqualValues(t, stat["gearmand.queue.prefix1-Job--Bar.total"].(uint32), 0)
-	assert.EqualValues(t, stat["gearmand.queue.prefix2-Job--Baz.available"].(uint32), 18)
-	assert.EqualValues(t, stat["gearmand.queue.prefix2-Job--Baz.running"].(uint32), 1)
-	assert.EqualValues(t, stat["gearmand.queue.prefix2-Job--Baz.total"].(uint32), 1)
+	assert.EqualValues(t, stat["queue.Job--Foo.available"].(uint32), 6)
+	assert.EqualValues(t, stat["queue.Job--Foo.running"].(uint32), 0)
+	assert.EqualValues(t, stat["queue.Job--Foo.total"].(uint32), 0)
+	assert.EqualValues(t, stat["queue.prefix1-Job--Bar.available"].(uint32), 18)
+	assert.EqualValues(t, stat["queue.prefix1-Job--Bar.running"].(uint32), 0)
+	assert.EqualValues(t, stat["queue.prefix1-Job--Bar.total"].(uint32), 0)
+	assert.EqualValues(t, stat["queue.prefix2-Job--Baz.available"].(uint32), 18)
+	assert.EqualValues(t, stat["queue.prefix2-Job--Baz.running"].(uint32), 1)
+	assert.EqualValues(t, stat["queue.prefix2-Job--Baz.total"].(uint32), 1)
+}
+
+func TestParsePerFunction(t *testing.T) {
+	gearmand := GearmandPlugin{ExcludeFunction: regexp.MustCompile(`^prefix1\t`)}
+	status := bytes.NewBufferString(stub)
+
+	stat, err := gearmand.parseStats(status)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, stat["function.Job_3a_3aFoo.queued"])
+	assert.EqualValues(t, 6, stat["function.Job_3a_3aFoo.workers"])
+	assert.EqualValues(t, 1, stat["function.prefix2_09Job_3a_3aBaz.queued"])
+	assert.EqualValues(t, 1, stat["function.prefix2_09Job_3a_3aBaz.running"])
+	assert.EqualValues(t, 18, stat["function.prefix2_09Job_3a_3aBaz.workers"])
+	assert.NotContains(t, stat, "function.prefix1_09Job_3a_3aBar.queued")
+	assert.NotContains(t, stat, "queue.prefix1-Job--Bar.total")
+}
+
+func TestMetricKeyUnique(t *testing.T) {
+	keys := make(map[string]string)
+	for _, name := range []string{"Job::Foo", "Job__Foo", "Job_3a_3aFoo", "Job.Foo", "Job-Foo"} {
+		key := (&gearmandFunction{function: name}).metricKey()
+		if other, ok := keys[key]; ok {
+			t.Errorf("metricKey: %s and %s should not collide as %s", name, other, key)
+		}
+		keys[key] = name
+	}
+}
+
+func TestParseWorkers(t *testing.T) {
+	workers, err := parseWorkers(bytes.NewBufferString(`33 127.0.0.1 worker-1 : Job::Foo Job::Bar
+34 127.0.0.1 - :
+35 127.0.0.1 worker-2 : Job::Foo
+.
+`))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, workers)
+
+	_, err = parseWorkers(bytes.NewBufferString("33 127.0.0.1 worker-1 : Job::Foo\n"))
+	assert.Error(t, err)
 }
@@ -5,17 +5,36 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
 
 	"github.com/fukata/golang-stats-api-handler"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringSlice) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
 // GostatsPlugin mackerel plugin for go server
 type GostatsPlugin struct {
-	URI    string
-	Prefix string
+	URI     string
+	Prefix  string
+	Format  string
+	Header  stringSlice
+	Metrics []CustomMetric
 }
 
 /*
@@ -53,7 +72,7 @@ type GostatsPlugin struct {
 // GraphDefinition interface for mackerelplugin
 func (m GostatsPlugin) GraphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(m.Prefix)
-	return map[string]mp.Graphs{
+	graphs := map[string]mp.Graphs{
 		(m.Prefix + ".runtime"): {
 			Label: (labelPrefix + " Runtime"),
 			Unit:  "integer",
@@ -84,6 +103,7 @@ func (m GostatsPlugin) GraphDefinition() map[string]mp.Graphs {
 			Label: (labelPrefix + " Heap"),
 			Unit:  "bytes",
 			Metrics: []mp.Metrics{
+				{Name: "heap_alloc", Label: "Alloc"},
 				{Name: "heap_sys", Label: "Sys"},
 				{Name: "heap_idle", Label: "Idle"},
 				{Name: "heap_inuse", Label: "In Use"},
@@ -99,20 +119,69 @@ func (m GostatsPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "gc_pause_per_second", Label: "GC Pause Per Second"},
 			},
 		},
+		(m.Prefix + ".gc_pause"): {
+			Label: (labelPrefix + " GC Pause"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "gc_pause_p95", Label: "p95 (ms)"},
+				{Name: "gc_pause_total", Label: "Total (ms)", Diff: true},
+			},
+		},
+	}
+	for name, g := range m.customGraphDefinition() {
+		graphs[name] = g
 	}
+	return graphs
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m GostatsPlugin) FetchMetrics() (map[string]float64, error) {
-	resp, err := http.Get(m.URI)
+	req, err := http.NewRequest("GET", m.URI, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range m.Header {
+		kv := strings.SplitN(h, ":", 2)
+		var k, v string
+		k = strings.TrimSpace(kv[0])
+		if len(kv) == 2 {
+			v = strings.TrimSpace(kv[1])
+		}
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", m.URI, resp.Status)
+	}
 
+	if m.Format == "expvar" {
+		return m.parseExpvar(resp.Body)
+	}
 	return m.parseStats(resp.Body)
 }
 
+// percentile returns the nearest-rank percentile of the values
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := int(float64(len(sorted))*p/100+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
 func (m GostatsPlugin) parseStats(body io.Reader) (map[string]float64, error) {
 	stat := make(map[string]float64)
 	decoder := json.NewDecoder(body)
@@ -130,6 +199,7 @@ func (m GostatsPlugin) parseStats(body io.Reader) (map[string]float64, error) {
 	stat["memory_lookups"] = float64(s.MemoryLookups)
 	stat["memory_frees"] = float64(s.MemoryFrees)
 	stat["memory_mallocs"] = float64(s.MemoryMallocs)
+	stat["heap_alloc"] = float64(s.HeapAlloc)
 	stat["heap_sys"] = float64(s.HeapSys)
 	stat["heap_idle"] = float64(s.HeapIdle)
 	stat["heap_inuse"] = float64(s.HeapInuse)
@@ -137,10 +207,97 @@ func (m GostatsPlugin) parseStats(body io.Reader) (map[string]float64, error) {
 	stat["gc_num"] = float64(s.GcNum)
 	stat["gc_per_second"] = float64(s.GcPerSecond)
 	stat["gc_pause_per_second"] = float64(s.GcPausePerSecond)
+	if len(s.GcPause) > 0 {
+		stat["gc_pause_p95"] = percentile(s.GcPause, 95)
+	}
 
 	return stat, nil
 }
 
+// expvarStats is the output of expvar (/debug/vars). The number of goroutines is available
+// only if published as "goroutines", e.g. expvar.Publish("goroutines", expvar.Func(...))
+type expvarStats struct {
+	Goroutines *float64 `json:"goroutines"`
+	Memstats   *struct {
+		Alloc        uint64
+		Sys          uint64
+		Lookups      uint64
+		Mallocs      uint64
+		Frees        uint64
+		HeapAlloc    uint64
+		HeapSys      uint64
+		HeapIdle     uint64
+		HeapInuse    uint64
+		HeapReleased uint64
+		StackInuse   uint64
+		PauseTotalNs uint64
+		PauseNs      []uint64
+		NumGC        uint32
+	} `json:"memstats"`
+}
+
+func (m GostatsPlugin) parseExpvar(body io.Reader) (map[string]float64, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var s expvarStats
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if s.Memstats == nil {
+		return nil, fmt.Errorf("memstats is not found in the expvar output")
+	}
+
+	stat := make(map[string]float64)
+	if s.Goroutines != nil {
+		stat["goroutine_num"] = *s.Goroutines
+	}
+	ms := s.Memstats
+	stat["memory_sys"] = float64(ms.Sys)
+	stat["memory_alloc"] = float64(ms.Alloc)
+	stat["memory_stack"] = float64(ms.StackInuse)
+	stat["memory_lookups"] = float64(ms.Lookups)
+	stat["memory_frees"] = float64(ms.Frees)
+	stat["memory_mallocs"] = float64(ms.Mallocs)
+	stat["heap_alloc"] = float64(ms.HeapAlloc)
+	stat["heap_sys"] = float64(ms.HeapSys)
+	stat["heap_idle"] = float64(ms.HeapIdle)
+	stat["heap_inuse"] = float64(ms.HeapInuse)
+	stat["heap_released"] = float64(ms.HeapReleased)
+	stat["gc_num"] = float64(ms.NumGC)
+	stat["gc_pause_total"] = float64(ms.PauseTotalNs) / 1000 / 1000
+
+	// PauseNs is the circular buffer of the recent 256 GC pauses
+	n := int(ms.NumGC)
+	if n > len(ms.PauseNs) {
+		n = len(ms.PauseNs)
+	}
+	if n > 0 {
+		pauses := make([]float64, 0, n)
+		for i := 0; i < n; i++ {
+			idx := (int(ms.NumGC) - 1 - i) % len(ms.PauseNs)
+			pauses = append(pauses, float64(ms.PauseNs[idx])/1000/1000)
+		}
+		stat["gc_pause_p95"] = percentile(pauses, 95)
+	}
+
+	if len(m.Metrics) > 0 {
+		var vars map[string]interface{}
+		if err := json.Unmarshal(data, &vars); err != nil {
+			return nil, err
+		}
+		m.fetchCustomMetrics(vars, stat)
+	}
+
+	return stat, nil
+}
+
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the stats
+func (m GostatsPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "gostats", m.URI)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "", "URI")
@@ -149,11 +306,46 @@ func Do() {
 	optPort := flag.String("port", "8080", "Port")
 	optPath := flag.String("path", "/api/stats", "Path")
 	optPrefix := flag.String("metric-key-prefix", "gostats", "Metric key prefix")
+	optFormat := flag.String("format", "stats-api", "Format of the stats (stats-api or expvar)")
+	optExpvar := flag.Bool("expvar", false, "Shorthand of -format=expvar")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optHeader := &stringSlice{}
+	flag.Var(optHeader, "header", "Set http header (e.g. \"Authorization: Bearer token\")")
+	optMetrics := &stringSlice{}
+	flag.Var(optMetrics, "metric", "Custom metric of expvar in the form of name=json.path[:diff] (e.g. \"requests=http.requests.*:diff\")")
 	flag.Parse()
 
+	if *optExpvar {
+		*optFormat = "expvar"
+	}
+	if *optFormat != "stats-api" && *optFormat != "expvar" {
+		fmt.Fprintf(os.Stderr, "-format should be stats-api or expvar: %s\n", *optFormat)
+		os.Exit(1)
+	}
+
 	gosrv := GostatsPlugin{
 		Prefix: *optPrefix,
+		Format: *optFormat,
+		Header: *optHeader,
+	}
+	names := make(map[string]bool)
+	for _, s := range *optMetrics {
+		c, err := parseCustomMetric(s)
+		if err != nil {
+			log.Fatalf("Invalid -metric: %s", err)
+		}
+		if names[c.Name] {
+			log.Fatalf("Invalid -metric: duplicated name: %s", c.Name)
+		}
+		names[c.Name] = true
+		gosrv.Metrics = append(gosrv.Metrics, c)
+	}
+	if len(gosrv.Metrics) > 0 && *optFormat != "expvar" {
+		fmt.Fprintf(os.Stderr, "-metric is available only with -format=expvar\n")
+		os.Exit(1)
+	}
+	if *optFormat == "expvar" && *optPath == "/api/stats" {
+		*optPath = "/debug/vars"
 	}
 	if *optURI != "" {
 		gosrv.URI = *optURI
@@ -162,7 +354,7 @@ func Do() {
 	}
 
 	helper := mp.NewMackerelPlugin(gosrv)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = gosrv.tempfile(*optTempfile)
 
 	helper.Run()
 }
@@ -1,6 +1,9 @@
 package mpgostats
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"strings"
 	"testing"
@@ -46,6 +49,7 @@ func TestParseStats(t *testing.T) {
 		"memory_lookups":      15.0,
 		"memory_frees":        0.0,
 		"memory_mallocs":      1137.0,
+		"heap_alloc":          213360.0,
 		"heap_sys":            655360.0,
 		"heap_idle":           65536.0,
 		"heap_inuse":          589824.0,
@@ -65,3 +69,163 @@ func TestParseStats(t *testing.T) {
 		t.Errorf("stats differs: %v (expected: %v)", got, expected)
 	}
 }
+
+func TestParseStatsGCPause(t *testing.T) {
+	stat := `{"goroutine_num": 6, "gc_num": 20, "gc_pause": [0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0, 1.1, 1.2, 1.3, 1.4, 1.5, 1.6, 1.7, 1.8, 1.9, 2.0]}`
+
+	m := GostatsPlugin{}
+	got, err := m.parseStats(strings.NewReader(stat))
+	if err != nil {
+		t.Fatalf("error should be nil but got: %v", err)
+	}
+	if got["gc_pause_p95"] != 1.9 {
+		t.Errorf("gc_pause_p95 should be 1.9 but got: %v", got["gc_pause_p95"])
+	}
+}
+
+func expvarJSON(numGC int) string {
+	pauses := make([]string, 256)
+	for i := range pauses {
+		pauses[i] = "0"
+	}
+	// the recent 20 pauses are 1ms, 2ms, ... 20ms
+	for i := 0; i < 20; i++ {
+		pauses[(numGC-20+i)%256] = fmt.Sprint((i + 1) * 1000 * 1000)
+	}
+	return fmt.Sprintf(`{
+  "cmdline": ["/usr/local/bin/app"],
+  "goroutines": 42,
+  "memstats": {"Alloc": 213360, "TotalAlloc": 213360, "Sys": 3377400, "Lookups": 15, "Mallocs": 1137, "Frees": 10,
+    "HeapAlloc": 213360, "HeapSys": 655360, "HeapIdle": 65536, "HeapInuse": 589824, "HeapReleased": 4096, "HeapObjects": 1137,
+    "StackInuse": 393216, "PauseTotalNs": 210000000, "PauseNs": [%s], "NumGC": %d, "GCCPUFraction": 0.001}
+}`, strings.Join(pauses, ","), numGC)
+}
+
+func TestParseExpvar(t *testing.T) {
+	expected := map[string]float64{
+		"goroutine_num":  42.0,
+		"memory_sys":     3377400.0,
+		"memory_alloc":   213360.0,
+		"memory_stack":   393216.0,
+		"memory_lookups": 15.0,
+		"memory_frees":   10.0,
+		"memory_mallocs": 1137.0,
+		"heap_alloc":     213360.0,
+		"heap_sys":       655360.0,
+		"heap_idle":      65536.0,
+		"heap_inuse":     589824.0,
+		"heap_released":  4096.0,
+		"gc_num":         20.0,
+		"gc_pause_p95":   19.0,
+		"gc_pause_total": 210.0,
+	}
+
+	m := GostatsPlugin{Format: "expvar"}
+	got, err := m.parseExpvar(strings.NewReader(expvarJSON(20)))
+	if err != nil {
+		t.Fatalf("error should be nil but got: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("stats differs: %v (expected: %v)", got, expected)
+	}
+
+	// the ring buffer has wrapped around, so all the 256 pauses including zeros are used
+	got, err = m.parseExpvar(strings.NewReader(expvarJSON(300)))
+	if err != nil {
+		t.Fatalf("error should be nil but got: %v", err)
+	}
+	if got["gc_pause_p95"] != 7.0 {
+		t.Errorf("gc_pause_p95 should be 7 but got: %v", got["gc_pause_p95"])
+	}
+
+	if _, err := m.parseExpvar(strings.NewReader(`{"cmdline": []}`)); err == nil {
+		t.Errorf("error should be returned without memstats")
+	}
+}
+
+func TestParseExpvarCustomMetrics(t *testing.T) {
+	var metrics []CustomMetric
+	for _, s := range []string{"requests=http.requests.*:diff", "queue=worker.queue.length", "version=app.version", "missing=app.missing"} {
+		c, err := parseCustomMetric(s)
+		if err != nil {
+			t.Fatalf("error should be nil but got: %v", err)
+		}
+		metrics = append(metrics, c)
+	}
+	vars := `{
+  "memstats": {"NumGC": 0},
+  "http": {"requests": {"GET /api": 120, "POST /api": 30, "bad": "n/a"}},
+  "worker": {"queue": {"length": 5}},
+  "app": {"version": "1.2.3"}
+}`
+
+	m := GostatsPlugin{Prefix: "gostats", Format: "expvar", Metrics: metrics}
+	got, err := m.parseExpvar(strings.NewReader(vars))
+	if err != nil {
+		t.Fatalf("error should be nil but got: %v", err)
+	}
+	expected := map[string]float64{
+		"gostats.custom.requests.GET__api.value":  120,
+		"gostats.custom.requests.POST__api.value": 30,
+		"custom_queue": 5,
+	}
+	for k, v := range expected {
+		if got[k] != v {
+			t.Errorf("%s should be %v but got: %v", k, v, got[k])
+		}
+	}
+	for _, k := range []string{"gostats.custom.requests.bad.value", "custom_version", "custom_missing"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s should not be posted", k)
+		}
+	}
+
+	graphs := m.GraphDefinition()
+	if g, ok := graphs["gostats.custom.requests.#"]; !ok || !g.Metrics[0].Diff || g.Metrics[0].Name != "value" {
+		t.Errorf("unexpected graph of requests: %#v", g)
+	}
+	if g, ok := graphs["gostats.custom.queue"]; !ok || g.Metrics[0].Diff || g.Metrics[0].Name != "custom_queue" {
+		t.Errorf("unexpected graph of queue: %#v", g)
+	}
+
+	for _, s := range []string{"requests", "a.b=x", "x=", "x=a.*.b.*"} {
+		if _, err := parseCustomMetric(s); err == nil {
+			t.Errorf("%s: error should be returned", s)
+		}
+	}
+}
+
+func TestFetchMetricsWithHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, expvarJSON(20))
+	}))
+	defer ts.Close()
+
+	m := GostatsPlugin{URI: ts.URL + "/debug/vars", Format: "expvar"}
+	if _, err := m.FetchMetrics(); err == nil {
+		t.Errorf("error should be returned without the header")
+	}
+
+	m.Header = stringSlice{"Authorization: Bearer secret"}
+	got, err := m.FetchMetrics()
+	if err != nil {
+		t.Fatalf("error should be nil but got: %v", err)
+	}
+	if got["heap_idle"] != 65536.0 {
+		t.Errorf("heap_idle should be 65536 but got: %v", got["heap_idle"])
+	}
+}
+
+func TestTempfile(t *testing.T) {
+	p := GostatsPlugin{URI: "http://localhost:8080/api/stats"}
+	if other := (GostatsPlugin{URI: "http://localhost:8081/api/stats"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/gostats.json"); f != "/tmp/gostats.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,145 @@
+package mpgostats
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// CustomMetric is a numeric var of expvar given by -metric
+type CustomMetric struct {
+	Name string
+	// Path is the dotted path to the var, whose element may be `*` to post a metric per key of the expvar.Map
+	Path []string
+	Diff bool
+}
+
+var (
+	validNameRe  = regexp.MustCompile(`^[-a-zA-Z0-9_]+$`)
+	invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+)
+
+// parseCustomMetric parses `name=json.path[:diff]` of -metric
+func parseCustomMetric(s string) (CustomMetric, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return CustomMetric{}, fmt.Errorf("should be in the form of name=json.path[:diff]: %s", s)
+	}
+	m := CustomMetric{Name: s[:i]}
+	path := s[i+1:]
+	if strings.HasSuffix(path, ":diff") {
+		m.Diff = true
+		path = strings.TrimSuffix(path, ":diff")
+	}
+	if !validNameRe.MatchString(m.Name) {
+		return CustomMetric{}, fmt.Errorf("name should match %s: %q", validNameRe, m.Name)
+	}
+	if path == "" {
+		return CustomMetric{}, fmt.Errorf("path is required: %s", s)
+	}
+	m.Path = strings.Split(path, ".")
+	if strings.Count(path, "*") > 1 {
+		return CustomMetric{}, fmt.Errorf("path should contain at most one wildcard: %s", path)
+	}
+	return m, nil
+}
+
+func (c CustomMetric) isWildcard() bool {
+	for _, p := range c.Path {
+		if p == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CustomMetric) graphName(prefix string) string {
+	if c.isWildcard() {
+		return prefix + ".custom." + c.Name + ".#"
+	}
+	return prefix + ".custom." + c.Name
+}
+
+// metricName returns the name of the metric in the graph. The metrics of the wildcard paths are wildcard metrics, and the
+// others are keyed by "custom_<name>" not to conflict with the memstats ones
+func (c CustomMetric) metricName() string {
+	if c.isWildcard() {
+		return "value"
+	}
+	return "custom_" + c.Name
+}
+
+// lookupVars returns the values at the path keyed by the keys matching the wildcard, or by "" without the wildcard
+func lookupVars(v interface{}, path []string) map[string]interface{} {
+	for i, p := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if p == "*" {
+			ret := make(map[string]interface{}, len(m))
+			for k, child := range m {
+				for _, leaf := range lookupVars(child, path[i+1:]) {
+					ret[k] = leaf
+				}
+			}
+			return ret
+		}
+		if v, ok = m[p]; !ok {
+			return nil
+		}
+	}
+	return map[string]interface{}{"": v}
+}
+
+// fetchCustomMetrics sets the values of the custom metrics from the vars. The non-numeric values are skipped.
+func (m GostatsPlugin) fetchCustomMetrics(vars map[string]interface{}, stat map[string]float64) {
+	for _, c := range m.Metrics {
+		values := lookupVars(vars, c.Path)
+		if len(values) == 0 {
+			log.Printf("%s is not found in the expvar output", strings.Join(c.Path, "."))
+			continue
+		}
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v, ok := values[k].(float64)
+			if !ok {
+				log.Printf("%s is not numeric: %v", strings.Join(c.Path, "."), values[k])
+				continue
+			}
+			if !c.isWildcard() {
+				stat[c.metricName()] = v
+				continue
+			}
+			key := invalidKeyRe.ReplaceAllString(k, "_")
+			stat[m.Prefix+".custom."+c.Name+"."+key+"."+c.metricName()] = v
+		}
+	}
+}
+
+func (m GostatsPlugin) customGraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs, len(m.Metrics))
+	labelPrefix := strings.Title(m.Prefix)
+	for _, c := range m.Metrics {
+		label := strings.Join(c.Path, ".")
+		if c.isWildcard() {
+			label = "%1"
+		}
+		graphs[c.graphName(m.Prefix)] = mp.Graphs{
+			Label: labelPrefix + " " + c.Name,
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: c.metricName(), Label: label, Diff: c.Diff},
+			},
+		}
+	}
+	return graphs
+}
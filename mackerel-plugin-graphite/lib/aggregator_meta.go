@@ -0,0 +1,54 @@
+package mpgraphite
+
+var aggregatorPrefix = "graphite-carbon.aggregator."
+
+var aggregatorMeta = map[string]meta{
+	"cpuUsage": {
+		label: " CPU Usage",
+		unit:  "float",
+	},
+	"memUsage": {
+		label: " Memory Usage",
+		unit:  "integer",
+	},
+	"metricsReceived": {
+		label: " Metrics Received",
+		unit:  "integer",
+	},
+	"allocatedBuffers": {
+		label: " Allocated Buffers",
+		unit:  "integer",
+	},
+	"bufferedDatapoints": {
+		label: " Buffered Datapoints",
+		unit:  "integer",
+	},
+	"aggregateDatapointsSent": {
+		label: " Aggregate Datapoints Sent",
+		unit:  "integer",
+	},
+	"destinations_attemptedRelays": {
+		label: " Attempted Relays",
+		unit:  "integer",
+	},
+	"destinations_queuedUntilConnected": {
+		label: " Queued Until Connected",
+		unit:  "integer",
+	},
+	"destinations_queuedUntilReady": {
+		label: " Queued Until Ready",
+		unit:  "integer",
+	},
+	"destinations_sent": {
+		label: " Sent",
+		unit:  "integer",
+	},
+	"destinations_relayMaxQueueLength": {
+		label: " Max Queue Length",
+		unit:  "integer",
+	},
+	"destinations_fullQueueDrops": {
+		label: " Full Queue Drops",
+		unit:  "integer",
+	},
+}
@@ -32,7 +32,9 @@ func (p GraphitePlugin) GraphDefinition() map[string]mp.Graphs {
 	case "cache":
 		graphdef = p.cacheGraphDefinition()
 	case "relay":
-		graphdef = p.relayGraphDefinition()
+		graphdef = p.destinationGraphDefinition(relayPrefix, relayMeta)
+	case "aggregator":
+		graphdef = p.destinationGraphDefinition(aggregatorPrefix, aggregatorMeta)
 	}
 	return graphdef
 }
@@ -81,8 +83,8 @@ func (p GraphitePlugin) cacheGraphDefinition() map[string]mp.Graphs {
 	return graphdef
 }
 
-// relayGraphDefinition returns Graphs for carbon-relay
-func (p GraphitePlugin) relayGraphDefinition() map[string]mp.Graphs {
+// destinationGraphDefinition returns Graphs for carbon-relay or carbon-aggregator
+func (p GraphitePlugin) destinationGraphDefinition(prefix string, metas map[string]meta) map[string]mp.Graphs {
 	data, err := p.fetchData()
 	if err != nil {
 		log.Fatalln(err)
@@ -97,7 +99,7 @@ func (p GraphitePlugin) relayGraphDefinition() map[string]mp.Graphs {
 	}
 
 	graphdef := make(map[string]mp.Graphs)
-	for key, m := range relayMeta {
+	for key, m := range metas {
 		var unit string
 		if m.unit == "float" {
 			unit = "float64"
@@ -106,7 +108,7 @@ func (p GraphitePlugin) relayGraphDefinition() map[string]mp.Graphs {
 		}
 
 		if !strings.Contains(key, "destinations_") {
-			graphdef[relayPrefix+key] = mp.Graphs{
+			graphdef[prefix+key] = mp.Graphs{
 				Label: p.LabelPrefix + m.label,
 				Unit:  m.unit,
 				Metrics: []mp.Metrics{
@@ -123,7 +125,7 @@ func (p GraphitePlugin) relayGraphDefinition() map[string]mp.Graphs {
 				})
 			}
 
-			graphdef[relayPrefix+key] = mp.Graphs{
+			graphdef[prefix+key] = mp.Graphs{
 				Label:   p.LabelPrefix + m.label,
 				Unit:    m.unit,
 				Metrics: ms,
@@ -212,10 +214,10 @@ func newGraphitePlugin(host, webHost, webPort, thetype, instance, labelPrefix st
 		} else {
 			plugin.Instance = instance
 		}
-	case "relay":
+	case "relay", "aggregator":
 		plugin.Type = thetype
 		if instance == "" || instance == "*" {
-			log.Fatalln("You mush specify concrete instance name in case of relay")
+			log.Fatalln("You mush specify concrete instance name in case of " + thetype)
 		} else {
 			plugin.Instance = instance
 		}
@@ -231,6 +233,8 @@ func newGraphitePlugin(host, webHost, webPort, thetype, instance, labelPrefix st
 		targets = fmt.Sprintf("target=carbon.agents.%s-%s.*&target=carbon.agents.%s-%s.*.*", plugin.Host, plugin.Instance, plugin.Host, plugin.Instance)
 	case "relay":
 		targets = fmt.Sprintf("target=carbon.relays.%s-%s.*&target=carbon.relays.%s-%s.destinations.*.*", plugin.Host, plugin.Instance, plugin.Host, plugin.Instance)
+	case "aggregator":
+		targets = fmt.Sprintf("target=carbon.aggregator.%s-%s.*&target=carbon.aggregator.%s-%s.destinations.*.*", plugin.Host, plugin.Instance, plugin.Host, plugin.Instance)
 	}
 	plugin.URL = fmt.Sprintf("http://%s:%s/render/?%s&from=-15min&format=json", plugin.WebHost, plugin.WebPort, targets)
 
@@ -242,13 +246,19 @@ func Do() {
 	optHost := flag.String("host", "", "Hostname")
 	optWebHost := flag.String("webhost", "", "Graphite-web hostname")
 	optWebPort := flag.String("webport", "", "Graphite-web port")
-	optType := flag.String("type", "", "Carbon type (cache or relay)")
+	optRole := flag.String("role", "", "Carbon role (cache, relay or aggregator)")
+	optType := flag.String("type", "", "Carbon type (deprecated alias of -role)")
 	optInstance := flag.String("instance", "", "Instance name")
 	optLabelPrefix := flag.String("metric-label-prefix", "Carbon", "Metric Label Prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	flag.Parse()
 
-	plugin := newGraphitePlugin(*optHost, *optWebHost, *optWebPort, *optType, *optInstance, *optLabelPrefix)
+	role := *optRole
+	if role == "" {
+		role = *optType
+	}
+
+	plugin := newGraphitePlugin(*optHost, *optWebHost, *optWebPort, role, *optInstance, *optLabelPrefix)
 
 	helper := mp.NewMackerelPlugin(plugin)
 	helper.Tempfile = *optTempfile
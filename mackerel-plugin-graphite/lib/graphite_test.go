@@ -22,6 +22,12 @@ var relayGoldenMetrics = []metrics{
 	{"carbon.relays.host_hoge-a.destinations.127_0_0_1:3104:b.sent", [][]interface{}{{1, 1}, {2, 2}}},
 }
 
+var aggregatorGoldenMetrics = []metrics{
+	{"carbon.aggregator.host_hoge-a.bufferedDatapoints", [][]interface{}{{10, 1}, {20, 2}}},
+	{"carbon.aggregator.host_hoge-a.destinations.127_0_0_1:2004:a.fullQueueDrops", [][]interface{}{{0, 1}, {3, 2}}},
+	{"carbon.aggregator.host_hoge-a.destinations.127_0_0_1:2104:b.fullQueueDrops", [][]interface{}{{0, 1}, {nil, 2}}},
+}
+
 var cacheHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	d, err := json.Marshal(cacheGoldenMetrics)
 	if err != nil {
@@ -40,6 +46,15 @@ var relayHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request)
 	w.Write(d)
 })
 
+var aggregatorHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	d, err := json.Marshal(aggregatorGoldenMetrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(d)
+})
+
 func TestFetchData(t *testing.T) {
 	ts := httptest.NewServer(cacheHandler)
 	defer ts.Close()
@@ -123,6 +138,38 @@ func TestRelayGraphDefinition(t *testing.T) {
 	}
 }
 
+func TestAggregatorGraphDefinition(t *testing.T) {
+	ts := httptest.NewServer(aggregatorHandler)
+	defer ts.Close()
+
+	plugin := GraphitePlugin{
+		Host:        "host_hoge",
+		WebHost:     "webhost.hoge",
+		WebPort:     "8000",
+		Type:        "aggregator",
+		Instance:    "a",
+		LabelPrefix: "Carbon",
+		URL:         ts.URL,
+	}
+
+	graph := plugin.GraphDefinition()
+	if actual := len(graph); actual != len(aggregatorMeta) {
+		t.Errorf("GraphDefinition(): %d should be %d", actual, len(aggregatorMeta))
+	}
+	for k, g := range graph {
+		matched, _ := regexp.MatchString(`destinations_`, k)
+		if matched {
+			if actual := len(g.Metrics); actual != 2 {
+				t.Errorf("GraphDefinition(): %d should be 2", actual)
+			}
+		} else {
+			if actual := len(g.Metrics); actual != 1 {
+				t.Errorf("GraphDefinition(): %d should be 1", actual)
+			}
+		}
+	}
+}
+
 func TestOutputValueForCache(t *testing.T) {
 	ts := httptest.NewServer(cacheHandler)
 	defer ts.Close()
@@ -184,3 +231,32 @@ graphite-carbon.relay.destinations_sent.127_0_0_1-3104-b	2	2
 		t.Errorf("outputValues(): %s should be %s", actual, expected)
 	}
 }
+
+func TestOutputValueForAggregator(t *testing.T) {
+	ts := httptest.NewServer(aggregatorHandler)
+	defer ts.Close()
+
+	plugin := GraphitePlugin{
+		Host:        "host_hoge",
+		WebHost:     "webhost.hoge",
+		WebPort:     "8000",
+		Type:        "aggregator",
+		Instance:    "a",
+		LabelPrefix: "Carbon",
+		URL:         ts.URL,
+	}
+
+	s := new(bytes.Buffer)
+	plugin.outputValues(s)
+
+	expected := `graphite-carbon.aggregator.bufferedDatapoints.bufferedDatapoints	10	1
+graphite-carbon.aggregator.bufferedDatapoints.bufferedDatapoints	20	2
+graphite-carbon.aggregator.destinations_fullQueueDrops.127_0_0_1-2004-a	0	1
+graphite-carbon.aggregator.destinations_fullQueueDrops.127_0_0_1-2004-a	3	2
+graphite-carbon.aggregator.destinations_fullQueueDrops.127_0_0_1-2104-b	0	1
+`
+
+	if actual := string(s.Bytes()); actual != expected {
+		t.Errorf("outputValues(): %s should be %s", actual, expected)
+	}
+}
@@ -18,6 +18,22 @@ var cacheRegexp = regexp.MustCompile(`carbon\.agents\..*-(.*?)\.(.*)`)
 // carbon.relays.host_name-a.destinations.{instance|127_0_0_1:3004:a}.{metric}
 var relayRegexp = regexp.MustCompile(`carbon\.relays\..*-.*?\.(.*)`)
 
+// carbon.aggregator.host_name-a.{metric}
+// carbon.aggregator.host_name-a.destinations.{127_0_0_1:2004:a}.{metric}
+var aggregatorRegexp = regexp.MustCompile(`carbon\.aggregator\..*-.*?\.(.*)`)
+
+// matchDestinationMetric matches metrics of carbon-relay and carbon-aggregator,
+// which share the same layout, and returns the prefix and the rest of the target
+func (m metrics) matchDestinationMetric() (string, string) {
+	if matched := relayRegexp.FindStringSubmatch(m.Target); matched != nil {
+		return relayPrefix, matched[1]
+	}
+	if matched := aggregatorRegexp.FindStringSubmatch(m.Target); matched != nil {
+		return aggregatorPrefix, matched[1]
+	}
+	return "", ""
+}
+
 func (m metrics) getInstanceName() string {
 	matched := cacheRegexp.FindStringSubmatch(m.Target)
 	if matched != nil {
@@ -27,17 +43,17 @@ func (m metrics) getInstanceName() string {
 }
 
 func (m metrics) getDestinationName() string {
-	matched := relayRegexp.FindStringSubmatch(m.Target)
-	if matched == nil {
+	prefix, metric := m.matchDestinationMetric()
+	if prefix == "" {
 		return ""
 	}
 
-	if !strings.Contains(matched[1], ".") {
+	if !strings.Contains(metric, ".") {
 		// If metric is {cpuUsage,memUsage,metricsRecieved}
 		return ""
 	}
 
-	return strings.Split(matched[1], ".")[1]
+	return strings.Split(metric, ".")[1]
 }
 
 func (m metrics) getMetricName() string {
@@ -51,10 +67,8 @@ func (m metrics) getMetricName() string {
 		return metric
 	}
 
-	// In case of carbon-relay
-	matched = relayRegexp.FindStringSubmatch(m.Target)
-	if matched != nil {
-		metric := matched[1]
+	// In case of carbon-relay or carbon-aggregator
+	if prefix, metric := m.matchDestinationMetric(); prefix != "" {
 		if !strings.Contains(metric, ".") {
 			return metric
 		}
@@ -72,6 +86,9 @@ func (m metrics) getUnitType() string {
 	if m, ok := relayMeta[name]; ok {
 		return m.unit
 	}
+	if m, ok := aggregatorMeta[name]; ok {
+		return m.unit
+	}
 	return ""
 }
 
@@ -96,19 +113,17 @@ func (m metrics) getMetricKey() string {
 		return cachePrefix + metric + "." + instance
 	}
 
-	// In case of carbon-relay
-	matched = relayRegexp.FindStringSubmatch(m.Target)
-	if matched != nil {
-		metric := matched[1]
+	// In case of carbon-relay or carbon-aggregator
+	if prefix, metric := m.matchDestinationMetric(); prefix != "" {
 		if !strings.Contains(metric, ".") {
 			// If metric is {cpuUsage,memUsage,metricsRecieved}
-			return relayPrefix + metric + "." + metric
+			return prefix + metric + "." + metric
 		}
 		split := strings.Split(metric, ".")
 		dest := split[1]
 		metric = split[2]
 		dest = strings.Replace(dest, ":", "-", -1)
-		return relayPrefix + "destinations_" + metric + "." + dest
+		return prefix + "destinations_" + metric + "." + dest
 	}
 
 	return ""
@@ -23,6 +23,8 @@ func TestGetDestinationName(t *testing.T) {
 	cases := []struct{ target, expected string }{
 		{"carbon.relays.t_e_s_t-a.avgUpdateTime", ""},
 		{"carbon.relays.t_e_s_t-a.destinations.127_0_0_1:3004:a.sent", "127_0_0_1:3004:a"},
+		{"carbon.aggregator.t_e_s_t-a.bufferedDatapoints", ""},
+		{"carbon.aggregator.t_e_s_t-a.destinations.127_0_0_1:2004:a.fullQueueDrops", "127_0_0_1:2004:a"},
 	}
 
 	for _, tc := range cases {
@@ -40,6 +42,8 @@ func TestGetMetricName(t *testing.T) {
 		{"carbon.agents.t_e_s_t-a.cache.size", "cache_size"},
 		{"carbon.relays.t_e_s_t-a.cpuUsage", "cpuUsage"},
 		{"carbon.relays.t_e_s_t-a.destinations.127_0_0_1:3004:a.sent", "destinations_sent"},
+		{"carbon.aggregator.t_e_s_t-a.allocatedBuffers", "allocatedBuffers"},
+		{"carbon.aggregator.t_e_s_t-a.destinations.127_0_0_1:2004:a.relayMaxQueueLength", "destinations_relayMaxQueueLength"},
 	}
 
 	for _, tc := range cases {
@@ -57,6 +61,8 @@ func TestGetUnitType(t *testing.T) {
 		{"carbon.agents.t_e_s_t-a.cache.size", "integer"},
 		{"carbon.relays.t_e_s_t-a.cpuUsage", "float"},
 		{"carbon.relays.t_e_s_t-a.destinations.127_0_0_1:3004:a.sent", "integer"},
+		{"carbon.aggregator.t_e_s_t-a.cpuUsage", "float"},
+		{"carbon.aggregator.t_e_s_t-a.aggregateDatapointsSent", "integer"},
 	}
 
 	for _, tc := range cases {
@@ -94,6 +100,9 @@ func TestGetMetricKey(t *testing.T) {
 		{"carbon.agents.t_e_s_t-a.cache.size", "graphite-carbon.cache.cache_size.a"},
 		{"carbon.relays.t_e_s_t-a.cpuUsage", "graphite-carbon.relay.cpuUsage.cpuUsage"},
 		{"carbon.relays.t_e_s_t-a.destinations.127_0_0_1:3004:a.sent", "graphite-carbon.relay.destinations_sent.127_0_0_1-3004-a"},
+		{"carbon.relays.t_e_s_t-a.destinations.127_0_0_1:3004:a.fullQueueDrops", "graphite-carbon.relay.destinations_fullQueueDrops.127_0_0_1-3004-a"},
+		{"carbon.aggregator.t_e_s_t-a.bufferedDatapoints", "graphite-carbon.aggregator.bufferedDatapoints.bufferedDatapoints"},
+		{"carbon.aggregator.t_e_s_t-a.destinations.127_0_0_1:2004:a.fullQueueDrops", "graphite-carbon.aggregator.destinations_fullQueueDrops.127_0_0_1-2004-a"},
 	}
 
 	for _, tc := range cases {
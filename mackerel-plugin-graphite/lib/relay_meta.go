@@ -31,4 +31,12 @@ var relayMeta = map[string]meta{
 		label: " Sent",
 		unit:  "integer",
 	},
+	"destinations_relayMaxQueueLength": {
+		label: " Max Queue Length",
+		unit:  "integer",
+	},
+	"destinations_fullQueueDrops": {
+		label: " Full Queue Drops",
+		unit:  "integer",
+	},
 }
@@ -8,47 +8,36 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"haproxy.total.sessions": {
-		Label: "HAProxy Total Sessions",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "sessions", Label: "Sessions", Diff: true},
-		},
-	},
-	"haproxy.total.bytes": {
-		Label: "HAProxy Total Bytes",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "bytes_in", Label: "Bytes In", Diff: true},
-			{Name: "bytes_out", Label: "Bytes Out", Diff: true},
-		},
-	},
-	"haproxy.total.connection_errors": {
-		Label: "HAProxy Total Connection Errors",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "connection_errors", Label: "Connection Errors", Diff: true},
-		},
-	},
-}
-
 // HAProxyPlugin mackerel plugin for haproxy
 type HAProxyPlugin struct {
-	URI      string
-	Username string
-	Password string
+	URI         string
+	Username    string
+	Password    string
+	Prefix      string
+	LabelPrefix string
+	// Socket is the admin socket of HAProxy, from which the stats are fetched instead of URI
+	Socket  string
+	Timeout time.Duration
 }
 
+var logger = pluginutil.NewLogger("haproxy")
+
 // FetchMetrics interface for mackerelplugin
 func (p HAProxyPlugin) FetchMetrics() (map[string]float64, error) {
+	if p.Socket != "" {
+		return p.fetchMetricsFromSocket()
+	}
+
 	client := &http.Client{
-		Timeout: time.Duration(5) * time.Second,
+		Timeout: p.Timeout,
 	}
 
 	requestURI := p.URI + ";csv;norefresh"
@@ -121,11 +110,69 @@ func (p HAProxyPlugin) parseStats(statsBody io.Reader) (map[string]float64, erro
 	return stat, nil
 }
 
+// MetricKeyPrefix interface for PluginWithPrefix
+func (p HAProxyPlugin) MetricKeyPrefix() string {
+	if p.Prefix == "" {
+		p.Prefix = "haproxy"
+	}
+	return p.Prefix
+}
+
+// labelPrefix returns the prefix of the graph labels, which is HAProxy unless the metric key prefix is changed
+func (p HAProxyPlugin) labelPrefix() string {
+	if p.LabelPrefix != "" {
+		return p.LabelPrefix
+	}
+	if p.MetricKeyPrefix() == "haproxy" {
+		return "HAProxy"
+	}
+	return strings.Title(p.MetricKeyPrefix())
+}
+
 // GraphDefinition interface for mackerelplugin
 func (p HAProxyPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+
+	graphdef := map[string]mp.Graphs{
+		"total.sessions": {
+			Label: labelPrefix + " Total Sessions",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "sessions", Label: "Sessions", Diff: true},
+			},
+		},
+		"total.bytes": {
+			Label: labelPrefix + " Total Bytes",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "bytes_in", Label: "Bytes In", Diff: true},
+				{Name: "bytes_out", Label: "Bytes Out", Diff: true},
+			},
+		},
+		"total.connection_errors": {
+			Label: labelPrefix + " Total Connection Errors",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "connection_errors", Label: "Connection Errors", Diff: true},
+			},
+		},
+	}
+	if p.Socket != "" {
+		for k, v := range p.infoGraphDefinition(labelPrefix) {
+			graphdef[k] = v
+		}
+	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI or the socket of the stats
+func (p HAProxyPlugin) tempfile(tempfile string) string {
+	if p.Socket != "" {
+		return pluginutil.Tempfile(tempfile, "haproxy", p.Socket)
+	}
+	return pluginutil.Tempfile(tempfile, "haproxy", p.URI)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "", "URI")
@@ -134,11 +181,19 @@ func Do() {
 	optPort := flag.String("port", "80", "Port")
 	optPath := flag.String("path", "/", "Path")
 	optUsername := flag.String("username", "", "Username for Basic Auth")
-	optPassword := flag.String("password", "", "Password for Basic Auth")
+	optPassword := flag.String("password", "", "Password for Basic Auth (or $MACKEREL_PLUGIN_HAPROXY_PASSWORD)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "haproxy", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: HAProxy, or the metric key prefix in title case if it is changed)")
+	optSocket := flag.String("socket", "", "Admin socket of HAProxy (e.g. /var/run/haproxy.sock), which wins over the URI")
+	optTimeout := flag.Duration("timeout", 5*time.Second, "Timeout of the request to the stats page or the socket")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_HAPROXY_PASSWORD")
 
-	var haproxy HAProxyPlugin
+	haproxy := HAProxyPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix, Socket: *optSocket, Timeout: *optTimeout}
+	if *optSocket != "" && *optURI != "" {
+		logger.Warningf("-uri is ignored since -socket is given")
+	}
 	if *optURI != "" {
 		haproxy.URI = *optURI
 	} else {
@@ -154,7 +209,7 @@ func Do() {
 	}
 
 	helper := mp.NewMackerelPlugin(haproxy)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = haproxy.tempfile(*optTempfile)
 
 	helper.Run()
 }
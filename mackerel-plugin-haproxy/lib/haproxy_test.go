@@ -17,6 +17,28 @@ func TestGraphDefinition(t *testing.T) {
 	}
 }
 
+func TestGraphDefinitionPrefix(t *testing.T) {
+	var haproxy HAProxyPlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range haproxy.GraphDefinition() {
+		graphs[haproxy.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"haproxy.total.sessions":          "HAProxy Total Sessions",
+		"haproxy.total.bytes":             "HAProxy Total Bytes",
+		"haproxy.total.connection_errors": "HAProxy Total Connection Errors",
+	}, graphs)
+
+	haproxy.Prefix = "haproxy-web"
+	assert.Equal(t, "haproxy-web", haproxy.MetricKeyPrefix())
+	assert.Equal(t, "Haproxy-Web Total Sessions", haproxy.GraphDefinition()["total.sessions"].Label)
+
+	haproxy.LabelPrefix = "Web"
+	assert.Equal(t, "Web Total Sessions", haproxy.GraphDefinition()["total.sessions"].Label)
+}
+
 func TestParse(t *testing.T) {
 	var haproxy HAProxyPlugin
 	stub := `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,
@@ -35,3 +57,18 @@ hastats,BACKEND,0,0,0,1,7,17,7061,15994,0,0,,17,0,0,0,UP,0,0,0,,0,1543,0,,1,1,0,
 	assert.EqualValues(t, stat["bytes_out"], 15994)
 	assert.EqualValues(t, stat["connection_errors"], 17)
 }
+
+func TestTempfile(t *testing.T) {
+	p := HAProxyPlugin{URI: "http://localhost:80/"}
+	for field, other := range map[string]HAProxyPlugin{
+		"URI":    {URI: "http://localhost:8080/"},
+		"Socket": {Socket: "/var/run/haproxy.sock"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/haproxy.json"); f != "/tmp/haproxy.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,112 @@
+package mphaproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// infoPlace maps the fields of show info to the metrics
+var infoPlace = map[string]string{
+	"CurrConns": "curr_conns",
+	"ConnRate":  "conn_rate",
+	"Idle_pct":  "idle_pct",
+}
+
+// runSocketCommand sends the command to the admin socket and returns the whole response, which is closed by HAProxy
+// after the command in the non-interactive mode. The timeout bounds the connect and all the I/O.
+func (p HAProxyPlugin) runSocketCommand(command string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", p.Socket, p.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the socket %s: %s", p.Socket, err)
+	}
+	defer conn.Close()
+	if p.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.Timeout))
+	}
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return nil, fmt.Errorf("failed to send %q to the socket %s: %s", command, p.Socket, err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, conn); err != nil {
+		return nil, fmt.Errorf("failed to read %q from the socket %s: %s", command, p.Socket, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// fetchMetricsFromSocket returns the metrics of show stat, which is the same CSV as the stats page, and show info
+func (p HAProxyPlugin) fetchMetricsFromSocket() (map[string]float64, error) {
+	stats, err := p.runSocketCommand("show stat")
+	if err != nil {
+		return nil, err
+	}
+	stat, err := p.parseStats(bytes.NewReader(stats))
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := p.runSocketCommand("show info")
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range parseInfo(bytes.NewReader(info)) {
+		stat[k] = v
+	}
+	return stat, nil
+}
+
+// parseInfo parses the lines of show info in the form of <name>: <value>
+func parseInfo(r io.Reader) map[string]float64 {
+	stat := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		name, ok := infoPlace[strings.TrimSpace(kv[0])]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			continue
+		}
+		stat[name] = v
+	}
+	return stat
+}
+
+func (p HAProxyPlugin) infoGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"info.connections": {
+			Label: labelPrefix + " Current Connections",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "curr_conns", Label: "Current Connections"},
+			},
+		},
+		"info.conn_rate": {
+			Label: labelPrefix + " Connection Rate",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "conn_rate", Label: "Connections per second"},
+			},
+		},
+		"info.idle": {
+			Label: labelPrefix + " Idle",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "idle_pct", Label: "Idle"},
+			},
+		},
+	}
+}
@@ -0,0 +1,103 @@
+package mphaproxy
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testShowStat = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,weight,act,bck,chkfail,chkdown,lastchg,downtime,qlimit,pid,iid,sid,throttle,lbtot,tracked,type,rate,rate_lim,rate_max,check_status,check_code,check_duration,hrsp_1xx,hrsp_2xx,hrsp_3xx,hrsp_4xx,hrsp_5xx,hrsp_other,hanafail,req_rate,req_rate_max,req_tot,cli_abrt,srv_abrt,comp_in,comp_out,comp_byp,comp_rsp,lastsess,last_chk,last_agt,qtime,ctime,rtime,ttime,
+hastats,FRONTEND,,,1,1,64,43,7061,15994,0,0,0,,,,,OPEN,,,,,,,,,1,1,0,,,,0,2,0,2,,,,0,10,0,15,17,0,,2,2,43,,,0,0,0,0,,,,,,,,
+hastats,BACKEND,0,0,0,1,7,17,7061,15994,0,0,,17,0,0,0,UP,0,0,0,,0,1543,0,,1,1,0,,0,,1,0,,1,,,,0,0,0,0,17,0,,,,,0,0,0,0,0,0,0,,,0,0,0,0,
+
+`
+
+const testShowInfo = `Name: HAProxy
+Version: 2.8.3
+Nbthread: 4
+Maxconn: 4096
+CurrConns: 12
+CumConns: 3456
+ConnRate: 7
+Idle_pct: 98
+node: lb1
+
+`
+
+// serveSocket answers the commands of the admin socket until the returned func is called
+func serveSocket(t *testing.T, responses map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-haproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "haproxy.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("unix socket is not available: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				command, _ := bufio.NewReader(conn).ReadString('\n')
+				if resp, ok := responses[strings.TrimSpace(command)]; ok {
+					io.WriteString(conn, resp)
+					return
+				}
+				// hang up without answering
+				time.Sleep(time.Second)
+			}()
+		}
+	}()
+	return socket, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFetchMetricsFromSocket(t *testing.T) {
+	socket, stop := serveSocket(t, map[string]string{"show stat": testShowStat, "show info": testShowInfo})
+	defer stop()
+
+	haproxy := HAProxyPlugin{URI: "http://localhost/", Socket: socket, Timeout: time.Second}
+	stat, err := haproxy.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 17, stat["sessions"])
+	assert.EqualValues(t, 7061, stat["bytes_in"])
+	assert.EqualValues(t, 12, stat["curr_conns"])
+	assert.EqualValues(t, 7, stat["conn_rate"])
+	assert.EqualValues(t, 98, stat["idle_pct"])
+	assert.NotContains(t, stat, "cum_conns")
+}
+
+func TestFetchMetricsFromSocketTimeout(t *testing.T) {
+	socket, stop := serveSocket(t, map[string]string{"show stat": testShowStat})
+	defer stop()
+
+	haproxy := HAProxyPlugin{Socket: socket, Timeout: 100 * time.Millisecond}
+	_, err := haproxy.FetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), socket) {
+		t.Errorf("FetchMetrics() should fail with the timeout of the socket: %v", err)
+	}
+}
+
+func TestGraphDefinitionSocket(t *testing.T) {
+	haproxy := HAProxyPlugin{Socket: "/var/run/haproxy.sock"}
+	graphdef := haproxy.GraphDefinition()
+	assert.Len(t, graphdef, 6)
+	assert.Equal(t, "HAProxy Idle", graphdef["info.idle"].Label)
+	assert.NotEqual(t, HAProxyPlugin{URI: "http://localhost/"}.tempfile(""), haproxy.tempfile(""))
+}
@@ -1,12 +1,14 @@
 package mpinode
 
 import (
+	"flag"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
@@ -15,7 +17,13 @@ import (
 var logger = logging.GetLogger("metrics.plugin.inode")
 
 // InodePlugin plugin
-type InodePlugin struct{}
+type InodePlugin struct {
+	Filter MountFilter
+	// StatfsTimeout bounds the statfs of the filesystems in the mountinfo
+	StatfsTimeout time.Duration
+	// Mountinfo is the path of mountinfo of Linux, which is walked instead of df if it is readable
+	Mountinfo string
+}
 
 var dfHeaderPattern = regexp.MustCompile(
 	`^Filesystem\s+`,
@@ -42,6 +50,26 @@ var deviceUnacceptablePattern = regexp.MustCompile(
 
 // FetchMetrics interface for mackerelplugin
 func (p InodePlugin) FetchMetrics() (map[string]interface{}, error) {
+	if runtime.GOOS == "linux" && p.Mountinfo != "" {
+		f, err := os.Open(p.Mountinfo)
+		if err == nil {
+			defer f.Close()
+			mounts, err := parseMountinfo(f)
+			if err != nil {
+				return nil, err
+			}
+			result := make(map[string]interface{})
+			for _, st := range statMounts(filterMounts(mounts, p.Filter), p.StatfsTimeout) {
+				setInodes(result, metricName(st.source), st.used, st.free)
+			}
+			return result, nil
+		}
+		logger.Debugf("Failed to open %s, falling back to df: %s", p.Mountinfo, err)
+	}
+	return p.fetchMetricsFromDf()
+}
+
+func (p InodePlugin) fetchMetricsFromDf() (map[string]interface{}, error) {
 	dfOpt := "-i"
 	if runtime.GOOS == "linux" {
 		dfOpt = "-iP"
@@ -60,11 +88,14 @@ func (p InodePlugin) FetchMetrics() (map[string]interface{}, error) {
 		} else if matches := dfColumnsPattern.FindStringSubmatch(line); matches != nil {
 			name := matches[1]
 			// https://github.com/docker/docker/blob/v1.5.0/daemon/graphdriver/devmapper/deviceset.go#L981
-			if regexp.MustCompile(`^/dev/mapper/docker-`).FindStringSubmatch(name) != nil {
+			if dockerDevicemapperPattern.MatchString(name) {
 				continue
 			}
-			if nameMatches := devicePattern.FindStringSubmatch(name); nameMatches != nil {
-				device := deviceUnacceptablePattern.ReplaceAllString(nameMatches[1], "_")
+			// df shows no types of the filesystems, so that only the mountpoints are filtered
+			if !p.Filter.matchMountpoint(matches[5]) {
+				continue
+			}
+			if devicePattern.MatchString(name) {
 				iused, err := strconv.ParseInt(matches[2], 0, 64)
 				if err != nil {
 					logger.Warningf("Failed to parse value: [%s]", matches[2])
@@ -75,20 +106,24 @@ func (p InodePlugin) FetchMetrics() (map[string]interface{}, error) {
 					logger.Warningf("Failed to parse value: [%s]", matches[3])
 					continue
 				}
-				result["inode.count."+device+".used"] = uint64(iused)
-				result["inode.count."+device+".free"] = uint64(ifree)
-				result["inode.count."+device+".total"] = uint64(iused + ifree)
-				usedPercentage := 100.0 // 100% if both iused and ifree are 0
-				if iused+ifree > 0 {
-					usedPercentage = float64(iused) * 100 / float64(iused+ifree)
-				}
-				result["inode.percentage."+device+".used"] = usedPercentage
+				setInodes(result, metricName(name), uint64(iused), uint64(ifree))
 			}
 		}
 	}
 	return result, nil
 }
 
+func setInodes(result map[string]interface{}, device string, iused, ifree uint64) {
+	result["inode.count."+device+".used"] = iused
+	result["inode.count."+device+".free"] = ifree
+	result["inode.count."+device+".total"] = iused + ifree
+	usedPercentage := 100.0 // 100% if both iused and ifree are 0
+	if iused+ifree > 0 {
+		usedPercentage = float64(iused) * 100 / float64(iused+ifree)
+	}
+	result["inode.percentage."+device+".used"] = usedPercentage
+}
+
 // GraphDefinition interface for mackerelplugin
 func (p InodePlugin) GraphDefinition() map[string]mp.Graphs {
 	return map[string]mp.Graphs{
@@ -113,7 +148,36 @@ func (p InodePlugin) GraphDefinition() map[string]mp.Graphs {
 
 // Do the plugin
 func Do() {
-	inode := InodePlugin{}
+	optExcludeFstype := flag.String("exclude-fstype", defaultExcludeFstypes, "Comma separated types of the filesystems to exclude")
+	optIncludeMountpoint := flag.String("include-mountpoint", "", "Regexp of the mountpoints to include")
+	optExcludeMountpoint := flag.String("exclude-mountpoint", "", "Regexp of the mountpoints to exclude")
+	optStatfsTimeout := flag.Duration("statfs-timeout", 5*time.Second, "Timeout of statfs, after which the filesystem, e.g. the hung NFS, is skipped")
+	optMountinfo := flag.String("mountinfo", "/proc/self/mountinfo", "Path of mountinfo (Linux)")
+	flag.Parse()
+
+	inode := InodePlugin{
+		Filter: MountFilter{
+			ExcludeFstypes: ParseFstypes(*optExcludeFstype),
+		},
+		StatfsTimeout: *optStatfsTimeout,
+		Mountinfo:     *optMountinfo,
+	}
+	if *optIncludeMountpoint != "" {
+		re, err := regexp.Compile(*optIncludeMountpoint)
+		if err != nil {
+			logger.Criticalf("Invalid -include-mountpoint: %s", err)
+			os.Exit(1)
+		}
+		inode.Filter.IncludeMountpoint = re
+	}
+	if *optExcludeMountpoint != "" {
+		re, err := regexp.Compile(*optExcludeMountpoint)
+		if err != nil {
+			logger.Criticalf("Invalid -exclude-mountpoint: %s", err)
+			os.Exit(1)
+		}
+		inode.Filter.ExcludeMountpoint = re
+	}
 	helper := mp.NewMackerelPlugin(inode)
 	helper.Run()
 }
@@ -0,0 +1,213 @@
+package mpinode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultExcludeFstypes are the types of the filesystems excluded by default, which are mounted many times on
+// the container hosts
+const defaultExcludeFstypes = "tmpfs,devtmpfs,overlay,squashfs,nsfs"
+
+// mount is a line of /proc/self/mountinfo, e.g. "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw"
+type mount struct {
+	device     string // major:minor
+	root       string
+	mountpoint string
+	fstype     string
+	source     string
+}
+
+// parseMountinfo parses /proc/self/mountinfo, see proc(5)
+func parseMountinfo(r io.Reader) ([]mount, error) {
+	var mounts []mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+3 {
+			continue
+		}
+		mounts = append(mounts, mount{
+			device:     fields[2],
+			root:       unescapeMountinfo(fields[3]),
+			mountpoint: unescapeMountinfo(fields[4]),
+			fstype:     fields[sep+1],
+			source:     unescapeMountinfo(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountinfo unescapes the octal escapes of the spaces, the tabs, the newlines and the backslashes
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return '0' <= c && c <= '7'
+}
+
+// MountFilter selects the filesystems whose inodes are posted
+type MountFilter struct {
+	ExcludeFstypes    []string
+	IncludeMountpoint *regexp.Regexp
+	ExcludeMountpoint *regexp.Regexp
+}
+
+func (f MountFilter) matchMountpoint(mountpoint string) bool {
+	if f.IncludeMountpoint != nil && !f.IncludeMountpoint.MatchString(mountpoint) {
+		return false
+	}
+	if f.ExcludeMountpoint != nil && f.ExcludeMountpoint.MatchString(mountpoint) {
+		return false
+	}
+	return true
+}
+
+func (f MountFilter) match(m mount) bool {
+	for _, fstype := range f.ExcludeFstypes {
+		if m.fstype == fstype {
+			return false
+		}
+	}
+	return f.matchMountpoint(m.mountpoint)
+}
+
+var dockerDevicemapperPattern = regexp.MustCompile(`^/dev/mapper/docker-`)
+
+// remoteSourcePattern matches the sources of the network filesystems, e.g. host:/export of NFS or //host/share of CIFS
+var remoteSourcePattern = regexp.MustCompile(`^[^/]+:/|^//`)
+
+// reportedSource reports whether the filesystem is posted, which is on a device as well as df, or on the network
+func reportedSource(source string) bool {
+	// https://github.com/docker/docker/blob/v1.5.0/daemon/graphdriver/devmapper/deviceset.go#L981
+	if dockerDevicemapperPattern.MatchString(source) {
+		return false
+	}
+	return devicePattern.MatchString(source) || remoteSourcePattern.MatchString(source)
+}
+
+// filterMounts returns the filesystems to be posted, where the bind mounts of the same device are reported once
+// at the mount of the root of the filesystem, or else at the shortest mountpoint
+func filterMounts(mounts []mount, filter MountFilter) []mount {
+	devices := make(map[string]mount)
+	var order []string
+	for _, m := range mounts {
+		if !reportedSource(m.source) || !filter.match(m) {
+			continue
+		}
+		prev, ok := devices[m.device]
+		if !ok {
+			order = append(order, m.device)
+		} else if prev.root == "/" && (m.root != "/" || len(prev.mountpoint) <= len(m.mountpoint)) {
+			continue
+		} else if prev.root != "/" && m.root != "/" && len(prev.mountpoint) <= len(m.mountpoint) {
+			continue
+		}
+		devices[m.device] = m
+	}
+	result := make([]mount, len(order))
+	for i, device := range order {
+		result[i] = devices[device]
+	}
+	return result
+}
+
+// metricName returns the name of the filesystem in the metrics, which is the device under /dev as well as df
+func metricName(source string) string {
+	if matches := devicePattern.FindStringSubmatch(source); matches != nil {
+		source = matches[1]
+	}
+	return deviceUnacceptablePattern.ReplaceAllString(source, "_")
+}
+
+// statfs is replaced with the hung one in the tests
+var statfs = sysStatfs
+
+type inodes struct {
+	mount
+	used, free uint64
+}
+
+// statMounts returns the inodes of the filesystems by statfs in parallel. The filesystems whose statfs does
+// not return in the timeout, e.g. the NFS whose server is down, are skipped.
+func statMounts(mounts []mount, timeout time.Duration) []inodes {
+	type result struct {
+		i     int
+		files uint64
+		ffree uint64
+		err   error
+	}
+	ch := make(chan result, len(mounts))
+	for i, m := range mounts {
+		go func(i int, mountpoint string) {
+			files, ffree, err := statfs(mountpoint)
+			ch <- result{i, files, ffree, err}
+		}(i, m.mountpoint)
+	}
+
+	var stats []inodes
+	done := make([]bool, len(mounts))
+	deadline := time.After(timeout)
+	for range mounts {
+		select {
+		case r := <-ch:
+			done[r.i] = true
+			if r.err != nil {
+				logger.Warningf("Failed to statfs %s: %s", mounts[r.i].mountpoint, r.err)
+				continue
+			}
+			stats = append(stats, inodes{mount: mounts[r.i], used: r.files - r.ffree, free: r.ffree})
+		case <-deadline:
+			for i, m := range mounts {
+				if !done[i] {
+					logger.Warningf("statfs %s timed out in %s. Skip the filesystem.", m.mountpoint, timeout)
+				}
+			}
+			return sortInodes(stats)
+		}
+	}
+	return sortInodes(stats)
+}
+
+func sortInodes(stats []inodes) []inodes {
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].mountpoint < stats[j].mountpoint
+	})
+	return stats
+}
+
+// ParseFstypes parses the comma separated types of the filesystems
+func ParseFstypes(s string) []string {
+	var fstypes []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			fstypes = append(fstypes, t)
+		}
+	}
+	return fstypes
+}
@@ -0,0 +1,107 @@
+package mpinode
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mountinfo = `22 28 0:20 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+25 28 0:5 / /dev rw,nosuid,relatime shared:2 - devtmpfs udev rw,size=4004812k,nr_inodes=1001203,mode=755
+28 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw,errors=remount-ro
+30 28 259:1 / /boot/efi rw,relatime shared:3 - vfat /dev/nvme0n1p1 rw
+31 28 259:3 / /var/lib/docker rw,relatime shared:4 - xfs /dev/nvme0n1p3 rw
+32 28 259:3 /volumes/data /srv/data rw,relatime shared:4 - xfs /dev/nvme0n1p3 rw
+33 28 0:40 / /mnt/nfs rw,relatime shared:5 - nfs4 nfs.example.com:/export rw,vers=4.2
+34 28 7:0 / /snap/core/1 ro,nodev,relatime shared:6 - squashfs /dev/loop0 ro
+35 31 0:50 / /var/lib/docker/overlay2/abc/merged rw,relatime - overlay overlay rw
+36 28 259:4 / /mnt/my\040disk rw,relatime shared:8 - ext4 /dev/mapper/vg-my--lv rw
+`
+
+func TestParseMountinfo(t *testing.T) {
+	mounts, err := parseMountinfo(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 10 {
+		t.Fatalf("10 mounts should be parsed, but %d", len(mounts))
+	}
+	expected := mount{device: "259:3", root: "/volumes/data", mountpoint: "/srv/data", fstype: "xfs", source: "/dev/nvme0n1p3"}
+	if mounts[5] != expected {
+		t.Errorf("the bind mount should be %+v, but %+v", expected, mounts[5])
+	}
+	if mounts[9].mountpoint != "/mnt/my disk" {
+		t.Errorf("the space of the mountpoint should be unescaped, but %q", mounts[9].mountpoint)
+	}
+}
+
+func mountpoints(mounts []mount) []string {
+	var result []string
+	for _, m := range mounts {
+		result = append(result, m.mountpoint)
+	}
+	return result
+}
+
+func TestFilterMounts(t *testing.T) {
+	mounts, _ := parseMountinfo(strings.NewReader(mountinfo))
+
+	filter := MountFilter{ExcludeFstypes: ParseFstypes(defaultExcludeFstypes)}
+	expected := []string{"/", "/boot/efi", "/var/lib/docker", "/mnt/nfs", "/mnt/my disk"}
+	if got := mountpoints(filterMounts(mounts, filter)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("filtered mountpoints should be %v, but %v", expected, got)
+	}
+
+	filter.ExcludeMountpoint = regexp.MustCompile(`^/(boot|mnt)/`)
+	expected = []string{"/", "/var/lib/docker"}
+	if got := mountpoints(filterMounts(mounts, filter)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("filtered mountpoints should be %v, but %v", expected, got)
+	}
+
+	// the bind mount is reported if the root of the filesystem is excluded
+	filter = MountFilter{IncludeMountpoint: regexp.MustCompile(`^/srv/`)}
+	expected = []string{"/srv/data"}
+	if got := mountpoints(filterMounts(mounts, filter)); !reflect.DeepEqual(got, expected) {
+		t.Errorf("filtered mountpoints should be %v, but %v", expected, got)
+	}
+
+	// the root of the filesystem is reported even if the bind mount is found first
+	reversed := []mount{mounts[5], mounts[4]}
+	expected = []string{"/var/lib/docker"}
+	if got := mountpoints(filterMounts(reversed, MountFilter{})); !reflect.DeepEqual(got, expected) {
+		t.Errorf("filtered mountpoints should be %v, but %v", expected, got)
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for source, expected := range map[string]string{
+		"/dev/nvme0n1p2":          "nvme0n1p2",
+		"/dev/mapper/vg-my--lv":   "mapper_vg-my--lv",
+		"nfs.example.com:/export": "nfs_example_com__export",
+	} {
+		if name := metricName(source); name != expected {
+			t.Errorf("the name of %s should be %s, but %s", source, expected, name)
+		}
+	}
+}
+
+func TestStatMountsTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	orig := statfs
+	defer func() { statfs = orig }()
+	statfs = func(path string) (uint64, uint64, error) {
+		if path == "/mnt/nfs" {
+			<-hung
+		}
+		return 100, 40, nil
+	}
+
+	mounts := []mount{{mountpoint: "/mnt/nfs", source: "nfs.example.com:/export"}, {mountpoint: "/", source: "/dev/sda1"}}
+	stats := statMounts(mounts, 100*time.Millisecond)
+	if len(stats) != 1 || stats[0].mountpoint != "/" || stats[0].used != 60 || stats[0].free != 40 {
+		t.Errorf("only / should be returned, but %+v", stats)
+	}
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package mpinode
+
+import "syscall"
+
+// sysStatfs returns the total and the free inodes of the filesystem mounted on the path
+func sysStatfs(path string) (files, ffree uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Files), uint64(st.Ffree), nil
+}
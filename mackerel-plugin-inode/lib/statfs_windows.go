@@ -0,0 +1,8 @@
+package mpinode
+
+import "errors"
+
+// sysStatfs is not supported on Windows, where no mountinfo is walked
+func sysStatfs(path string) (files, ffree uint64, err error) {
+	return 0, 0, errors.New("statfs is not supported on windows")
+}
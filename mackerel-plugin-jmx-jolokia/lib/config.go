@@ -0,0 +1,259 @@
+package mpjmxjolokia
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// MBeanQuery is a user-defined metric read from an attribute of MBeans, given by the file of -config
+type MBeanQuery struct {
+	// MBean is the ObjectName, which may be a pattern with `*` to post a metric per matching MBean
+	MBean     string `json:"mbean"`
+	Attribute string `json:"attribute"`
+	// Path is the inner path of the composite data, such as `used` of HeapMemoryUsage
+	Path  string `json:"path,omitempty"`
+	Name  string `json:"name"`
+	Label string `json:"label,omitempty"`
+	Unit  string `json:"unit,omitempty"`
+	Diff  bool   `json:"diff,omitempty"`
+}
+
+// Config is the file of -config
+type Config struct {
+	MBeans []MBeanQuery `json:"mbeans"`
+}
+
+var (
+	validNameRe  = regexp.MustCompile(`^[-a-zA-Z0-9_]+$`)
+	invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+)
+
+// loadConfig reads and validates the config file
+func loadConfig(file string) (*Config, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	// the names of the non-pattern queries are the keys of the metrics as well as the built-in ones
+	for _, g := range graphdef {
+		for _, m := range g.Metrics {
+			names[m.Name] = true
+		}
+	}
+	for i, q := range conf.MBeans {
+		if q.MBean == "" || q.Attribute == "" {
+			return nil, fmt.Errorf("mbeans[%d]: mbean and attribute are required", i)
+		}
+		if !validNameRe.MatchString(q.Name) {
+			return nil, fmt.Errorf("mbeans[%d]: name should match %s: %q", i, validNameRe, q.Name)
+		}
+		if names[q.Name] {
+			return nil, fmt.Errorf("mbeans[%d]: duplicated name of the metric: %s", i, q.Name)
+		}
+		names[q.Name] = true
+	}
+	return &conf, nil
+}
+
+func (q MBeanQuery) isPattern() bool {
+	return strings.ContainsAny(q.MBean, "*?")
+}
+
+func (q MBeanQuery) graphKey() string {
+	if q.isPattern() {
+		return "jmx.jolokia.custom." + q.Name + ".#"
+	}
+	return "jmx.jolokia.custom." + q.Name
+}
+
+// metricName returns the name of the metric in the graph. The metrics of the patterns are wildcard metrics, and the
+// others are keyed by their names as well as the built-in metrics
+func (q MBeanQuery) metricName() string {
+	if q.isPattern() {
+		return "value"
+	}
+	return q.Name
+}
+
+// parseObjectName returns the domain and the key properties of the ObjectName
+func parseObjectName(name string) (string, map[string]string) {
+	props := make(map[string]string)
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return name, props
+	}
+	for _, p := range strings.Split(name[i+1:], ",") {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			props[kv[0]] = kv[1]
+		}
+	}
+	return name[:i], props
+}
+
+// instanceKey returns the key of the MBean matching the pattern, which is made of the values of the key properties not
+// fixed by the pattern, e.g. `foo` for the topic of kafka.server:type=BrokerTopicMetrics,name=MessagesInPerSec,topic=*
+func instanceKey(pattern, objectName string) string {
+	_, fixed := parseObjectName(pattern)
+	_, props := parseObjectName(objectName)
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		if v, ok := fixed[k]; ok && !strings.ContainsAny(v, "*?") {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values = append(values, strings.Trim(props[k], `"`))
+	}
+	return invalidKeyRe.ReplaceAllString(strings.Join(values, "_"), "_")
+}
+
+// lookupPath returns the value at the path of the composite data. The value is returned as is if it is not composite,
+// since Jolokia has already applied the path for non-pattern reads.
+func lookupPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	for _, p := range strings.Split(path, "/") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		v = m[p]
+	}
+	return v
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type bulkReadRequest struct {
+	Type      string `json:"type"`
+	MBean     string `json:"mbean"`
+	Attribute string `json:"attribute"`
+	Path      string `json:"path,omitempty"`
+}
+
+type bulkReadResponse struct {
+	Status int         `json:"status"`
+	Value  interface{} `json:"value"`
+	Error  string      `json:"error"`
+}
+
+// fetchMBeans reads all the queries by a bulk request. The queries which fail to resolve are logged and skipped.
+func (j JmxJolokiaPlugin) fetchMBeans(stat map[string]interface{}) error {
+	if len(j.MBeans) == 0 {
+		return nil
+	}
+	reqs := make([]bulkReadRequest, 0, len(j.MBeans))
+	for _, q := range j.MBeans {
+		reqs = append(reqs, bulkReadRequest{Type: "read", MBean: q.MBean, Attribute: q.Attribute, Path: q.Path})
+	}
+	body, err := json.Marshal(reqs)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(j.BaseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var results []bulkReadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return err
+	}
+	if len(results) != len(j.MBeans) {
+		return fmt.Errorf("unexpected number of responses of the bulk request: %d", len(results))
+	}
+
+	for i, q := range j.MBeans {
+		r := results[i]
+		if r.Status != http.StatusOK {
+			logger.Warningf("Failed to read %s of %s: %s", q.Attribute, q.MBean, r.Error)
+			continue
+		}
+		if !q.isPattern() {
+			v, ok := numericValue(lookupPath(r.Value, q.Path))
+			if !ok {
+				logger.Warningf("Non-numeric value of %s of %s", q.Attribute, q.MBean)
+				continue
+			}
+			stat[q.metricName()] = v
+			continue
+		}
+
+		// the value of a pattern read is keyed by the ObjectName and the attribute
+		mbeans, ok := r.Value.(map[string]interface{})
+		if !ok || len(mbeans) == 0 {
+			logger.Warningf("No MBeans match %s", q.MBean)
+			continue
+		}
+		for objectName, attrs := range mbeans {
+			a, ok := attrs.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			v, ok := numericValue(lookupPath(a[q.Attribute], q.Path))
+			if !ok {
+				continue
+			}
+			key := instanceKey(q.MBean, objectName)
+			if key == "" {
+				continue
+			}
+			stat["jmx.jolokia.custom."+q.Name+"."+key+"."+q.metricName()] = v
+		}
+	}
+	return nil
+}
+
+func (j JmxJolokiaPlugin) mbeanGraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs, len(j.MBeans))
+	for _, q := range j.MBeans {
+		label := q.Label
+		if label == "" {
+			label = q.Name
+		}
+		unit := q.Unit
+		if unit == "" {
+			unit = "float"
+		}
+		metricLabel := q.Attribute
+		if q.isPattern() {
+			metricLabel = "%1"
+		}
+		graphs[q.graphKey()] = mp.Graphs{
+			Label: "Jmx " + label,
+			Unit:  unit,
+			Metrics: []mp.Metrics{
+				{Name: q.metricName(), Label: metricLabel, Diff: q.Diff, Type: "float64"},
+			},
+		}
+	}
+	return graphs
+}
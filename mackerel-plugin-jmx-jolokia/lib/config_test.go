@@ -0,0 +1,105 @@
+package mpjmxjolokia
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "mackerel-plugin-jmx-jolokia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"mbeans": [
+  {"mbean": "kafka.server:type=BrokerTopicMetrics,name=MessagesInPerSec,topic=*", "attribute": "Count", "name": "messages_in", "diff": true},
+  {"mbean": "com.zaxxer.hikari:type=Pool (main)", "attribute": "ActiveConnections", "name": "hikari_active", "unit": "integer"}
+]}`)
+	f.Close()
+
+	conf, err := loadConfig(f.Name())
+	if err != nil {
+		t.Fatalf("loadConfig: %s", err)
+	}
+	if len(conf.MBeans) != 2 || !conf.MBeans[0].Diff || conf.MBeans[1].Unit != "integer" {
+		t.Errorf("loadConfig: unexpected %v", conf.MBeans)
+	}
+
+	for _, c := range []string{
+		`{"mbeans": [{"mbean": "java.lang:type=Memory", "name": "heap"}]}`,
+		`{"mbeans": [{"mbean": "java.lang:type=Memory", "attribute": "HeapMemoryUsage", "name": "heap.used"}]}`,
+		`{"mbeans": [{"mbean": "java.lang:type=Threading", "attribute": "ThreadCount", "name": "ThreadCount"}]}`,
+	} {
+		ioutil.WriteFile(f.Name(), []byte(c), 0644)
+		if _, err := loadConfig(f.Name()); err == nil {
+			t.Errorf("loadConfig(%s) should fail", c)
+		}
+	}
+}
+
+func TestInstanceKey(t *testing.T) {
+	cases := []struct{ pattern, name, expected string }{
+		{"kafka.server:type=BrokerTopicMetrics,name=MessagesInPerSec,topic=*", "kafka.server:name=MessagesInPerSec,topic=my.topic,type=BrokerTopicMetrics", "my_topic"},
+		{"kafka.server:type=BrokerTopicMetrics,*", "kafka.server:name=BytesInPerSec,topic=foo,type=BrokerTopicMetrics", "BytesInPerSec_foo"},
+		{"com.zaxxer.hikari:type=Pool *", "com.zaxxer.hikari:type=Pool (main)", "Pool__main_"},
+	}
+	for _, c := range cases {
+		if actual := instanceKey(c.pattern, c.name); actual != c.expected {
+			t.Errorf("instanceKey(%s, %s): %s should be %s", c.pattern, c.name, actual, c.expected)
+		}
+	}
+}
+
+func TestFetchMBeans(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []bulkReadRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil || len(reqs) != 3 {
+			t.Errorf("unexpected bulk request: %v", reqs)
+		}
+		w.Write([]byte(`[
+  {"status": 200, "value": {
+    "kafka.server:name=MessagesInPerSec,topic=foo,type=BrokerTopicMetrics": {"Count": 100},
+    "kafka.server:name=MessagesInPerSec,topic=bar,type=BrokerTopicMetrics": {"Count": 200}
+  }},
+  {"status": 200, "value": 12},
+  {"status": 404, "error": "javax.management.InstanceNotFoundException : com.example:type=Missing"}
+]`))
+	}))
+	defer ts.Close()
+
+	j := JmxJolokiaPlugin{BaseURL: ts.URL, MBeans: []MBeanQuery{
+		{MBean: "kafka.server:type=BrokerTopicMetrics,name=MessagesInPerSec,topic=*", Attribute: "Count", Name: "messages_in", Diff: true},
+		{MBean: "com.zaxxer.hikari:type=Pool (main)", Attribute: "ActiveConnections", Name: "hikari_active"},
+		{MBean: "com.example:type=Missing", Attribute: "Value", Name: "missing"},
+	}}
+	stat := make(map[string]interface{})
+	if err := j.fetchMBeans(stat); err != nil {
+		t.Fatalf("fetchMBeans: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"jmx.jolokia.custom.messages_in.foo.value": 100.0,
+		"jmx.jolokia.custom.messages_in.bar.value": 200.0,
+		"hikari_active": 12.0,
+	}
+	if len(stat) != len(expected) {
+		t.Errorf("fetchMBeans: %d metrics should be %d: %v", len(stat), len(expected), stat)
+	}
+	for k, v := range expected {
+		if stat[k] != v {
+			t.Errorf("fetchMBeans: %s should be %v, but %v", k, v, stat[k])
+		}
+	}
+
+	graphs := j.GraphDefinition()
+	if len(graphs) != len(graphdef)+3 {
+		t.Errorf("GraphDefinition(): %d graphs should be %d", len(graphs), len(graphdef)+3)
+	}
+	if g := graphs["jmx.jolokia.custom.messages_in.#"]; len(g.Metrics) != 1 || !g.Metrics[0].Diff {
+		t.Errorf("GraphDefinition(): unexpected messages_in graph %v", g)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
@@ -16,6 +17,9 @@ var logger = logging.GetLogger("metrics.plugin.jmx-jolokia")
 type JmxJolokiaPlugin struct {
 	Target   string
 	Tempfile string
+	// BaseURL is the endpoint of the bulk requests for MBeans
+	BaseURL string
+	MBeans  []MBeanQuery
 }
 
 // JmxJolokiaResponse response for Jolokia
@@ -95,6 +99,10 @@ func (j JmxJolokiaPlugin) FetchMetrics() (map[string]interface{}, error) {
 		logger.Warningf(err.Error())
 	}
 
+	if err := j.fetchMBeans(stat); err != nil {
+		logger.Warningf(err.Error())
+	}
+
 	return stat, nil
 }
 
@@ -169,7 +177,14 @@ func (j JmxJolokiaPlugin) executeGetRequest(mbean string) (*JmxJolokiaResponse,
 
 // GraphDefinition interface for mackerelplugin
 func (j JmxJolokiaPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	if len(j.MBeans) == 0 {
+		return graphdef
+	}
+	graphs := j.mbeanGraphDefinition()
+	for k, v := range graphdef {
+		graphs[k] = v
+	}
+	return graphs
 }
 
 // Do the plugin
@@ -177,10 +192,19 @@ func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "8778", "Port")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optConfig := flag.String("config", "", "JSON file of the MBeans to read in addition to the built-in ones")
 	flag.Parse()
 
 	var jmxJolokia JmxJolokiaPlugin
 	jmxJolokia.Target = fmt.Sprintf("http://%s:%s/jolokia/read/", *optHost, *optPort)
+	jmxJolokia.BaseURL = fmt.Sprintf("http://%s:%s/jolokia/", *optHost, *optPort)
+	if *optConfig != "" {
+		conf, err := loadConfig(*optConfig)
+		if err != nil {
+			log.Fatalf("Invalid -config: %s", err)
+		}
+		jmxJolokia.MBeans = conf.MBeans
+	}
 
 	helper := mp.NewMackerelPlugin(jmxJolokia)
 	if *optTempfile != "" {
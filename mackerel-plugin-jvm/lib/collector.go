@@ -0,0 +1,175 @@
+package mpjvm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// # jcmd <pid> VM.info
+// # JRE version: OpenJDK Runtime Environment (17.0.2+8) (build 17.0.2+8-86)
+// # Java VM: OpenJDK 64-Bit Server VM (17.0.2+8-86, mixed mode, sharing, tiered, compressed oops, compressed class ptrs, g1 gc, linux-amd64)
+// ...
+// Heap:
+//  garbage-first heap   total 262144K, used 21504K [0x0000000700000000, 0x0000000800000000)
+//   region size 1024K, 18 young (18432K), 2 survivors (2048K)
+// ...
+// Heap Regions: E=young(eden), S=young(survivor), O=old, HS=humongous(starts), HC=humongous(continues), ...
+// |   0|0x0000000700000000, 0x0000000700100000, 0x0000000700100000|100%| O|  |TAMS 0x0000000700100000, 0x0000000700000000| Untracked
+// |   1|0x0000000700100000, 0x0000000700200000, 0x0000000700200000|100%|HS|  |TAMS 0x0000000700200000, 0x0000000700100000| Complete
+//
+// The heap of ZGC and Shenandoah:
+//  ZHeap           used 30M, capacity 256M, max capacity 4096M
+//  Shenandoah Heap
+//  4096M max, 4096M soft max, 256M committed, 31744K used
+
+var (
+	vmInfoCollectorRe = regexp.MustCompile(`(?m)^# Java VM: .*\((.*)\)\s*$`)
+	g1HeapRe          = regexp.MustCompile(`garbage-first heap\s+total (\d+[KMG]), used (\d+[KMG])`)
+	g1RegionSizeRe    = regexp.MustCompile(`region size (\d+[KMG])`)
+	g1RegionRe        = regexp.MustCompile(`(?m)^\|\s*\d+\|[^|]*\|\s*\d+%\|\s*([A-Z]+)\|`)
+	zHeapRe           = regexp.MustCompile(`ZHeap\s+used (\d+[KMG]), capacity (\d+[KMG]), max capacity (\d+[KMG])`)
+	shenandoahHeapRe  = regexp.MustCompile(`(\d+[KMG]) max, (?:\d+[KMG] soft max, )?(\d+[KMG]) committed, (\d+[KMG]) used`)
+)
+
+// g1RegionMetrics maps the types of the G1 regions to the metrics
+var g1RegionMetrics = map[string]string{
+	"E":  "g1_eden_bytes",
+	"S":  "g1_survivor_bytes",
+	"O":  "g1_old_bytes",
+	"OA": "g1_old_bytes",
+	"CA": "g1_old_bytes",
+	"HS": "g1_humongous_bytes",
+	"HC": "g1_humongous_bytes",
+	"F":  "g1_free_bytes",
+}
+
+// fetchVMInfo returns the output of jcmd VM.info, which does not work on remote as well as jinfo
+func (m JVMPlugin) fetchVMInfo() (string, error) {
+	stdout, _, exitStatus, err := runTimeoutCommand(m.JcmdPath, m.Lvmid, "VM.info")
+	if err == nil && exitStatus.IsTimedOut() {
+		err = fmt.Errorf("jcmd command timed out")
+	}
+	return stdout, err
+}
+
+// detectCollector returns the collector in the header of VM.info, e.g. g1, z, shenandoah, parallel or serial,
+// or the empty string if it is not found
+func detectCollector(vmInfo string) string {
+	match := vmInfoCollectorRe.FindStringSubmatch(vmInfo)
+	if match == nil {
+		return ""
+	}
+	for _, attr := range strings.Split(match[1], ",") {
+		attr = strings.TrimSpace(attr)
+		if strings.HasSuffix(attr, " gc") {
+			return strings.TrimSuffix(attr, " gc")
+		}
+	}
+	return ""
+}
+
+// parseSize parses the size of jcmd such as 1024K into bytes
+func parseSize(s string) float64 {
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0
+	}
+	switch s[len(s)-1] {
+	case 'K':
+		n *= 1024
+	case 'M':
+		n *= 1024 * 1024
+	case 'G':
+		n *= 1024 * 1024 * 1024
+	}
+	return n
+}
+
+// parseVMInfo returns the metrics of the heap of G1, ZGC and Shenandoah in VM.info, where the usage of the G1
+// regions is counted by their types, since jstat counts the humongous regions as old and the regions as the
+// classic generations
+func parseVMInfo(vmInfo string) map[string]float64 {
+	stat := make(map[string]float64)
+	switch detectCollector(vmInfo) {
+	case "g1":
+		if match := g1HeapRe.FindStringSubmatch(vmInfo); match != nil {
+			stat["heap_committed"] = parseSize(match[1])
+			stat["heap_used"] = parseSize(match[2])
+		}
+		match := g1RegionSizeRe.FindStringSubmatch(vmInfo)
+		if match == nil {
+			break
+		}
+		regionSize := parseSize(match[1])
+		regions := g1RegionRe.FindAllStringSubmatch(vmInfo, -1)
+		if len(regions) == 0 {
+			break
+		}
+		for _, metric := range g1RegionMetrics {
+			stat[metric] = 0
+		}
+		for _, region := range regions {
+			if metric, ok := g1RegionMetrics[region[1]]; ok {
+				stat[metric] += regionSize
+			}
+		}
+	case "z":
+		if match := zHeapRe.FindStringSubmatch(vmInfo); match != nil {
+			stat["heap_used"] = parseSize(match[1])
+			stat["heap_committed"] = parseSize(match[2])
+			stat["heap_max"] = parseSize(match[3])
+		}
+	case "shenandoah":
+		if match := shenandoahHeapRe.FindStringSubmatch(vmInfo); match != nil {
+			stat["heap_max"] = parseSize(match[1])
+			stat["heap_committed"] = parseSize(match[2])
+			stat["heap_used"] = parseSize(match[3])
+		}
+	}
+	return stat
+}
+
+// collectorGraphDefinition returns the graphs of the heap of jcmd and the concurrent GC of jstat on JDK 9 or later,
+// which are posted for G1, ZGC and Shenandoah
+func collectorGraphDefinition(name, labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"jvm." + name + ".heap": {
+			Label: labelPrefix + " Heap",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "heap_max", Label: "Heap max", Diff: false},
+				{Name: "heap_committed", Label: "Heap committed", Diff: false},
+				{Name: "heap_used", Label: "Heap used", Diff: false},
+			},
+		},
+		"jvm." + name + ".g1_regions": {
+			Label: labelPrefix + " G1 Regions",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "g1_eden_bytes", Label: "Eden", Diff: false, Stacked: true},
+				{Name: "g1_survivor_bytes", Label: "Survivor", Diff: false, Stacked: true},
+				{Name: "g1_old_bytes", Label: "Old", Diff: false, Stacked: true},
+				{Name: "g1_humongous_bytes", Label: "Humongous", Diff: false, Stacked: true},
+				{Name: "g1_free_bytes", Label: "Free", Diff: false, Stacked: true},
+			},
+		},
+		"jvm." + name + ".concurrent_gc_events": {
+			Label: labelPrefix + " Concurrent GC events",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "CGC", Label: "Concurrent GC event", Diff: true},
+			},
+		},
+		"jvm." + name + ".concurrent_gc_time": {
+			Label: labelPrefix + " Concurrent GC time (sec)",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "CGCT", Label: "Concurrent GC time", Diff: true},
+			},
+		},
+	}
+}
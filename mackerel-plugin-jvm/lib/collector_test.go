@@ -0,0 +1,97 @@
+package mpjvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+const g1VMInfo = `#
+# JRE version: OpenJDK Runtime Environment (17.0.2+8) (build 17.0.2+8-86)
+# Java VM: OpenJDK 64-Bit Server VM (17.0.2+8-86, mixed mode, sharing, tiered, compressed oops, compressed class ptrs, g1 gc, linux-amd64)
+
+Heap:
+ garbage-first heap   total 8192K, used 5120K [0x0000000700000000, 0x0000000800000000)
+  region size 1024K, 2 young (2048K), 1 survivors (1024K)
+ Metaspace       used 1207K, committed 1408K, reserved 1114112K
+  class space    used 105K, committed 192K, reserved 1048576K
+
+Heap Regions: E=young(eden), S=young(survivor), O=old, HS=humongous(starts), HC=humongous(continues), CS=collection set, F=free, OA=open archive, CA=closed archive, TAMS=top-at-mark-start (previous, next)
+|   0|0x0000000700000000, 0x0000000700100000, 0x0000000700100000|100%| O|  |TAMS 0x0000000700100000, 0x0000000700000000| Untracked
+|   1|0x0000000700100000, 0x0000000700200000, 0x0000000700200000|100%|HS|  |TAMS 0x0000000700200000, 0x0000000700100000| Complete
+|   2|0x0000000700200000, 0x0000000700300000, 0x0000000700300000|100%|HC|  |TAMS 0x0000000700300000, 0x0000000700200000| Complete
+|   3|0x0000000700300000, 0x0000000700300000, 0x0000000700400000|  0%| F|  |TAMS 0x0000000700300000, 0x0000000700300000| Untracked
+|   4|0x0000000700400000, 0x0000000700480000, 0x0000000700500000| 50%| E|CS|TAMS 0x0000000700400000, 0x0000000700400000| Complete
+|   5|0x0000000700500000, 0x0000000700600000, 0x0000000700600000|100%| E|CS|TAMS 0x0000000700500000, 0x0000000700500000| Complete
+|   6|0x0000000700600000, 0x0000000700700000, 0x0000000700700000|100%| S|CS|TAMS 0x0000000700600000, 0x0000000700600000| Complete
+|   7|0x0000000700700000, 0x0000000700700000, 0x0000000700800000|  0%| F|  |TAMS 0x0000000700700000, 0x0000000700700000| Untracked
+`
+
+func TestDetectCollector(t *testing.T) {
+	if c := detectCollector(g1VMInfo); c != "g1" {
+		t.Errorf("the collector should be g1, but %q", c)
+	}
+	zgc := "# Java VM: OpenJDK 64-Bit Server VM (21+35-2513, mixed mode, sharing, tiered, z gc, linux-amd64)\n"
+	if c := detectCollector(zgc); c != "z" {
+		t.Errorf("the collector should be z, but %q", c)
+	}
+	// JDK 8 does not show the collector
+	jdk8 := "# Java VM: OpenJDK 64-Bit Server VM (25.292-b10 mixed mode linux-amd64 compressed oops)\n"
+	if c := detectCollector(jdk8); c != "" {
+		t.Errorf("the collector should be unknown, but %q", c)
+	}
+}
+
+func TestParseVMInfoG1(t *testing.T) {
+	const mb = 1024 * 1024
+	expected := map[string]float64{
+		"heap_committed":     8 * mb,
+		"heap_used":          5 * mb,
+		"g1_eden_bytes":      2 * mb,
+		"g1_survivor_bytes":  1 * mb,
+		"g1_old_bytes":       1 * mb,
+		"g1_humongous_bytes": 2 * mb,
+		"g1_free_bytes":      2 * mb,
+	}
+	if stat := parseVMInfo(g1VMInfo); !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the metrics of G1 should be %v, but %v", expected, stat)
+	}
+}
+
+func TestParseVMInfoZGCAndShenandoah(t *testing.T) {
+	const mb = 1024 * 1024
+	zgc := `# Java VM: OpenJDK 64-Bit Server VM (17.0.2+8-86, mixed mode, sharing, tiered, z gc, linux-amd64)
+
+Heap:
+ ZHeap           used 30M, capacity 256M, max capacity 4096M
+ Metaspace       used 1207K, committed 1408K, reserved 1114112K
+`
+	expected := map[string]float64{
+		"heap_used":      30 * mb,
+		"heap_committed": 256 * mb,
+		"heap_max":       4096 * mb,
+	}
+	if stat := parseVMInfo(zgc); !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the metrics of ZGC should be %v, but %v", expected, stat)
+	}
+
+	shenandoah := `# Java VM: OpenJDK 64-Bit Server VM (17.0.2+8, mixed mode, sharing, tiered, compressed oops, compressed class ptrs, shenandoah gc, linux-amd64)
+
+Heap:
+Shenandoah Heap
+ 4096M max, 4096M soft max, 256M committed, 31744K used
+`
+	expected = map[string]float64{
+		"heap_max":       4096 * mb,
+		"heap_committed": 256 * mb,
+		"heap_used":      31744 * 1024,
+	}
+	if stat := parseVMInfo(shenandoah); !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the metrics of Shenandoah should be %v, but %v", expected, stat)
+	}
+
+	// the classic collectors have no metrics of jcmd
+	parallel := "# Java VM: OpenJDK 64-Bit Server VM (17.0.2+8, mixed mode, parallel gc, linux-amd64)\n"
+	if stat := parseVMInfo(parallel); len(stat) != 0 {
+		t.Errorf("the metrics of Parallel GC should be empty, but %v", stat)
+	}
+}
@@ -0,0 +1,98 @@
+package mpjvm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Instance is a JVM monitored as jvm.<Name>.*, which is found by JavaName with jps, or by the pid in PidFile
+type Instance struct {
+	Name     string
+	JavaName string
+	PidFile  string
+}
+
+var instanceNameRe = regexp.MustCompile("^[-a-zA-Z0-9_]+$")
+
+// InstancesFlag is the flag.Value of -instance, which is repeated as name=javaname or name=/path/to/pidfile
+type InstancesFlag []Instance
+
+func (f *InstancesFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	instances := make([]string, len(*f))
+	for i, inst := range *f {
+		instances[i] = inst.Name + "=" + inst.JavaName + inst.PidFile
+	}
+	return strings.Join(instances, ",")
+}
+
+// Set parses name=javaname, or name=pidfile if it contains a slash
+func (f *InstancesFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return fmt.Errorf("the instance should be name=javaname or name=pidfile: %q", s)
+	}
+	if !instanceNameRe.MatchString(kv[0]) {
+		return fmt.Errorf("the name of the instance should consist of alphanumerics, - and _: %q", kv[0])
+	}
+	for _, inst := range *f {
+		if inst.Name == kv[0] {
+			return fmt.Errorf("the name of the instance is duplicated: %q", kv[0])
+		}
+	}
+	inst := Instance{Name: kv[0]}
+	if strings.Contains(kv[1], "/") {
+		inst.PidFile = kv[1]
+	} else {
+		inst.JavaName = kv[1]
+	}
+	*f = append(*f, inst)
+	return nil
+}
+
+// lvmid returns the lvmid of the instance, which is looked up at every run since the JVM may be restarted
+func (m JVMPlugin) lvmid(inst Instance) (string, error) {
+	if inst.PidFile != "" {
+		return readPidfile(inst.PidFile)
+	}
+	return fetchLvmidByAppname(inst.JavaName, generateVmid(m.Remote, ""), m.JpsPath)
+}
+
+// fetchInstancesMetrics fetches the metrics of each instance, and namespaces them by the name of the instance and
+// the graph, since a metric such as YGCT is in several graphs. The instances which fail are skipped.
+func (m JVMPlugin) fetchInstancesMetrics() (map[string]interface{}, error) {
+	graphdef := graphDefinition("#", "JVM")
+	stat := make(map[string]interface{})
+	var lastErr error
+	fetched := 0
+	for _, inst := range m.Instances {
+		n := m
+		n.Instances = nil
+		lvmid, err := m.lvmid(inst)
+		if err == nil {
+			n.Lvmid = lvmid
+			var instStat map[string]float64
+			if instStat, err = n.fetchMetrics(); err == nil {
+				for key, graph := range graphdef {
+					prefix := "jvm." + inst.Name + "." + strings.TrimPrefix(key, "jvm.#.") + "."
+					for _, metric := range graph.Metrics {
+						if v, ok := instStat[metric.Name]; ok {
+							stat[prefix+metric.Name] = v
+						}
+					}
+				}
+				fetched++
+				continue
+			}
+		}
+		logger.Warningf("Failed to fetch the instance %s. Skip the instance. %s", inst.Name, err)
+		lastErr = err
+	}
+	if fetched == 0 {
+		return nil, lastErr
+	}
+	return stat, nil
+}
@@ -0,0 +1,55 @@
+package mpjvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInstancesFlag(t *testing.T) {
+	var instances InstancesFlag
+	for _, s := range []string{"broker1=Kafka", "worker=/var/run/worker.pid"} {
+		if err := instances.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := InstancesFlag{
+		{Name: "broker1", JavaName: "Kafka"},
+		{Name: "worker", PidFile: "/var/run/worker.pid"},
+	}
+	if !reflect.DeepEqual(instances, expected) {
+		t.Errorf("instances should be %v, but %v", expected, instances)
+	}
+
+	for _, s := range []string{"broker1=Kafka", "Kafka", "broker.2=Kafka", "broker2="} {
+		if err := instances.Set(s); err == nil {
+			t.Errorf("%q should be an error", s)
+		}
+	}
+}
+
+func TestGraphDefinitionInstances(t *testing.T) {
+	jvm := JVMPlugin{JavaName: "NettyServer"}
+	graphs := jvm.GraphDefinition()
+	if g, ok := graphs["jvm.nettyserver.gc_events"]; !ok || g.Label != "JVM NettyServer GC events" {
+		t.Errorf("the graph of the single instance should be kept: %v", g)
+	}
+
+	jvm = JVMPlugin{Instances: []Instance{{Name: "broker1", JavaName: "Kafka"}}}
+	graphs = jvm.GraphDefinition()
+	if g, ok := graphs["jvm.#.gc_events"]; !ok || g.Label != "JVM GC events" {
+		t.Errorf("the graphs of the instances should be wildcard: %v", graphs)
+	}
+	if len(graphs) != 12 {
+		t.Errorf("the graphs should be 12, but %d", len(graphs))
+	}
+}
+
+func TestFetchInstancesMetricsFailure(t *testing.T) {
+	jvm := JVMPlugin{Instances: []Instance{
+		{Name: "a", PidFile: "/nonexistent/a.pid"},
+		{Name: "b", PidFile: "/nonexistent/b.pid"},
+	}}
+	if _, err := jvm.FetchMetrics(); err == nil {
+		t.Errorf("the error should be returned when no instance is fetched")
+	}
+}
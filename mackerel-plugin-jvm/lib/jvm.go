@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +26,10 @@ type JVMPlugin struct {
 	JinfoPath string
 	JavaName  string
 	Tempfile  string
+	JpsPath   string
+	JcmdPath  string
+	// Instances are the JVMs monitored at once with -instance, whose metrics are posted as jvm.<name>.*
+	Instances []Instance
 }
 
 // # jps
@@ -50,17 +55,62 @@ func fetchLvmidByAppname(appname, target, jpsPath string) (string, error) {
 		return "", err
 	}
 
-	for _, line := range strings.Split(string(stdout), "\n") {
+	lvmids := parseJps(stdout, appname)
+	switch len(lvmids) {
+	case 0:
+		return "", fmt.Errorf("cannot get lvmid from %s (please run with the java process user)", appname)
+	case 1:
+		return lvmids[0], nil
+	default:
+		return "", fmt.Errorf("multiple JVMs named %s are found: %s (please give one of them by '-pid')", appname, strings.Join(lvmids, ", "))
+	}
+}
+
+// parseJps returns the lvmids of the JVMs named appname in the output of jps
+func parseJps(stdout, appname string) []string {
+	var lvmids []string
+	for _, line := range strings.Split(stdout, "\n") {
 		words := strings.Split(line, " ")
 		if len(words) != 2 {
 			continue
 		}
 		lvmid, name := words[0], words[1]
 		if name == appname {
-			return lvmid, nil
+			lvmids = append(lvmids, lvmid)
+		}
+	}
+	return lvmids
+}
+
+// readPidfile returns the pid written in the pidfile
+func readPidfile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pid := strings.TrimSpace(string(b))
+	if _, err := strconv.Atoi(pid); err != nil {
+		return "", fmt.Errorf("invalid pid in %s: %q", path, pid)
+	}
+	return pid, nil
+}
+
+// toolPath returns the path of the JDK tool: the path given explicitly, the one in javaHome/bin, or the default path
+// if it exists, or else the one found in PATH
+func toolPath(name, path, javaHome string) string {
+	if path != "" {
+		return path
+	}
+	if javaHome != "" {
+		return filepath.Join(javaHome, "bin", name)
+	}
+	defaultPath := filepath.Join("/usr/bin", name)
+	if _, err := os.Stat(defaultPath); err != nil {
+		if p, err := exec.LookPath(name); err == nil {
+			return p
 		}
 	}
-	return "", fmt.Errorf("cannot get lvmid from %s (please run with the java process user)", appname)
+	return defaultPath
 }
 
 func (m JVMPlugin) fetchJstatMetrics(option string) (map[string]float64, error) {
@@ -81,6 +131,10 @@ func (m JVMPlugin) fetchJstatMetrics(option string) (map[string]float64, error)
 
 	stat := make(map[string]float64)
 	for i, key := range keys {
+		if i >= len(values) || values[i] == "-" {
+			// the columns which do not apply to the collector, e.g. the survivors of ZGC
+			continue
+		}
 		value, err := strconv.ParseFloat(values[i], 64)
 		if err != nil {
 			logger.Warningf("Failed to parse value. %s", err)
@@ -93,34 +147,46 @@ func (m JVMPlugin) fetchJstatMetrics(option string) (map[string]float64, error)
 
 func (m JVMPlugin) calculateMemorySpaceRate(gcStat map[string]float64) (map[string]float64, error) {
 	ret := make(map[string]float64)
-	ret["oldSpaceRate"] = gcStat["OU"] / gcStat["OC"] * 100
-	ret["newSpaceRate"] = (gcStat["S0U"] + gcStat["S1U"] + gcStat["EU"]) / (gcStat["S0C"] + gcStat["S1C"] + gcStat["EC"]) * 100
-	if m.checkCMSGC() {
-		ret["CMSInitiatingOccupancyFraction"] = fetchCMSInitiatingOccupancyFraction(m.Lvmid, m.JinfoPath)
+	// the generations may have no capacity, e.g. the young generation of ZGC
+	if gcStat["OC"] > 0 {
+		ret["oldSpaceRate"] = gcStat["OU"] / gcStat["OC"] * 100
+	}
+	if newCapacity := gcStat["S0C"] + gcStat["S1C"] + gcStat["EC"]; newCapacity > 0 {
+		ret["newSpaceRate"] = (gcStat["S0U"] + gcStat["S1U"] + gcStat["EU"]) / newCapacity * 100
+	}
+	cms, err := m.checkCMSGC()
+	if err != nil {
+		return nil, err
+	}
+	if cms {
+		fraction, err := fetchCMSInitiatingOccupancyFraction(m.Lvmid, m.JinfoPath)
+		if err != nil {
+			return nil, err
+		}
+		ret["CMSInitiatingOccupancyFraction"] = fraction
 	}
 
 	return ret, nil
 }
 
-func (m JVMPlugin) checkCMSGC() bool {
+func (m JVMPlugin) checkCMSGC() (bool, error) {
 	// jinfo does not work on remote
 	if m.Remote != "" {
-		return false
+		return false, nil
 	}
 	stdout, _, exitStatus, err := runTimeoutCommand(m.JinfoPath, "-flag", "UseConcMarkSweepGC", m.Lvmid)
 
 	if err == nil && exitStatus.IsTimedOut() {
 		err = fmt.Errorf("jinfo command timed out")
-		os.Exit(1)
 	}
 	if err != nil {
 		logger.Errorf("Failed to run exec jinfo. %s. Please run with the java process user.", err)
-		os.Exit(1)
+		return false, err
 	}
-	return strings.Index(string(stdout), "+UseConcMarkSweepGC") != -1
+	return strings.Index(string(stdout), "+UseConcMarkSweepGC") != -1, nil
 }
 
-func fetchCMSInitiatingOccupancyFraction(lvmid, JinfoPath string) float64 {
+func fetchCMSInitiatingOccupancyFraction(lvmid, JinfoPath string) (float64, error) {
 	var fraction float64
 
 	stdout, _, exitStatus, err := runTimeoutCommand(JinfoPath, "-flag", "CMSInitiatingOccupancyFraction", lvmid)
@@ -130,14 +196,17 @@ func fetchCMSInitiatingOccupancyFraction(lvmid, JinfoPath string) float64 {
 	}
 	if err != nil {
 		logger.Errorf("Failed to run exec jinfo. %s. Please run with the java process user.", err)
-		os.Exit(1)
+		return 0, err
 	}
 
 	out := strings.Trim(string(stdout), "\n")
 	tmp := strings.Split(out, "=")
+	if len(tmp) < 2 {
+		return 0, fmt.Errorf("unexpected output of jinfo: %q", out)
+	}
 	fraction, _ = strconv.ParseFloat(tmp[1], 64)
 
-	return fraction
+	return fraction, nil
 }
 
 func mergeStat(dst, src map[string]float64) {
@@ -186,6 +255,22 @@ func runTimeoutCommand(Path string, Args ...string) (string, string, timeout.Exi
 
 // FetchMetrics interface for mackerelplugin
 func (m JVMPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if len(m.Instances) > 0 {
+		return m.fetchInstancesMetrics()
+	}
+	stat, err := m.fetchMetrics()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	for k, v := range stat {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (m JVMPlugin) fetchMetrics() (map[string]float64, error) {
 	gcStat, err := m.fetchJstatMetrics("-gc")
 	if err != nil {
 		return nil, err
@@ -214,36 +299,47 @@ func (m JVMPlugin) FetchMetrics() (map[string]interface{}, error) {
 	mergeStat(stat, gcOldStat)
 	mergeStat(stat, gcSpaceRate)
 
-	result := make(map[string]interface{})
-	for k, v := range stat {
-		result[k] = v
+	// jcmd does not work on remote as well as jinfo, and the heap of the collector is optional
+	if m.Remote == "" && m.JcmdPath != "" {
+		vmInfo, err := m.fetchVMInfo()
+		if err != nil {
+			logger.Warningf("Failed to run exec jcmd. Skip the heap metrics of the collector. %s", err)
+		} else {
+			mergeStat(stat, parseVMInfo(vmInfo))
+		}
 	}
-	return result, nil
+	return stat, nil
 }
 
 // GraphDefinition interface for mackerelplugin
 func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
-	rawJavaName := m.JavaName
-	lowerJavaName := strings.ToLower(m.JavaName)
-	return map[string]mp.Graphs{
-		fmt.Sprintf("jvm.%s.gc_events", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s GC events", rawJavaName),
+	if len(m.Instances) > 0 {
+		return graphDefinition("#", "JVM")
+	}
+	return graphDefinition(strings.ToLower(m.JavaName), "JVM "+m.JavaName)
+}
+
+// graphDefinition returns the graphs of jvm.<name>.*, whose labels start with labelPrefix
+func graphDefinition(name, labelPrefix string) map[string]mp.Graphs {
+	graphdef := map[string]mp.Graphs{
+		"jvm." + name + ".gc_events": {
+			Label: labelPrefix + " GC events",
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
 				{Name: "YGC", Label: "Young GC event", Diff: true},
 				{Name: "FGC", Label: "Full GC event", Diff: true},
 			},
 		},
-		fmt.Sprintf("jvm.%s.gc_time", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s GC time (sec)", rawJavaName),
+		"jvm." + name + ".gc_time": {
+			Label: labelPrefix + " GC time (sec)",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "YGCT", Label: "Young GC time", Diff: true},
 				{Name: "FGCT", Label: "Full GC time", Diff: true},
 			},
 		},
-		fmt.Sprintf("jvm.%s.gc_time_percentage", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s GC time percentage", rawJavaName),
+		"jvm." + name + ".gc_time_percentage": {
+			Label: labelPrefix + " GC time percentage",
 			Unit:  "percentage",
 			Metrics: []mp.Metrics{
 				// gc_time_percentage is the percentage of gc time to 60 sec.
@@ -251,8 +347,8 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "FGCT", Label: "Full GC time", Diff: true, Scale: (100.0 / 60)},
 			},
 		},
-		fmt.Sprintf("jvm.%s.new_space", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s New Space memory", rawJavaName),
+		"jvm." + name + ".new_space": {
+			Label: labelPrefix + " New Space memory",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "NGCMX", Label: "New max", Diff: false, Scale: 1024},
@@ -262,8 +358,8 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "S1U", Label: "Survivor1 used", Diff: false, Scale: 1024},
 			},
 		},
-		fmt.Sprintf("jvm.%s.old_space", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s Old Space memory", rawJavaName),
+		"jvm." + name + ".old_space": {
+			Label: labelPrefix + " Old Space memory",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "OGCMX", Label: "Old max", Diff: false, Scale: 1024},
@@ -271,8 +367,8 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "OU", Label: "Old used", Diff: false, Scale: 1024},
 			},
 		},
-		fmt.Sprintf("jvm.%s.perm_space", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s Permanent Space", rawJavaName),
+		"jvm." + name + ".perm_space": {
+			Label: labelPrefix + " Permanent Space",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "PGCMX", Label: "Perm max", Diff: false, Scale: 1024},
@@ -280,8 +376,8 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "PU", Label: "Perm used", Diff: false, Scale: 1024},
 			},
 		},
-		fmt.Sprintf("jvm.%s.metaspace", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s Metaspace", rawJavaName),
+		"jvm." + name + ".metaspace": {
+			Label: labelPrefix + " Metaspace",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "MCMX", Label: "Metaspace capacity max", Diff: false, Scale: 1024},
@@ -292,8 +388,8 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "CCSU", Label: "Compressed Class Space Used", Diff: false, Scale: 1024},
 			},
 		},
-		fmt.Sprintf("jvm.%s.memorySpace", lowerJavaName): {
-			Label: fmt.Sprintf("JVM %s MemorySpace", rawJavaName),
+		"jvm." + name + ".memorySpace": {
+			Label: labelPrefix + " MemorySpace",
 			Unit:  "float",
 			Metrics: []mp.Metrics{
 				{Name: "oldSpaceRate", Label: "GC Old Memory Space", Diff: false},
@@ -302,6 +398,10 @@ func (m JVMPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+	for k, v := range collectorGraphDefinition(name, labelPrefix) {
+		graphdef[k] = v
+	}
+	return graphdef
 }
 
 func generateVmid(remote, lvmid string) string {
@@ -340,45 +440,87 @@ func Do() {
 	optHost := flag.String("host", "", "jps/jstat target hostname [deprecated]")
 	optPort := flag.Int("port", 0, "jps/jstat target port [deprecated]")
 	optRemote := flag.String("remote", "", "jps/jstat remote target. hostname[:port][/servername]")
-	optJstatPath := flag.String("jstatpath", "/usr/bin/jstat", "jstat path")
-	optJinfoPath := flag.String("jinfopath", "/usr/bin/jinfo", "jinfo path")
-	optJpsPath := flag.String("jpspath", "/usr/bin/jps", "jps path")
+	optJstatPath := flag.String("jstatpath", "", "jstat path (default: /usr/bin/jstat, or the one in PATH)")
+	flag.StringVar(optJstatPath, "jstat-path", "", "Alias of -jstatpath")
+	optJinfoPath := flag.String("jinfopath", "", "jinfo path (default: /usr/bin/jinfo, or the one in PATH)")
+	optJpsPath := flag.String("jpspath", "", "jps path (default: /usr/bin/jps, or the one in PATH)")
+	optJcmdPath := flag.String("jcmdpath", "", "jcmd path for the heap of G1, ZGC and Shenandoah (default: /usr/bin/jcmd, or the one in PATH)")
+	optDisableJcmd := flag.Bool("disable-jcmd", false, "Disable the heap metrics of the collector by jcmd")
+	optJavaHome := flag.String("java-home", "", "JDK directory whose bin contains jstat, jinfo and jps")
 	optJavaName := flag.String("javaname", "", "Java app name")
+	optPid := flag.String("pid", "", "pid of the JVM, which is monitored without jps")
 	optPidFile := flag.String("pidfile", "", "pidfile path")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	var optInstances InstancesFlag
+	flag.Var(&optInstances, "instance", "name=javaname or name=/path/to/pidfile of the JVM, which is repeated to monitor several JVMs")
 	flag.Parse()
 
 	var jvm JVMPlugin
-	jvm.JstatPath = *optJstatPath
-	jvm.JinfoPath = *optJinfoPath
+	jvm.JstatPath = toolPath("jstat", *optJstatPath, *optJavaHome)
+	jvm.JinfoPath = toolPath("jinfo", *optJinfoPath, *optJavaHome)
+	jvm.JpsPath = toolPath("jps", *optJpsPath, *optJavaHome)
+	if !*optDisableJcmd {
+		jvm.JcmdPath = toolPath("jcmd", *optJcmdPath, *optJavaHome)
+	}
 	jvm.Remote = generateRemote(*optRemote, *optHost, *optPort)
 
+	if len(optInstances) > 0 {
+		if *optJavaName != "" || *optPid != "" || *optPidFile != "" {
+			logger.Errorf("'-instance' cannot be used with '-javaname', '-pid' or '-pidfile'")
+			os.Exit(1)
+		}
+		for _, inst := range optInstances {
+			if inst.PidFile != "" && jvm.Remote != "" {
+				logger.Errorf("the pidfile of the instance %s does not work with '-remote'", inst.Name)
+				os.Exit(1)
+			}
+		}
+		jvm.Instances = optInstances
+
+		helper := mp.NewMackerelPlugin(jvm)
+		helper.Tempfile = *optTempfile
+		helper.Run()
+		return
+	}
+
 	if *optJavaName == "" {
-		logger.Errorf("javaname is required (if you use 'pidfile' option, 'javaname' is used as just a prefix of graph label)")
+		logger.Errorf("javaname or instance is required (if you use 'pid' or 'pidfile' option, 'javaname' is used as just a prefix of graph label)")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	if *optPidFile != "" && jvm.Remote != "" {
-		logger.Warningf("both '-pidfile' and '-remote' specified, but '-pidfile' does not work with '-remote' therefore ignored")
+	if *optPid != "" && *optPidFile != "" {
+		logger.Errorf("'-pid' and '-pidfile' cannot be specified at once")
+		os.Exit(1)
+	}
+	local := *optPid != "" || *optPidFile != ""
+	if local && jvm.Remote != "" {
+		logger.Warningf("both '-pid' or '-pidfile' and '-remote' specified, but they do not work with '-remote' therefore ignored")
 	}
 
-	if *optPidFile == "" || jvm.Remote != "" {
-		lvmid, err := fetchLvmidByAppname(*optJavaName, generateVmid(jvm.Remote, ""), *optJpsPath)
+	switch {
+	case !local || jvm.Remote != "":
+		lvmid, err := fetchLvmidByAppname(*optJavaName, generateVmid(jvm.Remote, ""), jvm.JpsPath)
 		if err != nil {
 			logger.Errorf("Failed to fetch lvmid. %s. Please run with the java process user when monitoring local JVM, or set proper 'remote' option when monitorint remote one.", err)
 			os.Exit(1)
 		}
 		jvm.Lvmid = lvmid
-	} else {
+	case *optPid != "":
+		if _, err := strconv.Atoi(*optPid); err != nil {
+			logger.Errorf("Invalid pid %q", *optPid)
+			os.Exit(1)
+		}
+		jvm.Lvmid = *optPid
+	default:
 		// https://docs.oracle.com/javase/7/docs/technotes/tools/share/jps.html
 		// `The lvmid is typically, but not necessarily, the operating system's process identifier for the JVM process.`
-		pid, err := ioutil.ReadFile(*optPidFile)
+		pid, err := readPidfile(*optPidFile)
 		if err != nil {
 			logger.Errorf("Failed to load pid. %s", err)
 			os.Exit(1)
 		}
-		jvm.Lvmid = strings.Replace(string(pid), "\n", "", 1)
+		jvm.Lvmid = pid
 	}
 
 	jvm.JavaName = *optJavaName
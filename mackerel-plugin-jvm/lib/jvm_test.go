@@ -1,6 +1,10 @@
 package mpjvm
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -66,3 +70,49 @@ func TestGenerateRemote(t *testing.T) {
 		t.Errorf("remote should be %s, but %s", expected, r)
 	}
 }
+
+func TestParseJps(t *testing.T) {
+	stdout := "26547 NettyServer\n6438 Jps\n26600 NettyServer\n100 Main\n"
+
+	if lvmids := parseJps(stdout, "Main"); !reflect.DeepEqual(lvmids, []string{"100"}) {
+		t.Errorf("lvmids should be [100], but %v", lvmids)
+	}
+	// the error of fetchLvmidByAppname lists all of them
+	if lvmids := parseJps(stdout, "NettyServer"); !reflect.DeepEqual(lvmids, []string{"26547", "26600"}) {
+		t.Errorf("lvmids should be [26547 26600], but %v", lvmids)
+	}
+	if lvmids := parseJps(stdout, "Unknown"); len(lvmids) != 0 {
+		t.Errorf("lvmids should be empty, but %v", lvmids)
+	}
+}
+
+func TestReadPidfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-jvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.pid")
+	if err := ioutil.WriteFile(path, []byte(" 12345\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := readPidfile(path); err != nil || pid != "12345" {
+		t.Errorf("pid should be 12345, but %q (%v)", pid, err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPidfile(path); err == nil {
+		t.Errorf("the empty pidfile should be an error")
+	}
+}
+
+func TestToolPath(t *testing.T) {
+	if p := toolPath("jstat", "/opt/bin/jstat", "/usr/lib/jvm/java-17"); p != "/opt/bin/jstat" {
+		t.Errorf("the explicit path should precede java-home, but %s", p)
+	}
+	if p := toolPath("jstat", "", "/usr/lib/jvm/java-17"); p != "/usr/lib/jvm/java-17/bin/jstat" {
+		t.Errorf("the path should be in java-home, but %s", p)
+	}
+}
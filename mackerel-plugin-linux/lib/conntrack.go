@@ -0,0 +1,113 @@
+package mplinux
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// conntrackPaths are the count, the max and the per-CPU statistics of the connection tracking relative to /proc,
+// where ip_conntrack is of the kernels before nf_conntrack
+var conntrackPaths = [][3]string{
+	{"sys/net/netfilter/nf_conntrack_count", "sys/net/netfilter/nf_conntrack_max", "net/stat/nf_conntrack"},
+	{"sys/net/ipv4/netfilter/ip_conntrack_count", "sys/net/ipv4/netfilter/ip_conntrack_max", "net/stat/ip_conntrack"},
+}
+
+// collect the connection tracking table of netfilter, which is skipped silently when the conntrack module is not loaded
+func collectConntrack(dir string, p *map[string]interface{}) error {
+	for _, paths := range conntrackPaths {
+		count, err := readProcValue(filepath.Join(dir, paths[0]))
+		if err != nil {
+			continue
+		}
+		max, err := readProcValue(filepath.Join(dir, paths[1]))
+		if err != nil {
+			continue
+		}
+
+		graphdef["linux.conntrack.entries"] = mp.Graphs{
+			Label: "Linux Conntrack Entries",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "conntrack_count", Label: "Count", Diff: false},
+				{Name: "conntrack_max", Label: "Max", Diff: false},
+			},
+		}
+		graphdef["linux.conntrack.usage"] = mp.Graphs{
+			Label: "Linux Conntrack Usage",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "conntrack_usage_percent", Label: "Usage", Diff: false},
+			},
+		}
+		(*p)["conntrack_count"] = count
+		(*p)["conntrack_max"] = max
+		if max > 0 {
+			(*p)["conntrack_usage_percent"] = count / max * 100
+		}
+
+		file, err := os.Open(filepath.Join(dir, paths[2]))
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		graphdef["linux.conntrack.failures"] = mp.Graphs{
+			Label: "Linux Conntrack Failures",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "conntrack_insert_failed", Label: "Insert Failed", Diff: true},
+				{Name: "conntrack_drop", Label: "Drop", Diff: true},
+			},
+		}
+		return parseConntrackStat(file, p)
+	}
+	return nil
+}
+
+func readProcValue(path string) (float64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return atof(strings.TrimSpace(string(b)))
+}
+
+// parsing the per-CPU statistics of the connection tracking, whose values are hexadecimal
+// entries  searched found new invalid ignore delete delete_list insert insert_failed drop early_drop ...
+// 000000aa  00000000 00000000 00000000 0000001f 00000436 00000000 00000000 00000000 00000002 00000001 00000000 ...
+func parseConntrackStat(r io.Reader, p *map[string]interface{}) error {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	columns := map[string]int{}
+	for i, name := range strings.Fields(scanner.Text()) {
+		columns[name] = i
+	}
+
+	sums := map[string]float64{}
+	for scanner.Scan() {
+		record := strings.Fields(scanner.Text())
+		for _, name := range []string{"insert_failed", "drop"} {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				continue
+			}
+			v, err := strconv.ParseUint(record[i], 16, 64)
+			if err != nil {
+				return err
+			}
+			sums[name] += float64(v)
+		}
+	}
+	for name, v := range sums {
+		(*p)["conntrack_"+name] = v
+	}
+	return scanner.Err()
+}
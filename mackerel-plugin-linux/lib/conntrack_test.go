@@ -0,0 +1,64 @@
+package mplinux
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeProcFiles writes the files into a temporary directory, which the caller should remove
+func writeProcFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCollectConntrack(t *testing.T) {
+	dir := writeProcFiles(t, map[string]string{
+		"sys/net/netfilter/nf_conntrack_count": "1024\n",
+		"sys/net/netfilter/nf_conntrack_max":   "4096\n",
+		"net/stat/nf_conntrack": `entries  searched found new invalid ignore delete delete_list insert insert_failed drop early_drop icmp_error  expect_new expect_create expect_delete search_restart
+00000400  00000000 00000000 00000000 0000001f 00000436 00000000 00000000 00000000 00000002 0000000a 00000000 00000000  00000000 00000000 00000000 00000000
+00000400  00000000 00000000 00000000 00000003 00000110 00000000 00000000 00000000 00000001 00000010 00000000 00000000  00000000 00000000 00000000 00000000
+`,
+	})
+	defer os.RemoveAll(dir)
+	p := make(map[string]interface{})
+	assert.Nil(t, collectConntrack(dir, &p))
+	assert.EqualValues(t, 1024, p["conntrack_count"])
+	assert.EqualValues(t, 4096, p["conntrack_max"])
+	assert.EqualValues(t, 25, p["conntrack_usage_percent"])
+	assert.EqualValues(t, 3, p["conntrack_insert_failed"])
+	assert.EqualValues(t, 26, p["conntrack_drop"])
+}
+
+func TestCollectConntrackFallback(t *testing.T) {
+	dir := writeProcFiles(t, map[string]string{
+		"sys/net/ipv4/netfilter/ip_conntrack_count": "10\n",
+		"sys/net/ipv4/netfilter/ip_conntrack_max":   "100\n",
+	})
+	defer os.RemoveAll(dir)
+	p := make(map[string]interface{})
+	assert.Nil(t, collectConntrack(dir, &p))
+	assert.EqualValues(t, 10, p["conntrack_usage_percent"])
+	assert.NotContains(t, p, "conntrack_drop")
+
+	// the conntrack module is not loaded
+	p = make(map[string]interface{})
+	assert.Nil(t, collectConntrack(filepath.Join(dir, "not-loaded"), &p))
+	assert.Len(t, p, 0)
+}
@@ -0,0 +1,151 @@
+package mplinux
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// defaultExcludeDevice excludes the loop, ram and device-mapper devices, and the partitions of the disks
+const defaultExcludeDevice = `^(loop|ram|dm-|sr)[0-9]+$|^([shv]d[a-z]+|xvd[a-z]+)[0-9]+$|^(nvme[0-9]+n[0-9]+|mmcblk[0-9]+)p[0-9]+$`
+
+// sectorSize is the size of the sectors of /proc/diskstats, which is always 512 bytes regardless of the device
+const sectorSize = 512
+
+// diskRawPrefix is the prefix of the counters of the devices, which are saved in the tempfile without being posted
+const diskRawPrefix = "linux.disk_raw."
+
+var deviceNameRe = regexp.MustCompile("[^-a-zA-Z0-9_]")
+
+// diskCounters are the fields of /proc/diskstats used for the per-device metrics
+var diskCounters = map[string]int{
+	"reads":         3,
+	"sectors_read":  5,
+	"read_ticks":    6,
+	"writes":        7,
+	"sectors_write": 9,
+	"write_ticks":   10,
+	"io_ticks":      12,
+}
+
+// collect the per-device metrics of /proc/diskstats
+func (c LinuxPlugin) collectDiskDevices(path string, p *map[string]interface{}) error {
+	graphdef["linux.disk.#.iops"] = mp.Graphs{
+		Label: "Disk IOPS",
+		Unit:  "iops",
+		Metrics: []mp.Metrics{
+			{Name: "reads", Label: "Read", Diff: false},
+			{Name: "writes", Label: "Write", Diff: false},
+		},
+	}
+	graphdef["linux.disk.#.bytes"] = mp.Graphs{
+		Label: "Disk Throughput",
+		Unit:  "bytes/sec",
+		Metrics: []mp.Metrics{
+			{Name: "read_bytes", Label: "Read", Diff: false},
+			{Name: "write_bytes", Label: "Write", Diff: false},
+		},
+	}
+	graphdef["linux.disk.#.await"] = mp.Graphs{
+		Label: "Disk Average Latency (ms)",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "await_ms", Label: "Await", Diff: false},
+		},
+	}
+	graphdef["linux.disk.#.util"] = mp.Graphs{
+		Label: "Disk Utilization",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "util_percent", Label: "Utilization", Diff: false},
+		},
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	counters, err := parseDiskDevices(file, c.ExcludeDevice)
+	if err != nil {
+		return err
+	}
+	setDiskDeviceStats(*p, counters, c.lastStat, time.Since(c.lastTime))
+	return nil
+}
+
+// parseDiskDevices returns the counters of the devices in /proc/diskstats which are not excluded
+func parseDiskDevices(r io.Reader, exclude *regexp.Regexp) (map[string]map[string]float64, error) {
+	devices := make(map[string]map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		record := strings.Fields(scanner.Text())
+		if len(record) < 14 {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(record[2]) {
+			continue
+		}
+		counters := make(map[string]float64)
+		for name, i := range diskCounters {
+			v, err := atof(record[i])
+			if err != nil {
+				return nil, err
+			}
+			counters[name] = v
+		}
+		devices[deviceNameRe.ReplaceAllString(record[2], "_")] = counters
+	}
+	return devices, scanner.Err()
+}
+
+// setDiskDeviceStats sets the counters of the devices to be saved, and the rates since the last run like iostat.
+// The rates of a device are posted from the second run after it appears, and are skipped when the counters are
+// reset, so that a hotplugged device has no spike.
+func setDiskDeviceStats(stat map[string]interface{}, devices map[string]map[string]float64, lastStat map[string]interface{}, interval time.Duration) {
+	for device, counters := range devices {
+		raw := diskRawPrefix + device + "."
+		for name, v := range counters {
+			stat[raw+name] = v
+		}
+
+		sec := interval.Seconds()
+		if sec <= 0 {
+			continue
+		}
+		delta := make(map[string]float64, len(counters))
+		ok := true
+		for name, v := range counters {
+			last, found := lastStat[raw+name].(float64)
+			if !found || v < last {
+				ok = false
+				break
+			}
+			delta[name] = v - last
+		}
+		if !ok {
+			continue
+		}
+
+		prefix := "linux.disk." + device + "."
+		stat[prefix+"iops.reads"] = delta["reads"] / sec
+		stat[prefix+"iops.writes"] = delta["writes"] / sec
+		stat[prefix+"bytes.read_bytes"] = delta["sectors_read"] * sectorSize / sec
+		stat[prefix+"bytes.write_bytes"] = delta["sectors_write"] * sectorSize / sec
+		await := 0.0
+		if ops := delta["reads"] + delta["writes"]; ops > 0 {
+			await = (delta["read_ticks"] + delta["write_ticks"]) / ops
+		}
+		stat[prefix+"await.await_ms"] = await
+		util := delta["io_ticks"] / (sec * 1000) * 100
+		if util > 100 {
+			util = 100
+		}
+		stat[prefix+"util.util_percent"] = util
+	}
+}
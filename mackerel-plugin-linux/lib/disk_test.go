@@ -0,0 +1,98 @@
+package mplinux
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDiskDevices(t *testing.T) {
+	stub := `   1       0 ram0 0 0 0 0 0 0 0 0 0 0 0
+   7       0 loop0 10 0 20 0 0 0 0 0 0 0 0
+   8       0 sda 324351 303093 35032074 12441261 4456146 5387174 68639686 423711425 0 23865772 436201338
+   8       1 sda1 678 405 10970 4696 276 22946 46462 1217036 0 53528 1221732
+ 259       0 nvme0n1 100 0 800 50 200 0 1600 150 0 120 200
+ 259       1 nvme0n1p1 10 0 80 5 20 0 160 15 0 12 20
+ 253       2 dm-2 83 0 664 94 0 0 0 0 0 94 94`
+
+	devices, err := parseDiskDevices(bytes.NewBufferString(stub), regexp.MustCompile(defaultExcludeDevice))
+	assert.Nil(t, err)
+	assert.Len(t, devices, 2)
+	assert.EqualValues(t, 324351, devices["sda"]["reads"])
+	assert.EqualValues(t, 35032074, devices["sda"]["sectors_read"])
+	assert.EqualValues(t, 4456146, devices["sda"]["writes"])
+	assert.EqualValues(t, 23865772, devices["sda"]["io_ticks"])
+	assert.Contains(t, devices, "nvme0n1")
+}
+
+func TestSetDiskDeviceStats(t *testing.T) {
+	last := map[string]interface{}{}
+	first := map[string]map[string]float64{
+		"sda": {"reads": 1000, "sectors_read": 8000, "read_ticks": 500, "writes": 2000, "sectors_write": 16000, "write_ticks": 1500, "io_ticks": 10000},
+	}
+	setDiskDeviceStats(last, first, nil, time.Minute)
+	// the rates are not posted at the first run
+	assert.NotContains(t, last, "linux.disk.sda.iops.reads")
+	assert.EqualValues(t, 1000, last["linux.disk_raw.sda.reads"])
+
+	stat := map[string]interface{}{}
+	second := map[string]map[string]float64{
+		"sda": {"reads": 1600, "sectors_read": 20000, "read_ticks": 800, "writes": 2600, "sectors_write": 28000, "write_ticks": 2400, "io_ticks": 40000},
+		// hotplugged since the last run
+		"sdb": {"reads": 10, "sectors_read": 80, "read_ticks": 5, "writes": 0, "sectors_write": 0, "write_ticks": 0, "io_ticks": 5},
+	}
+	setDiskDeviceStats(stat, second, last, time.Minute)
+	assert.EqualValues(t, 10, stat["linux.disk.sda.iops.reads"])
+	assert.EqualValues(t, 10, stat["linux.disk.sda.iops.writes"])
+	assert.EqualValues(t, 12000*512/60, stat["linux.disk.sda.bytes.read_bytes"])
+	assert.EqualValues(t, 12000*512/60, stat["linux.disk.sda.bytes.write_bytes"])
+	// (300 + 900) ms for 1200 IOs
+	assert.EqualValues(t, 1, stat["linux.disk.sda.await.await_ms"])
+	// 30000 ms busy in 60 sec
+	assert.EqualValues(t, 50, stat["linux.disk.sda.util.util_percent"])
+	assert.NotContains(t, stat, "linux.disk.sdb.iops.reads")
+	assert.EqualValues(t, 10, stat["linux.disk_raw.sdb.reads"])
+
+	// the counters reset by the reattachment are skipped
+	reset := map[string]interface{}{}
+	setDiskDeviceStats(reset, first, stat, time.Minute)
+	assert.NotContains(t, reset, "linux.disk.sda.iops.reads")
+}
+
+func TestCollectDiskDevicesWithLastValues(t *testing.T) {
+	diskstats, err := ioutil.TempFile("", "diskstats")
+	assert.Nil(t, err)
+	defer os.Remove(diskstats.Name())
+	diskstats.WriteString("   8       0 sda 1600 0 20000 800 2600 0 28000 2400 0 40000 3200\n")
+	diskstats.Close()
+
+	tempfile, err := ioutil.TempFile("", "mackerel-plugin-linux")
+	assert.Nil(t, err)
+	defer os.Remove(tempfile.Name())
+	// the values of the last run saved by the helper
+	fmt.Fprintf(tempfile, `{"_lastTime": %d, "linux.disk_raw.sda.reads": 1000, "linux.disk_raw.sda.sectors_read": 8000,
+"linux.disk_raw.sda.read_ticks": 500, "linux.disk_raw.sda.writes": 2000, "linux.disk_raw.sda.sectors_write": 16000,
+"linux.disk_raw.sda.write_ticks": 1500, "linux.disk_raw.sda.io_ticks": 10000}`, time.Now().Add(-time.Minute).Unix())
+	tempfile.Close()
+
+	linux := LinuxPlugin{}
+	helper := mp.NewMackerelPlugin(linux)
+	helper.Tempfile = tempfile.Name()
+	lv, err := helper.FetchLastValues()
+	assert.Nil(t, err)
+	linux.lastStat = lv.Values
+	linux.lastTime = lv.Timestamp
+
+	stat := map[string]interface{}{}
+	assert.Nil(t, linux.collectDiskDevices(diskstats.Name(), &stat))
+	// 600 reads in about 60 sec
+	assert.InDelta(t, 10, stat["linux.disk.sda.iops.reads"], 0.5)
+	assert.EqualValues(t, 1600, stat["linux.disk_raw.sda.reads"])
+}
@@ -7,6 +7,7 @@ import (
 var flags = []cli.Flag{
 	cliTempFile,
 	cliType,
+	cliExcludeDevice,
 }
 
 var cliTempFile = cli.StringFlag{
@@ -19,6 +20,12 @@ var cliTempFile = cli.StringFlag{
 var cliType = cli.StringSliceFlag{
 	Name:   "type, p",
 	Value:  &cli.StringSlice{},
-	Usage:  "Select metrics type(s) to fetch: all, swap, netstat, diskstats, proc_stat, users",
+	Usage:  "Select metrics type(s) to fetch: all, swap, netstat, diskstats, proc_stat, users, psi, conntrack",
 	EnvVar: "ENVVAR_TYPE",
 }
+
+var cliExcludeDevice = cli.StringFlag{
+	Name:  "exclude-device",
+	Value: defaultExcludeDevice,
+	Usage: "Set the regexp of the devices excluded from the per-device disk metrics.",
+}
@@ -7,9 +7,11 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/urfave/cli"
@@ -19,6 +21,8 @@ const (
 	pathVmstat    = "/proc/vmstat"
 	pathDiskstats = "/proc/diskstats"
 	pathStat      = "/proc/stat"
+	pathPressure  = "/proc/pressure"
+	pathProc      = "/proc"
 )
 
 // metric value structure
@@ -29,6 +33,12 @@ var graphdef = map[string]mp.Graphs{}
 type LinuxPlugin struct {
 	Tempfile string
 	Typemap  map[string]bool
+	// ExcludeDevice excludes the devices from the per-device disk metrics
+	ExcludeDevice *regexp.Regexp
+
+	// lastStat and lastTime are the values of the last run saved in the tempfile, for the per-device disk metrics
+	lastStat map[string]interface{}
+	lastTime time.Time
 }
 
 // GraphDefinition interface for mackerelplugin
@@ -56,6 +66,10 @@ func (c LinuxPlugin) GraphDefinition() map[string]mp.Graphs {
 		if err != nil {
 			return nil
 		}
+		err = c.collectDiskDevices(pathDiskstats, &p)
+		if err != nil {
+			return nil
+		}
 	}
 
 	if c.Typemap["all"] || c.Typemap["proc_stat"] {
@@ -72,6 +86,20 @@ func (c LinuxPlugin) GraphDefinition() map[string]mp.Graphs {
 		}
 	}
 
+	if c.Typemap["all"] || c.Typemap["psi"] {
+		err = collectPressure(pathPressure, &p)
+		if err != nil {
+			return nil
+		}
+	}
+
+	if c.Typemap["all"] || c.Typemap["conntrack"] {
+		err = collectConntrack(pathProc, &p)
+		if err != nil {
+			return nil
+		}
+	}
+
 	return graphdef
 }
 
@@ -90,9 +118,22 @@ func doMain(c *cli.Context) error {
 		}
 	}
 	linux.Typemap = typemap
+	exclude, err := regexp.Compile(c.String("exclude-device"))
+	if err != nil {
+		return fmt.Errorf("invalid -exclude-device: %s", err)
+	}
+	linux.ExcludeDevice = exclude
 	helper := mp.NewMackerelPlugin(linux)
 	helper.Tempfile = c.String("tempfile")
 
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		if lv, err := helper.FetchLastValues(); err == nil {
+			linux.lastStat = lv.Values
+			linux.lastTime = lv.Timestamp
+		}
+		helper.Plugin = linux
+	}
+
 	helper.Run()
 	return nil
 }
@@ -122,6 +163,10 @@ func (c LinuxPlugin) FetchMetrics() (map[string]interface{}, error) {
 		if err != nil {
 			return nil, err
 		}
+		err = c.collectDiskDevices(pathDiskstats, &p)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if c.Typemap["all"] || c.Typemap["proc_stat"] {
@@ -138,6 +183,20 @@ func (c LinuxPlugin) FetchMetrics() (map[string]interface{}, error) {
 		}
 	}
 
+	if c.Typemap["all"] || c.Typemap["psi"] {
+		err = collectPressure(pathPressure, &p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Typemap["all"] || c.Typemap["conntrack"] {
+		err = collectConntrack(pathProc, &p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return p, nil
 }
 
@@ -410,6 +469,79 @@ func parseProcVmstat(r io.Reader, p *map[string]interface{}) error {
 	return nil
 }
 
+// pressureResources are the resources of /proc/pressure
+var pressureResources = []struct {
+	name  string
+	label string
+}{
+	{"cpu", "CPU"},
+	{"memory", "Memory"},
+	{"io", "IO"},
+}
+
+// collect /proc/pressure of the kernel 4.20 or above. The resources are skipped when PSI is not supported or
+// disabled by psi=0, where /proc/pressure does not exist or is not readable.
+func collectPressure(dir string, p *map[string]interface{}) error {
+	for _, res := range pressureResources {
+		file, err := os.Open(filepath.Join(dir, res.name))
+		if err != nil {
+			continue
+		}
+		err = parsePressure(file, res.name, p)
+		file.Close()
+		if err != nil {
+			// reading fails with EOPNOTSUPP when PSI is disabled
+			continue
+		}
+
+		graphdef["linux.pressure_"+res.name] = mp.Graphs{
+			Label: "Linux " + res.label + " Pressure (avg10)",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "psi_" + res.name + "_some_avg10", Label: "Some", Diff: false},
+				{Name: "psi_" + res.name + "_full_avg10", Label: "Full", Diff: false},
+			},
+		}
+		graphdef["linux.pressure_stall_"+res.name] = mp.Graphs{
+			Label: "Linux " + res.label + " Stall Time (usec)",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "psi_" + res.name + "_some_total", Label: "Some", Diff: true},
+				{Name: "psi_" + res.name + "_full_total", Label: "Full", Diff: true},
+			},
+		}
+	}
+	return nil
+}
+
+// parsing metrics from /proc/pressure/<resource>, where the full line is missing from cpu before the kernel 5.13
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=12345
+// full avg10=0.00 avg60=0.00 avg300=0.00 total=6789
+func parsePressure(r io.Reader, resource string, p *map[string]interface{}) error {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		record := strings.Fields(scanner.Text())
+		if len(record) < 2 || (record[0] != "some" && record[0] != "full") {
+			continue
+		}
+		prefix := "psi_" + resource + "_" + record[0] + "_"
+		for _, field := range record[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || (kv[0] != "avg10" && kv[0] != "total") {
+				continue
+			}
+			value, errParse := atof(kv[1])
+			if errParse != nil {
+				return errParse
+			}
+			(*p)[prefix+kv[0]] = value
+		}
+	}
+
+	return scanner.Err()
+}
+
 // atof
 func atof(str string) (float64, error) {
 	return strconv.ParseFloat(strings.Trim(str, " "), 64)
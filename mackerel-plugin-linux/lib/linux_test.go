@@ -2,7 +2,9 @@ package mplinux
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -167,3 +169,38 @@ pswpout 113`
 	assert.EqualValues(t, stat["pswpin"], 0)
 	assert.EqualValues(t, stat["pswpout"], 113)
 }
+
+func TestCollectPressure(t *testing.T) {
+	p := make(map[string]interface{})
+
+	dir, err := ioutil.TempDir("", "mackerel-plugin-linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// PSI is not supported
+	assert.Nil(t, collectPressure(filepath.Join(dir, "pressure"), &p))
+	assert.Len(t, p, 0)
+
+	// cpu has no full line before the kernel 5.13, and io is missing
+	files := map[string]string{
+		"cpu":    "some avg10=1.50 avg60=0.80 avg300=0.20 total=123456\n",
+		"memory": "some avg10=0.00 avg60=0.00 avg300=0.00 total=100\nfull avg10=0.30 avg60=0.00 avg300=0.00 total=50\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Nil(t, collectPressure(dir, &p))
+	assert.EqualValues(t, 1.5, p["psi_cpu_some_avg10"])
+	assert.EqualValues(t, 123456, p["psi_cpu_some_total"])
+	assert.NotContains(t, p, "psi_cpu_full_avg10")
+	assert.NotContains(t, p, "psi_cpu_some_avg60")
+	assert.EqualValues(t, 0.3, p["psi_memory_full_avg10"])
+	assert.EqualValues(t, 50, p["psi_memory_full_total"])
+	assert.NotContains(t, p, "psi_io_some_avg10")
+	assert.Contains(t, graphdef, "linux.pressure_memory")
+	assert.NotContains(t, graphdef, "linux.pressure_io")
+}
@@ -2,6 +2,7 @@ package mpmailq
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +11,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
@@ -19,6 +21,18 @@ type mailq struct {
 	args    []string
 	line    int
 	pattern string
+
+	// extras are posted besides count where the MTA distinguishes them
+	extras []extraMetric
+}
+
+// extraMetric is counted by parse in the output of the command executed with args. The command is executed once per
+// run for the same args, so that the metrics of the same output are consistent with each other.
+type extraMetric struct {
+	name  string
+	label string
+	args  []string
+	parse func(io.Reader) (uint64, error)
 }
 
 var mailqFormats = map[string]mailq{
@@ -27,22 +41,45 @@ var mailqFormats = map[string]mailq{
 		args:    []string{"-p"},
 		line:    -1,
 		pattern: `-- \d+ Kbytes in (\d+) Requests\.`,
+		extras: []extraMetric{
+			{name: "deferred", label: "deferred", args: []string{"-p"}, parse: parsePostqueueDeferred},
+		},
 	},
 	"qmail": {
 		command: "qmail-qstat",
 		pattern: `messages in queue: (\d+)`,
+		extras: []extraMetric{
+			{name: "unprocessed", label: "not yet preprocessed", parse: parseMatch(`messages in queue but not yet preprocessed: (\d+)`)},
+		},
 	},
 	"exim": {
 		command: "exim",
 		args:    []string{"-bpc"},
 		pattern: `(\d+)`,
+		extras: []extraMetric{
+			{name: "frozen", label: "frozen", args: []string{"-bp"}, parse: parseEximQueue(true)},
+			{name: "deferred", label: "deferred", args: []string{"-bp"}, parse: parseEximQueue(false)},
+		},
 	},
 }
 
+// the order to probe MTAs when -mta is not given or auto
+var mtaDetectionOrder = []string{"postfix", "exim", "qmail"}
+
+func detectMTA() (string, bool) {
+	for _, mta := range mtaDetectionOrder {
+		if _, err := exec.LookPath(mailqFormats[mta].command); err == nil {
+			return mta, true
+		}
+	}
+	return "", false
+}
+
 type plugin struct {
 	path                   string
 	mailq                  mailq
 	keyPrefix, labelPrefix string
+	postfixQueue           *postfixQueue
 }
 
 func (format *mailq) parse(rd io.Reader) (count uint64, err error) {
@@ -59,8 +96,79 @@ func (format *mailq) parse(rd io.Reader) (count uint64, err error) {
 	return
 }
 
-func (p *plugin) fetchMailqCount() (count uint64, err error) {
+// eximMessageRe matches the first line of a message in the output of exim -bp: the age, the size, the message ID and
+// the sender, followed by "*** frozen ***" if frozen
+var eximMessageRe = regexp.MustCompile(`^\s*\d+[smhdw]\s+[\d.]+[KM]?\s+[-0-9A-Za-z]+\s+<[^>]*>(.*)$`)
+
+// parseEximQueue returns the parser counting the frozen messages, or the others in the output of exim -bp.
+// exim tries to deliver a message when it is received, so the messages left in the queue other than the frozen ones
+// are the deferred ones waiting for the retry.
+func parseEximQueue(frozen bool) func(io.Reader) (uint64, error) {
+	return func(rd io.Reader) (count uint64, err error) {
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			m := eximMessageRe.FindStringSubmatch(scanner.Text())
+			if m == nil {
+				continue
+			}
+			if strings.Contains(m[1], "*** frozen ***") == frozen {
+				count++
+			}
+		}
+		err = scanner.Err()
+		return
+	}
+}
 
+// parseMatch returns the parser of the number captured by the pattern in any line
+func parseMatch(pattern string) func(io.Reader) (uint64, error) {
+	re := regexp.MustCompile(pattern)
+	return func(rd io.Reader) (count uint64, err error) {
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			if m := re.FindStringSubmatch(scanner.Text()); m != nil {
+				return strconv.ParseUint(m[1], 10, 64)
+			}
+		}
+		err = scanner.Err()
+		return
+	}
+}
+
+// parsePostqueueDeferred counts the messages with the reasons of the deferral in the output of postqueue -p.
+// The messages in the active queue and the hold queue are marked with * and ! after their queue IDs.
+func parsePostqueueDeferred(rd io.Reader) (count uint64, err error) {
+	var marked, deferred bool
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if deferred {
+				count++
+			}
+			marked, deferred = false, false
+		case line[0] != ' ' && line[0] != '\t':
+			// the header, the summary, or the first line of a message
+			if deferred {
+				count++
+			}
+			fields := strings.Fields(line)
+			marked = strings.HasSuffix(fields[0], "*") || strings.HasSuffix(fields[0], "!")
+			deferred = false
+		case !marked && strings.HasPrefix(strings.TrimSpace(line), "("):
+			deferred = true
+		}
+	}
+	if deferred {
+		count++
+	}
+	err = scanner.Err()
+	return
+}
+
+// execute returns the output of the command executed with args
+func (p *plugin) execute(args []string) (out []byte, err error) {
 	var path string
 	if p.path != "" {
 		path = p.path
@@ -73,52 +181,83 @@ func (p *plugin) fetchMailqCount() (count uint64, err error) {
 
 	cmd := exec.Cmd{
 		Path: path,
-		Args: append([]string{p.mailq.command}, p.mailq.args...),
+		Args: append([]string{p.mailq.command}, args...),
+		// the outputs are parsed in English
+		Env: append(os.Environ(), "LC_ALL=C"),
 	}
 
-	if p.path != "" {
-		cmd.Path = p.path
-	}
+	return cmd.Output()
+}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return
+func (p *plugin) FetchMetrics() (map[string]interface{}, error) {
+	// the outputs by the args, so that the command is executed once for the count and the extras of the same args
+	outputs := make(map[string][]byte)
+	output := func(args []string) ([]byte, error) {
+		key := strings.Join(args, " ")
+		if out, ok := outputs[key]; ok {
+			return out, nil
+		}
+		out, err := p.execute(args)
+		if err != nil {
+			return nil, err
+		}
+		outputs[key] = out
+		return out, nil
 	}
 
-	err = cmd.Start()
+	out, err := output(p.mailq.args)
 	if err != nil {
-		return
+		return nil, err
 	}
-
-	count, err = p.mailq.parse(stdout)
+	count, err := p.mailq.parse(bytes.NewReader(out))
 	if err != nil {
-		cmd.Wait()
-		return
+		return nil, err
 	}
 
-	err = cmd.Wait()
-	return
-}
+	metrics := map[string]interface{}{"count": count}
 
-func (p *plugin) FetchMetrics() (map[string]interface{}, error) {
-	count, err := p.fetchMailqCount()
-	if err != nil {
-		return nil, err
+	for _, extra := range p.mailq.extras {
+		out, err := output(extra.args)
+		if err != nil {
+			return nil, err
+		}
+		v, err := extra.parse(bytes.NewReader(out))
+		if err != nil {
+			return nil, err
+		}
+		metrics[extra.name] = v
 	}
 
-	return map[string]interface{}{"count": count}, nil
+	if p.postfixQueue != nil {
+		for k, v := range p.postfixQueue.fetch(p.keyPrefix) {
+			metrics[k] = v
+		}
+	}
+
+	return metrics, nil
 }
 
 func (p *plugin) GraphDefinition() map[string]mp.Graphs {
-	return map[string]mp.Graphs{
+	metrics := []mp.Metrics{
+		{Name: "count", Label: "count", Type: "uint64"},
+	}
+	for _, extra := range p.mailq.extras {
+		metrics = append(metrics, mp.Metrics{Name: extra.name, Label: extra.label, Type: "uint64"})
+	}
+
+	graphs := map[string]mp.Graphs{
 		p.keyPrefix: {
-			Label: p.labelPrefix + " Count",
-			Unit:  "integer",
-			Metrics: []mp.Metrics{
-				{Name: "count", Label: "count", Type: "uint64"},
-			},
+			Label:   p.labelPrefix + " Count",
+			Unit:    "integer",
+			Metrics: metrics,
 		},
 	}
+	if p.postfixQueue != nil {
+		for k, v := range postfixQueueGraphDefinition(p.keyPrefix, p.labelPrefix) {
+			graphs[k] = v
+		}
+	}
+	return graphs
 }
 
 func getNthLine(rd io.Reader, nth int) (string, error) {
@@ -171,16 +310,26 @@ func Do() {
 		mtas = append(mtas, k)
 	}
 
-	mta := flag.String("mta", "", fmt.Sprintf("type of MTA (one of %v)", mtas))
+	mta := flag.String("mta", "", fmt.Sprintf("type of MTA (one of %v, or auto to detect it by probing the commands, which is the default, postfix if none found)", mtas))
 	flag.StringVar(mta, "M", "", "shorthand for -mta")
 	command := flag.String("command", "", "path to queue-printing command (guessed by -M flag if not given)")
 	flag.StringVar(command, "c", "", "shorthand for -command")
 	tempfile := flag.String("tempfile", "", "path to tempfile")
 	keyPrefix := flag.String("metric-key-prefix", "mailq", "prefix to metric key")
 	labelPrefix := flag.String("metric-label-prefix", "Mailq", "prefix to metric label")
+	postfixSpool := flag.String("postfix-spool-dir", "/var/spool/postfix", "path to the spool directory of Postfix to count messages per queue (set empty to disable)")
+	postfixMaxFiles := flag.Int("postfix-max-files", 100000, "maximum number of files to count in the spool directory of Postfix")
 
 	flag.Parse()
 
+	if *mta == "" || *mta == "auto" {
+		if detected, ok := detectMTA(); ok {
+			*mta = detected
+		} else {
+			*mta = "postfix"
+		}
+	}
+
 	if format, ok := mailqFormats[*mta]; *mta == "" || !ok {
 		fmt.Fprintf(os.Stderr, "Unknown MTA: %s\n", *mta)
 		flag.PrintDefaults()
@@ -192,6 +341,15 @@ func Do() {
 			keyPrefix:   *keyPrefix,
 			labelPrefix: *labelPrefix,
 		}
+		if *mta == "postfix" && *postfixSpool != "" {
+			if fi, err := os.Stat(*postfixSpool); err == nil && fi.IsDir() {
+				plugin.postfixQueue = &postfixQueue{
+					spoolDir: *postfixSpool,
+					maxFiles: *postfixMaxFiles,
+					now:      time.Now,
+				}
+			}
+		}
 		helper := mp.NewMackerelPlugin(plugin)
 		helper.Tempfile = *tempfile
 		helper.Run()
@@ -1,11 +1,29 @@
 package mpmailq
 
 import (
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
 )
 
+// commandLog returns the file logging the commands executed by the fixtures, and the func to read and remove it
+func commandLog(t *testing.T) (string, func() string) {
+	f, err := ioutil.TempFile("", "mackerel-plugin-mailq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f.Name(), func() string {
+		defer os.Remove(f.Name())
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
 func TestGetNthLine(t *testing.T) {
 	{
 		s := `0000`
@@ -240,8 +258,8 @@ func TestGraphDefinition(t *testing.T) {
 			t.Errorf("Mailq is expected to have a label")
 		}
 
-		if len(graphMailq.Metrics) != 1 {
-			t.Errorf("Mailq is expected to have one definition of metrics")
+		if len(graphMailq.Metrics) != 2 {
+			t.Errorf("Mailq is expected to have two definitions of metrics")
 		}
 
 		if graphMailq.Metrics[0].Name != "count" {
@@ -251,10 +269,16 @@ func TestGraphDefinition(t *testing.T) {
 		if graphMailq.Metrics[0].Type != "uint64" {
 			t.Errorf("Mailq is expected to have type uint64")
 		}
+
+		if graphMailq.Metrics[1].Name != "deferred" {
+			t.Errorf("Mailq for postfix is expected to have deferred metric")
+		}
 	}
 }
 
 func TestFetchMetricsPostfix(t *testing.T) {
+	cwd, _ := os.Getwd()
+
 	plugin := plugin{
 		mailq:       mailqFormats["postfix"],
 		keyPrefix:   "mailq",
@@ -262,12 +286,15 @@ func TestFetchMetricsPostfix(t *testing.T) {
 	}
 
 	origPath := os.Getenv("PATH")
-	os.Setenv("PATH", "./fixtures:/bin:/usr/bin")
+	os.Setenv("PATH", cwd+"/fixtures:/bin:/usr/bin")
 	defer os.Setenv("PATH", origPath)
 
 	{
 		os.Setenv("TEST_MAILQ_COUNT", "42")
 		defer os.Unsetenv("TEST_MAILQ_COUNT")
+		log, readLog := commandLog(t)
+		os.Setenv("TEST_MAILQ_LOG", log)
+		defer os.Unsetenv("TEST_MAILQ_LOG")
 
 		metrics, err := plugin.FetchMetrics()
 		if err != nil {
@@ -276,6 +303,47 @@ func TestFetchMetricsPostfix(t *testing.T) {
 		if metrics["count"].(uint64) != 42 {
 			t.Errorf("Incorrect value: %d", metrics["count"].(uint64))
 		}
+		if metrics["deferred"].(uint64) != 42 {
+			t.Errorf("Incorrect value: %d", metrics["deferred"].(uint64))
+		}
+		if executed := readLog(); executed != "postqueue -p\n" {
+			t.Errorf("postqueue -p is expected to be executed once, but executed %q", executed)
+		}
+	}
+}
+
+func TestParsePostqueueDeferred(t *testing.T) {
+	output := `-Queue ID- --Size-- ----Arrival Time---- -Sender/Recipient-------
+DD0C740001C      274 Thu Mar  3 23:52:37  foobar@example.com
+          (connect to mail.invalid[192.0.2.100]:25: Connection timed out)
+                                         nyao@mail.invalid
+          (host mail.invalid[192.0.2.101] said: 450 try again later)
+                                         mew@mail.invalid
+
+3F1A740002A*     512 Thu Mar  3 23:53:01  foobar@example.com
+                                         nyao@mail.invalid
+
+7B2C740003B!     128 Thu Mar  3 23:54:12  foobar@example.com
+          (on hold)
+                                         nyao@mail.invalid
+
+8C3D740004C      300 Thu Mar  3 23:55:40  foobar@example.com
+          (delivery temporarily suspended: connect to mail.invalid[192.0.2.100]:25: Connection timed out)
+                                         nyao@mail.invalid
+
+-- 2 Kbytes in 4 Requests.
+`
+	count, err := parsePostqueueDeferred(strings.NewReader(output))
+	if err != nil {
+		t.Errorf("Error in parsePostqueueDeferred: %s", err.Error())
+	}
+	if count != 2 {
+		t.Errorf("2 messages are expected to be deferred, but got %d", count)
+	}
+
+	count, _ = parsePostqueueDeferred(strings.NewReader("Mail queue is empty\n"))
+	if count != 0 {
+		t.Errorf("no message is expected to be deferred, but got %d", count)
 	}
 }
 
@@ -296,6 +364,8 @@ func TestFetchMetricsQmail(t *testing.T) {
 	{
 		os.Setenv("TEST_MAILQ_COUNT", "42")
 		defer os.Unsetenv("TEST_MAILQ_COUNT")
+		os.Setenv("TEST_MAILQ_UNPROCESSED", "5")
+		defer os.Unsetenv("TEST_MAILQ_UNPROCESSED")
 
 		metrics, err := plugin.FetchMetrics()
 		if err != nil {
@@ -304,5 +374,135 @@ func TestFetchMetricsQmail(t *testing.T) {
 		if metrics["count"].(uint64) != 42 {
 			t.Errorf("Incorrect value: %d", metrics["count"].(uint64))
 		}
+		if metrics["unprocessed"].(uint64) != 5 {
+			t.Errorf("Incorrect value: %d", metrics["unprocessed"].(uint64))
+		}
+	}
+}
+
+func TestParseEximQueue(t *testing.T) {
+	{
+		output := ` 4d  1.2K 1bK9zD-0003Ae-Rq <> *** frozen ***
+          nyao@mail.invalid
+
+25m  2.9K 1bKBfO-0004hX-Fa <foobar@example.com>
+          nyao@mail.invalid
+
+ 2h  3.1K 1bKAxk-0004Pc-1J <> *** frozen ***
+          foobar@mail.invalid
+
+`
+
+		count, err := parseEximQueue(true)(strings.NewReader(output))
+		if err != nil {
+			t.Errorf("Error in parseEximQueue: %s", err.Error())
+		}
+		if count != 2 {
+			t.Errorf("2 messages are expected to be frozen, but got %d", count)
+		}
+
+		count, err = parseEximQueue(false)(strings.NewReader(output))
+		if err != nil {
+			t.Errorf("Error in parseEximQueue: %s", err.Error())
+		}
+		if count != 1 {
+			t.Errorf("1 message is expected to be deferred, but got %d", count)
+		}
+	}
+
+	{
+		// the recipients which have been delivered are marked with D, and the IDs of exim 4.97 are longer
+		output := ` 3h  5.4K 1t5C6f-00000000c8Z-0a3B <foobar@example.com>
+        D nyao@mail.invalid
+          mew@mail.invalid
+
+`
+		count, _ := parseEximQueue(false)(strings.NewReader(output))
+		if count != 1 {
+			t.Errorf("1 message is expected to be deferred, but got %d", count)
+		}
+	}
+}
+
+func TestGraphDefinitionExim(t *testing.T) {
+	plugin := plugin{
+		mailq:       mailqFormats["exim"],
+		keyPrefix:   "mailq",
+		labelPrefix: "Mailq",
+	}
+
+	graphs := plugin.GraphDefinition()
+	graphMailq := graphs["mailq"]
+	if len(graphMailq.Metrics) != 3 {
+		t.Errorf("Mailq for exim is expected to have three definitions of metrics")
+	}
+	if graphMailq.Metrics[1].Name != "frozen" {
+		t.Errorf("Mailq for exim is expected to have frozen metric")
+	}
+	if graphMailq.Metrics[2].Name != "deferred" {
+		t.Errorf("Mailq for exim is expected to have deferred metric")
+	}
+}
+
+func TestFetchMetricsExim(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	plugin := plugin{
+		mailq:       mailqFormats["exim"],
+		keyPrefix:   "mailq",
+		labelPrefix: "Mailq",
+	}
+
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", cwd+"/fixtures/exim:/bin:/usr/bin")
+	defer os.Setenv("PATH", origPath)
+
+	{
+		os.Setenv("TEST_MAILQ_COUNT", "42")
+		defer os.Unsetenv("TEST_MAILQ_COUNT")
+		os.Setenv("TEST_MAILQ_FROZEN", "3")
+		defer os.Unsetenv("TEST_MAILQ_FROZEN")
+		log, readLog := commandLog(t)
+		os.Setenv("TEST_MAILQ_LOG", log)
+		defer os.Unsetenv("TEST_MAILQ_LOG")
+
+		metrics, err := plugin.FetchMetrics()
+		if err != nil {
+			t.Errorf("Error %s", err.Error())
+		}
+		if metrics["count"].(uint64) != 42 {
+			t.Errorf("Incorrect value: %d", metrics["count"].(uint64))
+		}
+		if metrics["frozen"].(uint64) != 3 {
+			t.Errorf("Incorrect value: %d", metrics["frozen"].(uint64))
+		}
+		if metrics["deferred"].(uint64) != 39 {
+			t.Errorf("Incorrect value: %d", metrics["deferred"].(uint64))
+		}
+		if executed := readLog(); executed != "exim -bpc\nexim -bp\n" {
+			t.Errorf("exim -bpc and exim -bp are expected to be executed once each, but executed %q", executed)
+		}
+	}
+}
+
+func TestDetectMTA(t *testing.T) {
+	cwd, _ := os.Getwd()
+
+	origPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", origPath)
+
+	os.Setenv("PATH", cwd+"/fixtures/exim:"+cwd+"/fixtures/qmail")
+	if mta, ok := detectMTA(); !ok || mta != "exim" {
+		t.Errorf("exim is expected to be detected, but got %s", mta)
+	}
+
+	os.Setenv("PATH", cwd+"/fixtures:"+cwd+"/fixtures/exim")
+	if mta, ok := detectMTA(); !ok || mta != "postfix" {
+		t.Errorf("postfix is expected to be detected, but got %s", mta)
+	}
+
+	os.Setenv("PATH", cwd+"/fixtures/nonexistent")
+	if _, ok := detectMTA(); ok {
+		t.Errorf("no MTA is expected to be detected")
 	}
 }
@@ -0,0 +1,160 @@
+package mpmailq
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+var postfixQueueNames = []string{"incoming", "active", "deferred", "hold", "corrupt"}
+
+// postfixQueue counts messages per queue directory by walking the spool of Postfix
+type postfixQueue struct {
+	spoolDir string
+	maxFiles int
+	now      func() time.Time
+}
+
+func (q *postfixQueue) fetch(keyPrefix string) map[string]interface{} {
+	metrics := make(map[string]interface{})
+	files := 0
+	var oldest time.Time
+
+	for _, name := range postfixQueueNames {
+		var count uint64
+		dir := filepath.Join(q.spoolDir, name)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// tolerate permission errors and vanished files, which are usual in a busy spool
+				if info != nil && info.IsDir() && path != dir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if q.maxFiles > 0 && files >= q.maxFiles {
+				return errTooManyFiles
+			}
+			files++
+			count++
+
+			if name == "deferred" {
+				arrival, err := readPostfixArrivalTime(path)
+				if err != nil {
+					arrival = info.ModTime()
+				}
+				if oldest.IsZero() || arrival.Before(oldest) {
+					oldest = arrival
+				}
+			}
+			return nil
+		})
+		if err == errTooManyFiles {
+			log.Printf("more than %d files found in %s, stopped counting", q.maxFiles, q.spoolDir)
+		}
+		metrics[keyPrefix+".queue."+name] = count
+		if err == errTooManyFiles {
+			break
+		}
+	}
+
+	var age uint64
+	if !oldest.IsZero() {
+		if d := q.now().Sub(oldest); d > 0 {
+			age = uint64(d / time.Minute)
+		}
+	}
+	metrics[keyPrefix+".deferred_age.oldest"] = age
+
+	return metrics
+}
+
+var errTooManyFiles = errors.New("too many files")
+
+// readPostfixArrivalTime reads the arrival time from the time record of a queue file,
+// because Postfix uses the modification time of deferred queue files for retry scheduling.
+func readPostfixArrivalTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	// the time record is one of the first records of a queue file
+	for i := 0; i < 10; i++ {
+		typ, data, err := readPostfixRecord(rd)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if typ != 'T' {
+			continue
+		}
+		// "seconds microseconds"
+		sec, err := strconv.ParseInt(strings.Fields(string(data) + " ")[0], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+	return time.Time{}, errors.New("time record not found")
+}
+
+// readPostfixRecord reads a record of a queue file: a type byte, the length of
+// the data encoded in 7 bits per byte, and the data.
+func readPostfixRecord(rd *bufio.Reader) (byte, []byte, error) {
+	typ, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		c, err := rd.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		if shift > 21 {
+			return 0, nil, errors.New("invalid record length")
+		}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(rd, data); err != nil {
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+func postfixQueueGraphDefinition(keyPrefix, labelPrefix string) map[string]mp.Graphs {
+	var queues []mp.Metrics
+	for _, name := range postfixQueueNames {
+		queues = append(queues, mp.Metrics{Name: name, Label: name, Type: "uint64", Stacked: true, AbsoluteName: true})
+	}
+	return map[string]mp.Graphs{
+		keyPrefix + ".queue": {
+			Label:   labelPrefix + " Postfix Queue",
+			Unit:    "integer",
+			Metrics: queues,
+		},
+		keyPrefix + ".deferred_age": {
+			Label: labelPrefix + " Postfix Oldest Deferred Message Age (minutes)",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "oldest", Label: "oldest", Type: "uint64", AbsoluteName: true},
+			},
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package mpmailq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeQueueFile writes a queue file which has a size record and a time record
+func writeQueueFile(t *testing.T, path string, arrival time.Time) {
+	timeRecord := []byte(fmt.Sprintf("%d 0", arrival.Unix()))
+	content := []byte{'C', 3}
+	content = append(content, []byte("123")...)
+	content = append(content, 'T', byte(len(timeRecord)))
+	content = append(content, timeRecord...)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPostfixQueue(t *testing.T) {
+	spool, err := ioutil.TempDir("", "mailq-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spool)
+
+	now := time.Unix(1500000000, 0)
+	for _, dir := range []string{"active", "deferred/A", "deferred/B", "hold"} {
+		os.MkdirAll(filepath.Join(spool, dir), 0700)
+	}
+	writeQueueFile(t, filepath.Join(spool, "active", "AAAA1"), now)
+	writeQueueFile(t, filepath.Join(spool, "active", "AAAA2"), now)
+	writeQueueFile(t, filepath.Join(spool, "deferred", "A", "ABCD1"), now.Add(-30*time.Minute))
+	writeQueueFile(t, filepath.Join(spool, "deferred", "B", "BCDE1"), now.Add(-95*time.Minute))
+	// a broken queue file falls back to the modification time
+	ioutil.WriteFile(filepath.Join(spool, "deferred", "B", "BCDE2"), []byte("broken"), 0600)
+	os.Chtimes(filepath.Join(spool, "deferred", "B", "BCDE2"), now.Add(-10*time.Minute), now.Add(-10*time.Minute))
+	writeQueueFile(t, filepath.Join(spool, "hold", "HOLD1"), now)
+
+	q := &postfixQueue{spoolDir: spool, now: func() time.Time { return now }}
+	metrics := q.fetch("mailq")
+
+	expected := map[string]uint64{
+		"mailq.queue.incoming":      0,
+		"mailq.queue.active":        2,
+		"mailq.queue.deferred":      3,
+		"mailq.queue.hold":          1,
+		"mailq.queue.corrupt":       0,
+		"mailq.deferred_age.oldest": 95,
+	}
+	for k, v := range expected {
+		if metrics[k].(uint64) != v {
+			t.Errorf("%s is expected to be %d, but %d", k, v, metrics[k].(uint64))
+		}
+	}
+
+	q.maxFiles = 3
+	metrics = q.fetch("mailq")
+	if metrics["mailq.queue.deferred"].(uint64) != 1 {
+		t.Errorf("counting is expected to stop at maxFiles, but %d", metrics["mailq.queue.deferred"].(uint64))
+	}
+	if _, ok := metrics["mailq.queue.hold"]; ok {
+		t.Errorf("queues after reaching maxFiles are expected not to be counted")
+	}
+}
+
+func TestPostfixQueueGraphDefinition(t *testing.T) {
+	plugin := plugin{
+		mailq:        mailqFormats["postfix"],
+		keyPrefix:    "mailq",
+		labelPrefix:  "Mailq",
+		postfixQueue: &postfixQueue{spoolDir: "/var/spool/postfix"},
+	}
+
+	graphs := plugin.GraphDefinition()
+	if len(graphs) != 3 {
+		t.Errorf("Mailq for postfix is expected to have 3 graphs, but %d", len(graphs))
+	}
+	if len(graphs["mailq.queue"].Metrics) != len(postfixQueueNames) {
+		t.Errorf("mailq.queue is expected to have a metric per queue")
+	}
+}
@@ -1,15 +1,22 @@
 package mpmcrouter
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 var cmdMetricNames = []string{
@@ -46,10 +53,38 @@ var resultMetricNames = []string{
 	"result_tko_count",
 }
 
+var proxyMetricNames = []string{
+	"proxy_reqs_processing",
+	"proxy_reqs_waiting",
+	"proxy_request_num_outstanding",
+}
+
+// tkoMetricNames are the TKO states of each destination server in "stats servers"
+var tkoMetricNames = []string{
+	"soft_tko",
+	"hard_tko",
+}
+
+// poolMetricNames are the stats of each pool in the keys like "pool.<name>.requests"
+var poolMetricNames = []string{
+	"requests",
+	"errors",
+}
+
+// suspect server states in the server_health graph
+const (
+	serverHealthy = 0
+	serverSoftTKO = 1
+	serverHardTKO = 2
+)
+
 // McrouterPlugin mackerel plugin
 type McrouterPlugin struct {
-	Prefix    string
-	StatsFile string
+	Prefix        string
+	StatsFile     string
+	EnableServers bool
+	Address       string
+	Timeout       time.Duration
 }
 
 // MetricKeyPrefix interface for mackerelplugin
@@ -99,40 +134,334 @@ func (p McrouterPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "duration_us", Label: "Duration(us)", Diff: false},
 			},
 		},
+		"proxy_requests": {
+			Label: (labelPrefix + " Proxy Requests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "proxy_reqs_processing", Label: "Processing", Diff: false},
+				{Name: "proxy_reqs_waiting", Label: "Waiting", Diff: false},
+				{Name: "proxy_request_num_outstanding", Label: "Outstanding", Diff: false},
+				{Name: "dev_null_requests", Label: "Dev Null", Diff: true},
+			},
+		},
+		"get_out": {
+			Label: (labelPrefix + " Outgoing Get Requests"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "cmd_get_out_all", Label: "All", Diff: false},
+				{Name: "cmd_get_out_failover", Label: "Failover", Diff: false},
+			},
+		},
+		"failover": {
+			Label: (labelPrefix + " Failover Percentage"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "failover_percentage", Label: "Failover", Diff: false},
+			},
+		},
+		"servers_tko.#": {
+			Label: (labelPrefix + " Servers TKO"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "soft_tko", Label: "Soft TKO", Diff: false},
+				{Name: "hard_tko", Label: "Hard TKO", Diff: false},
+			},
+		},
+		"server_health.#": {
+			Label: (labelPrefix + " Server Health"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "state", Label: "State (0: healthy, 1: soft TKO, 2: hard TKO)", Diff: false},
+			},
+		},
+		"pool.#": {
+			Label: (labelPrefix + " Pool Requests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true},
+				{Name: "errors", Label: "Errors", Diff: false},
+			},
+		},
 	}
 }
 
 // FetchMetrics interface for mackerelplugin
 func (p McrouterPlugin) FetchMetrics() (map[string]interface{}, error) {
-	stats, err := readStatsFile(p.StatsFile)
+	stats, err := p.fetchStats()
 	if err != nil {
 		return nil, err
 	}
 
 	ret := make(map[string]interface{})
-	statsPrefix := strings.TrimSuffix(path.Base(p.StatsFile), ".stats")
 
 	// Get cmd_[operation]_count stats
 	for _, name := range cmdMetricNames {
-		key := fmt.Sprintf("%s.%s", statsPrefix, name)
-		ret[name] = stats[key]
+		ret[name] = stats[name]
 	}
 
 	// Get result_[reply result]_count stats
 	for _, name := range resultMetricNames {
-		key := fmt.Sprintf("%s.%s", statsPrefix, name)
-		ret[name] = stats[key]
+		ret[name] = stats[name]
 	}
 
 	// Get duration_us stats
 	for _, name := range []string{"duration_us"} {
-		key := fmt.Sprintf("%s.%s", statsPrefix, name)
-		ret[name] = stats[key]
+		ret[name] = stats[name]
+	}
+
+	// Get proxy request stats if available
+	for _, name := range append(proxyMetricNames, "dev_null_requests") {
+		if v, ok := stats[name]; ok {
+			ret[name] = v
+		}
+	}
+
+	// cmd_get_out_* are the rates per second, so the percentage is calculated from them directly
+	all, okAll := stats["cmd_get_out_all"]
+	failover, okFailover := stats["cmd_get_out_failover"]
+	if okAll {
+		ret["cmd_get_out_all"] = all
+	}
+	if okFailover {
+		ret["cmd_get_out_failover"] = failover
+	}
+	if okAll && okFailover && all > 0 {
+		ret["failover_percentage"] = failover / all * 100
+	}
+
+	for pool, stat := range poolStats(stats) {
+		for name, v := range stat {
+			ret["pool."+pool+"."+name] = v
+		}
+	}
+
+	if p.EnableServers {
+		servers, err := p.fetchServerStats()
+		if err != nil {
+			return nil, err
+		}
+		for server, tko := range servers {
+			for _, name := range tkoMetricNames {
+				ret["servers_tko."+server+"."+name] = tko[name]
+			}
+			ret["server_health."+server+".state"] = float64(serverHealthy)
+		}
+
+		suspects, err := p.fetchSuspectServers()
+		if err != nil {
+			return nil, err
+		}
+		for server, state := range suspects {
+			ret["server_health."+server+".state"] = float64(state)
+		}
 	}
 
 	return ret, nil
 }
 
+// fetchStats returns the stats keyed by the names without the prefix of the stats file like "libmcrouter.mcrouter.5000.",
+// from the stats file if given, or else by "stats all" from the mcrouter at the address
+func (p McrouterPlugin) fetchStats() (map[string]float64, error) {
+	if p.StatsFile == "" {
+		conn, err := p.command("stats all")
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		return parseStats(conn)
+	}
+
+	stats, err := readStatsFile(p.StatsFile)
+	if err != nil {
+		return nil, err
+	}
+	statsPrefix := strings.TrimSuffix(path.Base(p.StatsFile), ".stats") + "."
+	ret := make(map[string]float64, len(stats))
+	for key, v := range stats {
+		if strings.HasPrefix(key, statsPrefix) {
+			ret[strings.TrimPrefix(key, statsPrefix)] = v
+		}
+	}
+	return ret, nil
+}
+
+// command sends the command to the admin port of the mcrouter, and returns the connection to read the response
+func (p McrouterPlugin) command(cmd string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+
+	if _, err := fmt.Fprint(conn, cmd+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p McrouterPlugin) fetchServerStats() (map[string]map[string]float64, error) {
+	conn, err := p.command("stats servers")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return parseServerStats(conn)
+}
+
+func (p McrouterPlugin) fetchSuspectServers() (map[string]int, error) {
+	conn, err := p.command("stats suspect_servers")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return parseSuspectServers(conn)
+}
+
+// poolStats returns the stats of each pool from the keys like "pool.<name>.requests". The names of the pools are
+// normalized for the metric keys.
+func poolStats(stats map[string]float64) map[string]map[string]float64 {
+	pools := make(map[string]map[string]float64)
+	for key, v := range stats {
+		if !strings.HasPrefix(key, "pool.") {
+			continue
+		}
+		i := strings.LastIndex(key, ".")
+		pool, name := normalizeMetricNameRe.ReplaceAllString(key[len("pool."):i], "_"), key[i+1:]
+		if pool == "" {
+			continue
+		}
+		for _, n := range poolMetricNames {
+			if name != n {
+				continue
+			}
+			if _, ok := pools[pool]; !ok {
+				pools[pool] = make(map[string]float64)
+			}
+			pools[pool][name] += v
+		}
+	}
+	return pools
+}
+
+var serverProtocolRe = regexp.MustCompile(`:(ascii|caret|umbrella)(:.*)?$`)
+
+var normalizeMetricNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// serverKey returns the metric key of the server like "10_0_0_1_11211" from "10.0.0.1:11211:ascii:plain:notcompressed"
+func serverKey(name string) string {
+	return normalizeMetricNameRe.ReplaceAllString(serverProtocolRe.ReplaceAllString(name, ""), "_")
+}
+
+// parseServerStats parses the response of "stats servers", whose lines are like
+// "STAT 10.0.0.1:11211:ascii:plain:notcompressed avg_latency_us:302.000 pending_reqs:0 inflight_reqs:0 up:4; soft_tko:1"
+func parseServerStats(r io.Reader) (map[string]map[string]float64, error) {
+	servers := make(map[string]map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "END" {
+			return servers, nil
+		}
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+			return nil, fmt.Errorf("failed to get servers stats: %s", line)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "STAT" {
+			continue
+		}
+		stat := make(map[string]float64)
+		for _, field := range fields[2:] {
+			kv := strings.SplitN(strings.TrimSuffix(field, ";"), ":", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				continue
+			}
+			stat[kv[0]] = v
+		}
+		key := serverKey(fields[1])
+		if s, ok := servers[key]; ok {
+			for k, v := range stat {
+				s[k] += v
+			}
+			continue
+		}
+		servers[key] = stat
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unexpected end of servers stats")
+}
+
+// parseStats parses the response of "stats all", whose lines are like "STAT cmd_get_count 1380598681"
+func parseStats(r io.Reader) (map[string]float64, error) {
+	stats := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "END" {
+			return stats, nil
+		}
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+			return nil, fmt.Errorf("failed to get stats: %s", line)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		stats[fields[1]] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unexpected end of stats")
+}
+
+// parseSuspectServers parses the response of "stats suspect_servers", whose lines are like
+// "STAT 10.0.0.1:11211 status:tko num_failures:3", and returns the states of the servers. The servers with failures but
+// not marked as TKO are healthy.
+func parseSuspectServers(r io.Reader) (map[string]int, error) {
+	servers := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "END" {
+			return servers, nil
+		}
+		if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+			return nil, fmt.Errorf("failed to get suspect servers: %s", line)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "STAT" {
+			continue
+		}
+		status := strings.ToLower(strings.Join(fields[2:], " "))
+		state := serverHealthy
+		switch {
+		case strings.Contains(status, "hard"):
+			state = serverHardTKO
+		case strings.Contains(status, "tko"):
+			state = serverSoftTKO
+		}
+		key := serverKey(fields[1])
+		if s, ok := servers[key]; !ok || state > s {
+			servers[key] = state
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unexpected end of suspect servers")
+}
+
 func readStatsFile(statsFile string) (map[string]float64, error) {
 	data, err := ioutil.ReadFile(statsFile)
 	if err != nil {
@@ -148,31 +477,43 @@ func readStatsFile(statsFile string) (map[string]float64, error) {
 	return stats, nil
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the stats file and the address
+func (p McrouterPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "mcrouter", p.StatsFile, p.Address)
+}
+
 // Do the plugin
 func Do() {
 	var (
-		optStatsFile = flag.String("stats-file", "", "Mcrouter stats file")
+		optStatsFile = flag.String("stats-file", "", "Mcrouter stats file. The stats are fetched by \"stats all\" from -address if not given")
 		optPrefix    = flag.String("metric-key-prefix", "mcrouter", "Metric key prefix")
+		optServers   = flag.Bool("enable-servers", false, "Enable TKO metrics of each server from \"stats servers\" and \"stats suspect_servers\"")
+		optAddress   = flag.String("address", "localhost:5000", "Mcrouter address for the admin commands")
+		optTimeout   = flag.Duration("timeout", 5*time.Second, "Timeout")
+		optTempfile  = flag.String("tempfile", "", "Temp file name")
 	)
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s -stats-file /path/to/mcrouter.stats [OPTIONS]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [-stats-file /path/to/mcrouter.stats] [OPTIONS]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 
-	if *optStatsFile == "" {
-		flag.Usage()
-		os.Exit(1)
-	}
-	if _, err := os.Stat(*optStatsFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Stats file not found\n")
-		flag.Usage()
-		os.Exit(1)
+	if *optStatsFile != "" {
+		if _, err := os.Stat(*optStatsFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Stats file not found\n")
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 
-	helper := mp.NewMackerelPlugin(McrouterPlugin{
-		Prefix:    *optPrefix,
-		StatsFile: *optStatsFile,
-	})
+	mcrouter := McrouterPlugin{
+		Prefix:        *optPrefix,
+		StatsFile:     *optStatsFile,
+		EnableServers: *optServers,
+		Address:       *optAddress,
+		Timeout:       *optTimeout,
+	}
+	helper := mp.NewMackerelPlugin(mcrouter)
+	helper.Tempfile = mcrouter.tempfile(*optTempfile)
 	helper.Run()
 }
@@ -1,7 +1,11 @@
 package mpmcrouter
 
 import (
+	"bufio"
+	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFetchMetrics(t *testing.T) {
@@ -35,6 +39,15 @@ func TestFetchMetrics(t *testing.T) {
 		"result_tko_all_count":             float64(530113),
 		"result_tko_count":                 float64(406731),
 		"duration_us":                      float64(2653.1359895317773),
+		"proxy_reqs_processing":            float64(365),
+		"proxy_reqs_waiting":               float64(0),
+		"proxy_request_num_outstanding":    float64(364),
+		"dev_null_requests":                float64(0),
+		"cmd_get_out_all":                  float64(72387.79583333334),
+		"pool.A.requests":                  float64(184723),
+		"pool.A.errors":                    float64(12),
+		"pool.shared_eu-west.requests":     float64(5321),
+		"pool.shared_eu-west.errors":       float64(0),
 	}
 
 	p := &McrouterPlugin{
@@ -58,3 +71,188 @@ func TestFetchMetrics(t *testing.T) {
 		}
 	}
 }
+
+var serverStatsStub = `STAT 10.0.0.1:11211:ascii:plain:notcompressed avg_latency_us:302.000 pending_reqs:0 inflight_reqs:0 up:4; soft_tko:1
+STAT 10.0.0.2:11211:ascii:plain:notcompressed avg_latency_us:0.000 pending_reqs:0 inflight_reqs:0 hard_tko:2
+STAT [::1]:11211:caret:plain:notcompressed avg_latency_us:120.500 pending_reqs:1 inflight_reqs:1 up:3
+END
+`
+
+func TestParseServerStats(t *testing.T) {
+	servers, err := parseServerStats(strings.NewReader(serverStatsStub))
+	if err != nil {
+		t.Fatalf("Failed to parseServerStats: %s", err)
+	}
+
+	expected := map[string]map[string]float64{
+		"10_0_0_1_11211": {"avg_latency_us": 302, "pending_reqs": 0, "inflight_reqs": 0, "up": 4, "soft_tko": 1},
+		"10_0_0_2_11211": {"avg_latency_us": 0, "pending_reqs": 0, "inflight_reqs": 0, "hard_tko": 2},
+		"___1__11211":    {"avg_latency_us": 120.5, "pending_reqs": 1, "inflight_reqs": 1, "up": 3},
+	}
+	for server, stat := range expected {
+		got, ok := servers[server]
+		if !ok {
+			t.Errorf("stats of %s cannot be parsed", server)
+			continue
+		}
+		for key, v := range stat {
+			if got[key] != v {
+				t.Errorf("%s of %s should be %v, but %v", key, server, v, got[key])
+			}
+		}
+	}
+
+	if _, err := parseServerStats(strings.NewReader("ERROR\r\n")); err == nil {
+		t.Errorf("parseServerStats should return error against ERROR")
+	}
+}
+
+var suspectServersStub = `STAT 10.0.0.2:11211 status:hard TKO; num_failures:5
+STAT 10.0.0.3:11211 status:soft TKO; num_failures:3
+STAT 10.0.0.4:11211 status:down num_failures:1
+END
+`
+
+func TestParseSuspectServers(t *testing.T) {
+	servers, err := parseSuspectServers(strings.NewReader(suspectServersStub))
+	if err != nil {
+		t.Fatalf("Failed to parseSuspectServers: %s", err)
+	}
+
+	expected := map[string]int{
+		"10_0_0_2_11211": serverHardTKO,
+		"10_0_0_3_11211": serverSoftTKO,
+		"10_0_0_4_11211": serverHealthy,
+	}
+	if len(servers) != len(expected) {
+		t.Errorf("states of %d servers should be parsed, but %d", len(expected), len(servers))
+	}
+	for server, state := range expected {
+		if servers[server] != state {
+			t.Errorf("state of %s should be %d, but %d", server, state, servers[server])
+		}
+	}
+
+	if _, err := parseSuspectServers(strings.NewReader("ERROR\r\n")); err == nil {
+		t.Errorf("parseSuspectServers should return error against ERROR")
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	pools := poolStats(map[string]float64{
+		"pool.A.requests":      10,
+		"pool.A.errors":        1,
+		"pool.A.latency_us":    300,
+		"pool.10.0.0.1.errors": 2,
+		"cmd_get_count":        100,
+	})
+	if len(pools) != 2 {
+		t.Errorf("stats of 2 pools should be returned, but %v", pools)
+	}
+	if pools["A"]["requests"] != 10 || pools["A"]["errors"] != 1 {
+		t.Errorf("unexpected stats of the pool A: %v", pools["A"])
+	}
+	if _, ok := pools["A"]["latency_us"]; ok {
+		t.Errorf("latency_us of the pool A should not be returned")
+	}
+	if pools["10_0_0_1"]["errors"] != 2 {
+		t.Errorf("unexpected stats of the pool 10_0_0_1: %v", pools["10_0_0_1"])
+	}
+}
+
+// serveAdminStub serves the responses of the admin commands until the listener is closed
+func serveAdminStub(ln net.Listener, responses map[string]string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if res, ok := responses[strings.TrimSpace(line)]; ok {
+				conn.Write([]byte(res))
+			} else {
+				conn.Write([]byte("ERROR\r\n"))
+			}
+		}(conn)
+	}
+}
+
+func TestFetchMetricsFromAdminPort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAdminStub(ln, map[string]string{
+		"stats all": "STAT version 0.40.0\r\nSTAT cmd_get_count 1000\r\nSTAT pool.A.requests 42\r\nEND\r\n",
+	})
+
+	p := &McrouterPlugin{
+		Address: ln.Addr().String(),
+		Timeout: time.Second,
+	}
+	metrics, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("Failed to FetchMetrics: %s", err)
+	}
+	if metrics["cmd_get_count"] != float64(1000) {
+		t.Errorf("cmd_get_count should be 1000, but %v", metrics["cmd_get_count"])
+	}
+	if metrics["pool.A.requests"] != float64(42) {
+		t.Errorf("pool.A.requests should be 42, but %v", metrics["pool.A.requests"])
+	}
+}
+
+func TestFetchMetricsWithServers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveAdminStub(ln, map[string]string{
+		"stats servers":         serverStatsStub,
+		"stats suspect_servers": suspectServersStub,
+	})
+
+	p := &McrouterPlugin{
+		StatsFile:     "testdata/libmcrouter.mcrouter.6000.stats",
+		EnableServers: true,
+		Address:       ln.Addr().String(),
+		Timeout:       time.Second,
+	}
+	metrics, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("Failed to FetchMetrics: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"servers_tko.10_0_0_1_11211.soft_tko": float64(1),
+		"servers_tko.10_0_0_1_11211.hard_tko": float64(0),
+		"servers_tko.10_0_0_2_11211.hard_tko": float64(2),
+		"server_health.10_0_0_1_11211.state":  float64(serverHealthy),
+		"server_health.10_0_0_2_11211.state":  float64(serverHardTKO),
+		"server_health.10_0_0_3_11211.state":  float64(serverSoftTKO),
+	}
+	for key, expectedValue := range expected {
+		if gotValue := metrics[key]; gotValue != expectedValue {
+			t.Errorf("metric of %s should be %v, but %v", key, expectedValue, gotValue)
+		}
+	}
+}
+
+func TestTempfile(t *testing.T) {
+	p := McrouterPlugin{StatsFile: "/var/mcrouter/stats/libmcrouter.mcrouter.5000.stats", Address: "localhost:5000"}
+	for field, other := range map[string]McrouterPlugin{
+		"StatsFile": {StatsFile: "/var/mcrouter/stats/libmcrouter.mcrouter.5001.stats", Address: "localhost:5000"},
+		"Address":   {StatsFile: "/var/mcrouter/stats/libmcrouter.mcrouter.5000.stats", Address: "localhost:5001"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/mcrouter.json"); f != "/tmp/mcrouter.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
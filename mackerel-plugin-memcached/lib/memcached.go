@@ -7,10 +7,12 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // MemcachedPlugin mackerel plugin for memchached
@@ -19,6 +21,10 @@ type MemcachedPlugin struct {
 	Socket   string
 	Tempfile string
 	Prefix   string
+	// EnableSlabs posts the statistics of each slab class from `stats slabs` and `stats items`
+	EnableSlabs bool
+	// lastStat are the values of the last run saved in the tempfile, for get_hit_rate
+	lastStat map[string]float64
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -49,6 +55,7 @@ func (m MemcachedPlugin) FetchMetrics() (map[string]float64, error) {
 	if err != nil {
 		return nil, err
 	}
+	setHitRate(ret, m.lastStat)
 	ret2, err := m.parseStatsItems(conn)
 	if err != nil {
 		log.Printf("failed to get stats items: %s", err.Error())
@@ -57,9 +64,43 @@ func (m MemcachedPlugin) FetchMetrics() (map[string]float64, error) {
 			ret[k] = v
 		}
 	}
+	if m.EnableSlabs {
+		ret3, err := m.parseStatsSlabs(conn)
+		if err != nil {
+			log.Printf("failed to get stats slabs: %s", err.Error())
+		} else {
+			for k, v := range ret3 {
+				ret[k] = v
+			}
+		}
+	}
 	return ret, nil
 }
 
+// setHitRate sets get_hit_rate as the percentage of get_hits in the gets since the last run.
+// It is not set when there were no gets, or when the counters are reset by the restart of memcached.
+func setHitRate(stat, lastStat map[string]float64) {
+	hits, ok1 := stat["get_hits"]
+	misses, ok2 := stat["get_misses"]
+	lastHits, ok3 := lastStat["get_hits"]
+	lastMisses, ok4 := lastStat["get_misses"]
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return
+	}
+	dh := hits - lastHits
+	dm := misses - lastMisses
+	if dh < 0 || dm < 0 || dh+dm == 0 {
+		return
+	}
+	stat["get_hit_rate"] = 100.0 * dh / (dh + dm)
+}
+
+// slabsItemsKeys are the fields of the slab classes in `stats items` posted with -enable-slabs
+var slabsItemsKeys = map[string]string{
+	"evicted":      "slabs",
+	"evicted_time": "slabs_evicted_time",
+}
+
 func (m MemcachedPlugin) parseStatsItems(conn io.ReadWriter) (map[string]float64, error) {
 	ret := make(map[string]float64)
 	fmt.Fprint(conn, "stats items\r\n")
@@ -84,10 +125,64 @@ func (m MemcachedPlugin) parseStatsItems(conn io.ReadWriter) (map[string]float64
 				ret["nonzero_evictions"] += value
 			}
 		}
+		if graph, ok := slabsItemsKeys[fields2[2]]; ok && m.EnableSlabs {
+			value, err := strconv.ParseFloat(fields[2], 64)
+			if err == nil {
+				ret[graph+"."+fields2[1]+"."+fields2[2]] = value
+			}
+		}
 	}
 	return ret, scr.Err()
 }
 
+// parseStatsSlabs returns chunk_size, used_chunks and free_chunks of each slab class in `stats slabs`,
+// with used_chunks_ratio as the percentage of used_chunks in total_chunks.
+// The classes without any pages are not listed by memcached, and are not posted.
+func (m MemcachedPlugin) parseStatsSlabs(conn io.ReadWriter) (map[string]float64, error) {
+	ret := make(map[string]float64)
+	totalChunks := make(map[string]float64)
+	fmt.Fprint(conn, "stats slabs\r\n")
+	scr := bufio.NewScanner(bufio.NewReader(conn))
+	for scr.Scan() {
+		// ex. STAT 1:chunk_size 96
+		line := scr.Text()
+		if line == "END" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("result of `stats slabs` is strange: %s", line)
+		}
+		fields2 := strings.Split(fields[1], ":")
+		if len(fields2) != 2 {
+			// the totals such as active_slabs and total_malloced
+			continue
+		}
+		class, key := fields2[0], fields2[1]
+		value, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "chunk_size":
+			ret["slabs_chunk_size."+class+".chunk_size"] = value
+		case "used_chunks", "free_chunks":
+			ret["slabs_chunks."+class+"."+key] = value
+		case "total_chunks":
+			totalChunks[class] = value
+		}
+	}
+	if err := scr.Err(); err != nil {
+		return nil, err
+	}
+	for class, total := range totalChunks {
+		if used, ok := ret["slabs_chunks."+class+".used_chunks"]; ok && total > 0 {
+			ret["slabs."+class+".used_chunks_ratio"] = 100.0 * used / total
+		}
+	}
+	return ret, nil
+}
+
 func (m MemcachedPlugin) parseStats(conn io.Reader) (map[string]float64, error) {
 	scanner := bufio.NewScanner(conn)
 	stat := make(map[string]float64)
@@ -151,6 +246,15 @@ func (m MemcachedPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "cas_misses", Label: "Cas Misses", Diff: true},
 				{Name: "touch_hits", Label: "Touch Hits", Diff: true},
 				{Name: "touch_misses", Label: "Touch Misses", Diff: true},
+				{Name: "get_expired", Label: "Get Expired", Diff: true},
+				{Name: "get_flushed", Label: "Get Flushed", Diff: true},
+			},
+		},
+		"hit_rate": {
+			Label: (labelPrefix + " Hit Rate"),
+			Unit:  mp.UnitPercentage,
+			Metrics: []mp.Metrics{
+				{Name: "get_hit_rate", Label: "Get Hit Rate"},
 			},
 		},
 		"evictions": {
@@ -203,9 +307,46 @@ func (m MemcachedPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+	if m.EnableSlabs {
+		graphdef["slabs.#"] = mp.Graphs{
+			Label: (labelPrefix + " Slab Class"),
+			Unit:  mp.UnitFloat,
+			Metrics: []mp.Metrics{
+				{Name: "evicted", Label: "Evicted", Diff: true},
+				{Name: "used_chunks_ratio", Label: "Used Chunks (%)"},
+			},
+		}
+		graphdef["slabs_chunks.#"] = mp.Graphs{
+			Label: (labelPrefix + " Slab Class Chunks"),
+			Unit:  mp.UnitInteger,
+			Metrics: []mp.Metrics{
+				{Name: "used_chunks", Label: "Used", Stacked: true},
+				{Name: "free_chunks", Label: "Free", Stacked: true},
+			},
+		}
+		graphdef["slabs_chunk_size.#"] = mp.Graphs{
+			Label: (labelPrefix + " Slab Class Chunk Size"),
+			Unit:  mp.UnitBytes,
+			Metrics: []mp.Metrics{
+				{Name: "chunk_size", Label: "Chunk Size"},
+			},
+		}
+		graphdef["slabs_evicted_time.#"] = mp.Graphs{
+			Label: (labelPrefix + " Slab Class Evicted Time"),
+			Unit:  mp.UnitInteger,
+			Metrics: []mp.Metrics{
+				{Name: "evicted_time", Label: "Seconds since the last access of the last evicted"},
+			},
+		}
+	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the target or the socket
+func (m MemcachedPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "memcached", m.Target, m.Socket)
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
@@ -213,11 +354,13 @@ func Do() {
 	optSocket := flag.String("socket", "", "Server socket (overrides hosts and port)")
 	optPrefix := flag.String("metric-key-prefix", "memcached", "Metric key prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optEnableSlabs := flag.Bool("enable-slabs", false, "Enable the statistics of each slab class")
 	flag.Parse()
 
 	var memcached MemcachedPlugin
 
 	memcached.Prefix = *optPrefix
+	memcached.EnableSlabs = *optEnableSlabs
 
 	if *optSocket != "" {
 		memcached.Socket = *optSocket
@@ -225,6 +368,11 @@ func Do() {
 		memcached.Target = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	}
 	helper := mp.NewMackerelPlugin(memcached)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = memcached.tempfile(*optTempfile)
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		// the counters of the last run are read before the helper overwrites them
+		memcached.lastStat, _, _ = helper.FetchLastValues()
+		helper.Plugin = memcached
+	}
 	helper.Run()
 }
@@ -12,8 +12,8 @@ func TestGraphDefinition(t *testing.T) {
 	var memcached MemcachedPlugin
 
 	graphdef := memcached.GraphDefinition()
-	if len(graphdef) != 9 {
-		t.Errorf("GetTempfilename: %d should be 9", len(graphdef))
+	if len(graphdef) != 10 {
+		t.Errorf("GetTempfilename: %d should be 10", len(graphdef))
 	}
 }
 
@@ -65,3 +65,112 @@ END
 	// Memcached Stats
 	assert.EqualValues(t, stat["get_hits"], 2769383483)
 }
+
+func TestGraphDefinition_EnableSlabs(t *testing.T) {
+	memcached := MemcachedPlugin{EnableSlabs: true}
+
+	graphdef := memcached.GraphDefinition()
+	if len(graphdef) != 14 {
+		t.Errorf("GraphDefinition: %d should be 14", len(graphdef))
+	}
+	assert.Contains(t, graphdef, "slabs.#")
+}
+
+func TestParseStatsSlabs(t *testing.T) {
+	memcached := MemcachedPlugin{EnableSlabs: true}
+	stub := `STAT 1:chunk_size 96
+STAT 1:chunks_per_page 10922
+STAT 1:total_pages 1
+STAT 1:total_chunks 10922
+STAT 1:used_chunks 2731
+STAT 1:free_chunks 8191
+STAT 1:free_chunks_end 0
+STAT 5:chunk_size 240
+STAT 5:total_chunks 4369
+STAT 5:used_chunks 4369
+STAT 5:free_chunks 0
+STAT active_slabs 2
+STAT total_malloced 2097152
+END
+`
+
+	stat, err := memcached.parseStatsSlabs(bytes.NewBufferString(stub))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 96, stat["slabs_chunk_size.1.chunk_size"])
+	assert.EqualValues(t, 2731, stat["slabs_chunks.1.used_chunks"])
+	assert.EqualValues(t, 8191, stat["slabs_chunks.1.free_chunks"])
+	assert.InDelta(t, 25.0, stat["slabs.1.used_chunks_ratio"], 0.01)
+	assert.EqualValues(t, 100, stat["slabs.5.used_chunks_ratio"])
+	// the classes not listed are not posted
+	_, ok := stat["slabs.2.used_chunks_ratio"]
+	assert.False(t, ok)
+	_, ok = stat["active_slabs"]
+	assert.False(t, ok)
+}
+
+func TestParseStatsItems(t *testing.T) {
+	stub := `STAT items:1:number 2731
+STAT items:1:evicted 12
+STAT items:1:evicted_nonzero 3
+STAT items:1:evicted_time 1800
+STAT items:5:number 4369
+STAT items:5:evicted 30
+STAT items:5:evicted_nonzero 4
+STAT items:5:evicted_time 60
+END
+`
+
+	stat, err := MemcachedPlugin{}.parseStatsItems(bytes.NewBufferString(stub))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, stat["nonzero_evictions"])
+	_, ok := stat["slabs.1.evicted"]
+	assert.False(t, ok, "the slab classes should be posted only with -enable-slabs")
+
+	stat, err = MemcachedPlugin{EnableSlabs: true}.parseStatsItems(bytes.NewBufferString(stub))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 7, stat["nonzero_evictions"])
+	assert.EqualValues(t, 12, stat["slabs.1.evicted"])
+	assert.EqualValues(t, 30, stat["slabs.5.evicted"])
+	assert.EqualValues(t, 1800, stat["slabs_evicted_time.1.evicted_time"])
+}
+
+func TestSetHitRate(t *testing.T) {
+	last := map[string]float64{"get_hits": 100, "get_misses": 50}
+
+	stat := map[string]float64{"get_hits": 190, "get_misses": 60}
+	setHitRate(stat, last)
+	assert.EqualValues(t, 90, stat["get_hit_rate"])
+
+	// no gets in the interval
+	stat = map[string]float64{"get_hits": 100, "get_misses": 50}
+	setHitRate(stat, last)
+	_, ok := stat["get_hit_rate"]
+	assert.False(t, ok, "get_hit_rate should not be posted without gets")
+
+	// the counters reset by the restart
+	stat = map[string]float64{"get_hits": 10, "get_misses": 5}
+	setHitRate(stat, last)
+	_, ok = stat["get_hit_rate"]
+	assert.False(t, ok, "get_hit_rate should not be posted after the restart")
+
+	// the first run without the tempfile
+	stat = map[string]float64{"get_hits": 10, "get_misses": 5}
+	setHitRate(stat, nil)
+	_, ok = stat["get_hit_rate"]
+	assert.False(t, ok, "get_hit_rate should not be posted without the last values")
+}
+
+func TestTempfile(t *testing.T) {
+	p := MemcachedPlugin{Target: "localhost:11211"}
+	for field, other := range map[string]MemcachedPlugin{
+		"Target": {Target: "localhost:11212"},
+		"Socket": {Socket: "/tmp/memcached.sock"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/memcached.json"); f != "/tmp/memcached.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
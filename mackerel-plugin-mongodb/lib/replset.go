@@ -0,0 +1,149 @@
+package mpmongodb
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// the states of the members in replSetGetStatus
+const (
+	memberStatePrimary = 1
+	memberStateArbiter = 7
+)
+
+// memberNameRe matches the characters not allowed in the metric names, e.g. the dots and the colon of host:port
+var memberNameRe = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+var replSetGraphdef = map[string]mp.Graphs{
+	"mongodb.replset.member.#": {
+		Label: "MongoDB Replica Set Member",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "state", Label: "State"},
+			{Name: "lag", Label: "Replication Lag (sec)"},
+		},
+	},
+}
+
+// fetchReplSetStatus returns the state and the lag of each member of the replica set, or nothing for a standalone mongod.
+// The failures are warned without failing the metrics of serverStatus, since the commands may not be allowed for the user.
+func (m MongoDBPlugin) fetchReplSetStatus(ctx context.Context, client *mongo.Client, serverStatus bson.M) map[string]interface{} {
+	repl, ok := serverStatus["repl"].(bson.M)
+	if !ok {
+		return nil
+	}
+	if _, ok := repl["setName"]; !ok {
+		return nil
+	}
+
+	admin := client.Database("admin")
+	status := bson.M{}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).Decode(&status); err != nil {
+		logger.Warningf("Failed to run replSetGetStatus: %s", err)
+		return nil
+	}
+
+	// hidden members are found only in the config, which is used as far as it is allowed
+	config := bson.M{}
+	if err := admin.RunCommand(ctx, bson.D{{Key: "replSetGetConfig", Value: 1}}).Decode(&config); err != nil {
+		logger.Warningf("Failed to run replSetGetConfig: %s", err)
+	}
+	return parseReplSetStatus(status, hiddenMembers(config))
+}
+
+// hiddenMembers returns the hosts of the hidden members in the result of replSetGetConfig
+func hiddenMembers(config bson.M) map[string]bool {
+	hidden := make(map[string]bool)
+	c, ok := config["config"].(bson.M)
+	if !ok {
+		return hidden
+	}
+	members, _ := c["members"].(bson.A)
+	for _, v := range members {
+		member, ok := v.(bson.M)
+		if !ok {
+			continue
+		}
+		if h, _ := member["hidden"].(bool); h {
+			if host, ok := member["host"].(string); ok {
+				hidden[host] = true
+			}
+		}
+	}
+	return hidden
+}
+
+// parseReplSetStatus returns the state of each member, and its lag behind the optimeDate of the primary.
+// The lags of the arbiters and the hidden members are omitted, and so are all the lags while there is no primary.
+func parseReplSetStatus(status bson.M, hidden map[string]bool) map[string]interface{} {
+	members, _ := status["members"].(bson.A)
+
+	var primaryOptime time.Time
+	hasPrimary := false
+	for _, v := range members {
+		member, ok := v.(bson.M)
+		if !ok {
+			continue
+		}
+		if state, ok := toFloat64(member["state"]); ok && state == memberStatePrimary {
+			primaryOptime, hasPrimary = toTime(member["optimeDate"])
+			break
+		}
+	}
+
+	stat := make(map[string]interface{})
+	for _, v := range members {
+		member, ok := v.(bson.M)
+		if !ok {
+			continue
+		}
+		name, ok := member["name"].(string)
+		if !ok {
+			continue
+		}
+		state, ok := toFloat64(member["state"])
+		if !ok {
+			continue
+		}
+		prefix := "mongodb.replset.member." + memberNameRe.ReplaceAllString(name, "_")
+		stat[prefix+".state"] = state
+
+		if !hasPrimary || state == memberStateArbiter || hidden[name] {
+			continue
+		}
+		optime, ok := toTime(member["optimeDate"])
+		if !ok {
+			continue
+		}
+		stat[prefix+".lag"] = primaryOptime.Sub(optime).Seconds()
+	}
+	return stat
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return t.Time(), true
+	case time.Time:
+		return t, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,62 @@
+package mpmongodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseReplSetStatus(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	status := bson.M{
+		"set": "rs0",
+		"members": bson.A{
+			bson.M{"name": "db1.example.com:27017", "state": int32(1), "optimeDate": primitive.NewDateTimeFromTime(now)},
+			bson.M{"name": "db2.example.com:27017", "state": int32(2), "optimeDate": primitive.NewDateTimeFromTime(now.Add(-3 * time.Second))},
+			bson.M{"name": "db3.example.com:27017", "state": int32(2), "optimeDate": primitive.NewDateTimeFromTime(now.Add(-10 * time.Second))},
+			bson.M{"name": "arbiter.example.com:27017", "state": int32(7)},
+		},
+	}
+	stat := parseReplSetStatus(status, map[string]bool{"db3.example.com:27017": true})
+
+	assert.EqualValues(t, 1, stat["mongodb.replset.member.db1_example_com_27017.state"])
+	assert.EqualValues(t, 0, stat["mongodb.replset.member.db1_example_com_27017.lag"])
+	assert.EqualValues(t, 2, stat["mongodb.replset.member.db2_example_com_27017.state"])
+	assert.EqualValues(t, 3, stat["mongodb.replset.member.db2_example_com_27017.lag"])
+	assert.EqualValues(t, 2, stat["mongodb.replset.member.db3_example_com_27017.state"])
+	assert.NotContains(t, stat, "mongodb.replset.member.db3_example_com_27017.lag", "the lag of the hidden member should be omitted")
+	assert.EqualValues(t, 7, stat["mongodb.replset.member.arbiter_example_com_27017.state"])
+	assert.NotContains(t, stat, "mongodb.replset.member.arbiter_example_com_27017.lag", "the lag of the arbiter should be omitted")
+}
+
+func TestParseReplSetStatusWithoutPrimary(t *testing.T) {
+	status := bson.M{
+		"members": bson.A{
+			bson.M{"name": "db1:27017", "state": int32(2), "optimeDate": primitive.NewDateTimeFromTime(time.Now())},
+			bson.M{"name": "db2:27017", "state": int32(8)},
+		},
+	}
+	stat := parseReplSetStatus(status, nil)
+
+	assert.Equal(t, map[string]interface{}{
+		"mongodb.replset.member.db1_27017.state": 2.0,
+		"mongodb.replset.member.db2_27017.state": 8.0,
+	}, stat)
+}
+
+func TestHiddenMembers(t *testing.T) {
+	config := bson.M{
+		"config": bson.M{
+			"members": bson.A{
+				bson.M{"host": "db1:27017", "hidden": false},
+				bson.M{"host": "db2:27017", "hidden": true},
+				bson.M{"host": "db3:27017"},
+			},
+		},
+	}
+	assert.Equal(t, map[string]bool{"db2:27017": true}, hiddenMembers(config))
+	assert.Len(t, hiddenMembers(bson.M{}), 0)
+}
@@ -0,0 +1,102 @@
+package mpmongodb
+
+import (
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+var wiredTigerGraphdef = map[string]mp.Graphs{
+	"mongodb.wiredtiger_cache": {
+		Label: "MongoDB WiredTiger Cache",
+		Unit:  "bytes",
+		Metrics: []mp.Metrics{
+			{Name: "wiredtiger_cache_bytes", Label: "In the cache"},
+			{Name: "wiredtiger_cache_dirty_bytes", Label: "Dirty"},
+			{Name: "wiredtiger_cache_max_bytes", Label: "Maximum"},
+		},
+	},
+	"mongodb.wiredtiger_cache_usage": {
+		Label: "MongoDB WiredTiger Cache Usage",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "wiredtiger_cache_used_percentage", Label: "Used"},
+		},
+	},
+	"mongodb.wiredtiger_evicted": {
+		Label: "MongoDB WiredTiger Pages Evicted",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "wiredtiger_pages_evicted_modified", Label: "Modified", Diff: true, Type: "uint64"},
+			{Name: "wiredtiger_pages_evicted_unmodified", Label: "Unmodified", Diff: true, Type: "uint64"},
+		},
+	},
+	"mongodb.wiredtiger_tickets": {
+		Label: "MongoDB WiredTiger Tickets",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "wiredtiger_read_tickets_available", Label: "Read Available"},
+			{Name: "wiredtiger_read_tickets_out", Label: "Read Out"},
+			{Name: "wiredtiger_write_tickets_available", Label: "Write Available"},
+			{Name: "wiredtiger_write_tickets_out", Label: "Write Out"},
+		},
+	},
+}
+
+// metricPlaceWiredTiger has the places of each metric in serverStatus tried in order, since the tickets are moved
+// from wiredTiger.concurrentTransactions to queues.execution in MongoDB 7.0.
+// ref. https://www.mongodb.com/docs/manual/reference/command/serverStatus/#wiredtiger
+var metricPlaceWiredTiger = map[string][][]string{
+	"wiredtiger_cache_bytes": {
+		{"wiredTiger", "cache", "bytes currently in the cache"},
+	},
+	"wiredtiger_cache_dirty_bytes": {
+		{"wiredTiger", "cache", "tracked dirty bytes in the cache"},
+	},
+	"wiredtiger_cache_max_bytes": {
+		{"wiredTiger", "cache", "maximum bytes configured"},
+	},
+	"wiredtiger_pages_evicted_modified": {
+		{"wiredTiger", "cache", "modified pages evicted"},
+	},
+	"wiredtiger_pages_evicted_unmodified": {
+		{"wiredTiger", "cache", "unmodified pages evicted"},
+	},
+	"wiredtiger_read_tickets_available": {
+		{"wiredTiger", "concurrentTransactions", "read", "available"},
+		{"queues", "execution", "read", "available"},
+	},
+	"wiredtiger_read_tickets_out": {
+		{"wiredTiger", "concurrentTransactions", "read", "out"},
+		{"queues", "execution", "read", "out"},
+	},
+	"wiredtiger_write_tickets_available": {
+		{"wiredTiger", "concurrentTransactions", "write", "available"},
+		{"queues", "execution", "write", "available"},
+	},
+	"wiredtiger_write_tickets_out": {
+		{"wiredTiger", "concurrentTransactions", "write", "out"},
+		{"queues", "execution", "write", "out"},
+	},
+}
+
+// parseWiredTiger returns the metrics of WiredTiger found in serverStatus, which has none of them for the other
+// storage engines, with the percentage of the cache used in the maximum bytes configured
+func parseWiredTiger(serverStatus map[string]interface{}) map[string]interface{} {
+	stat := make(map[string]interface{})
+	for k, places := range metricPlaceWiredTiger {
+		for _, v := range places {
+			if val, err := getFloatValue(serverStatus, v); err == nil {
+				stat[k] = val
+				break
+			}
+		}
+	}
+
+	used, ok := stat["wiredtiger_cache_bytes"].(float64)
+	if !ok {
+		return stat
+	}
+	if max, ok := stat["wiredtiger_cache_max_bytes"].(float64); ok && max > 0 {
+		stat["wiredtiger_cache_used_percentage"] = 100.0 * used / max
+	}
+	return stat
+}
@@ -0,0 +1,71 @@
+package mpmongodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseWiredTiger(t *testing.T) {
+	serverStatus := bson.M{
+		"version": "6.0.5",
+		"wiredTiger": bson.M{
+			"cache": bson.M{
+				"bytes currently in the cache":     int64(256 * 1024 * 1024),
+				"maximum bytes configured":         int64(1024 * 1024 * 1024),
+				"tracked dirty bytes in the cache": int64(1024),
+				"modified pages evicted":           int64(12),
+				"unmodified pages evicted":         int64(34),
+			},
+			"concurrentTransactions": bson.M{
+				"read":  bson.M{"out": int32(1), "available": int32(127), "totalTickets": int32(128)},
+				"write": bson.M{"out": int32(2), "available": int32(126), "totalTickets": int32(128)},
+			},
+		},
+	}
+	stat := parseWiredTiger(serverStatus)
+
+	assert.EqualValues(t, 256*1024*1024, stat["wiredtiger_cache_bytes"])
+	assert.EqualValues(t, 1024*1024*1024, stat["wiredtiger_cache_max_bytes"])
+	assert.EqualValues(t, 1024, stat["wiredtiger_cache_dirty_bytes"])
+	assert.EqualValues(t, 25, stat["wiredtiger_cache_used_percentage"])
+	assert.EqualValues(t, 12, stat["wiredtiger_pages_evicted_modified"])
+	assert.EqualValues(t, 34, stat["wiredtiger_pages_evicted_unmodified"])
+	assert.EqualValues(t, 127, stat["wiredtiger_read_tickets_available"])
+	assert.EqualValues(t, 1, stat["wiredtiger_read_tickets_out"])
+	assert.EqualValues(t, 126, stat["wiredtiger_write_tickets_available"])
+	assert.EqualValues(t, 2, stat["wiredtiger_write_tickets_out"])
+}
+
+func TestParseWiredTigerQueues(t *testing.T) {
+	// the tickets are moved to queues.execution in MongoDB 7.0
+	serverStatus := bson.M{
+		"version": "7.0.2",
+		"wiredTiger": bson.M{
+			"cache": bson.M{
+				"bytes currently in the cache": int64(100),
+			},
+		},
+		"queues": bson.M{
+			"execution": bson.M{
+				"read":  bson.M{"out": int32(0), "available": int32(8)},
+				"write": bson.M{"out": int32(1), "available": int32(7)},
+			},
+		},
+	}
+	stat := parseWiredTiger(serverStatus)
+
+	assert.Equal(t, map[string]interface{}{
+		"wiredtiger_cache_bytes":             100.0,
+		"wiredtiger_read_tickets_available":  8.0,
+		"wiredtiger_read_tickets_out":        0.0,
+		"wiredtiger_write_tickets_available": 7.0,
+		"wiredtiger_write_tickets_out":       1.0,
+	}, stat)
+}
+
+func TestParseWiredTigerAbsent(t *testing.T) {
+	stat := parseWiredTiger(bson.M{"version": "3.0.0", "storageEngine": bson.M{"name": "mmapv1"}})
+	assert.Len(t, stat, 0)
+}
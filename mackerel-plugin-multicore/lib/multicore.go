@@ -35,6 +35,13 @@ var graphDef = map[string]mp.Graphs{
 			{Name: "user", Label: "user", Diff: false, Stacked: true},
 		},
 	},
+	"multicore.steal": {
+		Label: "MultiCore CPU steal",
+		Unit:  "percentage",
+		Metrics: []mp.Metrics{
+			{Name: "steal_percentage", Label: "steal", Diff: false, Stacked: false},
+		},
+	},
 	"multicore.loadavg_per_core": {
 		Label: "MultiCore loadavg5 per core",
 		Unit:  "float",
@@ -110,6 +117,10 @@ func parseProcStat(out io.Reader) (map[string]procStats, error) {
 		}
 
 		for i, valStr := range values {
+			// ignore the columns added by newer kernels
+			if i >= len(statPtrs) {
+				break
+			}
 			val, err := strconv.ParseUint(valStr, 10, 64)
 			if err != nil {
 				return nil, err
@@ -193,12 +204,9 @@ func calcCPUUsage(currentValues map[string]procStats, now time.Time, savedItem *
 	var result []cpuPercentages
 	for name, current := range currentValues {
 		last, ok := savedItem.ProcStatsByCPU[name]
-		if !ok {
+		if !ok || !isComparable(last, current) {
 			continue
 		}
-		if last.Total > current.Total {
-			return nil, errors.New("cpu counter has been reset")
-		}
 
 		user := calculatePercentage(current.User, last.User, current.Total, last.Total)
 		nice := calculatePercentage(current.Nice, last.Nice, current.Total, last.Total)
@@ -230,6 +238,45 @@ func calcCPUUsage(currentValues map[string]procStats, now time.Time, savedItem *
 	return result, nil
 }
 
+// isComparable reports whether the diffs of the cpu are valid. The cpu which has been offline
+// for the interval or whose counters have been reset is skipped, as well as the one whose
+// columns changed e.g. by the kernel upgrade.
+func isComparable(last, current procStats) bool {
+	if last.Total >= current.Total {
+		return false
+	}
+	lastPtrs := []*uint64{last.User, last.Nice, last.System, last.Idle, last.IoWait, last.Irq, last.SoftIrq, last.Steal, last.Guest, last.GuestNice}
+	currentPtrs := []*uint64{current.User, current.Nice, current.System, current.Idle, current.IoWait, current.Irq, current.SoftIrq, current.Steal, current.Guest, current.GuestNice}
+	for i := range lastPtrs {
+		if (lastPtrs[i] == nil) != (currentPtrs[i] == nil) {
+			return false
+		}
+		if lastPtrs[i] != nil && *lastPtrs[i] > *currentPtrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// calcStealPercentage returns the steal time of all the cpus in percentage, or nil if the kernel
+// does not report steal
+func calcStealPercentage(currentValues map[string]procStats, savedItem *saveItem) *float64 {
+	var steal, total uint64
+	for name, current := range currentValues {
+		last, ok := savedItem.ProcStatsByCPU[name]
+		if !ok || !isComparable(last, current) || current.Steal == nil {
+			continue
+		}
+		steal += *current.Steal - *last.Steal
+		total += current.Total - last.Total
+	}
+	if total == 0 {
+		return nil
+	}
+	ret := float64(steal) / float64(total) * 100.0
+	return &ret
+}
+
 func calculatePercentage(currentValue *uint64, lastValue *uint64, currentTotal uint64, lastTotal uint64) *float64 {
 	if currentValue == nil || lastValue == nil {
 		return nil
@@ -321,10 +368,12 @@ func outputMulticore(tempFileName string) {
 	if err != nil {
 		log.Fatalln("fetchLoadavg5: ", err)
 	}
-	loadPerCPUCount := loadavg5 / (float64(len(cpuUsage)))
-
 	outputCPUUsage(cpuUsage, now)
-	outputLoadavgPerCore(loadPerCPUCount, now)
+	printValue("multicore.steal.steal_percentage", calcStealPercentage(currentValues, savedItem), now)
+	if len(cpuUsage) > 0 {
+		loadPerCPUCount := loadavg5 / (float64(len(cpuUsage)))
+		outputLoadavgPerCore(loadPerCPUCount, now)
+	}
 }
 
 func generateTempfilePath() string {
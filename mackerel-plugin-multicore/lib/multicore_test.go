@@ -3,6 +3,7 @@ package mpmulticore
 import (
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseProcStats(t *testing.T) {
@@ -105,3 +106,45 @@ func TestParseProcStatsOldKernel(t *testing.T) {
 		t.Errorf("parseProcStat: guest should be nil, but '%d'", *stat["cpu0"].Guest)
 	}
 }
+
+func TestParseProcStatsNewKernel(t *testing.T) {
+	// a column unknown to the plugin follows guest_nice
+	stab := `cpu0 100 0 50 1000 10 1 2 30 0 0 7`
+
+	stat, err := parseProcStat(strings.NewReader(stab))
+	if err != nil {
+		t.Fatalf("parseProcStat: %s", err)
+	}
+	if stat["cpu0"].Total != 1193 {
+		t.Errorf("parseProcStat: total should be 1193, but '%d'", stat["cpu0"].Total)
+	}
+}
+
+func TestCalcCPUUsageSkipsIncomparableCPUs(t *testing.T) {
+	now := time.Now()
+	last, _ := parseProcStat(strings.NewReader(`cpu0 100 0 50 1000 10 1 2 30 0 0
+cpu1 100 0 50 1000 10 1 2 30 0 0
+cpu2 100 0 50 1000
+cpu3 100 0 50 1000 10 1 2 30 0 0`))
+	// cpu1 stayed offline, cpu2 got the columns of a newer kernel, and cpu3 is missing
+	current, _ := parseProcStat(strings.NewReader(`cpu0 160 0 70 1090 20 1 2 50 0 0
+cpu1 100 0 50 1000 10 1 2 30 0 0
+cpu2 200 0 60 1100 10 1 2 30 0 0`))
+	saved := &saveItem{LastTime: now.Add(-time.Minute), ProcStatsByCPU: last}
+
+	usage, err := calcCPUUsage(current, now, saved)
+	if err != nil {
+		t.Fatalf("calcCPUUsage: %s", err)
+	}
+	if len(usage) != 1 || usage[0].CPUName != "cpu0" {
+		t.Fatalf("calcCPUUsage: only cpu0 should be calculated, but %v", usage)
+	}
+	if *usage[0].Steal != 10 {
+		t.Errorf("calcCPUUsage: steal should be 10, but '%f'", *usage[0].Steal)
+	}
+
+	steal := calcStealPercentage(current, saved)
+	if steal == nil || *steal != 10 {
+		t.Errorf("calcStealPercentage: should be 10, but %v", steal)
+	}
+}
@@ -0,0 +1,41 @@
+// +build !windows
+
+package mpmunin
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// setCredential makes cmd run as the user, as munin-node does with the `user` setting of plugin-conf.d
+func setCredential(cmd *exec.Cmd, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() != 0 {
+		if uint64(os.Geteuid()) == uid {
+			// already running as the user
+			return nil
+		}
+		return fmt.Errorf("must run as root to execute munin plugin as %s", username)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// +build !windows
+
+package mpmunin
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandUser(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := MuninPlugin{PluginPath: "/bin/true", User: current.Username}
+	cmd, err := p.command()
+	assert.Nil(t, err)
+	if os.Geteuid() != 0 {
+		assert.Nil(t, cmd.SysProcAttr, "no need to switch to the current user")
+	}
+
+	p.User = "mackerel-plugin-munin-no-such-user"
+	_, err = p.command()
+	assert.NotNil(t, err)
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("nobody is not found")
+	}
+	p.User = "nobody"
+	cmd, err = p.command()
+	if os.Geteuid() != 0 {
+		assert.NotNil(t, err, "must run as root to switch the user")
+		return
+	}
+	assert.Nil(t, err)
+	if assert.NotNil(t, cmd.SysProcAttr) && assert.NotNil(t, cmd.SysProcAttr.Credential) {
+		assert.EqualValues(t, nobody.Uid, strconv.FormatUint(uint64(cmd.SysProcAttr.Credential.Uid), 10))
+		assert.EqualValues(t, nobody.Gid, strconv.FormatUint(uint64(cmd.SysProcAttr.Credential.Gid), 10))
+	}
+}
+
+func TestRunPluginUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run as root to switch the user")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("nobody is not found")
+	}
+	if _, err := exec.LookPath("id"); err != nil {
+		t.Skip("id is not found")
+	}
+	dir, err := ioutil.TempDir("", "mackerel-plugin-munin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the plugin should be readable by the user
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	plugin := writePlugin(t, dir, "whoami", "echo \"uid.value $(id -u)\"\n")
+
+	p := MuninPlugin{PluginPath: plugin, User: "nobody", Timeout: 10 * time.Second}
+	out, err := p.runPlugin()
+	assert.Nil(t, err)
+	assert.EqualValues(t, "uid.value "+nobody.Uid, strings.TrimSpace(out))
+}
@@ -0,0 +1,12 @@
+// +build windows
+
+package mpmunin
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, username string) error {
+	return fmt.Errorf("-user option is not supported on Windows")
+}
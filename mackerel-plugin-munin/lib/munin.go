@@ -14,12 +14,25 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Songmu/timeout"
 	mp "github.com/mackerelio/go-mackerel-plugin"
 )
 
 type serviceEnvs map[string]string
 
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringSlice) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
 type services map[string]serviceEnvs
 
 // MuninMetric metric of munin
@@ -30,6 +43,12 @@ type MuninMetric struct {
 	Value string
 }
 
+// MuninGraph sub-graph of munin multigraph plugin
+type MuninGraph struct {
+	Title        string
+	MuninMetrics map[string](*MuninMetric)
+}
+
 // MuninPlugin mackerel plugin for munin
 type MuninPlugin struct {
 	PluginPath    string
@@ -37,6 +56,10 @@ type MuninPlugin struct {
 	GraphTitle    string
 	GraphName     string
 	MuninMetrics  map[string](*MuninMetric)
+	SubGraphs     map[string](*MuninGraph)
+	Envs          []string
+	User          string
+	Timeout       time.Duration
 }
 
 var exp = map[string](*regexp.Regexp){}
@@ -203,6 +226,35 @@ func parsePluginVals(str string, m *map[string](*MuninMetric)) {
 	}
 }
 
+// splitMultigraph splits the output of multigraph plugins into the sections
+// headed by `multigraph <name>` lines. The lines before the first multigraph
+// line are returned as the top-level section.
+func splitMultigraph(str string) (string, map[string]string) {
+	var top []string
+	sections := make(map[string][]string)
+	current := ""
+	inSection := false
+	for _, line := range strings.Split(str, "\n") {
+		graphM := getExp("^multigraph\\s+(\\S+)\\s*$").FindStringSubmatch(line)
+		if graphM != nil {
+			current = graphM[1]
+			inSection = true
+			continue
+		}
+		if inSection {
+			sections[current] = append(sections[current], line)
+		} else {
+			top = append(top, line)
+		}
+	}
+
+	subs := make(map[string]string, len(sections))
+	for name, lines := range sections {
+		subs[name] = strings.Join(lines, "\n")
+	}
+	return strings.Join(top, "\n"), subs
+}
+
 func removeUselessMetrics(m *map[string](*MuninMetric)) {
 	// remove metrics which have an empty Value
 	for name, mmet := range *m {
@@ -219,45 +271,111 @@ func (p *MuninPlugin) prepare() error {
 		setPluginEnvironments(path.Base(p.PluginPath), p.PluginConfDir)
 	}
 
-	outConfig, err := exec.Command(p.PluginPath, "config").Output()
+	outConfig, err := p.runPlugin("config")
+	if err != nil {
+		return err
+	}
+
+	outVals, err := p.runPlugin()
+	if err != nil {
+		return err
+	}
+
+	p.parse(outConfig, outVals)
+
+	return nil
+}
+
+// command returns the command to run the plugin with the environment given by -env, as the user given by -user
+func (p *MuninPlugin) command(args ...string) (*exec.Cmd, error) {
+	cmd := exec.Command(p.PluginPath, args...)
+
+	// -env options override the settings of plugin-conf.d, which are in the environment of this process
+	env := os.Environ()
+	for _, e := range p.Envs {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid env: %s (must be KEY=VALUE)", e)
+		}
+		env = append(env, e)
+	}
+	// tell the plugin that we understand the multigraph protocol, as munin-node does
+	cmd.Env = append(env, "MUNIN_CAP_MULTIGRAPH=1")
+
+	if p.User != "" {
+		if err := setCredential(cmd, p.User); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
+
+func (p *MuninPlugin) runPlugin(args ...string) (string, error) {
+	cmd, err := p.command(args...)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, outConfig)
+		return "", err
 	}
 
-	outVals, err := exec.Command(p.PluginPath).Output()
+	tio := &timeout.Timeout{
+		Cmd:       cmd,
+		Duration:  p.Timeout,
+		KillAfter: 5 * time.Second,
+	}
+	exitStatus, stdout, stderr, err := tio.Run()
+	if err == nil && exitStatus.IsTimedOut() {
+		err = fmt.Errorf("%s timed out after %s", p.PluginPath, p.Timeout)
+	}
+	if err == nil && exitStatus.Code != 0 {
+		err = fmt.Errorf("%s exited with status %d", p.PluginPath, exitStatus.Code)
+	}
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, outVals)
+		return "", fmt.Errorf("%s: %s", err, stderr)
 	}
+	return stdout, nil
+}
+
+func (p *MuninPlugin) parse(outConfig string, outVals string) {
+	topConfig, subConfigs := splitMultigraph(outConfig)
+	topVals, subVals := splitMultigraph(outVals)
 
 	p.MuninMetrics = make(map[string](*MuninMetric))
-	parsePluginConfig(string(outConfig), &p.MuninMetrics, &p.GraphTitle)
-	parsePluginVals(string(outVals), &p.MuninMetrics)
+	parsePluginConfig(topConfig, &p.MuninMetrics, &p.GraphTitle)
+	parsePluginVals(topVals, &p.MuninMetrics)
 	removeUselessMetrics(&p.MuninMetrics)
 
-	return nil
+	p.SubGraphs = make(map[string](*MuninGraph))
+	for name, config := range subConfigs {
+		g := &MuninGraph{MuninMetrics: make(map[string](*MuninMetric))}
+		parsePluginConfig(config, &g.MuninMetrics, &g.Title)
+		parsePluginVals(subVals[name], &g.MuninMetrics)
+		removeUselessMetrics(&g.MuninMetrics)
+		if len(g.MuninMetrics) > 0 {
+			p.SubGraphs[name] = g
+		}
+	}
 }
 
-// FetchMetrics interface for mackerelplugin
-func (p MuninPlugin) FetchMetrics() (map[string]float64, error) {
-	stat := make(map[string]float64, len(p.MuninMetrics))
-	for name, mmet := range p.MuninMetrics {
+// subGraphName returns the graph name for a sub-graph of multigraph plugins
+func (p MuninPlugin) subGraphName(name string) string {
+	return p.GraphName + "." + getExp("[^-a-zA-Z0-9_.]").ReplaceAllString(name, "_")
+}
+
+func parseMetricValues(stat map[string]float64, prefix string, m map[string](*MuninMetric)) {
+	for name, mmet := range m {
 		parsed, err := strconv.ParseFloat(mmet.Value, 64)
 		if err != nil {
-			log.Printf("Failed to parse value of %s: %s", name, err)
+			log.Printf("Failed to parse value of %s: %s", prefix+name, err)
 			continue
 		}
 
-		stat[name] = parsed
+		stat[prefix+name] = parsed
 	}
-
-	return stat, nil
 }
 
-// GraphDefinition interface for mackerelplugin
-func (p MuninPlugin) GraphDefinition() map[string]mp.Graphs {
-	metrics := make([]mp.Metrics, 0, len(p.MuninMetrics))
-	for name, mmet := range p.MuninMetrics {
-		met := mp.Metrics{Name: name}
+func graphMetrics(m map[string](*MuninMetric), absoluteName bool) []mp.Metrics {
+	metrics := make([]mp.Metrics, 0, len(m))
+	for name, mmet := range m {
+		met := mp.Metrics{Name: name, AbsoluteName: absoluteName}
 		if mmet.Label == "" {
 			met.Label = name
 		} else {
@@ -273,12 +391,44 @@ func (p MuninPlugin) GraphDefinition() map[string]mp.Graphs {
 
 		metrics = append(metrics, met)
 	}
+	return metrics
+}
+
+// FetchMetrics interface for mackerelplugin
+func (p MuninPlugin) FetchMetrics() (map[string]float64, error) {
+	stat := make(map[string]float64, len(p.MuninMetrics))
+	parseMetricValues(stat, "", p.MuninMetrics)
+	for name, g := range p.SubGraphs {
+		// metrics of sub-graphs use AbsoluteName, because field names are often shared among sub-graphs
+		parseMetricValues(stat, p.subGraphName(name)+".", g.MuninMetrics)
+	}
+
+	return stat, nil
+}
+
+// GraphDefinition interface for mackerelplugin
+func (p MuninPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphdef := make(map[string]mp.Graphs, len(p.SubGraphs)+1)
+	if len(p.MuninMetrics) > 0 || len(p.SubGraphs) == 0 {
+		graphdef[p.GraphName] = mp.Graphs{
+			Label:   p.GraphTitle,
+			Unit:    "float",
+			Metrics: graphMetrics(p.MuninMetrics, false),
+		}
+	}
+	for name, g := range p.SubGraphs {
+		label := g.Title
+		if label == "" {
+			label = name
+		}
+		graphdef[p.subGraphName(name)] = mp.Graphs{
+			Label:   label,
+			Unit:    "float",
+			Metrics: graphMetrics(g.MuninMetrics, true),
+		}
+	}
 
-	return map[string]mp.Graphs{p.GraphName: {
-		Label:   p.GraphTitle,
-		Unit:    "float",
-		Metrics: metrics,
-	}}
+	return graphdef
 }
 
 // Do the plugin
@@ -287,6 +437,10 @@ func Do() {
 	optPluginConfDir := flag.String("plugin-conf-d", "", "Munin plugin-conf.d path")
 	optGraphName := flag.String("name", "", "Graph name")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optEnvs := &stringSlice{}
+	flag.Var(optEnvs, "env", "Set environment variable for the munin plugin (e.g. \"mysqlopts=-uroot\"). can be specified multiple times")
+	optUser := flag.String("user", "", "Run the munin plugin as this user (requires root)")
+	optTimeout := flag.Duration("timeout", 10*time.Second, "Timeout of the munin plugin execution")
 	flag.Parse()
 
 	var munin MuninPlugin
@@ -295,6 +449,9 @@ func Do() {
 	}
 	munin.PluginPath = *optPluginPath
 	munin.PluginConfDir = *optPluginConfDir
+	munin.Envs = *optEnvs
+	munin.User = *optUser
+	munin.Timeout = *optTimeout
 	if *optGraphName == "" {
 		munin.GraphName = "munin." + path.Base(munin.PluginPath)
 	} else {
@@ -2,7 +2,13 @@ package mpmunin
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -157,3 +163,232 @@ func TestCompileEnvPairs(t *testing.T) {
 	assert.EqualValues(t, envs["hoge"], "abs")
 	assert.EqualValues(t, envs["piyo"], "piYO")
 }
+
+// output of the diskstats multigraph plugin, shortened to one device
+var diskstatsConfigStub = `multigraph diskstats_latency
+graph_title Disk latency per device
+graph_args --base 1000
+graph_vlabel Average IO Wait (seconds)
+graph_category disk
+graph_width 400
+sda_avgwait.label sda
+sda_avgwait.type GAUGE
+sda_avgwait.info Average wait time for an I/O request
+sda_avgwait.min 0
+sda_avgwait.draw LINE1
+
+multigraph diskstats_latency.sda
+graph_title Average latency for /dev/sda
+graph_args --base 1000 --logarithmic
+graph_vlabel seconds
+graph_category disk
+svctm.label Device IO time
+svctm.type GAUGE
+svctm.min 0
+svctm.draw LINE1
+avgwait.label IO Wait time
+avgwait.type GAUGE
+avgwait.min 0
+avgwait.draw LINE1
+
+multigraph diskstats_iops.sda
+graph_title IOs for /dev/sda
+graph_args --base 1000
+graph_vlabel Units read (-) / write (+)
+graph_category disk
+rdio.label dummy
+rdio.type GAUGE
+rdio.graph no
+rdio.min 0
+rdio.draw LINE1
+wrio.label IO/sec
+wrio.type GAUGE
+wrio.min 0
+wrio.negative rdio
+wrio.draw LINE1
+`
+
+var diskstatsValsStub = `multigraph diskstats_latency
+sda_avgwait.value 0.00260149825043224
+
+multigraph diskstats_latency.sda
+svctm.value 0.000155834815503004
+avgwait.value 0.00260149825043224
+
+multigraph diskstats_iops.sda
+rdio.value 0.263387979010722
+wrio.value 6.20539248365394
+`
+
+func TestSplitMultigraph(t *testing.T) {
+	top, subs := splitMultigraph(diskstatsValsStub)
+
+	assert.EqualValues(t, top, "")
+	assert.EqualValues(t, len(subs), 3)
+	assert.Contains(t, subs["diskstats_latency"], "sda_avgwait.value 0.00260149825043224")
+	assert.Contains(t, subs["diskstats_latency.sda"], "svctm.value 0.000155834815503004")
+	assert.Contains(t, subs["diskstats_iops.sda"], "wrio.value 6.20539248365394")
+
+	top, subs = splitMultigraph("swap_in.value 1\nswap_out.value 2\n")
+	assert.Contains(t, top, "swap_in.value 1")
+	assert.EqualValues(t, len(subs), 0)
+}
+
+func TestMultigraph(t *testing.T) {
+	p := MuninPlugin{GraphName: "munin.diskstats"}
+	p.parse(diskstatsConfigStub, diskstatsValsStub)
+
+	assert.EqualValues(t, len(p.MuninMetrics), 0)
+	assert.EqualValues(t, len(p.SubGraphs), 3)
+
+	graphs := p.GraphDefinition()
+	assert.EqualValues(t, len(graphs), 3)
+	_, ok := graphs["munin.diskstats"]
+	assert.EqualValues(t, ok, false)
+
+	g := graphs["munin.diskstats.diskstats_latency.sda"]
+	assert.EqualValues(t, g.Label, "Average latency for /dev/sda")
+	assert.EqualValues(t, len(g.Metrics), 2)
+	for _, m := range g.Metrics {
+		assert.EqualValues(t, m.AbsoluteName, true)
+	}
+	assert.EqualValues(t, len(graphs["munin.diskstats.diskstats_iops.sda"].Metrics), 2)
+
+	stat, err := p.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, len(stat), 5)
+	assert.EqualValues(t, stat["munin.diskstats.diskstats_latency.sda_avgwait"], 0.00260149825043224)
+	assert.EqualValues(t, stat["munin.diskstats.diskstats_latency.sda.avgwait"], 0.00260149825043224)
+	assert.EqualValues(t, stat["munin.diskstats.diskstats_iops.sda.wrio"], 6.20539248365394)
+}
+
+// writePlugin writes a munin plugin of the shell script into dir
+func writePlugin(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("munin plugins are shell scripts")
+	}
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// lookupEnv returns the value of key in env, where the last one wins as exec.Cmd does
+func lookupEnv(env []string, key string) (string, bool) {
+	value, ok := "", false
+	for _, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			value, ok = strings.TrimPrefix(e, key+"="), true
+		}
+	}
+	return value, ok
+}
+
+func TestCommand(t *testing.T) {
+	p := MuninPlugin{PluginPath: "/usr/share/munin/plugins/mysql_"}
+	cmd, err := p.command("config")
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"/usr/share/munin/plugins/mysql_", "config"}, cmd.Args)
+	assert.Nil(t, cmd.SysProcAttr, "runs as the current user without -user")
+	v, _ := lookupEnv(cmd.Env, "MUNIN_CAP_MULTIGRAPH")
+	assert.EqualValues(t, "1", v)
+
+	os.Setenv("MUNIN_TEST_MYSQLOPTS", "-uplugin-conf-d")
+	defer os.Unsetenv("MUNIN_TEST_MYSQLOPTS")
+	p.Envs = []string{"MUNIN_TEST_MYSQLOPTS=-uroot", "MUNIN_TEST_DSN=user=root password=secret"}
+	cmd, err = p.command()
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"/usr/share/munin/plugins/mysql_"}, cmd.Args)
+	v, _ = lookupEnv(cmd.Env, "MUNIN_TEST_MYSQLOPTS")
+	assert.EqualValues(t, "-uroot", v, "-env overrides the environment")
+	v, _ = lookupEnv(cmd.Env, "MUNIN_TEST_DSN")
+	assert.EqualValues(t, "user=root password=secret", v, "only the first = separates the value")
+	_, ok := lookupEnv(cmd.Env, "PATH")
+	assert.True(t, ok, "the environment of the process is passed")
+
+	for _, env := range []string{"MUNIN_TEST_MYSQLOPTS", "=-uroot"} {
+		p.Envs = []string{env}
+		_, err = p.command()
+		assert.NotNil(t, err, env)
+	}
+}
+
+func TestPrepareEnvs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-munin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin := writePlugin(t, dir, "envtest", `if [ "$1" = config ]; then
+  echo "graph_title $MUNIN_TEST_TITLE"
+  echo "conf.label conf"
+  echo "env.label env"
+  echo "multigraph.label multigraph"
+  exit 0
+fi
+echo "conf.value $MUNIN_TEST_CONF"
+echo "env.value $MUNIN_TEST_ENV"
+echo "multigraph.value $MUNIN_CAP_MULTIGRAPH"
+`)
+	confDir := filepath.Join(dir, "plugin-conf.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := "[envtest]\nenv.MUNIN_TEST_CONF 1\nenv.MUNIN_TEST_ENV 2\nenv.MUNIN_TEST_TITLE envtest\n"
+	if err := ioutil.WriteFile(filepath.Join(confDir, "munin-node"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, key := range []string{"MUNIN_TEST_CONF", "MUNIN_TEST_ENV", "MUNIN_TEST_TITLE"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	p := MuninPlugin{
+		PluginPath:    plugin,
+		PluginConfDir: confDir,
+		Envs:          []string{"MUNIN_TEST_ENV=42"},
+		Timeout:       10 * time.Second,
+	}
+	err = p.prepare()
+	assert.Nil(t, err)
+	assert.EqualValues(t, "envtest", p.GraphTitle)
+	assert.EqualValues(t, "1", p.MuninMetrics["conf"].Value)
+	assert.EqualValues(t, "42", p.MuninMetrics["env"].Value, "-env overrides plugin-conf.d")
+	assert.EqualValues(t, "1", p.MuninMetrics["multigraph"].Value)
+}
+
+func TestRunPluginTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-munin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin := writePlugin(t, dir, "hang", "exec sleep 30\n")
+
+	p := MuninPlugin{PluginPath: plugin, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	_, err = p.runPlugin()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 100ms")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "the hanging plugin should be killed")
+}
+
+func TestRunPluginExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-munin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugin := writePlugin(t, dir, "fail", "echo 'cannot connect' >&2\nexit 1\n")
+
+	p := MuninPlugin{PluginPath: plugin, Timeout: 10 * time.Second}
+	_, err = p.runPlugin()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "exited with status 1")
+		assert.Contains(t, err.Error(), "cannot connect")
+	}
+}
@@ -0,0 +1,247 @@
+package mpmurmur
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of MurmurRPC.proto used by the plugin are encoded by hand
+// instead of depending on the generated code of the whole service.
+//
+//   message Server       { required uint32 id = 1; }
+//   message Uptime       { optional uint64 secs = 1; }
+//   message Channel      { optional uint32 id = 2; optional string name = 3; }
+//   message User         { optional Channel channel = 12; }
+//   message Channel.List { repeated Channel channels = 2; }
+//   message User.List    { repeated User users = 2; }
+//   message Ban.List     { repeated Ban bans = 2; }
+//
+// Channel.Query, User.Query and Ban.Query have the Server at 1.
+
+// rawCodec passes the encoded messages through
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+type field struct {
+	num   protowire.Number
+	value uint64
+	bytes []byte
+}
+
+// parseFields decodes the varint and length-delimited fields of a message
+func parseFields(b []byte) ([]field, error) {
+	var fields []field
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func encodeServer(id uint32) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(id))
+}
+
+// encodeQuery encodes Channel.Query, User.Query and Ban.Query of the server
+func encodeQuery(serverID uint32) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, encodeServer(serverID))
+}
+
+// repeated returns the embedded messages of the field
+func repeated(b []byte, num protowire.Number) ([][]byte, error) {
+	fields, err := parseFields(b)
+	if err != nil {
+		return nil, err
+	}
+	var messages [][]byte
+	for _, f := range fields {
+		if f.num == num && f.bytes != nil {
+			messages = append(messages, f.bytes)
+		}
+	}
+	return messages, nil
+}
+
+type channel struct {
+	id   uint32
+	name string
+}
+
+func parseChannel(b []byte) (channel, error) {
+	var c channel
+	fields, err := parseFields(b)
+	if err != nil {
+		return c, err
+	}
+	for _, f := range fields {
+		switch f.num {
+		case 2:
+			c.id = uint32(f.value)
+		case 3:
+			c.name = string(f.bytes)
+		}
+	}
+	return c, nil
+}
+
+// userChannel returns the id of the channel where the user is
+func userChannel(b []byte) (uint32, error) {
+	channels, err := repeated(b, 12)
+	if err != nil || len(channels) == 0 {
+		return 0, err
+	}
+	c, err := parseChannel(channels[0])
+	return c.id, err
+}
+
+func parseUptime(b []byte) (uint64, error) {
+	fields, err := parseFields(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range fields {
+		if f.num == 1 {
+			return f.value, nil
+		}
+	}
+	return 0, nil
+}
+
+type grpcClient struct {
+	conn    *grpc.ClientConn
+	timeout time.Duration
+}
+
+func dialGRPC(addr string, timeout time.Duration) (*grpcClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	return &grpcClient{conn: conn, timeout: timeout}, nil
+}
+
+func (c *grpcClient) call(method string, req []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var resp []byte
+	if err := c.conn.Invoke(ctx, "/MurmurRPC.V1/"+method, req, &resp); err != nil {
+		return nil, fmt.Errorf("%s: %s", method, err)
+	}
+	return resp, nil
+}
+
+func (c *grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// fetchGRPCMetrics fetches the users, the users per channel, the bans and the uptime of the virtual server
+func (m MurmurPlugin) fetchGRPCMetrics() (map[string]interface{}, error) {
+	c, err := dialGRPC(m.Host, time.Millisecond*time.Duration(m.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	resp, err := c.call("ChannelQuery", encodeQuery(m.ServerID))
+	if err != nil {
+		return nil, err
+	}
+	channelList, err := repeated(resp, 2)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]interface{})
+	names := make(map[uint32]string)
+	for _, b := range channelList {
+		ch, err := parseChannel(b)
+		if err != nil {
+			return nil, err
+		}
+		names[ch.id] = channelKey(ch.name)
+		metrics["channel_users."+names[ch.id]+".users"] = uint32(0)
+	}
+
+	resp, err = c.call("UserQuery", encodeQuery(m.ServerID))
+	if err != nil {
+		return nil, err
+	}
+	users, err := repeated(resp, 2)
+	if err != nil {
+		return nil, err
+	}
+	metrics["con_cur"] = uint32(len(users))
+	for _, b := range users {
+		id, err := userChannel(b)
+		if err != nil {
+			return nil, err
+		}
+		if name, ok := names[id]; ok {
+			key := "channel_users." + name + ".users"
+			metrics[key] = metrics[key].(uint32) + 1
+		}
+	}
+
+	resp, err = c.call("BansGet", encodeQuery(m.ServerID))
+	if err != nil {
+		return nil, err
+	}
+	bans, err := repeated(resp, 2)
+	if err != nil {
+		return nil, err
+	}
+	metrics["bans"] = uint32(len(bans))
+
+	resp, err = c.call("GetUptime", nil)
+	if err != nil {
+		return nil, err
+	}
+	if metrics["uptime"], err = parseUptime(resp); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
@@ -3,35 +3,46 @@ package mpmurmur
 import (
 	"flag"
 	"fmt"
+	"os"
+	"regexp"
+	"strings"
 	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"layeh.com/gumble/gumble"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"murmur.connections": {
-		Label: "Murmur Connections",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "con_cur", Label: "Current users", Diff: false, Type: "uint32"},
-			{Name: "con_max", Label: "Maximum users", Diff: false, Type: "uint32"},
-		},
-	},
-}
-
 // MurmurPlugin mackerel plugin for Murmur
 type MurmurPlugin struct {
-	Host    string
-	Timeout uint64
+	Host        string
+	Timeout     uint64
+	Interface   string
+	ServerID    uint32
+	Prefix      string
+	LabelPrefix string
+}
+
+var normalizeMetricNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// channelKey returns the metric key of the channel, e.g. Lobby_1 for "Lobby 1"
+func channelKey(name string) string {
+	return normalizeMetricNameRe.ReplaceAllString(name, "_")
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m MurmurPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if m.Interface == "grpc" {
+		metrics, err := m.fetchGRPCMetrics()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch metrics through the gRPC interface of %s: %s", m.Host, err)
+		}
+		return metrics, nil
+	}
+
 	resp, err := gumble.Ping(m.Host, 0, time.Millisecond*time.Duration(m.Timeout))
 
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to ping %s: %s", m.Host, err)
 	}
 
 	metrics := map[string]interface{}{
@@ -42,23 +53,97 @@ func (m MurmurPlugin) FetchMetrics() (map[string]interface{}, error) {
 	return metrics, nil
 }
 
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m MurmurPlugin) MetricKeyPrefix() string {
+	if m.Prefix == "" {
+		m.Prefix = "murmur"
+	}
+	return m.Prefix
+}
+
 // GraphDefinition interface for mackerelplugin
 func (m MurmurPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := m.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(m.MetricKeyPrefix())
+	}
+
+	if m.Interface != "grpc" {
+		return map[string]mp.Graphs{
+			"connections": {
+				Label: labelPrefix + " Connections",
+				Unit:  "integer",
+				Metrics: []mp.Metrics{
+					{Name: "con_cur", Label: "Current users", Diff: false, Type: "uint32"},
+					{Name: "con_max", Label: "Maximum users", Diff: false, Type: "uint32"},
+				},
+			},
+		}
+	}
+	// the gRPC interface has no maximum users but the metrics of the channels, the bans and the uptime
+	return map[string]mp.Graphs{
+		"connections": {
+			Label: labelPrefix + " Connections",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "con_cur", Label: "Current users", Diff: false, Type: "uint32"},
+			},
+		},
+		"channel_users.#": {
+			Label: labelPrefix + " Users per Channel",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "users", Label: "Users", Diff: false, Type: "uint32"},
+			},
+		},
+		"bans": {
+			Label: labelPrefix + " Bans",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "bans", Label: "Bans", Diff: false, Type: "uint32"},
+			},
+		},
+		"uptime": {
+			Label: labelPrefix + " Uptime",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "uptime", Label: "Seconds", Diff: false, Type: "uint64"},
+			},
+		},
+	}
 }
 
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
-	optPort := flag.String("port", "64738", "Port")
+	optPort := flag.String("port", "", "Port (default: 64738 for ping, 50051 for grpc)")
 	optTimeout := flag.Uint64("timeout", 1000, "Timeout (ms)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optInterface := flag.String("interface", "ping", "Interface to fetch the metrics: ping or grpc")
+	optServerID := flag.Uint("server-id", 1, "ID of the virtual server (grpc)")
+	optPrefix := flag.String("metric-key-prefix", "murmur", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
 	flag.Parse()
 
-	var murmur MurmurPlugin
+	murmur := MurmurPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
 
+	switch *optInterface {
+	case "ping":
+		if *optPort == "" {
+			*optPort = "64738"
+		}
+	case "grpc":
+		if *optPort == "" {
+			*optPort = "50051"
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown interface: %s\n", *optInterface)
+		os.Exit(1)
+	}
 	murmur.Host = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	murmur.Timeout = *optTimeout
+	murmur.Interface = *optInterface
+	murmur.ServerID = uint32(*optServerID)
 	helper := mp.NewMackerelPlugin(murmur)
 
 	if *optTempfile != "" {
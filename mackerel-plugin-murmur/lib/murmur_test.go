@@ -0,0 +1,114 @@
+package mpmurmur
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendMessage(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+func encodeChannel(id uint32, name string) []byte {
+	b := protowire.AppendTag(nil, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(id))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendString(b, name)
+}
+
+func encodeUser(session uint32, channelID uint32) []byte {
+	b := protowire.AppendTag(nil, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(session))
+	return appendMessage(b, 12, encodeChannel(channelID, ""))
+}
+
+// stubV1 answers the MurmurRPC.V1 methods used by the plugin
+func stubV1(srv interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	var req []byte
+	if err := stream.RecvMsg(&req); err != nil {
+		return err
+	}
+	var resp []byte
+	switch method {
+	case "/MurmurRPC.V1/ChannelQuery":
+		resp = appendMessage(resp, 1, encodeServer(1))
+		resp = appendMessage(resp, 2, encodeChannel(0, "Root"))
+		resp = appendMessage(resp, 2, encodeChannel(1, "Lobby 1"))
+		resp = appendMessage(resp, 2, encodeChannel(2, "AFK"))
+	case "/MurmurRPC.V1/UserQuery":
+		resp = appendMessage(resp, 2, encodeUser(1, 1))
+		resp = appendMessage(resp, 2, encodeUser(2, 1))
+		resp = appendMessage(resp, 2, encodeUser(3, 0))
+	case "/MurmurRPC.V1/BansGet":
+		resp = appendMessage(resp, 2, nil)
+	case "/MurmurRPC.V1/GetUptime":
+		resp = protowire.AppendTag(resp, 1, protowire.VarintType)
+		resp = protowire.AppendVarint(resp, 3600)
+	}
+	return stream.SendMsg(resp)
+}
+
+func TestFetchGRPCMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(stubV1))
+	go s.Serve(l)
+	defer s.Stop()
+
+	m := MurmurPlugin{Host: l.Addr().String(), Timeout: 1000, Interface: "grpc", ServerID: 1}
+	stat, err := m.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 3, stat["con_cur"])
+	assert.EqualValues(t, 1, stat["channel_users.Root.users"])
+	assert.EqualValues(t, 2, stat["channel_users.Lobby_1.users"])
+	assert.EqualValues(t, 0, stat["channel_users.AFK.users"])
+	assert.EqualValues(t, 1, stat["bans"])
+	assert.EqualValues(t, 3600, stat["uptime"])
+}
+
+func TestFetchGRPCMetricsConnectionFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	m := MurmurPlugin{Host: addr, Timeout: 100, Interface: "grpc"}
+	_, err = m.FetchMetrics()
+	if assert.NotNil(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "gRPC interface"), err.Error())
+	}
+}
+
+func TestGraphDefinition(t *testing.T) {
+	assert.Len(t, MurmurPlugin{Interface: "ping"}.GraphDefinition(), 1)
+	assert.Len(t, MurmurPlugin{Interface: "grpc"}.GraphDefinition(), 4)
+
+	// the default prefixes keep the graph names and the labels unchanged
+	m := MurmurPlugin{Interface: "grpc"}
+	graphs := make(map[string]string)
+	for key, graph := range m.GraphDefinition() {
+		graphs[m.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"murmur.connections":     "Murmur Connections",
+		"murmur.channel_users.#": "Murmur Users per Channel",
+		"murmur.bans":            "Murmur Bans",
+		"murmur.uptime":          "Murmur Uptime",
+	}, graphs)
+
+	m.Prefix = "murmur-guild"
+	assert.Equal(t, "Murmur-Guild Bans", m.GraphDefinition()["bans"].Label)
+	m.LabelPrefix = "Guild"
+	assert.Equal(t, "Guild Bans", m.GraphDefinition()["bans"].Label)
+}
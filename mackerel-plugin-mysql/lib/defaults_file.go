@@ -0,0 +1,172 @@
+package mpmysql
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// defaultsFileFlags maps the options of [client] in the defaults file onto the flags
+var defaultsFileFlags = map[string]string{
+	"user":     "username",
+	"password": "password",
+	"host":     "host",
+	"port":     "port",
+	"socket":   "socket",
+}
+
+// setFromDefaultsFile sets the flags not given on the command line from [client] of the defaults file,
+// or of ~/.my.cnf if path is empty and it exists
+func setFromDefaultsFile(fs *flag.FlagSet, path string) error {
+	if path == "" {
+		home := homeDir()
+		if home == "" {
+			return nil
+		}
+		path = filepath.Join(home, ".my.cnf")
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	options, err := readDefaultsFile(path)
+	if err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for option, name := range defaultsFileFlags {
+		v, ok := options[option]
+		if !ok || given[name] {
+			continue
+		}
+		// the socket of the file does not take over -host and -port
+		if option == "socket" && (given["host"] || given["port"]) {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("%s: invalid %s: %s", path, option, err)
+		}
+	}
+	return nil
+}
+
+// homeDir returns $HOME, or the home directory of the current user if it is not set
+func homeDir() string {
+	if home := os.Getenv("HOME"); home != "" {
+		return home
+	}
+	if u, err := user.Current(); err == nil {
+		return u.HomeDir
+	}
+	return ""
+}
+
+// readDefaultsFile reads [client] of the defaults file
+func readDefaultsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the defaults file: %s", err)
+	}
+	defer f.Close()
+
+	options, err := parseDefaultsFile(f, "client")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return options, nil
+}
+
+// parseDefaultsFile parses the options of the section in the format of my.cnf, where the values may be quoted
+// and the comments start with # or ;
+func parseDefaultsFile(r io.Reader, section string) (map[string]string, error) {
+	options := make(map[string]string)
+	current := ""
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '!' {
+			// !include and !includedir are not followed
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: malformed section: %s", n, line)
+			}
+			current = strings.TrimSpace(line[1:end])
+			continue
+		}
+		if current != section {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		// the options without values such as skip-ssl are ignored
+		key := strings.Replace(strings.TrimSpace(kv[0]), "-", "_", -1)
+		if len(kv) < 2 {
+			continue
+		}
+		value, err := parseOptionValue(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		options[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// parseOptionValue returns the value without the comment, or the quoted value with the escapes
+func parseOptionValue(value string) (string, error) {
+	if value == "" || (value[0] != '"' && value[0] != '\'') {
+		if i := strings.IndexByte(value, '#'); i >= 0 {
+			value = value[:i]
+		}
+		return strings.TrimSpace(value), nil
+	}
+
+	quote := value[0]
+	var b bytes.Buffer
+	for i := 1; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 's':
+				b.WriteByte(' ')
+			default:
+				b.WriteByte(value[i])
+			}
+		case c == quote:
+			rest := strings.TrimSpace(value[i+1:])
+			if rest != "" && rest[0] != '#' {
+				return "", fmt.Errorf("unexpected characters after the quoted value: %s", rest)
+			}
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted value")
+}
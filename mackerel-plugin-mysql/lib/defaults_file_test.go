@@ -0,0 +1,101 @@
+package mpmysql
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDefaultsFile(t *testing.T) {
+	cnf := `# comment
+[mysqld]
+user = mysql
+
+[client]
+user = mackerel # the monitoring user
+password = "p#ss=w\"rd" # quoted
+host=db.example.com
+port = 3307
+; comment
+ssl
+!includedir /etc/mysql/conf.d/
+
+[mysql]
+password = other
+`
+	options, err := parseDefaultsFile(strings.NewReader(cnf), "client")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"user":     "mackerel",
+		"password": `p#ss=w"rd`,
+		"host":     "db.example.com",
+		"port":     "3307",
+	}, options)
+}
+
+func TestParseDefaultsFile_SingleQuoted(t *testing.T) {
+	options, err := parseDefaultsFile(strings.NewReader("[client]\npassword='a;b # c'\n"), "client")
+	assert.Nil(t, err)
+	assert.Equal(t, "a;b # c", options["password"])
+}
+
+func TestParseDefaultsFile_Malformed(t *testing.T) {
+	for _, cnf := range []string{
+		"[client\nuser = mackerel\n",
+		"[client]\npassword = \"secret\n",
+		"[client]\npassword = \"secret\" trailing\n",
+	} {
+		_, err := parseDefaultsFile(strings.NewReader(cnf), "client")
+		assert.NotNil(t, err, cnf)
+	}
+}
+
+func TestSetFromDefaultsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-mysql")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "my.cnf")
+	cnf := "[client]\nuser = mackerel\npassword = \"p#ss\"\nhost = db.example.com\nsocket = /tmp/mysql.sock\n"
+	assert.Nil(t, ioutil.WriteFile(path, []byte(cnf), 0600))
+
+	fs := flag.NewFlagSet("mysql", flag.ContinueOnError)
+	user := fs.String("username", "root", "")
+	pass := fs.String("password", "", "")
+	host := fs.String("host", "localhost", "")
+	fs.String("port", "3306", "")
+	socket := fs.String("socket", "", "")
+	assert.Nil(t, fs.Parse([]string{"-host=127.0.0.1"}))
+
+	assert.Nil(t, setFromDefaultsFile(fs, path))
+	assert.Equal(t, "mackerel", *user)
+	assert.Equal(t, "p#ss", *pass)
+	// the flags given explicitly take precedence over the file
+	assert.Equal(t, "127.0.0.1", *host)
+	assert.Equal(t, "", *socket)
+}
+
+func TestSetFromDefaultsFile_Error(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-mysql")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fs := flag.NewFlagSet("mysql", flag.ContinueOnError)
+	fs.String("username", "root", "")
+
+	missing := filepath.Join(dir, "missing.cnf")
+	err = setFromDefaultsFile(fs, missing)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), missing)
+	}
+
+	malformed := filepath.Join(dir, "malformed.cnf")
+	assert.Nil(t, ioutil.WriteFile(malformed, []byte("[client]\npassword = 'secret\n"), 0600))
+	err = setFromDefaultsFile(fs, malformed)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), malformed)
+	}
+}
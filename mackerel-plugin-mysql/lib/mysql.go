@@ -1,18 +1,27 @@
 package mpmysql
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
-	"github.com/ziutek/mymysql/mysql"
-	// MySQL Driver
-	_ "github.com/ziutek/mymysql/native"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
+var logger = pluginutil.NewStdLogger("mysql")
+
 var (
 	processState map[string]bool
 )
@@ -108,6 +117,14 @@ func (m MySQLPlugin) defaultGraphdef() map[string]mp.Graphs {
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
 				{Name: "Seconds_Behind_Master", Label: "Seconds Behind Master", Diff: false, Stacked: false},
+				{Name: "replication_delay", Label: "Aurora Replica Lag (ms)", Diff: false, Stacked: false},
+			},
+		},
+		"aurora_role": {
+			Label: labelPrefix + " Aurora Role",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "role", Label: "Writer", Diff: false, Stacked: false},
 			},
 		},
 		"table_locks": {
@@ -145,6 +162,125 @@ type MySQLPlugin struct {
 	DisableInnoDB  bool
 	isUnixSocket   bool
 	EnableExtended bool
+	EnableGalera   bool
+	// EnablePerformanceSchema posts the statement summary of performance_schema
+	EnablePerformanceSchema bool
+	// performanceSchemaWarnedFile exists while the failure of performance_schema has been warned
+	performanceSchemaWarnedFile string
+	// InnoDBSource is auto, status or information_schema, where the empty is auto
+	InnoDBSource string
+
+	UseSSL        bool
+	SSLCA         string
+	SSLCert       string
+	SSLKey        string
+	SSLSkipVerify bool
+
+	MaxExecutionTime time.Duration
+}
+
+// tlsConfigName is the name of the TLS configuration registered to the driver
+const tlsConfigName = "mackerel-plugin-mysql"
+
+// tlsConfig builds the TLS configuration from the options, which verifies the hostname unless -ssl-skip-verify
+func (m MySQLPlugin) tlsConfig() (*tls.Config, error) {
+	host, _, _ := net.SplitHostPort(m.Target)
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: m.SSLSkipVerify,
+	}
+	if m.SSLCA != "" {
+		pem, err := ioutil.ReadFile(m.SSLCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", m.SSLCA)
+		}
+		config.RootCAs = pool
+	}
+	if m.SSLCert != "" || m.SSLKey != "" {
+		if m.SSLCert == "" || m.SSLKey == "" {
+			return nil, errors.New("both -ssl-cert and -ssl-key are required for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(m.SSLCert, m.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// config returns the configuration of the driver for the target. The TLS options are ignored for the socket.
+func (m MySQLPlugin) config(ctx context.Context) (*mysql.Config, error) {
+	config := mysql.NewConfig()
+	config.User = m.Username
+	config.Passwd = m.Password
+	config.Addr = m.Target
+	config.Net = "tcp"
+	if m.isUnixSocket {
+		config.Net = "unix"
+	}
+	// the old passwords of MySQL 4.0 have been accepted
+	config.AllowOldPasswords = true
+	if _, ok := ctx.Deadline(); ok {
+		config.Timeout = pluginutil.Timeout(ctx, 0)
+	}
+	if m.UseSSL && !m.isUnixSocket {
+		tlsConfig, err := m.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := mysql.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+			return nil, err
+		}
+		config.TLSConfig = tlsConfigName
+	}
+	return config, nil
+}
+
+// query runs the query and returns the columns and the rows, whose values are []byte, or nil for NULL
+func query(ctx context.Context, db *sql.DB, q string) ([]string, [][]interface{}, error) {
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	var result [][]interface{}
+	for rows.Next() {
+		values := make([][]byte, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		row := make([]interface{}, len(columns))
+		for i, v := range values {
+			if v != nil {
+				row[i] = v
+			}
+		}
+		result = append(result, row)
+	}
+	return columns, result, rows.Err()
+}
+
+// targetLogger returns the logger with the target in the JSON logs
+func (m MySQLPlugin) targetLogger() *pluginutil.Logger {
+	if m.isUnixSocket {
+		return logger.With(pluginutil.LogFields{"socket": m.Target})
+	}
+	host, port, _ := net.SplitHostPort(m.Target)
+	return logger.With(pluginutil.LogFields{"host": host, "port": port})
 }
 
 // MetricKeyPrefix retruns the metrics key prefix
@@ -155,10 +291,13 @@ func (m MySQLPlugin) MetricKeyPrefix() string {
 	return m.prefix
 }
 
-func (m MySQLPlugin) fetchShowStatus(db mysql.Conn, stat map[string]float64) error {
-	rows, _, err := db.Query("show /*!50002 global */ status")
+func (m MySQLPlugin) fetchShowStatus(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, rows, err := query(ctx, db, "show /*!50002 global */ status")
 	if err != nil {
-		log.Fatalln("FetchMetrics (Status): ", err)
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW STATUS"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (Status): %s", err)
 		return err
 	}
 
@@ -166,23 +305,30 @@ func (m MySQLPlugin) fetchShowStatus(db mysql.Conn, stat map[string]float64) err
 		if len(row) > 1 {
 			variableName := string(row[0].([]byte))
 			if err != nil {
-				log.Fatalln("FetchMetrics (Status Fetch): ", err)
+				m.targetLogger().Fatalf("FetchMetrics (Status Fetch): %s", err)
 				return err
 			}
 			stat[variableName], _ = atof(string(row[1].([]byte)))
 		} else {
-			log.Fatalln("FetchMetrics (Status): row length is too small: ", len(row))
+			m.targetLogger().Fatalf("FetchMetrics (Status): row length is too small: %d", len(row))
 		}
 	}
 	return nil
 }
 
-func (m MySQLPlugin) fetchShowInnodbStatus(db mysql.Conn, stat map[string]float64) error {
-	row, _, err := db.QueryFirst("SHOW /*!50000 ENGINE*/ INNODB STATUS")
+func (m MySQLPlugin) fetchShowInnodbStatus(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, rows, err := query(ctx, db, "SHOW /*!50000 ENGINE*/ INNODB STATUS")
 	if err != nil {
-		log.Fatalln("FetchMetrics (InnoDB Status): ", err)
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW ENGINE INNODB STATUS"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (InnoDB Status): %s", err)
 	}
 
+	var row []interface{}
+	if len(rows) > 0 {
+		row = rows[0]
+	}
 	if len(row) > 0 {
 		parseInnodbStatus(string(row[len(row)-1].([]byte)), &stat)
 	} else {
@@ -191,27 +337,147 @@ func (m MySQLPlugin) fetchShowInnodbStatus(db mysql.Conn, stat map[string]float6
 	return nil
 }
 
-func (m MySQLPlugin) fetchShowVariables(db mysql.Conn, stat map[string]float64) error {
-	rows, _, err := db.Query("SHOW VARIABLES")
+// The sources of the InnoDB metrics of -innodb-source
+const (
+	innodbSourceAuto              = "auto"
+	innodbSourceStatus            = "status"
+	innodbSourceInformationSchema = "information_schema"
+)
+
+// innodbMetricsNames maps the counters of information_schema.INNODB_METRICS onto the metrics parsed from SHOW ENGINE INNODB STATUS
+var innodbMetricsNames = map[string]string{
+	"os_data_reads":                 "file_reads",
+	"os_data_writes":                "file_writes",
+	"os_data_fsyncs":                "file_fsyncs",
+	"os_log_pending_fsyncs":         "pending_log_flushes",
+	"os_log_pending_writes":         "pending_log_writes",
+	"log_pending_checkpoint_writes": "pending_chkp_writes",
+	"log_num_log_io":                "log_writes",
+	"log_lsn_current":               "log_bytes_written",
+	"log_lsn_last_flush":            "log_bytes_flushed",
+	"log_lsn_last_checkpoint":       "last_checkpoint",
+	"trx_rseg_history_len":          "history_list",
+	"ibuf_merges":                   "ibuf_merges",
+	"dml_reads":                     "rows_read",
+	"dml_inserts":                   "rows_inserted",
+	"dml_updates":                   "rows_updated",
+	"dml_deletes":                   "rows_deleted",
+}
+
+// innodbBufferPoolStatsColumns maps the columns of information_schema.INNODB_BUFFER_POOL_STATS onto the metrics
+// parsed from SHOW ENGINE INNODB STATUS, which are summed up over the buffer pool instances
+var innodbBufferPoolStatsColumns = map[string]string{
+	"POOL_SIZE":                 "pool_size",
+	"FREE_BUFFERS":              "free_pages",
+	"DATABASE_PAGES":            "database_pages",
+	"MODIFIED_DATABASE_PAGES":   "modified_pages",
+	"NUMBER_PAGES_READ":         "pages_read",
+	"NUMBER_PAGES_CREATED":      "pages_created",
+	"NUMBER_PAGES_WRITTEN":      "pages_written",
+	"NUMBER_PAGES_READ_AHEAD":   "read_ahead",
+	"NUMBER_READ_AHEAD_EVICTED": "read_evicted",
+}
+
+// fetchInnodb fetches the InnoDB metrics from -innodb-source. The metrics of information_schema override
+// the ones parsed from SHOW ENGINE INNODB STATUS, which are still used for the metrics without the tables.
+func (m MySQLPlugin) fetchInnodb(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	if err := m.fetchShowInnodbStatus(ctx, db, stat); err != nil {
+		return err
+	}
+	switch m.InnoDBSource {
+	case innodbSourceStatus:
+		return nil
+	case innodbSourceInformationSchema:
+		return m.fetchInnodbInformationSchema(ctx, db, stat)
+	}
+	if err := m.fetchInnodbInformationSchema(ctx, db, stat); err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "selecting information_schema.INNODB_METRICS"); derr != nil {
+			return derr
+		}
+		// MySQL 5.5 or the user without PROCESS
+		m.targetLogger().Debugf("FetchMetrics (InnoDB information_schema): %s", err)
+	}
+	return nil
+}
+
+func (m MySQLPlugin) fetchInnodbInformationSchema(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, metrics, err := query(ctx, db, "SELECT NAME, COUNT FROM information_schema.INNODB_METRICS WHERE STATUS = 'enabled'")
 	if err != nil {
-		log.Fatalln("FetchMetrics (Variables): ", err)
+		return err
+	}
+	columns, pools, err := query(ctx, db, "SELECT * FROM information_schema.INNODB_BUFFER_POOL_STATS")
+	if err != nil {
+		return err
+	}
+	parseInnodbMetrics(metrics, stat)
+	parseInnodbBufferPoolStats(columns, pools, stat)
+	stat["unflushed_log"] = stat["log_bytes_written"] - stat["log_bytes_flushed"]
+	stat["uncheckpointed_bytes"] = stat["log_bytes_written"] - stat["last_checkpoint"]
+	return nil
+}
+
+// parseInnodbMetrics sets the metrics from the rows of NAME and COUNT of INNODB_METRICS
+func parseInnodbMetrics(rows [][]interface{}, stat map[string]float64) {
+	for _, row := range rows {
+		if len(row) < 2 || row[0] == nil || row[1] == nil {
+			continue
+		}
+		key, ok := innodbMetricsNames[string(row[0].([]byte))]
+		if !ok {
+			continue
+		}
+		if v, err := atof(string(row[1].([]byte))); err == nil {
+			stat[key] = v
+		}
+	}
+}
+
+// parseInnodbBufferPoolStats sets the sums of the buffer pool instances of INNODB_BUFFER_POOL_STATS
+func parseInnodbBufferPoolStats(columns []string, rows [][]interface{}, stat map[string]float64) {
+	if len(rows) == 0 {
+		return
+	}
+	for column, key := range innodbBufferPoolStatsColumns {
+		idx := columnIndex(columns, column)
+		if idx < 0 {
+			continue
+		}
+		sum := 0.0
+		for _, row := range rows {
+			if idx >= len(row) || row[idx] == nil {
+				continue
+			}
+			v, _ := atof(string(row[idx].([]byte)))
+			sum += v
+		}
+		stat[key] = sum
+	}
+}
+
+func (m MySQLPlugin) fetchShowVariables(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, rows, err := query(ctx, db, "SHOW VARIABLES")
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW VARIABLES"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (Variables): %s", err)
 	}
 
 	for _, row := range rows {
 		if len(row) > 1 {
 			variableName := string(row[0].([]byte))
 			if err != nil {
-				log.Println("FetchMetrics (Fetch Variables): ", err)
+				m.targetLogger().Warningf("FetchMetrics (Fetch Variables): %s", err)
 			}
 			stat[variableName], _ = atof(string(row[1].([]byte)))
 		} else {
-			log.Fatalln("FetchMetrics (Variables): row length is too small: ", len(row))
+			m.targetLogger().Fatalf("FetchMetrics (Variables): row length is too small: %d", len(row))
 		}
 	}
 	if m.EnableExtended {
 		err = fetchShowVariablesBackwardCompatibile(stat)
 		if err != nil {
-			log.Fatalln("FetchExtendedMetrics (Fetch Variables): ", err)
+			m.targetLogger().Fatalf("FetchExtendedMetrics (Fetch Variables): %s", err)
 		}
 		if _, found := stat["key_cache_block_size"]; found {
 			if _, found = stat["Key_blocks_unused"]; found {
@@ -233,30 +499,129 @@ func fetchShowVariablesBackwardCompatibile(stat map[string]float64) error {
 	return nil
 }
 
-func (m MySQLPlugin) fetchShowSlaveStatus(db mysql.Conn, stat map[string]float64) error {
-	rows, res, err := db.Query("show slave status")
+// fetchShowSlaveStatus runs SHOW REPLICA STATUS of MySQL 8.0.22 or later, or SHOW SLAVE STATUS of the older versions
+func (m MySQLPlugin) fetchShowSlaveStatus(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	columns, rows, err := query(ctx, db, "SHOW REPLICA STATUS")
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW REPLICA STATUS"); derr != nil {
+			return derr
+		}
+		columns, rows, err = query(ctx, db, "show slave status")
+	}
 	if err != nil {
-		log.Fatalln("FetchMetrics (Slave Status): ", err)
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW SLAVE STATUS"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (Slave Status): %s", err)
 		return err
 	}
 
+	if lag, ok := secondsBehindMaster(columns, rows); ok {
+		stat["Seconds_Behind_Master"] = lag
+	}
+	return nil
+}
+
+// secondsBehindMaster returns the worst lag of the replication channels, from Seconds_Behind_Source
+// since MySQL 8.0.22 or Seconds_Behind_Master. The lag is NULL while the replication threads are stopped.
+func secondsBehindMaster(columns []string, rows [][]interface{}) (float64, bool) {
+	idx := columnIndex(columns, "Seconds_Behind_Source")
+	if idx < 0 {
+		idx = columnIndex(columns, "Seconds_Behind_Master")
+	}
+	if idx < 0 {
+		return 0, false
+	}
+
+	var lag float64
+	found := false
 	for _, row := range rows {
-		idx := res.Map("Seconds_Behind_Master")
-		switch row[idx].(type) {
-		case nil:
-			// nop
-		default:
-			Value := row.Int(idx)
-			stat["Seconds_Behind_Master"] = float64(Value)
+		if idx >= len(row) || row[idx] == nil {
+			continue
+		}
+		v, err := atof(string(row[idx].([]byte)))
+		if err != nil {
+			continue
 		}
+		if !found || v > lag {
+			lag = v
+		}
+		found = true
 	}
+	return lag, found
+}
+
+// fetchAuroraReplicaStatus posts the role and the replica lag of Amazon Aurora MySQL, whose SHOW SLAVE STATUS is empty.
+// Nothing is posted for the other servers, which have no @@aurora_server_id.
+func (m MySQLPlugin) fetchAuroraReplicaStatus(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, rows, err := query(ctx, db, "SELECT @@aurora_server_id")
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "selecting @@aurora_server_id"); derr != nil {
+			return derr
+		}
+		return nil
+	}
+	if len(rows) == 0 || len(rows[0]) == 0 || rows[0][0] == nil {
+		return nil
+	}
+	serverID := string(rows[0][0].([]byte))
+
+	columns, rows, err := query(ctx, db, "SELECT SERVER_ID, SESSION_ID, REPLICA_LAG_IN_MILLISECONDS FROM information_schema.replica_host_status")
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "selecting information_schema.replica_host_status"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Warningf("FetchMetrics (Aurora Replica Status): %s", err)
+		return nil
+	}
+	parseAuroraReplicaStatus(serverID, columns, rows, stat)
 	return nil
 }
 
-func (m MySQLPlugin) fetchProcesslist(db mysql.Conn, stat map[string]float64) error {
-	rows, _, err := db.Query("SHOW PROCESSLIST")
+// parseAuroraReplicaStatus sets role to 1 for the writer, whose SESSION_ID is MASTER_SESSION_ID, and 0 for the readers
+// with replication_delay of their own rows
+func parseAuroraReplicaStatus(serverID string, columns []string, rows [][]interface{}, stat map[string]float64) {
+	serverIdx := columnIndex(columns, "SERVER_ID")
+	sessionIdx := columnIndex(columns, "SESSION_ID")
+	lagIdx := columnIndex(columns, "REPLICA_LAG_IN_MILLISECONDS")
+	if serverIdx < 0 || sessionIdx < 0 || lagIdx < 0 {
+		return
+	}
+	for _, row := range rows {
+		if row[serverIdx] == nil || string(row[serverIdx].([]byte)) != serverID {
+			continue
+		}
+		if row[sessionIdx] != nil && string(row[sessionIdx].([]byte)) == "MASTER_SESSION_ID" {
+			stat["role"] = 1
+			return
+		}
+		stat["role"] = 0
+		if row[lagIdx] != nil {
+			if v, err := atof(string(row[lagIdx].([]byte))); err == nil {
+				stat["replication_delay"] = v
+			}
+		}
+		return
+	}
+}
+
+// columnIndex returns the index of the column, or -1 if not found
+func columnIndex(columns []string, name string) int {
+	for i, c := range columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m MySQLPlugin) fetchProcesslist(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	_, rows, err := query(ctx, db, "SHOW PROCESSLIST")
 	if err != nil {
-		log.Fatalln("FetchMetrics (Processlist): ", err)
+		if derr := pluginutil.DeadlineExceeded(ctx, "running SHOW PROCESSLIST"); derr != nil {
+			return derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (Processlist): %s", err)
 		return err
 	}
 
@@ -274,7 +639,7 @@ func (m MySQLPlugin) fetchProcesslist(db mysql.Conn, stat map[string]float64) er
 			}
 			parseProcesslist(state, &stat)
 		} else {
-			log.Fatalln("FetchMetrics (Processlist): row length is too small: ", len(row))
+			m.targetLogger().Fatalf("FetchMetrics (Processlist): row length is too small: %d", len(row))
 		}
 	}
 
@@ -290,45 +655,89 @@ func (m MySQLPlugin) calculateCapacity(stat map[string]float64) {
 
 // FetchMetrics interface for mackerelplugin
 func (m MySQLPlugin) FetchMetrics() (map[string]interface{}, error) {
-	proto := "tcp"
-	if m.isUnixSocket {
-		proto = "unix"
+	ctx, cancel := pluginutil.WithMaxExecutionTime(m.MaxExecutionTime)
+	defer cancel()
+
+	config, err := m.config(ctx)
+	if err != nil {
+		m.targetLogger().Fatalf("FetchMetrics (TLS Config): %s", err)
+		return nil, err
 	}
-	db := mysql.New(proto, "", m.Target, m.Username, m.Password, "")
-	err := db.Connect()
+	db, err := sql.Open("mysql", config.FormatDSN())
 	if err != nil {
-		log.Fatalln("FetchMetrics (DB Connect): ", err)
+		m.targetLogger().Fatalf("FetchMetrics (DB Connect): %s", err)
 		return nil, err
 	}
+	// the queries are bounded by the deadline of ctx
+	db.SetMaxOpenConns(1)
 	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "connecting to MySQL"); derr != nil {
+			m.targetLogger().Errorf("FetchMetrics (DB Connect): %s", derr)
+			return nil, derr
+		}
+		m.targetLogger().Fatalf("FetchMetrics (DB Connect): %s", err)
+		return nil, err
+	}
 
 	stat := make(map[string]float64)
-	m.fetchShowStatus(db, stat)
+	if err := m.fetchMetrics(ctx, db, stat); err != nil {
+		// the metrics fetched before the deadline are posted
+		m.targetLogger().Warningf("FetchMetrics: %s", err)
+	} else {
+		m.calculateCapacity(stat)
+	}
+
+	statRet := make(map[string]interface{})
+	for key, value := range stat {
+		statRet[key] = value
+	}
+
+	return statRet, nil
+}
+
+// fetchMetrics runs the queries in order. It returns the error only if the deadline is exceeded,
+// since the other failures of the queries are fatal.
+func (m *MySQLPlugin) fetchMetrics(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	if err := m.fetchShowStatus(ctx, db, stat); err != nil {
+		return err
+	}
 
 	if m.DisableInnoDB != true {
-		err := m.fetchShowInnodbStatus(db, stat)
+		err := m.fetchInnodb(ctx, db, stat)
+		if derr := pluginutil.DeadlineExceeded(ctx, "fetching the InnoDB metrics"); err != nil && derr != nil {
+			return derr
+		}
 		if err != nil {
-			log.Println("FetchMetrics (InnoDB Status): ", err)
+			m.targetLogger().Warningf("FetchMetrics (InnoDB Status): %s", err)
 			m.DisableInnoDB = true
 		}
 	}
 
-	m.fetchShowVariables(db, stat)
-
-	m.fetchShowSlaveStatus(db, stat)
+	if err := m.fetchShowVariables(ctx, db, stat); err != nil {
+		return err
+	}
 
-	if m.EnableExtended {
-		m.fetchProcesslist(db, stat)
+	if err := m.fetchShowSlaveStatus(ctx, db, stat); err != nil {
+		return err
 	}
 
-	m.calculateCapacity(stat)
+	if err := m.fetchAuroraReplicaStatus(ctx, db, stat); err != nil {
+		return err
+	}
 
-	statRet := make(map[string]interface{})
-	for key, value := range stat {
-		statRet[key] = value
+	if m.EnableExtended {
+		if err := m.fetchProcesslist(ctx, db, stat); err != nil {
+			return err
+		}
 	}
 
-	return statRet, err
+	if m.EnablePerformanceSchema {
+		if err := m.fetchPerformanceSchema(ctx, db, stat); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GraphDefinition interface for mackerelplugin
@@ -340,6 +749,59 @@ func (m MySQLPlugin) GraphDefinition() map[string]mp.Graphs {
 	if m.EnableExtended {
 		graphdef = m.addExtendedGraphdef(graphdef)
 	}
+	if m.EnableGalera {
+		graphdef = m.addGaleraGraphdef(graphdef)
+	}
+	if m.EnablePerformanceSchema {
+		graphdef = m.addPerformanceSchemaGraphdef(graphdef)
+	}
+	return graphdef
+}
+
+// addGaleraGraphdef adds the graphs of the wsrep status of Galera Cluster
+func (m MySQLPlugin) addGaleraGraphdef(graphdef map[string]mp.Graphs) map[string]mp.Graphs {
+	labelPrefix := strings.Title(strings.Replace(m.MetricKeyPrefix(), "mysql", "MySQL", -1))
+	graphdef["wsrep_cluster"] = mp.Graphs{
+		Label: labelPrefix + " wsrep Cluster",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "wsrep_cluster_size", Label: "Cluster Size", Diff: false, Stacked: false},
+		},
+	}
+	// wsrep_local_state is 1: Joining, 2: Donor/Desynced, 3: Joined and 4: Synced
+	graphdef["wsrep_state"] = mp.Graphs{
+		Label: labelPrefix + " wsrep Local State",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "wsrep_local_state", Label: "Local State", Diff: false, Stacked: false},
+		},
+	}
+	graphdef["wsrep_queue"] = mp.Graphs{
+		Label: labelPrefix + " wsrep Queue",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "wsrep_local_recv_queue", Label: "Receive Queue", Diff: false, Stacked: false},
+			{Name: "wsrep_local_send_queue", Label: "Send Queue", Diff: false, Stacked: false},
+		},
+	}
+	graphdef["wsrep_flow_control"] = mp.Graphs{
+		Label: labelPrefix + " wsrep Flow Control",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "wsrep_flow_control_paused", Label: "Paused", Diff: false, Stacked: false},
+		},
+	}
+	graphdef["wsrep_transactions"] = mp.Graphs{
+		Label: labelPrefix + " wsrep Transactions",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "wsrep_replicated", Label: "Replicated", Diff: true, Stacked: false},
+			{Name: "wsrep_received", Label: "Received", Diff: true, Stacked: false},
+			{Name: "wsrep_local_commits", Label: "Local Commits", Diff: true, Stacked: false},
+			{Name: "wsrep_local_cert_failures", Label: "Certification Failures", Diff: true, Stacked: false},
+			{Name: "wsrep_local_bf_aborts", Label: "Brute Force Aborts", Diff: true, Stacked: false},
+		},
+	}
 	return graphdef
 }
 
@@ -1035,18 +1497,37 @@ func makeBigint(hi string, lo string) int64 {
 	return val
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the target, i.e. the host and the port or the socket
+func (m MySQLPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "mysql", m.Target)
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "3306", "Port")
 	optSocket := flag.String("socket", "", "Port")
 	optUser := flag.String("username", "root", "Username")
-	optPass := flag.String("password", "", "Password")
+	optPass := flag.String("password", "", "Password (or $MACKEREL_PLUGIN_MYSQL_PASSWORD, $MYSQL_PWD)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optInnoDB := flag.Bool("disable_innodb", false, "Disable InnoDB metrics")
 	optMetricKeyPrefix := flag.String("metric-key-prefix", "mysql", "metric key prefix")
 	optEnableExtended := flag.Bool("enable_extended", false, "Enable Extended metrics")
+	optEnableGalera := flag.Bool("enable-galera", false, "Enable the wsrep metrics of Galera Cluster")
+	optEnablePerformanceSchema := flag.Bool("enable-performance-schema", false, "Enable the statement summary metrics of performance_schema")
+	optInnoDBSource := flag.String("innodb-source", innodbSourceAuto, "Source of the InnoDB metrics: auto, status or information_schema. auto uses information_schema if available")
+	optSSL := flag.Bool("ssl", false, "Connect with TLS (ignored for -socket)")
+	optSSLCA := flag.String("ssl-ca", "", "CA certificate file to verify the server certificate")
+	optSSLCert := flag.String("ssl-cert", "", "Client certificate file")
+	optSSLKey := flag.String("ssl-key", "", "Client private key file")
+	optSSLSkipVerify := flag.Bool("ssl-skip-verify", false, "Skip the verification of the server certificate")
+	optDefaultsFile := flag.String("defaults-file", "", "Option file to read user, password, host, port and socket of [client] from (default: ~/.my.cnf if exists)")
+	optMaxExecutionTime := pluginutil.MaxExecutionTimeFlag(flag.CommandLine)
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_MYSQL_PASSWORD", "MYSQL_PWD")
+	if err := setFromDefaultsFile(flag.CommandLine, *optDefaultsFile); err != nil {
+		logger.Fatalf("%s", err)
+	}
 
 	var mysql MySQLPlugin
 
@@ -1061,7 +1542,25 @@ func Do() {
 	mysql.DisableInnoDB = *optInnoDB
 	mysql.prefix = *optMetricKeyPrefix
 	mysql.EnableExtended = *optEnableExtended
+	mysql.EnableGalera = *optEnableGalera
+	mysql.EnablePerformanceSchema = *optEnablePerformanceSchema
+	switch *optInnoDBSource {
+	case innodbSourceAuto, innodbSourceStatus, innodbSourceInformationSchema:
+		mysql.InnoDBSource = *optInnoDBSource
+	default:
+		logger.Fatalf("-innodb-source should be auto, status or information_schema: %s", *optInnoDBSource)
+	}
+	mysql.UseSSL = *optSSL
+	mysql.SSLCA = *optSSLCA
+	mysql.SSLCert = *optSSLCert
+	mysql.SSLKey = *optSSLKey
+	mysql.SSLSkipVerify = *optSSLSkipVerify
+	mysql.MaxExecutionTime = *optMaxExecutionTime
 	helper := mp.NewMackerelPlugin(mysql)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = mysql.tempfile(*optTempfile)
+	if mysql.EnablePerformanceSchema && helper.Tempfile != "" {
+		mysql.performanceSchemaWarnedFile = helper.Tempfile + ".performance_schema"
+		helper.Plugin = mysql
+	}
 	helper.Run()
 }
@@ -1,6 +1,7 @@
 package mpmysql
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,7 +12,7 @@ func TestGraphDefinition_DisableInnoDB(t *testing.T) {
 
 	mysql.DisableInnoDB = true
 	graphdef := mysql.GraphDefinition()
-	if len(graphdef) != 8 {
+	if len(graphdef) != 9 {
 		t.Errorf("GetTempfilename: %d should be 7", len(graphdef))
 	}
 }
@@ -20,7 +21,7 @@ func TestGraphDefinition(t *testing.T) {
 	var mysql MySQLPlugin
 
 	graphdef := mysql.GraphDefinition()
-	if len(graphdef) != 29 {
+	if len(graphdef) != 30 {
 		t.Errorf("GetTempfilename: %d should be 28", len(graphdef))
 	}
 }
@@ -31,8 +32,8 @@ func TestGraphDefinition_DisableInnoDB_EnableExtended(t *testing.T) {
 	mysql.DisableInnoDB = true
 	mysql.EnableExtended = true
 	graphdef := mysql.GraphDefinition()
-	if len(graphdef) != 18 {
-		t.Errorf("GetTempfilename: %d should be 18", len(graphdef))
+	if len(graphdef) != 19 {
+		t.Errorf("GetTempfilename: %d should be 19", len(graphdef))
 	}
 }
 
@@ -41,8 +42,21 @@ func TestGraphDefinition_EnableExtended(t *testing.T) {
 
 	mysql.EnableExtended = true
 	graphdef := mysql.GraphDefinition()
-	if len(graphdef) != 39 {
-		t.Errorf("GetTempfilename: %d should be 39", len(graphdef))
+	if len(graphdef) != 40 {
+		t.Errorf("GetTempfilename: %d should be 40", len(graphdef))
+	}
+}
+
+func TestGraphDefinition_EnableGalera(t *testing.T) {
+	var mysql MySQLPlugin
+
+	mysql.EnableGalera = true
+	graphdef := mysql.GraphDefinition()
+	if len(graphdef) != 35 {
+		t.Errorf("GetTempfilename: %d should be 35", len(graphdef))
+	}
+	if _, ok := graphdef["wsrep_state"]; !ok {
+		t.Errorf("wsrep_state should be defined with EnableGalera")
 	}
 }
 
@@ -1370,3 +1384,161 @@ func TestParseProcesslist2(t *testing.T) {
 	assert.EqualValues(t, 1, stat["State_none"])
 	assert.EqualValues(t, 58, stat["State_other"])
 }
+
+func TestTempfile(t *testing.T) {
+	p := MySQLPlugin{Target: "localhost:3306"}
+	if other := (MySQLPlugin{Target: "localhost:3307"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with Target: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/mysql.json"); f != "/tmp/mysql.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+func TestSecondsBehindMaster(t *testing.T) {
+	// SHOW SLAVE STATUS before MySQL 8.0.22
+	slave := []string{"Slave_IO_Running", "Slave_SQL_Running", "Seconds_Behind_Master"}
+	lag, ok := secondsBehindMaster(slave, [][]interface{}{{[]byte("Yes"), []byte("Yes"), []byte("12")}})
+	assert.True(t, ok)
+	assert.EqualValues(t, 12, lag)
+
+	// SHOW REPLICA STATUS with the channels of the multi-source replication
+	replica := []string{"Replica_IO_Running", "Replica_SQL_Running", "Seconds_Behind_Source", "Channel_Name"}
+	lag, ok = secondsBehindMaster(replica, [][]interface{}{
+		{[]byte("Yes"), []byte("Yes"), []byte("3"), []byte("source_1")},
+		{[]byte("Yes"), []byte("Yes"), []byte("40"), []byte("source_2")},
+		{[]byte("No"), []byte("Yes"), nil, []byte("source_3")},
+	})
+	assert.True(t, ok)
+	assert.EqualValues(t, 40, lag, "the worst lag of the channels should be posted")
+
+	// the replication threads are stopped
+	_, ok = secondsBehindMaster(replica, [][]interface{}{{[]byte("No"), []byte("No"), nil, []byte("")}})
+	assert.False(t, ok)
+
+	// not a replica
+	_, ok = secondsBehindMaster(replica, nil)
+	assert.False(t, ok)
+}
+
+func TestConfig(t *testing.T) {
+	m := MySQLPlugin{Target: "db.example.com:3306", Username: "mackerel", Password: "secret", UseSSL: true}
+	config, err := m.config(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", config.Net)
+	assert.Equal(t, tlsConfigName, config.TLSConfig)
+
+	tlsConfig, err := m.tlsConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "db.example.com", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify, "the hostname should be verified by default")
+
+	// the TLS options are ignored for the socket
+	m = MySQLPlugin{Target: "/var/run/mysqld/mysqld.sock", isUnixSocket: true, UseSSL: true, SSLCA: "/nonexistent/ca.pem"}
+	config, err = m.config(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", config.Net)
+	assert.Equal(t, "", config.TLSConfig)
+
+	m = MySQLPlugin{Target: "db.example.com:3306", UseSSL: true, SSLCert: "client.pem"}
+	_, err = m.config(context.Background())
+	assert.Error(t, err, "both -ssl-cert and -ssl-key should be required")
+}
+
+func TestParseInnodbInformationSchema(t *testing.T) {
+	status := `
+------------
+TRANSACTIONS
+------------
+History list length 775
+--------
+FILE I/O
+--------
+516 OS file reads, 55 OS file writes, 9 OS fsyncs
+---
+LOG
+---
+Log sequence number 379575319
+Log flushed up to   379575300
+Last checkpoint at  379575310
+12 log i/o's done, 3.00 log i/o's/second
+----------------------
+BUFFER POOL AND MEMORY
+----------------------
+Buffer pool size   32764
+Free buffers       32472
+Database pages     288
+Modified db pages  1
+Pages read 288, created 34, written 36
+Pages read ahead 0.00/s, evicted without access 0.00/s, Random read ahead 0.00/s
+--------------
+ROW OPERATIONS
+--------------
+Number of rows inserted 3, updated 4, deleted 5, read 8
+`
+	metrics := [][]interface{}{
+		{[]byte("trx_rseg_history_len"), []byte("775")},
+		{[]byte("os_data_reads"), []byte("516")},
+		{[]byte("os_data_writes"), []byte("55")},
+		{[]byte("os_data_fsyncs"), []byte("9")},
+		{[]byte("log_lsn_current"), []byte("379575319")},
+		{[]byte("log_lsn_last_flush"), []byte("379575300")},
+		{[]byte("log_lsn_last_checkpoint"), []byte("379575310")},
+		{[]byte("log_num_log_io"), []byte("12")},
+		{[]byte("dml_reads"), []byte("8")},
+		{[]byte("dml_inserts"), []byte("3")},
+		{[]byte("dml_updates"), []byte("4")},
+		{[]byte("dml_deletes"), []byte("5")},
+		{[]byte("lock_deadlocks"), []byte("2")},
+	}
+	columns := []string{"POOL_ID", "POOL_SIZE", "FREE_BUFFERS", "DATABASE_PAGES", "OLD_DATABASE_PAGES", "MODIFIED_DATABASE_PAGES",
+		"NUMBER_PAGES_READ", "NUMBER_PAGES_CREATED", "NUMBER_PAGES_WRITTEN", "NUMBER_PAGES_READ_AHEAD", "NUMBER_READ_AHEAD_EVICTED"}
+	// the buffer pool of 2 instances
+	pools := [][]interface{}{
+		{[]byte("0"), []byte("16382"), []byte("16228"), []byte("152"), []byte("0"), []byte("0"), []byte("152"), []byte("0"), []byte("2"), []byte("0"), []byte("0")},
+		{[]byte("1"), []byte("16382"), []byte("16244"), []byte("136"), []byte("0"), []byte("1"), []byte("136"), []byte("34"), []byte("34"), []byte("0"), []byte("0")},
+	}
+
+	fromStatus := make(map[string]float64)
+	parseInnodbStatus(status, &fromStatus)
+	fromInformationSchema := make(map[string]float64)
+	parseInnodbMetrics(metrics, fromInformationSchema)
+	parseInnodbBufferPoolStats(columns, pools, fromInformationSchema)
+
+	var keys []string
+	for _, k := range innodbBufferPoolStatsColumns {
+		keys = append(keys, k)
+	}
+	for _, k := range []string{"history_list", "file_reads", "file_writes", "file_fsyncs", "log_bytes_written", "log_bytes_flushed", "last_checkpoint", "log_writes", "rows_read", "rows_inserted", "rows_updated", "rows_deleted"} {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		v, ok := fromInformationSchema[k]
+		assert.True(t, ok, k+" should be set from information_schema")
+		assert.EqualValues(t, fromStatus[k], v, k+" should be the same in both sources")
+	}
+	assert.Len(t, fromInformationSchema, len(keys), "the counters without the mapping should be ignored")
+}
+
+func TestParseAuroraReplicaStatus(t *testing.T) {
+	columns := []string{"SERVER_ID", "SESSION_ID", "REPLICA_LAG_IN_MILLISECONDS"}
+	rows := [][]interface{}{
+		{[]byte("aurora-1"), []byte("MASTER_SESSION_ID"), []byte("0")},
+		{[]byte("aurora-2"), []byte("b7a9e1c0-1c2d-11eb-adc1-0242ac120002"), []byte("18.5")},
+	}
+
+	stat := make(map[string]float64)
+	parseAuroraReplicaStatus("aurora-1", columns, rows, stat)
+	assert.EqualValues(t, 1, stat["role"])
+	_, ok := stat["replication_delay"]
+	assert.False(t, ok, "replication_delay should not be posted for the writer")
+
+	stat = make(map[string]float64)
+	parseAuroraReplicaStatus("aurora-2", columns, rows, stat)
+	assert.EqualValues(t, 0, stat["role"])
+	assert.EqualValues(t, 18.5, stat["replication_delay"])
+
+	stat = make(map[string]float64)
+	parseAuroraReplicaStatus("aurora-3", columns, rows, stat)
+	assert.Len(t, stat, 0)
+}
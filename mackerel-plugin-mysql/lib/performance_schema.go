@@ -0,0 +1,104 @@
+package mpmysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+)
+
+// performanceSchemaStatementsQuery sums up the statement summary of all the event names.
+// SUM_TIMER_WAIT is in picoseconds.
+const performanceSchemaStatementsQuery = `SELECT
+	SUM(SUM_TIMER_WAIT) / 1000000000 AS statement_latency,
+	SUM(SUM_NO_INDEX_USED) AS full_scans,
+	SUM(SUM_CREATED_TMP_DISK_TABLES) AS tmp_disk_tables,
+	SUM(SUM_SORT_MERGE_PASSES) AS sort_merge_passes
+FROM performance_schema.events_statements_summary_global_by_event_name`
+
+// errPerformanceSchemaDisabled is returned when the statement summary is empty, as with performance_schema=OFF
+var errPerformanceSchemaDisabled = errors.New("the statement summary of performance_schema is empty. performance_schema may be disabled")
+
+// fetchPerformanceSchema posts the statement summary of performance_schema. The failure is warned only once until
+// it succeeds again, since performance_schema disabled or the lack of the privileges does not resolve by itself.
+func (m MySQLPlugin) fetchPerformanceSchema(ctx context.Context, db *sql.DB, stat map[string]float64) error {
+	columns, rows, err := query(ctx, db, performanceSchemaStatementsQuery)
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "selecting performance_schema"); derr != nil {
+			return derr
+		}
+	} else {
+		err = parsePerformanceSchemaStatements(columns, rows, stat)
+	}
+	if err != nil {
+		m.warnPerformanceSchemaOnce(err)
+		return nil
+	}
+	if m.performanceSchemaWarnedFile != "" {
+		os.Remove(m.performanceSchemaWarnedFile)
+	}
+	return nil
+}
+
+// warnPerformanceSchemaOnce warns the failure if it has not been warned since the last success,
+// which is remembered by the file next to the tempfile
+func (m MySQLPlugin) warnPerformanceSchemaOnce(err error) {
+	if m.performanceSchemaWarnedFile == "" {
+		m.targetLogger().Warningf("FetchMetrics (Performance Schema): %s", err)
+		return
+	}
+	if _, serr := os.Stat(m.performanceSchemaWarnedFile); serr == nil {
+		return
+	}
+	m.targetLogger().Warningf("FetchMetrics (Performance Schema): %s. The metrics are skipped without this warning until they are fetched.", err)
+	ioutil.WriteFile(m.performanceSchemaWarnedFile, nil, 0600)
+}
+
+// parsePerformanceSchemaStatements sets the sums of the statement summary, which are NULL if the summary is empty
+func parsePerformanceSchemaStatements(columns []string, rows [][]interface{}, stat map[string]float64) error {
+	if len(rows) == 0 {
+		return errPerformanceSchemaDisabled
+	}
+	values := make(map[string]float64)
+	for i, column := range columns {
+		if i >= len(rows[0]) || rows[0][i] == nil {
+			return errPerformanceSchemaDisabled
+		}
+		v, err := atof(string(rows[0][i].([]byte)))
+		if err != nil {
+			return err
+		}
+		values[column] = v
+	}
+	for k, v := range values {
+		stat[k] = v
+	}
+	return nil
+}
+
+// addPerformanceSchemaGraphdef adds the graphs of the statement summary of performance_schema
+func (m MySQLPlugin) addPerformanceSchemaGraphdef(graphdef map[string]mp.Graphs) map[string]mp.Graphs {
+	labelPrefix := strings.Title(strings.Replace(m.MetricKeyPrefix(), "mysql", "MySQL", -1))
+	graphdef["performance_schema_statements"] = mp.Graphs{
+		Label: labelPrefix + " Performance Schema Statements",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "full_scans", Label: "Full Table Scans", Diff: true, Stacked: false},
+			{Name: "tmp_disk_tables", Label: "Tmp Disk Tables", Diff: true, Stacked: false},
+			{Name: "sort_merge_passes", Label: "Sort Merge Passes", Diff: true, Stacked: false},
+		},
+	}
+	graphdef["performance_schema_latency"] = mp.Graphs{
+		Label: labelPrefix + " Performance Schema Statement Latency (ms)",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "statement_latency", Label: "Total Latency", Diff: true, Stacked: false},
+		},
+	}
+	return graphdef
+}
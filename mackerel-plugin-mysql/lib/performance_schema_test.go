@@ -0,0 +1,59 @@
+package mpmysql
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePerformanceSchemaStatements(t *testing.T) {
+	columns := []string{"statement_latency", "full_scans", "tmp_disk_tables", "sort_merge_passes"}
+	stat := make(map[string]float64)
+	err := parsePerformanceSchemaStatements(columns, [][]interface{}{
+		{[]byte("123456.7890"), []byte("42"), []byte("3"), []byte("0")},
+	}, stat)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 123456.789, stat["statement_latency"])
+	assert.EqualValues(t, 42, stat["full_scans"])
+	assert.EqualValues(t, 3, stat["tmp_disk_tables"])
+	assert.EqualValues(t, 0, stat["sort_merge_passes"])
+}
+
+func TestParsePerformanceSchemaStatements_Disabled(t *testing.T) {
+	columns := []string{"statement_latency", "full_scans", "tmp_disk_tables", "sort_merge_passes"}
+	stat := make(map[string]float64)
+	err := parsePerformanceSchemaStatements(columns, [][]interface{}{{nil, nil, nil, nil}}, stat)
+	assert.Equal(t, errPerformanceSchemaDisabled, err)
+	assert.Len(t, stat, 0)
+}
+
+func TestWarnPerformanceSchemaOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-mysql")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	warned := filepath.Join(dir, "mysql.performance_schema")
+	m := MySQLPlugin{Target: "localhost:3306", performanceSchemaWarnedFile: warned}
+
+	m.warnPerformanceSchemaOnce(errors.New("SELECT command denied"))
+	_, err = os.Stat(warned)
+	assert.Nil(t, err, "the warning should be remembered")
+
+	// the second failure is not warned, and the file is left
+	m.warnPerformanceSchemaOnce(errors.New("SELECT command denied"))
+	_, err = os.Stat(warned)
+	assert.Nil(t, err)
+}
+
+func TestGraphDefinition_EnablePerformanceSchema(t *testing.T) {
+	var mysql MySQLPlugin
+
+	mysql.EnablePerformanceSchema = true
+	graphdef := mysql.GraphDefinition()
+	assert.Contains(t, graphdef, "performance_schema_statements")
+	assert.Contains(t, graphdef, "performance_schema_latency")
+	assert.Len(t, graphdef["performance_schema_statements"].Metrics, 3)
+}
@@ -0,0 +1,94 @@
+package mpnginx
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStubStatus = `Active connections: 123
+server accepts handled requests
+ 1693613501 1693613501 7996986318
+Reading: 66 Writing: 16 Waiting: 41
+`
+
+func TestFetchMetricsSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "nginx-status.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix socket is not available: %s", err)
+	}
+	var host string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		fmt.Fprint(w, testStubStatus)
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	nginx := NginxPlugin{URI: "http://localhost/nginx_status", Header: stringSlice{"Host: status.example.com"}, Socket: socket}
+	stat, err := nginx.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 123, stat["connections"])
+	assert.Equal(t, "status.example.com", host)
+
+	nginx.Socket = filepath.Join(dir, "missing.sock")
+	_, err = nginx.FetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), nginx.Socket) {
+		t.Errorf("the error should name the socket: %v", err)
+	}
+}
+
+func TestFetchMetricsTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testStubStatus)
+	}))
+	defer ts.Close()
+
+	nginx := NginxPlugin{URI: ts.URL + "/nginx_status"}
+	_, err := nginx.FetchMetrics()
+	assert.NotNil(t, err, "the certificate of the test server should not be verified")
+
+	nginx.InsecureSkipVerify = true
+	_, err = nginx.FetchMetrics()
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "mackerel-plugin-nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacert := filepath.Join(dir, "ca.pem")
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(cacert, pemBytes, 0600); err != nil {
+		t.Fatal(err)
+	}
+	nginx = NginxPlugin{URI: ts.URL + "/nginx_status", CACert: cacert}
+	stat, err := nginx.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 41, stat["waiting"])
+}
+
+func TestTempfileSocket(t *testing.T) {
+	a := NginxPlugin{URI: "http://localhost/nginx_status", Socket: "/var/run/a.sock"}
+	b := NginxPlugin{URI: "http://localhost/nginx_status", Socket: "/var/run/b.sock"}
+	assert.NotEqual(t, a.tempfile(""), b.tempfile(""))
+	// the tempfile without the socket is kept
+	assert.Equal(t, pluginutil.Tempfile("", "nginx", a.URI), NginxPlugin{URI: a.URI}.tempfile(""))
+}
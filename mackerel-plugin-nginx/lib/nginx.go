@@ -2,9 +2,15 @@ package mpnginx
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 
 	"errors"
 	"net/http"
@@ -13,35 +19,10 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"nginx.connections": {
-		Label: "Nginx Connections",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "connections", Label: "Active connections", Diff: false},
-		},
-	},
-	"nginx.requests": {
-		Label: "Nginx requests",
-		Unit:  "float",
-		Metrics: []mp.Metrics{
-			{Name: "accepts", Label: "Accepted connections", Diff: true, Type: "uint64"},
-			{Name: "handled", Label: "Handled connections", Diff: true, Type: "uint64"},
-			{Name: "requests", Label: "Handled requests", Diff: true, Type: "uint64"},
-		},
-	},
-	"nginx.queue": {
-		Label: "Nginx connection status",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "reading", Label: "Reading", Diff: false},
-			{Name: "writing", Label: "Writing", Diff: false},
-			{Name: "waiting", Label: "Waiting", Diff: false},
-		},
-	},
-}
+var logger = pluginutil.NewLogger("nginx")
 
 type stringSlice []string
 
@@ -56,8 +37,31 @@ func (s *stringSlice) String() string {
 
 // NginxPlugin mackerel plugin for Nginx
 type NginxPlugin struct {
-	URI    string
-	Header stringSlice
+	URI         string
+	Header      stringSlice
+	Prefix      string
+	LabelPrefix string
+	// Format is the format of the status, stub for stub_status, vts for nginx-module-vts or plus for the NGINX Plus API
+	Format string
+
+	// Socket is the path of the unix socket to which the requests of URI are sent
+	Socket             string
+	CACert             string
+	InsecureSkipVerify bool
+}
+
+// the formats of the status
+const (
+	formatStub = "stub"
+	formatVTS  = "vts"
+	formatPlus = "plus"
+)
+
+// defaultPaths are the default paths of the status of each format
+var defaultPaths = map[string]string{
+	formatStub: "/nginx_status",
+	formatVTS:  "/status/format/json",
+	formatPlus: "/api/9",
 }
 
 // % wget -qO- http://localhost:8080/nginx_status
@@ -68,7 +72,25 @@ type NginxPlugin struct {
 
 // FetchMetrics interface for mackerelplugin
 func (n NginxPlugin) FetchMetrics() (map[string]interface{}, error) {
-	req, err := http.NewRequest("GET", n.URI, nil)
+	switch n.Format {
+	case formatVTS:
+		return n.fetchVTS()
+	case formatPlus:
+		return n.fetchPlus()
+	}
+
+	resp, err := n.get(n.URI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return n.parseStats(resp.Body)
+}
+
+// get requests uri with the headers
+func (n NginxPlugin) get(uri string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", uri, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -85,13 +107,59 @@ func (n NginxPlugin) FetchMetrics() (map[string]interface{}, error) {
 			req.Header.Set(k, v)
 		}
 	}
-	resp, err := http.DefaultClient.Do(req)
+	client, err := n.httpClient()
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	resp, err := client.Do(req)
+	if err != nil && n.Socket != "" {
+		return nil, fmt.Errorf("failed to request via the socket %s: %s", n.Socket, err)
+	}
+	return resp, err
+}
 
-	return n.parseStats(resp.Body)
+// httpClient returns the client dialing Socket instead of the host of URI if it is given, with the TLS configuration
+func (n NginxPlugin) httpClient() (*http.Client, error) {
+	if n.Socket == "" && n.CACert == "" && !n.InsecureSkipVerify {
+		return http.DefaultClient, nil
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if n.Socket != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", n.Socket)
+		}
+	}
+	if n.CACert != "" || n.InsecureSkipVerify {
+		config := &tls.Config{InsecureSkipVerify: n.InsecureSkipVerify}
+		if n.CACert != "" {
+			pem, err := ioutil.ReadFile(n.CACert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", n.CACert)
+			}
+			config.RootCAs = pool
+		}
+		transport.TLSClientConfig = config
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// getJSON decodes the JSON response of uri into v
+func (n NginxPlugin) getJSON(uri string, v interface{}) error {
+	resp, err := n.get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", uri, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
 }
 
 func (n NginxPlugin) parseStats(body io.Reader) (map[string]interface{}, error) {
@@ -163,32 +231,104 @@ func (n NginxPlugin) parseStats(body io.Reader) (map[string]interface{}, error)
 	return stat, nil
 }
 
+// MetricKeyPrefix interface for PluginWithPrefix
+func (n NginxPlugin) MetricKeyPrefix() string {
+	if n.Prefix == "" {
+		n.Prefix = "nginx"
+	}
+	return n.Prefix
+}
+
 // GraphDefinition interface for mackerelplugin
 func (n NginxPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := n.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(n.MetricKeyPrefix())
+	}
+
+	graphdef := map[string]mp.Graphs{
+		"connections": {
+			Label: labelPrefix + " Connections",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "connections", Label: "Active connections", Diff: false},
+			},
+		},
+		"requests": {
+			Label: labelPrefix + " requests",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "accepts", Label: "Accepted connections", Diff: true, Type: "uint64"},
+				{Name: "handled", Label: "Handled connections", Diff: true, Type: "uint64"},
+				{Name: "requests", Label: "Handled requests", Diff: true, Type: "uint64"},
+			},
+		},
+		"queue": {
+			Label: labelPrefix + " connection status",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "reading", Label: "Reading", Diff: false},
+				{Name: "writing", Label: "Writing", Diff: false},
+				{Name: "waiting", Label: "Waiting", Diff: false},
+			},
+		},
+	}
+	if n.Format == formatVTS || n.Format == formatPlus {
+		for k, v := range zoneGraphDefinition(labelPrefix) {
+			graphdef[k] = v
+		}
+	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the status page and the socket
+func (n NginxPlugin) tempfile(tempfile string) string {
+	if n.Socket == "" {
+		return pluginutil.Tempfile(tempfile, "nginx", n.URI)
+	}
+	return pluginutil.Tempfile(tempfile, "nginx", n.URI, n.Socket)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "", "URI")
 	optScheme := flag.String("scheme", "http", "Scheme")
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "8080", "Port")
-	optPath := flag.String("path", "/nginx_status", "Path")
+	optPath := flag.String("path", defaultPaths[formatStub], "Path (default: /status/format/json for vts, and /api/9 for plus)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optHeader := &stringSlice{}
 	flag.Var(optHeader, "header", "Set http header (e.g. \"Host: servername\")")
+	optPrefix := flag.String("metric-key-prefix", "nginx", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
+	optFormat := flag.String("format", formatStub, "Format of the status: stub (stub_status), vts (nginx-module-vts) or plus (NGINX Plus API)")
+	optSocket := flag.String("socket", "", "Unix socket to which the request of the status is sent, e.g. /var/run/nginx-status.sock")
+	optCACert := flag.String("cacert", "", "CA certificate file to verify the server certificate")
+	optInsecure := flag.Bool("insecure", false, "Skip the verification of the server certificate")
 	flag.Parse()
 
-	var nginx NginxPlugin
+	path, ok := defaultPaths[*optFormat]
+	if !ok {
+		logger.Fatalf("Unknown -format: %s", *optFormat)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "path" {
+			path = *optPath
+		}
+	})
+
+	nginx := NginxPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix, Format: *optFormat}
 	if *optURI != "" {
 		nginx.URI = *optURI
 	} else {
-		nginx.URI = fmt.Sprintf("%s://%s:%s%s", *optScheme, *optHost, *optPort, *optPath)
+		nginx.URI = fmt.Sprintf("%s://%s:%s%s", *optScheme, *optHost, *optPort, path)
 	}
 	nginx.Header = *optHeader
+	nginx.Socket = *optSocket
+	nginx.CACert = *optCACert
+	nginx.InsecureSkipVerify = *optInsecure
 
 	helper := mp.NewMackerelPlugin(nginx)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = nginx.tempfile(*optTempfile)
 	helper.Run()
 }
@@ -16,6 +16,22 @@ func TestGraphDefinition(t *testing.T) {
 	if len(graphdef) != 3 {
 		t.Errorf("GetTempfilename: %d should be 3", len(graphdef))
 	}
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range graphdef {
+		graphs[nginx.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"nginx.connections": "Nginx Connections",
+		"nginx.requests":    "Nginx requests",
+		"nginx.queue":       "Nginx connection status",
+	}, graphs)
+
+	nginx.Prefix = "nginx-proxy"
+	assert.Equal(t, "Nginx-Proxy Connections", nginx.GraphDefinition()["connections"].Label)
+	nginx.LabelPrefix = "Proxy"
+	assert.Equal(t, "Proxy Connections", nginx.GraphDefinition()["connections"].Label)
 }
 
 func TestParse(t *testing.T) {
@@ -36,3 +52,13 @@ Reading: 66 Writing: 16 Waiting: 41
 	assert.EqualValues(t, reflect.TypeOf(stat["accepts"]).String(), "float64")
 	assert.EqualValues(t, stat["accepts"], 1693613501)
 }
+
+func TestTempfile(t *testing.T) {
+	p := NginxPlugin{URI: "http://localhost:8080/nginx_status"}
+	if other := (NginxPlugin{URI: "http://localhost:8081/nginx_status"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/nginx.json"); f != "/tmp/nginx.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,206 @@
+package mpnginx
+
+import (
+	"regexp"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// zoneNameRe matches the characters not allowed in the metric names, e.g. the dots of the server names
+var zoneNameRe = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+// zoneMetricName returns the name of the zone in the metric names, where * of vts, the total of the server zones,
+// is named total
+func zoneMetricName(name string) string {
+	if name == "*" {
+		return "total"
+	}
+	return strings.Trim(zoneNameRe.ReplaceAllString(name, "_"), "_")
+}
+
+type zoneResponses struct {
+	Responses1xx float64 `json:"1xx"`
+	Responses2xx float64 `json:"2xx"`
+	Responses3xx float64 `json:"3xx"`
+	Responses4xx float64 `json:"4xx"`
+	Responses5xx float64 `json:"5xx"`
+}
+
+// setZone sets the requests and the responses of the server zone. The zones are posted as they are found, so that
+// a new zone has no diff until the next run, and a removed one is left from the tempfile.
+func setZone(stat map[string]interface{}, name string, requests float64, responses zoneResponses) {
+	name = zoneMetricName(name)
+	stat["server_zone_requests."+name+".requests"] = requests
+	prefix := "server_zone_responses." + name + "."
+	stat[prefix+"responses_1xx"] = responses.Responses1xx
+	stat[prefix+"responses_2xx"] = responses.Responses2xx
+	stat[prefix+"responses_3xx"] = responses.Responses3xx
+	stat[prefix+"responses_4xx"] = responses.Responses4xx
+	stat[prefix+"responses_5xx"] = responses.Responses5xx
+}
+
+// setUpstreamResponseTime sets the average response time of the server in the upstream in milliseconds
+func setUpstreamResponseTime(stat map[string]interface{}, upstream, server string, msec float64) {
+	stat["upstream_response_time."+zoneMetricName(upstream+"_"+server)+".response_msec"] = msec
+}
+
+// zoneGraphDefinition returns the graphs of the zones of vts and NGINX Plus. The counters are diffed as float,
+// so that a counter reset by the reload of nginx is skipped instead of a spike.
+func zoneGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"server_zone_requests.#": {
+			Label: labelPrefix + " Server Zone Requests",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true},
+			},
+		},
+		"server_zone_responses.#": {
+			Label: labelPrefix + " Server Zone Responses",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "responses_1xx", Label: "1xx", Diff: true, Stacked: true},
+				{Name: "responses_2xx", Label: "2xx", Diff: true, Stacked: true},
+				{Name: "responses_3xx", Label: "3xx", Diff: true, Stacked: true},
+				{Name: "responses_4xx", Label: "4xx", Diff: true, Stacked: true},
+				{Name: "responses_5xx", Label: "5xx", Diff: true, Stacked: true},
+			},
+		},
+		"upstream_response_time.#": {
+			Label: labelPrefix + " Upstream Response Time",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "response_msec", Label: "Response Time (msec)", Diff: false},
+			},
+		},
+	}
+}
+
+// % wget -qO- http://localhost:8080/status/format/json
+// {"connections":{"active":2,"reading":0,"writing":1,"waiting":1,"accepted":10,"handled":10,"requests":32},
+//  "serverZones":{"example.com":{"requestCounter":30,"responses":{"1xx":0,"2xx":25,"3xx":2,"4xx":3,"5xx":0}},...},
+//  "upstreamZones":{"backend":[{"server":"10.0.0.1:80","requestCounter":20,"responses":{...},"responseMsec":12},...]}}
+
+type vtsStatus struct {
+	Connections struct {
+		Active   float64 `json:"active"`
+		Reading  float64 `json:"reading"`
+		Writing  float64 `json:"writing"`
+		Waiting  float64 `json:"waiting"`
+		Accepted float64 `json:"accepted"`
+		Handled  float64 `json:"handled"`
+		Requests float64 `json:"requests"`
+	} `json:"connections"`
+	ServerZones map[string]struct {
+		RequestCounter float64       `json:"requestCounter"`
+		Responses      zoneResponses `json:"responses"`
+	} `json:"serverZones"`
+	UpstreamZones map[string][]struct {
+		Server       string  `json:"server"`
+		ResponseMsec float64 `json:"responseMsec"`
+	} `json:"upstreamZones"`
+}
+
+func (n NginxPlugin) fetchVTS() (map[string]interface{}, error) {
+	var status vtsStatus
+	if err := n.getJSON(n.URI, &status); err != nil {
+		return nil, err
+	}
+	return parseVTS(status), nil
+}
+
+// parseVTS returns the metrics of vts, where the connections are posted as the metrics of stub_status
+func parseVTS(status vtsStatus) map[string]interface{} {
+	stat := map[string]interface{}{
+		"connections": status.Connections.Active,
+		"accepts":     status.Connections.Accepted,
+		"handled":     status.Connections.Handled,
+		"requests":    status.Connections.Requests,
+		"reading":     status.Connections.Reading,
+		"writing":     status.Connections.Writing,
+		"waiting":     status.Connections.Waiting,
+	}
+	for name, zone := range status.ServerZones {
+		setZone(stat, name, zone.RequestCounter, zone.Responses)
+	}
+	for upstream, servers := range status.UpstreamZones {
+		for _, server := range servers {
+			setUpstreamResponseTime(stat, upstream, server.Server, server.ResponseMsec)
+		}
+	}
+	return stat
+}
+
+// % wget -qO- http://localhost:8080/api/9/http/server_zones
+// {"example.com":{"processing":1,"requests":30,"responses":{"1xx":0,"2xx":25,"3xx":2,"4xx":3,"5xx":0,"total":30},...}}
+// % wget -qO- http://localhost:8080/api/9/http/upstreams
+// {"backend":{"peers":[{"id":0,"server":"10.0.0.1:80","requests":20,"response_time":12,...}],...}}
+
+type plusConnections struct {
+	Accepted float64 `json:"accepted"`
+	Dropped  float64 `json:"dropped"`
+	Active   float64 `json:"active"`
+	Idle     float64 `json:"idle"`
+}
+
+type plusRequests struct {
+	Total float64 `json:"total"`
+}
+
+type plusServerZones map[string]struct {
+	Requests  float64       `json:"requests"`
+	Responses zoneResponses `json:"responses"`
+}
+
+type plusUpstreams map[string]struct {
+	Peers []struct {
+		Server string `json:"server"`
+		// ResponseTime is missing until the peer responds
+		ResponseTime *float64 `json:"response_time"`
+	} `json:"peers"`
+}
+
+func (n NginxPlugin) fetchPlus() (map[string]interface{}, error) {
+	base := strings.TrimRight(n.URI, "/")
+	var connections plusConnections
+	if err := n.getJSON(base+"/connections", &connections); err != nil {
+		return nil, err
+	}
+	var requests plusRequests
+	if err := n.getJSON(base+"/http/requests", &requests); err != nil {
+		return nil, err
+	}
+	var zones plusServerZones
+	if err := n.getJSON(base+"/http/server_zones", &zones); err != nil {
+		return nil, err
+	}
+	var upstreams plusUpstreams
+	if err := n.getJSON(base+"/http/upstreams", &upstreams); err != nil {
+		return nil, err
+	}
+	return parsePlus(connections, requests, zones, upstreams), nil
+}
+
+// parsePlus returns the metrics of the NGINX Plus API, where the connections are posted as the metrics of
+// stub_status as far as they are found, and the idle connections as waiting
+func parsePlus(connections plusConnections, requests plusRequests, zones plusServerZones, upstreams plusUpstreams) map[string]interface{} {
+	stat := map[string]interface{}{
+		"connections": connections.Active + connections.Idle,
+		"accepts":     connections.Accepted,
+		"handled":     connections.Accepted - connections.Dropped,
+		"requests":    requests.Total,
+		"waiting":     connections.Idle,
+	}
+	for name, zone := range zones {
+		setZone(stat, name, zone.Requests, zone.Responses)
+	}
+	for upstream, u := range upstreams {
+		for _, peer := range u.Peers {
+			if peer.ResponseTime != nil {
+				setUpstreamResponseTime(stat, upstream, peer.Server, *peer.ResponseTime)
+			}
+		}
+	}
+	return stat
+}
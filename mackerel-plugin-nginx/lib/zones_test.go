@@ -0,0 +1,76 @@
+package mpnginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testVTSStatus = `{"hostName":"web1","nginxVersion":"1.25.3","connections":{"active":2,"reading":0,"writing":1,"waiting":1,"accepted":10,"handled":9,"requests":32},
+"serverZones":{"example.com":{"requestCounter":30,"inBytes":1024,"outBytes":4096,"responses":{"1xx":0,"2xx":25,"3xx":2,"4xx":3,"5xx":0,"miss":0},"requestMsec":5},
+"*":{"requestCounter":32,"responses":{"1xx":0,"2xx":27,"3xx":2,"4xx":3,"5xx":0}}},
+"upstreamZones":{"backend":[{"server":"10.0.0.1:80","requestCounter":20,"responses":{"2xx":20},"responseMsec":12,"requestMsec":13}],
+"::nogroups":[{"server":"127.0.0.1:9000","requestCounter":2,"responseMsec":3}]}}`
+
+func TestParseVTS(t *testing.T) {
+	var status vtsStatus
+	if err := json.Unmarshal([]byte(testVTSStatus), &status); err != nil {
+		t.Fatal(err)
+	}
+	stat := parseVTS(status)
+
+	assert.EqualValues(t, 2, stat["connections"])
+	assert.EqualValues(t, 10, stat["accepts"])
+	assert.EqualValues(t, 9, stat["handled"])
+	assert.EqualValues(t, 32, stat["requests"])
+	assert.EqualValues(t, 1, stat["waiting"])
+	assert.EqualValues(t, 30, stat["server_zone_requests.example_com.requests"])
+	assert.EqualValues(t, 25, stat["server_zone_responses.example_com.responses_2xx"])
+	assert.EqualValues(t, 3, stat["server_zone_responses.example_com.responses_4xx"])
+	assert.EqualValues(t, 32, stat["server_zone_requests.total.requests"])
+	assert.EqualValues(t, 12, stat["upstream_response_time.backend_10_0_0_1_80.response_msec"])
+	assert.EqualValues(t, 3, stat["upstream_response_time.nogroups_127_0_0_1_9000.response_msec"])
+}
+
+func TestFetchMetricsPlus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/9/connections", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"accepted":100,"dropped":2,"active":3,"idle":4}`)
+	})
+	mux.HandleFunc("/api/9/http/requests", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total":500,"current":1}`)
+	})
+	mux.HandleFunc("/api/9/http/server_zones", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"example.com":{"processing":1,"requests":30,"responses":{"1xx":0,"2xx":25,"3xx":2,"4xx":3,"5xx":0,"total":30},"discarded":0,"received":1024,"sent":4096}}`)
+	})
+	mux.HandleFunc("/api/9/http/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"backend":{"peers":[{"id":0,"server":"10.0.0.1:80","state":"up","requests":20,"response_time":12},{"id":1,"server":"10.0.0.2:80","state":"up","requests":0}],"zone":"backend"}}`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	nginx := NginxPlugin{URI: ts.URL + "/api/9/", Format: formatPlus}
+	stat, err := nginx.FetchMetrics()
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 7, stat["connections"])
+	assert.EqualValues(t, 100, stat["accepts"])
+	assert.EqualValues(t, 98, stat["handled"])
+	assert.EqualValues(t, 500, stat["requests"])
+	assert.EqualValues(t, 4, stat["waiting"])
+	assert.EqualValues(t, 30, stat["server_zone_requests.example_com.requests"])
+	assert.EqualValues(t, 25, stat["server_zone_responses.example_com.responses_2xx"])
+	assert.EqualValues(t, 12, stat["upstream_response_time.backend_10_0_0_1_80.response_msec"])
+	assert.NotContains(t, stat, "upstream_response_time.backend_10_0_0_2_80.response_msec")
+}
+
+func TestGraphDefinitionZones(t *testing.T) {
+	nginx := NginxPlugin{Format: formatVTS}
+	graphdef := nginx.GraphDefinition()
+	assert.Len(t, graphdef, 6)
+	assert.Equal(t, "Nginx Server Zone Responses", graphdef["server_zone_responses.#"].Label)
+}
@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"log"
+	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -17,8 +20,20 @@ var queryOptions = []string{
 	"memory.total",
 	"memory.used",
 	"memory.free",
+	"power.draw",
+	"power.limit",
+	"clocks_throttle_reasons.active",
+	// the columns to identify GPUs
+	"index",
+	"uuid",
+	"clocks.sm",
 }
 
+const (
+	indexColumn = 10
+	uuidColumn  = 11
+)
+
 var formatOptions = []string{
 	"noheader",
 	"nounits",
@@ -30,23 +45,126 @@ var nvidiaSmiOptions = []string{
 	fmt.Sprintf("--query-gpu=%s", strings.Join(queryOptions, ",")),
 }
 
+var nvidiaSmiProcessOptions = []string{
+	fmt.Sprintf("--format=%s", strings.Join(formatOptions, ",")),
+	"--query-compute-apps=gpu_uuid,pid,used_memory",
+}
+
 var metricsKeyFormats = []string{
-	"gpu.util.gpu%d",
-	"memory.util.gpu%d",
-	"temperature.gpu%d",
-	"fanspeed.gpu%d",
-	"memory.usage.gpu%d.total",
-	"memory.usage.gpu%d.used",
-	"memory.usage.gpu%d.free",
+	"gpu.util.%s",
+	"memory.util.%s",
+	"temperature.%s",
+	"fanspeed.%s",
+	"memory.usage.%s.total",
+	"memory.usage.%s.used",
+	"memory.usage.%s.free",
+	"power.%s.draw",
+	"power.%s.limit",
+	"throttle_reasons.%s",
+	// index and uuid are not posted
+	"",
+	"",
+	"clocks.sm.%s",
 }
 
-func (n NVidiaSMIPlugin) getMetricKey(index int, gpuIndex int) string {
-	return fmt.Sprintf(metricsKeyFormats[index], gpuIndex)
+func (n NVidiaSMIPlugin) getMetricKey(index int, gpu string) string {
+	return fmt.Sprintf(metricsKeyFormats[index], gpu)
 }
 
 // NVidiaSMIPlugin mackerel plugin for nvidia-smi
 type NVidiaSMIPlugin struct {
-	Prefix string
+	Prefix          string
+	KeyByUUID       bool
+	UseNVML         bool
+	EnableProcesses bool
+	// GPUs are the indices of the GPUs to be posted, or all the GPUs if empty
+	GPUs []int
+}
+
+// selected reports whether the GPU of the index is posted
+func (n NVidiaSMIPlugin) selected(index int) bool {
+	if len(n.GPUs) == 0 {
+		return true
+	}
+	for _, i := range n.GPUs {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// errNVMLUnavailable is returned when NVML cannot be used, e.g. libnvidia-ml.so is not found
+type errNVMLUnavailable struct {
+	reason string
+}
+
+func (e errNVMLUnavailable) Error() string {
+	return "NVML is unavailable: " + e.reason
+}
+
+var normalizeMetricNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// gpuKeyOf returns the key of the GPU like "gpu0", or the UUID if KeyByUUID
+func (n NVidiaSMIPlugin) gpuKeyOf(index int, uuid string) string {
+	if n.KeyByUUID && uuid != "" {
+		return normalizeMetricNameRe.ReplaceAllString(uuid, "_")
+	}
+	return fmt.Sprintf("gpu%d", index)
+}
+
+// gpuIndex returns the index column, or id (the line number) if it is not given
+func gpuIndex(id int, values []string) int {
+	if len(values) > indexColumn {
+		if index, err := strconv.Atoi(values[indexColumn]); err == nil {
+			return index
+		}
+	}
+	return id
+}
+
+func (n NVidiaSMIPlugin) gpuKey(id int, values []string) string {
+	var uuid string
+	if len(values) > uuidColumn {
+		uuid = values[uuidColumn]
+	}
+	return n.gpuKeyOf(gpuIndex(id, values), uuid)
+}
+
+func processMetricKey(gpu string, pid uint64) string {
+	return fmt.Sprintf("process_memory.%s_%d", gpu, pid)
+}
+
+func setMemoryPercentage(stats map[string]interface{}, gpu string) {
+	total, okTotal := stats["memory.usage."+gpu+".total"]
+	used, okUsed := stats["memory.usage."+gpu+".used"]
+	if okTotal && okUsed && toFloat(total) > 0 {
+		stats["memory.percentage."+gpu] = toFloat(used) / toFloat(total) * 100
+	}
+}
+
+// parseValue parses a field, which may be "[N/A]" or "[Not Supported]" depending on the GPU (e.g. in MIG mode)
+func parseValue(value string) (interface{}, bool) {
+	if strings.HasPrefix(value, "0x") {
+		// clocks_throttle_reasons.active is a bitmask like 0x0000000000000004
+		v, err := strconv.ParseUint(value[2:], 16, 64)
+		return v, err == nil
+	}
+	if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+		return v, true
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	return v, err == nil
+}
+
+func toFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 0
 }
 
 // GraphDefinition interface for mackerelplugin
@@ -90,17 +208,78 @@ func (n NVidiaSMIPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "free", Label: "free", Scale: 1024 * 1024, Stacked: true},
 			},
 		},
+		"memory.percentage": {
+			Label: "GPU Memory Usage Percentage",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "#", Label: "used"},
+			},
+		},
+		"power.#": {
+			Label: "GPU Power",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "draw", Label: "draw (W)"},
+				{Name: "limit", Label: "limit (W)"},
+			},
+		},
+		"throttle_reasons": {
+			Label: "GPU Clocks Throttle Reasons",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Label: "reasons"},
+			},
+		},
+		"clocks.sm": {
+			Label: "GPU SM Clock (MHz)",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Label: "sm"},
+			},
+		},
+	}
+	if n.EnableProcesses {
+		graphdef["process_memory"] = mp.Graphs{
+			Label: "GPU Memory Usage by Process",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "#", Label: "used", Scale: 1024 * 1024, Stacked: true},
+			},
+		}
 	}
 	return graphdef
 }
 
 // FetchMetrics interface for mackerelplugin
 func (n NVidiaSMIPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if n.UseNVML {
+		stats, err := n.fetchNVMLMetrics()
+		if err == nil {
+			return stats, nil
+		}
+		if _, ok := err.(errNVMLUnavailable); !ok {
+			return nil, err
+		}
+		log.Printf("%s, falling back to nvidia-smi", err)
+	}
+
 	ret, err := exec.Command("nvidia-smi", nvidiaSmiOptions...).CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("%s: %s", err, ret)
 	}
-	return n.parseStats(string(ret))
+	stats, err := n.parseStats(string(ret))
+	if err != nil {
+		return nil, err
+	}
+
+	if n.EnableProcesses {
+		out, err := exec.Command("nvidia-smi", nvidiaSmiProcessOptions...).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, out)
+		}
+		n.parseProcesses(string(out), n.gpuKeys(string(ret)), stats)
+	}
+	return stats, nil
 }
 
 // MetricKeyPrefix interface for mackerelplugin
@@ -124,22 +303,123 @@ func (n NVidiaSMIPlugin) parseLine(id int, line string, stats *map[string]interf
 		return nil
 	}
 
-	for i, value := range strings.Split(line, ",") {
-		value, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
-		if err != nil {
+	values := splitFields(line)
+	if !n.selected(gpuIndex(id, values)) {
+		return nil
+	}
+	gpu := n.gpuKey(id, values)
+
+	for i, value := range values {
+		if i >= len(metricsKeyFormats) {
+			break
+		}
+		if metricsKeyFormats[i] == "" {
 			continue
 		}
-		(*stats)[n.getMetricKey(i, id)] = value
+		v, ok := parseValue(value)
+		if !ok {
+			continue
+		}
+		(*stats)[n.getMetricKey(i, gpu)] = v
 	}
+
+	setMemoryPercentage(*stats, gpu)
 	return nil
 }
 
+func splitFields(line string) []string {
+	values := strings.Split(line, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+// gpuKeys returns the keys of the GPUs by the UUIDs
+func (n NVidiaSMIPlugin) gpuKeys(ret string) map[string]string {
+	keys := make(map[string]string)
+	for id, line := range strings.Split(ret, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		values := splitFields(line)
+		if len(values) > uuidColumn && n.selected(gpuIndex(id, values)) {
+			keys[values[uuidColumn]] = n.gpuKey(id, values)
+		}
+	}
+	return keys
+}
+
+// parseGPUs parses the value of -gpu like 0,2
+func parseGPUs(s string) ([]int, error) {
+	var gpus []int
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid index of GPU: %s", v)
+		}
+		gpus = append(gpus, i)
+	}
+	return gpus, nil
+}
+
+// parseProcesses parses the output of --query-compute-apps=gpu_uuid,pid,used_memory
+func (n NVidiaSMIPlugin) parseProcesses(ret string, gpus map[string]string, stats map[string]interface{}) {
+	for _, line := range strings.Split(ret, "\n") {
+		values := splitFields(line)
+		if len(values) < 3 {
+			continue
+		}
+		gpu, ok := gpus[values[0]]
+		if !ok {
+			continue
+		}
+		pid, err := strconv.ParseUint(values[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		used, err := strconv.ParseUint(values[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		key := processMetricKey(gpu, pid)
+		if v, ok := stats[key].(uint64); ok {
+			used += v
+		}
+		stats[key] = used
+	}
+}
+
 // Do the plugin
 func Do() {
 	optPrefix := flag.String("metric-key-prefix", "nvidia.gpu", "Metric key prefix")
+	optKeyBy := flag.String("key-by", "index", "Key GPUs by index or uuid")
+	optUseNVML := flag.Bool("use-nvml", false, "Use NVML (libnvidia-ml.so) instead of executing nvidia-smi")
+	optEnableProcesses := flag.Bool("enable-processes", false, "Enable GPU memory usage metrics of each process")
+	optGPUs := flag.String("gpu", "", "Comma separated indices of the GPUs to be posted (default all)")
 	flag.Parse()
 	var plugin NVidiaSMIPlugin
 	plugin.Prefix = *optPrefix
+	plugin.UseNVML = *optUseNVML
+	plugin.EnableProcesses = *optEnableProcesses
+	gpus, err := parseGPUs(*optGPUs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-gpu: %s\n", err)
+		os.Exit(1)
+	}
+	plugin.GPUs = gpus
+	switch *optKeyBy {
+	case "index":
+	case "uuid":
+		plugin.KeyByUUID = true
+	default:
+		fmt.Fprintf(os.Stderr, "-key-by should be index or uuid: %s\n", *optKeyBy)
+		os.Exit(1)
+	}
 	helper := mp.NewMackerelPlugin(plugin)
 	helper.Run()
 }
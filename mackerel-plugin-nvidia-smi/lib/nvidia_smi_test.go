@@ -10,8 +10,8 @@ func TestGraphDefinition(t *testing.T) {
 	var plugin NVidiaSMIPlugin
 
 	graphdef := plugin.GraphDefinition()
-	if len(graphdef) != 5 {
-		t.Errorf("GraphDef's size: %d should be 5", len(graphdef))
+	if len(graphdef) != 9 {
+		t.Errorf("GraphDef's size: %d should be 9", len(graphdef))
 	}
 }
 
@@ -51,3 +51,76 @@ func TestParse(t *testing.T) {
 	assert.EqualValues(t, 66, stats["memory.usage.gpu2.used"])
 	assert.EqualValues(t, 960, stats["memory.usage.gpu2.free"])
 }
+
+func TestParseAllColumns(t *testing.T) {
+	var plugin NVidiaSMIPlugin
+	plugin.Prefix = "nvidia.gpu"
+	data := `97, 60, 83, 70, 40960, 30720, 10240, 298.52, 300.00, 0x0000000000000020, 0, GPU-8ca2b2e1-7c32-4a0f-9c8b-3f5a1f0e6b11
+[N/A], [N/A], 35, [N/A], 40960, 1024, 39936, [N/A], 400.00, 0x0000000000000000, 3, GPU-1d2f3a4b-0000-1111-2222-333344445555
+`
+
+	stats, err := plugin.parseStats(data)
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 97, stats["gpu.util.gpu0"])
+	assert.EqualValues(t, 298.52, stats["power.gpu0.draw"])
+	assert.EqualValues(t, 300, stats["power.gpu0.limit"])
+	assert.EqualValues(t, 0x20, stats["throttle_reasons.gpu0"])
+	assert.InDelta(t, 75.0, stats["memory.percentage.gpu0"], 0.001)
+
+	// keyed by the index column, and N/A fields are skipped
+	assert.Nil(t, stats["gpu.util.gpu3"])
+	assert.Nil(t, stats["power.gpu3.draw"])
+	assert.EqualValues(t, 35, stats["temperature.gpu3"])
+	assert.EqualValues(t, 400, stats["power.gpu3.limit"])
+	assert.EqualValues(t, 0, stats["throttle_reasons.gpu3"])
+	assert.InDelta(t, 2.5, stats["memory.percentage.gpu3"], 0.001)
+
+	plugin.KeyByUUID = true
+	stats, err = plugin.parseStats(data)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 97, stats["gpu.util.GPU-8ca2b2e1-7c32-4a0f-9c8b-3f5a1f0e6b11"])
+	assert.EqualValues(t, 35, stats["temperature.GPU-1d2f3a4b-0000-1111-2222-333344445555"])
+}
+
+func TestParseProcesses(t *testing.T) {
+	var plugin NVidiaSMIPlugin
+	plugin.EnableProcesses = true
+	data := `97, 60, 83, 70, 40960, 30720, 10240, 298.52, 300.00, 0x0000000000000020, 0, GPU-8ca2b2e1-7c32-4a0f-9c8b-3f5a1f0e6b11
+35, 10, 35, 30, 40960, 1024, 39936, 80.00, 400.00, 0x0000000000000000, 1, GPU-1d2f3a4b-0000-1111-2222-333344445555
+`
+	processes := `GPU-8ca2b2e1-7c32-4a0f-9c8b-3f5a1f0e6b11, 1234, 30000
+GPU-1d2f3a4b-0000-1111-2222-333344445555, 5678, 1000
+GPU-unknown, 9999, 10
+`
+
+	stats := make(map[string]interface{})
+	plugin.parseProcesses(processes, plugin.gpuKeys(data), stats)
+	assert.EqualValues(t, 30000, stats["process_memory.gpu0_1234"])
+	assert.EqualValues(t, 1000, stats["process_memory.gpu1_5678"])
+	assert.Len(t, stats, 2)
+
+	assert.Contains(t, plugin.GraphDefinition(), "process_memory")
+}
+
+func TestParseGPUFilter(t *testing.T) {
+	var plugin NVidiaSMIPlugin
+	gpus, err := parseGPUs("1, 2")
+	assert.Nil(t, err)
+	plugin.GPUs = gpus
+	data := `97, 60, 83, 70, 40960, 30720, 10240, 298.52, 300.00, 0x0000000000000020, 0, GPU-8ca2b2e1-7c32-4a0f-9c8b-3f5a1f0e6b11, 1410
+35, 10, 35, [N/A], 40960, 1024, 39936, 80.00, 400.00, 0x0000000000000000, 1, GPU-1d2f3a4b-0000-1111-2222-333344445555, 210
+`
+
+	stats, err := plugin.parseStats(data)
+	assert.Nil(t, err)
+	assert.Nil(t, stats["gpu.util.gpu0"])
+	assert.Nil(t, stats["clocks.sm.gpu0"])
+	assert.EqualValues(t, 35, stats["gpu.util.gpu1"])
+	assert.EqualValues(t, 210, stats["clocks.sm.gpu1"])
+	assert.Nil(t, stats["fanspeed.gpu1"])
+	assert.EqualValues(t, map[string]string{"GPU-1d2f3a4b-0000-1111-2222-333344445555": "gpu1"}, plugin.gpuKeys(data))
+
+	_, err = parseGPUs("0,gpu1")
+	assert.NotNil(t, err)
+}
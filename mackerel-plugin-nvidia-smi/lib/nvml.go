@@ -0,0 +1,84 @@
+// +build linux,cgo
+
+package mpnvidiasmi
+
+import (
+	"fmt"
+
+	"github.com/NVIDIA/go-nvml/pkg/nvml"
+)
+
+const mebibyte = 1024 * 1024
+
+// fetchNVMLMetrics fetches the metrics with NVML, which are posted with the same keys as nvidia-smi
+func (n NVidiaSMIPlugin) fetchNVMLMetrics() (map[string]interface{}, error) {
+	if ret := nvml.Init(); ret != nvml.SUCCESS {
+		return nil, errNVMLUnavailable{nvml.ErrorString(ret)}
+	}
+	defer nvml.Shutdown()
+
+	count, ret := nvml.DeviceGetCount()
+	if ret != nvml.SUCCESS {
+		return nil, fmt.Errorf("failed to get the device count: %s", nvml.ErrorString(ret))
+	}
+
+	stats := make(map[string]interface{})
+	for i := 0; i < count; i++ {
+		if !n.selected(i) {
+			continue
+		}
+		device, ret := nvml.DeviceGetHandleByIndex(i)
+		if ret != nvml.SUCCESS {
+			return nil, fmt.Errorf("failed to get the device %d: %s", i, nvml.ErrorString(ret))
+		}
+		uuid, _ := device.GetUUID()
+		gpu := n.gpuKeyOf(i, uuid)
+
+		// each field may not be supported depending on the GPU (e.g. in MIG mode)
+		if util, ret := device.GetUtilizationRates(); ret == nvml.SUCCESS {
+			stats["gpu.util."+gpu] = uint64(util.Gpu)
+			stats["memory.util."+gpu] = uint64(util.Memory)
+		}
+		if temp, ret := device.GetTemperature(nvml.TEMPERATURE_GPU); ret == nvml.SUCCESS {
+			stats["temperature."+gpu] = uint64(temp)
+		}
+		if fan, ret := device.GetFanSpeed(); ret == nvml.SUCCESS {
+			stats["fanspeed."+gpu] = uint64(fan)
+		}
+		if mem, ret := device.GetMemoryInfo(); ret == nvml.SUCCESS {
+			stats["memory.usage."+gpu+".total"] = mem.Total / mebibyte
+			stats["memory.usage."+gpu+".used"] = mem.Used / mebibyte
+			stats["memory.usage."+gpu+".free"] = mem.Free / mebibyte
+			setMemoryPercentage(stats, gpu)
+		}
+		if power, ret := device.GetPowerUsage(); ret == nvml.SUCCESS {
+			stats["power."+gpu+".draw"] = float64(power) / 1000
+		}
+		if limit, ret := device.GetPowerManagementLimit(); ret == nvml.SUCCESS {
+			stats["power."+gpu+".limit"] = float64(limit) / 1000
+		}
+		if reasons, ret := device.GetCurrentClocksThrottleReasons(); ret == nvml.SUCCESS {
+			stats["throttle_reasons."+gpu] = reasons
+		}
+
+		if clock, ret := device.GetClockInfo(nvml.CLOCK_SM); ret == nvml.SUCCESS {
+			stats["clocks.sm."+gpu] = uint64(clock)
+		}
+
+		if n.EnableProcesses {
+			processes, ret := device.GetComputeRunningProcesses()
+			if ret != nvml.SUCCESS {
+				continue
+			}
+			for _, p := range processes {
+				key := processMetricKey(gpu, uint64(p.Pid))
+				used := p.UsedGpuMemory / mebibyte
+				if v, ok := stats[key].(uint64); ok {
+					used += v
+				}
+				stats[key] = used
+			}
+		}
+	}
+	return stats, nil
+}
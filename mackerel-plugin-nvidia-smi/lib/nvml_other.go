@@ -0,0 +1,7 @@
+// +build !linux !cgo
+
+package mpnvidiasmi
+
+func (n NVidiaSMIPlugin) fetchNVMLMetrics() (map[string]interface{}, error) {
+	return nil, errNVMLUnavailable{"not supported in this build"}
+}
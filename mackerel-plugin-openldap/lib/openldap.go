@@ -2,9 +2,12 @@ package mpopenldap
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"regexp"
 	"sort"
@@ -14,6 +17,7 @@ import (
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
 	ldap "gopkg.in/ldap.v2"
 )
 
@@ -27,6 +31,8 @@ type OpenLDAPPlugin struct {
 	Prefix             string
 	UseTLS             bool
 	InsecureSkipVerify bool
+	StartTLS           bool
+	CACert             string
 	TargetHost         string
 	BindDn             string
 	ReplBase           string
@@ -81,70 +87,207 @@ func mergeStat(dst, src map[string]float64) {
 	}
 }
 
-func latestCSN(sr *ldap.SearchResult) (time.Time, error) {
-	var res time.Time
+// parseCSN parses a CSN like "20170713094701.963361Z#000000#05b#000000" into the timestamp and the replica ID
+func parseCSN(v string) (time.Time, string, error) {
+	parts := strings.Split(v, "#")
+	if len(parts) < 3 {
+		return time.Time{}, "", fmt.Errorf("invalid CSN: %s", v)
+	}
+	t, err := time.Parse("20060102150405.999999Z", parts[0])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return t, parts[2], nil
+}
+
+// contextCSNs returns the timestamps of contextCSN by the replica IDs
+func contextCSNs(sr *ldap.SearchResult) (map[string]time.Time, error) {
 	if len(sr.Entries) == 0 {
-		return res, errors.New("not found CSN")
+		return nil, errors.New("not found CSN")
 	}
 	entry := sr.Entries[0]
 	if len(entry.Attributes) == 0 {
-		return res, errors.New("not found CSN")
+		return nil, errors.New("not found CSN")
 	}
 	attr := entry.Attributes[0]
-	vs := entry.GetAttributeValues(attr.Name)
-	csns := make([]time.Time, len(vs))
-	for i, v := range vs {
-		t, err := time.Parse("20060102150405.999999Z", v[0:strings.Index(v, "#")])
+	csns := make(map[string]time.Time)
+	for _, v := range entry.GetAttributeValues(attr.Name) {
+		t, sid, err := parseCSN(v)
 		if err != nil {
-			return res, err
+			return nil, err
 		}
-		csns[i] = t
+		csns[sid] = t
+	}
+	return csns, nil
+}
+
+func latestCSN(sr *ldap.SearchResult) (time.Time, error) {
+	var res time.Time
+	csns, err := contextCSNs(sr)
+	if err != nil {
+		return res, err
 	}
-	sort.Slice(csns, func(i, j int) bool {
-		return csns[i].After(csns[j])
+	times := make([]time.Time, 0, len(csns))
+	for _, t := range csns {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].After(times[j])
 	})
-	res = csns[0]
+	res = times[0]
 	return res, nil
 }
 
-func getLatestCSN(host, base, bind, passwd string, useTLS, insecureSkipVerify bool) (time.Time, error) {
-	var l *ldap.Conn
-	var err error
-	var res time.Time
+func (m OpenLDAPPlugin) tlsConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: m.InsecureSkipVerify}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		config.ServerName = h
+	}
+	if m.CACert != "" {
+		pem, err := ioutil.ReadFile(m.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to load CA certificate: %s", m.CACert)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// dial connects to the host with LDAPS if useTLS, otherwise with StartTLS if enabled
+func (m OpenLDAPPlugin) dial(host string, useTLS bool) (*ldap.Conn, error) {
+	config, err := m.tlsConfig(host)
+	if err != nil {
+		return nil, err
+	}
 	if useTLS {
-		l, err = ldap.DialTLS("tcp", host, &tls.Config{InsecureSkipVerify: insecureSkipVerify})
-	} else {
-		l, err = ldap.Dial("tcp", host)
+		return ldap.DialTLS("tcp", host, config)
+	}
+	l, err := ldap.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if m.StartTLS {
+		if err := l.StartTLS(config); err != nil {
+			l.Close()
+			return nil, err
+		}
 	}
+	return l, nil
+}
+
+func (m OpenLDAPPlugin) getContextCSNs(host, bind, passwd string, useTLS bool) (map[string]time.Time, error) {
+	l, err := m.dial(host, useTLS)
+	if err != nil {
+		logger.Errorf("Failed to Dial %s, err: %s", host, err)
+		return nil, err
+	}
+	defer l.Close()
 	err = l.Bind(bind, passwd)
 	if err != nil {
 		logger.Errorf("Failed to Bind %s, err: %s", bind, err)
-		return res, err
+		return nil, err
 	}
-	searchRequest := ldap.NewSearchRequest(base, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(&(objectClass=*))", []string{"ContextCSN"}, nil)
+	searchRequest := ldap.NewSearchRequest(m.ReplBase, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(&(objectClass=*))", []string{"ContextCSN"}, nil)
 	sr, err := l.Search(searchRequest)
-	l.Close()
 	if err != nil {
 		logger.Errorf("Failed to ldap search. %s.", err)
-		return res, err
+		return nil, err
+	}
+	return contextCSNs(sr)
+}
+
+func latest(csns map[string]time.Time) time.Time {
+	var res time.Time
+	for _, t := range csns {
+		if t.After(res) {
+			res = t
+		}
+	}
+	return res
+}
+
+// replicationLags returns the lags in seconds of the local server behind the provider by the replica IDs
+func replicationLags(provider, local map[string]time.Time) map[string]float64 {
+	lags := make(map[string]float64)
+	for sid, pt := range provider {
+		lt, ok := local[sid]
+		if !ok {
+			logger.Warningf("contextCSN of replica ID %s is not found in the local server", sid)
+			continue
+		}
+		lag := pt.Sub(lt).Seconds()
+		if lag < 0 {
+			lag = 0
+		}
+		lags[sid] = lag
+	}
+	return lags
+}
+
+// databaseEntries returns the entry counts of the databases in cn=Databases,cn=Monitor, e.g. database_1
+func databaseEntries(sr *ldap.SearchResult) map[string]float64 {
+	stat := make(map[string]float64)
+	for _, entry := range sr.Entries {
+		v := entry.GetAttributeValue("olmMDBEntries")
+		if v == "" {
+			continue
+		}
+		name := transformKeyName(entry.DN)
+		if name == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warningf("Failed to parse value. %s", err)
+			continue
+		}
+		stat["database_entries."+name+".entries"] = n
+	}
+	return stat
+}
+
+// monitorError turns the error of the search of cn=Monitor into a clear one when the monitor backend is not available
+func monitorError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return errors.New("cn=Monitor is not found: slapd should be configured with the monitor backend, and its ACLs should allow the bind dn (or anonymous) to read it")
 	}
-	return latestCSN(sr)
+	return err
+}
 
+// checkMonitor checks cn=Monitor beforehand, so that a server without the monitor backend fails with a single error
+// instead of the ones of each subtree
+func checkMonitor(l *ldap.Conn) error {
+	searchRequest := ldap.NewSearchRequest("cn=Monitor", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"dn"}, nil)
+	if _, err := l.Search(searchRequest); err != nil {
+		return monitorError(err)
+	}
+	return nil
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m OpenLDAPPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]float64)
+	if err := checkMonitor(m.l); err != nil {
+		logger.Errorf("%s", err)
+		return nil, err
+	}
 	if m.ReplBase != "" {
-		masterTime, err := getLatestCSN(m.ReplMasterHost, m.ReplBase, m.ReplMasterBind, m.ReplMasterPass, m.ReplMasterUseTLS, m.InsecureSkipVerify)
+		masterCSNs, err := m.getContextCSNs(m.ReplMasterHost, m.ReplMasterBind, m.ReplMasterPass, m.ReplMasterUseTLS)
 		if err != nil {
 			return nil, err
 		}
-		localTime, err := getLatestCSN(m.TargetHost, m.ReplBase, m.ReplLocalBind, m.ReplLocalPass, m.UseTLS, m.InsecureSkipVerify)
+		localCSNs, err := m.getContextCSNs(m.TargetHost, m.ReplLocalBind, m.ReplLocalPass, m.UseTLS)
 		if err != nil {
 			return nil, err
 		}
-		stat["replication_delay"] = masterTime.Sub(localTime).Seconds()
+		stat["replication_delay"] = latest(masterCSNs).Sub(latest(localCSNs)).Seconds()
+		for sid, lag := range replicationLags(masterCSNs, localCSNs) {
+			stat["replication_lag."+sid+".lag"] = lag
+		}
 	}
 
 	ldapOpes, err := fetchOpenldapMetrics(m.l, "cn=Operations,cn=Monitor", "", []string{"monitorOpInitiated", "monitorOpCompleted"})
@@ -190,6 +333,14 @@ func (m OpenLDAPPlugin) FetchMetrics() (map[string]interface{}, error) {
 	}
 	mergeStat(stat, ldapCurrentConns)
 
+	searchRequest := ldap.NewSearchRequest("cn=Databases,cn=Monitor", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(&(objectClass=*))", []string{"olmMDBEntries"}, nil)
+	sr, err := m.l.Search(searchRequest)
+	if err != nil {
+		logger.Errorf("Failed to ldap search. %s.", err)
+		return nil, err
+	}
+	mergeStat(stat, databaseEntries(sr))
+
 	result := make(map[string]interface{})
 	for k, v := range stat {
 		result[k] = v
@@ -288,6 +439,13 @@ func (m OpenLDAPPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "statistics_referrals_monitorCounter", Label: "referrals", Diff: true},
 			},
 		},
+		"database_entries.#": {
+			Label: (labelPrefix + " database entries"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "entries", Label: "entries", Diff: false},
+			},
+		},
 		"connections": {
 			Label: (labelPrefix + " connections"),
 			Unit:  "integer",
@@ -305,6 +463,13 @@ func (m OpenLDAPPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "replication_delay", Label: "replication delay sec", Diff: false},
 			},
 		}
+		graphs["replication_lag.#"] = mp.Graphs{
+			Label: (labelPrefix + " replication lag by replica ID"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "lag", Label: "lag sec", Diff: false},
+			},
+		}
 	}
 	return graphs
 }
@@ -315,25 +480,43 @@ func Do() {
 	optPort := flag.String("port", "389", "Port")
 	optTLS := flag.Bool("tls", false, "TLS(ldaps)")
 	optInsecureSkipVerify := flag.Bool("insecureSkipVerify", false, "TLS accepts any certificate.")
+	optStartTLS := flag.Bool("starttls", false, "Use StartTLS (unless TLS(ldaps) is used)")
+	optCACert := flag.String("cacert", "", "CA certificate file to verify the servers")
 	optReplBase := flag.String("replBase", "", "replication base dn")
 	optReplMasterBind := flag.String("replMasterBind", "", "replication master bind dn")
 	optReplMasterHost := flag.String("replMasterHost", "", "replication master hostname")
 	optReplMasterTLS := flag.Bool("replMasterTLS", false, "replication master TLS(ldaps)")
 	optReplMasterPort := flag.String("replMasterPort", "389", "replication master port")
-	optReplMasterPass := flag.String("replMasterPW", "", "replication master bind password")
+	optCompareHost := flag.String("compare-host", "", "provider host[:port] to compare contextCSN with (overrides replMasterHost and replMasterPort)")
+	optReplMasterPass := flag.String("replMasterPW", "", "replication master bind password (or $MACKEREL_PLUGIN_OPENLDAP_REPL_MASTER_PASSWORD)")
 	optReplLocalBind := flag.String("replLocalBind", "", "replicationlocalmaster bind dn")
-	optReplLocalPass := flag.String("replLocalPW", "", "replication local bind password")
-	optBindDn := flag.String("bind", "", "bind dn")
-	optBindPasswd := flag.String("pw", "", "bind password")
+	optReplLocalPass := flag.String("replLocalPW", "", "replication local bind password (or $MACKEREL_PLUGIN_OPENLDAP_REPL_LOCAL_PASSWORD)")
+	optBindDn := flag.String("bind", "", "bind dn (anonymous if not given)")
+	flag.StringVar(optBindDn, "binddn", "", "Alias of -bind")
+	optBindPasswd := flag.String("pw", "", "bind password (or $MACKEREL_PLUGIN_OPENLDAP_PASSWORD)")
+	flag.StringVar(optBindPasswd, "bindpw", "", "Alias of -pw")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "openldap", "Metric key prefix")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "replMasterPW", "MACKEREL_PLUGIN_OPENLDAP_REPL_MASTER_PASSWORD")
+	envutil.SetFromEnv(flag.CommandLine, "replLocalPW", "MACKEREL_PLUGIN_OPENLDAP_REPL_LOCAL_PASSWORD")
+	if *optBindPasswd == "" {
+		envutil.SetFromEnv(flag.CommandLine, "pw", "MACKEREL_PLUGIN_OPENLDAP_PASSWORD")
+	}
 
 	var m OpenLDAPPlugin
 	m.TargetHost = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	m.ReplMasterHost = fmt.Sprintf("%s:%s", *optReplMasterHost, *optReplMasterPort)
+	if *optCompareHost != "" {
+		m.ReplMasterHost = *optCompareHost
+		if _, _, err := net.SplitHostPort(*optCompareHost); err != nil {
+			m.ReplMasterHost = net.JoinHostPort(*optCompareHost, *optReplMasterPort)
+		}
+	}
 	m.UseTLS = *optTLS
 	m.InsecureSkipVerify = *optInsecureSkipVerify
+	m.StartTLS = *optStartTLS
+	m.CACert = *optCACert
 	m.ReplBase = *optReplBase
 	m.ReplMasterUseTLS = *optReplMasterTLS
 	m.ReplMasterBind = *optReplMasterBind
@@ -347,25 +530,19 @@ func Do() {
 	m.BindPasswd = *optBindPasswd
 	m.Prefix = *optPrefix
 
-	if *optBindDn == "" {
-		logger.Errorf("bind is required.")
-		flag.PrintDefaults()
-		os.Exit(1)
-	}
 	var err error
-	if m.UseTLS {
-		m.l, err = ldap.DialTLS("tcp", m.TargetHost, &tls.Config{InsecureSkipVerify: m.InsecureSkipVerify})
-	} else {
-		m.l, err = ldap.Dial("tcp", m.TargetHost)
-	}
+	m.l, err = m.dial(m.TargetHost, m.UseTLS)
 	if err != nil {
 		logger.Errorf("Failed to Dial %s, err: %s", m.TargetHost, err)
 		os.Exit(1)
 	}
-	err = m.l.Bind(m.BindDn, m.BindPasswd)
-	if err != nil {
-		logger.Errorf("Failed to Bind %s, err: %s", m.BindDn, err)
-		os.Exit(1)
+	// cn=Monitor is searched anonymously without the bind dn, if its ACLs allow
+	if m.BindDn != "" {
+		err = m.l.Bind(m.BindDn, m.BindPasswd)
+		if err != nil {
+			logger.Errorf("Failed to Bind %s, err: %s", m.BindDn, err)
+			os.Exit(1)
+		}
 	}
 	helper := mp.NewMackerelPlugin(m)
 	if *optTempfile != "" {
@@ -1,6 +1,8 @@
 package mpopenldap
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -97,3 +99,99 @@ func TestLatestCSN(t *testing.T) {
 		t.Errorf("latestCSN = %q, want %q", tm, want)
 	}
 }
+
+func TestParseCSN(t *testing.T) {
+	tm, sid, err := parseCSN("20170713094701.963361Z#000000#05b#000000")
+	if err != nil {
+		t.Fatalf("parseCSN() returns error: %s", err)
+	}
+	want, _ := time.Parse("2006-01-02T15:04:05.999999Z07:00", "2017-07-13T09:47:01.963361Z")
+	if !tm.Equal(want) {
+		t.Errorf("parseCSN() = %q, want %q", tm, want)
+	}
+	if sid != "05b" {
+		t.Errorf("replica ID = %q, want %q", sid, "05b")
+	}
+
+	if _, _, err := parseCSN("20170713094701.963361Z"); err == nil {
+		t.Errorf("parseCSN() should return error against an invalid CSN")
+	}
+}
+
+func TestReplicationLags(t *testing.T) {
+	base := time.Date(2017, 7, 13, 9, 47, 1, 0, time.UTC)
+	provider := map[string]time.Time{
+		"001": base,
+		"002": base.Add(30 * time.Second),
+		"003": base,
+	}
+	local := map[string]time.Time{
+		"001": base,
+		"002": base.Add(10 * time.Second),
+	}
+	lags := replicationLags(provider, local)
+	want := map[string]float64{"001": 0, "002": 20}
+	if len(lags) != len(want) {
+		t.Errorf("replicationLags() = %v, want %v", lags, want)
+	}
+	for sid, w := range want {
+		if lags[sid] != w {
+			t.Errorf("lag of %s = %f, want %f", sid, lags[sid], w)
+		}
+	}
+}
+
+func TestDatabaseEntries(t *testing.T) {
+	sr := &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			ldap.NewEntry("cn=Databases,cn=Monitor", map[string][]string{}),
+			ldap.NewEntry("cn=Database 1,cn=Databases,cn=Monitor", map[string][]string{
+				"olmMDBEntries": {"1234"},
+			}),
+			ldap.NewEntry("cn=Database 2,cn=Databases,cn=Monitor", map[string][]string{
+				"olmMDBEntries": {"56"},
+			}),
+		},
+	}
+	stat := databaseEntries(sr)
+	want := map[string]float64{
+		"database_entries.database_1.entries": 1234,
+		"database_entries.database_2.entries": 56,
+	}
+	if len(stat) != len(want) {
+		t.Errorf("databaseEntries() = %v, want %v", stat, want)
+	}
+	for k, w := range want {
+		if stat[k] != w {
+			t.Errorf("stat[%s] = %f, want %f", k, stat[k], w)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	m := OpenLDAPPlugin{InsecureSkipVerify: true}
+	config, err := m.tlsConfig("ldap.example.net:636")
+	if err != nil {
+		t.Fatalf("tlsConfig() returns error: %s", err)
+	}
+	if config.ServerName != "ldap.example.net" || !config.InsecureSkipVerify {
+		t.Errorf("tlsConfig() = %+v", config)
+	}
+
+	m.CACert = "testdata/not-found.pem"
+	if _, err := m.tlsConfig("ldap.example.net:636"); err == nil {
+		t.Errorf("tlsConfig() should return error against a CA certificate not found")
+	}
+}
+
+func TestMonitorError(t *testing.T) {
+	err := monitorError(ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("No Such Object")))
+	if !strings.HasPrefix(err.Error(), "cn=Monitor is not found") {
+		t.Errorf("monitorError: unexpected %s", err)
+	}
+
+	orig := ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("Insufficient Access Rights"))
+	if err := monitorError(orig); err != orig {
+		t.Errorf("monitorError: other errors should be returned as is, but %s", err)
+	}
+}
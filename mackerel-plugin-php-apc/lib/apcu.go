@@ -0,0 +1,143 @@
+package mpphpapc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// apcuStatPlace maps the fields of php-apcu.php, apcu_cache_info() and apcu_sma_info() of APCu, onto the metrics
+// of the user cache of APC, since APCu has no file cache
+var apcuStatPlace = map[string][]string{
+	"memory_segments":       {"apcu", "sma_info", "num_seg"},
+	"segment_size":          {"apcu", "sma_info", "seg_size"},
+	"available_memory":      {"apcu", "sma_info", "avail_mem"},
+	"user_cache_vars_count": {"apcu", "cache_info", "num_entries"},
+	"user_cache_vars_size":  {"apcu", "cache_info", "mem_size"},
+	"user_cache_hits":       {"apcu", "cache_info", "num_hits"},
+	"user_cache_misses":     {"apcu", "cache_info", "num_misses"},
+	"user_cache_full_count": {"apcu", "cache_info", "expunges"},
+}
+
+// opcacheStatPlace maps the fields of opcache_get_status()
+var opcacheStatPlace = map[string][]string{
+	"opcache_hit_rate":               {"opcache", "opcache_statistics", "opcache_hit_rate"},
+	"opcache_hits":                   {"opcache", "opcache_statistics", "hits"},
+	"opcache_misses":                 {"opcache", "opcache_statistics", "misses"},
+	"opcache_cached_scripts":         {"opcache", "opcache_statistics", "num_cached_scripts"},
+	"opcache_oom_restarts":           {"opcache", "opcache_statistics", "oom_restarts"},
+	"opcache_hash_restarts":          {"opcache", "opcache_statistics", "hash_restarts"},
+	"opcache_manual_restarts":        {"opcache", "opcache_statistics", "manual_restarts"},
+	"opcache_used_memory":            {"opcache", "memory_usage", "used_memory"},
+	"opcache_free_memory":            {"opcache", "memory_usage", "free_memory"},
+	"opcache_wasted_memory":          {"opcache", "memory_usage", "wasted_memory"},
+	"opcache_interned_strings_used":  {"opcache", "interned_strings_usage", "used_memory"},
+	"opcache_interned_strings_free":  {"opcache", "interned_strings_usage", "free_memory"},
+	"opcache_interned_strings_count": {"opcache", "interned_strings_usage", "number_of_strings"},
+}
+
+// isAPCuStatus reports whether the status page is the JSON of php-apcu.php rather than the lines of php-apc.php
+func isAPCuStatus(str string) bool {
+	return strings.HasPrefix(strings.TrimSpace(str), "{")
+}
+
+func getPlaceValue(v interface{}, place []string) (float64, bool) {
+	for _, key := range place {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		v = m[key]
+	}
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// parsing metrics from php-apcu.php, where the fields not found are skipped
+func parsePhpApcuStatus(str string, p *map[string]float64) error {
+	var status map[string]interface{}
+	if err := json.Unmarshal([]byte(str), &status); err != nil {
+		return fmt.Errorf("failed to parse the status of APCu: %s", err)
+	}
+
+	for _, places := range []map[string][]string{apcuStatPlace, opcacheStatPlace} {
+		for k, place := range places {
+			if v, ok := getPlaceValue(status, place); ok {
+				(*p)[k] = v
+			}
+		}
+	}
+	numSeg, ok1 := (*p)["memory_segments"]
+	segSize, ok2 := (*p)["segment_size"]
+	if ok1 && ok2 {
+		(*p)["total_memory"] = numSeg * segSize
+	}
+
+	if len(*p) == 0 {
+		return errors.New("status data of APCu or OPcache not found")
+	}
+	return nil
+}
+
+func opcacheGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"opcache.hit_rate": {
+			Label: labelPrefix + " OPcache Hit Rate",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_hit_rate", Label: "Hit Rate", Diff: false, Stacked: false},
+			},
+		},
+		"opcache.stats": {
+			Label: labelPrefix + " OPcache Statistics",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_hits", Label: "Hits", Diff: true, Stacked: false},
+				{Name: "opcache_misses", Label: "Misses", Diff: true, Stacked: false},
+			},
+		},
+		"opcache.scripts": {
+			Label: labelPrefix + " OPcache Cached Scripts",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_cached_scripts", Label: "Scripts", Diff: false, Stacked: false},
+			},
+		},
+		"opcache.memory": {
+			Label: labelPrefix + " OPcache Memory",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_used_memory", Label: "Used", Diff: false, Stacked: true},
+				{Name: "opcache_wasted_memory", Label: "Wasted", Diff: false, Stacked: true},
+				{Name: "opcache_free_memory", Label: "Free", Diff: false, Stacked: true},
+			},
+		},
+		"opcache.interned_strings": {
+			Label: labelPrefix + " OPcache Interned Strings",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_interned_strings_used", Label: "Used", Diff: false, Stacked: true},
+				{Name: "opcache_interned_strings_free", Label: "Free", Diff: false, Stacked: true},
+			},
+		},
+		"opcache.interned_strings_count": {
+			Label: labelPrefix + " OPcache Interned Strings Count",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_interned_strings_count", Label: "Strings", Diff: false, Stacked: false},
+			},
+		},
+		"opcache.restarts": {
+			Label: labelPrefix + " OPcache Restarts",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_oom_restarts", Label: "Out of Memory", Diff: true, Stacked: false},
+				{Name: "opcache_hash_restarts", Label: "Hash Full", Diff: true, Stacked: false},
+				{Name: "opcache_manual_restarts", Label: "Manual", Diff: true, Stacked: false},
+			},
+		},
+	}
+}
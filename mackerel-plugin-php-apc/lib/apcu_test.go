@@ -0,0 +1,66 @@
+package mpphpapc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the output of php-apcu.php on PHP 8 with APCu 5.1 and OPcache
+const apcuStub = `{
+  "apcu": {
+    "cache_info": {"num_slots": 4099, "ttl": 0, "num_hits": 8334, "num_misses": 10997, "num_inserts": 11000,
+      "num_entries": 770, "expunges": 2, "start_time": 1672628645, "mem_size": 45835056, "memory_type": "mmap"},
+    "sma_info": {"num_seg": 1, "seg_size": 134217592, "avail_mem": 88382536}
+  },
+  "opcache": {
+    "opcache_enabled": true,
+    "cache_full": false,
+    "memory_usage": {"used_memory": 20000000, "free_memory": 114000000, "wasted_memory": 217728, "current_wasted_percentage": 0.16},
+    "interned_strings_usage": {"buffer_size": 8388608, "used_memory": 3000000, "free_memory": 5388608, "number_of_strings": 50000},
+    "opcache_statistics": {"num_cached_scripts": 392, "num_cached_keys": 700, "max_cached_keys": 16229,
+      "hits": 606130, "misses": 392, "blacklist_misses": 0, "oom_restarts": 0, "hash_restarts": 1, "manual_restarts": 3,
+      "opcache_hit_rate": 99.93}
+  }
+}`
+
+func TestParsePhpApcuStatus(t *testing.T) {
+	assert.True(t, isAPCuStatus(apcuStub))
+	assert.False(t, isAPCuStatus("memory_segments:1\n"))
+
+	stat := make(map[string]float64)
+	err := parsePhpApcuStatus(apcuStub, &stat)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, stat["memory_segments"])
+	assert.EqualValues(t, 134217592, stat["total_memory"])
+	assert.EqualValues(t, 88382536, stat["available_memory"])
+	assert.EqualValues(t, 770, stat["user_cache_vars_count"])
+	assert.EqualValues(t, 45835056, stat["user_cache_vars_size"])
+	assert.EqualValues(t, 8334, stat["user_cache_hits"])
+	assert.EqualValues(t, 10997, stat["user_cache_misses"])
+	assert.EqualValues(t, 2, stat["user_cache_full_count"])
+	// APCu has no file cache
+	assert.NotContains(t, stat, "cache_hits")
+	assert.NotContains(t, stat, "cached_files_size")
+
+	assert.EqualValues(t, 99.93, stat["opcache_hit_rate"])
+	assert.EqualValues(t, 606130, stat["opcache_hits"])
+	assert.EqualValues(t, 392, stat["opcache_cached_scripts"])
+	assert.EqualValues(t, 1, stat["opcache_hash_restarts"])
+	assert.EqualValues(t, 3, stat["opcache_manual_restarts"])
+	assert.EqualValues(t, 217728, stat["opcache_wasted_memory"])
+	assert.EqualValues(t, 3000000, stat["opcache_interned_strings_used"])
+	assert.EqualValues(t, 50000, stat["opcache_interned_strings_count"])
+}
+
+func TestParsePhpApcuStatusWithoutOpcache(t *testing.T) {
+	stat := make(map[string]float64)
+	err := parsePhpApcuStatus(`{"apcu":{"cache_info":{"num_hits":1,"num_misses":2},"sma_info":{"num_seg":1,"seg_size":1024,"avail_mem":512}}}`, &stat)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1024, stat["total_memory"])
+	assert.NotContains(t, stat, "opcache_hit_rate")
+
+	stat = make(map[string]float64)
+	assert.NotNil(t, parsePhpApcuStatus(`{}`, &stat))
+	assert.NotNil(t, parsePhpApcuStatus(`memory_segments:1`, &stat))
+}
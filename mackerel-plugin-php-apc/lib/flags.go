@@ -9,6 +9,9 @@ var flags = []cli.Flag{
 	cliHTTPPort,
 	cliStatusPage,
 	cliTempFile,
+	cliMetricKeyPrefix,
+	cliLabelPrefix,
+	cliAPCu,
 }
 
 var cliHTTPHost = cli.StringFlag{
@@ -38,3 +41,20 @@ var cliTempFile = cli.StringFlag{
 	Usage:  "Set temporary file path.",
 	EnvVar: "ENVVAR_TEMPFILE",
 }
+
+var cliMetricKeyPrefix = cli.StringFlag{
+	Name:  "metric-key-prefix",
+	Value: "php-apc",
+	Usage: "Set metric key prefix.",
+}
+
+var cliLabelPrefix = cli.StringFlag{
+	Name:  "metric-label-prefix",
+	Value: "",
+	Usage: "Set metric label prefix. (default: PHP APC, or the metric key prefix in title case if it is changed)",
+}
+
+var cliAPCu = cli.BoolFlag{
+	Name:  "apcu",
+	Usage: "Parse the status of APCu and OPcache by php-apcu.php, whose status page is /mackerel/php-apcu.php by default.",
+}
@@ -10,59 +10,93 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 	"github.com/urfave/cli"
 )
 
-// metric value structure
-var graphdef = map[string]mp.Graphs{
-	"php-apc.purges": {
-		Label: "PHP APC Cache Purge Count",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "cache_full_count", Label: "File Cache", Diff: true, Stacked: false},
-			{Name: "user_cache_full_count", Label: "User Cache", Diff: true, Stacked: false},
-		},
-	},
-	"php-apc.stats": {
-		Label: "PHP APC File Cache Statistics",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "cache_hits", Label: "Hits", Diff: true, Stacked: false},
-			{Name: "cache_misses", Label: "Misses", Diff: true, Stacked: false},
-		},
-	},
-	"php-apc.cache_size": {
-		Label: "PHP APC Cache Size",
-		Unit:  "bytes",
-		Metrics: []mp.Metrics{
-			{Name: "cached_files_size", Label: "File Cache", Diff: false, Stacked: true},
-			{Name: "user_cache_vars_size", Label: "User Cache", Diff: false, Stacked: true},
-			{Name: "total_memory", Label: "Total", Diff: false, Stacked: false},
-		},
-	},
-	"php-apc.user_stats": {
-		Label: "PHP APC User Cache Statistics",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "user_cache_hits", Label: "Hits", Diff: true, Stacked: false},
-			{Name: "user_cache_misses", Label: "Misses", Diff: true, Stacked: false},
-		},
-	},
-}
-
 // PhpApcPlugin mackerel plugin for php-apc
 type PhpApcPlugin struct {
-	Host     string
-	Port     uint16
-	Path     string
-	Tempfile string
+	Host        string
+	Port        uint16
+	Path        string
+	Tempfile    string
+	Prefix      string
+	LabelPrefix string
+	// APCu requires the JSON of php-apcu.php, which is also detected from the status page without APCu
+	APCu bool
+}
+
+// MetricKeyPrefix interface for PluginWithPrefix
+func (c PhpApcPlugin) MetricKeyPrefix() string {
+	if c.Prefix == "" {
+		c.Prefix = "php-apc"
+	}
+	return c.Prefix
+}
+
+// labelPrefix returns the prefix of the graph labels, which is PHP APC unless the metric key prefix is changed
+func (c PhpApcPlugin) labelPrefix() string {
+	if c.LabelPrefix != "" {
+		return c.LabelPrefix
+	}
+	if c.MetricKeyPrefix() == "php-apc" {
+		return "PHP APC"
+	}
+	return strings.Title(c.MetricKeyPrefix())
 }
 
 // GraphDefinition interface for mackerelplugin
 func (c PhpApcPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := c.labelPrefix()
+
+	// metric value structure
+	graphdef := map[string]mp.Graphs{
+		"purges": {
+			Label: labelPrefix + " Cache Purge Count",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache_full_count", Label: "File Cache", Diff: true, Stacked: false},
+				{Name: "user_cache_full_count", Label: "User Cache", Diff: true, Stacked: false},
+			},
+		},
+		"stats": {
+			Label: labelPrefix + " File Cache Statistics",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache_hits", Label: "Hits", Diff: true, Stacked: false},
+				{Name: "cache_misses", Label: "Misses", Diff: true, Stacked: false},
+			},
+		},
+		"cache_size": {
+			Label: labelPrefix + " Cache Size",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "cached_files_size", Label: "File Cache", Diff: false, Stacked: true},
+				{Name: "user_cache_vars_size", Label: "User Cache", Diff: false, Stacked: true},
+				{Name: "available_memory", Label: "Available", Diff: false, Stacked: true},
+				{Name: "total_memory", Label: "Total", Diff: false, Stacked: false},
+			},
+		},
+		"user_stats": {
+			Label: labelPrefix + " User Cache Statistics",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "user_cache_hits", Label: "Hits", Diff: true, Stacked: false},
+				{Name: "user_cache_misses", Label: "Misses", Diff: true, Stacked: false},
+			},
+		},
+	}
+	for k, v := range opcacheGraphDefinition(labelPrefix) {
+		graphdef[k] = v
+	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host, the port and the status page
+func (c PhpApcPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "php-apc", c.Host, strconv.Itoa(int(c.Port)), c.Path)
+}
+
 // main function
 func doMain(c *cli.Context) error {
 
@@ -71,9 +105,15 @@ func doMain(c *cli.Context) error {
 	phpapc.Host = c.String("http_host")
 	phpapc.Port = uint16(c.Int("http_port"))
 	phpapc.Path = c.String("status_page")
+	phpapc.Prefix = c.String("metric-key-prefix")
+	phpapc.LabelPrefix = c.String("metric-label-prefix")
+	phpapc.APCu = c.Bool("apcu")
+	if phpapc.APCu && !c.IsSet("status_page") {
+		phpapc.Path = "/mackerel/php-apcu.php"
+	}
 
 	helper := mp.NewMackerelPlugin(phpapc)
-	helper.Tempfile = c.String("tempfile")
+	helper.Tempfile = phpapc.tempfile(c.String("tempfile"))
 
 	helper.Run()
 	return nil
@@ -87,6 +127,12 @@ func (c PhpApcPlugin) FetchMetrics() (map[string]float64, error) {
 	}
 
 	stat := make(map[string]float64)
+	if c.APCu || isAPCuStatus(data) {
+		if err := parsePhpApcuStatus(data, &stat); err != nil {
+			return nil, err
+		}
+		return stat, nil
+	}
 	errStat := parsePhpApcStatus(data, &stat)
 	if errStat != nil {
 		return nil, errStat
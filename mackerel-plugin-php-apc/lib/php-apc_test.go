@@ -92,3 +92,48 @@ user_cache_full_count:0`
 	assert.Contains(t, ret, "user_cache_misses")
 	assert.Contains(t, ret, "user_cache_full_count")
 }
+
+func TestGraphDefinition(t *testing.T) {
+	var phpapc PhpApcPlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range phpapc.GraphDefinition() {
+		graphs[phpapc.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"php-apc.purges":     "PHP APC Cache Purge Count",
+		"php-apc.stats":      "PHP APC File Cache Statistics",
+		"php-apc.cache_size": "PHP APC Cache Size",
+		"php-apc.user_stats": "PHP APC User Cache Statistics",
+
+		"php-apc.opcache.hit_rate":               "PHP APC OPcache Hit Rate",
+		"php-apc.opcache.stats":                  "PHP APC OPcache Statistics",
+		"php-apc.opcache.scripts":                "PHP APC OPcache Cached Scripts",
+		"php-apc.opcache.memory":                 "PHP APC OPcache Memory",
+		"php-apc.opcache.interned_strings":       "PHP APC OPcache Interned Strings",
+		"php-apc.opcache.interned_strings_count": "PHP APC OPcache Interned Strings Count",
+		"php-apc.opcache.restarts":               "PHP APC OPcache Restarts",
+	}, graphs)
+
+	phpapc.Prefix = "php-apc-app"
+	assert.Equal(t, "Php-Apc-App Cache Size", phpapc.GraphDefinition()["cache_size"].Label)
+	phpapc.LabelPrefix = "App"
+	assert.Equal(t, "App Cache Size", phpapc.GraphDefinition()["cache_size"].Label)
+}
+
+func TestTempfile(t *testing.T) {
+	p := PhpApcPlugin{Host: "127.0.0.1", Port: 80, Path: "/mackerel/php-apc.php"}
+	for field, other := range map[string]PhpApcPlugin{
+		"Host": {Host: "127.0.0.2", Port: 80, Path: "/mackerel/php-apc.php"},
+		"Port": {Host: "127.0.0.1", Port: 8080, Path: "/mackerel/php-apc.php"},
+		"Path": {Host: "127.0.0.1", Port: 80, Path: "/php-apc.php"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/php-apc.json"); f != "/tmp/php-apc.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
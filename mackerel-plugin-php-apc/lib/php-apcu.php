@@ -0,0 +1,21 @@
+<?php
+
+header("Content-Type: application/json");
+
+$stats = array();
+
+if (function_exists('apcu_cache_info')) {
+    $stats['apcu'] = array(
+        'cache_info' => apcu_cache_info(true),
+        'sma_info'   => apcu_sma_info(true),
+    );
+}
+
+if (function_exists('opcache_get_status')) {
+    $opcache = opcache_get_status(false);
+    if ($opcache !== false) {
+        $stats['opcache'] = $opcache;
+    }
+}
+
+echo json_encode($stats);
@@ -0,0 +1,163 @@
+package mpphpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the record types and the role of FastCGI, see https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+
+	// fcgiRequestID is the ID of the only request on the connection
+	fcgiRequestID = 1
+)
+
+type fcgiHeader struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+func writeRecord(w io.Writer, recType uint8, content []byte) error {
+	h := fcgiHeader{
+		Version:       fcgiVersion,
+		Type:          recType,
+		RequestID:     fcgiRequestID,
+		ContentLength: uint16(len(content)),
+	}
+	if err := binary.Write(w, binary.BigEndian, h); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// writeLength writes the length of the name or the value of the params in 1 byte, or in 4 bytes if it is 128 or more
+func writeLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	binary.Write(b, binary.BigEndian, uint32(n)|1<<31)
+}
+
+func encodeParams(params map[string]string) []byte {
+	var b bytes.Buffer
+	for k, v := range params {
+		writeLength(&b, len(k))
+		writeLength(&b, len(v))
+		b.WriteString(k)
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+// fcgiGet requests the script on the network address of php-fpm as GET, and returns the status, the headers and the
+// body of the CGI response. The timeout bounds the connect and all the I/O.
+func fcgiGet(network, address, script, query string, timeout time.Duration) (int, textproto.MIMEHeader, []byte, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"REQUEST_METHOD":    "GET",
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   script,
+		"REQUEST_URI":       script + "?" + query,
+		"QUERY_STRING":      query,
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+	}
+	w := bufio.NewWriter(conn)
+	records := []struct {
+		recType uint8
+		content []byte
+	}{
+		{fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}},
+		{fcgiParams, encodeParams(params)},
+		{fcgiParams, nil},
+		{fcgiStdin, nil},
+	}
+	for _, r := range records {
+		if err := writeRecord(w, r.recType, r.content); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	r := bufio.NewReader(conn)
+	for {
+		var h fcgiHeader
+		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+			return 0, nil, nil, fmt.Errorf("failed to read the response: %s", err)
+		}
+		content := make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return 0, nil, nil, fmt.Errorf("failed to read the response: %s", err)
+		}
+		content = content[:h.ContentLength]
+		switch h.Type {
+		case fcgiStdout:
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		}
+		if h.Type == fcgiEndRequest {
+			break
+		}
+	}
+	if stdout.Len() == 0 && stderr.Len() > 0 {
+		return 0, nil, nil, fmt.Errorf("php-fpm returned an error: %s", strings.TrimSpace(stderr.String()))
+	}
+	return parseCGIResponse(stdout.Bytes())
+}
+
+// parseCGIResponse parses the headers and the body of the CGI response, where the status is 200 without Status
+func parseCGIResponse(b []byte) (int, textproto.MIMEHeader, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to parse the response headers: %s", err)
+	}
+	status := 200
+	if s := header.Get("Status"); s != "" {
+		code, err := strconv.Atoi(strings.Fields(s)[0])
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("invalid status of the response: %s", s)
+		}
+		status = code
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return status, header, body, nil
+}
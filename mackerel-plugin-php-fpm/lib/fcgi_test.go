@@ -0,0 +1,86 @@
+package mpphpfpm
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveFCGI serves the handler as php-fpm over FastCGI on a unix socket, and returns the path of the socket and the
+// func to stop serving
+func serveFCGI(t *testing.T, handler http.HandlerFunc) (string, func()) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-php-fpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "php-fpm.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go fcgi.Serve(l, handler)
+	return socket, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetStatusFCGI(t *testing.T) {
+	var path, query string
+	socket, stop := serveFCGI(t, func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"pool":"www","active processes":3,"idle processes":7,"total processes":10,"processes":[{"pid":1}]}`))
+	})
+	defer stop()
+
+	p := PhpFpmPlugin{
+		URL:        "http://localhost/fpm-status?json",
+		Timeout:    5,
+		FCGISocket: socket,
+	}
+	status, err := getStatus(p)
+	assert.Nil(t, err)
+	assert.Equal(t, "/fpm-status", path)
+	assert.Equal(t, "json&full", query)
+	assert.EqualValues(t, 10, status.TotalProcesses)
+	assert.EqualValues(t, 3, status.ActiveProcesses)
+	assert.EqualValues(t, 7, status.IdleProcesses)
+}
+
+func TestGetStatusFCGIHTML(t *testing.T) {
+	socket, stop := serveFCGI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>pool: www</body></html>"))
+	})
+	defer stop()
+
+	p := PhpFpmPlugin{URL: "http://localhost/status", Timeout: 5, FCGISocket: socket}
+	_, err := getStatus(p)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "HTML")
+
+	socket, stopNotFound := serveFCGI(t, func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	defer stopNotFound()
+	p.FCGISocket = socket
+	_, err = getStatus(p)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
+
+func TestTempfileFCGI(t *testing.T) {
+	a := PhpFpmPlugin{URL: "http://localhost/status?json", FCGISocket: "/run/php/www.sock"}
+	b := PhpFpmPlugin{URL: "http://localhost/status?json", FCGISocket: "/run/php/admin.sock"}
+	c := PhpFpmPlugin{URL: "http://localhost/status?json"}
+	assert.NotEqual(t, a.tempfile(""), b.tempfile(""))
+	assert.NotEqual(t, a.tempfile(""), c.tempfile(""))
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // PhpFpmPlugin mackerel plugin
@@ -17,8 +20,16 @@ type PhpFpmPlugin struct {
 	Prefix      string
 	LabelPrefix string
 	Timeout     uint
+	// FCGISocket or FCGIAddress is the address of php-fpm requested over FastCGI instead of URL, where the path
+	// and the query of URL are requested
+	FCGISocket  string
+	FCGIAddress string
+	// Pools are the pools monitored at once with -pool, whose metrics are posted as <prefix>.<label>.*
+	Pools []Pool
 }
 
+var logger = pluginutil.NewLogger("php-fpm")
+
 // PhpFpmStatus struct for PhpFpmPlugin mackerel plugin
 type PhpFpmStatus struct {
 	Pool               string `json:"pool"`
@@ -44,7 +55,20 @@ func (p PhpFpmPlugin) MetricKeyPrefix() string {
 
 // GraphDefinition interface for mackerelplugin
 func (p PhpFpmPlugin) GraphDefinition() map[string]mp.Graphs {
-	return map[string]mp.Graphs{
+	graphdef := p.graphDefinition()
+	if len(p.Pools) > 0 {
+		pools := make(map[string]mp.Graphs, len(graphdef))
+		for k, v := range graphdef {
+			pools["#."+k] = v
+		}
+		return pools
+	}
+	return graphdef
+}
+
+// graphDefinition returns the graphs of a pool
+func (p PhpFpmPlugin) graphDefinition() map[string]mp.Graphs {
+	graphdef := map[string]mp.Graphs{
 		"processes": {
 			Label: p.LabelPrefix + " Processes",
 			Unit:  "integer",
@@ -91,14 +115,27 @@ func (p PhpFpmPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+
+	return graphdef
 }
 
 // FetchMetrics interface for mackerelplugin
 func (p PhpFpmPlugin) FetchMetrics() (map[string]interface{}, error) {
-	status, err := getStatus(p)
+	if len(p.Pools) > 0 {
+		return p.fetchPoolsMetrics()
+	}
+	stat, err := p.fetchMetrics()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to fetch PHP-FPM metrics: %s", err)
 	}
+	return stat, nil
+}
+
+func (p PhpFpmPlugin) fetchMetrics() (map[string]interface{}, error) {
+	status, err := getStatus(p)
+	if err != nil {
+		return nil, err
+	}
 
 	return map[string]interface{}{
 		"total_processes":      status.TotalProcesses,
@@ -114,28 +151,98 @@ func (p PhpFpmPlugin) FetchMetrics() (map[string]interface{}, error) {
 }
 
 func getStatus(p PhpFpmPlugin) (*PhpFpmStatus, error) {
-	url := p.URL
 	timeout := time.Duration(time.Duration(p.Timeout) * time.Second)
+	var (
+		status int
+		header http.Header
+		body   []byte
+		err    error
+	)
+	if network, address := p.fcgiAddress(); address != "" {
+		status, header, body, err = p.getStatusFCGI(network, address, timeout)
+	} else {
+		status, header, body, err = p.getStatusHTTP(timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("the status page returned %d", status)
+	}
+	return parseStatus(header, body)
+}
+
+func (p PhpFpmPlugin) getStatusHTTP(timeout time.Duration) (int, http.Header, []byte, error) {
 	client := http.Client{
 		Timeout: timeout,
 	}
 
-	res, err := client.Get(url)
+	res, err := client.Get(p.URL)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
 	}
+	return res.StatusCode, res.Header, body, nil
+}
 
-	var status *PhpFpmStatus
-	json.Unmarshal(body, &status)
+// fcgiAddress returns the network and the address of FCGISocket or FCGIAddress, or the empty address for HTTP
+func (p PhpFpmPlugin) fcgiAddress() (string, string) {
+	if p.FCGISocket != "" {
+		return "unix", p.FCGISocket
+	}
+	return "tcp", p.FCGIAddress
+}
 
+// getStatusFCGI requests pm.status_path, the path of URL, with ?json&full over FastCGI
+func (p PhpFpmPlugin) getStatusFCGI(network, address string, timeout time.Duration) (int, http.Header, []byte, error) {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	script := u.Path
+	if script == "" {
+		script = "/status"
+	}
+	status, header, body, err := fcgiGet(network, address, script, "json&full", timeout)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to request %s over FastCGI on %s: %s", script, address, err)
+	}
+	return status, http.Header(header), body, nil
+}
+
+// parseStatus parses the JSON of the status page, where the HTML or the plain text returned without ?json is
+// reported instead of the zero metrics
+func parseStatus(header http.Header, body []byte) (*PhpFpmStatus, error) {
+	if strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+		return nil, fmt.Errorf("the status page returned HTML instead of JSON; add ?json to the query of the URL")
+	}
+	var status *PhpFpmStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("the status page returned no JSON; add ?json to the query of the URL: %s", err)
+	}
 	return status, nil
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URL of the status page
+func (p PhpFpmPlugin) tempfile(tempfile string) string {
+	if len(p.Pools) > 0 {
+		ids := make([]string, len(p.Pools))
+		for i, pool := range p.Pools {
+			ids[i] = pool.Label + "=" + pool.URL
+		}
+		return pluginutil.Tempfile(tempfile, "php-fpm", ids...)
+	}
+	if _, address := p.fcgiAddress(); address != "" {
+		return pluginutil.Tempfile(tempfile, "php-fpm", address, p.URL)
+	}
+	return pluginutil.Tempfile(tempfile, "php-fpm", p.URL)
+}
+
 // Do the plugin
 func Do() {
 	optURL := flag.String("url", "http://localhost/status?json", "PHP-FPM status page URL")
@@ -143,16 +250,27 @@ func Do() {
 	optLabelPrefix := flag.String("metric-label-prefix", "PHP-FPM", "Metric label prefix")
 	optTimeout := flag.Uint("timeout", 5, "Timeout")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optFCGISocket := flag.String("fcgi-socket", "", "Unix socket of php-fpm requested over FastCGI instead of -url")
+	optFCGIAddress := flag.String("fcgi-address", "", "host:port of php-fpm requested over FastCGI instead of -url")
+	var optPools PoolsFlag
+	flag.Var(&optPools, "pool", "label=url of the pool, which is repeated or comma separated to monitor several pools")
 	flag.Parse()
 
+	if len(optPools) > 0 && (*optFCGISocket != "" || *optFCGIAddress != "") {
+		logger.Fatalf("-pool cannot be used with -fcgi-socket or -fcgi-address")
+	}
+
 	p := PhpFpmPlugin{
 		URL:         *optURL,
 		Prefix:      *optPrefix,
 		LabelPrefix: *optLabelPrefix,
 		Timeout:     *optTimeout,
+		FCGISocket:  *optFCGISocket,
+		FCGIAddress: *optFCGIAddress,
+		Pools:       optPools,
 	}
 	helper := mp.NewMackerelPlugin(p)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = p.tempfile(*optTempfile)
 
 	helper.Run()
 }
@@ -48,3 +48,18 @@ func TestGetStatus(t *testing.T) {
 	assert.EqualValues(t, 3, status.MaxListenQueue)
 	assert.EqualValues(t, 1000, status.SlowRequests)
 }
+
+func TestTempfile(t *testing.T) {
+	p := PhpFpmPlugin{URL: "http://localhost/status?json"}
+	for field, other := range map[string]PhpFpmPlugin{
+		"URL":   {URL: "http://localhost/pool2/status?json"},
+		"Pools": {Pools: []Pool{{Label: "www", URL: "http://localhost/status?json"}}},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/php-fpm.json"); f != "/tmp/php-fpm.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,81 @@
+package mpphpfpm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pool is a pool of php-fpm whose metrics are posted as <prefix>.<label>.*
+type Pool struct {
+	Label string
+	URL   string
+}
+
+var poolLabelRe = regexp.MustCompile("^[-a-zA-Z0-9_]+$")
+
+// PoolsFlag is the flag.Value of -pool, which is repeated or comma separated as label=url
+type PoolsFlag []Pool
+
+func (f *PoolsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	pools := make([]string, len(*f))
+	for i, pool := range *f {
+		pools[i] = pool.Label + "=" + pool.URL
+	}
+	return strings.Join(pools, ",")
+}
+
+// Set parses label=url, or the comma separated ones
+func (f *PoolsFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("the pool should be label=url: %q", v)
+		}
+		if !poolLabelRe.MatchString(kv[0]) {
+			return fmt.Errorf("the label of the pool should consist of alphanumerics, - and _: %q", kv[0])
+		}
+		for _, pool := range *f {
+			if pool.Label == kv[0] {
+				return fmt.Errorf("the label of the pool is duplicated: %q", kv[0])
+			}
+		}
+		*f = append(*f, Pool{Label: kv[0], URL: kv[1]})
+	}
+	return nil
+}
+
+// fetchPoolsMetrics fetches the metrics of each pool, and namespaces them by the label and the graph, since the graphs
+// are "#.<graph>" for the pools. The pools which are down are skipped.
+func (p PhpFpmPlugin) fetchPoolsMetrics() (map[string]interface{}, error) {
+	graphdef := p.graphDefinition()
+	stat := make(map[string]interface{})
+	var lastErr error
+	fetched := 0
+	for _, pool := range p.Pools {
+		n := p
+		n.URL = pool.URL
+		n.Pools = nil
+		poolStat, err := n.fetchMetrics()
+		if err != nil {
+			logger.Warningf("Failed to fetch the pool %s. Skip the pool. %s", pool.Label, err)
+			lastErr = err
+			continue
+		}
+		for key, graph := range graphdef {
+			for _, metric := range graph.Metrics {
+				if v, ok := poolStat[metric.Name]; ok {
+					stat[pool.Label+"."+key+"."+metric.Name] = v
+				}
+			}
+		}
+		fetched++
+	}
+	if fetched == 0 {
+		return nil, fmt.Errorf("Failed to fetch PHP-FPM metrics: %s", lastErr)
+	}
+	return stat, nil
+}
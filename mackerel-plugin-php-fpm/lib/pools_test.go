@@ -0,0 +1,107 @@
+package mpphpfpm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolsFlag(t *testing.T) {
+	var pools PoolsFlag
+	assert.Nil(t, pools.Set("www=http://localhost/www/status?json"))
+	assert.Nil(t, pools.Set("api=http://localhost/api/status?json, admin=http://localhost/admin/status?json"))
+	assert.Equal(t, PoolsFlag{
+		{Label: "www", URL: "http://localhost/www/status?json"},
+		{Label: "api", URL: "http://localhost/api/status?json"},
+		{Label: "admin", URL: "http://localhost/admin/status?json"},
+	}, pools)
+
+	assert.NotNil(t, pools.Set("www=http://localhost/status?json"), "the duplicated label")
+	assert.NotNil(t, pools.Set("http://localhost/status?json"), "no label")
+	assert.NotNil(t, pools.Set("w.w=http://localhost/status?json"), "the dot in the label")
+}
+
+func TestFetchPoolsMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/status" {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"pool":"` + r.URL.Path + `","active processes":2,"total processes":5}`))
+	}))
+	defer ts.Close()
+
+	p := PhpFpmPlugin{
+		Timeout: 5,
+		Pools: []Pool{
+			{Label: "www", URL: ts.URL + "/www/status?json"},
+			{Label: "api", URL: ts.URL + "/api/status?json"},
+			{Label: "admin", URL: ts.URL + "/admin/status?json"},
+		},
+	}
+	stat, err := p.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, stat["www.processes.total_processes"])
+	assert.EqualValues(t, 2, stat["api.processes.active_processes"])
+	// the pool down is skipped
+	assert.NotContains(t, stat, "admin.processes.total_processes")
+	assert.NotContains(t, stat, "total_processes")
+
+	// the keys should be looked up by the helper with the wildcard graphs of the pools
+	graphs := p.GraphDefinition()
+	for k := range stat {
+		if !matchesGraphDefinition(graphs, k) {
+			t.Errorf("%s matches no metrics of the graphs", k)
+		}
+	}
+	for _, label := range []string{"www", "api"} {
+		for _, name := range []string{"total_processes", "active_processes"} {
+			found := false
+			for k := range stat {
+				if graphMetricRe("#.processes", name).MatchString(k) && strings.HasPrefix(k, label+".") {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s of the pool %s should be posted", name, label)
+			}
+		}
+	}
+
+	p.Pools = p.Pools[2:]
+	_, err = p.FetchMetrics()
+	assert.NotNil(t, err)
+}
+
+// graphMetricRe returns the regexp of the keys of the metric in the graph, which the helper looks up the values by
+func graphMetricRe(key, name string) *regexp.Regexp {
+	re := strings.Replace(`\A`+key+"."+name+`\z`, ".", "\\.", -1)
+	return regexp.MustCompile(strings.Replace(re, "#", "[-a-zA-Z0-9_]+", -1))
+}
+
+func matchesGraphDefinition(graphdef map[string]mp.Graphs, k string) bool {
+	for key, graph := range graphdef {
+		for _, metric := range graph.Metrics {
+			if graphMetricRe(key, metric.Name).MatchString(k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestGraphDefinitionPools(t *testing.T) {
+	p := PhpFpmPlugin{LabelPrefix: "PHP-FPM"}
+	assert.Contains(t, p.GraphDefinition(), "processes")
+
+	p.Pools = []Pool{{Label: "www", URL: "http://localhost/status?json"}}
+	graphs := p.GraphDefinition()
+	assert.Contains(t, graphs, "#.processes")
+	assert.NotContains(t, graphs, "processes")
+	assert.Len(t, graphs, 6)
+}
@@ -9,6 +9,8 @@ var flags = []cli.Flag{
 	cliHTTPPort,
 	cliStatusPage,
 	cliTempFile,
+	cliMetricKeyPrefix,
+	cliLabelPrefix,
 }
 
 var cliHTTPHost = cli.StringFlag{
@@ -38,3 +40,15 @@ var cliTempFile = cli.StringFlag{
 	Usage:  "Set temporary file path.",
 	EnvVar: "ENVVAR_TEMPFILE",
 }
+
+var cliMetricKeyPrefix = cli.StringFlag{
+	Name:  "metric-key-prefix",
+	Value: "php-opcache",
+	Usage: "Set metric key prefix.",
+}
+
+var cliLabelPrefix = cli.StringFlag{
+	Name:  "metric-label-prefix",
+	Value: "",
+	Usage: "Set metric label prefix. (default: PHP OPCache, or the metric key prefix in title case if it is changed)",
+}
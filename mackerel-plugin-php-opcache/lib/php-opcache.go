@@ -10,59 +10,81 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 	"github.com/urfave/cli"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"php-opcache.memory_size": {
-		Label: "PHP OPCache Memory Size",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "used_memory", Label: "Used Memory", Diff: false, Stacked: false},
-			{Name: "free_memory", Label: "Free Memory", Diff: false, Stacked: false},
-			{Name: "wasted_memory", Label: "Wasted Memory", Diff: false, Stacked: false},
-		},
-	},
-	"php-opcache.memory": {
-		Label: "PHP OPCache Memory Statistics",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "opcache_hit_rate", Label: "OPCache hit rate", Diff: false, Stacked: false},
-			{Name: "current_wasted_percentage", Label: "Used Memory", Diff: false, Stacked: false},
-		},
-	},
-
-	"php-opcache.cache_size": {
-		Label: "PHP OPCache Cache Size",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "num_cached_scripts", Label: "Cached Script", Diff: false, Stacked: false},
-			{Name: "num_cached_keys", Label: "Num Cached Key", Diff: false, Stacked: false},
-			{Name: "max_cached_keys", Label: "Max Cached Key", Diff: false, Stacked: false},
-		},
-	},
-	"php-opcache.stats": {
-		Label: "PHP OPCache Cache Statistics",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "hits", Label: "Hits", Diff: true, Stacked: false},
-			{Name: "misses", Label: "Misses", Diff: true, Stacked: false},
-			{Name: "blacklist_misses", Label: "Blacklist Misses", Diff: true, Stacked: false},
-		},
-	},
-}
-
 // PhpOpcachePlugin mackerel plugin for php-opcache
 type PhpOpcachePlugin struct {
-	Host     string
-	Port     uint16
-	Path     string
-	Tempfile string
+	Host        string
+	Port        uint16
+	Path        string
+	Tempfile    string
+	Prefix      string
+	LabelPrefix string
+}
+
+// MetricKeyPrefix interface for PluginWithPrefix
+func (c PhpOpcachePlugin) MetricKeyPrefix() string {
+	if c.Prefix == "" {
+		c.Prefix = "php-opcache"
+	}
+	return c.Prefix
+}
+
+// labelPrefix returns the prefix of the graph labels, which is PHP OPCache unless the metric key prefix is changed
+func (c PhpOpcachePlugin) labelPrefix() string {
+	if c.LabelPrefix != "" {
+		return c.LabelPrefix
+	}
+	if c.MetricKeyPrefix() == "php-opcache" {
+		return "PHP OPCache"
+	}
+	return strings.Title(c.MetricKeyPrefix())
 }
 
 // GraphDefinition interface for mackerelplugin
 func (c PhpOpcachePlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := c.labelPrefix()
+
+	return map[string]mp.Graphs{
+		"memory_size": {
+			Label: labelPrefix + " Memory Size",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "used_memory", Label: "Used Memory", Diff: false, Stacked: false},
+				{Name: "free_memory", Label: "Free Memory", Diff: false, Stacked: false},
+				{Name: "wasted_memory", Label: "Wasted Memory", Diff: false, Stacked: false},
+			},
+		},
+		"memory": {
+			Label: labelPrefix + " Memory Statistics",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "opcache_hit_rate", Label: "OPCache hit rate", Diff: false, Stacked: false},
+				{Name: "current_wasted_percentage", Label: "Used Memory", Diff: false, Stacked: false},
+			},
+		},
+
+		"cache_size": {
+			Label: labelPrefix + " Cache Size",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "num_cached_scripts", Label: "Cached Script", Diff: false, Stacked: false},
+				{Name: "num_cached_keys", Label: "Num Cached Key", Diff: false, Stacked: false},
+				{Name: "max_cached_keys", Label: "Max Cached Key", Diff: false, Stacked: false},
+			},
+		},
+		"stats": {
+			Label: labelPrefix + " Cache Statistics",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "hits", Label: "Hits", Diff: true, Stacked: false},
+				{Name: "misses", Label: "Misses", Diff: true, Stacked: false},
+				{Name: "blacklist_misses", Label: "Blacklist Misses", Diff: true, Stacked: false},
+			},
+		},
+	}
 }
 
 // FetchMetrics interface for mackerelplugin
@@ -118,15 +140,22 @@ func getPhpOpcacheMetrics(host string, port uint16, path string) (string, error)
 	return string(body[:]), nil
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host, the port and the status page
+func (c PhpOpcachePlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "php-opcache", c.Host, strconv.Itoa(int(c.Port)), c.Path)
+}
+
 func doMain(c *cli.Context) error {
 	var phpopcache PhpOpcachePlugin
 
 	phpopcache.Host = c.String("http_host")
 	phpopcache.Port = uint16(c.Int("http_port"))
 	phpopcache.Path = c.String("status_page")
+	phpopcache.Prefix = c.String("metric-key-prefix")
+	phpopcache.LabelPrefix = c.String("metric-label-prefix")
 
 	helper := mp.NewMackerelPlugin(phpopcache)
-	helper.Tempfile = c.String("tempfile")
+	helper.Tempfile = phpopcache.tempfile(c.String("tempfile"))
 
 	helper.Run()
 	return nil
@@ -100,3 +100,40 @@ opcache_hit_rate:0`
 	assert.Contains(t, ret, "blacklist_miss_ratio")
 	assert.Contains(t, ret, "opcache_hit_rate")
 }
+
+func TestGraphDefinition(t *testing.T) {
+	var phpopcache PhpOpcachePlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range phpopcache.GraphDefinition() {
+		graphs[phpopcache.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"php-opcache.memory_size": "PHP OPCache Memory Size",
+		"php-opcache.memory":      "PHP OPCache Memory Statistics",
+		"php-opcache.cache_size":  "PHP OPCache Cache Size",
+		"php-opcache.stats":       "PHP OPCache Cache Statistics",
+	}, graphs)
+
+	phpopcache.Prefix = "opcache-app"
+	assert.Equal(t, "Opcache-App Cache Size", phpopcache.GraphDefinition()["cache_size"].Label)
+	phpopcache.LabelPrefix = "App"
+	assert.Equal(t, "App Cache Size", phpopcache.GraphDefinition()["cache_size"].Label)
+}
+
+func TestTempfile(t *testing.T) {
+	p := PhpOpcachePlugin{Host: "127.0.0.1", Port: 80, Path: "/mackerel/php-opcache.php"}
+	for field, other := range map[string]PhpOpcachePlugin{
+		"Host": {Host: "127.0.0.2", Port: 80, Path: "/mackerel/php-opcache.php"},
+		"Port": {Host: "127.0.0.1", Port: 8080, Path: "/mackerel/php-opcache.php"},
+		"Path": {Host: "127.0.0.1", Port: 80, Path: "/php-opcache.php"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/php-opcache.json"); f != "/tmp/php-opcache.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
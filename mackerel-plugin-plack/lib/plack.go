@@ -8,15 +8,28 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
+// requestMethods are the methods of the busy workers posted as busy_method_<method>, and the others are posted as
+// busy_method_other
+var requestMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
 // PlackPlugin mackerel plugin for Plack
 type PlackPlugin struct {
 	URI         string
 	Prefix      string
 	LabelPrefix string
+	User        string
+	Password    string
+	// SlowThreshold is the age of the in-flight requests of the slow workers
+	SlowThreshold time.Duration
+
+	Client *http.Client
 }
 
 // {
@@ -62,7 +75,13 @@ type PlackPlugin struct {
 // field types vary between versions
 
 // PlackRequest request
-type PlackRequest struct{}
+type PlackRequest struct {
+	Method     string      `json:"method"`
+	URI        string      `json:"uri"`
+	RemoteAddr string      `json:"remote_addr"`
+	Status     string      `json:"status"`
+	SS         interface{} `json:"ss"` // seconds since the beginning of the request
+}
 
 // PlackServerStatus sturct for server-status's json
 type PlackServerStatus struct {
@@ -76,11 +95,25 @@ type PlackServerStatus struct {
 
 // FetchMetrics interface for mackerelplugin
 func (p PlackPlugin) FetchMetrics() (map[string]interface{}, error) {
-	resp, err := http.Get(p.URI)
+	req, err := http.NewRequest("GET", p.URI, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.User != "" || p.Password != "" {
+		req.SetBasicAuth(p.User, p.Password)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", p.URI, resp.Status)
+	}
 
 	return p.parseStats(resp.Body)
 }
@@ -111,9 +144,70 @@ func (p PlackPlugin) parseStats(body io.Reader) (map[string]interface{}, error)
 		stat["bytes_sent"] = s
 	}
 
+	if len(s.Stats) > 0 {
+		p.parseWorkers(s.Stats, stat)
+	}
+
 	return stat, nil
 }
 
+// parseWorkers sets the stats of the busy workers from the rows of the extended status. The workers just spawned have
+// no requests, and are not counted.
+func (p PlackPlugin) parseWorkers(workers []PlackRequest, stat map[string]interface{}) {
+	methods := make(map[string]float64)
+	var aged, slow, total, maxAge float64
+	for _, w := range workers {
+		if w.Status != "A" || w.Method == "" {
+			continue
+		}
+		method := "other"
+		for _, m := range requestMethods {
+			if strings.EqualFold(w.Method, m) {
+				method = strings.ToLower(m)
+				break
+			}
+		}
+		methods[method]++
+
+		age, ok := requestAge(w.SS)
+		if !ok {
+			continue
+		}
+		aged++
+		total += age
+		if age > maxAge {
+			maxAge = age
+		}
+		if p.SlowThreshold > 0 && age >= p.SlowThreshold.Seconds() {
+			slow++
+		}
+	}
+
+	for _, m := range requestMethods {
+		stat["busy_method_"+strings.ToLower(m)] = methods[strings.ToLower(m)]
+	}
+	stat["busy_method_other"] = methods["other"]
+	stat["slow_workers"] = slow
+	stat["request_age_max"] = maxAge
+	if aged > 0 {
+		stat["request_age_avg"] = total / aged
+	} else {
+		stat["request_age_avg"] = float64(0)
+	}
+}
+
+// requestAge returns the seconds of ss, which is a number or a string depending on the versions
+func requestAge(ss interface{}) (float64, bool) {
+	switch v := ss.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
 // GraphDefinition interface for mackerelplugin
 func (p PlackPlugin) GraphDefinition() map[string]mp.Graphs {
 	var graphdef = map[string]mp.Graphs{
@@ -139,11 +233,43 @@ func (p PlackPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "bytes_sent", Label: "Bytes Sent", Diff: true, Type: "uint64"},
 			},
 		},
+		(p.Prefix + ".slow_workers"): {
+			Label: p.LabelPrefix + " Slow Workers",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "slow_workers", Label: "Slow Workers", Diff: false},
+			},
+		},
+		(p.Prefix + ".request_age"): {
+			Label: p.LabelPrefix + " In-flight Request Age",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "request_age_max", Label: "Max (sec)", Diff: false},
+				{Name: "request_age_avg", Label: "Average (sec)", Diff: false},
+			},
+		},
+	}
+
+	var methodMetrics []mp.Metrics
+	for _, m := range append(requestMethods, "other") {
+		methodMetrics = append(methodMetrics, mp.Metrics{
+			Name: "busy_method_" + strings.ToLower(m), Label: m, Diff: false, Stacked: true,
+		})
+	}
+	graphdef[p.Prefix+".busy_methods"] = mp.Graphs{
+		Label:   p.LabelPrefix + " Busy Workers by Method",
+		Unit:    "integer",
+		Metrics: methodMetrics,
 	}
 
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the server status
+func (p PlackPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "plack", p.URI)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "", "URI")
@@ -154,9 +280,22 @@ func Do() {
 	optPrefix := flag.String("metric-key-prefix", "plack", "Prefix")
 	optLabelPrefix := flag.String("metric-label-prefix", "", "Label Prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optUser := flag.String("user", "", "User of the basic authentication")
+	optPassword := flag.String("password", "", "Password of the basic authentication (or $MACKEREL_PLUGIN_PLACK_PASSWORD)")
+	optTimeout := flag.Duration("timeout", 10*time.Second, "Timeout of fetching the server status")
+	optSlowThreshold := flag.Duration("slow-threshold", 30*time.Second, "Age of the in-flight requests of the slow workers")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_PLACK_PASSWORD")
 
-	plack := PlackPlugin{URI: *optURI, Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
+	plack := PlackPlugin{
+		URI:           *optURI,
+		Prefix:        *optPrefix,
+		LabelPrefix:   *optLabelPrefix,
+		User:          *optUser,
+		Password:      *optPassword,
+		SlowThreshold: *optSlowThreshold,
+		Client:        &http.Client{Timeout: *optTimeout},
+	}
 	if plack.URI == "" {
 		plack.URI = fmt.Sprintf("%s://%s:%s%s", *optScheme, *optHost, *optPort, *optPath)
 	}
@@ -165,7 +304,7 @@ func Do() {
 	}
 
 	helper := mp.NewMackerelPlugin(plack)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = plack.tempfile(*optTempfile)
 
 	helper.Run()
 }
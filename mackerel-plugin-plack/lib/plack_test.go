@@ -3,8 +3,11 @@ package mpplack
 import (
 	"bytes"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,8 +16,8 @@ func TestGraphDefinition(t *testing.T) {
 	var plack PlackPlugin
 
 	graphdef := plack.GraphDefinition()
-	if len(graphdef) != 3 {
-		t.Errorf("GetTempfilename: %d should be 3", len(graphdef))
+	if len(graphdef) != 6 {
+		t.Errorf("GetTempfilename: %d should be 6", len(graphdef))
 	}
 }
 
@@ -97,3 +100,60 @@ func TestParseWithInsufficientResponse(t *testing.T) {
 	assert.EqualValues(t, stat["requests"], uint(670))
 	assert.Nil(t, stat["idle_workers"])
 }
+
+func TestParseWorkers(t *testing.T) {
+	plack := PlackPlugin{SlowThreshold: 30 * time.Second}
+	stub := `{
+  "TotalAccesses": "100",
+  "IdleWorkers": "1",
+  "TotalKbytes": "5",
+  "BusyWorkers": "4",
+  "stats": [
+    {"pid": 11061, "method": "GET", "ss": 45, "remote_addr": "192.0.2.1", "status": "A", "uri": "/slow"},
+    {"pid": 11062, "method": "POST", "ss": "3", "remote_addr": "192.0.2.2", "status": "A", "uri": "/api"},
+    {"pid": 11063, "method": "PROPFIND", "ss": 0, "remote_addr": "192.0.2.3", "status": "A", "uri": "/dav"},
+    {"pid": 11064, "method": "GET", "ss": 120, "remote_addr": "192.0.2.4", "status": "_", "uri": "/done"},
+    {"pid": 11065, "method": "", "ss": 600, "remote_addr": "", "status": "A", "uri": ""}
+  ]
+}`
+
+	stat, err := plack.parseStats(bytes.NewBufferString(stub))
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, stat["slow_workers"])
+	assert.EqualValues(t, 45, stat["request_age_max"])
+	assert.EqualValues(t, 16, stat["request_age_avg"])
+	assert.EqualValues(t, 1, stat["busy_method_get"])
+	assert.EqualValues(t, 1, stat["busy_method_post"])
+	assert.EqualValues(t, 1, stat["busy_method_other"])
+	assert.EqualValues(t, 0, stat["busy_method_put"])
+}
+
+func TestFetchMetricsWithBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"TotalKbytes":"36","IdleWorkers":"2","BusyWorkers":"1","TotalAccesses":"670","stats":[]}`)
+	}))
+	defer ts.Close()
+
+	plack := PlackPlugin{URI: ts.URL + "/server-status?json"}
+	_, err := plack.FetchMetrics()
+	assert.NotNil(t, err)
+
+	plack.User, plack.Password = "admin", "secret"
+	stat, err := plack.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 2, stat["idle_workers"])
+}
+
+func TestTempfile(t *testing.T) {
+	p := PlackPlugin{URI: "http://localhost:5000/server-status?json"}
+	if other := (PlackPlugin{URI: "http://localhost:5001/server-status?json"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/plack.json"); f != "/tmp/plack.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,147 @@
+package mppostgres
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// connectionStates are the states of the client backends in pg_stat_activity, where waiting is active and waiting
+// for a lock or I/O
+var connectionStates = []string{
+	"active",
+	"waiting",
+	"idle",
+	"idle_in_transaction",
+	"idle_in_transaction_aborted",
+	"fastpath_function_call",
+	"disabled",
+}
+
+// connectionStateRe matches the spaces and the parentheses of the states, e.g. idle in transaction (aborted)
+var connectionStateRe = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+// connectionStatesQuery groups the backends into the states of the client backends, replication and autovacuum.
+// backend_type is added in PostgreSQL 10, and waiting is replaced with wait_event_type in 9.6.
+func connectionStatesQuery(version version) string {
+	switch {
+	case version.first >= 10:
+		return `SELECT CASE
+	WHEN backend_type = 'walsender' THEN 'replication'
+	WHEN backend_type = 'autovacuum worker' THEN 'autovacuum'
+	WHEN state = 'active' AND wait_event_type IS NOT NULL THEN 'waiting'
+	ELSE state END, count(*)
+FROM pg_stat_activity
+WHERE state IS NOT NULL AND backend_type IN ('client backend', 'walsender', 'autovacuum worker')
+GROUP BY 1`
+	case version.first == 9 && version.second >= 6:
+		return `SELECT CASE
+	WHEN query LIKE 'autovacuum:%' THEN 'autovacuum'
+	WHEN state = 'active' AND wait_event_type IS NOT NULL THEN 'waiting'
+	ELSE state END, count(*)
+FROM pg_stat_activity
+WHERE state IS NOT NULL
+GROUP BY 1`
+	default:
+		return `SELECT CASE
+	WHEN query LIKE 'autovacuum:%' THEN 'autovacuum'
+	WHEN state = 'active' AND waiting THEN 'waiting'
+	ELSE state END, count(*)
+FROM pg_stat_activity
+WHERE state IS NOT NULL
+GROUP BY 1`
+	}
+}
+
+// fetchConnectionStates returns the client backends of each state as state_<state>, the walsenders and
+// the autovacuum workers separately, with the percentage of the client backends in max_connections
+func fetchConnectionStates(ctx context.Context, db *sqlx.DB, version version) (map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, connectionStatesQuery(version))
+	if err != nil {
+		logger.Errorf("Failed to select the states of pg_stat_activity. %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	stat := map[string]interface{}{
+		"replication_backends": 0.0,
+		"autovacuum_workers":   0.0,
+	}
+	for _, state := range connectionStates {
+		stat["state_"+state] = 0.0
+	}
+
+	var clients float64
+	for rows.Next() {
+		var state string
+		var count float64
+		if err := rows.Scan(&state, &count); err != nil {
+			logger.Warningf("Failed to scan %s", err)
+			continue
+		}
+		switch state {
+		case "replication":
+			stat["replication_backends"] = count
+		case "autovacuum":
+			stat["autovacuum_workers"] = count
+		default:
+			state = strings.Trim(connectionStateRe.ReplaceAllString(state, "_"), "_")
+			stat["state_"+state] = count
+			clients += count
+		}
+	}
+
+	var maxConnections string
+	if err := db.QueryRowContext(ctx, "SHOW max_connections").Scan(&maxConnections); err != nil {
+		logger.Errorf("Failed to show max_connections. %s", err)
+		return nil, err
+	}
+	max, err := strconv.ParseFloat(maxConnections, 64)
+	if err != nil {
+		logger.Warningf("Failed to parse max_connections. %s", err)
+		return stat, nil
+	}
+	stat["max_connections"] = max
+	if max > 0 {
+		stat["percentage_of_connections"] = 100.0 * clients / max
+	}
+	return stat, nil
+}
+
+func connectionStatesGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"connections_state": {
+			Label: (labelPrefix + " Connections by State"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "state_active", Label: "Active", Diff: false, Stacked: true},
+				{Name: "state_waiting", Label: "Waiting", Diff: false, Stacked: true},
+				{Name: "state_idle", Label: "Idle", Diff: false, Stacked: true},
+				{Name: "state_idle_in_transaction", Label: "Idle in transaction", Diff: false, Stacked: true},
+				{Name: "state_idle_in_transaction_aborted", Label: "Idle in transaction (aborted)", Diff: false, Stacked: true},
+				{Name: "state_fastpath_function_call", Label: "fast-path function call", Diff: false, Stacked: true},
+				{Name: "state_disabled", Label: "Disabled", Diff: false, Stacked: true},
+				{Name: "max_connections", Label: "Max Connections", Diff: false, Stacked: false},
+			},
+		},
+		"connections_backend": {
+			Label: (labelPrefix + " Background Connections"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "replication_backends", Label: "Replication", Diff: false, Stacked: true},
+				{Name: "autovacuum_workers", Label: "Autovacuum Workers", Diff: false, Stacked: true},
+			},
+		},
+		"connections_capacity": {
+			Label: (labelPrefix + " Connections Capacity"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "percentage_of_connections", Label: "Percentage of connections", Diff: false, Stacked: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,61 @@
+package mppostgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/erikstmartin/go-testdb"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestFetchConnectionStates(t *testing.T) {
+	db, _ := sqlx.Connect("testdb", "")
+
+	testdb.StubQuery(connectionStatesQuery(version{10, 0, 0}), testdb.RowsFromCSVString([]string{"state", "count"}, `
+	active,3
+	waiting,2
+	idle,40
+	idle in transaction,4
+	idle in transaction (aborted),1
+	replication,2
+	autovacuum,1
+	`))
+	testdb.StubQuery(`SHOW max_connections`, testdb.RowsFromCSVString([]string{"max_connections"}, "100"))
+
+	stat, err := fetchConnectionStates(context.Background(), db, version{10, 0, 0})
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+	expected := map[string]interface{}{
+		"state_active":                      3.0,
+		"state_waiting":                     2.0,
+		"state_idle":                        40.0,
+		"state_idle_in_transaction":         4.0,
+		"state_idle_in_transaction_aborted": 1.0,
+		"state_fastpath_function_call":      0.0,
+		"state_disabled":                    0.0,
+		"replication_backends":              2.0,
+		"autovacuum_workers":                1.0,
+		"max_connections":                   100.0,
+		// the replication and the autovacuum are not counted in max_connections
+		"percentage_of_connections": 50.0,
+	}
+	for k, v := range expected {
+		if stat[k] != v {
+			t.Errorf("%s should be %v, but %v", k, v, stat[k])
+		}
+	}
+}
+
+func TestConnectionStatesQuery(t *testing.T) {
+	if connectionStatesQuery(version{9, 6, 0}) == connectionStatesQuery(version{9, 5, 0}) {
+		t.Error("the query for 9.5 should use waiting instead of wait_event_type")
+	}
+	if connectionStatesQuery(version{10, 0, 0}) == connectionStatesQuery(version{9, 6, 0}) {
+		t.Error("the query for 10 should use backend_type")
+	}
+}
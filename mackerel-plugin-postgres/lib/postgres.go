@@ -1,6 +1,8 @@
 package mppostgres
 
 import (
+	"context"
+	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,12 +10,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	// PostgreSQL Driver
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 var logger = logging.GetLogger("metrics.plugin.postgres")
@@ -25,36 +30,53 @@ type PostgresPlugin struct {
 	Username string
 	Password string
 	SSLmode  string
-	Prefix   string
-	Timeout  int
-	Tempfile string
-	Option   string
+	// SSLRootCert, SSLCert and SSLKey are the files of the CA and the client certificate for the TLS connection
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	Prefix      string
+	Timeout     int
+	Tempfile    string
+	Option      string
+
+	// PerDatabase posts pg_stat_database of each database in addition to the totals
+	PerDatabase bool
+	// ExcludeTemplateDatabases skips the template databases in the metrics of each database
+	ExcludeTemplateDatabases bool
+	// ExcludeDatabase skips the databases matching it in the metrics of each database
+	ExcludeDatabase *regexp.Regexp
+	// EnableVacuum posts the dead tuples and the age of the transaction IDs, whose queries are bounded by StatementTimeout
+	EnableVacuum     bool
+	StatementTimeout time.Duration
+
+	MaxExecutionTime time.Duration
 }
 
-func fetchStatDatabase(db *sqlx.DB) (map[string]interface{}, error) {
+// pgStat is the columns of pg_stat_database, some of which are missing in the old versions
+type pgStat struct {
+	XactCommit   uint64   `db:"xact_commit"`
+	XactRollback uint64   `db:"xact_rollback"`
+	BlksRead     uint64   `db:"blks_read"`
+	BlksHit      uint64   `db:"blks_hit"`
+	BlkReadTime  *float64 `db:"blk_read_time"`
+	BlkWriteTime *float64 `db:"blk_write_time"`
+	TupReturned  uint64   `db:"tup_returned"`
+	TupFetched   uint64   `db:"tup_fetched"`
+	TupInserted  uint64   `db:"tup_inserted"`
+	TupUpdated   uint64   `db:"tup_updated"`
+	TupDeleted   uint64   `db:"tup_deleted"`
+	Deadlocks    *uint64  `db:"deadlocks"`
+	TempBytes    *uint64  `db:"temp_bytes"`
+}
+
+func fetchStatDatabase(ctx context.Context, db *sqlx.DB) (map[string]interface{}, error) {
 	db = db.Unsafe()
-	rows, err := db.Queryx(`SELECT * FROM pg_stat_database`)
+	rows, err := db.QueryxContext(ctx, `SELECT * FROM pg_stat_database`)
 	if err != nil {
 		logger.Errorf("Failed to select pg_stat_database. %s", err)
 		return nil, err
 	}
 
-	type pgStat struct {
-		XactCommit   uint64   `db:"xact_commit"`
-		XactRollback uint64   `db:"xact_rollback"`
-		BlksRead     uint64   `db:"blks_read"`
-		BlksHit      uint64   `db:"blks_hit"`
-		BlkReadTime  *float64 `db:"blk_read_time"`
-		BlkWriteTime *float64 `db:"blk_write_time"`
-		TupReturned  uint64   `db:"tup_returned"`
-		TupFetched   uint64   `db:"tup_fetched"`
-		TupInserted  uint64   `db:"tup_inserted"`
-		TupUpdated   uint64   `db:"tup_updated"`
-		TupDeleted   uint64   `db:"tup_deleted"`
-		Deadlocks    *uint64  `db:"deadlocks"`
-		TempBytes    *uint64  `db:"temp_bytes"`
-	}
-
 	totalStat := pgStat{}
 	for rows.Next() {
 		p := pgStat{}
@@ -125,7 +147,56 @@ func fetchStatDatabase(db *sqlx.DB) (map[string]interface{}, error) {
 	return stat, nil
 }
 
-func fetchConnections(db *sqlx.DB, version version) (map[string]interface{}, error) {
+// metricNameRe matches the characters of the database names and the application names which cannot be used in the metric keys
+var metricNameRe = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// fetchStatPerDatabase returns pg_stat_database of each database as database.<datname>.*, skipping the shared objects
+// whose datname is NULL, the template databases if excludeTemplates and the databases matching exclude
+func fetchStatPerDatabase(ctx context.Context, db *sqlx.DB, excludeTemplates bool, exclude *regexp.Regexp) (map[string]interface{}, error) {
+	db = db.Unsafe()
+	rows, err := db.QueryxContext(ctx, `SELECT s.*, d.datistemplate FROM pg_stat_database s JOIN pg_database d ON s.datid = d.oid`)
+	if err != nil {
+		logger.Errorf("Failed to select pg_stat_database of each database. %s", err)
+		return nil, err
+	}
+
+	type pgStatPerDatabase struct {
+		Datname    *string `db:"datname"`
+		IsTemplate bool    `db:"datistemplate"`
+		pgStat
+	}
+
+	stat := make(map[string]interface{})
+	for rows.Next() {
+		p := pgStatPerDatabase{}
+		if err := rows.StructScan(&p); err != nil {
+			logger.Warningf("Failed to scan. %s", err)
+			continue
+		}
+		if p.Datname == nil || (excludeTemplates && p.IsTemplate) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(*p.Datname) {
+			continue
+		}
+		prefix := "database." + metricNameRe.ReplaceAllString(*p.Datname, "_") + "."
+		stat[prefix+"xact_commit"] = p.XactCommit
+		stat[prefix+"xact_rollback"] = p.XactRollback
+		stat[prefix+"blks_read"] = p.BlksRead
+		stat[prefix+"blks_hit"] = p.BlksHit
+		stat[prefix+"tup_returned"] = p.TupReturned
+		stat[prefix+"tup_fetched"] = p.TupFetched
+		stat[prefix+"tup_inserted"] = p.TupInserted
+		stat[prefix+"tup_updated"] = p.TupUpdated
+		stat[prefix+"tup_deleted"] = p.TupDeleted
+		if p.Deadlocks != nil {
+			stat[prefix+"deadlocks"] = *p.Deadlocks
+		}
+	}
+	return stat, nil
+}
+
+func fetchConnections(ctx context.Context, db *sqlx.DB, version version) (map[string]interface{}, error) {
 	var query string
 
 	if version.first > 9 || version.first == 9 && version.second >= 6 {
@@ -133,7 +204,7 @@ func fetchConnections(db *sqlx.DB, version version) (map[string]interface{}, err
 	} else {
 		query = `select count(*), state, waiting from pg_stat_activity group by state, waiting`
 	}
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		logger.Errorf("Failed to select pg_stat_activity. %s", err)
 		return nil, err
@@ -168,8 +239,8 @@ func fetchConnections(db *sqlx.DB, version version) (map[string]interface{}, err
 	return stat, nil
 }
 
-func fetchDatabaseSize(db *sqlx.DB) (map[string]interface{}, error) {
-	rows, err := db.Query("select sum(pg_database_size(datname)) as dbsize from pg_database where has_database_privilege(datname, 'connect')")
+func fetchDatabaseSize(ctx context.Context, db *sqlx.DB) (map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, "select sum(pg_database_size(datname)) as dbsize from pg_database where has_database_privilege(datname, 'connect')")
 	if err != nil {
 		logger.Errorf("Failed to select pg_database_size. %s", err)
 		return nil, err
@@ -198,11 +269,11 @@ type version struct {
 	third  uint
 }
 
-func fetchVersion(db *sqlx.DB) (version, error) {
+func fetchVersion(ctx context.Context, db *sqlx.DB) (version, error) {
 
 	res := version{}
 
-	rows, err := db.Query("select version()")
+	rows, err := db.QueryContext(ctx, "select version()")
 	if err != nil {
 		logger.Errorf("Failed to select version(). %s", err)
 		return res, err
@@ -240,6 +311,16 @@ func fetchVersion(db *sqlx.DB) (version, error) {
 	return res, errors.New("failed to select version()")
 }
 
+// skipFailure warns the failure of the optional metrics and skips them without failing the others,
+// and returns the error only if the deadline is exceeded
+func skipFailure(ctx context.Context, doing string, format string, err error) (map[string]interface{}, error) {
+	if derr := pluginutil.DeadlineExceeded(ctx, doing); derr != nil {
+		return nil, derr
+	}
+	logger.Warningf(format, err)
+	return map[string]interface{}{}, nil
+}
+
 func mergeStat(dst, src map[string]interface{}) {
 	for k, v := range src {
 		dst[k] = v
@@ -254,41 +335,119 @@ func (p PostgresPlugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
+// connectionString returns the connection string of lib/pq, with the certificates only if they are given
+func (p PostgresPlugin) connectionString() string {
+	conn := fmt.Sprintf("user=%s password=%s host=%s port=%s sslmode=%s connect_timeout=%d", p.Username, p.Password, p.Host, p.Port, p.SSLmode, p.Timeout)
+	for _, param := range []struct {
+		key   string
+		value string
+	}{
+		{"sslrootcert", p.SSLRootCert},
+		{"sslcert", p.SSLCert},
+		{"sslkey", p.SSLKey},
+	} {
+		if param.value != "" {
+			conn += " " + param.key + "=" + quoteConnectionValue(param.value)
+		}
+	}
+	if p.Option != "" {
+		conn += " " + p.Option
+	}
+	return conn
+}
+
+// quoteConnectionValue quotes the value in the connection string if it is empty or has spaces, quotes or backslashes
+func quoteConnectionValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n'\\") {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// describeConnectError tells the failures of the TLS and the authentication from the others, which lib/pq reports
+// as they are
+func (p PostgresPlugin) describeConnectError(err error) error {
+	if err == pq.ErrSSLNotSupported {
+		return fmt.Errorf("TLS is not enabled on the server, which is required by sslmode=%s: %s", p.SSLmode, err)
+	}
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError:
+		return fmt.Errorf("failed to verify the server certificate with sslmode=%s, which is not signed by -sslrootcert: %s", p.SSLmode, err)
+	case x509.HostnameError:
+		return fmt.Errorf("failed to verify the server certificate with sslmode=%s, which does not match the host: %s", p.SSLmode, err)
+	case x509.CertificateInvalidError:
+		return fmt.Errorf("failed to verify the server certificate with sslmode=%s: %s", p.SSLmode, err)
+	case *pq.Error:
+		if e.Code.Class() == "28" {
+			return fmt.Errorf("authentication failed with sslmode=%s (check pg_hba.conf, -sslcert and -sslkey): %s", p.SSLmode, err)
+		}
+	}
+	return err
+}
+
 // FetchMetrics interface for mackerelplugin
 func (p PostgresPlugin) FetchMetrics() (map[string]interface{}, error) {
+	ctx, cancel := pluginutil.WithMaxExecutionTime(p.MaxExecutionTime)
+	defer cancel()
 
-	db, err := sqlx.Connect("postgres", fmt.Sprintf("user=%s password=%s host=%s port=%s sslmode=%s connect_timeout=%d %s", p.Username, p.Password, p.Host, p.Port, p.SSLmode, p.Timeout, p.Option))
+	db, err := sqlx.ConnectContext(ctx, "postgres", p.connectionString())
 	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "connecting to PostgreSQL"); derr != nil {
+			err = derr
+		} else {
+			err = p.describeConnectError(err)
+		}
 		logger.Errorf("FetchMetrics: %s", err)
 		return nil, err
 	}
 	defer db.Close()
 
-	version, err := fetchVersion(db)
+	version, err := fetchVersion(ctx, db)
 	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "selecting version()"); derr != nil {
+			err = derr
+		}
 		logger.Warningf("FetchMetrics: %s", err)
 		return nil, err
 	}
 
-	statStatDatabase, err := fetchStatDatabase(db)
-	if err != nil {
-		return nil, err
+	type fetcher struct {
+		doing string
+		fetch func() (map[string]interface{}, error)
 	}
-	statConnections, err := fetchConnections(db, version)
-	if err != nil {
-		return nil, err
+	fetchers := []fetcher{
+		{"selecting pg_stat_database", func() (map[string]interface{}, error) { return fetchStatDatabase(ctx, db) }},
+		{"selecting pg_stat_activity", func() (map[string]interface{}, error) { return fetchConnections(ctx, db, version) }},
+		{"selecting the states of pg_stat_activity", func() (map[string]interface{}, error) { return fetchConnectionStates(ctx, db, version) }},
+		{"selecting pg_database_size", func() (map[string]interface{}, error) { return fetchDatabaseSize(ctx, db) }},
+		{"selecting the replication", func() (map[string]interface{}, error) { return fetchReplication(ctx, db, version) }},
 	}
-	statDatabaseSize, err := fetchDatabaseSize(db)
-	if err != nil {
-		return nil, err
+	if p.EnableVacuum {
+		fetchers = append(fetchers, fetcher{"selecting the vacuum statistics", func() (map[string]interface{}, error) {
+			return fetchVacuum(ctx, db, p.StatementTimeout)
+		}})
+	}
+	if p.PerDatabase {
+		fetchers = append(fetchers, fetcher{"selecting pg_stat_database of each database", func() (map[string]interface{}, error) {
+			return fetchStatPerDatabase(ctx, db, p.ExcludeTemplateDatabases, p.ExcludeDatabase)
+		}})
 	}
 
 	stat := make(map[string]interface{})
-	mergeStat(stat, statStatDatabase)
-	mergeStat(stat, statConnections)
-	mergeStat(stat, statDatabaseSize)
+	for _, f := range fetchers {
+		s, err := f.fetch()
+		if err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, f.doing); derr != nil {
+				// the metrics fetched before the deadline are posted
+				logger.Warningf("FetchMetrics: %s", derr)
+				return stat, nil
+			}
+			return nil, err
+		}
+		mergeStat(stat, s)
+	}
 
-	return stat, err
+	return stat, nil
 }
 
 // GraphDefinition interface for mackerelplugin
@@ -366,22 +525,66 @@ func (p PostgresPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+	for k, g := range connectionStatesGraphDefinition(labelPrefix) {
+		graphdef[k] = g
+	}
+	for k, g := range replicationGraphDefinition(labelPrefix) {
+		graphdef[k] = g
+	}
+	if p.EnableVacuum {
+		for k, g := range vacuumGraphDefinition(labelPrefix) {
+			graphdef[k] = g
+		}
+	}
+	if p.PerDatabase {
+		graphdef["database.#"] = mp.Graphs{
+			Label: (labelPrefix + " Database"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "xact_commit", Label: "Xact Commit", Diff: true, Stacked: false},
+				{Name: "xact_rollback", Label: "Xact Rollback", Diff: true, Stacked: false},
+				{Name: "blks_read", Label: "Blocks Read", Diff: true, Stacked: false},
+				{Name: "blks_hit", Label: "Blocks Hit", Diff: true, Stacked: false},
+				{Name: "tup_returned", Label: "Returned Rows", Diff: true, Stacked: false},
+				{Name: "tup_fetched", Label: "Fetched Rows", Diff: true, Stacked: false},
+				{Name: "tup_inserted", Label: "Inserted Rows", Diff: true, Stacked: false},
+				{Name: "tup_updated", Label: "Updated Rows", Diff: true, Stacked: false},
+				{Name: "tup_deleted", Label: "Deleted Rows", Diff: true, Stacked: false},
+				{Name: "deadlocks", Label: "Deadlocks", Diff: true, Stacked: false},
+			},
+		}
+	}
 
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host, the port and the database
+func (p PostgresPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "postgres", p.Host, p.Port, p.Option)
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("hostname", "localhost", "Hostname to login to")
 	optPort := flag.String("port", "5432", "Database port")
 	optUser := flag.String("user", "", "Postgres User")
 	optDatabase := flag.String("database", "", "Database name")
-	optPass := flag.String("password", "", "Postgres Password")
+	optPass := flag.String("password", "", "Postgres Password (or $MACKEREL_PLUGIN_POSTGRES_PASSWORD, $PGPASSWORD)")
 	optPrefix := flag.String("metric-key-prefix", "postgres", "Metric key prefix")
-	optSSLmode := flag.String("sslmode", "disable", "Whether or not to use SSL")
+	optSSLmode := flag.String("sslmode", "disable", "Whether or not to use SSL: disable, allow, prefer, require, verify-ca or verify-full")
+	optSSLRootCert := flag.String("sslrootcert", "", "CA certificate file to verify the server certificate")
+	optSSLCert := flag.String("sslcert", "", "Client certificate file")
+	optSSLKey := flag.String("sslkey", "", "Client private key file")
 	optConnectTimeout := flag.Int("connect_timeout", 5, "Maximum wait for connection, in seconds.")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPerDatabase := flag.Bool("per-database", false, "Post pg_stat_database of each database as database.<datname>.*")
+	optExcludeTemplates := flag.Bool("exclude-template-databases", true, "Skip the template databases in -per-database")
+	optExcludeDatabase := flag.String("exclude-database", "", "Skip the databases matching the regexp in -per-database")
+	optEnableVacuum := flag.Bool("enable-vacuum", false, "Enable the metrics of the dead tuples and the transaction ID wraparound")
+	optStatementTimeout := flag.Duration("statement-timeout", 10*time.Second, "statement_timeout of the queries of -enable-vacuum")
+	optMaxExecutionTime := pluginutil.MaxExecutionTimeFlag(flag.CommandLine)
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_POSTGRES_PASSWORD", "PGPASSWORD")
 
 	if *optUser == "" {
 		logger.Warningf("user is required")
@@ -393,6 +596,13 @@ func Do() {
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
+	switch *optSSLmode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		logger.Warningf("sslmode should be disable, allow, prefer, require, verify-ca or verify-full: %s", *optSSLmode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
 	option := ""
 	if *optDatabase != "" {
 		option = fmt.Sprintf("dbname=%s", *optDatabase)
@@ -405,11 +615,26 @@ func Do() {
 	postgres.Password = *optPass
 	postgres.Prefix = *optPrefix
 	postgres.SSLmode = *optSSLmode
+	postgres.SSLRootCert = *optSSLRootCert
+	postgres.SSLCert = *optSSLCert
+	postgres.SSLKey = *optSSLKey
 	postgres.Timeout = *optConnectTimeout
 	postgres.Option = option
+	postgres.PerDatabase = *optPerDatabase
+	postgres.EnableVacuum = *optEnableVacuum
+	postgres.StatementTimeout = *optStatementTimeout
+	postgres.ExcludeTemplateDatabases = *optExcludeTemplates
+	if *optExcludeDatabase != "" {
+		re, err := regexp.Compile(*optExcludeDatabase)
+		if err != nil {
+			logger.Warningf("-exclude-database is not a valid regexp. %s", err)
+			os.Exit(1)
+		}
+		postgres.ExcludeDatabase = re
+	}
+	postgres.MaxExecutionTime = *optMaxExecutionTime
 
 	helper := mp.NewMackerelPlugin(postgres)
-
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = postgres.tempfile(*optTempfile)
 	helper.Run()
 }
@@ -1,10 +1,16 @@
 package mppostgres
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/erikstmartin/go-testdb"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 func TestFetchStatDatabase(t *testing.T) {
@@ -18,7 +24,7 @@ func TestFetchStatDatabase(t *testing.T) {
 	10,20,30,40,50,60,70,80,90,100,110,120,130
 	`))
 
-	stat, err := fetchStatDatabase(db)
+	stat, err := fetchStatDatabase(context.Background(), db)
 
 	expected := map[string]interface{}{
 		"xact_commit":  uint64(11),
@@ -43,6 +49,54 @@ func TestFetchStatDatabase(t *testing.T) {
 	}
 }
 
+func TestFetchStatPerDatabase(t *testing.T) {
+	db, _ := sqlx.Connect("testdb", "")
+
+	columns := []string{"datid", "datname", "xact_commit", "xact_rollback", "blks_read", "blks_hit",
+		"tup_returned", "tup_fetched", "tup_inserted", "tup_updated", "tup_deleted", "deadlocks", "datistemplate"}
+
+	testdb.StubQuery(`SELECT s.*, d.datistemplate FROM pg_stat_database s JOIN pg_database d ON s.datid = d.oid`, testdb.RowsFromCSVString(columns, `
+	1,template1,1,2,3,4,5,6,7,8,9,10,true
+	16384,my.app,11,12,13,14,15,16,17,18,19,20,false
+	16385,app_test,21,22,23,24,25,26,27,28,29,30,false
+	`))
+
+	stat, err := fetchStatPerDatabase(context.Background(), db, true, regexp.MustCompile("_test$"))
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+	if stat["database.my_app.xact_commit"] != uint64(11) {
+		t.Errorf("database.my_app.xact_commit should be 11, but %v", stat["database.my_app.xact_commit"])
+	}
+	if stat["database.my_app.deadlocks"] != uint64(20) {
+		t.Errorf("database.my_app.deadlocks should be 20, but %v", stat["database.my_app.deadlocks"])
+	}
+	if _, ok := stat["database.template1.xact_commit"]; ok {
+		t.Error("the template databases should be skipped")
+	}
+	if _, ok := stat["database.app_test.xact_commit"]; ok {
+		t.Error("the databases matching the exclude regexp should be skipped")
+	}
+}
+
+func TestGraphDefinitionPerDatabase(t *testing.T) {
+	p := PostgresPlugin{}
+	if _, ok := p.GraphDefinition()["database.#"]; ok {
+		t.Error("database.# should not be defined without -per-database")
+	}
+	p.PerDatabase = true
+	if _, ok := p.GraphDefinition()["commits"]; !ok {
+		t.Error("the graphs of the totals should be kept")
+	}
+	if _, ok := p.GraphDefinition()["database.#"]; !ok {
+		t.Error("database.# should be defined with -per-database")
+	}
+}
+
 var fetchVersionTests = []struct {
 	response string
 	expected version
@@ -76,7 +130,7 @@ func TestFetchVersion(t *testing.T) {
 
 		testdb.StubQuery(`SELECT version()`, testdb.RowsFromCSVString(columns, tc.response, '|'))
 
-		v, err := fetchVersion(db)
+		v, err := fetchVersion(context.Background(), db)
 
 		if err != nil {
 			t.Errorf("Expected no error, but got %s instead", err)
@@ -95,3 +149,58 @@ func TestFetchVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestTempfile(t *testing.T) {
+	p := PostgresPlugin{Host: "localhost", Port: "5432"}
+	for field, other := range map[string]PostgresPlugin{
+		"Host":   {Host: "db.example.com", Port: "5432"},
+		"Port":   {Host: "localhost", Port: "5433"},
+		"Option": {Host: "localhost", Port: "5432", Option: "dbname=app"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/postgres.json"); f != "/tmp/postgres.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	p := PostgresPlugin{Host: "db.example.com", Port: "5432", Username: "mackerel", Password: "secret", SSLmode: "disable", Timeout: 5, Option: "dbname=app"}
+	if got := p.connectionString(); got != "user=mackerel password=secret host=db.example.com port=5432 sslmode=disable connect_timeout=5 dbname=app" {
+		t.Errorf("the connection string without the certificates should be as before: %s", got)
+	}
+
+	p.SSLmode = "verify-full"
+	p.SSLRootCert = "/etc/ssl/certs/ca bundle.pem"
+	p.SSLCert = "/etc/mackerel/client.crt"
+	p.SSLKey = "/etc/mackerel/client.key"
+	expected := "user=mackerel password=secret host=db.example.com port=5432 sslmode=verify-full connect_timeout=5 sslrootcert='/etc/ssl/certs/ca bundle.pem' sslcert=/etc/mackerel/client.crt sslkey=/etc/mackerel/client.key dbname=app"
+	if got := p.connectionString(); got != expected {
+		t.Errorf("connectionString() should be %s, but %s", expected, got)
+	}
+}
+
+func TestDescribeConnectError(t *testing.T) {
+	p := PostgresPlugin{SSLmode: "verify-full"}
+	tests := []struct {
+		err      error
+		contains string
+	}{
+		{x509.UnknownAuthorityError{}, "not signed by -sslrootcert"},
+		{x509.HostnameError{Certificate: &x509.Certificate{}, Host: "db.example.com"}, "does not match the host"},
+		{pq.ErrSSLNotSupported, "TLS is not enabled on the server"},
+		{&pq.Error{Code: "28000", Message: "no pg_hba.conf entry"}, "authentication failed"},
+	}
+	for _, tc := range tests {
+		if got := p.describeConnectError(tc.err).Error(); !strings.Contains(got, tc.contains) {
+			t.Errorf("the error should contain %q: %s", tc.contains, got)
+		}
+	}
+
+	err := errors.New("dial tcp: connection refused")
+	if p.describeConnectError(err) != err {
+		t.Error("the other errors should be returned as they are")
+	}
+}
@@ -0,0 +1,123 @@
+package mppostgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// replicationQueries are the queries of the replication, whose functions are renamed from xlog to wal in PostgreSQL 10
+type replicationQueries struct {
+	// replicas selects application_name, write_lag, flush_lag, replay_lag in seconds and the byte lag of the replay
+	replicas string
+	// replayDelay selects the seconds since the last transaction replayed by the standby, which is 0 while it has
+	// replayed all received
+	replayDelay string
+}
+
+var replicationQueriesV10 = replicationQueries{
+	replicas: `SELECT application_name,
+	EXTRACT(EPOCH FROM write_lag), EXTRACT(EPOCH FROM flush_lag), EXTRACT(EPOCH FROM replay_lag),
+	pg_wal_lsn_diff(pg_current_wal_lsn(), replay_lsn)
+FROM pg_stat_replication`,
+	replayDelay: `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`,
+}
+
+// replicationQueriesV9 has no lags in time, which are added to pg_stat_replication in PostgreSQL 10
+var replicationQueriesV9 = replicationQueries{
+	replicas: `SELECT application_name,
+	NULL, NULL, NULL,
+	pg_xlog_location_diff(pg_current_xlog_location(), replay_location)
+FROM pg_stat_replication`,
+	replayDelay: `SELECT CASE WHEN pg_last_xlog_receive_location() = pg_last_xlog_replay_location() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`,
+}
+
+// fetchReplication returns the lags of each replica as replication.<application_name>.* and
+// replication_bytes.<application_name>.* on the primary, and replay_delay of the replication_delay graph on the standby.
+// The failures are warned without failing the other metrics, since the functions may not be allowed for the user.
+func fetchReplication(ctx context.Context, db *sqlx.DB, version version) (map[string]interface{}, error) {
+	queries := replicationQueriesV10
+	if version.first < 10 {
+		queries = replicationQueriesV9
+	}
+
+	var inRecovery bool
+	if err := db.QueryRowContext(ctx, "select pg_is_in_recovery()").Scan(&inRecovery); err != nil {
+		return skipFailure(ctx, "selecting the replication", "Failed to select pg_is_in_recovery(). %s", err)
+	}
+
+	stat := make(map[string]interface{})
+	if inRecovery {
+		var delay float64
+		if err := db.QueryRowContext(ctx, queries.replayDelay).Scan(&delay); err != nil {
+			return skipFailure(ctx, "selecting the replication", "Failed to select the replay delay. %s", err)
+		}
+		stat["replay_delay"] = delay
+		return stat, nil
+	}
+
+	rows, err := db.QueryContext(ctx, queries.replicas)
+	if err != nil {
+		return skipFailure(ctx, "selecting the replication", "Failed to select pg_stat_replication. %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var writeLag, flushLag, replayLag, replayBytes sql.NullFloat64
+		if err := rows.Scan(&name, &writeLag, &flushLag, &replayLag, &replayBytes); err != nil {
+			logger.Warningf("Failed to scan %s", err)
+			continue
+		}
+		// the replicas of the same application_name (e.g. walreceiver by default) are posted as their worst lags
+		name = metricNameRe.ReplaceAllString(name, "_")
+		setMaxLag(stat, "replication."+name+".write_lag", writeLag)
+		setMaxLag(stat, "replication."+name+".flush_lag", flushLag)
+		setMaxLag(stat, "replication."+name+".replay_lag", replayLag)
+		setMaxLag(stat, "replication_bytes."+name+".replay_lag_bytes", replayBytes)
+	}
+	return stat, nil
+}
+
+// setMaxLag sets the lag if it is not NULL and greater than the one already set. The lags in time are NULL
+// while the replica has caught up with the idle primary, and the byte lag is NULL without the privileges.
+func setMaxLag(stat map[string]interface{}, key string, lag sql.NullFloat64) {
+	if !lag.Valid {
+		return
+	}
+	if v, ok := stat[key].(float64); ok && v >= lag.Float64 {
+		return
+	}
+	stat[key] = lag.Float64
+}
+
+func replicationGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"replication.#": {
+			Label: (labelPrefix + " Replication Lag"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "write_lag", Label: "Write Lag (sec)", Diff: false, Stacked: false},
+				{Name: "flush_lag", Label: "Flush Lag (sec)", Diff: false, Stacked: false},
+				{Name: "replay_lag", Label: "Replay Lag (sec)", Diff: false, Stacked: false},
+			},
+		},
+		"replication_bytes.#": {
+			Label: (labelPrefix + " Replication Lag Bytes"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "replay_lag_bytes", Label: "Replay Lag", Diff: false, Stacked: false},
+			},
+		},
+		"replication_delay": {
+			Label: (labelPrefix + " Replication Delay"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "replay_delay", Label: "Replay Delay (sec)", Diff: false, Stacked: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package mppostgres
+
+import (
+	"context"
+	"testing"
+
+	"github.com/erikstmartin/go-testdb"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestFetchReplicationPrimary(t *testing.T) {
+	db, _ := sqlx.Connect("testdb", "")
+
+	testdb.StubQuery(`select pg_is_in_recovery()`, testdb.RowsFromCSVString([]string{"pg_is_in_recovery"}, "false"))
+	testdb.StubQuery(replicationQueriesV10.replicas, testdb.RowsFromCSVString(
+		[]string{"application_name", "write_lag", "flush_lag", "replay_lag", "pg_wal_lsn_diff"}, `
+	standby1,0.001,0.002,0.003,1024
+	walreceiver,0.5,0.6,0.7,2048
+	walreceiver,1.5,1.6,1.7,512
+	`))
+
+	stat, err := fetchReplication(context.Background(), db, version{10, 0, 0})
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+	if stat["replication.standby1.replay_lag"] != 0.003 {
+		t.Errorf("replication.standby1.replay_lag should be 0.003, but %v", stat["replication.standby1.replay_lag"])
+	}
+	if stat["replication_bytes.standby1.replay_lag_bytes"] != 1024.0 {
+		t.Errorf("replication_bytes.standby1.replay_lag_bytes should be 1024, but %v", stat["replication_bytes.standby1.replay_lag_bytes"])
+	}
+	// the worst lags of the replicas of the same application_name
+	if stat["replication.walreceiver.write_lag"] != 1.5 {
+		t.Errorf("replication.walreceiver.write_lag should be 1.5, but %v", stat["replication.walreceiver.write_lag"])
+	}
+	if stat["replication_bytes.walreceiver.replay_lag_bytes"] != 2048.0 {
+		t.Errorf("replication_bytes.walreceiver.replay_lag_bytes should be 2048, but %v", stat["replication_bytes.walreceiver.replay_lag_bytes"])
+	}
+	if _, ok := stat["replay_delay"]; ok {
+		t.Error("replication_delay.replay_delay should not be posted by the primary")
+	}
+}
+
+func TestFetchReplicationStandby(t *testing.T) {
+	db, _ := sqlx.Connect("testdb", "")
+
+	testdb.StubQuery(`select pg_is_in_recovery()`, testdb.RowsFromCSVString([]string{"pg_is_in_recovery"}, "true"))
+	testdb.StubQuery(replicationQueriesV9.replayDelay, testdb.RowsFromCSVString([]string{"delay"}, "12.5"))
+
+	stat, err := fetchReplication(context.Background(), db, version{9, 6, 4})
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+	if stat["replay_delay"] != 12.5 {
+		t.Errorf("replication_delay.replay_delay should be 12.5, but %v", stat["replay_delay"])
+	}
+}
@@ -0,0 +1,88 @@
+package mppostgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// fetchVacuum returns the dead tuples of the tables in the database, and the age of the oldest transaction ID
+// with its percentage in autovacuum_freeze_max_age. The queries are run in a transaction with statement_timeout,
+// since they scan pg_stat_user_tables of the whole schema, and their failures are warned without failing the others.
+func fetchVacuum(ctx context.Context, db *sqlx.DB, statementTimeout time.Duration) (map[string]interface{}, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return skipFailure(ctx, "selecting the vacuum statistics", "Failed to begin the transaction. %s", err)
+	}
+	// the transaction only reads the statistics
+	defer tx.Rollback()
+
+	if statementTimeout > 0 {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", statementTimeout/time.Millisecond)); err != nil {
+			return skipFailure(ctx, "selecting the vacuum statistics", "Failed to set statement_timeout. %s", err)
+		}
+	}
+
+	var deadTuples, liveTuples float64
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(sum(n_dead_tup), 0), COALESCE(sum(n_live_tup), 0) FROM pg_stat_user_tables").Scan(&deadTuples, &liveTuples); err != nil {
+		return skipFailure(ctx, "selecting the vacuum statistics", "Failed to select pg_stat_user_tables. %s", err)
+	}
+
+	var xidAge float64
+	if err := tx.QueryRowContext(ctx, "SELECT max(age(datfrozenxid)) FROM pg_database").Scan(&xidAge); err != nil {
+		return skipFailure(ctx, "selecting the vacuum statistics", "Failed to select the age of datfrozenxid. %s", err)
+	}
+
+	stat := map[string]interface{}{
+		"dead_tuples": deadTuples,
+		"live_tuples": liveTuples,
+		"xid_age":     xidAge,
+	}
+
+	var freezeMaxAge string
+	if err := tx.QueryRowContext(ctx, "SHOW autovacuum_freeze_max_age").Scan(&freezeMaxAge); err != nil {
+		return skipFailure(ctx, "selecting the vacuum statistics", "Failed to show autovacuum_freeze_max_age. %s", err)
+	}
+	max, err := strconv.ParseFloat(freezeMaxAge, 64)
+	if err != nil {
+		logger.Warningf("Failed to parse autovacuum_freeze_max_age. %s", err)
+		return stat, nil
+	}
+	stat["autovacuum_freeze_max_age"] = max
+	if max > 0 {
+		stat["percentage_of_freeze_max_age"] = 100.0 * xidAge / max
+	}
+	return stat, nil
+}
+
+func vacuumGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"tuples": {
+			Label: (labelPrefix + " Tuples"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "dead_tuples", Label: "Dead Tuples", Diff: false, Stacked: false},
+				{Name: "live_tuples", Label: "Live Tuples", Diff: false, Stacked: false},
+			},
+		},
+		"xid_age": {
+			Label: (labelPrefix + " Transaction ID Age"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "xid_age", Label: "Oldest datfrozenxid Age", Diff: false, Stacked: false},
+				{Name: "autovacuum_freeze_max_age", Label: "autovacuum_freeze_max_age", Diff: false, Stacked: false},
+			},
+		},
+		"wraparound": {
+			Label: (labelPrefix + " Transaction ID Wraparound"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "percentage_of_freeze_max_age", Label: "Percentage of autovacuum_freeze_max_age", Diff: false, Stacked: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,52 @@
+package mppostgres
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/erikstmartin/go-testdb"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestFetchVacuum(t *testing.T) {
+	db, _ := sqlx.Connect("testdb", "")
+
+	testdb.StubExec(`SET LOCAL statement_timeout = 5000`, testdb.NewResult(0, nil, 0, nil))
+	testdb.StubQuery(`SELECT COALESCE(sum(n_dead_tup), 0), COALESCE(sum(n_live_tup), 0) FROM pg_stat_user_tables`,
+		testdb.RowsFromCSVString([]string{"dead", "live"}, "1200,56000"))
+	testdb.StubQuery(`SELECT max(age(datfrozenxid)) FROM pg_database`, testdb.RowsFromCSVString([]string{"max"}, "50000000"))
+	testdb.StubQuery(`SHOW autovacuum_freeze_max_age`, testdb.RowsFromCSVString([]string{"autovacuum_freeze_max_age"}, "200000000"))
+
+	stat, err := fetchVacuum(context.Background(), db, 5*time.Second)
+
+	if err != nil {
+		t.Errorf("Expected no error, but got %s instead", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Error '%s' was not expected while closing the database", err)
+	}
+	expected := map[string]interface{}{
+		"dead_tuples":                  1200.0,
+		"live_tuples":                  56000.0,
+		"xid_age":                      50000000.0,
+		"autovacuum_freeze_max_age":    200000000.0,
+		"percentage_of_freeze_max_age": 25.0,
+	}
+	for k, v := range expected {
+		if stat[k] != v {
+			t.Errorf("%s should be %v, but %v", k, v, stat[k])
+		}
+	}
+}
+
+func TestGraphDefinitionEnableVacuum(t *testing.T) {
+	p := PostgresPlugin{}
+	if _, ok := p.GraphDefinition()["wraparound"]; ok {
+		t.Error("wraparound should not be defined without -enable-vacuum")
+	}
+	p.EnableVacuum = true
+	if _, ok := p.GraphDefinition()["wraparound"]; !ok {
+		t.Error("wraparound should be defined with -enable-vacuum")
+	}
+}
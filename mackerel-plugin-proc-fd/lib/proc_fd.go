@@ -3,8 +3,10 @@ package mpprocfd
 import (
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"regexp"
+	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
@@ -17,10 +19,15 @@ type ProcfdPlugin struct {
 	Process           string
 	NormalizedProcess string
 	MetricName        string
+	// Patterns are given by -process name=pattern, whose processes are read from procfs
+	Patterns []ProcessPattern
 }
 
 // FetchMetrics fetch the metrics
 func (p ProcfdPlugin) FetchMetrics() (map[string]interface{}, error) {
+	if len(p.Patterns) > 0 {
+		return fetchPatternMetrics(p.Patterns)
+	}
 	fds, err := openFd.getNumOpenFileDesc()
 	if err != nil {
 		return nil, err
@@ -42,6 +49,19 @@ func (p ProcfdPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 // GraphDefinition Graph definition
 func (p ProcfdPlugin) GraphDefinition() map[string]mp.Graphs {
+	if len(p.Patterns) > 0 {
+		return map[string]mp.Graphs{
+			"fd.#": {
+				Label: "Opening fd",
+				Unit:  "integer",
+				Metrics: []mp.Metrics{
+					{Name: "count", Label: "Total", Diff: false, Type: "uint64"},
+					{Name: "max_per_process", Label: "Maximum per process", Diff: false, Type: "uint64"},
+					{Name: "max_usage", Label: "Maximum usage of the soft limit (%)", Diff: false},
+				},
+			},
+		}
+	}
 	return map[string]mp.Graphs{
 		fmt.Sprintf("proc-fd.%s", p.NormalizedProcess): {
 			Label: fmt.Sprintf("Opening fd by %s", p.NormalizedProcess),
@@ -60,22 +80,44 @@ func normalizeForMetricName(process string) string {
 	return re.ReplaceAllString(process, "_")
 }
 
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringSlice) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
 // Do the plugin
 func Do() {
-	optProcess := flag.String("process", "", "Process name")
+	var optProcesses stringSlice
+	flag.Var(&optProcesses, "process", "Process name, or name=pattern (can be specified multiple times)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	flag.Parse()
 
-	if *optProcess == "" {
+	if len(optProcesses) == 0 || optProcesses[0] == "" {
 		logger.Warningf("Process name is required")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
 	var fd ProcfdPlugin
-	fd.Process = *optProcess
-	openFd = RealOpenFd{fd.Process}
-	fd.NormalizedProcess = normalizeForMetricName(*optProcess)
+	if len(optProcesses) == 1 && !strings.Contains(optProcesses[0], "=") {
+		fd.Process = optProcesses[0]
+		openFd = RealOpenFd{fd.Process}
+		fd.NormalizedProcess = normalizeForMetricName(fd.Process)
+	} else {
+		for _, v := range optProcesses {
+			pattern, err := parseProcessPattern(v)
+			if err != nil {
+				log.Fatalf("Invalid -process: %s", err)
+			}
+			fd.Patterns = append(fd.Patterns, pattern)
+		}
+	}
 
 	helper := mp.NewMackerelPlugin(fd)
 	helper.Tempfile = *optTempfile
@@ -0,0 +1,146 @@
+package mpprocfd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// procRoot is the mount point of procfs, replaced in tests
+var procRoot = "/proc"
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// ProcessPattern is a set of processes whose fds are posted as fd.<Name>.*
+type ProcessPattern struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// parseProcessPattern parses `name=pattern` of -process
+func parseProcessPattern(s string) (ProcessPattern, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return ProcessPattern{}, fmt.Errorf("should be in the form of name=pattern: %s", s)
+	}
+	re, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return ProcessPattern{}, err
+	}
+	return ProcessPattern{Name: invalidKeyRe.ReplaceAllString(s[:i], "_"), Pattern: re}, nil
+}
+
+// findPids returns the pids whose command lines match the pattern, except the plugin itself
+func findPids(pattern *regexp.Regexp) ([]string, error) {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	self := strconv.Itoa(os.Getpid())
+	var pids []string
+	for _, e := range entries {
+		pid := e.Name()
+		if _, err := strconv.Atoi(pid); err != nil || pid == self {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procRoot, pid, "cmdline"))
+		if err != nil {
+			// the process has exited
+			continue
+		}
+		if pattern.Match(bytes.TrimSpace(bytes.Replace(cmdline, []byte{0}, []byte{' '}, -1))) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// countFds returns the number of the open fds of the process
+func countFds(pid string) (uint64, error) {
+	fds, err := ioutil.ReadDir(filepath.Join(procRoot, pid, "fd"))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(fds)), nil
+}
+
+// softLimit returns the soft limit of the open files of the process, or 0 if unlimited
+func softLimit(pid string) (uint64, error) {
+	f, err := os.Open(filepath.Join(procRoot, pid, "limits"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) == 0 || fields[0] == "unlimited" {
+			return 0, nil
+		}
+		return strconv.ParseUint(fields[0], 10, 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// fetchPatternMetrics returns the sum and the max of the open fds, and the max usage against the soft limit of the
+// processes per pattern. The patterns matching no processes are not posted.
+func fetchPatternMetrics(patterns []ProcessPattern) (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+	for _, p := range patterns {
+		pids, err := findPids(p.Pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		var count, maxFd uint64
+		var maxUsage float64
+		found := false
+		for _, pid := range pids {
+			n, err := countFds(pid)
+			if err != nil {
+				// the process has exited during the scan
+				if os.IsNotExist(err) {
+					continue
+				}
+				// the fds of the processes of the other users are not readable unless the plugin runs as root
+				if os.IsPermission(err) {
+					logger.Debugf("Cannot read the fds of %s matching %s: %s", pid, p.Name, err)
+					continue
+				}
+				return nil, err
+			}
+			found = true
+			count += n
+			if n > maxFd {
+				maxFd = n
+			}
+			if limit, err := softLimit(pid); err == nil && limit > 0 {
+				if usage := float64(n) / float64(limit) * 100; usage > maxUsage {
+					maxUsage = usage
+				}
+			}
+		}
+		if !found {
+			logger.Debugf("No processes match %s: %s", p.Name, p.Pattern)
+			continue
+		}
+		stat["fd."+p.Name+".count"] = count
+		stat["fd."+p.Name+".max_per_process"] = maxFd
+		stat["fd."+p.Name+".max_usage"] = maxUsage
+	}
+	return stat, nil
+}
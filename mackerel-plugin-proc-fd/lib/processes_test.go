@@ -0,0 +1,127 @@
+package mpprocfd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+const testLimits = `Limit                     Soft Limit           Hard Limit           Units
+Max cpu time              unlimited            unlimited            seconds
+Max open files            1024                 4096                 files
+Max locked memory         65536                65536                bytes
+`
+
+func writeProcess(t *testing.T, root, pid, cmdline string, fds int) {
+	dir := filepath.Join(root, pid)
+	if err := os.MkdirAll(filepath.Join(dir, "fd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "limits"), []byte(testLimits), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < fds; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, "fd", string(rune('a'+i))), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseProcessPattern(t *testing.T) {
+	p, err := parseProcessPattern("my.app=^/usr/bin/app( |$)")
+	if err != nil {
+		t.Fatalf("parseProcessPattern: %s", err)
+	}
+	if p.Name != "my_app" || p.Pattern.String() != "^/usr/bin/app( |$)" {
+		t.Errorf("parseProcessPattern: unexpected %v", p)
+	}
+
+	for _, s := range []string{"nginx", "=nginx", "nginx=("} {
+		if _, err := parseProcessPattern(s); err == nil {
+			t.Errorf("parseProcessPattern(%q) should fail", s)
+		}
+	}
+}
+
+func TestFetchPatternMetrics(t *testing.T) {
+	root, err := ioutil.TempDir("", "mackerel-plugin-proc-fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(orig string) { procRoot = orig }(procRoot)
+	procRoot = root
+
+	writeProcess(t, root, "100", "nginx: master process /usr/sbin/nginx\x00", 4)
+	writeProcess(t, root, "101", "nginx: worker process\x00", 8)
+	writeProcess(t, root, "200", "/usr/bin/ruby\x00/usr/bin/fluentd\x00", 2)
+	// the process has exited after its cmdline was read
+	os.MkdirAll(filepath.Join(root, "102"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "102", "cmdline"), []byte("nginx: worker process\x00"), 0644)
+
+	p := ProcfdPlugin{Patterns: []ProcessPattern{
+		{Name: "nginx", Pattern: regexp.MustCompile(`^nginx: `)},
+		{Name: "fluentd", Pattern: regexp.MustCompile(`fluentd`)},
+		{Name: "app", Pattern: regexp.MustCompile(`^/usr/bin/app`)},
+	}}
+	stat, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"fd.nginx.count":             uint64(12),
+		"fd.nginx.max_per_process":   uint64(8),
+		"fd.nginx.max_usage":         8.0 / 1024 * 100,
+		"fd.fluentd.count":           uint64(2),
+		"fd.fluentd.max_per_process": uint64(2),
+		"fd.fluentd.max_usage":       2.0 / 1024 * 100,
+	}
+	if len(stat) != len(expected) {
+		t.Errorf("FetchMetrics: %d metrics should be %d: %v", len(stat), len(expected), stat)
+	}
+	for k, v := range expected {
+		if stat[k] != v {
+			t.Errorf("FetchMetrics: %s should be %v, but %v", k, v, stat[k])
+		}
+	}
+
+	if graph := p.GraphDefinition(); len(graph["fd.#"].Metrics) != 3 {
+		t.Errorf("GraphDefinition(): fd.# should have 3 metrics")
+	}
+}
+
+func TestFetchPatternMetricsPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("the fds are always readable by root")
+	}
+	root, err := ioutil.TempDir("", "mackerel-plugin-proc-fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(orig string) { procRoot = orig }(procRoot)
+	procRoot = root
+
+	writeProcess(t, root, "100", "nginx: master process /usr/sbin/nginx\x00", 4)
+	writeProcess(t, root, "101", "nginx: worker process\x00", 8)
+	// the process of another user
+	fd := filepath.Join(root, "100", "fd")
+	if err := os.Chmod(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(fd, 0755)
+
+	stat, err := fetchPatternMetrics([]ProcessPattern{{Name: "nginx", Pattern: regexp.MustCompile(`^nginx: `)}})
+	if err != nil {
+		t.Fatalf("fetchPatternMetrics: %s", err)
+	}
+	if stat["fd.nginx.count"] != uint64(8) {
+		t.Errorf("fetchPatternMetrics: fd.nginx.count should be 8, but %v", stat["fd.nginx.count"])
+	}
+}
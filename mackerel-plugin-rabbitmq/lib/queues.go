@@ -0,0 +1,192 @@
+package mprabbitmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// queuesPageSize is the number of queues per page of /api/queues
+const queuesPageSize = 500
+
+var queuesClient = &http.Client{Timeout: 30 * time.Second}
+
+type rateDetails struct {
+	Rate float64 `json:"rate"`
+}
+
+// queueInfo is a queue of /api/queues, see https://www.rabbitmq.com/docs/http-api-reference
+type queueInfo struct {
+	Name                   string `json:"name"`
+	Vhost                  string `json:"vhost"`
+	MessagesReady          int64  `json:"messages_ready"`
+	MessagesUnacknowledged int64  `json:"messages_unacknowledged"`
+	Consumers              int64  `json:"consumers"`
+	// MessageStats is absent until the queue has any traffic
+	MessageStats *struct {
+		PublishDetails    *rateDetails `json:"publish_details"`
+		DeliverGetDetails *rateDetails `json:"deliver_get_details"`
+		AckDetails        *rateDetails `json:"ack_details"`
+	} `json:"message_stats"`
+}
+
+type queuesPage struct {
+	Items     []queueInfo `json:"items"`
+	Page      int         `json:"page"`
+	PageCount int         `json:"page_count"`
+}
+
+// QueueFilter selects the queues posted per queue
+type QueueFilter struct {
+	Vhost   string
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+}
+
+func (f QueueFilter) match(q queueInfo) bool {
+	if f.Vhost != "" && q.Vhost != f.Vhost {
+		return false
+	}
+	if f.Include != nil && !f.Include.MatchString(q.Name) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(q.Name) {
+		return false
+	}
+	return true
+}
+
+// queuesURL returns the URL of the page of /api/queues. The include regexp is also applied by the API to keep the
+// response small.
+func (r RabbitMQPlugin) queuesURL(page int) string {
+	path := "/api/queues"
+	if r.Queues.Vhost != "" {
+		path += "/" + url.PathEscape(r.Queues.Vhost)
+	}
+	params := url.Values{}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("page_size", strconv.Itoa(queuesPageSize))
+	params.Set("columns", "name,vhost,messages_ready,messages_unacknowledged,consumers,message_stats")
+	if r.Queues.Include != nil {
+		params.Set("name", r.Queues.Include.String())
+		params.Set("use_regex", "true")
+	}
+	return strings.TrimRight(r.URI, "/") + path + "?" + params.Encode()
+}
+
+// fetchQueues fetches all the pages of /api/queues
+func (r RabbitMQPlugin) fetchQueues() ([]queueInfo, error) {
+	var queues []queueInfo
+	for page := 1; ; page++ {
+		req, err := http.NewRequest("GET", r.queuesURL(page), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(r.User, r.Password)
+		resp, err := queuesClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch queues: %s", resp.Status)
+		}
+
+		// RabbitMQ before 3.6 ignores the pagination and returns all the queues
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			var all []queueInfo
+			if err := json.Unmarshal(body, &all); err != nil {
+				return nil, err
+			}
+			return append(queues, all...), nil
+		}
+		var p queuesPage
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		queues = append(queues, p.Items...)
+		if page >= p.PageCount {
+			return queues, nil
+		}
+	}
+}
+
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// queueKey returns the key of the queue in the metric names. The vhost is prepended unless it is the default one or
+// only one vhost is monitored.
+func (r RabbitMQPlugin) queueKey(q queueInfo) string {
+	name := q.Name
+	if r.Queues.Vhost == "" && q.Vhost != "/" {
+		name = q.Vhost + "_" + name
+	}
+	return invalidKeyRe.ReplaceAllString(name, "_")
+}
+
+// parseQueues returns the metrics of the queues matching the filter
+func (r RabbitMQPlugin) parseQueues(queues []queueInfo) map[string]interface{} {
+	stat := make(map[string]interface{})
+	for _, q := range queues {
+		if !r.Queues.match(q) {
+			continue
+		}
+		key := r.queueKey(q)
+		stat["queue_messages."+key+".ready"] = float64(q.MessagesReady)
+		stat["queue_messages."+key+".unacknowledged"] = float64(q.MessagesUnacknowledged)
+		stat["queue_consumers."+key+".consumers"] = float64(q.Consumers)
+		if s := q.MessageStats; s != nil {
+			for name, d := range map[string]*rateDetails{
+				"publish":     s.PublishDetails,
+				"deliver_get": s.DeliverGetDetails,
+				"ack":         s.AckDetails,
+			} {
+				if d != nil {
+					stat["queue_rates."+key+"."+name] = d.Rate
+				}
+			}
+		}
+	}
+	return stat
+}
+
+func (r RabbitMQPlugin) queueGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"queue_messages.#": {
+			Label: labelPrefix + " Queue Messages",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ready", Label: "Ready"},
+				{Name: "unacknowledged", Label: "Unacknowledged"},
+			},
+		},
+		"queue_consumers.#": {
+			Label: labelPrefix + " Queue Consumers",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "consumers", Label: "Consumers"},
+			},
+		},
+		"queue_rates.#": {
+			Label: labelPrefix + " Queue Message Rates",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "publish", Label: "Publish"},
+				{Name: "deliver_get", Label: "Deliver and Get"},
+				{Name: "ack", Label: "Ack"},
+			},
+		},
+	}
+}
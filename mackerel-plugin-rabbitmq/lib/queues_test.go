@@ -0,0 +1,79 @@
+package mprabbitmq
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchQueues(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.URL.RequestURI())
+		if user, pass, _ := req.BasicAuth(); user != "guest" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page := req.URL.Query().Get("page")
+		fmt.Fprintf(w, `{"items":[{"name":"orders.%s","vhost":"/","messages_ready":%s}],"page":%s,"page_count":2}`, page, page, page)
+	}))
+	defer ts.Close()
+
+	r := RabbitMQPlugin{URI: ts.URL + "/", User: "guest", Password: "secret"}
+	r.Queues.Vhost = "/"
+	r.Queues.Include = regexp.MustCompile(`^orders\.`)
+	queues, err := r.fetchQueues()
+	assert.Nil(t, err)
+	assert.Len(t, queues, 2)
+	assert.Equal(t, "orders.2", queues[1].Name)
+	assert.Len(t, requests, 2)
+	assert.Contains(t, requests[0], "/api/queues/%2F?")
+	assert.Contains(t, requests[0], "use_regex=true")
+
+	r.Password = "wrong"
+	_, err = r.fetchQueues()
+	assert.NotNil(t, err)
+}
+
+func TestFetchQueuesWithoutPagination(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `[{"name":"a","vhost":"/"},{"name":"b","vhost":"/"}]`)
+	}))
+	defer ts.Close()
+
+	r := RabbitMQPlugin{URI: ts.URL}
+	queues, err := r.fetchQueues()
+	assert.Nil(t, err)
+	assert.Len(t, queues, 2)
+}
+
+func TestParseQueues(t *testing.T) {
+	queues := []queueInfo{
+		{Name: "orders.created", Vhost: "/", MessagesReady: 10, MessagesUnacknowledged: 2, Consumers: 3},
+		{Name: "amq.gen-abc", Vhost: "/", MessagesReady: 1},
+		{Name: "mail/outbox", Vhost: "staging", MessagesReady: 4},
+	}
+	queues[0].MessageStats = &struct {
+		PublishDetails    *rateDetails `json:"publish_details"`
+		DeliverGetDetails *rateDetails `json:"deliver_get_details"`
+		AckDetails        *rateDetails `json:"ack_details"`
+	}{PublishDetails: &rateDetails{Rate: 1.5}}
+
+	r := RabbitMQPlugin{PerQueue: true}
+	r.Queues.Exclude = regexp.MustCompile(`^amq\.gen-`)
+	assert.Equal(t, map[string]interface{}{
+		"queue_messages.orders_created.ready":               10.0,
+		"queue_messages.orders_created.unacknowledged":      2.0,
+		"queue_consumers.orders_created.consumers":          3.0,
+		"queue_rates.orders_created.publish":                1.5,
+		"queue_messages.staging_mail_outbox.ready":          4.0,
+		"queue_messages.staging_mail_outbox.unacknowledged": 0.0,
+		"queue_consumers.staging_mail_outbox.consumers":     0.0,
+	}, r.parseQueues(queues))
+
+	assert.Len(t, r.GraphDefinition(), 5)
+}
@@ -2,36 +2,27 @@ package mprabbitmq
 
 import (
 	"flag"
+	"log"
+	"regexp"
+	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 	"github.com/michaelklishin/rabbit-hole"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"rabbitmq.queue": {
-		Label: "RabbitMQ Queue",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "messages", Label: "Total", Diff: false},
-			{Name: "ready", Label: "Ready", Diff: false},
-			{Name: "unacknowledged", Label: "Unacknowledged", Diff: false},
-		},
-	},
-	"rabbitmq.message": {
-		Label: "RabbitMQ Message",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "publish", Label: "Publish", Diff: false},
-		},
-	},
-}
-
 // RabbitMQPlugin metrics
 type RabbitMQPlugin struct {
-	URI      string
-	User     string
-	Password string
-	TempFile string
+	URI         string
+	User        string
+	Password    string
+	TempFile    string
+	Prefix      string
+	LabelPrefix string
+	// PerQueue posts the metrics of the queues matching Queues per queue
+	PerQueue bool
+	Queues   QueueFilter
 }
 
 // FetchMetrics interface for mackerelplugin
@@ -45,7 +36,18 @@ func (r RabbitMQPlugin) FetchMetrics() (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	return r.parseStats(*res)
+	stat, err := r.parseStats(*res)
+	if err != nil || !r.PerQueue {
+		return stat, err
+	}
+	queues, err := r.fetchQueues()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.parseQueues(queues) {
+		stat[k] = v
+	}
+	return stat, nil
 }
 
 func (r RabbitMQPlugin) parseStats(res rabbithole.Overview) (map[string]interface{}, error) {
@@ -60,25 +62,99 @@ func (r RabbitMQPlugin) parseStats(res rabbithole.Overview) (map[string]interfac
 
 }
 
-// GraphDefinition interface for mackerel plugin
+// MetricKeyPrefix interface for PluginWithPrefix
+func (r RabbitMQPlugin) MetricKeyPrefix() string {
+	if r.Prefix == "" {
+		r.Prefix = "rabbitmq"
+	}
+	return r.Prefix
+}
+
+// labelPrefix returns the prefix of the graph labels, which is RabbitMQ unless the metric key prefix is changed
+func (r RabbitMQPlugin) labelPrefix() string {
+	if r.LabelPrefix != "" {
+		return r.LabelPrefix
+	}
+	if r.MetricKeyPrefix() == "rabbitmq" {
+		return "RabbitMQ"
+	}
+	return strings.Title(r.MetricKeyPrefix())
+}
+
+// GraphDefinition interface for mackerelplugin
 func (r RabbitMQPlugin) GraphDefinition() map[string]mp.Graphs {
+	labelPrefix := r.labelPrefix()
+
+	graphdef := map[string]mp.Graphs{
+		"queue": {
+			Label: labelPrefix + " Queue",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "messages", Label: "Total", Diff: false},
+				{Name: "ready", Label: "Ready", Diff: false},
+				{Name: "unacknowledged", Label: "Unacknowledged", Diff: false},
+			},
+		},
+		"message": {
+			Label: labelPrefix + " Message",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "publish", Label: "Publish", Diff: false},
+			},
+		},
+	}
+	if r.PerQueue {
+		for k, g := range r.queueGraphDefinition(labelPrefix) {
+			graphdef[k] = g
+		}
+	}
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the management API
+func (r RabbitMQPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "rabbitmq", r.URI)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "http://localhost:15672", "URI")
 	optUser := flag.String("user", "guest", "User")
-	optPass := flag.String("password", "guest", "Password")
+	optPass := flag.String("password", "guest", "Password (or $MACKEREL_PLUGIN_RABBITMQ_PASSWORD)")
+	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "rabbitmq", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: RabbitMQ, or the metric key prefix in title case if it is changed)")
+	optPerQueue := flag.Bool("per-queue", false, "Post the metrics per queue")
+	optVhost := flag.String("vhost", "", "Post the metrics of the queues in the vhost only (implies -per-queue)")
+	optIncludeQueue := flag.String("include-queue", "", "Regexp of the names of the queues posted per queue (implies -per-queue)")
+	optExcludeQueue := flag.String("exclude-queue", "", "Regexp of the names of the queues not posted per queue (implies -per-queue)")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_RABBITMQ_PASSWORD")
 
-	var rabbitmq RabbitMQPlugin
+	rabbitmq := RabbitMQPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
 
 	rabbitmq.URI = *optURI
 	rabbitmq.User = *optUser
 	rabbitmq.Password = *optPass
+	rabbitmq.PerQueue = *optPerQueue || *optVhost != "" || *optIncludeQueue != "" || *optExcludeQueue != ""
+	rabbitmq.Queues.Vhost = *optVhost
+	if *optIncludeQueue != "" {
+		re, err := regexp.Compile(*optIncludeQueue)
+		if err != nil {
+			log.Fatalf("invalid -include-queue: %s", err)
+		}
+		rabbitmq.Queues.Include = re
+	}
+	if *optExcludeQueue != "" {
+		re, err := regexp.Compile(*optExcludeQueue)
+		if err != nil {
+			log.Fatalf("invalid -exclude-queue: %s", err)
+		}
+		rabbitmq.Queues.Exclude = re
+	}
 
 	helper := mp.NewMackerelPlugin(rabbitmq)
+	helper.Tempfile = rabbitmq.tempfile(*optTempfile)
 
 	helper.Run()
 }
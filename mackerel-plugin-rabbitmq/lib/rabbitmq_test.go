@@ -15,6 +15,21 @@ func TestGraphDefinition(t *testing.T) {
 	if len(graphdef) != 2 {
 		t.Errorf("GetTempfilename: %d should be 2", len(graphdef))
 	}
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range graphdef {
+		graphs[rabbitmq.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"rabbitmq.queue":   "RabbitMQ Queue",
+		"rabbitmq.message": "RabbitMQ Message",
+	}, graphs)
+
+	rabbitmq.Prefix = "rabbitmq-events"
+	assert.Equal(t, "Rabbitmq-Events Queue", rabbitmq.GraphDefinition()["queue"].Label)
+	rabbitmq.LabelPrefix = "Events"
+	assert.Equal(t, "Events Queue", rabbitmq.GraphDefinition()["queue"].Label)
 }
 
 func TestParse(t *testing.T) {
@@ -34,3 +49,13 @@ func TestParse(t *testing.T) {
 	assert.EqualValues(t, reflect.TypeOf(stat["publish"]).String(), "float64")
 	assert.EqualValues(t, stat["publish"], 4)
 }
+
+func TestTempfile(t *testing.T) {
+	p := RabbitMQPlugin{URI: "http://localhost:15672"}
+	if other := (RabbitMQPlugin{URI: "http://localhost:15673"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/rabbitmq.json"); f != "/tmp/rabbitmq.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
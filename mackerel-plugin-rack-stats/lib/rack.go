@@ -15,6 +15,7 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 var sock string
@@ -161,6 +162,11 @@ func (u RackStatsPlugin) GraphDefinition() map[string]mp.Graphs {
 	}
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the address and the path
+func (u RackStatsPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "rack-stats", u.Address, u.Path)
+}
+
 // Do the plugin
 func Do() {
 	optAddress := flag.String("address", "http://localhost:8080", "URL or Unix Domain Socket")
@@ -181,7 +187,7 @@ func Do() {
 	rack.MetricKey = *optMetricKey
 
 	helper := mp.NewMackerelPlugin(rack)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = rack.tempfile(*optTempfile)
 
 	helper.Run()
 }
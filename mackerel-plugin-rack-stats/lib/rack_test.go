@@ -115,3 +115,18 @@ func TestParseUnix(t *testing.T) {
 	assert.EqualValues(t, reflect.TypeOf(stats["queued"]).String(), "float64")
 	assert.EqualValues(t, stats["queued"], 80)
 }
+
+func TestTempfile(t *testing.T) {
+	p := RackStatsPlugin{Address: "http://localhost:8080", Path: "/_raindrops"}
+	for field, other := range map[string]RackStatsPlugin{
+		"Address": {Address: "unix:/tmp/unicorn.sock", Path: "/_raindrops"},
+		"Path":    {Address: "http://localhost:8080", Path: "/raindrops"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/rack-stats.json"); f != "/tmp/rack-stats.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
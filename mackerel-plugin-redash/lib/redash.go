@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // RedashPlugin mackerel plugin
@@ -90,6 +91,11 @@ func (p RedashPlugin) FetchMetrics() (map[string]interface{}, error) {
 	return metrics, nil
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the URI of the stats
+func (p RedashPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "redash", p.URI)
+}
+
 // Do the plugin
 func Do() {
 	optURI := flag.String("uri", "http://localhost/api/admin/queries/tasks?api_key=hoge", "stats URI")
@@ -105,6 +111,6 @@ func Do() {
 	}
 
 	helper := mp.NewMackerelPlugin(p)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = p.tempfile(*optTempfile)
 	helper.Run()
 }
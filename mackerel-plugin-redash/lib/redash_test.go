@@ -185,3 +185,13 @@ func TestFetchMetricsFail(t *testing.T) {
 		t.Errorf("FetchMetrics should return error: stub=%v", stub)
 	}
 }
+
+func TestTempfile(t *testing.T) {
+	p := RedashPlugin{URI: "http://localhost/api/admin/queries/tasks?api_key=foo"}
+	if other := (RedashPlugin{URI: "http://redash.example.com/api/admin/queries/tasks?api_key=foo"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with URI: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/redash.json"); f != "/tmp/redash.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,213 @@
+package mpredis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+)
+
+// clusterSumKeys are the metrics of the masters summed up into the metrics of the whole cluster
+var clusterSumKeys = []string{
+	"total_commands_processed",
+	"total_connections_received",
+	"rejected_connections",
+	"connected_clients",
+	"blocked_clients",
+	"connected_slaves",
+	"keys",
+	"expires",
+	"expired",
+	"expired_keys",
+	"evicted_keys",
+	"keyspace_hits",
+	"keyspace_misses",
+	"used_memory",
+	"used_memory_rss",
+	"used_memory_peak",
+	"used_memory_lua",
+}
+
+// clusterNodeKeys maps the metrics of each master to the graphs of the nodes
+var clusterNodeKeys = map[string]string{
+	"total_commands_processed": "cluster.node",
+	"connected_clients":        "cluster.node",
+	"keys":                     "cluster.node",
+	"used_memory":              "cluster.node_memory",
+}
+
+// clusterNode is the address of a node in CLUSTER NODES
+type clusterNode struct {
+	host string
+	port string
+}
+
+// parseClusterNodes returns the masters in CLUSTER NODES, whose lines are like
+// 07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 master - 0 1426238317239 4 connected 0-5460
+func parseClusterNodes(nodes string) []clusterNode {
+	var masters []clusterNode
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		if !isClusterMaster(fields[2]) {
+			continue
+		}
+		// the address is ip:port@cport, followed by ,hostname since Redis 7
+		addr := strings.SplitN(strings.SplitN(fields[1], ",", 2)[0], "@", 2)[0]
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			logger.Warningf("Failed to parse the address of the cluster node %s. %s", fields[0], err)
+			continue
+		}
+		masters = append(masters, clusterNode{host, port})
+	}
+	return masters
+}
+
+// isClusterMaster reports whether the flags of CLUSTER NODES tell the node is a master with an address
+func isClusterMaster(flags string) bool {
+	master := false
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "master":
+			master = true
+		case "noaddr", "handshake":
+			return false
+		}
+	}
+	return master
+}
+
+// parseClusterInfo parses CLUSTER INFO into the metrics, with cluster_state as 1 for ok and 0 for fail
+func parseClusterInfo(info string) map[string]interface{} {
+	stat := make(map[string]interface{})
+	for _, line := range strings.Split(info, "\r\n") {
+		record := strings.SplitN(line, ":", 2)
+		if len(record) < 2 {
+			continue
+		}
+		key, value := record[0], record[1]
+		switch key {
+		case "cluster_state":
+			if value == "ok" {
+				stat[key] = 1.0
+			} else {
+				stat[key] = 0.0
+			}
+		case "cluster_slots_ok", "cluster_slots_pfail", "cluster_slots_fail", "cluster_known_nodes":
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				logger.Warningf("Failed to parse %s. %s", key, err)
+				continue
+			}
+			stat[key] = v
+		}
+	}
+	return stat
+}
+
+// fetchClusterMetrics asks the node for the masters of the cluster, and sums up INFO of each master.
+// The masters which are unreachable are skipped.
+func (m RedisPlugin) fetchClusterMetrics(ctx context.Context) (map[string]interface{}, error) {
+	c, err := m.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	info, err := c.ClusterInfo().Result()
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running CLUSTER INFO"); derr != nil {
+			m.targetLogger().Errorf("%s", derr)
+			return nil, derr
+		}
+		m.targetLogger().Errorf("Failed to run `CLUSTER INFO` command. %s", err)
+		return nil, err
+	}
+
+	nodes, err := c.ClusterNodes().Result()
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running CLUSTER NODES"); derr != nil {
+			m.targetLogger().Errorf("%s", derr)
+			return nil, derr
+		}
+		m.targetLogger().Errorf("Failed to run `CLUSTER NODES` command. %s", err)
+		return nil, err
+	}
+
+	stat := parseClusterInfo(info)
+	for _, k := range clusterSumKeys {
+		stat[k] = 0.0
+	}
+	for _, node := range parseClusterNodes(nodes) {
+		n := m
+		n.Host = node.host
+		n.Port = node.port
+		n.Socket = ""
+		nodeStat, err := n.fetchMetrics(ctx)
+		if err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, "fetching the cluster nodes"); derr != nil {
+				// the masters fetched so far are posted
+				m.targetLogger().Warningf("%s", derr)
+				return stat, nil
+			}
+			m.targetLogger().Warningf("Failed to fetch the cluster node %s. Skip the node. %s", net.JoinHostPort(node.host, node.port), err)
+			continue
+		}
+		for _, k := range clusterSumKeys {
+			if v, ok := nodeStat[k].(float64); ok {
+				stat[k] = stat[k].(float64) + v
+			}
+		}
+		key := addrKey(node.host, node.port)
+		for k, graph := range clusterNodeKeys {
+			if v, ok := nodeStat[k]; ok {
+				stat[fmt.Sprintf("%s.%s.%s", graph, key, k)] = v
+			}
+		}
+	}
+	return stat, nil
+}
+
+func clusterGraphDefinition(labelPrefix string) map[string]mp.Graphs {
+	return map[string]mp.Graphs{
+		"cluster_state": {
+			Label: (labelPrefix + " Cluster State"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_state", Label: "OK", Diff: false},
+			},
+		},
+		"cluster_slots": {
+			Label: (labelPrefix + " Cluster Slots"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cluster_slots_ok", Label: "OK", Diff: false, Stacked: true},
+				{Name: "cluster_slots_pfail", Label: "Possibly Failing", Diff: false, Stacked: true},
+				{Name: "cluster_slots_fail", Label: "Failing", Diff: false, Stacked: true},
+			},
+		},
+		"cluster.node.#": {
+			Label: (labelPrefix + " Cluster Node"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "total_commands_processed", Label: "Queries", Diff: true},
+				{Name: "connected_clients", Label: "Connected Clients", Diff: false},
+				{Name: "keys", Label: "Keys", Diff: false},
+			},
+		},
+		"cluster.node_memory.#": {
+			Label: (labelPrefix + " Cluster Node Memory"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "used_memory", Label: "Used Memory", Diff: false},
+			},
+		},
+	}
+}
@@ -0,0 +1,104 @@
+package mpredis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseClusterNodes(t *testing.T) {
+	nodes := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922\n" +
+		"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003,node3.example.com master - 0 1426238318243 3 connected 10923-16383\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460\n" +
+		"6ec23923021cf3ffec47632106199cb7f496ce01 :0@0 master,noaddr - 1426238316232 1426238316232 5 disconnected\n"
+	masters := parseClusterNodes(nodes)
+	expected := []clusterNode{{"127.0.0.1", "30002"}, {"127.0.0.1", "30003"}, {"127.0.0.1", "30001"}}
+	if fmt.Sprint(masters) != fmt.Sprint(expected) {
+		t.Errorf("the masters should be %v: %v", expected, masters)
+	}
+}
+
+func TestParseClusterInfo(t *testing.T) {
+	stat := parseClusterInfo("cluster_state:fail\r\ncluster_slots_assigned:16384\r\ncluster_slots_ok:10923\r\ncluster_slots_pfail:0\r\ncluster_slots_fail:5461\r\ncluster_known_nodes:6\r\n")
+	for k, v := range map[string]float64{
+		"cluster_state":       0,
+		"cluster_slots_ok":    10923,
+		"cluster_slots_pfail": 0,
+		"cluster_slots_fail":  5461,
+		"cluster_known_nodes": 6,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if stat := parseClusterInfo("cluster_state:ok\r\n"); stat["cluster_state"] != 1.0 {
+		t.Errorf("cluster_state should be 1 for ok: %v", stat["cluster_state"])
+	}
+}
+
+func TestFetchMetricsCluster(t *testing.T) {
+	l1, port1 := listenStub(t, stubHandler)
+	defer l1.Close()
+	l2, port2 := listenStub(t, stubHandler)
+	defer l2.Close()
+	down, downPort := listenStub(t, nil)
+	down.Close()
+
+	nodes := fmt.Sprintf("e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:%s@1%s myself,master - 0 0 1 connected 0-5460\n", port1, port1) +
+		fmt.Sprintf("67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:%s@1%s master - 0 1426238316232 2 connected 5461-10922\n", port2, port2) +
+		fmt.Sprintf("292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:%s@1%s master,fail - 0 1426238318243 3 disconnected 10923-16383\n", downPort, downPort)
+	seed, seedPort := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "CLUSTER" && len(args) == 2 {
+			switch strings.ToUpper(args[1]) {
+			case "INFO":
+				return bulkString("cluster_state:fail\r\ncluster_slots_ok:10923\r\ncluster_slots_pfail:0\r\ncluster_slots_fail:5461\r\ncluster_known_nodes:3\r\n")
+			case "NODES":
+				return bulkString(nodes)
+			}
+		}
+		return "-ERR This instance has cluster support disabled\r\n"
+	})
+	defer seed.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: seedPort, Timeout: 5, Cluster: true}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"cluster_state":            0,
+		"cluster_slots_ok":         10923,
+		"cluster_slots_fail":       5461,
+		"total_commands_processed": 20,
+		"keys":                     10,
+		"used_memory":              2048,
+		"expired":                  6,
+		"cluster.node.127_0_0_1_" + port1 + ".total_commands_processed": 10,
+		"cluster.node.127_0_0_1_" + port2 + ".keys":                     5,
+		"cluster.node_memory.127_0_0_1_" + port2 + ".used_memory":       1024,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := stat["cluster.node.127_0_0_1_"+downPort+".keys"]; ok {
+		t.Errorf("the unreachable node should be skipped")
+	}
+
+	graphdef := redis.GraphDefinition()
+	for _, k := range []string{"cluster_state", "cluster_slots", "cluster.node.#", "cluster.node_memory.#"} {
+		if _, ok := graphdef[k]; !ok {
+			t.Errorf("%s should be defined with -cluster", k)
+		}
+	}
+	if _, ok := (RedisPlugin{}).GraphDefinition()["cluster_state"]; ok {
+		t.Errorf("cluster_state should not be defined without -cluster")
+	}
+
+	// the node in the standalone mode is an error
+	redis.Port = port1
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("the node without the cluster support should be an error")
+	}
+}
@@ -1,96 +1,604 @@
 package mpredis
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/fzzy/radix/redis"
+	"github.com/go-redis/redis"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
-	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
-var logger = logging.GetLogger("metrics.plugin.redis")
+var logger = pluginutil.NewLogger("redis")
 
 // RedisPlugin mackerel plugin for Redis
 type RedisPlugin struct {
 	Host     string
 	Port     string
+	Username string
 	Password string
 	Socket   string
 	Prefix   string
 	Timeout  int
 	Tempfile string
+	PerDB    bool
+
+	UseTLS        bool
+	TLSSkipVerify bool
+	TLSCACert     string
+	TLSCert       string
+	TLSKey        string
+
+	SentinelHost string
+	SentinelPort string
+	MasterName   string
+
+	Cluster bool
+
+	// Ports are the instances on Host monitored at once with -port=6379,6380, whose metrics are posted as <prefix>.<port>.*
+	Ports []string
+
+	// ConfigCommand is the name of CONFIG renamed by rename-command, which is CONFIG if empty
+	ConfigCommand string
+	// EnableLatency posts the latency events of LATENCY LATEST, which are recorded with latency-monitor-threshold
+	EnableLatency bool
+	// EnableCommandstats posts the calls and the usec per call of each command of INFO commandstats,
+	// limited to the top CommandstatsLimit commands by calls if it is positive
+	EnableCommandstats bool
+	CommandstatsLimit  int
+	// DisableSlowlog skips SLOWLOG LEN, which is set by -enable-slowlog=false
+	DisableSlowlog bool
+	// DisableCapacity skips the capacity metrics, which is set by -config-command=""
+	DisableCapacity bool
+
+	MaxExecutionTime time.Duration
+
+	// lastStat are the values of the last run saved in the tempfile, for keyspace_hit_rate
+	lastStat map[string]interface{}
+}
+
+// tlsConfig builds the TLS configuration from the options
+func (m RedisPlugin) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         m.Host,
+		InsecureSkipVerify: m.TLSSkipVerify,
+	}
+	if m.TLSCACert != "" {
+		pem, err := ioutil.ReadFile(m.TLSCACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", m.TLSCACert)
+		}
+		config.RootCAs = pool
+	}
+	if m.TLSCert != "" || m.TLSKey != "" {
+		if m.TLSCert == "" || m.TLSKey == "" {
+			return nil, errors.New("both -tls-cert and -tls-key are required for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(m.TLSCert, m.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dial connects to redis, wrapping the connection in TLS if needed.
+// The timeout bounds the connect and the TLS handshake, and the deadline of ctx bounds all the I/O on the connection.
+func (m RedisPlugin) dial(ctx context.Context) (net.Conn, error) {
+	network := "tcp"
+	target := net.JoinHostPort(m.Host, m.Port)
+	if m.Socket != "" {
+		target = m.Socket
+		network = "unix"
+	}
+	timeout := time.Duration(m.Timeout) * time.Second
+
+	var config *tls.Config
+	if m.UseTLS {
+		var err error
+		if config, err = m.tlsConfig(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.DialTimeout(network, target, pluginutil.Timeout(ctx, timeout))
+	if err != nil {
+		return nil, err
+	}
+	conn = pluginutil.DeadlineConn(ctx, conn)
+	if !m.UseTLS {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, config)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// connect dials redis, and returns the client on the connection, which authenticates on the connect.
+// The timeout bounds each round trip of the commands.
+func (m RedisPlugin) connect(ctx context.Context) (*redis.Client, error) {
+	conn, err := m.dial(ctx)
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "connecting to redis"); derr != nil {
+			err = derr
+		}
+		m.targetLogger().Errorf("Failed to connect redis. %s", err)
+		return nil, err
+	}
+
+	timeout := time.Duration(m.Timeout) * time.Second
+	if timeout <= 0 {
+		// -timeout=0 is no timeout
+		timeout = -1
+	}
+	opt := &redis.Options{
+		Addr: conn.RemoteAddr().String(),
+		// the connection is dialed again if the client drops it on an error
+		Dialer: func() (net.Conn, error) {
+			if c := conn; c != nil {
+				conn = nil
+				return c, nil
+			}
+			return m.dial(ctx)
+		},
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		PoolSize:     1,
+	}
+	if m.Username != "" {
+		opt.OnConnect = func(cn *redis.Conn) error {
+			return authenticateByACL(m.targetLogger(), cn, m.Username, m.Password)
+		}
+	} else if m.Password != "" {
+		opt.OnConnect = func(cn *redis.Conn) error {
+			return authenticateByPassword(m.targetLogger(), cn, m.Password)
+		}
+	}
+	return redis.NewClient(opt), nil
 }
 
-func authenticateByPassword(c *redis.Client, password string) error {
-	if r := c.Cmd("AUTH", password); r.Err != nil {
-		logger.Errorf("Failed to authenticate. %s", r.Err)
-		return r.Err
+func authenticateByPassword(l *pluginutil.Logger, c *redis.Conn, password string) error {
+	if err := c.Do("AUTH", password).Err(); err != nil {
+		l.Errorf("Failed to authenticate. %s", err)
+		return authError(err)
 	}
 	return nil
 }
 
-func fetchPercentageOfMemory(c *redis.Client, stat map[string]interface{}) error {
-	r := c.Cmd("CONFIG", "GET", "maxmemory")
-	if r.Err != nil {
-		logger.Errorf("Failed to run `CONFIG GET maxmemory` command. %s", r.Err)
-		return r.Err
+// authenticateByACL authenticates as the ACL user of Redis 6 or later
+func authenticateByACL(l *pluginutil.Logger, c *redis.Conn, username, password string) error {
+	if err := c.Do("AUTH", username, password).Err(); err != nil {
+		l.Errorf("Failed to authenticate as %s. %s", username, err)
+		return authError(err)
+	}
+	return nil
+}
+
+// authError tells the authentication failures apart from the connection failures
+func authError(err error) error {
+	msg := err.Error()
+	switch {
+	case strings.HasPrefix(msg, "WRONGPASS"):
+		return fmt.Errorf("authentication failed: invalid username or password: %s", msg)
+	case strings.HasPrefix(msg, "NOPERM"):
+		return fmt.Errorf("authentication failed: the user has no permissions: %s", msg)
+	}
+	return err
+}
+
+// toHash converts the reply of field-value pairs, e.g. of CONFIG GET, into the map
+func toHash(reply interface{}) (map[string]string, error) {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply: %v", reply)
+	}
+	if len(values)%2 != 0 {
+		return nil, errors.New("reply has odd number of elements")
+	}
+	h := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		k, ok := values[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected field: %v", values[i])
+		}
+		v, ok := values[i+1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value of %s: %v", k, values[i+1])
+		}
+		h[k] = v
+	}
+	return h, nil
+}
+
+func fetchPercentageOfMemory(l *pluginutil.Logger, c *redis.Client, command string, stat map[string]interface{}) error {
+	// INFO may be truncated by proxies such as twemproxy
+	used, ok := stat["used_memory"].(float64)
+	if !ok {
+		l.Warningf("Failed to find used_memory in INFO. Skip percentage_of_memory.")
+		return nil
+	}
+
+	r, err := c.Do(command, "GET", "maxmemory").Result()
+	if err != nil {
+		l.Errorf("Failed to run `%s GET maxmemory` command. %s", command, err)
+		return err
 	}
 
-	res, err := r.Hash()
+	res, err := toHash(r)
 	if err != nil {
-		logger.Errorf("Failed to fetch maxmemory. %s", err)
+		l.Errorf("Failed to fetch maxmemory. %s", err)
 		return err
 	}
 
 	maxsize, err := strconv.ParseFloat(res["maxmemory"], 64)
 	if err != nil {
-		logger.Errorf("Failed to parse maxmemory. %s", err)
+		l.Errorf("Failed to parse maxmemory. %s", err)
 		return err
 	}
 
 	if maxsize == 0.0 {
 		stat["percentage_of_memory"] = 0.0
 	} else {
-		stat["percentage_of_memory"] = 100.0 * stat["used_memory"].(float64) / maxsize
+		stat["percentage_of_memory"] = 100.0 * used / maxsize
 	}
 
 	return nil
 }
 
-func fetchPercentageOfClients(c *redis.Client, stat map[string]interface{}) error {
-	r := c.Cmd("CONFIG", "GET", "maxclients")
-	if r.Err != nil {
-		logger.Errorf("Failed to run `CONFIG GET maxclients` command. %s", r.Err)
-		return r.Err
+func fetchPercentageOfClients(l *pluginutil.Logger, c *redis.Client, command string, stat map[string]interface{}) error {
+	connected, ok := stat["connected_clients"].(float64)
+	if !ok {
+		l.Warningf("Failed to find connected_clients in INFO. Skip percentage_of_clients.")
+		return nil
+	}
+
+	r, err := c.Do(command, "GET", "maxclients").Result()
+	if err != nil {
+		l.Errorf("Failed to run `%s GET maxclients` command. %s", command, err)
+		return err
 	}
 
-	res, err := r.Hash()
+	res, err := toHash(r)
 	if err != nil {
-		logger.Errorf("Failed to fetch maxclients. %s", err)
+		l.Errorf("Failed to fetch maxclients. %s", err)
 		return err
 	}
 
 	maxsize, err := strconv.ParseFloat(res["maxclients"], 64)
 	if err != nil {
-		logger.Errorf("Failed to parse maxclients. %s", err)
+		l.Errorf("Failed to parse maxclients. %s", err)
 		return err
 	}
 
-	stat["percentage_of_clients"] = 100.0 * stat["connected_clients"].(float64) / maxsize
+	stat["percentage_of_clients"] = 100.0 * connected / maxsize
 
 	return nil
 }
 
-func calculateCapacity(c *redis.Client, stat map[string]interface{}) error {
-	if err := fetchPercentageOfMemory(c, stat); err != nil {
+func calculateCapacity(l *pluginutil.Logger, c *redis.Client, command string, stat map[string]interface{}) error {
+	if command == "" {
+		command = "CONFIG"
+	}
+	if err := fetchPercentageOfMemory(l, c, command, stat); err != nil {
+		return err
+	}
+	return fetchPercentageOfClients(l, c, command, stat)
+}
+
+// fetchSlowlogLength posts the length of the slow log as is, which is never reset by the plugin.
+// SLOWLOG renamed or denied by the ACL is skipped.
+func fetchSlowlogLength(l *pluginutil.Logger, c *redis.Client, stat map[string]interface{}) error {
+	n, err := c.Do("SLOWLOG", "LEN").Int64()
+	if err != nil {
+		l.Debugf("Failed to run `SLOWLOG LEN` command. Skip the metric. %s", err)
 		return err
 	}
-	return fetchPercentageOfClients(c, stat)
+	stat["slowlog_length"] = float64(n)
+	return nil
+}
+
+// latencyEventRe matches the characters replaced in the names of the latency events, e.g. the hyphen of aof-write
+var latencyEventRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// fetchLatencyEvents posts the latest and the max latency (ms) of each event of LATENCY LATEST.
+// Nothing is posted while the latency monitor is disabled, which replies no events.
+func fetchLatencyEvents(l *pluginutil.Logger, c *redis.Client, stat map[string]interface{}) error {
+	r, err := c.Do("LATENCY", "LATEST").Result()
+	if err != nil {
+		l.Warningf("Failed to run `LATENCY LATEST` command. Skip these metrics. %s", err)
+		return err
+	}
+	events, ok := r.([]interface{})
+	if !ok {
+		return fmt.Errorf("unexpected reply of LATENCY LATEST: %v", r)
+	}
+	for _, e := range events {
+		// each event is [name, timestamp, latest, max]
+		event, ok := e.([]interface{})
+		if !ok || len(event) < 4 {
+			continue
+		}
+		name, ok := event[0].(string)
+		if !ok {
+			continue
+		}
+		latest, ok1 := event[2].(int64)
+		max, ok2 := event[3].(int64)
+		if !ok1 || !ok2 {
+			continue
+		}
+		key := "latency." + latencyEventRe.ReplaceAllString(name, "_")
+		stat[key+".latest"] = float64(latest)
+		stat[key+".max"] = float64(max)
+	}
+	return nil
+}
+
+// commandstat is the statistics of a command in INFO commandstats
+type commandstat struct {
+	name        string
+	calls       float64
+	usecPerCall float64
+}
+
+// parseCommandstats parses INFO commandstats, whose lines are like cmdstat_get:calls=123,usec=456,usec_per_call=3.70
+func parseCommandstats(info string) []commandstat {
+	var stats []commandstat
+	for _, line := range strings.Split(info, "\r\n") {
+		record := strings.SplitN(line, ":", 2)
+		if len(record) < 2 || !strings.HasPrefix(record[0], "cmdstat_") {
+			continue
+		}
+		kvs := parseKeyValues(record[1])
+		calls, err := strconv.ParseFloat(kvs["calls"], 64)
+		if err != nil {
+			logger.Warningf("Failed to parse the calls of %s. %s", record[0], err)
+			continue
+		}
+		usecPerCall, err := strconv.ParseFloat(kvs["usec_per_call"], 64)
+		if err != nil {
+			logger.Warningf("Failed to parse the usec per call of %s. %s", record[0], err)
+			continue
+		}
+		// the subcommands are like cmdstat_client|list since Redis 7
+		name := normalizeMetricNameRe.ReplaceAllString(strings.TrimPrefix(record[0], "cmdstat_"), "_")
+		stats = append(stats, commandstat{name, calls, usecPerCall})
+	}
+	return stats
+}
+
+// fetchCommandstats posts the statistics of the commands, or of the top limit commands by calls if limit is positive
+func fetchCommandstats(l *pluginutil.Logger, c *redis.Client, limit int, stat map[string]interface{}) error {
+	info, err := c.Info("commandstats").Result()
+	if err != nil {
+		l.Warningf("Failed to run `INFO commandstats` command. Skip these metrics. %s", err)
+		return err
+	}
+	stats := parseCommandstats(info)
+	if limit > 0 && len(stats) > limit {
+		sort.SliceStable(stats, func(i, j int) bool { return stats[i].calls > stats[j].calls })
+		stats = stats[:limit]
+	}
+	for _, s := range stats {
+		stat["commandstats."+s.name+".calls"] = s.calls
+		stat["commandstats."+s.name+".usec_per_call"] = s.usecPerCall
+	}
+	return nil
+}
+
+// persistenceStatusKeys are the statuses of the persistence in INFO, which are ok or err
+var persistenceStatusKeys = map[string]bool{
+	"rdb_last_bgsave_status":    true,
+	"aof_last_bgrewrite_status": true,
+	"aof_last_write_status":     true,
+}
+
+// uint64Keys are the counters which can exceed the precision of float64 on busy servers
+var uint64Keys = map[string]bool{
+	"total_net_input_bytes":  true,
+	"total_net_output_bytes": true,
+}
+
+// persistenceStatus maps ok to 0 and the others to 1, so that the failures of the persistence can be alerted
+func persistenceStatus(value string) float64 {
+	if value == "ok" {
+		return 0.0
+	}
+	return 1.0
+}
+
+// parseKeyValues parses the comma-separated key=value pairs in INFO, e.g. ip=10.0.0.2,port=6379,offset=1234
+func parseKeyValues(value string) map[string]string {
+	kvs := make(map[string]string)
+	for _, kv := range strings.Split(value, ",") {
+		field := strings.SplitN(kv, "=", 2)
+		if len(field) < 2 {
+			continue
+		}
+		kvs[field[0]] = field[1]
+	}
+	return kvs
+}
+
+// parseKeyspace parses the keyspace of a database in INFO, e.g. keys=5,expires=1,avg_ttl=0
+func parseKeyspace(value string) map[string]float64 {
+	keyspace := make(map[string]float64)
+	for k, v := range parseKeyValues(value) {
+		fv, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Warningf("Failed to parse db %s. %s", k, err)
+			continue
+		}
+		keyspace[k] = fv
+	}
+	return keyspace
+}
+
+var normalizeMetricNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// addrKey returns the metric key of the address, e.g. 10_0_0_2_6379
+func addrKey(host, port string) string {
+	return normalizeMetricNameRe.ReplaceAllString(host+"_"+port, "_")
+}
+
+// replicaKey returns the metric key of the replica in slaveN of INFO
+func replicaKey(replica map[string]string) string {
+	return addrKey(replica["ip"], replica["port"])
+}
+
+// setReplicationStats sets the bytes behind master_repl_offset of each replica,
+// and master_link_down_since_seconds which is only in INFO while the link is down on the replica
+func setReplicationStats(stat map[string]interface{}, role string, replicas []map[string]string) {
+	if masterOffset, ok := stat["master_repl_offset"].(float64); ok {
+		for _, replica := range replicas {
+			offset, err := strconv.ParseFloat(replica["offset"], 64)
+			if err != nil {
+				logger.Warningf("Failed to parse the offset of the replica. %s", err)
+				continue
+			}
+			delay := masterOffset - offset
+			if delay < 0 {
+				delay = 0
+			}
+			stat["replication_delay."+replicaKey(replica)+".offset_delay"] = delay
+		}
+	}
+	if role == "slave" {
+		if _, ok := stat["master_link_down_since_seconds"]; !ok {
+			stat["master_link_down_since_seconds"] = 0.0
+		}
+	}
+}
+
+// targetLogger returns the logger with the target in the JSON logs
+func (m RedisPlugin) targetLogger() *pluginutil.Logger {
+	fields := pluginutil.LogFields{"host": m.Host, "port": m.Port}
+	if m.Socket != "" {
+		fields = pluginutil.LogFields{"socket": m.Socket}
+	}
+	if m.MasterName != "" {
+		fields["master_name"] = m.MasterName
+	}
+	return logger.With(fields)
+}
+
+// resolveMaster asks the Sentinel for the address of the current master, and fetches the Sentinel-side metrics
+func (m RedisPlugin) resolveMaster(ctx context.Context) (RedisPlugin, map[string]interface{}, error) {
+	sentinel := m
+	sentinel.Host = m.SentinelHost
+	sentinel.Port = m.SentinelPort
+	sentinel.Socket = ""
+	// AUTH is sent only to the master
+	sentinel.Username = ""
+	sentinel.Password = ""
+	c, err := sentinel.connect(ctx)
+	if err != nil {
+		return m, nil, err
+	}
+	defer c.Close()
+
+	r, err := c.Do("SENTINEL", "get-master-addr-by-name", m.MasterName).Result()
+	if err == redis.Nil {
+		return m, nil, fmt.Errorf("unknown master: %s", m.MasterName)
+	}
+	if err != nil {
+		return m, nil, err
+	}
+	addr, ok := r.([]interface{})
+	if !ok || len(addr) != 2 {
+		return m, nil, fmt.Errorf("unexpected address of the master %s: %v", m.MasterName, r)
+	}
+
+	master := m
+	master.Host = fmt.Sprint(addr[0])
+	master.Port = fmt.Sprint(addr[1])
+	master.Socket = ""
+
+	stat, err := fetchSentinelStats(c, m.MasterName)
+	if err != nil {
+		m.targetLogger().Infof("Failed to fetch the Sentinel metrics of %s. Skip these metrics. %s", m.MasterName, err)
+	}
+	return master, stat, nil
+}
+
+// fetchSentinelStats counts the replicas and the Sentinels which the Sentinel knows for the master
+func fetchSentinelStats(c *redis.Client, name string) (map[string]interface{}, error) {
+	r, err := c.Do("SENTINEL", "master", name).Result()
+	if err != nil {
+		return nil, err
+	}
+	master, err := toHash(r)
+	if err != nil {
+		return nil, err
+	}
+	knownSlaves, err := strconv.ParseFloat(master["num-slaves"], 64)
+	if err != nil {
+		return nil, err
+	}
+	otherSentinels, err := strconv.ParseFloat(master["num-other-sentinels"], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = c.Do("SENTINEL", "slaves", name).Result()
+	if err != nil {
+		return nil, err
+	}
+	replicas, ok := r.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected replicas: %v", r)
+	}
+	okSlaves := 0.0
+	for _, e := range replicas {
+		replica, err := toHash(e)
+		if err != nil {
+			return nil, err
+		}
+		if isHealthyReplica(replica) {
+			okSlaves++
+		}
+	}
+
+	return map[string]interface{}{
+		"sentinel_known_slaves":    knownSlaves,
+		"sentinel_ok_slaves":       okSlaves,
+		"sentinel_known_sentinels": otherSentinels + 1,
+	}, nil
+}
+
+// isHealthyReplica reports whether the replica is neither down nor disconnected from the master
+func isHealthyReplica(replica map[string]string) bool {
+	for _, flag := range strings.Split(replica["flags"], ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+	return replica["master-link-status"] == "ok"
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -103,33 +611,161 @@ func (m RedisPlugin) MetricKeyPrefix() string {
 
 // FetchMetrics interface for mackerelplugin
 func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
-	network := "tcp"
-	target := fmt.Sprintf("%s:%s", m.Host, m.Port)
-	if m.Socket != "" {
-		target = m.Socket
-		network = "unix"
-	}
-	c, err := redis.DialTimeout(network, target, time.Duration(m.Timeout)*time.Second)
+	ctx, cancel := pluginutil.WithMaxExecutionTime(m.MaxExecutionTime)
+	defer cancel()
+
+	stat, err := m.fetch(ctx)
 	if err != nil {
-		logger.Errorf("Failed to connect redis. %s", err)
 		return nil, err
 	}
-	defer c.Close()
+	if len(m.Ports) <= 1 {
+		setKeyspaceHitRate(stat, m.lastStat, "")
+	}
+	return stat, nil
+}
+
+// fetch fetches the metrics of the instances, the cluster, the master through Sentinel or the instance
+func (m RedisPlugin) fetch(ctx context.Context) (map[string]interface{}, error) {
+	if len(m.Ports) > 1 {
+		return m.fetchInstancesMetrics(ctx)
+	}
+	if m.Cluster {
+		return m.fetchClusterMetrics(ctx)
+	}
+	if m.MasterName == "" {
+		return m.fetchMetrics(ctx)
+	}
 
-	if m.Password != "" {
-		if err = authenticateByPassword(c, m.Password); err != nil {
+	master, sentinelStat, err := m.resolveMaster(ctx)
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "asking Sentinel for the master"); derr != nil {
+			m.targetLogger().Errorf("%s", derr)
+			return nil, derr
+		}
+		if m.Host == "" && m.Socket == "" {
+			m.targetLogger().Errorf("Failed to resolve the master %s by Sentinel. %s", m.MasterName, err)
 			return nil, err
 		}
+		m.targetLogger().Warningf("Failed to resolve the master %s by Sentinel. Fall back to the given address. %s", m.MasterName, err)
+		return m.fetchMetrics(ctx)
+	}
+	stat, err := master.fetchMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range sentinelStat {
+		stat[k] = v
 	}
+	return stat, nil
+}
 
-	r := c.Cmd("info")
-	if r.Err != nil {
-		logger.Errorf("Failed to run info command. %s", r.Err)
-		return nil, r.Err
+// setKeyspaceHitRate calculates keyspace_hit_rate of the keys with prefix from the hits and the misses since the last run.
+// Nothing is posted without lookups, or when the counters are reset by a restart.
+func setKeyspaceHitRate(stat, lastStat map[string]interface{}, prefix string) {
+	hits, ok1 := stat[prefix+"keyspace_hits"].(float64)
+	misses, ok2 := stat[prefix+"keyspace_misses"].(float64)
+	lastHits, ok3 := lastStat[prefix+"keyspace_hits"].(float64)
+	lastMisses, ok4 := lastStat[prefix+"keyspace_misses"].(float64)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return
+	}
+	dh := hits - lastHits
+	dm := misses - lastMisses
+	if dh < 0 || dm < 0 || dh+dm == 0 {
+		return
 	}
-	str, err := r.Str()
+	stat[prefix+"keyspace_hit_rate"] = 100.0 * dh / (dh + dm)
+}
+
+// fetchInstancesMetrics fetches the metrics of each port, and namespaces them by the port and the graph, since the
+// graphs are "#.<graph>" for the instances. The instances which are unreachable are skipped.
+func (m RedisPlugin) fetchInstancesMetrics(ctx context.Context) (map[string]interface{}, error) {
+	graphdef := m.graphDefinition()
+	stat := make(map[string]interface{})
+	var lastErr error
+	fetched := 0
+	for _, port := range m.Ports {
+		n := m
+		n.Port = port
+		n.Ports = nil
+		instanceStat, err := n.fetchMetrics(ctx)
+		if err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, "fetching the instances"); derr != nil {
+				if fetched == 0 {
+					return nil, derr
+				}
+				// the instances fetched so far are posted
+				m.targetLogger().Warningf("%s", derr)
+				return stat, nil
+			}
+			n.targetLogger().Warningf("Failed to fetch the instance of port %s. Skip the instance. %s", port, err)
+			lastErr = err
+			continue
+		}
+		setKeyspaceHitRate(instanceStat, lastInstanceStat(graphdef, port, m.lastStat), "")
+		for k, v := range namespaceInstanceStat(graphdef, port, instanceStat) {
+			stat[k] = v
+		}
+		fetched++
+	}
+	if fetched == 0 {
+		return nil, lastErr
+	}
+	return stat, nil
+}
+
+// namespaceInstanceStat returns the metrics of the instance keyed by "<port>.<graph>.<metric>". The keys of the
+// wildcard graphs such as "keyspace.db0.keys" of "keyspace.#" are namespaced only by the port.
+func namespaceInstanceStat(graphdef map[string]mp.Graphs, port string, instanceStat map[string]interface{}) map[string]interface{} {
+	stat := make(map[string]interface{})
+	for key, graph := range graphdef {
+		if i := strings.Index(key, "#"); i >= 0 {
+			for k, v := range instanceStat {
+				if strings.HasPrefix(k, key[:i]) {
+					stat[port+"."+k] = v
+				}
+			}
+			continue
+		}
+		for _, metric := range graph.Metrics {
+			if v, ok := instanceStat[metric.Name]; ok {
+				stat[port+"."+key+"."+metric.Name] = v
+			}
+		}
+	}
+	return stat
+}
+
+// lastInstanceStat returns the last values of the instance from the namespaced ones, keyed by the names of the metrics
+func lastInstanceStat(graphdef map[string]mp.Graphs, port string, stat map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{})
+	for key, graph := range graphdef {
+		if strings.Contains(key, "#") {
+			continue
+		}
+		for _, metric := range graph.Metrics {
+			if v, ok := stat[port+"."+key+"."+metric.Name]; ok {
+				ret[metric.Name] = v
+			}
+		}
+	}
+	return ret
+}
+
+func (m RedisPlugin) fetchMetrics(ctx context.Context) (map[string]interface{}, error) {
+	c, err := m.connect(ctx)
 	if err != nil {
-		logger.Errorf("Failed to fetch information. %s", err)
+		return nil, err
+	}
+	defer c.Close()
+
+	str, err := c.Info().Result()
+	if err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running info command"); derr != nil {
+			m.targetLogger().Errorf("%s", derr)
+			return nil, derr
+		}
+		m.targetLogger().Errorf("Failed to run info command. %s", err)
 		return nil, err
 	}
 
@@ -137,6 +773,8 @@ func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 	keysStat := 0.0
 	expiresStat := 0.0
+	var role string
+	var replicas []map[string]string
 
 	for _, line := range strings.Split(str, "\r\n") {
 		if line == "" {
@@ -153,23 +791,34 @@ func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
 		key, value := record[0], record[1]
 
 		if re, _ := regexp.MatchString("^db", key); re {
-			kv := strings.SplitN(value, ",", 3)
-			keys, expires := kv[0], kv[1]
+			keyspace := parseKeyspace(value)
+			keysStat += keyspace["keys"]
+			expiresStat += keyspace["expires"]
 
-			keysKv := strings.SplitN(keys, "=", 2)
-			keysFv, err := strconv.ParseFloat(keysKv[1], 64)
-			if err != nil {
-				logger.Warningf("Failed to parse db keys. %s", err)
+			if m.PerDB {
+				for k, v := range keyspace {
+					stat["keyspace."+key+"."+k] = v
+				}
 			}
-			keysStat += keysFv
+			continue
+		}
 
-			expiresKv := strings.SplitN(expires, "=", 2)
-			expiresFv, err := strconv.ParseFloat(expiresKv[1], 64)
-			if err != nil {
-				logger.Warningf("Failed to parse db expires. %s", err)
+		if key == "role" {
+			role = value
+			continue
+		}
+		if re, _ := regexp.MatchString("^slave[0-9]+$", key); re {
+			replicas = append(replicas, parseKeyValues(value))
+			continue
+		}
+		if persistenceStatusKeys[key] {
+			stat[key] = persistenceStatus(value)
+			continue
+		}
+		if uint64Keys[key] {
+			if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+				stat[key] = v
 			}
-			expiresStat += expiresFv
-
 			continue
 		}
 
@@ -181,6 +830,7 @@ func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 	stat["keys"] = keysStat
 	stat["expires"] = expiresStat
+	setReplicationStats(stat, role, replicas)
 
 	if _, ok := stat["keys"]; !ok {
 		stat["keys"] = 0
@@ -189,14 +839,50 @@ func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
 		stat["expires"] = 0
 	}
 
+	// expired is the gauge of expired_keys kept for compatibility
 	if _, ok := stat["expired_keys"]; ok {
 		stat["expired"] = stat["expired_keys"]
 	} else {
 		stat["expired"] = 0.0
 	}
 
-	if err := calculateCapacity(c, stat); err != nil {
-		logger.Infof("Failed to calculate capacity. (The cause may be that AWS Elasticache Redis has no `CONFIG` command.) Skip these metrics. %s", err)
+	if m.EnableCommandstats {
+		if err := fetchCommandstats(m.targetLogger(), c, m.CommandstatsLimit, stat); err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, "running INFO commandstats"); derr != nil {
+				m.targetLogger().Warningf("%s", derr)
+				return stat, nil
+			}
+		}
+	}
+
+	if m.EnableLatency {
+		if err := fetchLatencyEvents(m.targetLogger(), c, stat); err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, "running LATENCY LATEST"); derr != nil {
+				m.targetLogger().Warningf("%s", derr)
+				return stat, nil
+			}
+		}
+	}
+
+	if !m.DisableSlowlog {
+		if err := fetchSlowlogLength(m.targetLogger(), c, stat); err != nil {
+			if derr := pluginutil.DeadlineExceeded(ctx, "running SLOWLOG LEN"); derr != nil {
+				m.targetLogger().Warningf("%s", derr)
+				return stat, nil
+			}
+		}
+	}
+
+	if m.DisableCapacity {
+		return stat, nil
+	}
+	if err := calculateCapacity(m.targetLogger(), c, m.ConfigCommand, stat); err != nil {
+		if derr := pluginutil.DeadlineExceeded(ctx, "running CONFIG GET"); derr != nil {
+			// the metrics from INFO are posted without the capacity
+			m.targetLogger().Warningf("%s", derr)
+			return stat, nil
+		}
+		m.targetLogger().Infof("Failed to calculate capacity. (The cause may be that AWS Elasticache Redis has no `CONFIG` command, which can be skipped with -config-command=\"\".) Skip these metrics. %s", err)
 	}
 
 	return stat, nil
@@ -204,6 +890,19 @@ func (m RedisPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 // GraphDefinition interface for mackerelplugin
 func (m RedisPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphdef := m.graphDefinition()
+	if len(m.Ports) > 1 {
+		instances := make(map[string]mp.Graphs, len(graphdef))
+		for k, v := range graphdef {
+			instances["#."+k] = v
+		}
+		return instances
+	}
+	return graphdef
+}
+
+// graphDefinition returns the graphs of an instance
+func (m RedisPlugin) graphDefinition() map[string]mp.Graphs {
 	labelPrefix := strings.Title(m.Prefix)
 
 	var graphdef = map[string]mp.Graphs{
@@ -212,6 +911,15 @@ func (m RedisPlugin) GraphDefinition() map[string]mp.Graphs {
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
 				{Name: "total_commands_processed", Label: "Queries", Diff: true},
+				{Name: "instantaneous_ops_per_sec", Label: "Instantaneous Ops per sec", Diff: false},
+			},
+		},
+		"network": {
+			Label: (labelPrefix + " Network"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "total_net_input_bytes", Label: "Input", Type: "uint64", Diff: true},
+				{Name: "total_net_output_bytes", Label: "Output", Type: "uint64", Diff: true},
 			},
 		},
 		"connections": {
@@ -240,6 +948,16 @@ func (m RedisPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "expired", Label: "Expired Keys", Diff: false},
 			},
 		},
+		// the counters are float, not uint64, so that the helper skips the diff when they are reset by a restart
+		// rather than taking it as a wrap-around
+		"evictions": {
+			Label: (labelPrefix + " Evictions"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "evicted_keys", Label: "Evicted Keys", Diff: true},
+				{Name: "expired_keys", Label: "Expired Keys", Diff: true},
+			},
+		},
 		"keyspace": {
 			Label: (labelPrefix + " Keyspace"),
 			Unit:  "integer",
@@ -256,6 +974,81 @@ func (m RedisPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "used_memory_rss", Label: "Used Memory RSS", Diff: false},
 				{Name: "used_memory_peak", Label: "Used Memory Peak", Diff: false},
 				{Name: "used_memory_lua", Label: "Used Memory Lua engine", Diff: false},
+				// allocator_* are reported since Redis 4.0
+				{Name: "allocator_allocated", Label: "Allocator Allocated", Diff: false},
+				{Name: "allocator_active", Label: "Allocator Active", Diff: false},
+				{Name: "allocator_resident", Label: "Allocator Resident", Diff: false},
+			},
+		},
+		"slowlog": {
+			Label: (labelPrefix + " Slow Log"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "slowlog_length", Label: "Length", Diff: false},
+			},
+		},
+		"fragmentation": {
+			Label: (labelPrefix + " Memory Fragmentation"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "mem_fragmentation_ratio", Label: "Fragmentation Ratio", Diff: false},
+				{Name: "allocator_frag_ratio", Label: "Allocator Fragmentation Ratio", Diff: false},
+			},
+		},
+		"replication": {
+			Label: (labelPrefix + " Replication"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "master_repl_offset", Label: "Master Offset", Diff: false},
+				{Name: "slave_repl_offset", Label: "Replica Offset", Diff: false},
+			},
+		},
+		"replication_delay.#": {
+			Label: (labelPrefix + " Replication Delay"),
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "offset_delay", Label: "Bytes behind master", Diff: false},
+			},
+		},
+		"replication_link": {
+			Label: (labelPrefix + " Replication Link"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "master_last_io_seconds_ago", Label: "Seconds since the last interaction with master", Diff: false},
+				{Name: "master_link_down_since_seconds", Label: "Seconds since the link is down", Diff: false},
+			},
+		},
+		"persistence": {
+			Label: (labelPrefix + " Persistence"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "rdb_last_bgsave_status", Label: "RDB last bgsave failed", Diff: false},
+				{Name: "aof_last_bgrewrite_status", Label: "AOF last rewrite failed", Diff: false},
+				{Name: "aof_last_write_status", Label: "AOF last write failed", Diff: false},
+				{Name: "rdb_bgsave_in_progress", Label: "RDB bgsave in progress", Diff: false},
+				{Name: "aof_rewrite_in_progress", Label: "AOF rewrite in progress", Diff: false},
+			},
+		},
+		"persistence_changes": {
+			Label: (labelPrefix + " Persistence Changes"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "rdb_changes_since_last_save", Label: "Changes since last save", Diff: false},
+			},
+		},
+		"persistence_time": {
+			Label: (labelPrefix + " Persistence Time"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "rdb_last_bgsave_time_sec", Label: "RDB last bgsave (sec)", Diff: false},
+				{Name: "aof_last_rewrite_time_sec", Label: "AOF last rewrite (sec)", Diff: false},
+			},
+		},
+		"fork": {
+			Label: (labelPrefix + " Fork"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "latest_fork_usec", Label: "Latest fork (usec)", Diff: false},
 			},
 		},
 		"capacity": {
@@ -264,37 +1057,164 @@ func (m RedisPlugin) GraphDefinition() map[string]mp.Graphs {
 			Metrics: []mp.Metrics{
 				{Name: "percentage_of_memory", Label: "Percentage of memory", Diff: false},
 				{Name: "percentage_of_clients", Label: "Percentage of clients", Diff: false},
+				{Name: "keyspace_hit_rate", Label: "Keyspace hit rate", Diff: false},
 			},
 		},
 	}
 
+	if m.PerDB {
+		graphdef["keyspace.#"] = mp.Graphs{
+			Label: (labelPrefix + " Keyspace per DB"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "keys", Label: "Keys", Diff: false},
+				{Name: "expires", Label: "Keys with expiration", Diff: false},
+				{Name: "avg_ttl", Label: "Average TTL (ms)", Diff: false},
+			},
+		}
+	}
+
+	if m.EnableCommandstats {
+		graphdef["commandstats.#"] = mp.Graphs{
+			Label: (labelPrefix + " Command Stats"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "calls", Label: "Calls", Diff: true},
+				{Name: "usec_per_call", Label: "Usec per call", Diff: false},
+			},
+		}
+	}
+
+	if m.EnableLatency {
+		graphdef["latency.#"] = mp.Graphs{
+			Label: (labelPrefix + " Latency Events"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "latest", Label: "Latest (ms)", Diff: false},
+				{Name: "max", Label: "Max (ms)", Diff: false},
+			},
+		}
+	}
+
+	if m.MasterName != "" {
+		graphdef["sentinel"] = mp.Graphs{
+			Label: (labelPrefix + " Sentinel"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "sentinel_known_slaves", Label: "Known Slaves", Diff: false},
+				{Name: "sentinel_ok_slaves", Label: "OK Slaves", Diff: false},
+				{Name: "sentinel_known_sentinels", Label: "Known Sentinels", Diff: false},
+			},
+		}
+	}
+
+	if m.Cluster {
+		for k, v := range clusterGraphDefinition(labelPrefix) {
+			graphdef[k] = v
+		}
+	}
+
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host and the port, or the socket.
+// The master monitored through Sentinel is identified by its name, which is stable across failovers.
+func (m RedisPlugin) tempfile(tempfile string) string {
+	if m.MasterName != "" {
+		return pluginutil.Tempfile(tempfile, "redis", m.SentinelHost, m.SentinelPort, m.MasterName)
+	}
+	return pluginutil.Tempfile(tempfile, "redis", m.Host, m.Port, m.Socket)
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
-	optPort := flag.String("port", "6379", "Port")
-	optPassowrd := flag.String("password", "", "Password")
+	optPort := flag.String("port", "6379", "Port, or the comma-separated ports of the instances on the host")
+	optUsername := flag.String("username", "", "Username of the ACL (Redis 6 or later)")
+	optPassowrd := flag.String("password", "", "Password (or $MACKEREL_PLUGIN_REDIS_PASSWORD, $REDISCLI_AUTH)")
 	optSocket := flag.String("socket", "", "Server socket (overrides host and port)")
 	optPrefix := flag.String("metric-key-prefix", "redis", "Metric key prefix")
 	optTimeout := flag.Int("timeout", 5, "Timeout")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPerDB := flag.Bool("per-db", false, "Post the keys, the expires and the average TTL of each database as well")
+	optTLS := flag.Bool("tls", false, "Connect with TLS")
+	optTLSSkipVerify := flag.Bool("tls-skip-verify", false, "Skip the verification of the server certificate")
+	optTLSCACert := flag.String("tls-ca-cert", "", "CA certificate file to verify the server certificate")
+	optTLSCert := flag.String("tls-cert", "", "Client certificate file")
+	optTLSKey := flag.String("tls-key", "", "Client private key file")
+	optSentinelHost := flag.String("sentinel-host", "localhost", "Hostname of Sentinel")
+	optSentinelPort := flag.String("sentinel-port", "26379", "Port of Sentinel")
+	optMasterName := flag.String("master-name", "", "Name of the master monitored by Sentinel, which enables to find the current master through Sentinel")
+	optCluster := flag.Bool("cluster", false, "Post the metrics of the whole Redis Cluster and of each master in it, found from the node")
+	optEnableCommandstats := flag.Bool("enable-commandstats", false, "Post the calls and the usec per call of each command of INFO commandstats")
+	optCommandstatsLimit := flag.Int("commandstats-limit", 0, "Post only the top N commands by calls with -enable-commandstats (0: all)")
+	optEnableLatency := flag.Bool("enable-latency", false, "Post the latency events of LATENCY LATEST")
+	optEnableSlowlog := flag.Bool("enable-slowlog", true, "Post the length of the slow log by SLOWLOG LEN")
+	optConfigCommand := flag.String("config-command", "CONFIG", "Name of the CONFIG command renamed by rename-command, or empty to skip the capacity metrics")
+	optMaxExecutionTime := pluginutil.MaxExecutionTimeFlag(flag.CommandLine)
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_REDIS_PASSWORD", "REDISCLI_AUTH")
 
 	redis := RedisPlugin{
-		Timeout: *optTimeout,
-		Prefix:  *optPrefix,
+		Timeout:       *optTimeout,
+		Prefix:        *optPrefix,
+		PerDB:         *optPerDB,
+		UseTLS:        *optTLS,
+		TLSSkipVerify: *optTLSSkipVerify,
+		TLSCACert:     *optTLSCACert,
+		TLSCert:       *optTLSCert,
+		TLSKey:        *optTLSKey,
+		SentinelHost:  *optSentinelHost,
+		SentinelPort:  *optSentinelPort,
+		MasterName:    *optMasterName,
+		Cluster:       *optCluster,
+		ConfigCommand: *optConfigCommand,
+
+		EnableCommandstats: *optEnableCommandstats,
+		CommandstatsLimit:  *optCommandstatsLimit,
+		EnableLatency:      *optEnableLatency,
+		DisableSlowlog:     !*optEnableSlowlog,
+		MaxExecutionTime:   *optMaxExecutionTime,
 	}
 	if *optSocket != "" {
 		redis.Socket = *optSocket
 	} else {
 		redis.Host = *optHost
 		redis.Port = *optPort
+		if ports := strings.Split(*optPort, ","); len(ports) > 1 {
+			redis.Ports = ports
+		}
+		redis.Username = *optUsername
 		redis.Password = *optPassowrd
 	}
+	if len(redis.Ports) > 1 && (redis.Cluster || redis.MasterName != "") {
+		logger.Fatalf("the comma-separated ports cannot be used with -cluster or -master-name")
+	}
+	if redis.ConfigCommand == "" {
+		redis.DisableCapacity = true
+	}
+	if redis.MasterName != "" && !isFlagPassed("host") && !isFlagPassed("port") {
+		// there is no address to fall back on when Sentinel is unreachable
+		redis.Host = ""
+	}
 	helper := mp.NewMackerelPlugin(redis)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = redis.tempfile(*optTempfile)
 
+	if os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		lv, _ := helper.FetchLastValues()
+		redis.lastStat = lv.Values
+		helper.Plugin = redis
+	}
 	helper.Run()
 }
+
+// isFlagPassed reports whether the flag is given on the command line
+func isFlagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
@@ -1,10 +1,29 @@
 package mpredis
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/soh335/go-test-redisserver"
 )
 
@@ -149,3 +168,1141 @@ func TestFetchMetrics(t *testing.T) {
 		}
 	}
 }
+
+// stubInfo is the reply of INFO of the stub server
+var stubInfo = "# Clients\r\nconnected_clients:2\r\n# Memory\r\nused_memory:1024\r\n# Stats\r\ntotal_commands_processed:10\r\nexpired_keys:3\r\n# Keyspace\r\ndb0:keys=5,expires=1,avg_ttl=0\r\n"
+
+// serveStub answers the commands in RESP with handle until the listener is closed
+func serveStub(l net.Listener, handle func(args []string) string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				args, err := readCommand(r)
+				if err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte(handle(args))); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimRight(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func stubHandler(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "INFO":
+		return bulkString(stubInfo)
+	case "CONFIG":
+		if len(args) == 3 {
+			value := "0"
+			if args[2] == "maxclients" {
+				value = "100"
+			}
+			return "*2\r\n" + bulkString(args[2]) + bulkString(value)
+		}
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its key into dir
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestFetchMetricsTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCertificate(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveStub(l, stubHandler)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	redis := RedisPlugin{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Timeout:   5,
+		UseTLS:    true,
+		TLSCACert: certFile,
+	}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"connected_clients":     2,
+		"used_memory":           1024,
+		"keys":                  5,
+		"expires":               1,
+		"expired":               3,
+		"percentage_of_memory":  0,
+		"percentage_of_clients": 2,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+
+	// the self-signed certificate is not trusted without -tls-ca-cert
+	redis.TLSCACert = ""
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("the verification of the server certificate should fail")
+	}
+	redis.TLSSkipVerify = true
+	if _, err := redis.FetchMetrics(); err != nil {
+		t.Errorf("something went wrong with -tls-skip-verify: %s", err)
+	}
+}
+
+func TestFetchMetricsTLSHandshakeTimeout(t *testing.T) {
+	// a listener which never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	redis := RedisPlugin{
+		Host:          "127.0.0.1",
+		Port:          port,
+		Timeout:       1,
+		UseTLS:        true,
+		TLSSkipVerify: true,
+	}
+	start := time.Now()
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("the handshake should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the handshake should time out in the timeout: %s", elapsed)
+	}
+}
+
+func listenStub(t *testing.T, handle func(args []string) string) (net.Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveStub(l, handle)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return l, port
+}
+
+func TestFetchMetricsAuth(t *testing.T) {
+	var mu sync.Mutex
+	var auth [][]string
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) != "AUTH" {
+			return stubHandler(args)
+		}
+		mu.Lock()
+		auth = append(auth, args[1:])
+		mu.Unlock()
+		switch {
+		case len(args) == 2 && args[1] == "secret":
+			return "+OK\r\n"
+		case len(args) == 3 && args[1] == "mackerel" && args[2] == "secret":
+			return "+OK\r\n"
+		case len(args) == 3 && args[1] == "readonly":
+			return "-NOPERM this user has no permissions to run the 'info' command\r\n"
+		}
+		return "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+	})
+	defer l.Close()
+
+	for _, tt := range []struct {
+		username, password string
+		auth               []string
+		err                string
+	}{
+		{"", "secret", []string{"secret"}, ""},
+		{"mackerel", "secret", []string{"mackerel", "secret"}, ""},
+		{"mackerel", "wrong", []string{"mackerel", "wrong"}, "authentication failed: invalid username or password"},
+		{"readonly", "secret", []string{"readonly", "secret"}, "authentication failed: the user has no permissions"},
+		{"", "", nil, ""},
+	} {
+		mu.Lock()
+		auth = nil
+		mu.Unlock()
+		redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, Username: tt.username, Password: tt.password}
+		_, err := redis.FetchMetrics()
+		mu.Lock()
+		sent := auth
+		mu.Unlock()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("something went wrong with %q: %s", tt.username, err)
+			}
+		} else if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("error should start with %q: %v", tt.err, err)
+		}
+		if len(tt.auth) == 0 && len(sent) != 0 || len(tt.auth) != 0 && (len(sent) != 1 || strings.Join(sent[0], " ") != strings.Join(tt.auth, " ")) {
+			t.Errorf("AUTH should be sent with %v: %v", tt.auth, sent)
+		}
+	}
+}
+
+func TestFetchMetricsPerDB(t *testing.T) {
+	var mu sync.Mutex
+	const header = "# Clients\r\nconnected_clients:2\r\n# Memory\r\nused_memory:1024\r\n"
+	info := header + "# Keyspace\r\ndb0:keys=5,expires=1,avg_ttl=0\r\ndb3:keys=10,expires=4,avg_ttl=3600000\r\n"
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			mu.Lock()
+			defer mu.Unlock()
+			return bulkString(info)
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["keys"] != 15.0 || stat["expires"] != 5.0 {
+		t.Errorf("keys and expires should be summed: %v, %v", stat["keys"], stat["expires"])
+	}
+	if _, ok := stat["keyspace.db0.keys"]; ok {
+		t.Errorf("keyspace.db0.keys should not be posted without -per-db")
+	}
+	if _, ok := redis.GraphDefinition()["keyspace.#"]; ok {
+		t.Errorf("keyspace.# should not be defined without -per-db")
+	}
+
+	redis.PerDB = true
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"keys":                 15,
+		"expires":              5,
+		"keyspace.db0.keys":    5,
+		"keyspace.db0.expires": 1,
+		"keyspace.db0.avg_ttl": 0,
+		"keyspace.db3.keys":    10,
+		"keyspace.db3.expires": 4,
+		"keyspace.db3.avg_ttl": 3600000,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := redis.GraphDefinition()["keyspace.#"]; !ok {
+		t.Errorf("keyspace.# should be defined with -per-db")
+	}
+
+	// the database whose keys are all deleted is not reported
+	mu.Lock()
+	info = header + "# Keyspace\r\ndb3:keys=10,expires=4,avg_ttl=3600000\r\n"
+	mu.Unlock()
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if _, ok := stat["keyspace.db0.keys"]; ok {
+		t.Errorf("keyspace.db0.keys should not be posted after db0 disappears")
+	}
+	if stat["keys"] != 10.0 {
+		t.Errorf("keys should be 10: %v", stat["keys"])
+	}
+}
+
+func TestTempfile(t *testing.T) {
+	p := RedisPlugin{Host: "localhost", Port: "6379"}
+	for field, other := range map[string]RedisPlugin{
+		"Host":       {Host: "127.0.0.1", Port: "6379"},
+		"Port":       {Host: "localhost", Port: "6380"},
+		"Socket":     {Host: "localhost", Port: "6379", Socket: "/tmp/redis.sock"},
+		"MasterName": {Host: "localhost", Port: "6379", SentinelHost: "localhost", SentinelPort: "26379", MasterName: "mymaster"},
+	} {
+		if other.tempfile("") == p.tempfile("") {
+			t.Errorf("the default tempfile should change with %s: %s", field, p.tempfile(""))
+		}
+	}
+	if f := p.tempfile("/tmp/redis.json"); f != "/tmp/redis.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+func TestFetchMetricsReplication(t *testing.T) {
+	var mu sync.Mutex
+	const header = "# Clients\r\nconnected_clients:2\r\n# Memory\r\nused_memory:1024\r\n"
+	info := header + "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n" +
+		"slave0:ip=10.0.0.2,port=6379,state=online,offset=1000,lag=0\r\n" +
+		"slave1:ip=10.0.0.3,port=6380,state=online,offset=1500,lag=1\r\n" +
+		"master_replid:8c1d3d5e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c\r\nmaster_repl_offset:1500\r\n"
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			mu.Lock()
+			defer mu.Unlock()
+			return bulkString(info)
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"master_repl_offset":                           1500,
+		"connected_slaves":                             2,
+		"replication_delay.10_0_0_2_6379.offset_delay": 500,
+		"replication_delay.10_0_0_3_6380.offset_delay": 0,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := stat["master_link_down_since_seconds"]; ok {
+		t.Errorf("master_link_down_since_seconds should not be posted on master")
+	}
+
+	mu.Lock()
+	info = header + "# Replication\r\nrole:slave\r\nmaster_host:10.0.0.1\r\nmaster_port:6379\r\nmaster_link_status:up\r\n" +
+		"master_last_io_seconds_ago:1\r\nslave_repl_offset:1400\r\nconnected_slaves:0\r\nmaster_repl_offset:1400\r\n"
+	mu.Unlock()
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"slave_repl_offset":              1400,
+		"master_last_io_seconds_ago":     1,
+		"master_link_down_since_seconds": 0,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+
+	mu.Lock()
+	info = header + "# Replication\r\nrole:slave\r\nmaster_link_status:down\r\nmaster_last_io_seconds_ago:-1\r\n" +
+		"master_link_down_since_seconds:30\r\nslave_repl_offset:1400\r\nmaster_repl_offset:1400\r\n"
+	mu.Unlock()
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["master_link_down_since_seconds"] != 30.0 {
+		t.Errorf("master_link_down_since_seconds should be 30: %v", stat["master_link_down_since_seconds"])
+	}
+}
+
+func multiBulk(elems ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(elems))
+	for _, e := range elems {
+		s += bulkString(e)
+	}
+	return s
+}
+
+// sentinelHandler answers as Sentinel monitoring the master mymaster at 127.0.0.1:port with two replicas, one of which is down
+func sentinelHandler(port string) func(args []string) string {
+	return func(args []string) string {
+		if strings.ToUpper(args[0]) != "SENTINEL" || len(args) != 3 {
+			return "-ERR unknown command\r\n"
+		}
+		if args[2] != "mymaster" {
+			if args[1] == "get-master-addr-by-name" {
+				return "*-1\r\n"
+			}
+			return "-ERR No such master with that name\r\n"
+		}
+		switch args[1] {
+		case "get-master-addr-by-name":
+			return multiBulk("127.0.0.1", port)
+		case "master":
+			return multiBulk("name", "mymaster", "ip", "127.0.0.1", "port", port, "flags", "master", "num-slaves", "2", "num-other-sentinels", "2", "quorum", "2")
+		case "slaves":
+			return "*2\r\n" +
+				multiBulk("name", "10.0.0.2:6379", "flags", "slave", "master-link-status", "ok") +
+				multiBulk("name", "10.0.0.3:6379", "flags", "s_down,slave,disconnected", "master-link-status", "err")
+		}
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestFetchMetricsSentinel(t *testing.T) {
+	l, port := listenStub(t, stubHandler)
+	defer l.Close()
+	sl, sentinelPort := listenStub(t, sentinelHandler(port))
+	defer sl.Close()
+
+	redis := RedisPlugin{SentinelHost: "127.0.0.1", SentinelPort: sentinelPort, MasterName: "mymaster", Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"total_commands_processed": 10,
+		"sentinel_known_slaves":    2,
+		"sentinel_ok_slaves":       1,
+		"sentinel_known_sentinels": 3,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := redis.GraphDefinition()["sentinel"]; !ok {
+		t.Errorf("sentinel should be defined with -master-name")
+	}
+	if _, ok := (RedisPlugin{}).GraphDefinition()["sentinel"]; ok {
+		t.Errorf("sentinel should not be defined without -master-name")
+	}
+
+	// the tempfile stays the same after the failover
+	moved := redis
+	moved.Host, moved.Port = "10.0.0.2", "6379"
+	if redis.tempfile("") != moved.tempfile("") {
+		t.Errorf("the default tempfile should not depend on the address of the master")
+	}
+
+	redis.MasterName = "unknown"
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("the unknown master should be an error")
+	}
+}
+
+func TestFetchMetricsSentinelFallback(t *testing.T) {
+	l, port := listenStub(t, stubHandler)
+	defer l.Close()
+	sl, sentinelPort := listenStub(t, nil)
+	sl.Close()
+
+	redis := RedisPlugin{SentinelHost: "127.0.0.1", SentinelPort: sentinelPort, MasterName: "mymaster", Timeout: 5}
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("unreachable Sentinel should be an error without the explicit address")
+	}
+
+	redis.Host = "127.0.0.1"
+	redis.Port = port
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("the explicit address should be used when Sentinel is unreachable: %s", err)
+	}
+	if stat["total_commands_processed"] != 10.0 {
+		t.Errorf("total_commands_processed should be 10: %v", stat["total_commands_processed"])
+	}
+	if _, ok := stat["sentinel_known_slaves"]; ok {
+		t.Errorf("the Sentinel metrics should not be posted without Sentinel")
+	}
+}
+
+func TestFetchMetricsMaxExecutionTime(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "CONFIG" {
+			<-hang
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	// the metrics from INFO are posted even if CONFIG GET hangs
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, MaxExecutionTime: 200 * time.Millisecond}
+	start := time.Now()
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("the metrics fetched before the deadline should be posted: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("FetchMetrics should return at the deadline: %s", elapsed)
+	}
+	if stat["total_commands_processed"] != 10.0 {
+		t.Errorf("total_commands_processed should be 10: %v", stat["total_commands_processed"])
+	}
+	if _, ok := stat["percentage_of_memory"]; ok {
+		t.Errorf("percentage_of_memory should not be posted after the deadline")
+	}
+
+	hl, hangPort := listenStub(t, func(args []string) string {
+		<-hang
+		return stubHandler(args)
+	})
+	defer hl.Close()
+	redis.Port = hangPort
+	_, err = redis.FetchMetrics()
+	if err == nil || err.Error() != "deadline exceeded while running info command" {
+		t.Errorf("the error should tell the deadline is exceeded while running INFO: %v", err)
+	}
+}
+
+func TestFetchMetricsCommandTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	// the server accepts the connection but never answers INFO
+	l, port := listenStub(t, func(args []string) string {
+		<-hang
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 1}
+	start := time.Now()
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("INFO should time out")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("INFO should time out in the timeout: %s", elapsed)
+	}
+}
+
+func TestFetchMetricsPersistence(t *testing.T) {
+	info := stubInfo + "# Persistence\r\nloading:0\r\nrdb_changes_since_last_save:42\r\nrdb_bgsave_in_progress:0\r\n" +
+		"rdb_last_bgsave_status:err\r\nrdb_last_bgsave_time_sec:3\r\naof_enabled:1\r\naof_rewrite_in_progress:1\r\n" +
+		"aof_last_rewrite_time_sec:-1\r\naof_last_bgrewrite_status:ok\r\naof_last_write_status:ok\r\n" +
+		"# Stats\r\nlatest_fork_usec:512\r\n"
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString(info)
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"rdb_last_bgsave_status":      1,
+		"aof_last_bgrewrite_status":   0,
+		"aof_last_write_status":       0,
+		"rdb_changes_since_last_save": 42,
+		"rdb_last_bgsave_time_sec":    3,
+		"aof_rewrite_in_progress":     1,
+		"latest_fork_usec":            512,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := redis.GraphDefinition()["persistence"]; !ok {
+		t.Errorf("persistence should be defined")
+	}
+}
+
+func TestFetchMetricsEvictions(t *testing.T) {
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString(stubInfo + "evicted_keys:7\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	// float64 rather than uint64, so that the reset of the counters is not taken as a wrap-around
+	for k, v := range map[string]float64{"evicted_keys": 7, "expired_keys": 3, "expired": 3} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	for _, m := range redis.GraphDefinition()["evictions"].Metrics {
+		if !m.Diff || m.Type != "" {
+			t.Errorf("%s should be a float counter with Diff", m.Name)
+		}
+	}
+}
+
+func TestFetchMetricsConfigCommand(t *testing.T) {
+	var mu sync.Mutex
+	var configs int
+	l, port := listenStub(t, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "CONFIG":
+			mu.Lock()
+			configs++
+			mu.Unlock()
+			return "-ERR unknown command 'CONFIG'\r\n"
+		case "MYCONFIG":
+			args[0] = "CONFIG"
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, ConfigCommand: "MYCONFIG"}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["percentage_of_clients"] != 2.0 {
+		t.Errorf("percentage_of_clients should be fetched with the renamed command: %v", stat["percentage_of_clients"])
+	}
+
+	redis = RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, DisableCapacity: true}
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if _, ok := stat["percentage_of_memory"]; ok {
+		t.Errorf("percentage_of_memory should not be posted with DisableCapacity")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if configs != 0 {
+		t.Errorf("CONFIG should not be sent: %d", configs)
+	}
+	if stat["keys"] != 5.0 {
+		t.Errorf("the metrics from INFO should be posted: %v", stat["keys"])
+	}
+}
+
+func TestFetchMetricsNetwork(t *testing.T) {
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString(stubInfo + "instantaneous_ops_per_sec:12\r\ntotal_net_input_bytes:1024\r\ntotal_net_output_bytes:18446744073709551000\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["instantaneous_ops_per_sec"] != 12.0 {
+		t.Errorf("instantaneous_ops_per_sec should be 12: %v", stat["instantaneous_ops_per_sec"])
+	}
+	if stat["total_net_input_bytes"] != uint64(1024) {
+		t.Errorf("total_net_input_bytes should be 1024 as uint64: %#v", stat["total_net_input_bytes"])
+	}
+	// the counter beyond the precision of float64 is kept exactly
+	if stat["total_net_output_bytes"] != uint64(18446744073709551000) {
+		t.Errorf("total_net_output_bytes should be kept as uint64: %#v", stat["total_net_output_bytes"])
+	}
+	for _, m := range redis.GraphDefinition()["network"].Metrics {
+		if !m.Diff || m.Type != "uint64" {
+			t.Errorf("%s should be a uint64 counter with Diff", m.Name)
+		}
+	}
+}
+
+func TestFetchMetricsFragmentation(t *testing.T) {
+	tests := []struct {
+		name     string
+		info     string
+		expected map[string]float64
+		missing  []string
+	}{
+		{
+			name: "Redis 3.2",
+			info: "# Memory\r\nused_memory:1024\r\nused_memory_rss:2048\r\nmem_fragmentation_ratio:2.00\r\nmem_allocator:jemalloc-4.0.3\r\n",
+			expected: map[string]float64{
+				"mem_fragmentation_ratio": 2,
+			},
+			missing: []string{"allocator_allocated", "allocator_active", "allocator_resident", "allocator_frag_ratio"},
+		},
+		{
+			name: "Redis 6.2",
+			info: "# Memory\r\nused_memory:1024\r\nused_memory_rss:2048\r\nallocator_allocated:1100\r\nallocator_active:1650\r\nallocator_resident:1800\r\nallocator_frag_ratio:1.50\r\nmem_fragmentation_ratio:2.00\r\nmem_allocator:jemalloc-5.1.0\r\n",
+			expected: map[string]float64{
+				"mem_fragmentation_ratio": 2,
+				"allocator_frag_ratio":    1.5,
+				"allocator_allocated":     1100,
+				"allocator_active":        1650,
+				"allocator_resident":      1800,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, port := listenStub(t, func(args []string) string {
+				if strings.ToUpper(args[0]) == "INFO" {
+					return bulkString("# Clients\r\nconnected_clients:2\r\n" + tt.info)
+				}
+				return stubHandler(args)
+			})
+			defer l.Close()
+
+			redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+			stat, err := redis.FetchMetrics()
+			if err != nil {
+				t.Fatalf("something went wrong: %s", err)
+			}
+			for k, v := range tt.expected {
+				if stat[k] != v {
+					t.Errorf("%s should be %v: %v", k, v, stat[k])
+				}
+			}
+			for _, k := range tt.missing {
+				if _, ok := stat[k]; ok {
+					t.Errorf("%s should not be posted: %v", k, stat[k])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchMetricsSlowlog(t *testing.T) {
+	var mu sync.Mutex
+	var slowlogs [][]string
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "SLOWLOG" {
+			mu.Lock()
+			slowlogs = append(slowlogs, args[1:])
+			mu.Unlock()
+			return ":12\r\n"
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["slowlog_length"] != 12.0 {
+		t.Errorf("slowlog_length should be 12: %v", stat["slowlog_length"])
+	}
+	mu.Lock()
+	if fmt.Sprint(slowlogs) != "[[LEN]]" {
+		t.Errorf("only SLOWLOG LEN should be sent: %v", slowlogs)
+	}
+	mu.Unlock()
+
+	redis.DisableSlowlog = true
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if _, ok := stat["slowlog_length"]; ok {
+		t.Errorf("slowlog_length should not be posted with DisableSlowlog")
+	}
+
+	// SLOWLOG denied by the ACL is skipped
+	denied, deniedPort := listenStub(t, stubHandler)
+	defer denied.Close()
+	redis = RedisPlugin{Host: "127.0.0.1", Port: deniedPort, Timeout: 5}
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if _, ok := stat["slowlog_length"]; ok {
+		t.Errorf("slowlog_length should not be posted without SLOWLOG")
+	}
+	if stat["percentage_of_clients"] != 2.0 {
+		t.Errorf("the capacity should be posted without SLOWLOG: %v", stat["percentage_of_clients"])
+	}
+}
+
+func TestFetchMetricsInstances(t *testing.T) {
+	l1, port1 := listenStub(t, stubHandler)
+	defer l1.Close()
+	l2, port2 := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString("# Clients\r\nconnected_clients:7\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l2.Close()
+	down, downPort := listenStub(t, nil)
+	down.Close()
+
+	single := RedisPlugin{Host: "127.0.0.1", Port: port1, Timeout: 5, PerDB: true}
+	singleStat, err := single.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+
+	redis := RedisPlugin{Host: "127.0.0.1", Timeout: 5, Ports: []string{port1, port2, downPort}, PerDB: true}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	graphdef := redis.GraphDefinition()
+
+	// the keys should be looked up by the helper with the wildcard graphs of the instances
+	for k := range stat {
+		if !matchesGraphDefinition(graphdef, k) {
+			t.Errorf("%s matches no metrics of the graphs", k)
+		}
+		if strings.HasPrefix(k, downPort+".") {
+			t.Errorf("the unreachable instance should be skipped: %s", k)
+		}
+	}
+	// the metrics posted by an instance should be posted for the instance as well
+	for key, graph := range single.GraphDefinition() {
+		for _, metric := range graph.Metrics {
+			if !posted(singleStat, key, metric.Name) {
+				continue
+			}
+			if !anyKeyMatches(stat, graphMetricRe(port1+"."+key, metric.Name)) {
+				t.Errorf("%s.%s of the instance %s should be posted", key, metric.Name, port1)
+			}
+		}
+	}
+	for k, v := range map[string]float64{
+		port1 + ".clients.connected_clients":        2,
+		port1 + ".queries.total_commands_processed": 10,
+		port1 + ".keyspace.db0.keys":                5,
+		port2 + ".clients.connected_clients":        7,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := stat["connected_clients"]; ok {
+		t.Errorf("the metrics should be namespaced by the port")
+	}
+
+	if _, ok := graphdef["#.memory"]; !ok {
+		t.Errorf("#.memory should be defined for the instances")
+	}
+	if _, ok := graphdef["memory"]; ok {
+		t.Errorf("memory should not be defined for the instances")
+	}
+
+	redis.Ports = []string{downPort, downPort}
+	if _, err := redis.FetchMetrics(); err == nil {
+		t.Errorf("all the instances unreachable should be an error")
+	}
+}
+
+// graphMetricRe returns the regexp of the keys of the metric in the graph, which the helper looks up the values by
+func graphMetricRe(key, name string) *regexp.Regexp {
+	re := strings.Replace(`\A`+key+"."+name+`\z`, ".", "\\.", -1)
+	re = strings.Replace(re, "#", "[-a-zA-Z0-9_]+", -1)
+	return regexp.MustCompile(strings.Replace(re, "*", "[-a-zA-Z0-9_]+", -1))
+}
+
+func matchesGraphDefinition(graphdef map[string]mp.Graphs, k string) bool {
+	for key, graph := range graphdef {
+		for _, metric := range graph.Metrics {
+			if graphMetricRe(key, metric.Name).MatchString(k) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// posted reports whether the metric of the graph is in the stat. The non-wildcard metrics of the non-wildcard graphs
+// are keyed by the names of the metrics.
+func posted(stat map[string]interface{}, key, name string) bool {
+	if !strings.ContainsAny(key+name, "#*") {
+		_, ok := stat[name]
+		return ok
+	}
+	return anyKeyMatches(stat, graphMetricRe(key, name))
+}
+
+func anyKeyMatches(stat map[string]interface{}, re *regexp.Regexp) bool {
+	for k := range stat {
+		if re.MatchString(k) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFetchMetricsTruncatedInfo(t *testing.T) {
+	// proxies such as twemproxy reply INFO without connected_clients and used_memory
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString("# Server\r\nredis_version:3.2.0\r\n# Stats\r\ntotal_commands_processed:10\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["total_commands_processed"] != 10.0 {
+		t.Errorf("total_commands_processed should be 10: %v", stat["total_commands_processed"])
+	}
+	for _, k := range []string{"percentage_of_memory", "percentage_of_clients"} {
+		if _, ok := stat[k]; ok {
+			t.Errorf("%s should not be posted without INFO: %v", k, stat[k])
+		}
+	}
+}
+
+func TestFetchMetricsLatency(t *testing.T) {
+	events := "*2\r\n" +
+		"*4\r\n" + bulkString("command") + ":1405067976\r\n:251\r\n:1001\r\n" +
+		"*4\r\n" + bulkString("aof-write") + ":1405067968\r\n:12\r\n:45\r\n"
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "LATENCY" {
+			return events
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, EnableLatency: true}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"latency.command.latest":   251,
+		"latency.command.max":      1001,
+		"latency.aof_write.latest": 12,
+		"latency.aof_write.max":    45,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := redis.GraphDefinition()["latency.#"]; !ok {
+		t.Errorf("latency.# should be defined with EnableLatency")
+	}
+
+	// the latency monitor is disabled
+	events = "*0\r\n"
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k := range stat {
+		if strings.HasPrefix(k, "latency.") {
+			t.Errorf("%s should not be posted without the events", k)
+		}
+	}
+}
+
+func TestSetKeyspaceHitRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hits     float64
+		misses   float64
+		expected interface{}
+	}{
+		{name: "lookups", hits: 190, misses: 60, expected: 90.0},
+		{name: "no lookups", hits: 100, misses: 50, expected: nil},
+		{name: "restarted", hits: 3, misses: 1, expected: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lastStat := map[string]interface{}{"keyspace_hits": 100.0, "keyspace_misses": 50.0}
+			stat := map[string]interface{}{"keyspace_hits": tt.hits, "keyspace_misses": tt.misses}
+			setKeyspaceHitRate(stat, lastStat, "")
+			if v, ok := stat["keyspace_hit_rate"]; tt.expected == nil && ok || tt.expected != nil && v != tt.expected {
+				t.Errorf("keyspace_hit_rate should be %v: %v", tt.expected, v)
+			}
+		})
+	}
+
+	// the first run has no last values
+	stat := map[string]interface{}{"keyspace_hits": 10.0, "keyspace_misses": 5.0}
+	setKeyspaceHitRate(stat, nil, "")
+	if _, ok := stat["keyspace_hit_rate"]; ok {
+		t.Errorf("keyspace_hit_rate should not be posted without the last values")
+	}
+}
+
+func TestFetchMetricsKeyspaceHitRate(t *testing.T) {
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString(stubInfo + "keyspace_hits:130\r\nkeyspace_misses:70\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	redis.lastStat = map[string]interface{}{"keyspace_hits": 100.0, "keyspace_misses": 60.0}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["keyspace_hit_rate"] != 75.0 {
+		t.Errorf("keyspace_hit_rate should be 75: %v", stat["keyspace_hit_rate"])
+	}
+
+	redis = RedisPlugin{Host: "127.0.0.1", Timeout: 5, Ports: []string{port, port}}
+	redis.lastStat = map[string]interface{}{port + ".keyspace.keyspace_hits": 120.0, port + ".keyspace.keyspace_misses": 70.0}
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat[port+".capacity.keyspace_hit_rate"] != 100.0 {
+		t.Errorf("keyspace_hit_rate of the instance should be 100: %v", stat[port+".capacity.keyspace_hit_rate"])
+	}
+}
+
+func TestFetchMetricsKeyspaceHitRateWithTempfile(t *testing.T) {
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" {
+			return bulkString(stubInfo + "keyspace_hits:130\r\nkeyspace_misses:70\r\n")
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	f, err := ioutil.TempFile("", "mackerel-plugin-redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// the values of the last run saved by the helper
+	fmt.Fprintf(f, `{"_lastTime": %d, "keyspace_hits": 90, "keyspace_misses": 10}`, time.Now().Add(-time.Minute).Unix())
+	f.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5}
+	helper := mp.NewMackerelPlugin(redis)
+	helper.Tempfile = f.Name()
+	lv, err := helper.FetchLastValues()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	redis.lastStat = lv.Values
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if stat["keyspace_hit_rate"] != 40.0 {
+		t.Errorf("keyspace_hit_rate should be 40: %v", stat["keyspace_hit_rate"])
+	}
+}
+
+func TestFetchMetricsCommandstats(t *testing.T) {
+	commandstats := "# Commandstats\r\n" +
+		"cmdstat_get:calls=300,usec=900,usec_per_call=3.00,rejected_calls=0,failed_calls=0\r\n" +
+		"cmdstat_set:calls=100,usec=500,usec_per_call=5.00\r\n" +
+		"cmdstat_client|list:calls=5,usec=150,usec_per_call=30.00,rejected_calls=0,failed_calls=0\r\n"
+	l, port := listenStub(t, func(args []string) string {
+		if strings.ToUpper(args[0]) == "INFO" && len(args) == 2 && args[1] == "commandstats" {
+			return bulkString(commandstats)
+		}
+		return stubHandler(args)
+	})
+	defer l.Close()
+
+	redis := RedisPlugin{Host: "127.0.0.1", Port: port, Timeout: 5, EnableCommandstats: true}
+	stat, err := redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	for k, v := range map[string]float64{
+		"commandstats.get.calls":                 300,
+		"commandstats.get.usec_per_call":         3,
+		"commandstats.set.calls":                 100,
+		"commandstats.client_list.calls":         5,
+		"commandstats.client_list.usec_per_call": 30,
+		"total_commands_processed":               10,
+	} {
+		if stat[k] != v {
+			t.Errorf("%s should be %v: %v", k, v, stat[k])
+		}
+	}
+	if _, ok := redis.GraphDefinition()["commandstats.#"]; !ok {
+		t.Errorf("commandstats.# should be defined with EnableCommandstats")
+	}
+
+	redis.CommandstatsLimit = 2
+	stat, err = redis.FetchMetrics()
+	if err != nil {
+		t.Fatalf("something went wrong: %s", err)
+	}
+	if _, ok := stat["commandstats.client_list.calls"]; ok {
+		t.Errorf("only the top 2 commands by calls should be posted")
+	}
+	if _, ok := stat["commandstats.set.calls"]; !ok {
+		t.Errorf("the top 2 commands by calls should be posted")
+	}
+}
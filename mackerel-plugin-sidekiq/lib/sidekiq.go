@@ -1,12 +1,23 @@
 package mpsidekiq
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	r "github.com/go-redis/redis"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // SidekiqPlugin for fetching metrics
@@ -37,9 +48,40 @@ var graphdef = map[string]mp.Graphs{
 	},
 }
 
+var queueGraphdef = map[string]mp.Graphs{
+	"queue_size.#": {
+		Label: "Sidekiq queue size",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "size", Label: "Size", Type: "uint64"},
+		},
+	},
+	"queue_latency.#": {
+		Label: "Sidekiq queue latency",
+		Unit:  "float",
+		Metrics: []mp.Metrics{
+			{Name: "latency_seconds", Label: "Latency (seconds)"},
+		},
+	},
+	"process_busy.#": {
+		Label: "Sidekiq process busy threads",
+		Unit:  "integer",
+		Metrics: []mp.Metrics{
+			{Name: "busy", Label: "Busy", Type: "uint64"},
+		},
+	},
+}
+
 // GraphDefinition Graph definition
 func (sp SidekiqPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	graphs := make(map[string]mp.Graphs, len(graphdef)+len(queueGraphdef))
+	for k, g := range graphdef {
+		graphs[k] = g
+	}
+	for k, g := range queueGraphdef {
+		graphs[k] = g
+	}
+	return graphs
 }
 
 func (sp SidekiqPlugin) get(key string) uint64 {
@@ -138,6 +180,69 @@ func (sp SidekiqPlugin) getDead() uint64 {
 	return sp.zCard("dead")
 }
 
+var invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// metricKey sanitizes the names of the queues and the identities of the processes to be used in metric names
+func metricKey(name string) string {
+	return invalidKeyRe.ReplaceAllString(name, "_")
+}
+
+// parseEnqueuedAt returns the seconds since enqueued_at of the job. enqueued_at is the epoch in seconds as a float
+// before Sidekiq 8, and in milliseconds as an integer since then.
+func parseEnqueuedAt(job string, now time.Time) (float64, error) {
+	var payload struct {
+		EnqueuedAt float64 `json:"enqueued_at"`
+	}
+	if err := json.Unmarshal([]byte(job), &payload); err != nil {
+		return 0, err
+	}
+	if payload.EnqueuedAt == 0 {
+		return 0, errors.New("no enqueued_at in the job")
+	}
+	enqueuedAt := payload.EnqueuedAt
+	if enqueuedAt > 1e11 {
+		enqueuedAt /= 1000
+	}
+	latency := float64(now.UnixNano())/float64(time.Second) - enqueuedAt
+	if latency < 0 {
+		return 0, nil
+	}
+	return latency, nil
+}
+
+// latency returns the age of the oldest job of the queue in seconds, which is 0 if the queue is empty
+func (sp SidekiqPlugin) latency(queue string, now time.Time) (float64, error) {
+	// jobs are pushed from the left and popped from the right
+	jobs, err := sp.Client.LRange("queue:"+queue, -1, -1).Result()
+	if err != nil && err != r.Nil {
+		return 0, err
+	}
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+	return parseEnqueuedAt(jobs[0], now)
+}
+
+// getQueueStats returns the sizes and the latencies of the queues, and the busy threads of the processes, which are
+// currently known by Sidekiq
+func (sp SidekiqPlugin) getQueueStats(now time.Time) map[string]interface{} {
+	stats := make(map[string]interface{})
+	for _, q := range sp.sMembers("queues") {
+		key := metricKey(q)
+		stats["queue_size."+key+".size"] = sp.lLen("queue:" + q)
+		latency, err := sp.latency(q, now)
+		if err != nil {
+			log.Printf("failed to get the latency of the queue %s: %s", q, err)
+			continue
+		}
+		stats["queue_latency."+key+".latency_seconds"] = latency
+	}
+	for _, p := range sp.sMembers("processes") {
+		stats["process_busy."+metricKey(p)+".busy"] = sp.hGet(p, "busy")
+	}
+	return stats
+}
+
 func (sp SidekiqPlugin) getProcessedFailed() map[string]interface{} {
 	data := make(map[string]interface{}, 20)
 
@@ -181,6 +286,9 @@ func (sp SidekiqPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 		return map1
 	}(stats, pf)
+	for k, v := range sp.getQueueStats(time.Now()) {
+		m[k] = v
+	}
 
 	return m, nil
 }
@@ -193,28 +301,124 @@ func (sp SidekiqPlugin) MetricKeyPrefix() string {
 	return sp.Prefix
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the address and the DB of redis
+func tempfile(tempfile, addr string, db int) string {
+	return pluginutil.Tempfile(tempfile, "sidekiq", addr, strconv.Itoa(db))
+}
+
+// TLSOptions are the options to connect to redis with TLS
+type TLSOptions struct {
+	SkipVerify bool
+	CACert     string
+	Cert       string
+	Key        string
+}
+
+// config builds the TLS configuration. ServerName is left empty to be the host of each connection, which may be
+// the master resolved by Sentinel.
+func (o TLSOptions) config() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.SkipVerify}
+	if o.CACert != "" {
+		pem, err := ioutil.ReadFile(o.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CACert)
+		}
+		config.RootCAs = pool
+	}
+	if o.Cert != "" || o.Key != "" {
+		if o.Cert == "" || o.Key == "" {
+			return nil, errors.New("both -tls-cert and -tls-key are required for a client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// parseSentinels parses the comma separated addresses of Sentinels, whose port defaults to 26379
+func parseSentinels(s string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, ":") {
+			addr += ":26379"
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "6379", "Port")
-	optPassword := flag.String("password", "", "Password")
+	optPassword := flag.String("password", "", "Password (or $MACKEREL_PLUGIN_SIDEKIQ_PASSWORD)")
 	optDB := flag.Int("db", 0, "DB")
 	optPrefix := flag.String("metric-key-prefix", "sidekiq", "Metric key prefix")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optTLS := flag.Bool("tls", false, "Connect with TLS")
+	var tlsOptions TLSOptions
+	flag.BoolVar(&tlsOptions.SkipVerify, "tls-skip-verify", false, "Skip the verification of the server certificate")
+	flag.StringVar(&tlsOptions.CACert, "tls-ca-cert", "", "CA certificate file to verify the server certificate")
+	flag.StringVar(&tlsOptions.Cert, "tls-cert", "", "Client certificate file")
+	flag.StringVar(&tlsOptions.Key, "tls-key", "", "Client private key file")
+	optSentinel := flag.String("sentinel", "", "Comma separated addresses of Sentinels like sentinel1:26379,sentinel2:26379")
+	optMasterName := flag.String("master-name", "", "Name of the master monitored by Sentinel")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_SIDEKIQ_PASSWORD")
+
+	var tlsConfig *tls.Config
+	if *optTLS {
+		var err error
+		if tlsConfig, err = tlsOptions.config(); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
-	client := r.NewClient(&r.Options{
-		Addr:     fmt.Sprintf("%s:%s", *optHost, *optPort),
-		Password: *optPassword,
-		DB:       *optDB,
-	})
+	addr := fmt.Sprintf("%s:%s", *optHost, *optPort)
+	var client *r.Client
+	if *optMasterName != "" {
+		sentinels := parseSentinels(*optSentinel)
+		if len(sentinels) == 0 {
+			log.Fatalln("-master-name requires -sentinel")
+		}
+		client = r.NewFailoverClient(&r.FailoverOptions{
+			MasterName:    *optMasterName,
+			SentinelAddrs: sentinels,
+			Password:      *optPassword,
+			DB:            *optDB,
+			TLSConfig:     tlsConfig,
+		})
+		// the tempfile follows the master name rather than the address of the current master
+		addr = *optMasterName
+	} else {
+		if *optSentinel != "" {
+			log.Fatalln("-sentinel requires -master-name")
+		}
+		client = r.NewClient(&r.Options{
+			Addr:      addr,
+			Password:  *optPassword,
+			DB:        *optDB,
+			TLSConfig: tlsConfig,
+		})
+	}
 
 	sp := SidekiqPlugin{
 		Client: client,
 		Prefix: *optPrefix,
 	}
 	helper := mp.NewMackerelPlugin(sp)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = tempfile(*optTempfile, addr, *optDB)
 
 	helper.Run()
 }
@@ -2,6 +2,7 @@ package mpsidekiq
 
 import (
 	"testing"
+	"time"
 )
 
 func TestGraphDefinition(t *testing.T) {
@@ -9,9 +10,62 @@ func TestGraphDefinition(t *testing.T) {
 
 	graphdef := sp.GraphDefinition()
 
-	expect := 2
+	expect := 5
 
 	if len(graphdef) != expect {
 		t.Errorf("GraphDefinition(): %d should be %d", len(graphdef), expect)
 	}
 }
+
+func TestTempfile(t *testing.T) {
+	f := tempfile("", "localhost:6379", 0)
+	if other := tempfile("", "localhost:6380", 0); other == f {
+		t.Errorf("the default tempfile should change with the address: %s", f)
+	}
+	if other := tempfile("", "localhost:6379", 1); other == f {
+		t.Errorf("the default tempfile should change with the DB: %s", f)
+	}
+	if f := tempfile("/tmp/sidekiq.json", "localhost:6379", 0); f != "/tmp/sidekiq.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+func TestParseEnqueuedAt(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	for _, tt := range []struct {
+		job     string
+		latency float64
+	}{
+		{`{"class":"HardWorker","enqueued_at":1700000040.5}`, 59.5},
+		// Sidekiq 8 or later
+		{`{"class":"HardWorker","enqueued_at":1700000070000}`, 30},
+		{`{"class":"HardWorker","enqueued_at":1700000200}`, 0},
+	} {
+		latency, err := parseEnqueuedAt(tt.job, now)
+		if err != nil {
+			t.Errorf("parseEnqueuedAt(%s) should succeed: %s", tt.job, err)
+		}
+		if latency != tt.latency {
+			t.Errorf("parseEnqueuedAt(%s): %f should be %f", tt.job, latency, tt.latency)
+		}
+	}
+	if _, err := parseEnqueuedAt(`{"class":"HardWorker"}`, now); err == nil {
+		t.Errorf("parseEnqueuedAt should fail without enqueued_at")
+	}
+}
+
+func TestMetricKey(t *testing.T) {
+	if k := metricKey("web-1.example.com:1234:0a1b2c"); k != "web-1_example_com_1234_0a1b2c" {
+		t.Errorf("metricKey: %s should be sanitized", k)
+	}
+}
+
+func TestParseSentinels(t *testing.T) {
+	addrs := parseSentinels("sentinel1, sentinel2:26380")
+	if len(addrs) != 2 || addrs[0] != "sentinel1:26379" || addrs[1] != "sentinel2:26380" {
+		t.Errorf("parseSentinels: %v should be [sentinel1:26379 sentinel2:26380]", addrs)
+	}
+	if addrs := parseSentinels(""); len(addrs) != 0 {
+		t.Errorf("parseSentinels: %v should be empty", addrs)
+	}
+}
@@ -0,0 +1,193 @@
+package mpsnmp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+	"github.com/soniah/gosnmp"
+)
+
+// V3Options options of SNMPv3 User-based Security Model
+type V3Options struct {
+	SecName      string
+	SecLevel     string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+}
+
+var authProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA256": gosnmp.SHA256,
+}
+
+var privProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"DES":    gosnmp.DES,
+	"AES":    gosnmp.AES,
+	"AES256": gosnmp.AES256,
+}
+
+var secLevels = map[string]gosnmp.SnmpV3MsgFlags{
+	"noauthnopriv": gosnmp.NoAuthNoPriv,
+	"authnopriv":   gosnmp.AuthNoPriv,
+	"authpriv":     gosnmp.AuthPriv,
+}
+
+// usmStatsErrors maps the OIDs of usmStats counters returned in Report PDUs to their meanings
+var usmStatsErrors = map[string]string{
+	".1.3.6.1.6.3.15.1.1.1.0": "unsupported security level",
+	".1.3.6.1.6.3.15.1.1.2.0": "not in time window",
+	".1.3.6.1.6.3.15.1.1.3.0": "unknown user name",
+	".1.3.6.1.6.3.15.1.1.4.0": "unknown engine ID",
+	".1.3.6.1.6.3.15.1.1.5.0": "wrong digest",
+	".1.3.6.1.6.3.15.1.1.6.0": "decryption error",
+}
+
+// engineIDDiscoveryRetries is the number of retries of requests including the engine ID discovery of SNMPv3
+const engineIDDiscoveryRetries = 3
+
+// protocolName normalizes the name of the protocol, e.g. SHA-256 to SHA256 as net-snmp accepts both
+func protocolName(s string) string {
+	return strings.ToUpper(strings.Replace(s, "-", "", -1))
+}
+
+func (o V3Options) securityParameters() (gosnmp.SnmpV3MsgFlags, *gosnmp.UsmSecurityParameters, error) {
+	if o.SecName == "" {
+		return 0, nil, fmt.Errorf("-sec-name (or -user) is required for SNMPv3")
+	}
+
+	level := strings.ToLower(o.SecLevel)
+	if level == "" {
+		switch {
+		case o.PrivPassword != "":
+			level = "authpriv"
+		case o.AuthPassword != "":
+			level = "authnopriv"
+		default:
+			level = "noauthnopriv"
+		}
+	}
+	flags, ok := secLevels[level]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown security level: %s", o.SecLevel)
+	}
+
+	params := &gosnmp.UsmSecurityParameters{
+		UserName:               o.SecName,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+	if flags == gosnmp.AuthNoPriv || flags == gosnmp.AuthPriv {
+		proto, ok := authProtocols[protocolName(o.AuthProtocol)]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown auth protocol: %s", o.AuthProtocol)
+		}
+		if o.AuthPassword == "" {
+			return 0, nil, fmt.Errorf("-auth-password is required for security level %s", level)
+		}
+		params.AuthenticationProtocol = proto
+		params.AuthenticationPassphrase = o.AuthPassword
+	}
+	if flags == gosnmp.AuthPriv {
+		proto, ok := privProtocols[protocolName(o.PrivProtocol)]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown priv protocol: %s", o.PrivProtocol)
+		}
+		if o.PrivPassword == "" {
+			return 0, nil, fmt.Errorf("-priv-password is required for security level %s", level)
+		}
+		params.PrivacyProtocol = proto
+		params.PrivacyPassphrase = o.PrivPassword
+	}
+	return flags, params, nil
+}
+
+// clientConfig returns the client of v2c, which sends each request once as before, or of v3, which retries the
+// requests failed on the engine ID discovery
+func (m SNMPPlugin) clientConfig() (*gosnmp.GoSNMP, error) {
+	s := &gosnmp.GoSNMP{
+		Target:    m.Host,
+		Port:      161,
+		Community: m.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   30 * time.Second,
+	}
+	if m.Timeout > 0 {
+		s.Timeout = m.Timeout
+	}
+
+	if m.V3 != nil {
+		flags, params, err := m.V3.securityParameters()
+		if err != nil {
+			return nil, err
+		}
+		s.Version = gosnmp.Version3
+		s.SecurityModel = gosnmp.UserSecurityModel
+		s.MsgFlags = flags
+		s.SecurityParameters = params
+		s.Retries = engineIDDiscoveryRetries
+	}
+	return s, nil
+}
+
+func (m SNMPPlugin) newClient() (*gosnmp.GoSNMP, error) {
+	s, err := m.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// deadlineClient shortens the timeout of each request so that the request and its retries end by the deadline of ctx
+type deadlineClient struct {
+	*gosnmp.GoSNMP
+	ctx     context.Context
+	timeout time.Duration
+}
+
+func newDeadlineClient(ctx context.Context, s *gosnmp.GoSNMP) deadlineClient {
+	return deadlineClient{GoSNMP: s, ctx: ctx, timeout: s.Timeout}
+}
+
+func requestTimeout(ctx context.Context, timeout time.Duration, retries int) time.Duration {
+	attempts := time.Duration(retries + 1)
+	return pluginutil.Timeout(ctx, timeout*attempts) / attempts
+}
+
+func (c deadlineClient) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	c.Timeout = requestTimeout(c.ctx, c.timeout, c.Retries)
+	return c.GoSNMP.Get(oids)
+}
+
+func (c deadlineClient) BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	c.Timeout = requestTimeout(c.ctx, c.timeout, c.Retries)
+	return c.GoSNMP.BulkWalkAll(rootOid)
+}
+
+// authError is an authentication failure of SNMPv3
+type authError string
+
+func (e authError) Error() string {
+	return "authentication failure: " + string(e)
+}
+
+// checkReport turns a Report PDU, which agents return for authentication failures of SNMPv3, into an error
+func checkReport(resp *gosnmp.SnmpPacket) error {
+	if resp.PDUType != gosnmp.Report {
+		return nil
+	}
+	for _, v := range resp.Variables {
+		if reason, ok := usmStatsErrors[v.Name]; ok {
+			return authError(reason)
+		}
+	}
+	return authError("unexpected report")
+}
@@ -0,0 +1,98 @@
+package mpsnmp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soniah/gosnmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecurityParameters(t *testing.T) {
+	flags, params, err := V3Options{
+		SecName:      "monitor",
+		AuthProtocol: "sha256",
+		AuthPassword: "authpass",
+		PrivProtocol: "AES256",
+		PrivPassword: "privpass",
+	}.securityParameters()
+	assert.Nil(t, err)
+	assert.EqualValues(t, gosnmp.AuthPriv, flags)
+	assert.EqualValues(t, "monitor", params.UserName)
+	assert.EqualValues(t, gosnmp.SHA256, params.AuthenticationProtocol)
+	assert.EqualValues(t, gosnmp.AES256, params.PrivacyProtocol)
+
+	flags, params, err = V3Options{
+		SecName:      "monitor",
+		AuthProtocol: "MD5",
+		AuthPassword: "authpass",
+		PrivProtocol: "DES",
+	}.securityParameters()
+	assert.Nil(t, err)
+	assert.EqualValues(t, gosnmp.AuthNoPriv, flags)
+	assert.EqualValues(t, gosnmp.NoPriv, params.PrivacyProtocol)
+
+	_, params, err = V3Options{
+		SecName:      "monitor",
+		AuthProtocol: "SHA-256",
+		AuthPassword: "authpass",
+		PrivProtocol: "aes-256",
+		PrivPassword: "privpass",
+	}.securityParameters()
+	assert.Nil(t, err)
+	assert.EqualValues(t, gosnmp.SHA256, params.AuthenticationProtocol)
+	assert.EqualValues(t, gosnmp.AES256, params.PrivacyProtocol)
+
+	_, _, err = V3Options{SecName: "monitor", SecLevel: "authPriv", AuthProtocol: "SHA", AuthPassword: "authpass", PrivProtocol: "AES"}.securityParameters()
+	assert.NotNil(t, err, "priv-password is required for authPriv")
+
+	_, _, err = V3Options{SecName: "monitor", AuthProtocol: "SHA512", AuthPassword: "authpass"}.securityParameters()
+	assert.NotNil(t, err, "unknown auth protocol")
+
+	_, _, err = V3Options{}.securityParameters()
+	assert.NotNil(t, err, "sec-name is required")
+}
+
+func TestClientConfig(t *testing.T) {
+	s, err := SNMPPlugin{Host: "192.0.2.1", Community: "public"}.clientConfig()
+	assert.Nil(t, err)
+	assert.EqualValues(t, gosnmp.Version2c, s.Version)
+	assert.EqualValues(t, "public", s.Community)
+	assert.EqualValues(t, 30*time.Second, s.Timeout)
+	assert.EqualValues(t, 0, s.Retries, "v2c requests are not retried")
+
+	s, err = SNMPPlugin{
+		Host:    "192.0.2.1",
+		Timeout: 5 * time.Second,
+		V3:      &V3Options{SecName: "monitor", AuthProtocol: "SHA", AuthPassword: "authpass"},
+	}.clientConfig()
+	assert.Nil(t, err)
+	assert.EqualValues(t, gosnmp.Version3, s.Version)
+	assert.EqualValues(t, gosnmp.AuthNoPriv, s.MsgFlags)
+	assert.EqualValues(t, 5*time.Second, s.Timeout)
+	assert.EqualValues(t, engineIDDiscoveryRetries, s.Retries)
+
+	_, err = SNMPPlugin{Host: "192.0.2.1", V3: &V3Options{}}.clientConfig()
+	assert.NotNil(t, err, "sec-name is required")
+}
+
+func TestCheckReport(t *testing.T) {
+	assert.Nil(t, checkReport(&gosnmp.SnmpPacket{PDUType: gosnmp.GetResponse}))
+
+	err := checkReport(&gosnmp.SnmpPacket{
+		PDUType:   gosnmp.Report,
+		Variables: []gosnmp.SnmpPDU{{Name: ".1.3.6.1.6.3.15.1.1.5.0", Type: gosnmp.Counter32, Value: uint(1)}},
+	})
+	assert.EqualValues(t, "authentication failure: wrong digest", err.Error())
+}
+
+func TestRequestTimeout(t *testing.T) {
+	assert.EqualValues(t, 30*time.Second, requestTimeout(context.Background(), 30*time.Second, 3))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+	assert.EqualValues(t, time.Second, requestTimeout(ctx, time.Second, 3))
+	timeout := requestTimeout(ctx, 30*time.Second, 3)
+	assert.True(t, timeout <= 2*time.Second && timeout > time.Second, "the attempts end by the deadline")
+}
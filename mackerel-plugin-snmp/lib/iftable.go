@@ -0,0 +1,261 @@
+package mpsnmp
+
+import (
+	"regexp"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/soniah/gosnmp"
+)
+
+const (
+	oidIfDescr          = ".1.3.6.1.2.1.2.2.1.2"
+	oidIfOperStatus     = ".1.3.6.1.2.1.2.2.1.8"
+	oidIfInOctets       = ".1.3.6.1.2.1.2.2.1.10"
+	oidIfInUcastPkts    = ".1.3.6.1.2.1.2.2.1.11"
+	oidIfInDiscards     = ".1.3.6.1.2.1.2.2.1.13"
+	oidIfInErrors       = ".1.3.6.1.2.1.2.2.1.14"
+	oidIfOutOctets      = ".1.3.6.1.2.1.2.2.1.16"
+	oidIfOutUcastPkts   = ".1.3.6.1.2.1.2.2.1.17"
+	oidIfOutDiscards    = ".1.3.6.1.2.1.2.2.1.19"
+	oidIfOutErrors      = ".1.3.6.1.2.1.2.2.1.20"
+	oidIfName           = ".1.3.6.1.2.1.31.1.1.1.1"
+	oidIfHCInOctets     = ".1.3.6.1.2.1.31.1.1.1.6"
+	oidIfHCInUcastPkts  = ".1.3.6.1.2.1.31.1.1.1.7"
+	oidIfHCOutOctets    = ".1.3.6.1.2.1.31.1.1.1.10"
+	oidIfHCOutUcastPkts = ".1.3.6.1.2.1.31.1.1.1.11"
+
+	ifOperStatusUp = 1
+)
+
+// IfTableOptions options of the ifTable mode, which discovers interfaces by walking ifTable
+type IfTableOptions struct {
+	Pattern *regexp.Regexp
+	// DescrPattern selects interfaces by ifDescr, which is given in addition to ifName by some agents
+	DescrPattern *regexp.Regexp
+	OperUpOnly   bool
+}
+
+// ifTableColumn is a column of counters and the type of its values
+type ifTableColumn struct {
+	oid, typ string
+}
+
+// ifTableCounters are the counters posted per interface: graph, metric, columns in order of preference
+var ifTableCounters = []struct {
+	graph, metric string
+	columns       []ifTableColumn
+}{
+	{"iftable_bps", "in", []ifTableColumn{{oidIfHCInOctets, "uint64"}, {oidIfInOctets, "uint32"}}},
+	{"iftable_bps", "out", []ifTableColumn{{oidIfHCOutOctets, "uint64"}, {oidIfOutOctets, "uint32"}}},
+	{"iftable_pps", "in", []ifTableColumn{{oidIfHCInUcastPkts, "uint64"}, {oidIfInUcastPkts, "uint32"}}},
+	{"iftable_pps", "out", []ifTableColumn{{oidIfHCOutUcastPkts, "uint64"}, {oidIfOutUcastPkts, "uint32"}}},
+	{"iftable_errors", "in", []ifTableColumn{{oidIfInErrors, "uint32"}}},
+	{"iftable_errors", "out", []ifTableColumn{{oidIfOutErrors, "uint32"}}},
+	{"iftable_discards", "in", []ifTableColumn{{oidIfInDiscards, "uint32"}}},
+	{"iftable_discards", "out", []ifTableColumn{{oidIfOutDiscards, "uint32"}}},
+}
+
+// walker is implemented by *gosnmp.GoSNMP
+type walker interface {
+	BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// walkCache caches the results of walks, so that each column is walked at most once in a run
+type walkCache struct {
+	walker
+	results map[string][]gosnmp.SnmpPDU
+}
+
+func newWalkCache(s walker) *walkCache {
+	return &walkCache{walker: s, results: make(map[string][]gosnmp.SnmpPDU)}
+}
+
+func (c *walkCache) BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	if pdus, ok := c.results[rootOid]; ok {
+		return pdus, nil
+	}
+	pdus, err := c.walker.BulkWalkAll(rootOid)
+	if err != nil {
+		return nil, err
+	}
+	c.results[rootOid] = pdus
+	return pdus, nil
+}
+
+// walkIndexed walks the column of a table and returns the values by the index
+func walkIndexed(s walker, oid string) (map[string]gosnmp.SnmpPDU, error) {
+	pdus, err := s.BulkWalkAll(oid)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]gosnmp.SnmpPDU, len(pdus))
+	for _, pdu := range pdus {
+		index := strings.TrimPrefix(strings.TrimPrefix(pdu.Name, "."), strings.TrimPrefix(oid, ".")+".")
+		ret[index] = pdu
+	}
+	return ret, nil
+}
+
+func pduString(pdu gosnmp.SnmpPDU) string {
+	if b, ok := pdu.Value.([]byte); ok {
+		return string(b)
+	}
+	return ""
+}
+
+// discoverInterfaces returns the names of interfaces to monitor by the index
+func (m SNMPPlugin) discoverInterfaces(s walker) (map[string]string, error) {
+	descrs, err := walkIndexed(s, oidIfDescr)
+	if err != nil {
+		return nil, err
+	}
+	// ifName is preferred to ifDescr, which is often too long, but old agents lack ifXTable
+	names, err := walkIndexed(s, oidIfName)
+	if err != nil {
+		names = map[string]gosnmp.SnmpPDU{}
+	}
+	statuses, err := walkIndexed(s, oidIfOperStatus)
+	if err != nil {
+		if m.IfTable.OperUpOnly {
+			return nil, err
+		}
+		statuses = map[string]gosnmp.SnmpPDU{}
+	}
+
+	ifs := make(map[string]string)
+	for index, descr := range descrs {
+		name := pduString(names[index])
+		if name == "" {
+			name = pduString(descr)
+		}
+		if name == "" {
+			continue
+		}
+		if m.IfTable.Pattern != nil && !m.IfTable.Pattern.MatchString(name) {
+			continue
+		}
+		if m.IfTable.DescrPattern != nil && !m.IfTable.DescrPattern.MatchString(pduString(descr)) {
+			continue
+		}
+		if m.IfTable.OperUpOnly {
+			if status, err := pduValue(statuses[index], ""); err != nil || status.(float64) != ifOperStatusUp {
+				continue
+			}
+		}
+		ifs[index] = sanitizeMetricName(name)
+	}
+	return ifs, nil
+}
+
+func (m SNMPPlugin) fetchIfTable(w walker, stat map[string]interface{}) error {
+	s := newWalkCache(w)
+	ifs, err := m.discoverInterfaces(s)
+	if err != nil {
+		return err
+	}
+	if len(ifs) == 0 {
+		return nil
+	}
+
+	for _, c := range ifTableCounters {
+		// the 32-bit counters of the fallback are posted as the uint32 metric of their own, since they wrap at 2^32
+		var values map[string]gosnmp.SnmpPDU
+		typ, metric := "", c.metric
+		for i, col := range c.columns {
+			values, err = walkIndexed(s, col.oid)
+			if err == nil && len(values) > 0 {
+				typ = col.typ
+				if i > 0 {
+					metric += fallbackSuffix
+				}
+				break
+			}
+		}
+		for index, name := range ifs {
+			pdu, ok := values[index]
+			if !ok {
+				continue
+			}
+			v, err := pduValue(pdu, typ)
+			if err != nil {
+				continue
+			}
+			// keyed by the name of the interface, since ifIndex may change when the device reboots
+			stat[m.GraphName+"."+c.graph+"."+name+"."+metric] = v
+		}
+	}
+
+	// ifOperStatus has been walked by discoverInterfaces
+	statuses, err := walkIndexed(s, oidIfOperStatus)
+	if err != nil {
+		return nil
+	}
+	for index, name := range ifs {
+		status, err := pduValue(statuses[index], "")
+		if err != nil {
+			continue
+		}
+		up := 0.0
+		if status.(float64) == ifOperStatusUp {
+			up = 1
+		}
+		stat[m.GraphName+".iftable_status."+name+".up"] = up
+	}
+	return nil
+}
+
+// withFallbackMetrics appends the metrics of the 32-bit fallback counters to the metrics of the 64-bit counters
+func withFallbackMetrics(metrics []mp.Metrics) []mp.Metrics {
+	ret := metrics
+	for _, metric := range metrics {
+		ret = append(ret, fallbackMetric(metric))
+	}
+	return ret
+}
+
+func (m SNMPPlugin) ifTableGraphDefinition(graphKey string) map[string]mp.Graphs {
+	graphs := map[string]mp.Graphs{
+		graphKey + ".iftable_bps.#": {
+			Label: m.GraphName + " Interface Traffic (bits/sec)",
+			Unit:  "integer",
+			// the helper calculates the diff per minute
+			Metrics: withFallbackMetrics([]mp.Metrics{
+				{Name: "in", Label: "In", Diff: true, Type: "uint64", Scale: 8.0 / 60},
+				{Name: "out", Label: "Out", Diff: true, Type: "uint64", Scale: 8.0 / 60},
+			}),
+		},
+		graphKey + ".iftable_pps.#": {
+			Label: m.GraphName + " Interface Unicast Packets",
+			Unit:  "integer",
+			Metrics: withFallbackMetrics([]mp.Metrics{
+				{Name: "in", Label: "In", Diff: true, Type: "uint64"},
+				{Name: "out", Label: "Out", Diff: true, Type: "uint64"},
+			}),
+		},
+		graphKey + ".iftable_status.#": {
+			Label: m.GraphName + " Interface Oper Status",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "up", Label: "Up"},
+			},
+		},
+		graphKey + ".iftable_errors.#": {
+			Label: m.GraphName + " Interface Errors",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "in", Label: "In", Diff: true, Type: "uint32"},
+				{Name: "out", Label: "Out", Diff: true, Type: "uint32"},
+			},
+		},
+		graphKey + ".iftable_discards.#": {
+			Label: m.GraphName + " Interface Discards",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "in", Label: "In", Diff: true, Type: "uint32"},
+				{Name: "out", Label: "Out", Diff: true, Type: "uint32"},
+			},
+		},
+	}
+	return graphs
+}
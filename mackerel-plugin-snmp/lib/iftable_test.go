@@ -0,0 +1,149 @@
+package mpsnmp
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/soniah/gosnmp"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAgent map[string][]gosnmp.SnmpPDU
+
+func (a fakeAgent) BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	a["walked"] = append(a["walked"], gosnmp.SnmpPDU{Name: rootOid})
+	var pdus []gosnmp.SnmpPDU
+	for oid, vs := range a {
+		if oid == rootOid || strings.HasPrefix(oid, rootOid+".") {
+			pdus = append(pdus, vs...)
+		}
+	}
+	return pdus, nil
+}
+
+func (a fakeAgent) set(oid string, typ gosnmp.Asn1BER, value interface{}) {
+	column := oid[:strings.LastIndex(oid, ".")]
+	a[column] = append(a[column], gosnmp.SnmpPDU{Name: oid, Type: typ, Value: value})
+}
+
+func newFakeSwitch() fakeAgent {
+	a := fakeAgent{}
+	// ifIndex 1: lo (up), 3: GigabitEthernet0/1 (up), 4: GigabitEthernet0/2 (down)
+	a.set(oidIfDescr+".1", gosnmp.OctetString, []byte("Software Loopback Interface 1"))
+	a.set(oidIfDescr+".3", gosnmp.OctetString, []byte("GigabitEthernet0/1"))
+	a.set(oidIfDescr+".4", gosnmp.OctetString, []byte("GigabitEthernet0/2"))
+	a.set(oidIfName+".1", gosnmp.OctetString, []byte("lo"))
+	a.set(oidIfName+".3", gosnmp.OctetString, []byte("Gi0/1"))
+	a.set(oidIfName+".4", gosnmp.OctetString, []byte("Gi0/2"))
+	a.set(oidIfOperStatus+".1", gosnmp.Integer, 1)
+	a.set(oidIfOperStatus+".3", gosnmp.Integer, 1)
+	a.set(oidIfOperStatus+".4", gosnmp.Integer, 2)
+	a.set(oidIfHCInOctets+".3", gosnmp.Counter64, uint64(18446744073709551000))
+	a.set(oidIfHCOutOctets+".3", gosnmp.Counter64, uint64(12345))
+	a.set(oidIfHCInUcastPkts+".3", gosnmp.Counter64, uint64(100))
+	a.set(oidIfHCOutUcastPkts+".3", gosnmp.Counter64, uint64(200))
+	a.set(oidIfInErrors+".3", gosnmp.Counter32, uint(3))
+	a.set(oidIfOutErrors+".3", gosnmp.Counter32, uint(4))
+	a.set(oidIfInDiscards+".3", gosnmp.Counter32, uint(5))
+	a.set(oidIfOutDiscards+".3", gosnmp.Counter32, uint(6))
+	return a
+}
+
+func TestDiscoverInterfaces(t *testing.T) {
+	m := SNMPPlugin{GraphName: "snmp", IfTable: &IfTableOptions{OperUpOnly: true}}
+	ifs, err := m.discoverInterfaces(newFakeSwitch())
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]string{"1": "lo", "3": "Gi0_1"}, ifs)
+
+	m.IfTable = &IfTableOptions{Pattern: regexp.MustCompile(`^Gi`)}
+	ifs, err = m.discoverInterfaces(newFakeSwitch())
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]string{"3": "Gi0_1", "4": "Gi0_2"}, ifs)
+
+	m.IfTable = &IfTableOptions{DescrPattern: regexp.MustCompile(`0/2$`)}
+	ifs, err = m.discoverInterfaces(newFakeSwitch())
+	assert.Nil(t, err)
+	assert.EqualValues(t, map[string]string{"4": "Gi0_2"}, ifs)
+}
+
+func TestFetchIfTable(t *testing.T) {
+	m := SNMPPlugin{GraphName: "snmp", IfTable: &IfTableOptions{Pattern: regexp.MustCompile(`^Gi`), OperUpOnly: true}}
+	stat := make(map[string]interface{})
+	err := m.fetchIfTable(newFakeSwitch(), stat)
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, uint64(18446744073709551000), stat["snmp.iftable_bps.Gi0_1.in"])
+	assert.EqualValues(t, uint64(12345), stat["snmp.iftable_bps.Gi0_1.out"])
+	assert.EqualValues(t, uint32(3), stat["snmp.iftable_errors.Gi0_1.in"])
+	assert.EqualValues(t, uint32(4), stat["snmp.iftable_errors.Gi0_1.out"])
+	assert.EqualValues(t, uint32(5), stat["snmp.iftable_discards.Gi0_1.in"])
+	assert.EqualValues(t, uint32(6), stat["snmp.iftable_discards.Gi0_1.out"])
+	assert.EqualValues(t, uint64(100), stat["snmp.iftable_pps.Gi0_1.in"])
+	assert.EqualValues(t, uint64(200), stat["snmp.iftable_pps.Gi0_1.out"])
+	assert.EqualValues(t, 1, stat["snmp.iftable_status.Gi0_1.up"])
+	assert.EqualValues(t, 9, len(stat))
+}
+
+func TestFetchIfTableDown(t *testing.T) {
+	a := newFakeSwitch()
+	m := SNMPPlugin{GraphName: "snmp", IfTable: &IfTableOptions{Pattern: regexp.MustCompile(`^Gi`)}}
+	stat := make(map[string]interface{})
+	err := m.fetchIfTable(a, stat)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, stat["snmp.iftable_status.Gi0_1.up"])
+	assert.EqualValues(t, 0, stat["snmp.iftable_status.Gi0_2.up"])
+
+	// each column is walked once
+	walked := make(map[string]int)
+	for _, pdu := range a["walked"] {
+		walked[pdu.Name]++
+	}
+	for oid, n := range walked {
+		assert.EqualValues(t, 1, n, oid)
+	}
+}
+
+func TestFetchIfTableWithoutIfXTable(t *testing.T) {
+	a := newFakeSwitch()
+	delete(a, oidIfName)
+	delete(a, oidIfHCInOctets)
+	delete(a, oidIfHCOutOctets)
+	delete(a, oidIfHCInUcastPkts)
+	a.set(oidIfInOctets+".3", gosnmp.Counter32, uint(100))
+	a.set(oidIfOutOctets+".3", gosnmp.Counter32, uint(4294967295))
+	a.set(oidIfInUcastPkts+".3", gosnmp.Counter32, uint(300))
+
+	m := SNMPPlugin{GraphName: "snmp", IfTable: &IfTableOptions{Pattern: regexp.MustCompile(`^GigabitEthernet`), OperUpOnly: true}}
+	stat := make(map[string]interface{})
+	err := m.fetchIfTable(a, stat)
+	assert.Nil(t, err)
+	// the 32-bit counters are posted as the uint32 metrics of their own
+	assert.Equal(t, uint32(100), stat["snmp.iftable_bps.GigabitEthernet0_1.in_32bit"])
+	assert.Equal(t, uint32(4294967295), stat["snmp.iftable_bps.GigabitEthernet0_1.out_32bit"])
+	assert.Equal(t, uint32(300), stat["snmp.iftable_pps.GigabitEthernet0_1.in_32bit"])
+	assert.NotContains(t, stat, "snmp.iftable_bps.GigabitEthernet0_1.in")
+	// the 64-bit counters are still used where the agent has them
+	assert.Equal(t, uint64(200), stat["snmp.iftable_pps.GigabitEthernet0_1.out"])
+
+	// the helper handles the wraps by the types of the graph definition
+	graphs := m.ifTableGraphDefinition(m.GraphName)
+	for key, v := range stat {
+		parts := strings.Split(key, ".")
+		graph := graphs[strings.Join(parts[:2], ".")+".#"]
+		var found bool
+		for _, metric := range graph.Metrics {
+			if metric.Name != parts[3] {
+				continue
+			}
+			found = true
+			switch v.(type) {
+			case uint32:
+				assert.EqualValues(t, "uint32", metric.Type, key)
+			case uint64:
+				assert.EqualValues(t, "uint64", metric.Type, key)
+			}
+		}
+		assert.True(t, found, key)
+	}
+}
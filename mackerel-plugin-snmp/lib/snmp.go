@@ -1,20 +1,32 @@
 package mpsnmp
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/alouca/gosnmp"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
+	"github.com/soniah/gosnmp"
 )
 
 // SNMPMetrics metrics
 type SNMPMetrics struct {
 	OID     string
 	Metrics mp.Metrics
+	// Walk walks the subtree of OID and posts each value as a wildcard metric of the graph WalkName
+	Walk     bool
+	WalkName string
+	// FallbackOID is used when the agent does not have OID, and its value is posted as the metric of fallbackMetric
+	FallbackOID string
 }
 
 // SNMPPlugin mackerel plugin for snmp
@@ -22,53 +34,342 @@ type SNMPPlugin struct {
 	GraphName        string
 	GraphUnit        string
 	Host             string
+	Hosts            []string // metrics are namespaced by the host when more than one
+	Concurrency      int
+	Timeout          time.Duration
 	Community        string
+	V3               *V3Options
+	MaxRepetitions   uint8
+	IfTable          *IfTableOptions
 	Tempfile         string
 	SNMPMetricsSlice []SNMPMetrics
+	MaxExecutionTime time.Duration
+
+	// hostPrefixed is set by forHost; GraphName already contains the host
+	hostPrefixed bool
+}
+
+// counterTypes maps the TYPE field of metric definitions to the types of the helper
+var counterTypes = map[string]string{
+	"counter32": "uint32",
+	"counter64": "uint64",
+}
+
+// parseMetricDefinition parses `OID:NAME[:DIFF?][:STACK?][:TYPE?]`
+func parseMetricDefinition(arg string, preferHC bool) (SNMPMetrics, error) {
+	vals := strings.Split(arg, ":")
+	if len(vals) < 2 {
+		return SNMPMetrics{}, fmt.Errorf("invalid metric definition: %s", arg)
+	}
+
+	mpm := mp.Metrics{Name: vals[1], Label: vals[1]}
+	if len(vals) >= 3 {
+		mpm.Diff, _ = strconv.ParseBool(vals[2])
+	}
+	if len(vals) >= 4 {
+		mpm.Stacked, _ = strconv.ParseBool(vals[3])
+	}
+	if len(vals) >= 5 && vals[4] != "" {
+		typ, ok := counterTypes[strings.ToLower(vals[4])]
+		if !ok {
+			return SNMPMetrics{}, fmt.Errorf("unknown type %s: %s", vals[4], arg)
+		}
+		mpm.Type = typ
+	}
+
+	sm := SNMPMetrics{OID: vals[0], Metrics: mpm}
+	if strings.HasSuffix(sm.OID, ".*") {
+		sm.OID = strings.TrimSuffix(sm.OID, ".*")
+		sm.Walk = true
+		sm.WalkName = sm.Metrics.Name
+		sm.Metrics.Name = "*"
+		sm.Metrics.Label = "%1"
+	}
+	if preferHC {
+		if hc, ok := hcOID(sm.OID); ok {
+			sm.FallbackOID = sm.OID
+			sm.OID = hc
+			sm.Metrics.Type = "uint64"
+		}
+	}
+	return sm, nil
+}
+
+// graphKey returns the prefix of graph names, which has a wildcard for the host when multiple hosts are monitored
+func (m SNMPPlugin) graphKey() string {
+	if len(m.Hosts) > 1 {
+		return m.GraphName + ".#"
+	}
+	return m.GraphName
+}
+
+func (m SNMPPlugin) walkGraphName(graphKey string, sm SNMPMetrics) string {
+	return graphKey + "." + sanitizeMetricName(sm.WalkName)
+}
+
+// forHost returns the plugin for one of Hosts
+func (m SNMPPlugin) forHost(host string) SNMPPlugin {
+	p := m
+	p.Host = host
+	p.Hosts = nil
+	p.GraphName = m.GraphName + "." + sanitizeMetricName(host)
+	p.hostPrefixed = true
+	return p
+}
+
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m SNMPPlugin) FetchMetrics() (map[string]interface{}, error) {
+	ctx, cancel := pluginutil.WithMaxExecutionTime(m.MaxExecutionTime)
+	defer cancel()
+
+	if len(m.Hosts) <= 1 {
+		return m.fetchHost(ctx)
+	}
+
+	type result struct {
+		host string
+		stat map[string]interface{}
+		err  error
+	}
+	hosts := make(chan string)
+	results := make(chan result, len(m.Hosts))
+	concurrency := m.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			for host := range hosts {
+				stat, err := m.forHost(host).fetchHostWithTimeout(ctx)
+				results <- result{host, stat, err}
+			}
+		}()
+	}
+	go func() {
+		for _, host := range m.Hosts {
+			hosts <- host
+		}
+		close(hosts)
+	}()
+
 	stat := make(map[string]interface{})
+	for i := range m.Hosts {
+		var r result
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			// the hosts fetched so far are posted
+			log.Println(pluginutil.DeadlineExceeded(ctx, fmt.Sprintf("waiting for %d of %d hosts", len(m.Hosts)-i, len(m.Hosts))))
+			return stat, nil
+		}
+		if r.err != nil {
+			// other hosts are still posted
+			log.Printf("%s: %s", r.host, r.err)
+			continue
+		}
+		for k, v := range r.stat {
+			stat[k] = v
+		}
+	}
+	return stat, nil
+}
+
+// fetchHostWithTimeout gives up the host after the timeout, so that an unreachable host does not delay others
+func (m SNMPPlugin) fetchHostWithTimeout(ctx context.Context) (map[string]interface{}, error) {
+	type result struct {
+		stat map[string]interface{}
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		stat, err := m.fetchHost(ctx)
+		ch <- result{stat, err}
+	}()
 
-	s, err := gosnmp.NewGoSNMP(m.Host, m.Community, gosnmp.Version2c, 30)
+	select {
+	case r := <-ch:
+		return r.stat, r.err
+	case <-time.After(m.Timeout):
+		return nil, fmt.Errorf("timed out after %s", m.Timeout)
+	}
+}
+
+func (m SNMPPlugin) fetchHost(ctx context.Context) (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+
+	c, err := m.newClient()
 	if err != nil {
 		return nil, err
 	}
+	defer c.Conn.Close()
+	if m.MaxRepetitions > 0 {
+		c.MaxRepetitions = m.MaxRepetitions
+	}
+	s := newDeadlineClient(ctx, c)
 
 	for _, sm := range m.SNMPMetricsSlice {
-		resp, err := s.Get(sm.OID)
-		if err != nil {
-			log.Println("SNMP get failed: ", err)
+		if sm.Walk {
+			// GETBULK is used for walking, since SNMPv1 is not supported
+			pdus, err := s.BulkWalkAll(sm.OID)
+			if err != nil {
+				if derr := pluginutil.DeadlineExceeded(ctx, "walking "+sm.OID); derr != nil {
+					// the metrics fetched so far are posted
+					log.Println(derr)
+					return stat, nil
+				}
+				log.Println("SNMP walk failed: ", err)
+				continue
+			}
+			graph := m.walkGraphName(m.GraphName, sm)
+			for _, pdu := range pdus {
+				ret, err := pduValue(pdu, sm.Metrics.Type)
+				if err != nil {
+					continue
+				}
+				index := strings.TrimPrefix(strings.TrimPrefix(pdu.Name, "."), strings.TrimPrefix(sm.OID, ".")+".")
+				stat[graph+"."+sanitizeMetricName(index)] = ret
+			}
 			continue
 		}
 
-		ret, err := strconv.ParseFloat(fmt.Sprint(resp.Variables[0].Value), 64)
+		name, ret, err := m.getMetric(s, sm)
 		if err != nil {
+			if _, ok := err.(authError); ok {
+				// an authentication failure fails all other requests as well
+				return nil, err
+			}
+			if derr := pluginutil.DeadlineExceeded(ctx, "getting "+sm.OID); derr != nil {
+				log.Println(derr)
+				return stat, nil
+			}
 			log.Println(err)
 			continue
 		}
 
-		stat[sm.Metrics.Name] = ret
+		if m.hostPrefixed {
+			stat[m.GraphName+"."+name] = ret
+		} else {
+			stat[name] = ret
+		}
+	}
+
+	if m.IfTable != nil {
+		err := m.fetchIfTable(s, stat)
+		if derr := pluginutil.DeadlineExceeded(ctx, "walking ifTable"); derr != nil {
+			log.Println(derr)
+		} else if err != nil {
+			log.Println("SNMP walk of ifTable failed: ", err)
+		}
 	}
 
-	return stat, err
+	return stat, nil
+}
+
+// getter is implemented by *gosnmp.GoSNMP
+type getter interface {
+	Get(oids []string) (*gosnmp.SnmpPacket, error)
+}
+
+// getMetric gets the value of sm and the name of its metric, falling back to the 32-bit counter when the agent lacks
+// the 64-bit one
+func (m SNMPPlugin) getMetric(s getter, sm SNMPMetrics) (string, interface{}, error) {
+	ret, err := m.get(s, sm.OID, sm.Metrics.Type)
+	if err == errNoValue && sm.FallbackOID != "" {
+		ret, err = m.get(s, sm.FallbackOID, fallbackType)
+		return fallbackMetric(sm.Metrics).Name, ret, err
+	}
+	return sm.Metrics.Name, ret, err
+}
+
+func (m SNMPPlugin) get(s getter, oid string, typ string) (interface{}, error) {
+	resp, err := s.Get([]string{oid})
+	if err != nil {
+		return nil, fmt.Errorf("SNMP get failed: %s", err)
+	}
+	if err := checkReport(resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Variables) == 0 {
+		return nil, errNoValue
+	}
+	return pduValue(resp.Variables[0], typ)
 }
 
 // GraphDefinition interface for mackerelplugin
 func (m SNMPPlugin) GraphDefinition() map[string]mp.Graphs {
+	graphs := make(map[string]mp.Graphs)
+	graphKey := m.graphKey()
 	metrics := []mp.Metrics{}
 	for _, sm := range m.SNMPMetricsSlice {
+		if sm.Walk {
+			graphs[m.walkGraphName(graphKey, sm)] = mp.Graphs{
+				Label:   m.GraphName + " " + sm.WalkName,
+				Unit:    m.GraphUnit,
+				Metrics: []mp.Metrics{sm.Metrics},
+			}
+			continue
+		}
 		metrics = append(metrics, sm.Metrics)
+		if sm.FallbackOID != "" {
+			metrics = append(metrics, fallbackMetric(sm.Metrics))
+		}
 	}
 
-	return map[string]mp.Graphs{
-		m.GraphName: {
+	if len(metrics) > 0 {
+		graphs[graphKey] = mp.Graphs{
 			Label:   m.GraphName,
 			Unit:    m.GraphUnit,
 			Metrics: metrics,
-		},
+		}
 	}
+	if m.IfTable != nil {
+		for k, v := range m.ifTableGraphDefinition(graphKey) {
+			graphs[k] = v
+		}
+	}
+	return graphs
+}
+
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *stringSlice) String() string {
+	return fmt.Sprintf("%v", *s)
+}
+
+// readHostsFile reads hostnames from a file, ignoring empty lines and comments
+func readHostsFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line != "" {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, scanner.Err()
 }
 
 // Do the plugin
@@ -76,34 +377,105 @@ func Do() {
 	optGraphName := flag.String("name", "snmp", "Graph name")
 	optGraphUnit := flag.String("unit", "float", "Graph unit")
 
-	optHost := flag.String("host", "localhost", "Hostname")
-	optCommunity := flag.String("community", "public", "SNMP V2c Community")
+	optHosts := &stringSlice{}
+	flag.Var(optHosts, "host", "Hostname (can be specified multiple times, default localhost)")
+	optHostsFile := flag.String("hosts-file", "", "File listing hostnames, one per line")
+	optConcurrency := flag.Int("concurrency", 4, "Number of hosts queried concurrently")
+	optTimeout := flag.Duration("timeout", 30*time.Second, "Timeout per host")
+	optCommunity := flag.String("community", "public", "SNMP V2c Community (or $MACKEREL_PLUGIN_SNMP_COMMUNITY)")
+
+	optV3 := flag.Bool("v3", false, "Use SNMPv3")
+	optSecName := flag.String("sec-name", "", "SNMPv3 security name")
+	flag.StringVar(optSecName, "user", "", "Alias of -sec-name")
+	optSecLevel := flag.String("sec-level", "", "SNMPv3 security level (noAuthNoPriv, authNoPriv or authPriv; guessed from the passwords if not given)")
+	optAuthProtocol := flag.String("auth-protocol", "SHA", "SNMPv3 authentication protocol (MD5, SHA or SHA-256)")
+	optAuthPassword := flag.String("auth-password", "", "SNMPv3 authentication password (or $MACKEREL_PLUGIN_SNMP_AUTH_PASSWORD, $SNMP_AUTH_PASSWORD)")
+	optPrivProtocol := flag.String("priv-protocol", "AES", "SNMPv3 privacy protocol (DES, AES or AES-256)")
+	optPrivPassword := flag.String("priv-password", "", "SNMPv3 privacy password (or $MACKEREL_PLUGIN_SNMP_PRIV_PASSWORD, $SNMP_PRIV_PASSWORD)")
+
+	optPreferHC := flag.Bool("prefer-hc", false, "Use the 64-bit counters of ifXTable instead of the 32-bit counters of ifTable if available")
+	optMaxRepetitions := flag.Int("max-repetitions", 50, "max-repetitions of GETBULK requests to walk subtrees")
+
+	optIfTable := flag.Bool("iftable", false, "Discover interfaces from ifTable and post their traffic, errors and discards")
+	optIfPattern := flag.String("if-pattern", "", "Regexp to select interfaces by ifName (or ifDescr) in the ifTable mode")
+	optIfDescrPattern := flag.String("if-descr-pattern", "", "Regexp to select interfaces by ifDescr in the ifTable mode")
+	optIfAll := flag.Bool("if-all", false, "Post interfaces whose ifOperStatus is not up as well in the ifTable mode")
 
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optMaxExecutionTime := pluginutil.MaxExecutionTimeFlag(flag.CommandLine)
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "community", "MACKEREL_PLUGIN_SNMP_COMMUNITY")
+	envutil.SetFromEnv(flag.CommandLine, "auth-password", "MACKEREL_PLUGIN_SNMP_AUTH_PASSWORD", "SNMP_AUTH_PASSWORD")
+	envutil.SetFromEnv(flag.CommandLine, "priv-password", "MACKEREL_PLUGIN_SNMP_PRIV_PASSWORD", "SNMP_PRIV_PASSWORD")
 
 	var snmp SNMPPlugin
-	snmp.Host = *optHost
+	hosts := []string(*optHosts)
+	if *optHostsFile != "" {
+		fileHosts, err := readHostsFile(*optHostsFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		hosts = append(hosts, fileHosts...)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	snmp.Host = hosts[0]
+	if len(hosts) > 1 {
+		snmp.Hosts = hosts
+	}
+	snmp.Concurrency = *optConcurrency
+	snmp.Timeout = *optTimeout
+	snmp.MaxExecutionTime = *optMaxExecutionTime
 	snmp.Community = *optCommunity
+	if *optV3 {
+		v3 := &V3Options{
+			SecName:      *optSecName,
+			SecLevel:     *optSecLevel,
+			AuthProtocol: *optAuthProtocol,
+			AuthPassword: *optAuthPassword,
+			PrivProtocol: *optPrivProtocol,
+			PrivPassword: *optPrivPassword,
+		}
+		if _, _, err := v3.securityParameters(); err != nil {
+			log.Fatalln(err)
+		}
+		snmp.V3 = v3
+	}
 	snmp.GraphName = *optGraphName
 	snmp.GraphUnit = *optGraphUnit
 
-	sms := []SNMPMetrics{}
-	for _, arg := range flag.Args() {
-		vals := strings.Split(arg, ":")
-		if len(vals) < 2 {
-			continue
-		}
+	if *optMaxRepetitions < 1 || *optMaxRepetitions > 255 {
+		log.Fatalln("-max-repetitions must be between 1 and 255")
+	}
+	snmp.MaxRepetitions = uint8(*optMaxRepetitions)
 
-		mpm := mp.Metrics{Name: vals[1], Label: vals[1]}
-		if len(vals) >= 3 {
-			mpm.Diff, _ = strconv.ParseBool(vals[2])
+	if *optIfTable {
+		snmp.IfTable = &IfTableOptions{OperUpOnly: !*optIfAll}
+		if *optIfPattern != "" {
+			re, err := regexp.Compile(*optIfPattern)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			snmp.IfTable.Pattern = re
 		}
-		if len(vals) >= 4 {
-			mpm.Stacked, _ = strconv.ParseBool(vals[3])
+		if *optIfDescrPattern != "" {
+			re, err := regexp.Compile(*optIfDescrPattern)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			snmp.IfTable.DescrPattern = re
 		}
+	}
 
-		sms = append(sms, SNMPMetrics{OID: vals[0], Metrics: mpm})
+	sms := []SNMPMetrics{}
+	for _, arg := range flag.Args() {
+		sm, err := parseMetricDefinition(arg, *optPreferHC)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sms = append(sms, sm)
 	}
 	snmp.SNMPMetricsSlice = sms
 
@@ -0,0 +1,153 @@
+package mpsnmp
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/soniah/gosnmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricDefinition(t *testing.T) {
+	sm, err := parseMetricDefinition(".1.3.6.1.2.1.31.1.1.1.7.2:eth01in:1:0", false)
+	assert.Nil(t, err)
+	assert.EqualValues(t, ".1.3.6.1.2.1.31.1.1.1.7.2", sm.OID)
+	assert.EqualValues(t, "eth01in", sm.Metrics.Name)
+	assert.EqualValues(t, true, sm.Metrics.Diff)
+	assert.EqualValues(t, false, sm.Metrics.Stacked)
+	assert.EqualValues(t, "", sm.Metrics.Type)
+
+	sm, err = parseMetricDefinition(".1.3.6.1.2.1.2.2.1.10.2:eth01in:1:0:counter32", false)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "uint32", sm.Metrics.Type)
+
+	sm, err = parseMetricDefinition(".1.3.6.1.2.1.2.2.1.10.2:eth01in:1:0", true)
+	assert.Nil(t, err)
+	assert.EqualValues(t, ".1.3.6.1.2.1.31.1.1.1.6.2", sm.OID)
+	assert.EqualValues(t, ".1.3.6.1.2.1.2.2.1.10.2", sm.FallbackOID)
+	assert.EqualValues(t, "uint64", sm.Metrics.Type)
+
+	sm, err = parseMetricDefinition(".1.3.6.1.2.1.31.1.1.1.6.*:ifHCInOctets:1", false)
+	assert.Nil(t, err)
+	assert.EqualValues(t, ".1.3.6.1.2.1.31.1.1.1.6", sm.OID)
+	assert.EqualValues(t, true, sm.Walk)
+	assert.EqualValues(t, "*", sm.Metrics.Name)
+	assert.EqualValues(t, "ifHCInOctets", sm.WalkName)
+
+	_, err = parseMetricDefinition(".1.3.6.1.2.1.1.3.0", false)
+	assert.NotNil(t, err)
+	_, err = parseMetricDefinition(".1.3.6.1.2.1.1.3.0:uptime:0:0:counter16", false)
+	assert.NotNil(t, err)
+}
+
+type fakeGetter map[string]gosnmp.SnmpPDU
+
+func (g fakeGetter) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	pdu, ok := g[oids[0]]
+	if !ok {
+		pdu = gosnmp.SnmpPDU{Name: oids[0], Type: gosnmp.NoSuchObject}
+	}
+	return &gosnmp.SnmpPacket{PDUType: gosnmp.GetResponse, Variables: []gosnmp.SnmpPDU{pdu}}, nil
+}
+
+func TestGetMetric(t *testing.T) {
+	snmp := SNMPPlugin{GraphName: "snmp"}
+	sm, _ := parseMetricDefinition(".1.3.6.1.2.1.2.2.1.10.2:eth01in:1:0", true)
+	snmp.SNMPMetricsSlice = []SNMPMetrics{sm}
+	types := make(map[string]string)
+	for _, metric := range snmp.GraphDefinition()["snmp"].Metrics {
+		types[metric.Name] = metric.Type
+	}
+
+	name, v, err := snmp.getMetric(fakeGetter{
+		".1.3.6.1.2.1.31.1.1.1.6.2": {Type: gosnmp.Counter64, Value: uint64(18446744073709551000)},
+		".1.3.6.1.2.1.2.2.1.10.2":   {Type: gosnmp.Counter32, Value: uint(100)},
+	}, sm)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "eth01in", name)
+	assert.EqualValues(t, uint64(18446744073709551000), v)
+	assert.EqualValues(t, "uint64", types[name])
+
+	// the agent lacks ifXTable
+	name, v, err = snmp.getMetric(fakeGetter{
+		".1.3.6.1.2.1.2.2.1.10.2": {Type: gosnmp.Counter32, Value: uint(4294967295)},
+	}, sm)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "eth01in_32bit", name)
+	assert.Equal(t, uint32(4294967295), v)
+	assert.EqualValues(t, "uint32", types[name], "the wrap of the fallback counter should be handled at 2^32")
+
+	_, _, err = snmp.getMetric(fakeGetter{}, sm)
+	assert.EqualValues(t, errNoValue, err)
+}
+
+func TestGraphDefinition(t *testing.T) {
+	var snmp SNMPPlugin
+	snmp.GraphName = "snmp"
+	snmp.GraphUnit = "integer"
+	for _, arg := range []string{".1.3.6.1.2.1.1.3.0:uptime", ".1.3.6.1.2.1.31.1.1.1.6.*:ifHCInOctets:1"} {
+		sm, _ := parseMetricDefinition(arg, false)
+		snmp.SNMPMetricsSlice = append(snmp.SNMPMetricsSlice, sm)
+	}
+
+	graphs := snmp.GraphDefinition()
+	assert.EqualValues(t, 2, len(graphs))
+	assert.EqualValues(t, "uptime", graphs["snmp"].Metrics[0].Name)
+	assert.EqualValues(t, "*", graphs["snmp.ifHCInOctets"].Metrics[0].Name)
+}
+
+func TestGraphDefinitionMultipleHosts(t *testing.T) {
+	var snmp SNMPPlugin
+	snmp.GraphName = "snmp"
+	snmp.Hosts = []string{"192.0.2.1", "192.0.2.2"}
+	snmp.IfTable = &IfTableOptions{}
+	for _, arg := range []string{".1.3.6.1.2.1.1.3.0:uptime", ".1.3.6.1.2.1.31.1.1.1.6.*:ifHCInOctets:1"} {
+		sm, _ := parseMetricDefinition(arg, false)
+		snmp.SNMPMetricsSlice = append(snmp.SNMPMetricsSlice, sm)
+	}
+
+	graphs := snmp.GraphDefinition()
+	assert.EqualValues(t, 7, len(graphs))
+	assert.EqualValues(t, "uptime", graphs["snmp.#"].Metrics[0].Name)
+	assert.EqualValues(t, "*", graphs["snmp.#.ifHCInOctets"].Metrics[0].Name)
+	assert.Contains(t, graphs, "snmp.#.iftable_bps.#")
+
+	p := snmp.forHost("192.0.2.1")
+	assert.EqualValues(t, "192.0.2.1", p.Host)
+	assert.EqualValues(t, "snmp.192_0_2_1", p.GraphName)
+	assert.EqualValues(t, "snmp.192_0_2_1.ifHCInOctets", p.walkGraphName(p.GraphName, snmp.SNMPMetricsSlice[1]))
+}
+
+func TestReadHostsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mackerel-plugin-snmp")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("# switches\n192.0.2.1\n\n  192.0.2.2  # core\n")
+	f.Close()
+
+	hosts, err := readHostsFile(f.Name())
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"192.0.2.1", "192.0.2.2"}, hosts)
+}
+
+func TestPDUValue(t *testing.T) {
+	v, err := pduValue(gosnmp.SnmpPDU{Type: gosnmp.Counter64, Value: uint64(18446744073709551615)}, "uint64")
+	assert.Nil(t, err)
+	assert.EqualValues(t, uint64(18446744073709551615), v)
+
+	v, err = pduValue(gosnmp.SnmpPDU{Type: gosnmp.Counter32, Value: uint(4294967295)}, "uint32")
+	assert.Nil(t, err)
+	assert.EqualValues(t, uint32(4294967295), v)
+
+	v, err = pduValue(gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 42}, "")
+	assert.Nil(t, err)
+	assert.EqualValues(t, float64(42), v)
+
+	v, err = pduValue(gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte("0.75")}, "")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0.75, v)
+
+	_, err = pduValue(gosnmp.SnmpPDU{Type: gosnmp.NoSuchInstance}, "")
+	assert.EqualValues(t, errNoValue, err)
+}
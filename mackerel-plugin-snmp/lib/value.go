@@ -0,0 +1,83 @@
+package mpsnmp
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/soniah/gosnmp"
+)
+
+var errNoValue = errors.New("no such object")
+
+// hcOIDs maps the 32-bit counters of ifTable to the 64-bit counters of ifXTable
+var hcOIDs = map[string]string{
+	".1.3.6.1.2.1.2.2.1.10.": ".1.3.6.1.2.1.31.1.1.1.6.",  // ifInOctets -> ifHCInOctets
+	".1.3.6.1.2.1.2.2.1.11.": ".1.3.6.1.2.1.31.1.1.1.7.",  // ifInUcastPkts -> ifHCInUcastPkts
+	".1.3.6.1.2.1.2.2.1.16.": ".1.3.6.1.2.1.31.1.1.1.10.", // ifOutOctets -> ifHCOutOctets
+	".1.3.6.1.2.1.2.2.1.17.": ".1.3.6.1.2.1.31.1.1.1.11.", // ifOutUcastPkts -> ifHCOutUcastPkts
+}
+
+// fallbackType is the type of the values of the 32-bit counters read when the agent lacks the 64-bit ones
+const fallbackType = "uint32"
+
+// fallbackSuffix is appended to the names of the metrics of the 32-bit fallback counters, which are defined separately
+// from the 64-bit ones so that the helper handles their wraps at 2^32
+const fallbackSuffix = "_32bit"
+
+// fallbackMetric returns the metric posting the 32-bit fallback counter of metric
+func fallbackMetric(metric mp.Metrics) mp.Metrics {
+	metric.Name += fallbackSuffix
+	metric.Label += " (32-bit)"
+	metric.Type = fallbackType
+	return metric
+}
+
+// hcOID returns the 64-bit counterpart of oid if exists
+func hcOID(oid string) (string, bool) {
+	if !strings.HasPrefix(oid, ".") {
+		oid = "." + oid
+	}
+	for from, to := range hcOIDs {
+		if strings.HasPrefix(oid, from) {
+			return to + strings.TrimPrefix(oid, from), true
+		}
+	}
+	return "", false
+}
+
+// pduValue converts the value of pdu to the type of metric, which the helper uses to handle counter wraps
+func pduValue(pdu gosnmp.SnmpPDU, typ string) (interface{}, error) {
+	var v *big.Int
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		return nil, errNoValue
+	case gosnmp.OctetString:
+		// some agents return numbers as strings
+		b, ok := pdu.Value.([]byte)
+		if !ok {
+			return nil, errors.New("unexpected value of OctetString")
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+		if err != nil {
+			return nil, err
+		}
+		if typ == "" {
+			return f, nil
+		}
+		v, _ = big.NewFloat(f).Int(nil)
+	default:
+		v = gosnmp.ToBigInt(pdu.Value)
+	}
+
+	switch typ {
+	case "uint32":
+		return uint32(v.Uint64()), nil
+	case "uint64":
+		return v.Uint64(), nil
+	}
+	f, _ := new(big.Float).SetInt(v).Float64()
+	return f, nil
+}
@@ -0,0 +1,222 @@
+package mpsolr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// cloudMetricPrefixes are the metrics fetched from the metrics API, see
+// https://solr.apache.org/guide/solr/latest/deployment-guide/metrics-reporting.html
+var cloudMetricPrefixes = []string{
+	"CORE.collection",
+	"QUERY./select.requestTimes",
+	"UPDATE./update.requestTimes",
+	"CACHE.searcher.",
+	"INDEX.sizeInBytes",
+	"memory.heap.",
+	"threads.",
+	"CONTAINER.cores.",
+}
+
+// cloudHandlers are the request handlers posted per collection, keyed by their metric names in the metrics API
+var cloudHandlers = map[string]string{
+	"QUERY./select.requestTimes":  "select",
+	"UPDATE./update.requestTimes": "update",
+}
+
+var cloudCacheTypes = []string{"queryResultCache", "filterCache", "documentCache"}
+
+var (
+	invalidKeyRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+	// the cores of SolrCloud are named as <collection>_<shard>_replica_<type><number>, or <collection>_<shard>_replica<number>
+	// before Solr 7
+	replicaCoreRe = regexp.MustCompile(`^(.+)_shard\d+(_\d+)*_replica_?[nNtTpP]?\d+$`)
+)
+
+// collectionName returns the collection of the core registry such as solr.core.<collection>.<shard>.<replica>, which
+// is normalized from the name of the core if the registry is not in that form
+func collectionName(registry string, metrics map[string]interface{}) string {
+	if c, ok := metrics["CORE.collection"].(string); ok && c != "" {
+		return c
+	}
+	name := strings.TrimPrefix(registry, "solr.core.")
+	if parts := strings.Split(name, "."); len(parts) >= 3 {
+		return strings.Join(parts[:len(parts)-2], ".")
+	}
+	if m := replicaCoreRe.FindStringSubmatch(name); m != nil {
+		return m[1]
+	}
+	return name
+}
+
+func (s *SolrPlugin) cloudMetricsURL() string {
+	params := url.Values{}
+	params.Set("group", "core,jvm,node")
+	params.Set("prefix", strings.Join(cloudMetricPrefixes, ","))
+	params.Set("compact", "true")
+	params.Set("wt", "json")
+	return s.BaseURL + "/admin/metrics?" + params.Encode()
+}
+
+func floatValue(v interface{}, key string) (float64, bool) {
+	if m, ok := v.(map[string]interface{}); ok {
+		v = m[key]
+	}
+	f, ok := v.(float64)
+	return f, ok
+}
+
+// parseCloudMetrics aggregates the metrics of the replicas per collection. The rates and the index sizes are summed,
+// the 95th percentiles take the max, and the hit ratios are calculated from the summed hits and lookups.
+func parseCloudMetrics(body []byte) (map[string]float64, error) {
+	var res struct {
+		Metrics map[string]map[string]interface{} `json:"metrics"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	if res.Metrics == nil {
+		return nil, errors.New("no metrics in the response")
+	}
+
+	stat := make(map[string]float64)
+	hits := make(map[string]float64)
+	lookups := make(map[string]float64)
+	for registry, metrics := range res.Metrics {
+		switch {
+		case registry == "solr.jvm":
+			for _, k := range []string{"used", "committed", "max"} {
+				if v, ok := floatValue(metrics["memory.heap."+k], ""); ok {
+					stat["heap_"+k] = v
+				}
+			}
+			for _, k := range []string{"count", "daemon.count", "blocked.count"} {
+				if v, ok := floatValue(metrics["threads."+k], ""); ok {
+					stat["threads_"+strings.TrimSuffix(k, ".count")] = v
+				}
+			}
+		case registry == "solr.node":
+			for _, k := range []string{"loaded", "lazy", "unloaded"} {
+				if v, ok := floatValue(metrics["CONTAINER.cores."+k], ""); ok {
+					stat["cores_"+k] = v
+				}
+			}
+		case strings.HasPrefix(registry, "solr.core."):
+			key := "solr.collection." + invalidKeyRe.ReplaceAllString(collectionName(registry, metrics), "_")
+			for name, handler := range cloudHandlers {
+				if v, ok := floatValue(metrics[name], "1minRate"); ok {
+					stat[key+".request_rate."+handler] += v
+				}
+				if v, ok := floatValue(metrics[name], "p95_ms"); ok {
+					k := key + ".request_time_p95." + handler
+					if cur, ok := stat[k]; !ok || v > cur {
+						stat[k] = v
+					}
+				}
+			}
+			for _, cacheType := range cloudCacheTypes {
+				c := metrics["CACHE.searcher."+cacheType]
+				h, ok1 := floatValue(c, "hits")
+				l, ok2 := floatValue(c, "lookups")
+				if ok1 && ok2 {
+					hits[key+".cache_hitratio."+cacheType] += h
+					lookups[key+".cache_hitratio."+cacheType] += l
+				}
+			}
+			if v, ok := floatValue(metrics["INDEX.sizeInBytes"], ""); ok {
+				stat[key+".index_size.size"] += v
+			}
+		}
+	}
+	for k, l := range lookups {
+		if l > 0 {
+			stat[k] = hits[k] / l * 100
+		} else {
+			stat[k] = 0
+		}
+	}
+	return stat, nil
+}
+
+func (s *SolrPlugin) loadCloudStats() error {
+	body, err := s.get(s.cloudMetricsURL())
+	if err != nil {
+		return err
+	}
+	stat, err := parseCloudMetrics(body)
+	if err != nil {
+		logger.Errorf("Failed to %s", err)
+		return err
+	}
+	s.CloudStats = stat
+	return nil
+}
+
+func (s SolrPlugin) cloudGraphDefinition() map[string]mp.Graphs {
+	cacheMetrics := make([]mp.Metrics, 0, len(cloudCacheTypes))
+	for _, cacheType := range cloudCacheTypes {
+		cacheMetrics = append(cacheMetrics, mp.Metrics{Name: cacheType, Label: strings.Title(cacheType)})
+	}
+	return map[string]mp.Graphs{
+		"solr.collection.#.request_rate": {
+			Label: "Solr Collection Request Rate",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "select", Label: "Select"},
+				{Name: "update", Label: "Update"},
+			},
+		},
+		"solr.collection.#.request_time_p95": {
+			Label: "Solr Collection 95th Percentile Request Time (ms)",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "select", Label: "Select"},
+				{Name: "update", Label: "Update"},
+			},
+		},
+		"solr.collection.#.cache_hitratio": {
+			Label:   "Solr Collection Cache Hit Ratio",
+			Unit:    "percentage",
+			Metrics: cacheMetrics,
+		},
+		"solr.collection.#.index_size": {
+			Label: "Solr Collection Index Size",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "size", Label: "Size"},
+			},
+		},
+		"solr.jvm.heap": {
+			Label: "Solr JVM Heap",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "heap_used", Label: "Used"},
+				{Name: "heap_committed", Label: "Committed"},
+				{Name: "heap_max", Label: "Max"},
+			},
+		},
+		"solr.jvm.threads": {
+			Label: "Solr JVM Threads",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "threads_count", Label: "Count"},
+				{Name: "threads_daemon", Label: "Daemon"},
+				{Name: "threads_blocked", Label: "Blocked"},
+			},
+		},
+		"solr.node.cores": {
+			Label: "Solr Node Cores",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cores_loaded", Label: "Loaded"},
+				{Name: "cores_lazy", Label: "Lazy"},
+				{Name: "cores_unloaded", Label: "Unloaded"},
+			},
+		},
+	}
+}
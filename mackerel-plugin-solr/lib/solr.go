@@ -1,16 +1,20 @@
 package mpsolr
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 var (
@@ -36,18 +40,48 @@ type SolrPlugin struct {
 	Prefix   string
 	Stats    map[string](map[string]float64)
 	Tempfile string
+	User     string
+	Password string
+	// Client is used for the requests if not nil, e.g. to skip the verification of the server certificate
+	Client *http.Client
+	// Cloud fetches the metrics of the collections of SolrCloud from the metrics API instead of the mbeans of the cores
+	Cloud      bool
+	CloudStats map[string]float64
 }
 
-func (s *SolrPlugin) getStats(url string) (map[string]interface{}, error) {
-	resp, err := http.Get(url)
+func (s *SolrPlugin) get(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.User != "" || s.Password != "" {
+		req.SetBasicAuth(s.User, s.Password)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		logger.Errorf("Failed to %s", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
-	dec := json.NewDecoder(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("failed to get %s: %s", req.URL.Path, resp.Status)
+		logger.Errorf("%s", err)
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *SolrPlugin) getStats(url string) (map[string]interface{}, error) {
+	body, err := s.get(url)
+	if err != nil {
+		return nil, err
+	}
 	var stats map[string]interface{}
-	err = dec.Decode(&stats)
+	err = json.Unmarshal(body, &stats)
 	if err != nil {
 		logger.Errorf("Failed to %s", err)
 		return nil, err
@@ -161,6 +195,12 @@ func escapeSlash(slashIncludedString string) (str string) {
 // FetchMetrics interface for mackerelplugin
 func (s SolrPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]interface{})
+	if s.Cloud {
+		for k, v := range s.CloudStats {
+			stat[k] = v
+		}
+		return stat, nil
+	}
 	for core, stats := range s.Stats {
 		for k, v := range stats {
 			stat[core+"_"+k] = v
@@ -171,6 +211,9 @@ func (s SolrPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 // GraphDefinition interface for mackerelplugin
 func (s SolrPlugin) GraphDefinition() map[string]mp.Graphs {
+	if s.Cloud {
+		return s.cloudGraphDefinition()
+	}
 	graphdef := make(map[string]mp.Graphs)
 
 	for _, core := range s.Cores {
@@ -242,25 +285,50 @@ func (s SolrPlugin) GraphDefinition() map[string]mp.Graphs {
 	return graphdef
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the base URL
+func (s SolrPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "solr", s.BaseURL)
+}
+
 // Do the plugin
 func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "8983", "Port")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optScheme := flag.String("scheme", "http", "Scheme")
+	optUser := flag.String("user", "", "User of the basic authentication")
+	optPassword := flag.String("password", "", "Password of the basic authentication (or $MACKEREL_PLUGIN_SOLR_PASSWORD)")
+	optInsecure := flag.Bool("insecure", false, "Skip the verification of the server certificate")
+	optCloud := flag.Bool("cloud", false, "Fetch the metrics per collection of SolrCloud from the metrics API")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_SOLR_PASSWORD")
 
 	solr := SolrPlugin{
-		Protocol: "http",
+		Protocol: *optScheme,
 		Host:     *optHost,
 		Port:     *optPort,
 		Prefix:   "solr",
+		User:     *optUser,
+		Password: *optPassword,
+		Cloud:    *optCloud,
+	}
+	if *optInsecure {
+		transport := &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		solr.Client = &http.Client{Transport: transport}
 	}
 
 	solr.BaseURL = fmt.Sprintf("%s://%s:%s/solr", solr.Protocol, solr.Host, solr.Port)
-	solr.loadStats()
+	if solr.Cloud {
+		solr.loadCloudStats()
+	} else {
+		solr.loadStats()
+	}
 
 	helper := mp.NewMackerelPlugin(solr)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = solr.tempfile(*optTempfile)
 
 	helper.Run()
 }
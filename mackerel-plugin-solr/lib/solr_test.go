@@ -199,3 +199,88 @@ func TestFetchMetrics(t *testing.T) {
 		assert.EqualValues(t, 468, stat["testcore_lookups_fieldValueCache"], msgPrefix+"testcore_lookups_fieldValueCache")
 	}
 }
+
+func TestTempfile(t *testing.T) {
+	p := SolrPlugin{BaseURL: "http://localhost:8983/solr"}
+	if other := (SolrPlugin{BaseURL: "http://localhost:8984/solr"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with BaseURL: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/solr.json"); f != "/tmp/solr.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+func TestCollectionName(t *testing.T) {
+	for _, tt := range []struct {
+		registry   string
+		metrics    map[string]interface{}
+		collection string
+	}{
+		{"solr.core.products.shard1.replica_n1", map[string]interface{}{"CORE.collection": "products"}, "products"},
+		{"solr.core.logs.2024.shard1.replica_t2", map[string]interface{}{}, "logs.2024"},
+		{"solr.core.products_shard1_replica_n1", map[string]interface{}{}, "products"},
+		{"solr.core.products_shard1_0_replica1", map[string]interface{}{}, "products"},
+		{"solr.core.testcore", map[string]interface{}{}, "testcore"},
+	} {
+		assert.EqualValues(t, tt.collection, collectionName(tt.registry, tt.metrics), tt.registry)
+	}
+}
+
+func TestFetchMetricsCloud(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "solr" || password != "SolrRocks" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/solr/admin/metrics" || r.URL.Query().Get("group") != "core,jvm,node" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json, err := ioutil.ReadFile("./stats/cloud/metrics.json")
+		if err != nil {
+			panic(err)
+		}
+		w.Write(json)
+	}))
+	defer ts.Close()
+
+	solr := SolrPlugin{
+		BaseURL:  ts.URL + "/solr",
+		Prefix:   "solr",
+		User:     "solr",
+		Password: "SolrRocks",
+		Cloud:    true,
+	}
+	if err := solr.loadCloudStats(); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := solr.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.EqualValues(t, 4.0, stat["solr.collection.products.request_rate.select"])
+	assert.EqualValues(t, 0.75, stat["solr.collection.products.request_rate.update"])
+	assert.EqualValues(t, 20.0, stat["solr.collection.products.request_time_p95.select"])
+	assert.EqualValues(t, 40.0, stat["solr.collection.products.request_time_p95.update"])
+	assert.EqualValues(t, 60.0, stat["solr.collection.products.cache_hitratio.queryResultCache"])
+	assert.EqualValues(t, 75.0, stat["solr.collection.products.cache_hitratio.filterCache"])
+	assert.EqualValues(t, 0.0, stat["solr.collection.products.cache_hitratio.documentCache"])
+	assert.EqualValues(t, 3000.0, stat["solr.collection.products.index_size.size"])
+	assert.EqualValues(t, 0.02, stat["solr.collection.logs_2024.request_rate.select"])
+	assert.EqualValues(t, 300.0, stat["solr.collection.logs_2024.index_size.size"])
+
+	assert.EqualValues(t, 134217728.0, stat["heap_used"])
+	assert.EqualValues(t, 536870912.0, stat["heap_max"])
+	assert.EqualValues(t, 60.0, stat["threads_count"])
+	assert.EqualValues(t, 20.0, stat["threads_daemon"])
+	assert.EqualValues(t, 1.0, stat["threads_blocked"])
+	assert.EqualValues(t, 3.0, stat["cores_loaded"])
+
+	graphdef := solr.GraphDefinition()
+	assert.EqualValues(t, 7, len(graphdef))
+	assert.EqualValues(t, "select", graphdef["solr.collection.#.request_rate"].Metrics[0].Name)
+
+	solr.Password = "wrong"
+	assert.Error(t, solr.loadCloudStats())
+}
@@ -2,84 +2,222 @@ package mpsquid
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"squid.requests": {
-		Label: "Squid Client Requests",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "requests", Label: "Requests", Diff: true},
-		},
-	},
-	"squid.cache_hit_ratio.5min": {
-		Label: "Squid Client Cache Hit Ratio (5min)",
-		Unit:  "percentage",
-		Metrics: []mp.Metrics{
-			{Name: "request_ratio", Label: "Request Ratio", Diff: false},
-			{Name: "byte_ratio", Label: "Byte Ratio", Diff: false},
-		},
-	},
-}
-
 // SquidPlugin mackerel plugin for squid
 type SquidPlugin struct {
-	Target   string
-	Tempfile string
+	Target      string
+	Tempfile    string
+	Prefix      string
+	LabelPrefix string
+	// User and Password authenticate with cachemgr_passwd
+	User     string
+	Password string
 }
 
+// timeout bounds the connect and the I/O of each request to the cache manager
+const timeout = 10 * time.Second
+
 // FetchMetrics interface for mackerelplugin
 func (m SquidPlugin) FetchMetrics() (map[string]interface{}, error) {
-	conn, err := net.Dial("tcp", m.Target)
+	info, err := m.request("info")
+	if err != nil {
+		return nil, err
+	}
+	stat, err := parseInfo(bytes.NewReader(info))
 	if err != nil {
 		return nil, err
 	}
-	fmt.Fprintln(conn, "GET cache_object://"+m.Target+"/info HTTP/1.0\n\n")
-	scanner := bufio.NewScanner(conn)
 
-	stat := make(map[string]interface{})
-	//regexpmap := make(map[string]*regexp.Regexp)
-	regexpmap := map[*regexp.Regexp]string{
-		regexp.MustCompile("Number of HTTP requests received:\t([0-9]+)"): "requests",
-		// version 2
-		regexp.MustCompile("Request Hit Ratios:\t5min: ([0-9\\.]+)%"): "request_ratio",
-		regexp.MustCompile("Byte Hit Ratios:\t5min: ([0-9\\.]+)%"):    "byte_ratio",
-		// version 3
-		regexp.MustCompile("Hits as % of all requests:\t5min: ([0-9\\.]+)%"): "request_ratio",
-		regexp.MustCompile("Hits as % of bytes sent:\t5min: ([0-9\\.]+)%"):   "byte_ratio",
+	counters, err := m.request("counters")
+	if err != nil {
+		return nil, err
 	}
+	for k, v := range parseCounters(bytes.NewReader(counters)) {
+		// requests of info is kept, which counts the same as client_http.requests
+		if _, ok := stat[k]; !ok {
+			stat[k] = v
+		}
+	}
+	return stat, nil
+}
 
+// request requests the action of the cache manager, e.g. info, and returns the body of the response.
+// The password of cachemgr_passwd is sent in the basic authentication with User, or as cache_object://host/info@password.
+func (m SquidPlugin) request(action string) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", m.Target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	uri := "cache_object://" + m.Target + "/" + action
+	var header string
+	if m.User != "" {
+		header = "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(m.User+":"+m.Password)) + "\r\n"
+	} else if m.Password != "" {
+		uri += "@" + m.Password
+	}
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.0\r\n%s\r\n", uri, header); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("authentication failed for mgr:%s: %s", action, resp.Status)
+	default:
+		return nil, fmt.Errorf("mgr:%s returned %s", action, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// infoPatterns are the lines of mgr:info, where the tabs of Squid 3 are replaced with the spaces in some lines of
+// the later versions, and the labels of the hit ratios are changed in Squid 3
+var infoPatterns = map[*regexp.Regexp]string{
+	regexp.MustCompile("Number of HTTP requests received:\\s*([0-9]+)"): "requests",
+	// version 2
+	regexp.MustCompile("Request Hit Ratios:\\s*5min: ([0-9\\.]+)%"): "request_ratio",
+	regexp.MustCompile("Byte Hit Ratios:\\s*5min: ([0-9\\.]+)%"):    "byte_ratio",
+	// version 3 or later
+	regexp.MustCompile("Hits as % of all requests:\\s*5min: ([0-9\\.]+)%"): "request_ratio",
+	regexp.MustCompile("Hits as % of bytes sent:\\s*5min: ([0-9\\.]+)%"):   "byte_ratio",
+	// the 5 min column of Median Service Times (seconds)
+	regexp.MustCompile("^\\s*HTTP Requests \\(All\\):\\s*([0-9\\.]+)"): "service_time_all",
+	regexp.MustCompile("^\\s*Cache Misses:\\s*([0-9\\.]+)"):            "service_time_miss",
+	regexp.MustCompile("^\\s*Cache Hits:\\s*([0-9\\.]+)"):              "service_time_hit",
+	regexp.MustCompile("^\\s*DNS Lookups:\\s*([0-9\\.]+)"):             "service_time_dns",
+}
+
+// parseInfo parses mgr:info, where the metrics not found in the version are skipped
+func parseInfo(r io.Reader) (map[string]interface{}, error) {
+	stat := make(map[string]interface{})
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
-		s := string(line)
-
-		for rexp, key := range regexpmap {
-			match := rexp.FindStringSubmatch(s)
+		for rexp, key := range infoPatterns {
+			match := rexp.FindStringSubmatch(line)
 			if match == nil {
 				continue
 			}
 
-			stat[key], err = strconv.ParseFloat(match[1], 64)
+			v, err := strconv.ParseFloat(match[1], 64)
 			if err != nil {
 				return nil, err
 			}
+			stat[key] = v
 			break
 		}
 	}
+	return stat, scanner.Err()
+}
+
+// counterNames maps the counters of mgr:counters to the metrics
+var counterNames = map[string]string{
+	"client_http.requests": "requests",
+	"client_http.hits":     "hits",
+	"client_http.errors":   "errors",
+}
+
+// parseCounters parses the lines of mgr:counters in the form of <name> = <value>
+func parseCounters(r io.Reader) map[string]interface{} {
+	stat := make(map[string]interface{})
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, ok := counterNames[strings.TrimSpace(kv[0])]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil {
+			continue
+		}
+		stat[key] = v
+	}
+	return stat
+}
 
-	return stat, err
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m SquidPlugin) MetricKeyPrefix() string {
+	if m.Prefix == "" {
+		m.Prefix = "squid"
+	}
+	return m.Prefix
 }
 
 // GraphDefinition interface for mackerelplugin
 func (m SquidPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := m.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(m.MetricKeyPrefix())
+	}
+
+	return map[string]mp.Graphs{
+		"requests": {
+			Label: labelPrefix + " Client Requests",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true},
+			},
+		},
+		"cache_hit_ratio.5min": {
+			Label: labelPrefix + " Client Cache Hit Ratio (5min)",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "request_ratio", Label: "Request Ratio", Diff: false},
+				{Name: "byte_ratio", Label: "Byte Ratio", Diff: false},
+			},
+		},
+		"client_http": {
+			Label: labelPrefix + " Client HTTP",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "hits", Label: "Hits", Diff: true},
+				{Name: "errors", Label: "Errors", Diff: true},
+			},
+		},
+		"service_time.5min": {
+			Label: labelPrefix + " Median Service Time (5min)",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "service_time_all", Label: "HTTP Requests (sec)", Diff: false},
+				{Name: "service_time_miss", Label: "Cache Misses (sec)", Diff: false},
+				{Name: "service_time_hit", Label: "Cache Hits (sec)", Diff: false},
+				{Name: "service_time_dns", Label: "DNS Lookups (sec)", Diff: false},
+			},
+		},
+	}
+}
+
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the host and the port
+func (m SquidPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "squid", m.Target)
 }
 
 // Do the plugin
@@ -87,12 +225,17 @@ func Do() {
 	optHost := flag.String("host", "localhost", "Hostname")
 	optPort := flag.String("port", "3128", "Port")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "squid", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
+	optUser := flag.String("user", "", "User of the basic authentication of the cache manager")
+	optPassword := flag.String("password", "", "Password of cachemgr_passwd (or $MACKEREL_PLUGIN_SQUID_PASSWORD)")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "password", "MACKEREL_PLUGIN_SQUID_PASSWORD")
 
-	var squid SquidPlugin
+	squid := SquidPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix, User: *optUser, Password: *optPassword}
 	squid.Target = fmt.Sprintf("%s:%s", *optHost, *optPort)
 	helper := mp.NewMackerelPlugin(squid)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = squid.tempfile(*optTempfile)
 
 	helper.Run()
 }
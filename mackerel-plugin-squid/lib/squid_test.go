@@ -0,0 +1,204 @@
+package mpsquid
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraphDefinition(t *testing.T) {
+	var squid SquidPlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range squid.GraphDefinition() {
+		graphs[squid.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	expected := map[string]string{
+		"squid.requests":             "Squid Client Requests",
+		"squid.cache_hit_ratio.5min": "Squid Client Cache Hit Ratio (5min)",
+		"squid.client_http":          "Squid Client HTTP",
+		"squid.service_time.5min":    "Squid Median Service Time (5min)",
+	}
+	if !reflect.DeepEqual(graphs, expected) {
+		t.Errorf("the graphs should be %v but %v", expected, graphs)
+	}
+
+	squid.Prefix = "squid-proxy"
+	if label := squid.GraphDefinition()["requests"].Label; label != "Squid-Proxy Client Requests" {
+		t.Errorf("the label should be derived from the metric key prefix: %s", label)
+	}
+	squid.LabelPrefix = "Proxy"
+	if label := squid.GraphDefinition()["requests"].Label; label != "Proxy Client Requests" {
+		t.Errorf("the label should start with the label prefix: %s", label)
+	}
+}
+
+func TestTempfile(t *testing.T) {
+	p := SquidPlugin{Target: "localhost:3128"}
+	if other := (SquidPlugin{Target: "localhost:3129"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with Target: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/squid.json"); f != "/tmp/squid.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
+
+// a part of mgr:info of Squid 3.5
+const info35 = `Squid Object Cache: Version 3.5.27
+Connection information for squid:
+	Number of clients accessing cache:	1
+	Number of HTTP requests received:	1234
+	Number of ICP messages received:	0
+Cache information for squid:
+	Hits as % of all requests:	5min: 12.5%, 60min: 10.0%
+	Hits as % of bytes sent:	5min: 3.2%, 60min: 4.0%
+	Memory hits as % of hit requests:	5min: 0.0%, 60min: 0.0%
+Median Service Times (seconds)  5 min    60 min:
+	HTTP Requests (All):   0.04519  0.03829
+	Cache Misses:          0.05046  0.04519
+	Cache Hits:            0.00000  0.00000
+	Near Hits:             0.00000  0.00000
+	Not-Modified Replies:  0.00000  0.00000
+	DNS Lookups:           0.00190  0.00094
+	ICP Queries:           0.00000  0.00000
+`
+
+// a part of mgr:info of Squid 5, where some lines are indented with the spaces
+const info5 = `Squid Object Cache: Version 5.7
+Connection information for squid:
+        Number of clients accessing cache:      1
+        Number of HTTP requests received:       42
+Cache information for squid:
+        Hits as % of all requests:      5min: 50.0%, 60min: 40.0%
+        Hits as % of bytes sent:        5min: 60.0%, 60min: 70.0%
+Median Service Times (seconds)  5 min    60 min:
+        HTTP Requests (All):   0.00865  0.00865
+        Cache Misses:          0.01035  0.01035
+`
+
+func TestParseInfo(t *testing.T) {
+	stat, err := parseInfo(strings.NewReader(info35))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"requests":          1234.0,
+		"request_ratio":     12.5,
+		"byte_ratio":        3.2,
+		"service_time_all":  0.04519,
+		"service_time_miss": 0.05046,
+		"service_time_hit":  0.0,
+		"service_time_dns":  0.0019,
+	}
+	if !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the metrics of Squid 3.5 should be %v but %v", expected, stat)
+	}
+
+	stat, err = parseInfo(strings.NewReader(info5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lines not found are skipped rather than posted as zero
+	expected = map[string]interface{}{
+		"requests":          42.0,
+		"request_ratio":     50.0,
+		"byte_ratio":        60.0,
+		"service_time_all":  0.00865,
+		"service_time_miss": 0.01035,
+	}
+	if !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the metrics of Squid 5 should be %v but %v", expected, stat)
+	}
+}
+
+func TestParseCounters(t *testing.T) {
+	counters := `sample_time = 1672628645.123456 (Mon, 02 Jan 2023 03:04:05 GMT)
+client_http.requests = 1234
+client_http.hits = 150
+client_http.errors = 3
+client_http.kbytes_in = 512
+`
+	stat := parseCounters(strings.NewReader(counters))
+	expected := map[string]interface{}{
+		"requests": 1234.0,
+		"hits":     150.0,
+		"errors":   3.0,
+	}
+	if !reflect.DeepEqual(stat, expected) {
+		t.Errorf("the counters should be %v but %v", expected, stat)
+	}
+}
+
+// serveCacheManager serves one request of the cache manager with the handler on the listener. The request is read
+// by textproto since the underscore of cache_object is not allowed in the schemes of net/url.
+func serveCacheManager(t *testing.T, l net.Listener, handler func(uri string, header textproto.MIMEHeader) string) {
+	conn, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	r := textproto.NewReader(bufio.NewReader(conn))
+	line, err := r.ReadLine()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Write([]byte(handler(strings.Fields(line)[1], header)))
+}
+
+func TestRequest(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var uri, auth string
+	handler := func(u string, header textproto.MIMEHeader) string {
+		uri, auth = u, header.Get("Authorization")
+		return "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" + info5
+	}
+
+	m := SquidPlugin{Target: l.Addr().String(), Password: "secret"}
+	go serveCacheManager(t, l, handler)
+	body, err := m.request("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != info5 {
+		t.Errorf("the body should be the info: %q", body)
+	}
+	if uri != "cache_object://"+m.Target+"/info@secret" || auth != "" {
+		t.Errorf("the password should be sent in the URL without the user: %s %q", uri, auth)
+	}
+
+	m.User = "manager"
+	go serveCacheManager(t, l, handler)
+	if _, err := m.request("info"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("manager:secret")); auth != expected {
+		t.Errorf("the basic authentication should be sent with the user: %q", auth)
+	}
+	if uri != "cache_object://"+m.Target+"/info" {
+		t.Errorf("the password should not be in the URL with the user: %s", uri)
+	}
+
+	go serveCacheManager(t, l, func(string, textproto.MIMEHeader) string {
+		return "HTTP/1.1 401 Unauthorized\r\n\r\n"
+	})
+	if _, err := m.request("info"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("the authentication failure should be reported: %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
+	"github.com/mackerelio/mackerel-agent-plugins/envutil"
 	td "github.com/mattn/go-treasuredata"
 )
 
@@ -89,11 +90,12 @@ func (m TDTablePlugin) GraphDefinition() map[string]mp.Graphs {
 
 // Do the plugin
 func Do() {
-	optAPIKey := flag.String("api-key", "", "API Key")
+	optAPIKey := flag.String("api-key", "", "API Key (or $MACKEREL_PLUGIN_TD_TABLE_COUNT_API_KEY, $TD_API_KEY)")
 	optDatabase := flag.String("database", "", "Database name")
 	optIgnoreTableNames := flag.String("ignore-table", "", "Ignore Table name (Can be Comma-Separated)")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	flag.Parse()
+	envutil.SetFromEnv(flag.CommandLine, "api-key", "MACKEREL_PLUGIN_TD_TABLE_COUNT_API_KEY", "TD_API_KEY")
 
 	var plugin TDTablePlugin
 	plugin.APIKey = *optAPIKey
@@ -2,98 +2,272 @@ package mptrafficserver
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"trafficserver.cache": {
-		Label: "Trafficserver Cache Hits/Misses",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "cache_hits", Label: "Hits", Diff: true, Stacked: true, Type: "uint64"},
-			{Name: "cache_misses", Label: "Misses", Diff: true, Stacked: true, Type: "uint64"},
-		},
-	},
-	"trafficserver.http_response_codes": {
-		Label: "Trafficserver HTTP Response Codes",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "http_2xx", Label: "2xx", Diff: true, Stacked: true, Type: "uint64"},
-			{Name: "http_3xx", Label: "3xx", Diff: true, Stacked: true, Type: "uint64"},
-			{Name: "http_4xx", Label: "4xx", Diff: true, Stacked: true, Type: "uint64"},
-			{Name: "http_5xx", Label: "5xx", Diff: true, Stacked: true, Type: "uint64"},
-		},
-	},
-	"trafficserver.connections": {
-		Label: "Trafficserver Current Connections",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "conn_server", Label: "Server"},
-			{Name: "conn_client", Label: "Client"},
-		},
-	},
-}
+// metricVarDef maps metric names to the record names; the first record found is used,
+// since some records were renamed in ATS 7 and 9 (e.g. proxy.node.* was removed in ATS 9)
+var metricVarDef = map[string][]string{
+	// proxy.process.http.incoming_requests is not in the output of traffic_line on ATS 6 or earlier
+	"requests":              {"proxy.process.http.incoming_requests", "proxy.node.http.user_agents_total_transactions_count"},
+	"client_request_bytes":  {"proxy.node.http.user_agent_total_request_bytes", "proxy.process.http.user_agent_total_request_bytes"},
+	"client_response_bytes": {"proxy.node.http.user_agent_total_response_bytes", "proxy.process.http.user_agent_total_response_bytes"},
+	"server_request_bytes":  {"proxy.node.http.origin_server_total_request_bytes", "proxy.process.http.origin_server_total_request_bytes"},
+	"server_response_bytes": {"proxy.node.http.origin_server_total_response_bytes", "proxy.process.http.origin_server_total_response_bytes"},
 
-var metricVarDef = map[string]string{
-	"cache_hits":   "proxy.node.cache_total_hits",
-	"cache_misses": "proxy.node.cache_total_misses",
-	"http_2xx":     "proxy.process.http.2xx_responses",
-	"http_3xx":     "proxy.process.http.3xx_responses",
-	"http_4xx":     "proxy.process.http.4xx_responses",
-	"http_5xx":     "proxy.process.http.5xx_responses",
-	"conn_server":  "proxy.node.current_server_connections",
-	"conn_client":  "proxy.node.current_client_connections",
+	"cache_hits":   {"proxy.node.cache_total_hits", "proxy.process.cache_total_hits"},
+	"cache_misses": {"proxy.node.cache_total_misses", "proxy.process.cache_total_misses"},
+	"http_2xx":     {"proxy.process.http.2xx_responses"},
+	"http_3xx":     {"proxy.process.http.3xx_responses"},
+	"http_4xx":     {"proxy.process.http.4xx_responses"},
+	"http_5xx":     {"proxy.process.http.5xx_responses"},
+	"conn_server":  {"proxy.node.current_server_connections", "proxy.process.http.current_server_connections"},
+	"conn_client":  {"proxy.node.current_client_connections", "proxy.process.http.current_client_connections"},
+
+	"hit_fresh":       {"proxy.process.http.cache_hit_fresh"},
+	"hit_revalidated": {"proxy.process.http.cache_hit_revalidated"},
+	"hit_stale":       {"proxy.process.http.cache_hit_stale_served"},
+	"miss":            {"proxy.process.http.cache_miss_cold"},
+	"expired":         {"proxy.process.http.cache_miss_changed"},
+
+	"ram_cache_hits":       {"proxy.process.cache.ram_cache.hits"},
+	"ram_cache_misses":     {"proxy.process.cache.ram_cache.misses"},
+	"ram_cache_bytes_used": {"proxy.process.cache.ram_cache.bytes_used"},
+	"ram_cache_total":      {"proxy.process.cache.ram_cache.total_bytes"},
 }
 
+// cache results counted as hits and misses for the hit ratio
+var (
+	hitResults  = []string{"hit_fresh", "hit_revalidated", "hit_stale"}
+	missResults = []string{"miss", "expired"}
+)
+
+// sources of the records
+const (
+	sourceTrafficCtl  = "traffic_ctl"
+	sourceTrafficLine = "traffic_line"
+	sourceHTTP        = "http"
+)
+
 // TrafficserverPlugin mackerel plugin for apache trafficserver
 type TrafficserverPlugin struct {
-	Tempfile string
+	// Source is one of traffic_ctl, traffic_line and http, where traffic_ctl is used if empty
+	Source      string
+	Command     string
+	URI         string
+	Timeout     time.Duration
+	StateFile   string
+	Tempfile    string
+	Prefix      string
+	LabelPrefix string
+}
+
+// fetchRecords dumps the records from the source
+func (m TrafficserverPlugin) fetchRecords() (*string, error) {
+	switch m.Source {
+	case sourceHTTP:
+		return getDataWithHTTP(m.URI, m.Timeout)
+	case sourceTrafficLine:
+		return getDataWithCommand(m.Command, commandArgs(sourceTrafficLine))
+	}
+	return getDataWithCommand(m.Command, commandArgs(m.Command))
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m TrafficserverPlugin) FetchMetrics() (map[string]interface{}, error) {
 	var err error
-	strp, err := getDataWithCommand()
+	strp, err := m.fetchRecords()
 	if err != nil {
 		return nil, err
 	}
 
 	stat := make(map[string]interface{})
-	parseVars(strp, &stat)
+	if isJSON(*strp) {
+		err = parseJSON(*strp, &stat)
+	} else {
+		err = parseVars(strp, &stat)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.StateFile != "" {
+		if ratio, ok := m.hitRatio(stat, time.Now()); ok {
+			stat["hit_ratio"] = ratio
+		}
+	}
 
 	return stat, nil
 }
 
 func parseVars(text *string, statp *map[string]interface{}) error {
-	stat := *statp
-
-	varMetric := make(map[string]string)
-	for metric, varkey := range metricVarDef {
-		varMetric[varkey] = metric
-	}
+	records := make(map[string]string)
 
 	lines := strings.Split(*text, "\n")
 	for _, line := range lines {
-		factors := strings.Split(line, " ")
-		varkey := factors[0]
-
-		if metric, present := varMetric[varkey]; present {
-			stat[metric], _ = strconv.ParseUint(factors[1], 10, 64)
+		factors := strings.Fields(line)
+		if len(factors) < 2 {
+			continue
 		}
+		records[factors[0]] = factors[1]
 	}
 
+	setRecords(records, *statp)
 	return nil
 }
 
-func getDataWithCommand() (*string, error) {
-	cmd := exec.Command("traffic_line", "-m", "^proxy")
+func isJSON(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "{")
+}
+
+type jsonRecord struct {
+	Record struct {
+		RecordName   string      `json:"record_name"`
+		CurrentValue interface{} `json:"current_value"`
+	} `json:"record"`
+}
+
+// parseJSON parses the records dumped as JSON. Both of the JSON-RPC response of traffic_ctl
+// ({"result": {"recordList": [...]}}) and the flat object of stats_over_http ({"global": {...}}) are accepted.
+func parseJSON(text string, statp *map[string]interface{}) error {
+	var resp struct {
+		Result struct {
+			RecordList []jsonRecord `json:"recordList"`
+		} `json:"result"`
+		RecordList []jsonRecord           `json:"recordList"`
+		Global     map[string]interface{} `json:"global"`
+	}
+	if err := json.Unmarshal([]byte(text), &resp); err != nil {
+		return err
+	}
+
+	records := make(map[string]string)
+	for k, v := range resp.Global {
+		records[k] = fmt.Sprint(v)
+	}
+	for _, r := range append(resp.Result.RecordList, resp.RecordList...) {
+		records[r.Record.RecordName] = fmt.Sprint(r.Record.CurrentValue)
+	}
+
+	setRecords(records, *statp)
+	return nil
+}
+
+func setRecords(records map[string]string, stat map[string]interface{}) {
+	for metric, varkeys := range metricVarDef {
+		for _, varkey := range varkeys {
+			value, ok := records[varkey]
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			stat[metric] = uint64(v)
+			break
+		}
+	}
+}
+
+type saveItem struct {
+	LastTime time.Time `json:"last_time"`
+	Hits     uint64    `json:"hits"`
+	Total    uint64    `json:"total"`
+}
+
+func sumResults(stat map[string]interface{}, names []string) (uint64, bool) {
+	var sum uint64
+	for _, name := range names {
+		v, ok := stat[name].(uint64)
+		if !ok {
+			return 0, false
+		}
+		sum += v
+	}
+	return sum, true
+}
+
+// hitRatio calculates the cache hit ratio in percentage over the interval from the last run
+func (m TrafficserverPlugin) hitRatio(stat map[string]interface{}, now time.Time) (float64, bool) {
+	hits, ok := sumResults(stat, hitResults)
+	if !ok {
+		return 0, false
+	}
+	misses, ok := sumResults(stat, missResults)
+	if !ok {
+		return 0, false
+	}
+	current := saveItem{LastTime: now, Hits: hits, Total: hits + misses}
+
+	last, err := fetchSavedItem(m.StateFile)
+	if err != nil {
+		getStderrLogger().Println(err)
+	}
+	if err := saveValues(m.StateFile, current); err != nil {
+		getStderrLogger().Println(err)
+	}
+	if last == nil || now.Sub(last.LastTime).Seconds() > 600 {
+		return 0, false
+	}
+	// the counters have been reset or no request has come
+	if current.Hits < last.Hits || current.Total <= last.Total {
+		return 0, false
+	}
+	return float64(current.Hits-last.Hits) / float64(current.Total-last.Total) * 100.0, true
+}
+
+func saveValues(stateFile string, item saveItem) error {
+	f, err := os.Create(stateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(item)
+}
+
+func fetchSavedItem(stateFile string) (*saveItem, error) {
+	f, err := os.Open(stateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var item saveItem
+	if err := json.NewDecoder(f).Decode(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// commandArgs returns the arguments to dump the records; traffic_line is deprecated in favor of traffic_ctl
+func commandArgs(command string) []string {
+	if filepath.Base(command) == "traffic_line" {
+		return []string{"-m", "^proxy"}
+	}
+	return []string{"metric", "match", "^proxy\\."}
+}
+
+func getDataWithCommand(command string, args []string) (*string, error) {
+	cmd := exec.Command(command, args...)
 
 	var out bytes.Buffer
 	cmd.Stdout = &out
@@ -106,9 +280,122 @@ func getDataWithCommand() (*string, error) {
 	return &str, nil
 }
 
+// getDataWithHTTP fetches the records as JSON from the stats_over_http plugin
+func getDataWithHTTP(uri string, timeout time.Duration) (*string, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", uri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	str := string(body)
+	if !isJSON(str) {
+		return nil, fmt.Errorf("the response of %s is not JSON", uri)
+	}
+	return &str, nil
+}
+
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m TrafficserverPlugin) MetricKeyPrefix() string {
+	if m.Prefix == "" {
+		m.Prefix = "trafficserver"
+	}
+	return m.Prefix
+}
+
 // GraphDefinition interface for mackerelplugin
 func (m TrafficserverPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := m.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(m.MetricKeyPrefix())
+	}
+
+	return map[string]mp.Graphs{
+		"requests": {
+			Label: labelPrefix + " Incoming Requests",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true, Type: "uint64"},
+			},
+		},
+		"traffic": {
+			Label: labelPrefix + " Traffic",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "client_request_bytes", Label: "Client Request", Diff: true, Type: "uint64"},
+				{Name: "client_response_bytes", Label: "Client Response", Diff: true, Type: "uint64"},
+				{Name: "server_request_bytes", Label: "Origin Server Request", Diff: true, Type: "uint64"},
+				{Name: "server_response_bytes", Label: "Origin Server Response", Diff: true, Type: "uint64"},
+			},
+		},
+		"cache": {
+			Label: labelPrefix + " Cache Hits/Misses",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache_hits", Label: "Hits", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "cache_misses", Label: "Misses", Diff: true, Stacked: true, Type: "uint64"},
+			},
+		},
+		"http_response_codes": {
+			Label: labelPrefix + " HTTP Response Codes",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "http_2xx", Label: "2xx", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "http_3xx", Label: "3xx", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "http_4xx", Label: "4xx", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "http_5xx", Label: "5xx", Diff: true, Stacked: true, Type: "uint64"},
+			},
+		},
+		"cache_results": {
+			Label: labelPrefix + " Cache Results",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "hit_fresh", Label: "Hit Fresh", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "hit_revalidated", Label: "Hit Revalidated", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "hit_stale", Label: "Hit Stale", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "miss", Label: "Miss", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "expired", Label: "Expired", Diff: true, Stacked: true, Type: "uint64"},
+			},
+		},
+		"cache_hit_ratio": {
+			Label: labelPrefix + " Cache Hit Ratio",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "hit_ratio", Label: "Hit Ratio"},
+			},
+		},
+		"ram_cache": {
+			Label: labelPrefix + " RAM Cache Hits/Misses",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ram_cache_hits", Label: "Hits", Diff: true, Stacked: true, Type: "uint64"},
+				{Name: "ram_cache_misses", Label: "Misses", Diff: true, Stacked: true, Type: "uint64"},
+			},
+		},
+		"ram_cache_usage": {
+			Label: labelPrefix + " RAM Cache Usage",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "ram_cache_bytes_used", Label: "Used", Type: "uint64"},
+				{Name: "ram_cache_total", Label: "Total", Type: "uint64"},
+			},
+		},
+		"connections": {
+			Label: labelPrefix + " Current Connections",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "conn_server", Label: "Server"},
+				{Name: "conn_client", Label: "Client"},
+			},
+		},
+	}
 }
 
 var stderrLogger *log.Logger
@@ -120,12 +407,44 @@ func getStderrLogger() *log.Logger {
 	return stderrLogger
 }
 
+// stateFilePath returns the file to save the cache results for the interval hit ratio
+func stateFilePath(tempfile string) string {
+	if tempfile != "" {
+		return tempfile + "-hit-ratio"
+	}
+	dir := os.Getenv("MACKEREL_PLUGIN_WORKDIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "mackerel-plugin-trafficserver-hit-ratio")
+}
+
 // Do the plugin
 func Do() {
+	optSource := flag.String("source", sourceTrafficCtl, "Source of the records: traffic_ctl, traffic_line (ATS 6 or earlier) or http (stats_over_http)")
+	optCommand := flag.String("command", "", "Path to traffic_ctl or traffic_line (default: the name of -source)")
+	optURI := flag.String("uri", "http://localhost/_stats", "URI of stats_over_http for -source=http")
+	optTimeout := flag.Duration("timeout", 5*time.Second, "Timeout of the request for -source=http")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "trafficserver", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
 	flag.Parse()
 
-	var trafficserver TrafficserverPlugin
+	trafficserver := TrafficserverPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
+	switch *optSource {
+	case sourceTrafficCtl, sourceTrafficLine:
+		trafficserver.Command = *optCommand
+		if trafficserver.Command == "" {
+			trafficserver.Command = *optSource
+		}
+	case sourceHTTP:
+		trafficserver.URI = *optURI
+		trafficserver.Timeout = *optTimeout
+	default:
+		log.Fatalf("Invalid -source: %s", *optSource)
+	}
+	trafficserver.Source = *optSource
+	trafficserver.StateFile = stateFilePath(*optTempfile)
 
 	helper := mp.NewMackerelPlugin(trafficserver)
 	helper.Tempfile = *optTempfile
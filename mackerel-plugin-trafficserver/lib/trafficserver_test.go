@@ -1,7 +1,14 @@
 package mptrafficserver
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,6 +27,225 @@ func TestParsePluginConfig(t *testing.T) {
 	assert.EqualValues(t, stat["conn_client"], 2)
 }
 
+func TestParseVarsATS9(t *testing.T) {
+	stat := make(map[string]interface{})
+	parseVars(&parseVarsATS9Stub, &stat)
+
+	assert.EqualValues(t, 1520, stat["cache_hits"])
+	assert.EqualValues(t, 388, stat["cache_misses"])
+	assert.EqualValues(t, 1833, stat["http_2xx"])
+	assert.EqualValues(t, 12, stat["conn_server"])
+	assert.EqualValues(t, 34, stat["conn_client"])
+	assert.EqualValues(t, 1200, stat["hit_fresh"])
+	assert.EqualValues(t, 80, stat["hit_revalidated"])
+	assert.EqualValues(t, 20, stat["hit_stale"])
+	assert.EqualValues(t, 300, stat["miss"])
+	assert.EqualValues(t, 50, stat["expired"])
+	assert.EqualValues(t, 980, stat["ram_cache_hits"])
+	assert.EqualValues(t, 540, stat["ram_cache_misses"])
+	assert.EqualValues(t, 1048576, stat["ram_cache_bytes_used"])
+	assert.EqualValues(t, 33554432, stat["ram_cache_total"])
+	assert.EqualValues(t, 1910, stat["requests"])
+	assert.EqualValues(t, 734002, stat["client_request_bytes"])
+	assert.EqualValues(t, 52428800, stat["client_response_bytes"])
+	assert.EqualValues(t, 120340, stat["server_request_bytes"])
+	assert.EqualValues(t, 41943040, stat["server_response_bytes"])
+}
+
+func TestParseVarsATS7(t *testing.T) {
+	stat := make(map[string]interface{})
+	parseVars(&parseVarsATS7Stub, &stat)
+
+	// the records of proxy.node.* are preferred as before
+	assert.EqualValues(t, 2100, stat["cache_hits"])
+	assert.EqualValues(t, 410, stat["cache_misses"])
+	assert.EqualValues(t, 21, stat["conn_client"])
+	assert.EqualValues(t, 8, stat["conn_server"])
+	assert.EqualValues(t, 2512, stat["requests"])
+	assert.EqualValues(t, 912345, stat["client_request_bytes"])
+	assert.EqualValues(t, 73400320, stat["client_response_bytes"])
+	assert.EqualValues(t, 230000, stat["server_request_bytes"])
+	assert.EqualValues(t, 62914560, stat["server_response_bytes"])
+	assert.EqualValues(t, 2400, stat["http_2xx"])
+	assert.EqualValues(t, 1700, stat["hit_fresh"])
+}
+
+func TestFetchMetricsHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_stats" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, statsOverHTTPATS9Stub)
+	}))
+	defer ts.Close()
+
+	m := TrafficserverPlugin{Source: sourceHTTP, URI: ts.URL + "/_stats", Timeout: time.Second}
+	stat, err := m.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1520, stat["cache_hits"])
+	assert.EqualValues(t, 1833, stat["http_2xx"])
+	assert.EqualValues(t, 34, stat["conn_client"])
+	assert.EqualValues(t, 1910, stat["requests"])
+	assert.EqualValues(t, 52428800, stat["client_response_bytes"])
+
+	m.URI = ts.URL + "/missing"
+	_, err = m.FetchMetrics()
+	assert.Error(t, err)
+}
+
+func TestParseJSON(t *testing.T) {
+	for name, text := range map[string]string{
+		"traffic_ctl": `{"jsonrpc": "2.0", "result": {"recordList": [
+			{"record": {"record_name": "proxy.process.http.cache_hit_fresh", "current_value": "1200"}},
+			{"record": {"record_name": "proxy.process.http.current_client_connections", "current_value": "34"}}
+		]}, "id": "1"}`,
+		"stats_over_http": `{"global": {
+			"proxy.process.http.cache_hit_fresh": "1200",
+			"proxy.process.http.current_client_connections": 34
+		}}`,
+	} {
+		stat := make(map[string]interface{})
+		assert.True(t, isJSON(text), name)
+		assert.Nil(t, parseJSON(text, &stat), name)
+		assert.EqualValues(t, 1200, stat["hit_fresh"], name)
+		assert.EqualValues(t, 34, stat["conn_client"], name)
+	}
+	assert.False(t, isJSON(parseVarsATS9Stub))
+}
+
+func TestHitRatio(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-trafficserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := TrafficserverPlugin{StateFile: filepath.Join(dir, "hit-ratio")}
+	now := time.Now()
+	stat := map[string]interface{}{
+		"hit_fresh": uint64(100), "hit_revalidated": uint64(10), "hit_stale": uint64(0),
+		"miss": uint64(80), "expired": uint64(10),
+	}
+	_, ok := m.hitRatio(stat, now)
+	assert.False(t, ok, "no ratio at the first run")
+
+	stat["hit_fresh"] = uint64(160)
+	stat["miss"] = uint64(100)
+	ratio, ok := m.hitRatio(stat, now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.InDelta(t, 75.0, ratio, 0.001)
+
+	_, ok = m.hitRatio(map[string]interface{}{"hit_fresh": uint64(1)}, now.Add(2*time.Minute))
+	assert.False(t, ok, "no ratio without the cache results")
+}
+
+func TestGraphDefinition(t *testing.T) {
+	var trafficserver TrafficserverPlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range trafficserver.GraphDefinition() {
+		graphs[trafficserver.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"trafficserver.requests":            "Trafficserver Incoming Requests",
+		"trafficserver.traffic":             "Trafficserver Traffic",
+		"trafficserver.cache":               "Trafficserver Cache Hits/Misses",
+		"trafficserver.http_response_codes": "Trafficserver HTTP Response Codes",
+		"trafficserver.cache_results":       "Trafficserver Cache Results",
+		"trafficserver.cache_hit_ratio":     "Trafficserver Cache Hit Ratio",
+		"trafficserver.ram_cache":           "Trafficserver RAM Cache Hits/Misses",
+		"trafficserver.ram_cache_usage":     "Trafficserver RAM Cache Usage",
+		"trafficserver.connections":         "Trafficserver Current Connections",
+	}, graphs)
+
+	trafficserver.Prefix = "ats-edge"
+	assert.Equal(t, "Ats-Edge Cache Results", trafficserver.GraphDefinition()["cache_results"].Label)
+	trafficserver.LabelPrefix = "Edge"
+	assert.Equal(t, "Edge Cache Results", trafficserver.GraphDefinition()["cache_results"].Label)
+}
+
+func TestCommandArgs(t *testing.T) {
+	assert.Equal(t, []string{"metric", "match", "^proxy\\."}, commandArgs("traffic_ctl"))
+	assert.Equal(t, []string{"-m", "^proxy"}, commandArgs("/opt/ts/bin/traffic_line"))
+}
+
+// output of traffic_ctl metric match ^proxy\. on ATS 9
+var parseVarsATS9Stub = `proxy.process.http.completed_requests 1908
+proxy.process.http.2xx_responses 1833
+proxy.process.http.3xx_responses 41
+proxy.process.http.4xx_responses 30
+proxy.process.http.5xx_responses 4
+proxy.process.http.current_client_connections 34
+proxy.process.http.current_server_connections 12
+proxy.process.http.cache_hit_fresh 1200
+proxy.process.http.cache_hit_mem_fresh 0
+proxy.process.http.cache_hit_revalidated 80
+proxy.process.http.cache_hit_ims 3
+proxy.process.http.cache_hit_stale_served 20
+proxy.process.http.cache_miss_cold 300
+proxy.process.http.cache_miss_changed 50
+proxy.process.http.cache_miss_client_no_cache 0
+proxy.process.cache_total_hits 1520
+proxy.process.cache_total_misses 388
+proxy.process.cache.ram_cache.total_bytes 33554432
+proxy.process.cache.ram_cache.bytes_used 1048576
+proxy.process.cache.ram_cache.hits 980
+proxy.process.cache.ram_cache.misses 540
+proxy.process.http.incoming_requests 1910
+proxy.process.http.user_agent_total_request_bytes 734002
+proxy.process.http.user_agent_total_response_bytes 52428800
+proxy.process.http.origin_server_total_request_bytes 120340
+proxy.process.http.origin_server_total_response_bytes 41943040
+proxy.process.version.server.short 9.2.3
+`
+
+// output of traffic_ctl metric match ^proxy\. on ATS 7, which still has proxy.node.*
+var parseVarsATS7Stub = `proxy.node.cache_total_hits 2100
+proxy.node.cache_total_misses 410
+proxy.node.current_client_connections 21
+proxy.node.current_server_connections 8
+proxy.node.http.user_agents_total_transactions_count 2500
+proxy.node.http.user_agent_total_request_bytes 912345
+proxy.node.http.user_agent_total_response_bytes 73400320
+proxy.node.http.origin_server_total_request_bytes 230000
+proxy.node.http.origin_server_total_response_bytes 62914560
+proxy.process.cache_total_hits 2099
+proxy.process.cache_total_misses 409
+proxy.process.http.incoming_requests 2512
+proxy.process.http.user_agent_request_document_total_size 12345
+proxy.process.http.user_agent_response_document_total_size 70000000
+proxy.process.http.2xx_responses 2400
+proxy.process.http.3xx_responses 60
+proxy.process.http.4xx_responses 40
+proxy.process.http.5xx_responses 12
+proxy.process.http.current_client_connections 20
+proxy.process.http.current_server_connections 7
+proxy.process.http.cache_hit_fresh 1700
+proxy.process.http.cache_hit_revalidated 90
+proxy.process.http.cache_hit_stale_served 10
+proxy.process.http.cache_miss_cold 350
+proxy.process.http.cache_miss_changed 60
+proxy.process.version.server.short 7.1.12
+`
+
+// output of stats_over_http on ATS 9, whose values are strings
+var statsOverHTTPATS9Stub = `{ "global": {
+"proxy.process.http.completed_requests": "1908",
+"proxy.process.http.incoming_requests": "1910",
+"proxy.process.http.2xx_responses": "1833",
+"proxy.process.http.current_client_connections": "34",
+"proxy.process.http.current_server_connections": "12",
+"proxy.process.http.user_agent_total_request_bytes": "734002",
+"proxy.process.http.user_agent_total_response_bytes": "52428800",
+"proxy.process.cache_total_hits": "1520",
+"proxy.process.cache_total_misses": "388",
+"proxy.process.version.server.short": "9.2.3",
+"server": "9.2.3"
+}
+}
+`
+
 var parseVarsStub = `
 proxy.node.num_processes 0
 proxy.node.hostname_FQ examplehost
@@ -39,6 +39,8 @@ type ServerStats struct {
 	ResponseBytes     *uint64
 	Requests          *uint64
 	Responses         *uint64
+	// ServerEjectedAt is the time in microseconds when the server was ejected last, which is 0 if never
+	ServerEjectedAt *uint64
 }
 
 func getStats(p TwemproxyPlugin) (*TwemproxyStats, error) {
@@ -186,7 +188,7 @@ L:
 		case "responses":
 			server.Responses = &cv
 		case "server_ejected_at":
-			// do not use this parameter. skip.
+			server.ServerEjectedAt = &cv
 		default:
 			err = fmt.Errorf("invalid key: %v in rawServer: %v", k, rawStats)
 			break L
@@ -3,10 +3,12 @@ package mptwemproxy
 import (
 	"flag"
 	"fmt"
+	"log"
 	"regexp"
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // TwemproxyPlugin mackerel plugin
@@ -15,6 +17,8 @@ type TwemproxyPlugin struct {
 	Prefix            string
 	Timeout           uint
 	EachServerMetrics bool
+	// IncludePool limits the metrics of each pool and server to the pools matching the regexp if not nil
+	IncludePool *regexp.Regexp
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
@@ -66,7 +70,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "client_eof", Label: "Client EOF", Diff: true},
 			},
 		},
-		"server_error.#": {
+		"server_error.#.#": {
 			Label: (labelPrefix + " Server Error"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
@@ -74,7 +78,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "server_timedout", Label: "Server Timedout", Diff: true},
 			},
 		},
-		"server_connections.#": {
+		"server_connections.#.#": {
 			Label: (labelPrefix + " Server Connections"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
@@ -82,7 +86,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "server_eof", Label: "Server EOF", Diff: true},
 			},
 		},
-		"server_queue.#": {
+		"server_queue.#.#": {
 			Label: (labelPrefix + " Server Queue"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
@@ -90,7 +94,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "in_queue", Label: "In Queue", Diff: false},
 			},
 		},
-		"server_queue_bytes.#": {
+		"server_queue_bytes.#.#": {
 			Label: (labelPrefix + " Server Queue Bytes"),
 			Unit:  "bytes",
 			Metrics: []mp.Metrics{
@@ -98,7 +102,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "in_queue_bytes", Label: "In Queue Bytes", Diff: false},
 			},
 		},
-		"server_communications.#": {
+		"server_communications.#.#": {
 			Label: (labelPrefix + " Server Communications"),
 			Unit:  "integer",
 			Metrics: []mp.Metrics{
@@ -106,7 +110,7 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "responses", Label: "Responses", Diff: true},
 			},
 		},
-		"server_communication_bytes.#": {
+		"server_communication_bytes.#.#": {
 			Label: (labelPrefix + " Server Communication Bytes"),
 			Unit:  "bytes",
 			Metrics: []mp.Metrics{
@@ -114,6 +118,13 @@ func (p TwemproxyPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "response_bytes", Label: "Response Bytes", Diff: true},
 			},
 		},
+		"server_ejected.#.#": {
+			Label: (labelPrefix + " Server Ejected"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ejected", Label: "Ejected", Diff: false},
+			},
+		},
 	}
 	return graphdef
 }
@@ -142,23 +153,28 @@ func (p TwemproxyPlugin) FetchMetrics() (map[string]interface{}, error) {
 
 	// NOTE: Each custom metric name contains a wildcard.
 	for pName, po := range stats.Pools {
+		// the totals include the pools not matching IncludePool
+		included := p.IncludePool == nil || p.IncludePool.MatchString(pName)
+
 		// A normalized pool name corresponds a wildcard
 		np := normalizeMetricName(pName)
 		wp := "." + np + "."
-		metrics["pool_error"+wp+"client_err"] = *po.ClientErr
-		metrics["pool_error"+wp+"server_ejects"] = *po.ServerEjects
-		metrics["pool_error"+wp+"forward_error"] = *po.ForwardError
-		metrics["pool_client_connections"+wp+"client_eof"] = *po.ClientEOF
-		metrics["pool_client_connections"+wp+"client_connections"] = *po.ClientConnections
+		if included {
+			metrics["pool_error"+wp+"client_err"] = *po.ClientErr
+			metrics["pool_error"+wp+"server_ejects"] = *po.ServerEjects
+			metrics["pool_error"+wp+"forward_error"] = *po.ForwardError
+			metrics["pool_client_connections"+wp+"client_eof"] = *po.ClientEOF
+			metrics["pool_client_connections"+wp+"client_connections"] = *po.ClientConnections
+		}
 		totalPoolClientErr += *po.ClientErr
 		totalPoolServerEjects += *po.ServerEjects
 		totalPoolForwardErr += *po.ForwardError
 
 		for sName, s := range po.Servers {
-			if p.EachServerMetrics {
-				// A concat of normalized pool and server names corresponds a wildcard
+			if p.EachServerMetrics && included {
+				// Normalized pool and server names correspond wildcards respectively
 				ns := normalizeMetricName(sName)
-				ws := "." + np + "_" + ns + "."
+				ws := wp + ns + "."
 				metrics["server_error"+ws+"server_err"] = *s.ServerErr
 				metrics["server_error"+ws+"server_timedout"] = *s.ServerTimedout
 				metrics["server_connections"+ws+"server_eof"] = *s.ServerEOF
@@ -171,6 +187,13 @@ func (p TwemproxyPlugin) FetchMetrics() (map[string]interface{}, error) {
 				metrics["server_communications"+ws+"responses"] = *s.Responses
 				metrics["server_communication_bytes"+ws+"request_bytes"] = *s.RequestBytes
 				metrics["server_communication_bytes"+ws+"response_bytes"] = *s.ResponseBytes
+				if s.ServerEjectedAt != nil {
+					ejected := uint64(0)
+					if *s.ServerEjectedAt != 0 {
+						ejected = 1
+					}
+					metrics["server_ejected"+ws+"ejected"] = ejected
+				}
 			}
 			totalServerTimeout += *s.ServerTimedout
 			totalServerErr += *s.ServerErr
@@ -191,6 +214,11 @@ func normalizeMetricName(name string) string {
 	return normalizeMetricNameRe.ReplaceAllString(name, "_")
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the address of the stats
+func (p TwemproxyPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "twemproxy", p.Address)
+}
+
 // Do the plugin
 func Do() {
 	optAddress := flag.String("address", "localhost:22222", "twemproxy stats Address")
@@ -198,6 +226,7 @@ func Do() {
 	optTimeout := flag.Uint("timeout", 5, "Timeout")
 	optEachServerMetrics := flag.Bool("enable-each-server-metrics", false, "Enable metric collection for each server")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optIncludePool := flag.String("include-pool", "", "Regexp of the pools whose metrics of each pool and server are posted")
 	flag.Parse()
 
 	p := TwemproxyPlugin{
@@ -206,8 +235,15 @@ func Do() {
 		Timeout:           *optTimeout,
 		EachServerMetrics: *optEachServerMetrics,
 	}
+	if *optIncludePool != "" {
+		re, err := regexp.Compile(*optIncludePool)
+		if err != nil {
+			log.Fatalf("Invalid -include-pool: %s", err)
+		}
+		p.IncludePool = re
+	}
 
 	helper := mp.NewMackerelPlugin(p)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = p.tempfile(*optTempfile)
 	helper.Run()
 }
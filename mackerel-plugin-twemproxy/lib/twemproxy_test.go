@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -169,47 +170,50 @@ func TestFetchMetrics(t *testing.T) {
 		"pool_error.redis-index.forward_error":                                      1,
 		"pool_client_connections.redis-index.client_eof":                            1716,
 		"pool_client_connections.redis-index.client_connections":                    121,
-		"server_error.redis-index_index1_cache_6379.server_err":                     5,
-		"server_error.redis-index_index1_cache_6379.server_timedout":                3,
-		"server_connections.redis-index_index1_cache_6379.server_eof":               2,
-		"server_connections.redis-index_index1_cache_6379.server_connections":       4,
-		"server_queue.redis-index_index1_cache_6379.out_queue":                      1,
-		"server_queue.redis-index_index1_cache_6379.in_queue":                       2,
-		"server_queue_bytes.redis-index_index1_cache_6379.out_queue_bytes":          80,
-		"server_queue_bytes.redis-index_index1_cache_6379.in_queue_bytes":           50,
-		"server_communications.redis-index_index1_cache_6379.requests":              3908,
-		"server_communications.redis-index_index1_cache_6379.responses":             3908,
-		"server_communication_bytes.redis-index_index1_cache_6379.request_bytes":    170558,
-		"server_communication_bytes.redis-index_index1_cache_6379.response_bytes":   176918,
+		"server_error.redis-index.index1_cache_6379.server_err":                     5,
+		"server_error.redis-index.index1_cache_6379.server_timedout":                3,
+		"server_connections.redis-index.index1_cache_6379.server_eof":               2,
+		"server_connections.redis-index.index1_cache_6379.server_connections":       4,
+		"server_queue.redis-index.index1_cache_6379.out_queue":                      1,
+		"server_queue.redis-index.index1_cache_6379.in_queue":                       2,
+		"server_queue_bytes.redis-index.index1_cache_6379.out_queue_bytes":          80,
+		"server_queue_bytes.redis-index.index1_cache_6379.in_queue_bytes":           50,
+		"server_communications.redis-index.index1_cache_6379.requests":              3908,
+		"server_communications.redis-index.index1_cache_6379.responses":             3908,
+		"server_communication_bytes.redis-index.index1_cache_6379.request_bytes":    170558,
+		"server_communication_bytes.redis-index.index1_cache_6379.response_bytes":   176918,
 		"pool_error.redis_budget.client_err":                                        30,
 		"pool_error.redis_budget.server_ejects":                                     40,
 		"pool_error.redis_budget.forward_error":                                     2,
 		"pool_client_connections.redis_budget.client_eof":                           2716,
 		"pool_client_connections.redis_budget.client_connections":                   221,
-		"server_error.redis_budget_budget1_cache_6379.server_err":                   3,
-		"server_error.redis_budget_budget1_cache_6379.server_timedout":              4,
-		"server_connections.redis_budget_budget1_cache_6379.server_eof":             3,
-		"server_connections.redis_budget_budget1_cache_6379.server_connections":     5,
-		"server_queue.redis_budget_budget1_cache_6379.out_queue":                    2,
-		"server_queue.redis_budget_budget1_cache_6379.in_queue":                     3,
-		"server_queue_bytes.redis_budget_budget1_cache_6379.out_queue_bytes":        81,
-		"server_queue_bytes.redis_budget_budget1_cache_6379.in_queue_bytes":         51,
-		"server_communications.redis_budget_budget1_cache_6379.requests":            3909,
-		"server_communications.redis_budget_budget1_cache_6379.responses":           3909,
-		"server_communication_bytes.redis_budget_budget1_cache_6379.request_bytes":  170559,
-		"server_communication_bytes.redis_budget_budget1_cache_6379.response_bytes": 176919,
-		"server_error.redis_budget_budget2_cache_6379.server_err":                   5,
-		"server_error.redis_budget_budget2_cache_6379.server_timedout":              6,
-		"server_connections.redis_budget_budget2_cache_6379.server_eof":             5,
-		"server_connections.redis_budget_budget2_cache_6379.server_connections":     7,
-		"server_queue.redis_budget_budget2_cache_6379.out_queue":                    4,
-		"server_queue.redis_budget_budget2_cache_6379.in_queue":                     5,
-		"server_queue_bytes.redis_budget_budget2_cache_6379.out_queue_bytes":        83,
-		"server_queue_bytes.redis_budget_budget2_cache_6379.in_queue_bytes":         53,
-		"server_communications.redis_budget_budget2_cache_6379.requests":            3911,
-		"server_communications.redis_budget_budget2_cache_6379.responses":           3911,
-		"server_communication_bytes.redis_budget_budget2_cache_6379.request_bytes":  170561,
-		"server_communication_bytes.redis_budget_budget2_cache_6379.response_bytes": 176921,
+		"server_error.redis_budget.budget1_cache_6379.server_err":                   3,
+		"server_error.redis_budget.budget1_cache_6379.server_timedout":              4,
+		"server_connections.redis_budget.budget1_cache_6379.server_eof":             3,
+		"server_connections.redis_budget.budget1_cache_6379.server_connections":     5,
+		"server_queue.redis_budget.budget1_cache_6379.out_queue":                    2,
+		"server_queue.redis_budget.budget1_cache_6379.in_queue":                     3,
+		"server_queue_bytes.redis_budget.budget1_cache_6379.out_queue_bytes":        81,
+		"server_queue_bytes.redis_budget.budget1_cache_6379.in_queue_bytes":         51,
+		"server_communications.redis_budget.budget1_cache_6379.requests":            3909,
+		"server_communications.redis_budget.budget1_cache_6379.responses":           3909,
+		"server_communication_bytes.redis_budget.budget1_cache_6379.request_bytes":  170559,
+		"server_communication_bytes.redis_budget.budget1_cache_6379.response_bytes": 176919,
+		"server_error.redis_budget.budget2_cache_6379.server_err":                   5,
+		"server_error.redis_budget.budget2_cache_6379.server_timedout":              6,
+		"server_connections.redis_budget.budget2_cache_6379.server_eof":             5,
+		"server_connections.redis_budget.budget2_cache_6379.server_connections":     7,
+		"server_queue.redis_budget.budget2_cache_6379.out_queue":                    4,
+		"server_queue.redis_budget.budget2_cache_6379.in_queue":                     5,
+		"server_queue_bytes.redis_budget.budget2_cache_6379.out_queue_bytes":        83,
+		"server_queue_bytes.redis_budget.budget2_cache_6379.in_queue_bytes":         53,
+		"server_communications.redis_budget.budget2_cache_6379.requests":            3911,
+		"server_communications.redis_budget.budget2_cache_6379.responses":           3911,
+		"server_communication_bytes.redis_budget.budget2_cache_6379.request_bytes":  170561,
+		"server_communication_bytes.redis_budget.budget2_cache_6379.response_bytes": 176921,
+		"server_ejected.redis-index.index1_cache_6379.ejected":                      0,
+		"server_ejected.redis_budget.budget1_cache_6379.ejected":                    0,
+		"server_ejected.redis_budget.budget2_cache_6379.ejected":                    1,
 	}
 
 	for k, v := range expected {
@@ -263,6 +267,37 @@ func TestFetchMetrics_disableEachMetrics(t *testing.T) {
 	}
 }
 
+func TestFetchMetrics_includePool(t *testing.T) {
+	// response a valid stats json
+	stats = jsonStr
+
+	p := TwemproxyPlugin{
+		Address:           "localhost:" + strconv.Itoa(statsServer.Port()),
+		Prefix:            "twemproxy",
+		Timeout:           5,
+		EachServerMetrics: true,
+		IncludePool:       regexp.MustCompile(`budget`),
+	}
+	metrics, err := p.FetchMetrics()
+	if err != nil {
+		t.Errorf("Failed to FetchMetrics: %s", err)
+		return
+	}
+
+	for k := range metrics {
+		if strings.Contains(k, "redis-index") {
+			t.Errorf("metric of %s should not be fetched", k)
+		}
+	}
+	if _, ok := metrics["server_queue.redis_budget.budget1_cache_6379.in_queue"]; !ok {
+		t.Errorf("metric of the included pool should be fetched")
+	}
+	// the totals are over all the pools
+	if v := metrics["total_pool_client_error"]; v != uint64(40) {
+		t.Errorf("total_pool_client_error should be 40, but %v", v)
+	}
+}
+
 func TestFetchMetricsFail(t *testing.T) {
 	assertPanic := func(t *testing.T, f func() (map[string]interface{}, error)) {
 		defer func() {
@@ -322,30 +357,33 @@ func TestGraphDefinition(t *testing.T) {
 			"client_connections",
 			"client_eof",
 		},
-		"server_error.#": {
+		"server_error.#.#": {
 			"server_err",
 			"server_timedout",
 		},
-		"server_connections.#": {
+		"server_connections.#.#": {
 			"server_connections",
 			"server_eof",
 		},
-		"server_queue.#": {
+		"server_queue.#.#": {
 			"out_queue",
 			"in_queue",
 		},
-		"server_queue_bytes.#": {
+		"server_queue_bytes.#.#": {
 			"out_queue_bytes",
 			"in_queue_bytes",
 		},
-		"server_communications.#": {
+		"server_communications.#.#": {
 			"requests",
 			"responses",
 		},
-		"server_communication_bytes.#": {
+		"server_communication_bytes.#.#": {
 			"request_bytes",
 			"response_bytes",
 		},
+		"server_ejected.#.#": {
+			"ejected",
+		},
 	}
 
 	expectedLabels := map[string]([]string){
@@ -362,30 +400,33 @@ func TestGraphDefinition(t *testing.T) {
 			"Client Connections",
 			"Client EOF",
 		},
-		"server_error.#": {
+		"server_error.#.#": {
 			"Server Error",
 			"Server Timedout",
 		},
-		"server_connections.#": {
+		"server_connections.#.#": {
 			"Server Connections",
 			"Server EOF",
 		},
-		"server_queue.#": {
+		"server_queue.#.#": {
 			"Out Queue",
 			"In Queue",
 		},
-		"server_queue_bytes.#": {
+		"server_queue_bytes.#.#": {
 			"Out Queue Bytes",
 			"In Queue Bytes",
 		},
-		"server_communications.#": {
+		"server_communications.#.#": {
 			"Requests",
 			"Responses",
 		},
-		"server_communication_bytes.#": {
+		"server_communication_bytes.#.#": {
 			"Request Bytes",
 			"Response Bytes",
 		},
+		"server_ejected.#.#": {
+			"Ejected",
+		},
 	}
 
 	for k, names := range expectedNames {
@@ -418,3 +459,13 @@ func TestGraphDefinition(t *testing.T) {
 		}
 	}
 }
+
+func TestTempfile(t *testing.T) {
+	p := TwemproxyPlugin{Address: "localhost:22222"}
+	if other := (TwemproxyPlugin{Address: "localhost:22223"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with Address: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/twemproxy.json"); f != "/tmp/twemproxy.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
@@ -0,0 +1,68 @@
+package mpunicorn
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var raindropsClient = &http.Client{Timeout: 10 * time.Second}
+
+// raindropsStats is the output of Raindrops::Middleware
+type raindropsStats struct {
+	// Calling is the number of the workers processing requests
+	Calling uint64
+	// Writing is the number of the workers writing responses
+	Writing uint64
+}
+
+// fetchRaindrops fetches the stats from the endpoint of Raindrops::Middleware, which responds such as
+//
+//	calling: 1
+//	writing: 0
+//	0.0.0.0:8080 active: 1
+//	0.0.0.0:8080 queued: 0
+func fetchRaindrops(uri string) (*raindropsStats, error) {
+	resp, err := raindropsClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch raindrops stats: %s", resp.Status)
+	}
+
+	var stats raindropsStats
+	var calling, writing bool
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		var dest *uint64
+		switch kv[0] {
+		case "calling":
+			dest, calling = &stats.Calling, true
+		case "writing":
+			dest, writing = &stats.Writing, true
+		default:
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse raindrops stats: %s", err)
+		}
+		*dest = v
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !calling || !writing {
+		return nil, fmt.Errorf("Cannot find calling and writing in raindrops stats of %s", uri)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,34 @@
+package mpunicorn
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchRaindrops(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "calling: 3\nwriting: 1\n0.0.0.0:8080 active: 4\n0.0.0.0:8080 queued: 2\n")
+	}))
+	defer ts.Close()
+
+	stats, err := fetchRaindrops(ts.URL + "/_raindrops")
+	if err != nil {
+		t.Fatalf("fetchRaindrops: %s", err)
+	}
+	if stats.Calling != 3 || stats.Writing != 1 {
+		t.Errorf("fetchRaindrops: expected calling 3 and writing 1 but got %d and %d", stats.Calling, stats.Writing)
+	}
+}
+
+func TestFetchRaindropsInvalid(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html>not found</html>")
+	}))
+	defer ts.Close()
+
+	if _, err := fetchRaindrops(ts.URL); err == nil {
+		t.Errorf("fetchRaindrops should fail without calling and writing")
+	}
+}
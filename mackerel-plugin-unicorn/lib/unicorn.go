@@ -21,6 +21,9 @@ type UnicornPlugin struct {
 	WorkerPids []string
 	Tempfile   string
 	Prefix     string
+	// RaindropsURI is the endpoint of Raindrops::Middleware, which counts the busy workers instead of their CPU time
+	// if not empty
+	RaindropsURI string
 }
 
 // FetchMetrics interface for mackerelplugin
@@ -28,12 +31,36 @@ func (u UnicornPlugin) FetchMetrics() (map[string]interface{}, error) {
 	stat := make(map[string]interface{})
 
 	workers := len(u.WorkerPids)
-	idles, err := idleWorkerCount(u.WorkerPids)
+	if u.RaindropsURI != "" {
+		raindrops, err := fetchRaindrops(u.RaindropsURI)
+		if err != nil {
+			return stat, err
+		}
+		stat["calling"] = raindrops.Calling
+		stat["writing"] = raindrops.Writing
+		busy := int(raindrops.Calling)
+		if busy > workers {
+			busy = workers
+		}
+		stat["idle_workers"] = fmt.Sprint(workers - busy)
+		stat["busy_workers"] = fmt.Sprint(busy)
+	} else {
+		idles, err := idleWorkerCount(u.WorkerPids)
+		if err != nil {
+			return stat, err
+		}
+		stat["idle_workers"] = fmt.Sprint(idles)
+		stat["busy_workers"] = fmt.Sprint(workers - idles)
+	}
+
+	maxRSS, avgRSS, ok, err := workersRSS(u.WorkerPids)
 	if err != nil {
 		return stat, err
 	}
-	stat["idle_workers"] = fmt.Sprint(idles)
-	stat["busy_workers"] = fmt.Sprint(workers - idles)
+	if ok {
+		stat["max_worker_rss"] = maxRSS
+		stat["average_worker_rss"] = avgRSS
+	}
 
 	workersM, err := workersMemory()
 	if err != nil {
@@ -75,6 +102,8 @@ func (u UnicornPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "memory_workers", Label: "Workers", Diff: false, Stacked: true},
 				{Name: "memory_master", Label: "Master", Diff: false, Stacked: true},
 				{Name: "memory_workeravg", Label: "Worker Average", Diff: false, Stacked: false},
+				{Name: "max_worker_rss", Label: "Max Worker RSS", Diff: false, Stacked: false},
+				{Name: "average_worker_rss", Label: "Average Worker RSS", Diff: false, Stacked: false},
 			},
 		},
 		"workers": {
@@ -86,6 +115,16 @@ func (u UnicornPlugin) GraphDefinition() map[string]mp.Graphs {
 			},
 		},
 	}
+	if u.RaindropsURI != "" {
+		graphdef["raindrops"] = mp.Graphs{
+			Label: (labelPrefix + " Raindrops"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "calling", Label: "Calling", Diff: false, Stacked: false},
+				{Name: "writing", Label: "Writing", Diff: false, Stacked: false},
+			},
+		}
+	}
 
 	return graphdef
 }
@@ -95,6 +134,7 @@ func Do() {
 	optPidFile := flag.String("pidfile", "", "Pid file name")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
 	optPrefix := flag.String("metric-key-prefix", "unicorn", "Prefix")
+	optRaindropsURI := flag.String("raindrops-uri", "", "URI of Raindrops::Middleware such as http://localhost:8080/_raindrops")
 	flag.Parse()
 	var unicorn UnicornPlugin
 
@@ -121,6 +161,7 @@ func Do() {
 	unicorn.WorkerPids = workerPids
 
 	unicorn.Prefix = *optPrefix
+	unicorn.RaindropsURI = *optRaindropsURI
 
 	helper := mp.NewMackerelPlugin(unicorn)
 	helper.Tempfile = *optTempfile
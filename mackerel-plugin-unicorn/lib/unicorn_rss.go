@@ -0,0 +1,63 @@
+package mpunicorn
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var procRoot = "/proc"
+
+// workerRSS returns the resident set size of the process in bytes from /proc/<pid>/status
+func workerRSS(pid string) (uint64, error) {
+	f, err := os.Open(filepath.Join(procRoot, pid, "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// format: VmRSS:	  123456 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmRSS:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no VmRSS in %s", f.Name())
+}
+
+// workersRSS returns the max and the average of the resident set sizes of the workers. The workers exited after
+// they are listed are skipped, and ok is false if no worker is alive.
+func workersRSS(pids []string) (max, avg uint64, ok bool, err error) {
+	var sum, n uint64
+	for _, pid := range pids {
+		rss, err := workerRSS(pid)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, false, err
+		}
+		if rss > max {
+			max = rss
+		}
+		sum += rss
+		n++
+	}
+	if n == 0 {
+		return 0, 0, false, nil
+	}
+	return max, sum / n, true, nil
+}
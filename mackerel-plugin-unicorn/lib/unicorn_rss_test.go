@@ -0,0 +1,40 @@
+package mpunicorn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkersRSS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackerel-plugin-unicorn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	procRoot = dir
+	defer func() { procRoot = "/proc" }()
+	for pid, rss := range map[string]string{"584": "204800", "1857": "409600"} {
+		if err := os.MkdirAll(filepath.Join(procRoot, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		status := "Name:\truby\nVmPeak:\t  999999 kB\nVmRSS:\t  " + rss + " kB\nThreads:\t2\n"
+		if err := ioutil.WriteFile(filepath.Join(procRoot, pid, "status"), []byte(status), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2258 has exited after listed
+	max, avg, ok, err := workersRSS([]string{"584", "1857", "2258"})
+	if err != nil {
+		t.Fatalf("workersRSS: %s", err)
+	}
+	if !ok || max != 409600*1024 || avg != 307200*1024 {
+		t.Errorf("workersRSS: expected %d and %d but got %d and %d", 409600*1024, 307200*1024, max, avg)
+	}
+
+	if _, _, ok, err := workersRSS([]string{"2258"}); ok || err != nil {
+		t.Errorf("workersRSS: no worker should be found without errors")
+	}
+}
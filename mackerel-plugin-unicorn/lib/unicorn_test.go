@@ -19,3 +19,12 @@ func TestGraphDefinition(t *testing.T) {
 		t.Errorf("GetTempfilename: %d should be 2", len(graphdef))
 	}
 }
+
+func TestGraphDefinitionRaindrops(t *testing.T) {
+	unicorn := UnicornPlugin{RaindropsURI: "http://localhost:8080/_raindrops"}
+
+	graphdef := unicorn.GraphDefinition()
+	if len(graphdef) != 3 {
+		t.Errorf("GraphDefinition: %d should be 3", len(graphdef))
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"github.com/mackerelio/mackerel-agent-plugins/pluginutil"
 )
 
 // UWSGIVassalPlugin mackerel plugin for uWSGI
@@ -199,6 +200,11 @@ func (p UWSGIVassalPlugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
+// tempfile returns the tempfile given by -tempfile, or the default tempfile for the socket
+func (p UWSGIVassalPlugin) tempfile(tempfile string) string {
+	return pluginutil.Tempfile(tempfile, "uwsgi-vassal", p.Socket)
+}
+
 // Do the plugin
 func Do() {
 	optSocket := flag.String("socket", "", "Socket (must be with prefix of 'http://' or 'unix://')")
@@ -210,6 +216,6 @@ func Do() {
 	uwsgi.LabelPrefix = strings.Title(uwsgi.Prefix)
 
 	helper := mp.NewMackerelPlugin(uwsgi)
-	helper.Tempfile = *optTempfile
+	helper.Tempfile = uwsgi.tempfile(*optTempfile)
 	helper.Run()
 }
@@ -0,0 +1,15 @@
+package mpuwsgivassal
+
+import (
+	"testing"
+)
+
+func TestTempfile(t *testing.T) {
+	p := UWSGIVassalPlugin{Socket: "unix:///tmp/uwsgi.sock"}
+	if other := (UWSGIVassalPlugin{Socket: "http://localhost:1717"}); other.tempfile("") == p.tempfile("") {
+		t.Errorf("the default tempfile should change with Socket: %s", p.tempfile(""))
+	}
+	if f := p.tempfile("/tmp/uwsgi-vassal.json"); f != "/tmp/uwsgi-vassal.json" {
+		t.Errorf("the tempfile given by -tempfile should be used: %s", f)
+	}
+}
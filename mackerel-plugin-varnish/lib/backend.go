@@ -0,0 +1,65 @@
+package mpvarnish
+
+import (
+	"regexp"
+	"strings"
+)
+
+// backendCounters are the counters of VBE summed up into the metrics of each backend
+var backendCounters = map[string]string{
+	"conn":             "conn",
+	"req":              "req",
+	"beresp_hdrbytes":  "fetched_bytes",
+	"beresp_bodybytes": "fetched_bytes",
+}
+
+// backendNameRe matches the characters not allowed in the metric names
+var backendNameRe = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// backendName returns the name of the backend and the field of the counter of VBE, which is
+// VBE.<vcl>.<backend>.<field> in Varnish 4.1 or later, and VBE.<backend>(<ip>,<ip6>,<port>).<field> in Varnish 4.0
+func backendName(counter string) (backend, field string, ok bool) {
+	if !strings.HasPrefix(counter, "VBE.") {
+		return "", "", false
+	}
+	rest := counter[len("VBE."):]
+	i := strings.LastIndex(rest, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	rest, field = rest[:i], rest[i+1:]
+	if j := strings.Index(rest, "("); j >= 0 {
+		return rest[:j], field, true
+	}
+	if j := strings.LastIndex(rest, "."); j >= 0 {
+		rest = rest[j+1:]
+	}
+	return rest, field, true
+}
+
+// parseBackends returns the metrics of each backend as backend.<backend>.*. The backends of the VCLs loaded by the
+// reloads are aggregated by their names, where the counters are summed up, and the backend is healthy only if the
+// most recent probes of all the VCLs have succeeded.
+func parseBackends(counters map[string]float64, exclude *regexp.Regexp) map[string]interface{} {
+	stat := make(map[string]interface{})
+	for counter, v := range counters {
+		backend, field, ok := backendName(counter)
+		if !ok || exclude != nil && exclude.MatchString(backend) {
+			continue
+		}
+		prefix := "backend." + backendNameRe.ReplaceAllString(backend, "_") + "."
+		if field == "happy" {
+			if h, ok := stat[prefix+"happy"].(float64); !ok || v < h {
+				stat[prefix+"happy"] = v
+			}
+			continue
+		}
+		name, ok := backendCounters[field]
+		if !ok {
+			continue
+		}
+		sum, _ := stat[prefix+name].(float64)
+		stat[prefix+name] = sum + v
+	}
+	return stat
+}
@@ -0,0 +1,60 @@
+package mpvarnish
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendName(t *testing.T) {
+	for _, tt := range []struct {
+		counter string
+		backend string
+		field   string
+		ok      bool
+	}{
+		{"VBE.boot.default.happy", "default", "happy", true},
+		{"VBE.reload_20230102_030405_1234.api_v2.req", "api_v2", "req", true},
+		{"VBE.default(127.0.0.1,,8080).happy", "default", "happy", true},
+		{"MAIN.backend_req", "", "", false},
+		{"VBE.happy", "", "", false},
+	} {
+		backend, field, ok := backendName(tt.counter)
+		assert.Equal(t, tt.ok, ok, tt.counter)
+		assert.Equal(t, tt.backend, backend, tt.counter)
+		assert.Equal(t, tt.field, field, tt.counter)
+	}
+}
+
+func TestParseBackends(t *testing.T) {
+	out := []byte(`{
+  "version": 1,
+  "timestamp": "2023-01-02T03:04:05",
+  "counters": {
+    "VBE.boot.web.happy": {"flag": "b", "format": "b", "value": 18446744073709551614},
+    "VBE.boot.web.req": {"flag": "c", "format": "i", "value": 100},
+    "VBE.boot.web.conn": {"flag": "g", "format": "i", "value": 3},
+    "VBE.boot.web.beresp_hdrbytes": {"flag": "c", "format": "B", "value": 1000},
+    "VBE.boot.web.beresp_bodybytes": {"flag": "c", "format": "B", "value": 9000},
+    "VBE.reload_20230102_030405_1234.web.happy": {"flag": "b", "format": "b", "value": 18446744073709551615},
+    "VBE.reload_20230102_030405_1234.web.req": {"flag": "c", "format": "i", "value": 20},
+    "VBE.reload_20230102_030405_1234.api.happy": {"flag": "b", "format": "b", "value": 1},
+    "VBE.reload_20230102_030405_1234.api.req": {"flag": "c", "format": "i", "value": 5},
+    "VBE.reload_20230102_030405_1234.admin.req": {"flag": "c", "format": "i", "value": 1}
+  }
+}`)
+	counters, err := parseVarnishstatJSON(out)
+	assert.Nil(t, err)
+	stat := parseBackends(counters, regexp.MustCompile("^admin$"))
+
+	assert.Equal(t, map[string]interface{}{
+		// the most recent probe of the boot VCL has failed
+		"backend.web.happy":         0.0,
+		"backend.web.req":           120.0,
+		"backend.web.conn":          3.0,
+		"backend.web.fetched_bytes": 10000.0,
+		"backend.api.happy":         1.0,
+		"backend.api.req":           5.0,
+	}, stat)
+}
@@ -1,8 +1,10 @@
 package mpvarnish
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -11,165 +13,306 @@ import (
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
-var graphdef = map[string]mp.Graphs{
-	"varnish.requests": {
-		Label: "Varnish Client Requests",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "requests", Label: "Requests", Diff: true},
-			{Name: "cache_hits", Label: "Hits", Diff: true},
-		},
-	},
-	"varnish.backend": {
-		Label: "Varnish Backend",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "backend_req", Label: "Requests", Diff: true},
-			{Name: "backend_conn", Label: "Conn success", Diff: true},
-			{Name: "backend_fail", Label: "Conn fail", Diff: true},
-		},
-	},
-	"varnish.objects": {
-		Label: "Varnish Objects",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "n_object", Label: "object", Diff: false},
-			{Name: "n_objectcore", Label: "objectcore", Diff: false},
-			{Name: "n_objecthead", Label: "objecthead", Diff: false},
-		},
-	},
-	"varnish.objects_expire": {
-		Label: "Varnish Objects Expire",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "n_expired", Label: "expire", Diff: true},
-		},
-	},
-	"varnish.busy_requests": {
-		Label: "Varnish Busy Requests",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "busy_sleep", Label: "sleep", Diff: true},
-			{Name: "busy_wakeup", Label: "wakeup", Diff: true},
-		},
-	},
-	"varnish.sma.g_alloc.#": {
-		Label: "Varnish SMA Allocations",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "g_alloc", Label: "num", Diff: false},
-		},
-	},
-	"varnish.sma.memory.#": {
-		Label: "Varnish SMA Memory",
-		Unit:  "integer",
-		Metrics: []mp.Metrics{
-			{Name: "allocated", Label: "Allocated", Diff: false},
-			{Name: "available", Label: "Available", Diff: false},
-		},
-	},
-}
-
 // VarnishPlugin mackerel plugin for varnish
 type VarnishPlugin struct {
 	VarnishStatPath string
 	VarnishName     string
 	Tempfile        string
+	Prefix          string
+	LabelPrefix     string
+	// TextFormat parses varnishstat -1 instead of -j for the ancient versions
+	TextFormat bool
+	// ExcludeBackend excludes the backends whose names match
+	ExcludeBackend *regexp.Regexp
 }
 
 // FetchMetrics interface for mackerelplugin
 func (m VarnishPlugin) FetchMetrics() (map[string]interface{}, error) {
-	var out []byte
-	var err error
-
-	if m.VarnishName == "" {
-		out, err = exec.Command(m.VarnishStatPath, "-1").CombinedOutput()
-	} else {
-		out, err = exec.Command(m.VarnishStatPath, "-1", "-n", m.VarnishName).CombinedOutput()
+	format := "-j"
+	if m.TextFormat {
+		format = "-1"
+	}
+	args := []string{format}
+	if m.VarnishName != "" {
+		args = append(args, "-n", m.VarnishName)
 	}
+	out, err := exec.Command(m.VarnishStatPath, args...).Output()
 	if err != nil {
-		return nil, fmt.Errorf("%s: %s", err, out)
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("%s: %s", err, ee.Stderr)
+		}
+		return nil, err
 	}
 
-	lineexp := regexp.MustCompile("^([^ ]+) +(\\d+)")
-	smaexp := regexp.MustCompile("^SMA\\.([^\\.]+)\\.(.+)$")
-
-	stat := map[string]interface{}{
-		"requests": float64(0),
+	var counters map[string]float64
+	if m.TextFormat {
+		counters = parseVarnishstatText(out)
+	} else if counters, err = parseVarnishstatJSON(out); err != nil {
+		return nil, err
 	}
+	stat := parseCounters(counters)
+	for k, v := range parseBackends(counters, m.ExcludeBackend) {
+		stat[k] = v
+	}
+	return stat, nil
+}
+
+// parseVarnishstatText parses the output of varnishstat -1 of the ancient versions
+func parseVarnishstatText(out []byte) map[string]float64 {
+	lineexp := regexp.MustCompile("^([^ ]+) +(\\d+)")
 
-	var tmpv float64
+	counters := make(map[string]float64)
 	for _, line := range strings.Split(string(out), "\n") {
 		match := lineexp.FindStringSubmatch(line)
 		if match == nil {
 			continue
 		}
+		v, err := counterValue(match[1], match[2])
+		if err != nil {
+			continue
+		}
+		counters[match[1]] = v
+	}
+	return counters
+}
+
+type varnishstatCounter struct {
+	Value *json.Number `json:"value"`
+}
+
+// parseVarnishstatJSON parses the output of varnishstat -j, where the counters are wrapped in "counters" since
+// Varnish 6.5, and are at the top level with "timestamp" before
+func parseVarnishstatJSON(out []byte) (map[string]float64, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(out, &top); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of varnishstat -j: %s", err)
+	}
+	if wrapped, ok := top["counters"]; ok {
+		top = nil
+		if err := json.Unmarshal(wrapped, &top); err != nil {
+			return nil, fmt.Errorf("failed to parse the counters of varnishstat -j: %s", err)
+		}
+	}
 
-		tmpv, err = strconv.ParseFloat(match[2], 64)
+	counters := make(map[string]float64)
+	for name, raw := range top {
+		var c varnishstatCounter
+		// timestamp and version are not the counters
+		if err := json.Unmarshal(raw, &c); err != nil || c.Value == nil {
+			continue
+		}
+		v, err := counterValue(name, c.Value.String())
 		if err != nil {
 			continue
 		}
+		counters[name] = v
+	}
+	return counters, nil
+}
 
-		switch match[1] {
+// counterValue parses the value of the counter. The happy bitmap of the probes of a backend, whose least significant
+// bit is the most recent probe, is parsed as the bit, since the bitmap of 64 probes does not fit in float64.
+func counterValue(name, value string) (float64, error) {
+	if !strings.HasSuffix(name, ".happy") {
+		return strconv.ParseFloat(value, 64)
+	}
+	bits, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return float64(bits & 1), nil
+}
+
+// parseCounters maps the counters of varnishstat onto the metrics, where the counters of Varnish 3 have no MAIN.
+func parseCounters(counters map[string]float64) map[string]interface{} {
+	smaexp := regexp.MustCompile("^SMA\\.([^\\.]+)\\.(.+)$")
+
+	stat := map[string]interface{}{
+		"requests": float64(0),
+	}
+
+	for name, v := range counters {
+		switch name {
 		case "cache_hit", "MAIN.cache_hit":
-			stat["cache_hits"] = tmpv
-			stat["requests"] = stat["requests"].(float64) + tmpv
+			stat["cache_hits"] = v
+			stat["requests"] = stat["requests"].(float64) + v
 		case "cache_miss", "MAIN.cache_miss":
-			stat["requests"] = stat["requests"].(float64) + tmpv
+			stat["requests"] = stat["requests"].(float64) + v
 		case "cache_hitpass", "MAIN.cache_hitpass":
-			stat["requests"] = stat["requests"].(float64) + tmpv
+			stat["requests"] = stat["requests"].(float64) + v
 		case "MAIN.backend_req":
-			stat["backend_req"] = tmpv
+			stat["backend_req"] = v
 		case "MAIN.backend_conn":
-			stat["backend_conn"] = tmpv
+			stat["backend_conn"] = v
 		case "MAIN.backend_fail":
-			stat["backend_fail"] = tmpv
+			stat["backend_fail"] = v
+		case "MAIN.backend_busy":
+			stat["backend_busy"] = v
 		case "MAIN.n_object":
-			stat["n_object"] = tmpv
+			stat["n_object"] = v
 		case "MAIN.n_objectcore":
-			stat["n_objectcore"] = tmpv
+			stat["n_objectcore"] = v
 		case "MAIN.n_expired":
-			stat["n_expired"] = tmpv
+			stat["n_expired"] = v
+		case "MAIN.n_lru_nuked":
+			stat["n_lru_nuked"] = v
 		case "MAIN.n_objecthead":
-			stat["n_objecthead"] = tmpv
+			stat["n_objecthead"] = v
 		case "MAIN.busy_sleep":
-			stat["busy_sleep"] = tmpv
+			stat["busy_sleep"] = v
 		case "MAIN.busy_wakeup":
-			stat["busy_wakeup"] = tmpv
+			stat["busy_wakeup"] = v
+		case "MAIN.sess_conn":
+			stat["sess_conn"] = v
+		case "MAIN.sess_drop":
+			stat["sess_drop"] = v
+		case "MAIN.threads":
+			stat["threads"] = v
 		default:
-			smamatch := smaexp.FindStringSubmatch(match[1])
+			smamatch := smaexp.FindStringSubmatch(name)
 			if smamatch == nil || smamatch[1] == "Transient" {
 				continue
 			}
 			if smamatch[2] == "g_alloc" {
-				fmt.Printf("%+v\n", smamatch)
-				stat["varnish.sma.g_alloc."+smamatch[1]+".g_alloc"] = tmpv
+				stat["sma.g_alloc."+smamatch[1]+".g_alloc"] = v
 			} else if smamatch[2] == "g_bytes" {
-				stat["varnish.sma.memory."+smamatch[1]+".allocated"] = tmpv
+				stat["sma.memory."+smamatch[1]+".allocated"] = v
 			} else if smamatch[2] == "g_space" {
-				stat["varnish.sma.memory."+smamatch[1]+".available"] = tmpv
+				stat["sma.memory."+smamatch[1]+".available"] = v
 			}
 		}
 	}
 
-	return stat, err
+	return stat
+}
+
+// MetricKeyPrefix interface for PluginWithPrefix
+func (m VarnishPlugin) MetricKeyPrefix() string {
+	if m.Prefix == "" {
+		m.Prefix = "varnish"
+	}
+	return m.Prefix
 }
 
 // GraphDefinition interface for mackerelplugin
 func (m VarnishPlugin) GraphDefinition() map[string]mp.Graphs {
-	return graphdef
+	labelPrefix := m.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = strings.Title(m.MetricKeyPrefix())
+	}
+
+	return map[string]mp.Graphs{
+		"requests": {
+			Label: labelPrefix + " Client Requests",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "requests", Label: "Requests", Diff: true},
+				{Name: "cache_hits", Label: "Hits", Diff: true},
+			},
+		},
+		"backend": {
+			Label: labelPrefix + " Backend",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "backend_req", Label: "Requests", Diff: true},
+				{Name: "backend_conn", Label: "Conn success", Diff: true},
+				{Name: "backend_fail", Label: "Conn fail", Diff: true},
+				{Name: "backend_busy", Label: "Conn busy", Diff: true},
+			},
+		},
+		"objects": {
+			Label: labelPrefix + " Objects",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "n_object", Label: "object", Diff: false},
+				{Name: "n_objectcore", Label: "objectcore", Diff: false},
+				{Name: "n_objecthead", Label: "objecthead", Diff: false},
+			},
+		},
+		"objects_expire": {
+			Label: labelPrefix + " Objects Expire",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "n_expired", Label: "expire", Diff: true},
+				{Name: "n_lru_nuked", Label: "lru nuked", Diff: true},
+			},
+		},
+		"busy_requests": {
+			Label: labelPrefix + " Busy Requests",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "busy_sleep", Label: "sleep", Diff: true},
+				{Name: "busy_wakeup", Label: "wakeup", Diff: true},
+			},
+		},
+		"sessions": {
+			Label: labelPrefix + " Sessions",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "sess_conn", Label: "Accepted", Diff: true},
+				{Name: "sess_drop", Label: "Dropped", Diff: true},
+			},
+		},
+		"threads": {
+			Label: labelPrefix + " Threads",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "threads", Label: "Threads", Diff: false},
+			},
+		},
+		"backend.#": {
+			Label: labelPrefix + " Backend Health and Traffic",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "happy", Label: "Healthy", Diff: false},
+				{Name: "conn", Label: "Concurrent connections", Diff: false},
+				{Name: "req", Label: "Requests", Diff: true},
+				{Name: "fetched_bytes", Label: "Fetched bytes", Diff: true},
+			},
+		},
+		"sma.g_alloc.#": {
+			Label: labelPrefix + " SMA Allocations",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "g_alloc", Label: "num", Diff: false},
+			},
+		},
+		"sma.memory.#": {
+			Label: labelPrefix + " SMA Memory",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "allocated", Label: "Allocated", Diff: false},
+				{Name: "available", Label: "Available", Diff: false},
+			},
+		},
+	}
 }
 
 // Do the plugin
 func Do() {
 	optVarnishStatPath := flag.String("varnishstat", "/usr/bin/varnishstat", "Path of varnishstat")
+	flag.StringVar(optVarnishStatPath, "varnishstat-path", "/usr/bin/varnishstat", "Path of varnishstat (same as -varnishstat)")
 	optVarnishName := flag.String("varnish-name", "", "Varnish name")
+	flag.StringVar(optVarnishName, "name", "", "Varnish name given to varnishstat -n (same as -varnish-name)")
+	optTextFormat := flag.Bool("text", false, "Parse varnishstat -1 instead of -j for the versions without -j")
+	optExcludeBackend := flag.String("exclude-backend", "", "Regexp of the names of the backends excluded from the metrics")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
+	optPrefix := flag.String("metric-key-prefix", "varnish", "Metric key prefix")
+	optLabelPrefix := flag.String("metric-label-prefix", "", "Metric label prefix (default: the metric key prefix in title case)")
 	flag.Parse()
 
-	var varnish VarnishPlugin
+	varnish := VarnishPlugin{Prefix: *optPrefix, LabelPrefix: *optLabelPrefix}
 	varnish.VarnishStatPath = *optVarnishStatPath
 	varnish.VarnishName = *optVarnishName
+	varnish.TextFormat = *optTextFormat
+	if *optExcludeBackend != "" {
+		re, err := regexp.Compile(*optExcludeBackend)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -exclude-backend: %s\n", err)
+			os.Exit(1)
+		}
+		varnish.ExcludeBackend = re
+	}
 	helper := mp.NewMackerelPlugin(varnish)
 
 	if *optTempfile != "" {
@@ -0,0 +1,98 @@
+package mpvarnish
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphDefinition(t *testing.T) {
+	var varnish VarnishPlugin
+
+	// the default prefixes keep the graph names and the labels unchanged
+	graphs := make(map[string]string)
+	for key, graph := range varnish.GraphDefinition() {
+		graphs[varnish.MetricKeyPrefix()+"."+key] = graph.Label
+	}
+	assert.Equal(t, map[string]string{
+		"varnish.requests":       "Varnish Client Requests",
+		"varnish.backend":        "Varnish Backend",
+		"varnish.objects":        "Varnish Objects",
+		"varnish.objects_expire": "Varnish Objects Expire",
+		"varnish.busy_requests":  "Varnish Busy Requests",
+		"varnish.sessions":       "Varnish Sessions",
+		"varnish.threads":        "Varnish Threads",
+		"varnish.backend.#":      "Varnish Backend Health and Traffic",
+		"varnish.sma.g_alloc.#":  "Varnish SMA Allocations",
+		"varnish.sma.memory.#":   "Varnish SMA Memory",
+	}, graphs)
+
+	varnish.Prefix = "varnish-web"
+	assert.Equal(t, "varnish-web", varnish.MetricKeyPrefix())
+	assert.Equal(t, "Varnish-Web Backend", varnish.GraphDefinition()["backend"].Label)
+
+	varnish.LabelPrefix = "Web"
+	assert.Equal(t, "Web Backend", varnish.GraphDefinition()["backend"].Label)
+}
+
+func TestParseVarnishstatJSON(t *testing.T) {
+	// Varnish 6.5 or later
+	wrapped := `{
+  "version": 1,
+  "timestamp": "2023-01-02T03:04:05",
+  "counters": {
+    "MGT.uptime": {"description": "Management process uptime", "flag": "c", "format": "d", "value": 1000},
+    "MAIN.cache_hit": {"description": "Cache hits", "flag": "c", "format": "i", "value": 70},
+    "MAIN.cache_miss": {"description": "Cache misses", "flag": "c", "format": "i", "value": 20},
+    "MAIN.cache_hitpass": {"description": "Cache hits for pass", "flag": "c", "format": "i", "value": 10},
+    "MAIN.sess_conn": {"description": "Sessions accepted", "flag": "c", "format": "i", "value": 42},
+    "MAIN.threads": {"description": "Total number of threads", "flag": "g", "format": "i", "value": 200},
+    "MAIN.n_lru_nuked": {"description": "Number of LRU nuked objects", "flag": "g", "format": "i", "value": 3},
+    "MAIN.backend_busy": {"description": "Backend conn. too many", "flag": "c", "format": "i", "value": 1},
+    "SMA.s0.g_alloc": {"description": "Allocations outstanding", "flag": "g", "format": "i", "value": 5},
+    "SMA.s0.g_bytes": {"description": "Bytes outstanding", "flag": "g", "format": "B", "value": 1024},
+    "SMA.Transient.g_bytes": {"description": "Bytes outstanding", "flag": "g", "format": "B", "value": 64}
+  }
+}`
+	counters, err := parseVarnishstatJSON([]byte(wrapped))
+	assert.Nil(t, err)
+	stat := parseCounters(counters)
+	assert.EqualValues(t, 100, stat["requests"])
+	assert.EqualValues(t, 70, stat["cache_hits"])
+	assert.EqualValues(t, 42, stat["sess_conn"])
+	assert.EqualValues(t, 200, stat["threads"])
+	assert.EqualValues(t, 3, stat["n_lru_nuked"])
+	assert.EqualValues(t, 1, stat["backend_busy"])
+	assert.EqualValues(t, 5, stat["sma.g_alloc.s0.g_alloc"])
+	assert.EqualValues(t, 1024, stat["sma.memory.s0.allocated"])
+	assert.NotContains(t, stat, "sma.memory.Transient.allocated")
+
+	// Varnish 5 and 6 before 6.5
+	flat := `{
+  "timestamp": "2019-01-02T03:04:05",
+  "MAIN.cache_hit": {"description": "Cache hits", "type": "MAIN", "flag": "c", "format": "i", "value": 7},
+  "MAIN.cache_miss": {"description": "Cache misses", "type": "MAIN", "flag": "c", "format": "i", "value": 3},
+  "MAIN.backend_req": {"description": "Backend requests made", "type": "MAIN", "flag": "c", "format": "i", "value": 4}
+}`
+	counters, err = parseVarnishstatJSON([]byte(flat))
+	assert.Nil(t, err)
+	stat = parseCounters(counters)
+	assert.EqualValues(t, 10, stat["requests"])
+	assert.EqualValues(t, 7, stat["cache_hits"])
+	assert.EqualValues(t, 4, stat["backend_req"])
+
+	_, err = parseVarnishstatJSON([]byte("varnishstat: illegal option -- j"))
+	assert.NotNil(t, err)
+}
+
+func TestParseVarnishstatText(t *testing.T) {
+	out := `MAIN.uptime            1000         1.00 Child process uptime
+MAIN.cache_hit            70         0.07 Cache hits
+MAIN.cache_miss           30         0.03 Cache misses
+SMA.s0.g_space          2048          .   Bytes available
+`
+	stat := parseCounters(parseVarnishstatText([]byte(out)))
+	assert.EqualValues(t, 100, stat["requests"])
+	assert.EqualValues(t, 70, stat["cache_hits"])
+	assert.EqualValues(t, 2048, stat["sma.memory.s0.available"])
+}
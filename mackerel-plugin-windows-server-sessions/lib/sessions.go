@@ -1,11 +1,15 @@
 package mpwindowsserversessions
 
 import (
+	"bytes"
 	"encoding/csv"
 	"flag"
+	"fmt"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 	"github.com/mackerelio/golib/logging"
@@ -13,37 +17,152 @@ import (
 
 var logger = logging.GetLogger("metrics.plugin.windows-server-sessions")
 
+// wmiQuerier queries the properties of the instances of a WMI class
+type wmiQuerier interface {
+	Query(class string, properties []string) ([]map[string]string, error)
+}
+
+// wmicQuerier queries WMI with WMIC
+type wmicQuerier struct{}
+
+// Query runs e.g. WMIC PATH Win32_PerfFormattedData_PerfNet_Server GET ServerSessions /FORMAT:CSV
+func (wmicQuerier) Query(class string, properties []string) ([]map[string]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("WMIC", "PATH", class, "GET", strings.Join(properties, ","), "/FORMAT:CSV")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		// WMIC exits with the HRESULT of the failure
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return nil, fmt.Errorf("WMI query of %s failed: HRESULT 0x%08X: %s", class, uint32(status.ExitStatus()), strings.TrimSpace(stderr.String()))
+			}
+		}
+		return nil, fmt.Errorf("WMI query of %s failed: %s", class, err)
+	}
+	return parseWMICOutput(output)
+}
+
+// parseWMICOutput parses the CSV output of WMIC into the records keyed by the header
+func parseWMICOutput(output []byte) ([]map[string]string, error) {
+	text := strings.Replace(string(output), "\r", "", -1)
+	r := csv.NewReader(strings.NewReader(strings.TrimLeft(text, "\n")))
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := records[0]
+	var result []map[string]string
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, name := range header {
+			if i < len(record) {
+				row[strings.TrimSpace(name)] = strings.TrimSpace(record[i])
+			}
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
 // WindowsServerSessionsPlugin store the name of servers
 type WindowsServerSessionsPlugin struct {
 	names []string
+	wmi   wmiQuerier
 }
 
-func getCounts() (map[string]int, error) {
-	// WMIC PATH Win32_PerfFormattedData_PerfNet_Server GET ServerSessions /FORMAT:CSV
-	output, err := exec.Command("WMIC", "PATH", "Win32_PerfFormattedData_PerfNet_Server", "GET", "ServerSessions", "/FORMAT:CSV").Output()
-	if err != nil {
-		return nil, err
+func (m WindowsServerSessionsPlugin) querier() wmiQuerier {
+	if m.wmi == nil {
+		return wmicQuerier{}
 	}
-	r := csv.NewReader(strings.NewReader(string(output[1:])))
-	records, err := r.ReadAll()
+	return m.wmi
+}
+
+func getCounts(wmi wmiQuerier) (map[string]int, error) {
+	rows, err := wmi.Query("Win32_PerfFormattedData_PerfNet_Server", []string{"ServerSessions"})
 	if err != nil {
 		return nil, err
 	}
 	counts := make(map[string]int)
-	for _, record := range records[1:] {
-		name := strings.TrimSpace(record[0])
-		n, err := strconv.Atoi(strings.TrimSpace(record[1]))
+	for _, row := range rows {
+		n, err := strconv.Atoi(row["ServerSessions"])
 		if err != nil {
 			continue
 		}
-		counts[name] = n
+		counts[row["Node"]] = n
 	}
 	return counts, nil
 }
 
+var normalizeMetricNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// shareKey returns the metric key of the share, e.g. IPC_ for IPC$
+func shareKey(name string) string {
+	return normalizeMetricNameRe.ReplaceAllString(name, "_")
+}
+
+// getShareStats counts the connections, the distinct users and the open files of each share
+func getShareStats(wmi wmiQuerier) (map[string]uint64, error) {
+	rows, err := wmi.Query("Win32_ServerConnection", []string{"ShareName", "UserName", "NumberOfFiles"})
+	if err != nil {
+		return nil, err
+	}
+	stat := make(map[string]uint64)
+	users := make(map[string]map[string]bool)
+	for _, row := range rows {
+		share := shareKey(row["ShareName"])
+		if share == "" {
+			continue
+		}
+		stat["windows.server.shares."+share+".connections"]++
+		if users[share] == nil {
+			users[share] = make(map[string]bool)
+		}
+		if row["UserName"] != "" {
+			users[share][strings.ToLower(row["UserName"])] = true
+		}
+		if n, err := strconv.ParseUint(row["NumberOfFiles"], 10, 64); err == nil {
+			stat["windows.server.shares."+share+".files"] += n
+		}
+	}
+	for share, u := range users {
+		stat["windows.server.shares."+share+".users"] = uint64(len(u))
+		if _, ok := stat["windows.server.shares."+share+".files"]; !ok {
+			stat["windows.server.shares."+share+".files"] = 0
+		}
+	}
+	return stat, nil
+}
+
+// getSessionStats counts the distinct users and the open files of all the sessions
+func getSessionStats(wmi wmiQuerier) (map[string]uint64, error) {
+	rows, err := wmi.Query("Win32_ServerSession", []string{"UserName", "NumberOfOpens"})
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]bool)
+	var opens uint64
+	for _, row := range rows {
+		if row["UserName"] != "" {
+			users[strings.ToLower(row["UserName"])] = true
+		}
+		if n, err := strconv.ParseUint(row["NumberOfOpens"], 10, 64); err == nil {
+			opens += n
+		}
+	}
+	return map[string]uint64{
+		"windows.server.session_users.users": uint64(len(users)),
+		"windows.server.session_users.opens": opens,
+	}, nil
+}
+
 // FetchMetrics interface for mackerelplugin
 func (m WindowsServerSessionsPlugin) FetchMetrics() (map[string]interface{}, error) {
-	counts, err := getCounts()
+	wmi := m.querier()
+	counts, err := getCounts(wmi)
 	if err != nil {
 		return nil, err
 	}
@@ -51,6 +170,21 @@ func (m WindowsServerSessionsPlugin) FetchMetrics() (map[string]interface{}, err
 	for k, v := range counts {
 		stat["windows.server.sessions."+k+".count"] = uint64(v)
 	}
+
+	shares, err := getShareStats(wmi)
+	if err != nil {
+		logger.Warningf("Failed to get share stats: %s", err)
+	}
+	for k, v := range shares {
+		stat[k] = v
+	}
+	sessions, err := getSessionStats(wmi)
+	if err != nil {
+		logger.Warningf("Failed to get session stats: %s", err)
+	}
+	for k, v := range sessions {
+		stat[k] = v
+	}
 	return stat, nil
 }
 
@@ -64,6 +198,23 @@ func (m WindowsServerSessionsPlugin) GraphDefinition() map[string](mp.Graphs) {
 				{Name: "count", Label: "count", Diff: false, Stacked: false},
 			},
 		},
+		"windows.server.shares.#": mp.Graphs{
+			Label: "Windows Server Shares",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "connections", Label: "connections", Diff: false, Stacked: false},
+				{Name: "users", Label: "users", Diff: false, Stacked: false},
+				{Name: "files", Label: "open files", Diff: false, Stacked: false},
+			},
+		},
+		"windows.server.session_users": mp.Graphs{
+			Label: "Windows Server Session Users",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "users", Label: "users", Diff: false, Stacked: false},
+				{Name: "opens", Label: "open files", Diff: false, Stacked: false},
+			},
+		},
 	}
 }
 
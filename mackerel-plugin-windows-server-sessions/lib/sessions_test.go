@@ -0,0 +1,65 @@
+package mpwindowsserversessions
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeWMI map[string]string
+
+func (f fakeWMI) Query(class string, properties []string) ([]map[string]string, error) {
+	output, ok := f[class]
+	if !ok {
+		return nil, errors.New("WMI query of " + class + " failed: HRESULT 0x80041010")
+	}
+	return parseWMICOutput([]byte(output))
+}
+
+func TestParseWMICOutput(t *testing.T) {
+	output := "\r\r\nNode,ServerSessions\r\r\nWIN-SERVER,3\r\r\n"
+	rows, err := parseWMICOutput([]byte(output))
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]string{{"Node": "WIN-SERVER", "ServerSessions": "3"}}, rows)
+}
+
+func TestFetchMetrics(t *testing.T) {
+	wmi := fakeWMI{
+		"Win32_PerfFormattedData_PerfNet_Server": "\r\r\nNode,ServerSessions\r\r\nWIN-SERVER,3\r\r\n",
+		"Win32_ServerConnection": "\r\r\nNode,NumberOfFiles,ShareName,UserName\r\r\n" +
+			"WIN-SERVER,2,share1,alice\r\r\n" +
+			"WIN-SERVER,5,share1,Alice\r\r\n" +
+			"WIN-SERVER,1,share1,bob\r\r\n" +
+			"WIN-SERVER,0,IPC$,bob\r\r\n",
+		"Win32_ServerSession": "\r\r\nNode,NumberOfOpens,UserName\r\r\n" +
+			"WIN-SERVER,7,alice\r\r\n" +
+			"WIN-SERVER,1,bob\r\r\n",
+	}
+	p := WindowsServerSessionsPlugin{wmi: wmi}
+	stat, err := p.FetchMetrics()
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 3, stat["windows.server.sessions.WIN-SERVER.count"])
+	assert.EqualValues(t, 3, stat["windows.server.shares.share1.connections"])
+	assert.EqualValues(t, 2, stat["windows.server.shares.share1.users"])
+	assert.EqualValues(t, 8, stat["windows.server.shares.share1.files"])
+	assert.EqualValues(t, 1, stat["windows.server.shares.IPC_.connections"])
+	assert.EqualValues(t, 0, stat["windows.server.shares.IPC_.files"])
+	assert.EqualValues(t, 2, stat["windows.server.session_users.users"])
+	assert.EqualValues(t, 8, stat["windows.server.session_users.opens"])
+}
+
+func TestFetchMetricsError(t *testing.T) {
+	p := WindowsServerSessionsPlugin{wmi: fakeWMI{}}
+	_, err := p.FetchMetrics()
+	assert.EqualError(t, err, "WMI query of Win32_PerfFormattedData_PerfNet_Server failed: HRESULT 0x80041010")
+
+	// the share and session stats are optional
+	p = WindowsServerSessionsPlugin{wmi: fakeWMI{
+		"Win32_PerfFormattedData_PerfNet_Server": "\r\r\nNode,ServerSessions\r\r\nWIN-SERVER,0\r\r\n",
+	}}
+	stat, err := p.FetchMetrics()
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, stat["windows.server.sessions.WIN-SERVER.count"])
+}
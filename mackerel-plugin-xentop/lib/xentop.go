@@ -2,26 +2,24 @@ package mpxentop
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
-	"os"
+	"io"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
-// index from table headers to array index
-// This is generated dynamically at generateIndex
-var index = map[string]int{}
-
 var graphdef = map[string]mp.Graphs{
 	"xentop.cpu.#": {
 		Label: "Xentop CPU",
 		Unit:  "percentage",
 		Metrics: []mp.Metrics{
-			{Name: "cpu", Label: "cpu", Stacked: true, Diff: true},
+			{Name: "cpu", Label: "cpu", Stacked: true},
 		},
 	},
 	"xentop.memory.#": {
@@ -66,90 +64,148 @@ type XentopPlugin struct {
 	XenVersion int
 }
 
-// FetchMetrics interface for mackerelplugin
-func (m XentopPlugin) FetchMetrics() (map[string]interface{}, error) {
-	stat := make(map[string]interface{})
+// the STATE column follows the NAME column, e.g. --b--- or -----r
+var stateRe = regexp.MustCompile(`^[-rbpscdx]{6}$`)
 
-	var cmd *exec.Cmd
-	if m.XenVersion == 4 {
-		cmd = exec.Command("/bin/sh", "-c", "xentop --batch -i 1 -f")
-	} else {
-		cmd = exec.Command("/bin/sh", "-c", "xentop --batch -i 1")
+var normalizeXenNameRe = regexp.MustCompile(`[^-a-zA-Z0-9_]`)
+
+// domain is a row of xentop keyed by the column header
+type domain struct {
+	name   string
+	values map[string]string
+}
+
+// parseRow splits a row into the name, which may contain spaces, and the other columns.
+// The MAXMEM(k) of Domain-0 is "no limit".
+func parseRow(header []string, line string) (*domain, error) {
+	fields := strings.Fields(line)
+	i := 0
+	for i < len(fields) && !stateRe.MatchString(fields[i]) {
+		i++
+	}
+	if i == 0 || i == len(fields) {
+		return nil, fmt.Errorf("STATE column not found: %q", line)
+	}
+	d := &domain{name: strings.Join(fields[:i], " "), values: make(map[string]string)}
+	columns := fields[i:]
+	for j := 0; j+1 < len(columns); j++ {
+		if columns[j] == "no" && columns[j+1] == "limit" {
+			columns = append(columns[:j+1], columns[j+2:]...)
+			columns[j] = "no limit"
+		}
+	}
+	for j, name := range header[1:] {
+		if j < len(columns) {
+			d.values[name] = columns[j]
+		}
 	}
-	stdout, err := cmd.StdoutPipe()
+	return d, nil
+}
 
+// memoryPercentage returns MEM(k) against MAXMEM(k), or MEM(%) if the domain has no limit
+func memoryPercentage(d *domain) (float64, error) {
+	used, err := strconv.ParseFloat(d.values["MEM(k)"], 64)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return 0, err
 	}
-
-	execErr := cmd.Start()
-	if execErr != nil {
-		fmt.Println(execErr)
-		os.Exit(1)
+	limit, err := strconv.ParseFloat(d.values["MAXMEM(k)"], 64)
+	if err != nil || limit == 0 {
+		return strconv.ParseFloat(d.values["MEM(%)"], 64)
 	}
+	return 100 * used / limit, nil
+}
 
-	dom0 := false
-	scanner := bufio.NewScanner(stdout)
-	hasIndex := false
+// parseXentop parses the batch output of xentop. Only the last sample is used because
+// CPU(%) of the first sample is not measured over an interval.
+func parseXentop(r io.Reader) (map[string]interface{}, error) {
+	var header []string
+	var domains []*domain
+	samples := 0
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		sf := strings.Fields(string(scanner.Text()))
+		line := scanner.Text()
+		sf := strings.Fields(line)
+		if len(sf) == 0 {
+			continue
+		}
 		if sf[0] == "NAME" {
-			generateIndex(sf, index)
-			hasIndex = true
+			header = sf
+			domains = nil
+			samples++
 			continue
 		}
-		if !hasIndex {
+		if header == nil {
 			continue
 		}
-		if stringInSlice("n/a", sf) {
-			changeIndex(&index)
-			dom0 = true
+		d, err := parseRow(header, line)
+		if err != nil {
+			return nil, err
 		}
-		name := normalizeXenName(sf[index["NAME"]])
-
-		var errParse error
-		var tmpval float64 // avoid `stat[*] *= 1000` because of go interface bug
+		domains = append(domains, d)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if samples < 2 {
+		return nil, fmt.Errorf("xentop printed %d samples, expected 2", samples)
+	}
 
-		tmpval, errParse = strconv.ParseFloat(sf[index["CPU(sec)"]], 64)
-		if errParse != nil {
-			return nil, errParse
-		}
-		stat[fmt.Sprintf("xentop.cpu.%s.cpu", name)] = tmpval * 100 / 60
-		stat[fmt.Sprintf("xentop.memory.%s.memory", name)], errParse = strconv.ParseFloat(sf[index["MEM(%)"]], 64)
-		if errParse != nil {
-			return nil, errParse
-		}
-		tmpval, errParse = strconv.ParseFloat(sf[index["NETTX(k)"]], 64)
-		if errParse != nil {
-			return nil, errParse
+	stat := make(map[string]interface{})
+	for _, d := range domains {
+		// the domain being migrated away is renamed to migrating-<name> and
+		// must not be reported under a new name
+		if strings.HasPrefix(d.name, "migrating-") {
+			continue
 		}
-		stat[fmt.Sprintf("xentop.nettx.%s.nettx", name)] = tmpval * 1000
-		tmpval, errParse = strconv.ParseFloat(sf[index["NETRX(k)"]], 64)
-		if errParse != nil {
-			return nil, errParse
+		name := normalizeXenNameRe.ReplaceAllString(d.name, "_")
+
+		cpu, err := strconv.ParseFloat(d.values["CPU(%)"], 64)
+		if err != nil {
+			return nil, err
 		}
-		stat[fmt.Sprintf("xentop.netrx.%s.netrx", name)] = tmpval * 1000
-		stat[fmt.Sprintf("xentop.vbdrd.%s.vbdrd", name)], errParse = strconv.ParseFloat(sf[index["VBD_RD"]], 64)
-		if errParse != nil {
-			return nil, errParse
+		stat[fmt.Sprintf("xentop.cpu.%s.cpu", name)] = cpu
+		memory, err := memoryPercentage(d)
+		if err != nil {
+			return nil, err
 		}
-		stat[fmt.Sprintf("xentop.vbdwr.%s.vbdwr", name)], errParse = strconv.ParseFloat(sf[index["VBD_WR"]], 64)
-		if errParse != nil {
-			return nil, errParse
+		stat[fmt.Sprintf("xentop.memory.%s.memory", name)] = memory
+		for column, key := range map[string]string{
+			"NETTX(k)": "nettx",
+			"NETRX(k)": "netrx",
+		} {
+			v, err := strconv.ParseFloat(d.values[column], 64)
+			if err != nil {
+				return nil, err
+			}
+			stat[fmt.Sprintf("xentop.%s.%s.%s", key, name, key)] = v * 1024
 		}
-		if dom0 {
-			revertIndex(&index)
-			dom0 = false
+		for column, key := range map[string]string{
+			"VBD_RD": "vbdrd",
+			"VBD_WR": "vbdwr",
+		} {
+			v, err := strconv.ParseFloat(d.values[column], 64)
+			if err != nil {
+				return nil, err
+			}
+			stat[fmt.Sprintf("xentop.%s.%s.%s", key, name, key)] = v
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		panic(err)
-	}
-
 	return stat, nil
 }
 
+// FetchMetrics interface for mackerelplugin
+func (m XentopPlugin) FetchMetrics() (map[string]interface{}, error) {
+	args := []string{"-b", "-i", "2", "-d", "1"}
+	if m.XenVersion == 4 {
+		args = append(args, "-f")
+	}
+	out, err := exec.Command("xentop", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("xentop failed: %s", err)
+	}
+	return parseXentop(bytes.NewReader(out))
+}
+
 // GraphDefinition interface for mackerelplugin
 func (m XentopPlugin) GraphDefinition() map[string]mp.Graphs {
 	return graphdef
@@ -173,42 +229,3 @@ func Do() {
 
 	helper.Run()
 }
-
-func normalizeXenName(raw string) string {
-	return strings.Replace(raw, ".", "_", -1)
-}
-
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
-	}
-	return false
-}
-
-func generateIndex(sf []string, index map[string]int) {
-	i := 0
-	for _, column := range sf {
-		index[column] = i
-		i++
-	}
-}
-
-func changeIndex(p *map[string]int) {
-	maxmemPer := (*p)["MAXMEM(%)"]
-	for key, value := range *p {
-		if value >= maxmemPer {
-			(*p)[key]++
-		}
-	}
-}
-
-func revertIndex(p *map[string]int) {
-	maxmemPer := (*p)["MAXMEM(%)"]
-	for key, value := range *p {
-		if value >= maxmemPer {
-			(*p)[key]--
-		}
-	}
-}
@@ -0,0 +1,48 @@
+package mpxentop
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var xentopOutput = `      NAME  STATE   CPU(sec) CPU(%)     MEM(k) MEM(%)  MAXMEM(k) MAXMEM(%) VCPUS NETS NETTX(k) NETRX(k) VBDS   VBD_OO   VBD_RD   VBD_WR  VBD_RSECT  VBD_WSECT SSID
+  Domain-0 -----r       5210    0.0    4194304   25.0   no limit       n/a     4    0        0        0    0        0        0        0          0          0    0
+    web.01 --b---        120    0.0    1048576    6.2    2097152      12.5     2    1      100      200    1        0       10       20        160        320    0
+      NAME  STATE   CPU(sec) CPU(%)     MEM(k) MEM(%)  MAXMEM(k) MAXMEM(%) VCPUS NETS NETTX(k) NETRX(k) VBDS   VBD_OO   VBD_RD   VBD_WR  VBD_RSECT  VBD_WSECT SSID
+  Domain-0 -----r       5211   12.5    4194304   25.0   no limit       n/a     4    0        0        0    0        0        0        0          0          0    0
+    web.01 --b---        121   40.3    1048576    6.2    2097152      12.5     2    1      150      300    1        0       15       25        240        400    0
+    my vm  -----r         30    3.0     524288    3.1     524288       3.1     1    1        1        2    1        0        3        4         48         64    0
+migrating-db --b---        50    1.0     524288    3.1     524288       3.1     1    1        1        2    1        0        3        4         48         64    0
+`
+
+func TestParseXentop(t *testing.T) {
+	stat, err := parseXentop(strings.NewReader(xentopOutput))
+	assert.Nil(t, err)
+
+	assert.EqualValues(t, 12.5, stat["xentop.cpu.Domain-0.cpu"])
+	assert.EqualValues(t, 25.0, stat["xentop.memory.Domain-0.memory"])
+	assert.EqualValues(t, 0, stat["xentop.nettx.Domain-0.nettx"])
+
+	assert.EqualValues(t, 40.3, stat["xentop.cpu.web_01.cpu"])
+	assert.EqualValues(t, 50.0, stat["xentop.memory.web_01.memory"])
+	assert.EqualValues(t, 150*1024, stat["xentop.nettx.web_01.nettx"])
+	assert.EqualValues(t, 300*1024, stat["xentop.netrx.web_01.netrx"])
+	assert.EqualValues(t, 15, stat["xentop.vbdrd.web_01.vbdrd"])
+	assert.EqualValues(t, 25, stat["xentop.vbdwr.web_01.vbdwr"])
+
+	assert.EqualValues(t, 3.0, stat["xentop.cpu.my_vm.cpu"])
+	assert.EqualValues(t, 100.0, stat["xentop.memory.my_vm.memory"])
+
+	for k := range stat {
+		assert.False(t, strings.Contains(k, "migrating"), k)
+	}
+	assert.Len(t, stat, 18)
+}
+
+func TestParseXentopSingleSample(t *testing.T) {
+	lines := strings.SplitN(xentopOutput, "\n", 4)
+	_, err := parseXentop(strings.NewReader(strings.Join(lines[:3], "\n")))
+	assert.NotNil(t, err)
+}
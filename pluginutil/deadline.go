@@ -0,0 +1,99 @@
+package pluginutil
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultMaxExecutionTime is the default of -max-execution-time, which is shorter than
+// the 60 seconds mackerel-agent waits for a plugin so that the plugin can post something.
+const DefaultMaxExecutionTime = 50 * time.Second
+
+// MaxExecutionTimeFlag defines -max-execution-time on fs.
+func MaxExecutionTimeFlag(fs *flag.FlagSet) *time.Duration {
+	return fs.Duration("max-execution-time", DefaultMaxExecutionTime, "Deadline to fetch the metrics, after which the metrics fetched so far are posted (0 for no deadline)")
+}
+
+// WithMaxExecutionTime returns the context whose deadline is d from now,
+// or which is never exceeded if d is not positive.
+func WithMaxExecutionTime(d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
+// DeadlineExceeded returns the error telling the deadline of ctx is exceeded while doing something,
+// e.g. "running INFO", or nil if the deadline is not exceeded yet.
+func DeadlineExceeded(ctx context.Context, doing string) error {
+	// the I/O bounded by SetDeadline may time out just before ctx is done
+	deadline, ok := ctx.Deadline()
+	if !ok || ctx.Err() != context.DeadlineExceeded && time.Now().Before(deadline) {
+		return nil
+	}
+	return fmt.Errorf("deadline exceeded while %s", doing)
+}
+
+// Timeout shortens timeout so as not to exceed the deadline of ctx.
+// It returns the time left if timeout is not positive, or timeout as is if ctx has no deadline.
+func Timeout(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		// zero is no timeout for most of the clients
+		left = time.Millisecond
+	}
+	if timeout <= 0 || left < timeout {
+		return left
+	}
+	return timeout
+}
+
+// SetDeadline bounds the I/O on conn by timeout from now and the deadline of ctx, whichever comes first.
+func SetDeadline(ctx context.Context, conn net.Conn, timeout time.Duration) error {
+	timeout = Timeout(ctx, timeout)
+	if timeout <= 0 {
+		return nil
+	}
+	return conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// DeadlineConn returns conn whose deadlines, set by the client for each I/O, do not exceed the deadline of ctx.
+// It returns conn as is if ctx has no deadline.
+func DeadlineConn(ctx context.Context, conn net.Conn) net.Conn {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, deadline: deadline}
+}
+
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) bound(t time.Time) time.Time {
+	if t.IsZero() || c.deadline.Before(t) {
+		return c.deadline
+	}
+	return t
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.bound(t))
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.bound(t))
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.bound(t))
+}
@@ -0,0 +1,138 @@
+package pluginutil
+
+import (
+	"context"
+	"flag"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxExecutionTimeFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	d := MaxExecutionTimeFlag(fs)
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if *d != DefaultMaxExecutionTime {
+		t.Errorf("-max-execution-time should default to %s: %s", DefaultMaxExecutionTime, *d)
+	}
+	if err := fs.Parse([]string{"-max-execution-time", "10s"}); err != nil {
+		t.Fatal(err)
+	}
+	if *d != 10*time.Second {
+		t.Errorf("-max-execution-time should be 10s: %s", *d)
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	ctx, cancel := WithMaxExecutionTime(0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("zero should be no deadline")
+	}
+	if err := DeadlineExceeded(ctx, "running INFO"); err != nil {
+		t.Errorf("the deadline should not be exceeded: %s", err)
+	}
+	cancel()
+	if err := DeadlineExceeded(ctx, "running INFO"); err != nil {
+		t.Errorf("the cancellation is not the deadline: %s", err)
+	}
+
+	ctx, cancel = WithMaxExecutionTime(time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	err := DeadlineExceeded(ctx, "running INFO")
+	if err == nil || err.Error() != "deadline exceeded while running INFO" {
+		t.Errorf("the error should tell what was being done: %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	if d := Timeout(context.Background(), 5*time.Second); d != 5*time.Second {
+		t.Errorf("timeout should be kept without deadline: %s", d)
+	}
+	if d := Timeout(context.Background(), 0); d != 0 {
+		t.Errorf("no timeout should be kept without deadline: %s", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if d := Timeout(ctx, 5*time.Second); d > time.Second {
+		t.Errorf("timeout should be shortened to the deadline: %s", d)
+	}
+	if d := Timeout(ctx, 0); d <= 0 || d > time.Second {
+		t.Errorf("no timeout should be the time left: %s", d)
+	}
+	if d := Timeout(ctx, 10*time.Millisecond); d != 10*time.Millisecond {
+		t.Errorf("shorter timeout should be kept: %s", d)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if d := Timeout(expired, 5*time.Second); d <= 0 {
+		t.Errorf("timeout should stay positive after the deadline: %s", d)
+	}
+}
+
+func TestSetDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := SetDeadline(ctx, conn, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("read should time out: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read should time out at the deadline of the context: %s", elapsed)
+	}
+}
+
+func TestDeadlineConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if conn := DeadlineConn(context.Background(), c); conn != c {
+		t.Errorf("the connection should be returned as is without the deadline")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	conn := DeadlineConn(ctx, c)
+	// the client clears the deadline or sets a longer one
+	for _, deadline := range []time.Time{{}, time.Now().Add(5 * time.Second)} {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("read should time out: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("read should time out at the deadline of the context: %s", elapsed)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package pluginutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mackerelio/golib/logging"
+)
+
+// LogFormatEnv is the environment variable choosing the format of the logs.
+// With "json", each log line is a JSON object; otherwise the logs are written as before.
+const LogFormatEnv = "MACKEREL_PLUGIN_LOG_FORMAT"
+
+// LogFields are the fields added to the JSON logs, e.g. the host and the port of the target.
+type LogFields map[string]interface{}
+
+type leveledLogger interface {
+	Criticalf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+}
+
+// stdLogger writes the text logs with the standard log package, for the plugins which have logged with it
+type stdLogger struct{}
+
+func (stdLogger) Criticalf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{})    { log.Printf(format, args...) }
+func (stdLogger) Warningf(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})     { log.Printf(format, args...) }
+func (stdLogger) Debugf(format string, args ...interface{})    { log.Printf(format, args...) }
+
+// Logger writes the logs of the plugin in text as before, or as JSON objects with MACKEREL_PLUGIN_LOG_FORMAT=json.
+type Logger struct {
+	text   leveledLogger
+	json   io.Writer // nil for the text format
+	plugin string
+	fields LogFields
+}
+
+// jsonMu serializes the JSON logs written from goroutines
+var jsonMu sync.Mutex
+
+// NewLogger returns the logger writing the text logs with golib/logging, tagged metrics.plugin.<plugin>.
+func NewLogger(plugin string) *Logger {
+	return newLogger(logging.GetLogger("metrics.plugin."+plugin), plugin)
+}
+
+// NewStdLogger returns the logger writing the text logs with the standard log package.
+func NewStdLogger(plugin string) *Logger {
+	return newLogger(stdLogger{}, plugin)
+}
+
+func newLogger(text leveledLogger, plugin string) *Logger {
+	l := &Logger{text: text, plugin: plugin}
+	if os.Getenv(LogFormatEnv) == "json" {
+		l.json = os.Stderr
+	}
+	return l
+}
+
+// With returns the logger adding fields to the JSON logs. The text logs are not changed.
+func (l *Logger) With(fields LogFields) *Logger {
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	c := *l
+	c.fields = merged
+	return &c
+}
+
+// Criticalf logs at CRITICAL level
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.text.Criticalf(format, args...)
+		return
+	}
+	l.writeJSON("CRITICAL", format, args)
+}
+
+// Fatalf logs at CRITICAL level and exits with 1
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.Criticalf(format, args...)
+	os.Exit(1)
+}
+
+// Errorf logs at ERROR level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.text.Errorf(format, args...)
+		return
+	}
+	l.writeJSON("ERROR", format, args)
+}
+
+// Warningf logs at WARNING level
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.text.Warningf(format, args...)
+		return
+	}
+	l.writeJSON("WARNING", format, args)
+}
+
+// Infof logs at INFO level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if l.json == nil {
+		l.text.Infof(format, args...)
+		return
+	}
+	l.writeJSON("INFO", format, args)
+}
+
+// Debugf logs at DEBUG level only in the text format, whose level is controlled by golib/logging
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.json == nil {
+		l.text.Debugf(format, args...)
+	}
+}
+
+// writeJSON writes the log line with the fields, and the type of the error in args as error_class
+func (l *Logger) writeJSON(level, format string, args []interface{}) {
+	entry := make(map[string]interface{}, len(l.fields)+5)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			entry["error_class"] = fmt.Sprintf("%T", err)
+			break
+		}
+	}
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["level"] = level
+	entry["plugin"] = l.plugin
+	entry["message"] = fmt.Sprintf(format, args...)
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// the fields which cannot be marshaled are dropped
+		b, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": level, "plugin": l.plugin, "message": entry["message"]})
+	}
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	l.json.Write(append(b, '\n'))
+}
@@ -0,0 +1,86 @@
+package pluginutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) add(format string) { r.lines = append(r.lines, format) }
+
+func (r *recordingLogger) Criticalf(format string, args ...interface{}) { r.add(format) }
+func (r *recordingLogger) Errorf(format string, args ...interface{})    { r.add(format) }
+func (r *recordingLogger) Warningf(format string, args ...interface{})  { r.add(format) }
+func (r *recordingLogger) Infof(format string, args ...interface{})     { r.add(format) }
+func (r *recordingLogger) Debugf(format string, args ...interface{})    { r.add(format) }
+
+func TestLoggerText(t *testing.T) {
+	os.Unsetenv(LogFormatEnv)
+	text := &recordingLogger{}
+	l := newLogger(text, "redis")
+	l.With(LogFields{"host": "localhost"}).Errorf("Failed to connect redis. %s", errors.New("refused"))
+	if len(text.lines) != 1 || text.lines[0] != "Failed to connect redis. %s" {
+		t.Errorf("the text logs should be written as before: %v", text.lines)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	os.Setenv(LogFormatEnv, "json")
+	defer os.Unsetenv(LogFormatEnv)
+	text := &recordingLogger{}
+	l := newLogger(text, "redis")
+	var buf bytes.Buffer
+	l.json = &buf
+
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	target := l.With(LogFields{"host": "localhost", "port": "6379"})
+	target.Errorf("Failed to connect redis. %s", err)
+	l.Warningf("Failed to parse db %s", "keys")
+	l.Debugf("not written")
+
+	if len(text.lines) != 0 {
+		t.Errorf("the text logs should not be written with %s=json: %v", LogFormatEnv, text.lines)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("a line should be written per log: %q", buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"level":       "ERROR",
+		"plugin":      "redis",
+		"message":     "Failed to connect redis. dial tcp: connection refused",
+		"host":        "localhost",
+		"port":        "6379",
+		"error_class": "*net.OpError",
+	} {
+		if entry[k] != v {
+			t.Errorf("%s should be %q: %v", k, v, entry[k])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("time should be written")
+	}
+
+	entry = nil
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry["host"]; ok {
+		t.Errorf("With should not add the fields to the parent logger")
+	}
+	if _, ok := entry["error_class"]; ok {
+		t.Errorf("error_class should not be written without an error")
+	}
+}
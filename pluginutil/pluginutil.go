@@ -0,0 +1,28 @@
+// Package pluginutil provides the helpers shared by the plugins.
+package pluginutil
+
+import (
+	"crypto/md5"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+// TempfileBasename returns the basename of the default tempfile of the plugin for the target
+// given by ids, e.g. the host, the port, the socket or the URI. The instances of the plugin
+// monitoring different targets do not share the values of Diff metrics.
+func TempfileBasename(plugin string, ids ...string) string {
+	sum := md5.Sum([]byte(strings.Join(ids, "\n")))
+	return fmt.Sprintf("mackerel-plugin-%s-%x", plugin, sum)
+}
+
+// Tempfile returns tempfile given by the -tempfile option if it is not empty, or the default
+// tempfile of the plugin for the target given by ids in the work directory of the plugins.
+func Tempfile(tempfile, plugin string, ids ...string) string {
+	if tempfile != "" {
+		return tempfile
+	}
+	return filepath.Join(pluginutil.PluginWorkDir(), TempfileBasename(plugin, ids...))
+}
@@ -0,0 +1,45 @@
+package pluginutil
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+func TestTempfileBasename(t *testing.T) {
+	base := TempfileBasename("redis", "localhost", "6379", "")
+	if !strings.HasPrefix(base, "mackerel-plugin-redis-") {
+		t.Errorf("basename should start with mackerel-plugin-redis-: %s", base)
+	}
+	if base != TempfileBasename("redis", "localhost", "6379", "") {
+		t.Errorf("basename should be stable for the same target")
+	}
+	for _, ids := range [][]string{
+		{"localhost", "6380", ""},
+		{"127.0.0.1", "6379", ""},
+		{"", "", "/tmp/redis.sock"},
+		{"localhost6", "379", ""},
+	} {
+		if other := TempfileBasename("redis", ids...); other == base {
+			t.Errorf("basename of %v should differ from localhost:6379: %s", ids, other)
+		}
+	}
+	if TempfileBasename("memcached", "localhost", "6379", "") == base {
+		t.Errorf("basename should differ between the plugins")
+	}
+}
+
+func TestTempfile(t *testing.T) {
+	if f := Tempfile("/tmp/redis.json", "redis", "localhost", "6379", ""); f != "/tmp/redis.json" {
+		t.Errorf("tempfile given by -tempfile should be used: %s", f)
+	}
+	f := Tempfile("", "redis", "localhost", "6379", "")
+	if filepath.Base(f) != TempfileBasename("redis", "localhost", "6379", "") {
+		t.Errorf("default tempfile should be named by TempfileBasename: %s", f)
+	}
+	if filepath.Dir(f) != pluginutil.PluginWorkDir() {
+		t.Errorf("default tempfile should be in the work directory of the plugins: %s", f)
+	}
+}